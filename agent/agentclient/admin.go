@@ -0,0 +1,142 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// ErrTorrentNotFound is returned by admin operations on torrents which the
+// agent scheduler does not have.
+var ErrTorrentNotFound = errors.New("torrent not found")
+
+// AddTorrent downloads the blob of d into the agent, blocking until the
+// download completes or timeout elapses.
+func (c *HTTPClient) AddTorrent(namespace string, d core.Digest, timeout time.Duration) error {
+	_, err := httputil.Post(
+		fmt.Sprintf(
+			"http://%s/x/namespace/%s/blobs/%s/add",
+			c.addr, url.PathEscape(namespace), d),
+		httputil.SendTimeout(timeout))
+	return torrentError(err)
+}
+
+// Torrents returns the progress of every torrent of the agent scheduler.
+func (c *HTTPClient) Torrents() ([]*scheduler.Progress, error) {
+	var torrents []*scheduler.Progress
+	if err := c.getJSON("/x/torrents", &torrents); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// TorrentProgress returns the progress of the torrent of h.
+func (c *HTTPClient) TorrentProgress(h core.InfoHash) (*scheduler.Progress, error) {
+	var p scheduler.Progress
+	if err := c.getJSON("/x/torrents/"+h.Hex(), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CancelTorrent cancels the in-progress torrent of h, failing all of its
+// waiting downloads.
+func (c *HTTPClient) CancelTorrent(h core.InfoHash) error {
+	_, err := httputil.Delete(fmt.Sprintf("http://%s/x/torrents/%s", c.addr, h.Hex()))
+	return torrentError(err)
+}
+
+// RemoveTorrent stops leeching / seeding the torrent of d, and removes it from
+// the agent's disk.
+func (c *HTTPClient) RemoveTorrent(d core.Digest) error {
+	_, err := httputil.Delete(fmt.Sprintf("http://%s/blobs/%s", c.addr, d))
+	return err
+}
+
+// PauseTorrent stops the torrent of h from requesting pieces.
+func (c *HTTPClient) PauseTorrent(h core.InfoHash) error {
+	return c.postTorrent(h, "pause")
+}
+
+// ResumeTorrent resumes the paused torrent of h.
+func (c *HTTPClient) ResumeTorrent(h core.InfoHash) error {
+	return c.postTorrent(h, "resume")
+}
+
+// AnnounceTorrent announces the torrent of h to the tracker immediately.
+func (c *HTTPClient) AnnounceTorrent(h core.InfoHash) error {
+	return c.postTorrent(h, "announce")
+}
+
+// TorrentPeers returns the peers connected to the torrent of h.
+func (c *HTTPClient) TorrentPeers(h core.InfoHash) ([]*scheduler.TorrentPeer, error) {
+	var peers []*scheduler.TorrentPeer
+	if err := c.getJSON(fmt.Sprintf("/x/torrents/%s/peers", h.Hex()), &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Blacklist returns the blacklisted conns of the agent scheduler.
+func (c *HTTPClient) Blacklist() ([]connstate.BlacklistedConn, error) {
+	var blacklist []connstate.BlacklistedConn
+	if err := c.getJSON("/x/blacklist", &blacklist); err != nil {
+		return nil, err
+	}
+	return blacklist, nil
+}
+
+// SupportBundle returns the gzipped support bundle of the agent. Callers
+// should close the returned ReadCloser when done reading the bundle.
+func (c *HTTPClient) SupportBundle() (io.ReadCloser, error) {
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/support_bundle", c.addr))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *HTTPClient) postTorrent(h core.InfoHash, action string) error {
+	_, err := httputil.Post(fmt.Sprintf("http://%s/x/torrents/%s/%s", c.addr, h.Hex(), action))
+	return torrentError(err)
+}
+
+func (c *HTTPClient) getJSON(path string, v interface{}) error {
+	resp, err := httputil.Get(fmt.Sprintf("http://%s%s", c.addr, path))
+	if err != nil {
+		return torrentError(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("json decode: %s", err)
+	}
+	return nil
+}
+
+func torrentError(err error) error {
+	if httputil.IsNotFound(err) {
+		return ErrTorrentNotFound
+	}
+	return err
+}
@@ -14,12 +14,17 @@
 package agentserver
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	_ "net/http/pprof" // Registers /debug/pprof endpoints in http.DefaultServeMux.
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pressly/chi"
 	"github.com/uber-go/tally"
@@ -28,9 +33,15 @@ import (
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/middleware"
 	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/fallback"
 	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
 	"github.com/uber/kraken/utils/handler"
 	"github.com/uber/kraken/utils/httputil"
+
+	"go.uber.org/zap/zapcore"
 )
 
 // Config defines Server configuration.
@@ -38,11 +49,21 @@ type Config struct{}
 
 // Server defines the agent HTTP server.
 type Server struct {
-	config Config
-	stats  tally.Scope
-	cads   *store.CADownloadStore
-	sched  scheduler.ReloadableScheduler
-	tags   tagclient.Client
+	config   Config
+	stats    tally.Scope
+	cads     *store.CADownloadStore
+	sched    scheduler.ReloadableScheduler
+	tags     tagclient.Client
+	fallback fallback.Reader
+}
+
+// Option allows setting optional Server parameters.
+type Option func(*Server)
+
+// WithFallback configures a Server to add torrents with a deadline along with
+// r, which missing pieces are fetched from if the deadline is at risk.
+func WithFallback(r fallback.Reader) Option {
+	return func(s *Server) { s.fallback = r }
 }
 
 // New creates a new Server.
@@ -51,12 +72,23 @@ func New(
 	stats tally.Scope,
 	cads *store.CADownloadStore,
 	sched scheduler.ReloadableScheduler,
-	tags tagclient.Client) *Server {
+	tags tagclient.Client,
+	opts ...Option) *Server {
 
 	stats = stats.Tagged(map[string]string{
 		"module": "agentserver",
 	})
-	return &Server{config, stats, cads, sched, tags}
+	s := &Server{
+		config: config,
+		stats:  stats,
+		cads:   cads,
+		sched:  sched,
+		tags:   tags,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Handler returns the HTTP handler.
@@ -77,8 +109,56 @@ func (s *Server) Handler() http.Handler {
 	// Dangerous endpoint for running experiments.
 	r.Patch("/x/config/scheduler", handler.Wrap(s.patchSchedulerConfigHandler))
 
+	// Registers a blob from an existing file on the agent host, e.g. for
+	// prepopulating images at bake time.
+	r.Post("/x/namespace/{namespace}/blobs/{digest}/attach", handler.Wrap(s.attachBlobHandler))
+
+	// Writes a blob streamed in the request body, seeding its pieces as soon
+	// as they are written.
+	r.Put("/x/namespace/{namespace}/blobs/{digest}/ingest", handler.Wrap(s.ingestBlobHandler))
+
+	// Migrates a complete blob to a new piece length, while peers which still
+	// use the previous metainfo are served for a transition window.
+	r.Post("/x/blobs/{digest}/rechunk", handler.Wrap(s.rechunkBlobHandler))
+
 	r.Get("/x/blacklist", handler.Wrap(s.getBlacklistHandler))
 
+	// Dumps the most recently applied scheduler events.
+	r.Get("/x/events", handler.Wrap(s.getRecentEventsHandler))
+
+	// Administers the torrents of the scheduler, e.g. via kraken-sched.
+	r.Post("/x/namespace/{namespace}/blobs/{digest}/add", handler.Wrap(s.addTorrentHandler))
+	r.Get("/x/torrents", handler.Wrap(s.getTorrentsHandler))
+	r.Get("/x/torrents/{infohash}", handler.Wrap(s.getTorrentHandler))
+	r.Delete("/x/torrents/{infohash}", handler.Wrap(s.cancelTorrentHandler))
+	r.Post("/x/torrents/{infohash}/pause", handler.Wrap(s.pauseTorrentHandler))
+	r.Post("/x/torrents/{infohash}/resume", handler.Wrap(s.resumeTorrentHandler))
+	r.Get("/x/torrents/{infohash}/peers", handler.Wrap(s.getTorrentPeersHandler))
+	r.Post("/x/torrents/{infohash}/announce", handler.Wrap(s.announceTorrentHandler))
+
+	r.Get("/x/timelines", handler.Wrap(s.getTimelinesHandler))
+	r.Get("/x/timelines/{digest}", handler.Wrap(s.getDigestTimelinesHandler))
+
+	r.Get("/x/provenance/{digest}", handler.Wrap(s.getProvenanceHandler))
+
+	// Serves the seeded torrents of the agent, which trackers pull to reconcile
+	// their peer stores and neighbors pull to warm up.
+	r.Get("/x/seeded", handler.Wrap(s.getSeededExportHandler))
+
+	r.Get("/x/support_bundle", handler.Wrap(s.getSupportBundleHandler))
+
+	// Overrides the log level of a single torrent for targeted debugging.
+	r.Put("/x/loglevel/{digest}", handler.Wrap(s.putTorrentLogLevelHandler))
+	r.Delete("/x/loglevel/{digest}", handler.Wrap(s.deleteTorrentLogLevelHandler))
+
+	// Traces all events, messages and storage operations of a single torrent
+	// to a dedicated file for a bounded duration.
+	r.Put("/x/trace/{infohash}", handler.Wrap(s.putTorrentTraceHandler))
+	r.Delete("/x/trace/{infohash}", handler.Wrap(s.deleteTorrentTraceHandler))
+
+	// Dumps a read-only snapshot of scheduler state.
+	r.Get("/debug/scheduler", handler.Wrap(s.getSchedulerIntrospectionHandler))
+
 	// Serves /debug/pprof endpoints.
 	r.Mount("/", http.DefaultServeMux)
 
@@ -102,7 +182,11 @@ func (s *Server) getTagHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// downloadBlobHandler downloads a blob through p2p.
+// downloadBlobHandler downloads a blob through p2p. The optional, repeated
+// query arg metadata attaches "key:value" metadata to the torrent. The optional
+// query arg deadline is as in addTorrentHandler. Missing pieces may be fetched
+// from the fallback reader of s once the torrent is at risk of missing its
+// deadline.
 func (s *Server) downloadBlobHandler(w http.ResponseWriter, r *http.Request) error {
 	namespace, err := httputil.ParseParam(r, "namespace")
 	if err != nil {
@@ -112,10 +196,28 @@ func (s *Server) downloadBlobHandler(w http.ResponseWriter, r *http.Request) err
 	if err != nil {
 		return err
 	}
+	md, err := parseMetadata(r)
+	if err != nil {
+		return err
+	}
+	deadline, err := parseDeadline(r)
+	if err != nil {
+		return err
+	}
 	f, err := s.cads.Cache().GetFileReader(d.Hex())
 	if err != nil {
 		if os.IsNotExist(err) || s.cads.InDownloadError(err) {
-			if err := s.sched.Download(namespace, d); err != nil {
+			opts := []scheduler.TorrentOption{scheduler.WithNamespace(namespace)}
+			if len(md) > 0 {
+				opts = append(opts, scheduler.WithMetadata(md))
+			}
+			if !deadline.IsZero() {
+				opts = append(opts, scheduler.WithDeadline(deadline))
+			}
+			if s.fallback != nil {
+				opts = append(opts, scheduler.WithFallback(s.fallback))
+			}
+			if err := s.sched.AddTorrentWithOptions(r.Context(), d, opts...); err != nil {
 				if err == scheduler.ErrTorrentNotFound {
 					return handler.ErrorStatus(http.StatusNotFound)
 				}
@@ -135,6 +237,94 @@ func (s *Server) downloadBlobHandler(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
+// attachBlobHandler seeds a blob from an existing file on the agent host,
+// without copying it into the cache.
+func (s *Server) attachBlobHandler(w http.ResponseWriter, r *http.Request) error {
+	namespace, err := httputil.ParseParam(r, "namespace")
+	if err != nil {
+		return err
+	}
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	path := r.URL.Query().Get("path")
+	if !filepath.IsAbs(path) {
+		return handler.Errorf("query arg path must be an absolute path").Status(http.StatusBadRequest)
+	}
+	if err := s.sched.AttachTorrent(namespace, d, path); err != nil {
+		if err == scheduler.ErrTorrentNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("attach torrent: %s", err)
+	}
+	return nil
+}
+
+// ingestBlobHandler writes the blob of digest from the request body. Pieces are
+// seeded while the body is still being received. Returns once the whole body
+// is ingested.
+func (s *Server) ingestBlobHandler(w http.ResponseWriter, r *http.Request) error {
+	namespace, err := httputil.ParseParam(r, "namespace")
+	if err != nil {
+		return err
+	}
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.Ingest(namespace, d, r.Body); err != nil {
+		if err == scheduler.ErrTorrentNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("ingest torrent: %s", err)
+	}
+	return nil
+}
+
+// rechunkBlobHandler replaces the metainfo of a complete blob with metainfo of
+// the piece_length query arg. The previous metainfo is still served and
+// announced for the duration of the window query arg, which defaults to 24h.
+// Blobs held by the scheduler are rejected with 409.
+func (s *Server) rechunkBlobHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	pieceLength, err := strconv.ParseInt(r.URL.Query().Get("piece_length"), 10, 64)
+	if err != nil || pieceLength <= 0 {
+		return handler.Errorf(
+			"query arg piece_length must be a positive integer").Status(http.StatusBadRequest)
+	}
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		window, err = time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return handler.Errorf(
+				"query arg window must be a positive duration").Status(http.StatusBadRequest)
+		}
+	}
+	mi, err := s.sched.Rechunk(d, pieceLength, window)
+	if err != nil {
+		switch err {
+		case agentstorage.ErrRechunkIncomplete:
+			return handler.Errorf("%s", err).Status(http.StatusNotFound)
+		case agentstorage.ErrRechunkSamePieceLength:
+			return handler.Errorf("%s", err).Status(http.StatusBadRequest)
+		case scheduler.ErrRechunkTorrentHeld, scheduler.ErrTorrentRechunking:
+			return handler.Errorf("%s", err).Status(http.StatusConflict)
+		}
+		return handler.Errorf("rechunk: %s", err)
+	}
+	b, err := mi.Serialize()
+	if err != nil {
+		return handler.Errorf("serialize metainfo: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
 func (s *Server) deleteBlobHandler(w http.ResponseWriter, r *http.Request) error {
 	d, err := parseDigest(r)
 	if err != nil {
@@ -177,6 +367,372 @@ func (s *Server) getBlacklistHandler(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
+func (s *Server) getSchedulerIntrospectionHandler(w http.ResponseWriter, r *http.Request) error {
+	in, err := s.sched.Introspect()
+	if err != nil {
+		return handler.Errorf("introspect scheduler: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(in); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) getRecentEventsHandler(w http.ResponseWriter, r *http.Request) error {
+	events := s.sched.RecentEvents()
+	if err := json.NewEncoder(w).Encode(&events); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// addTorrentHandler downloads the blob of digest into the agent without
+// serving it, and returns once the download completes. The torrent is removed
+// if the request is cancelled before then. The optional query arg deadline is
+// the duration the download must complete within, e.g. "5m", in which case the
+// download may fall back to the fallback reader of s. Metadata is attached as
+// in downloadBlobHandler.
+func (s *Server) addTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	namespace, err := httputil.ParseParam(r, "namespace")
+	if err != nil {
+		return err
+	}
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	md, err := parseMetadata(r)
+	if err != nil {
+		return err
+	}
+	opts := []scheduler.TorrentOption{
+		scheduler.WithNamespace(namespace), scheduler.WithCaller("admin"),
+	}
+	if len(md) > 0 {
+		opts = append(opts, scheduler.WithMetadata(md))
+	}
+	deadline, err := parseDeadline(r)
+	if err != nil {
+		return err
+	}
+	if !deadline.IsZero() {
+		opts = append(opts, scheduler.WithDeadline(deadline))
+		if s.fallback != nil {
+			opts = append(opts, scheduler.WithFallback(s.fallback))
+		}
+	}
+	err = s.sched.AddTorrentWithOptions(r.Context(), d, opts...)
+	if err != nil {
+		if err == scheduler.ErrTorrentNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("add torrent: %s", err)
+	}
+	return nil
+}
+
+// getTorrentsHandler returns the progress of every torrent of the scheduler.
+func (s *Server) getTorrentsHandler(w http.ResponseWriter, r *http.Request) error {
+	torrents, err := s.sched.Torrents()
+	if err != nil {
+		return handler.Errorf("torrents: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(&torrents); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// getTorrentHandler returns the progress of the torrent of infohash.
+func (s *Server) getTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	p, err := s.sched.Progress(h)
+	if err != nil {
+		return torrentError("progress", err)
+	}
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// cancelTorrentHandler cancels the torrent of infohash, failing all of its
+// waiting downloads.
+func (s *Server) cancelTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.CancelTorrent(h); err != nil {
+		return torrentError("cancel torrent", err)
+	}
+	return nil
+}
+
+// pauseTorrentHandler stops the torrent of infohash from requesting pieces.
+func (s *Server) pauseTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.PauseTorrent(h); err != nil {
+		return torrentError("pause torrent", err)
+	}
+	return nil
+}
+
+// resumeTorrentHandler resumes the paused torrent of infohash.
+func (s *Server) resumeTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.ResumeTorrent(h); err != nil {
+		return torrentError("resume torrent", err)
+	}
+	return nil
+}
+
+// getTorrentPeersHandler returns the peers connected to the torrent of
+// infohash.
+func (s *Server) getTorrentPeersHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	peers, err := s.sched.TorrentPeers(h)
+	if err != nil {
+		return torrentError("torrent peers", err)
+	}
+	if err := json.NewEncoder(w).Encode(&peers); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// announceTorrentHandler announces the torrent of infohash to the tracker
+// immediately, rather than waiting for its turn in the announce queue.
+func (s *Server) announceTorrentHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.Announce(h); err != nil {
+		return torrentError("announce", err)
+	}
+	return nil
+}
+
+// getTimelinesHandler returns the event timelines of in-progress and recently
+// finished torrents.
+func (s *Server) getTimelinesHandler(w http.ResponseWriter, r *http.Request) error {
+	return encodeTimelines(w, s.sched.TorrentTimelines())
+}
+
+// getDigestTimelinesHandler returns the event timelines of in-progress and
+// recently finished torrents for a single digest.
+func (s *Server) getDigestTimelinesHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	timelines := []timeline.Timeline{}
+	for _, t := range s.sched.TorrentTimelines() {
+		if t.Digest == d {
+			timelines = append(timelines, t)
+		}
+	}
+	return encodeTimelines(w, timelines)
+}
+
+// getProvenanceHandler returns which peer supplied each piece of a completed
+// torrent, and when.
+func (s *Server) getProvenanceHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	record, err := s.sched.PieceProvenance(d)
+	if err != nil {
+		if err == provenance.ErrNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("piece provenance: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(&record); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// putTorrentLogLevelHandler overrides the log level of the torrent of digest
+// to the level query arg.
+func (s *Server) putTorrentLogLevelHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+		return handler.Errorf("parse level: %s", err).Status(http.StatusBadRequest)
+	}
+	if err := s.sched.SetTorrentLogLevel(d, level); err != nil {
+		if err == scheduler.ErrTooManyTorrentLogLevels {
+			return handler.Errorf("%s", err).Status(http.StatusConflict)
+		}
+		return handler.Errorf("set torrent log level: %s", err)
+	}
+	return nil
+}
+
+// deleteTorrentLogLevelHandler removes the log level override of the torrent
+// of digest.
+func (s *Server) deleteTorrentLogLevelHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	s.sched.ClearTorrentLogLevel(d)
+	return nil
+}
+
+// putTorrentTraceHandler traces the torrent of infohash for the duration query
+// arg, if set, else for the max trace duration. Returns the path of the trace
+// file.
+func (s *Server) putTorrentTraceHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	var d time.Duration
+	if raw := r.URL.Query().Get("duration"); raw != "" {
+		d, err = time.ParseDuration(raw)
+		if err != nil {
+			return handler.Errorf("parse duration: %s", err).Status(http.StatusBadRequest)
+		}
+	}
+	path, err := s.sched.StartTrace(h, d)
+	if err != nil {
+		switch err {
+		case scheduler.ErrTracingDisabled:
+			return handler.Errorf("%s", err).Status(http.StatusNotImplemented)
+		case scheduler.ErrTooManyTraces:
+			return handler.Errorf("%s", err).Status(http.StatusConflict)
+		}
+		return handler.Errorf("start trace: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]string{"path": path}); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// deleteTorrentTraceHandler stops the trace of the torrent of infohash.
+func (s *Server) deleteTorrentTraceHandler(w http.ResponseWriter, r *http.Request) error {
+	h, err := parseInfoHash(r)
+	if err != nil {
+		return err
+	}
+	if err := s.sched.StopTrace(h); err != nil {
+		if err == scheduler.ErrTraceNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("stop trace: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) getSeededExportHandler(w http.ResponseWriter, r *http.Request) error {
+	export, err := s.sched.SeededExport()
+	if err != nil {
+		return handler.Errorf("seeded export: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// getSupportBundleHandler returns a gzipped tarball of scheduler diagnostics.
+// The bundle is buffered, such that failures are reported as errors rather
+// than truncated bundles.
+func (s *Server) getSupportBundleHandler(w http.ResponseWriter, r *http.Request) error {
+	var b bytes.Buffer
+	if err := s.sched.SupportBundle(&b); err != nil {
+		return handler.Errorf("support bundle: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="kraken-agent-support.tar.gz"`)
+	if _, err := io.Copy(w, &b); err != nil {
+		return handler.Errorf("copy: %s", err)
+	}
+	return nil
+}
+
+func encodeTimelines(w http.ResponseWriter, timelines []timeline.Timeline) error {
+	if err := json.NewEncoder(w).Encode(&timelines); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+func parseInfoHash(r *http.Request) (core.InfoHash, error) {
+	raw, err := httputil.ParseParam(r, "infohash")
+	if err != nil {
+		return core.InfoHash{}, err
+	}
+	h, err := core.NewInfoHashFromHex(raw)
+	if err != nil {
+		return core.InfoHash{}, handler.Errorf("parse infohash: %s", err).Status(http.StatusBadRequest)
+	}
+	return h, nil
+}
+
+// torrentError maps ErrTorrentNotFound to 404, and wraps all other errors of
+// op.
+func torrentError(op string, err error) error {
+	if err == scheduler.ErrTorrentNotFound {
+		return handler.ErrorStatus(http.StatusNotFound)
+	}
+	return handler.Errorf("%s: %s", op, err)
+}
+
+// parseMetadata parses the "key:value" pairs of the metadata query args of r.
+func parseMetadata(r *http.Request) (map[string]string, error) {
+	raw := r.URL.Query()["metadata"]
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	md := make(map[string]string, len(raw))
+	for _, kv := range raw {
+		parts := strings.SplitN(kv, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, handler.Errorf(
+				"query arg metadata must be of the form key:value").Status(http.StatusBadRequest)
+		}
+		md[parts[0]] = parts[1]
+	}
+	return md, nil
+}
+
+// parseDeadline parses the optional deadline query arg of r, the duration a
+// download must complete within. Returns the zero time if r has no deadline.
+func parseDeadline(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("deadline")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	deadline, err := time.ParseDuration(v)
+	if err != nil || deadline <= 0 {
+		return time.Time{}, handler.Errorf(
+			"query arg deadline must be a positive duration").Status(http.StatusBadRequest)
+	}
+	return time.Now().Add(deadline), nil
+}
+
 func parseDigest(r *http.Request) (core.Digest, error) {
 	raw, err := httputil.ParseParam(r, "digest")
 	if err != nil {
@@ -15,10 +15,14 @@ package agentserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
@@ -30,12 +34,21 @@ import (
 	"github.com/uber/kraken/build-index/tagclient"
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/fallback"
 	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
+	"github.com/uber/kraken/lib/torrent/scheduler/warmup"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
 	mocktagclient "github.com/uber/kraken/mocks/build-index/tagclient"
 	mockscheduler "github.com/uber/kraken/mocks/lib/torrent/scheduler"
+	"github.com/uber/kraken/tracker/reconcile"
 	"github.com/uber/kraken/utils/httputil"
 	"github.com/uber/kraken/utils/testutil"
+
+	"go.uber.org/zap/zapcore"
 )
 
 type serverMocks struct {
@@ -61,8 +74,8 @@ func newServerMocks(t *testing.T) (*serverMocks, func()) {
 	return &serverMocks{cads, sched, tags, &cleanup}, cleanup.Run
 }
 
-func (m *serverMocks) startServer() string {
-	s := New(Config{}, tally.NoopScope, m.cads, m.sched, m.tags)
+func (m *serverMocks) startServer(opts ...Option) string {
+	s := New(Config{}, tally.NoopScope, m.cads, m.sched, m.tags, opts...)
 	addr, stop := testutil.StartServer(s.Handler())
 	m.cleanup.Add(stop)
 	return addr
@@ -112,8 +125,8 @@ func TestDownload(t *testing.T) {
 	namespace := core.TagFixture()
 	blob := core.NewBlobFixture()
 
-	mocks.sched.EXPECT().Download(namespace, blob.Digest).DoAndReturn(
-		func(namespace string, d core.Digest) error {
+	mocks.sched.EXPECT().AddTorrentWithOptions(gomock.Any(), blob.Digest, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, d core.Digest, opts ...scheduler.TorrentOption) error {
 			return store.RunDownload(mocks.cads, d, blob.Content)
 		})
 
@@ -127,6 +140,66 @@ func TestDownload(t *testing.T) {
 	require.Equal(string(blob.Content), string(result))
 }
 
+func TestDownloadWithMetadata(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	blob := core.NewBlobFixture()
+
+	// Adds the namespace and metadata options.
+	mocks.sched.EXPECT().AddTorrentWithOptions(
+		gomock.Any(), blob.Digest, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, d core.Digest, opts ...scheduler.TorrentOption) error {
+			return store.RunDownload(mocks.cads, d, blob.Content)
+		})
+
+	addr := mocks.startServer()
+
+	_, err := httputil.Get(fmt.Sprintf(
+		"http://%s/namespace/%s/blobs/%s?metadata=image:foo/bar&metadata=team:infra",
+		addr, url.PathEscape(namespace), blob.Digest))
+	require.NoError(err)
+
+	for _, md := range []string{"image", ":foo"} {
+		_, err := httputil.Get(fmt.Sprintf(
+			"http://%s/namespace/%s/blobs/%s?metadata=%s",
+			addr, url.PathEscape(namespace), core.DigestFixture(), md))
+		require.True(httputil.IsStatus(err, http.StatusBadRequest))
+	}
+}
+
+func TestDownloadWithFallback(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	blob := core.NewBlobFixture()
+
+	addr := mocks.startServer(WithFallback(fakeFallback{}))
+
+	// Adds the namespace, deadline and fallback options.
+	mocks.sched.EXPECT().AddTorrentWithOptions(
+		gomock.Any(), blob.Digest, gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, d core.Digest, opts ...scheduler.TorrentOption) error {
+			return store.RunDownload(mocks.cads, d, blob.Content)
+		})
+
+	_, err := httputil.Get(fmt.Sprintf(
+		"http://%s/namespace/%s/blobs/%s?deadline=1m",
+		addr, url.PathEscape(namespace), blob.Digest))
+	require.NoError(err)
+
+	_, err = httputil.Get(fmt.Sprintf(
+		"http://%s/namespace/%s/blobs/%s?deadline=soon",
+		addr, url.PathEscape(namespace), core.DigestFixture()))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+}
+
 func TestDownloadNotFound(t *testing.T) {
 	require := require.New(t)
 
@@ -136,7 +209,8 @@ func TestDownloadNotFound(t *testing.T) {
 	namespace := core.TagFixture()
 	blob := core.NewBlobFixture()
 
-	mocks.sched.EXPECT().Download(namespace, blob.Digest).Return(scheduler.ErrTorrentNotFound)
+	mocks.sched.EXPECT().AddTorrentWithOptions(
+		gomock.Any(), blob.Digest, gomock.Any()).Return(scheduler.ErrTorrentNotFound)
 
 	addr := mocks.startServer()
 	c := agentclient.New(addr)
@@ -155,7 +229,8 @@ func TestDownloadUnknownError(t *testing.T) {
 	namespace := core.TagFixture()
 	blob := core.NewBlobFixture()
 
-	mocks.sched.EXPECT().Download(namespace, blob.Digest).Return(fmt.Errorf("test error"))
+	mocks.sched.EXPECT().AddTorrentWithOptions(
+		gomock.Any(), blob.Digest, gomock.Any()).Return(fmt.Errorf("test error"))
 
 	addr := mocks.startServer()
 	c := agentclient.New(addr)
@@ -239,6 +314,273 @@ func TestGetBlacklistHandler(t *testing.T) {
 	require.Equal(blacklist, result)
 }
 
+func TestGetSchedulerIntrospectionHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+	in := &scheduler.Introspection{
+		Torrents: []scheduler.TorrentIntrospection{{
+			InfoHash:  h,
+			Digest:    core.DigestFixture(),
+			Namespace: "ns",
+			State:     "downloading",
+			Peers:     2,
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		}},
+		Queued: []core.InfoHash{},
+		AnnounceQueue: []announcequeue.Entry{{
+			InfoHash: h,
+			Priority: announcequeue.PriorityLeecher,
+			Status:   announcequeue.StatusPending,
+		}},
+		Conns: []connstate.ConnInfo{{
+			PeerID:   core.PeerIDFixture(),
+			InfoHash: h,
+		}},
+		Blacklist: []connstate.BlacklistedConn{},
+	}
+	mocks.sched.EXPECT().Introspect().Return(in, nil)
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/debug/scheduler", addr))
+	require.NoError(err)
+
+	var result scheduler.Introspection
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(in, &result)
+}
+
+func TestGetRecentEventsHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	events := []scheduler.EventRecord{{
+		Event:    "cancelTorrentEvent",
+		Class:    "control",
+		Fields:   map[string]string{"hash": core.InfoHashFixture().String()},
+		Applied:  time.Now().UTC().Truncate(time.Second),
+		Duration: time.Millisecond,
+	}}
+	mocks.sched.EXPECT().RecentEvents().Return(events)
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/events", addr))
+	require.NoError(err)
+
+	var result []scheduler.EventRecord
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(events, result)
+}
+
+func TestGetSeededExportHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	export := reconcile.NewExport(
+		core.PeerInfoFixture(), []core.InfoHash{core.InfoHashFixture()}, time.Now().UTC())
+	export.SetTorrents([]reconcile.Torrent{{Namespace: "ns", Digest: core.DigestFixture()}})
+	export.Sign([]byte("key"))
+
+	mocks.sched.EXPECT().SeededExport().Return(export, nil).Times(2)
+
+	addr := mocks.startServer()
+
+	result, err := reconcile.NewClient(nil).Pull(addr)
+	require.NoError(err)
+	require.NoError(result.Verify([]byte("key")))
+	require.Equal(export.InfoHashes, result.InfoHashes)
+
+	// Neighbors warm up from the same export.
+	torrents, err := warmup.NewClient(nil).Seeded(addr)
+	require.NoError(err)
+	require.Equal([]warmup.Torrent{{Namespace: "ns", Digest: export.Torrents[0].Digest}}, torrents)
+}
+
+func TestGetDigestTimelinesHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	expected := timeline.Timeline{
+		Namespace: "some/namespace",
+		Digest:    d,
+		InfoHash:  core.InfoHashFixture(),
+		Events: []timeline.Event{
+			{Time: time.Unix(1000, 0).UTC(), Kind: timeline.Added},
+			{Time: time.Unix(1005, 0).UTC(), Kind: timeline.Completed},
+		},
+		Finished: true,
+	}
+	other := timeline.Timeline{
+		Digest:   core.DigestFixture(),
+		InfoHash: core.InfoHashFixture(),
+		Events:   []timeline.Event{{Time: time.Unix(1000, 0).UTC(), Kind: timeline.Added}},
+	}
+	mocks.sched.EXPECT().TorrentTimelines().Return([]timeline.Timeline{other, expected})
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/timelines/%s", addr, d))
+	require.NoError(err)
+
+	var result []timeline.Timeline
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal([]timeline.Timeline{expected}, result)
+}
+
+func TestGetProvenanceHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	expected := provenance.Record{
+		Namespace: "some/namespace",
+		Digest:    d,
+		InfoHash:  core.InfoHashFixture(),
+		Pieces: []provenance.Piece{{
+			Index:  0,
+			Source: provenance.SourcePeer,
+			PeerID: core.PeerIDFixture().String(),
+			Time:   time.Unix(1000, 0).UTC(),
+		}},
+	}
+	mocks.sched.EXPECT().PieceProvenance(d).Return(expected, nil)
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/provenance/%s", addr, d))
+	require.NoError(err)
+
+	var result provenance.Record
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(expected, result)
+}
+
+func TestGetProvenanceHandlerNotFound(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	mocks.sched.EXPECT().PieceProvenance(d).Return(provenance.Record{}, provenance.ErrNotFound)
+
+	addr := mocks.startServer()
+
+	_, err := httputil.Get(fmt.Sprintf("http://%s/x/provenance/%s", addr, d))
+	require.True(httputil.IsNotFound(err))
+}
+
+func TestPutTorrentLogLevelHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().SetTorrentLogLevel(d, zapcore.DebugLevel).Return(nil)
+
+	_, err := httputil.Put(fmt.Sprintf("http://%s/x/loglevel/%s?level=debug", addr, d))
+	require.NoError(err)
+}
+
+func TestPutTorrentLogLevelHandlerInvalidLevel(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+
+	addr := mocks.startServer()
+
+	_, err := httputil.Put(fmt.Sprintf("http://%s/x/loglevel/%s?level=loud", addr, d))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+}
+
+func TestDeleteTorrentLogLevelHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().ClearTorrentLogLevel(d)
+
+	_, err := httputil.Delete(fmt.Sprintf("http://%s/x/loglevel/%s", addr, d))
+	require.NoError(err)
+}
+
+func TestPutTorrentTraceHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().StartTrace(h, 10*time.Minute).Return("/tmp/trace", nil)
+
+	resp, err := httputil.Put(fmt.Sprintf("http://%s/x/trace/%s?duration=10m", addr, h.Hex()))
+	require.NoError(err)
+	var result map[string]string
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal("/tmp/trace", result["path"])
+}
+
+func TestPutTorrentTraceHandlerDisabled(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().StartTrace(h, time.Duration(0)).Return("", scheduler.ErrTracingDisabled)
+
+	_, err := httputil.Put(fmt.Sprintf("http://%s/x/trace/%s", addr, h.Hex()))
+	require.True(httputil.IsStatus(err, http.StatusNotImplemented))
+}
+
+func TestDeleteTorrentTraceHandlerNotFound(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().StopTrace(h).Return(scheduler.ErrTraceNotFound)
+
+	_, err := httputil.Delete(fmt.Sprintf("http://%s/x/trace/%s", addr, h.Hex()))
+	require.True(httputil.IsNotFound(err))
+}
+
 func TestDeleteBlobHandler(t *testing.T) {
 	require := require.New(t)
 
@@ -249,8 +591,250 @@ func TestDeleteBlobHandler(t *testing.T) {
 
 	addr := mocks.startServer()
 
-	mocks.sched.EXPECT().RemoveTorrent(d).Return(nil)
+	mocks.sched.EXPECT().RemoveTorrent(d).Return(nil).Times(2)
 
 	_, err := httputil.Delete(fmt.Sprintf("http://%s/blobs/%s", addr, d))
 	require.NoError(err)
+
+	require.NoError(agentclient.New(addr).RemoveTorrent(d))
+}
+
+func TestRechunkBlobHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(64, 4)
+	mi, err := core.NewMetaInfo(blob.Digest, bytes.NewReader(blob.Content), 16)
+	require.NoError(err)
+
+	addr := mocks.startServer()
+
+	_, err = httputil.Post(fmt.Sprintf(
+		"http://%s/x/blobs/%s/rechunk?piece_length=abc", addr, blob.Digest))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+
+	mocks.sched.EXPECT().Rechunk(blob.Digest, int64(16), 24*time.Hour).Return(
+		nil, agentstorage.ErrRechunkIncomplete)
+	_, err = httputil.Post(fmt.Sprintf(
+		"http://%s/x/blobs/%s/rechunk?piece_length=16", addr, blob.Digest))
+	require.True(httputil.IsNotFound(err))
+
+	mocks.sched.EXPECT().Rechunk(blob.Digest, int64(4), 24*time.Hour).Return(
+		nil, agentstorage.ErrRechunkSamePieceLength)
+	_, err = httputil.Post(fmt.Sprintf(
+		"http://%s/x/blobs/%s/rechunk?piece_length=4", addr, blob.Digest))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+
+	mocks.sched.EXPECT().Rechunk(blob.Digest, int64(16), time.Hour).Return(
+		nil, scheduler.ErrRechunkTorrentHeld)
+	_, err = httputil.Post(fmt.Sprintf(
+		"http://%s/x/blobs/%s/rechunk?piece_length=16&window=1h", addr, blob.Digest))
+	require.True(httputil.IsConflict(err))
+
+	mocks.sched.EXPECT().Rechunk(blob.Digest, int64(16), time.Hour).Return(mi, nil)
+	resp, err := httputil.Post(fmt.Sprintf(
+		"http://%s/x/blobs/%s/rechunk?piece_length=16&window=1h", addr, blob.Digest))
+	require.NoError(err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	result, err := core.DeserializeMetaInfo(b)
+	require.NoError(err)
+	require.Equal(mi.InfoHash(), result.InfoHash())
+}
+
+func TestAttachBlobHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	d := core.DigestFixture()
+
+	addr := mocks.startServer()
+
+	mocks.sched.EXPECT().AttachTorrent(namespace, d, "/images/layer.tar").Return(nil)
+
+	_, err := httputil.Post(fmt.Sprintf(
+		"http://%s/x/namespace/%s/blobs/%s/attach?path=/images/layer.tar",
+		addr, url.PathEscape(namespace), d))
+	require.NoError(err)
+
+	_, err = httputil.Post(fmt.Sprintf(
+		"http://%s/x/namespace/%s/blobs/%s/attach?path=layer.tar",
+		addr, url.PathEscape(namespace), d))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+}
+
+func TestIngestBlobHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	blob := core.NewBlobFixture()
+
+	addr := mocks.startServer()
+
+	gomock.InOrder(
+		mocks.sched.EXPECT().Ingest(namespace, blob.Digest, gomock.Any()).DoAndReturn(
+			func(namespace string, d core.Digest, r io.Reader) error {
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				require.Equal(blob.Content, b)
+				return nil
+			}),
+		mocks.sched.EXPECT().Ingest(namespace, blob.Digest, gomock.Any()).Return(
+			scheduler.ErrTorrentNotFound),
+	)
+
+	ingestURL := fmt.Sprintf(
+		"http://%s/x/namespace/%s/blobs/%s/ingest", addr, url.PathEscape(namespace), blob.Digest)
+
+	_, err := httputil.Put(ingestURL, httputil.SendBody(bytes.NewReader(blob.Content)))
+	require.NoError(err)
+
+	_, err = httputil.Put(ingestURL, httputil.SendBody(bytes.NewReader(blob.Content)))
+	require.True(httputil.IsNotFound(err))
+}
+
+func TestAddTorrentHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	d := core.DigestFixture()
+
+	addr := mocks.startServer()
+	client := agentclient.New(addr)
+
+	gomock.InOrder(
+		mocks.sched.EXPECT().AddTorrentWithOptions(gomock.Any(), d, gomock.Any(), gomock.Any()).Return(nil),
+		mocks.sched.EXPECT().AddTorrentWithOptions(gomock.Any(), d, gomock.Any(), gomock.Any()).Return(
+			scheduler.ErrTorrentNotFound),
+	)
+
+	require.NoError(client.AddTorrent(namespace, d, 5*time.Second))
+	require.Equal(agentclient.ErrTorrentNotFound, client.AddTorrent(namespace, d, 5*time.Second))
+}
+
+type fakeFallback struct{}
+
+func (fakeFallback) ReadRange(string, core.Digest, int64, int64) ([]byte, error) {
+	return nil, fallback.ErrBlobNotFound
+}
+
+func TestAddTorrentHandlerWithDeadline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	namespace := core.TagFixture()
+	d := core.DigestFixture()
+
+	addr := mocks.startServer(WithFallback(fakeFallback{}))
+
+	// Adds the namespace, caller, deadline and fallback options.
+	mocks.sched.EXPECT().AddTorrentWithOptions(
+		gomock.Any(), d, gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+
+	_, err := httputil.Post(fmt.Sprintf(
+		"http://%s/x/namespace/%s/blobs/%s/add?deadline=1m",
+		addr, url.PathEscape(namespace), d))
+	require.NoError(err)
+
+	for _, deadline := range []string{"soon", "-1m"} {
+		_, err = httputil.Post(fmt.Sprintf(
+			"http://%s/x/namespace/%s/blobs/%s/add?deadline=%s",
+			addr, url.PathEscape(namespace), d, deadline))
+		require.True(httputil.IsStatus(err, http.StatusBadRequest))
+	}
+}
+
+func TestTorrentAdminHandlers(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+	progress := &scheduler.Progress{
+		InfoHash:  h,
+		Digest:    core.DigestFixture(),
+		Length:    64,
+		NumPieces: 4,
+	}
+	peers := []*scheduler.TorrentPeer{{
+		PeerID:          core.PeerIDFixture(),
+		ConnectedAt:     time.Now().UTC().Truncate(time.Second),
+		ProtocolVersion: 1,
+	}}
+
+	mocks.sched.EXPECT().Torrents().Return([]*scheduler.Progress{progress}, nil)
+	mocks.sched.EXPECT().Progress(h).Return(progress, nil)
+	mocks.sched.EXPECT().TorrentPeers(h).Return(peers, nil)
+	mocks.sched.EXPECT().PauseTorrent(h).Return(nil)
+	mocks.sched.EXPECT().ResumeTorrent(h).Return(nil)
+	mocks.sched.EXPECT().Announce(h).Return(nil)
+	mocks.sched.EXPECT().CancelTorrent(h).Return(nil)
+
+	addr := mocks.startServer()
+	client := agentclient.New(addr)
+
+	torrents, err := client.Torrents()
+	require.NoError(err)
+	require.Equal([]*scheduler.Progress{progress}, torrents)
+
+	p, err := client.TorrentProgress(h)
+	require.NoError(err)
+	require.Equal(progress, p)
+
+	result, err := client.TorrentPeers(h)
+	require.NoError(err)
+	require.Equal(peers, result)
+
+	require.NoError(client.PauseTorrent(h))
+	require.NoError(client.ResumeTorrent(h))
+	require.NoError(client.AnnounceTorrent(h))
+	require.NoError(client.CancelTorrent(h))
+}
+
+func TestTorrentAdminHandlersTorrentNotFound(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+
+	mocks.sched.EXPECT().Progress(h).Return(nil, scheduler.ErrTorrentNotFound)
+	mocks.sched.EXPECT().TorrentPeers(h).Return(nil, scheduler.ErrTorrentNotFound)
+	mocks.sched.EXPECT().PauseTorrent(h).Return(scheduler.ErrTorrentNotFound)
+	mocks.sched.EXPECT().Announce(h).Return(scheduler.ErrTorrentNotFound)
+	mocks.sched.EXPECT().CancelTorrent(h).Return(scheduler.ErrTorrentNotFound)
+
+	addr := mocks.startServer()
+	client := agentclient.New(addr)
+
+	_, err := client.TorrentProgress(h)
+	require.Equal(agentclient.ErrTorrentNotFound, err)
+
+	_, err = client.TorrentPeers(h)
+	require.Equal(agentclient.ErrTorrentNotFound, err)
+
+	require.Equal(agentclient.ErrTorrentNotFound, client.PauseTorrent(h))
+	require.Equal(agentclient.ErrTorrentNotFound, client.AnnounceTorrent(h))
+	require.Equal(agentclient.ErrTorrentNotFound, client.CancelTorrent(h))
+
+	_, err = httputil.Post(fmt.Sprintf("http://%s/x/torrents/notahash/pause", addr))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
 }
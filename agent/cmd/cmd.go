@@ -14,25 +14,34 @@
 package cmd
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/uber/kraken/agent/agentserver"
 	"github.com/uber/kraken/build-index/tagclient"
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/dockerregistry/transfer"
+	"github.com/uber/kraken/lib/hashring"
 	"github.com/uber/kraken/lib/store"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/lib/torrent/scheduler/remoteconfig"
 	"github.com/uber/kraken/metrics"
 	"github.com/uber/kraken/nginx"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/announceproxy"
 	"github.com/uber/kraken/utils/configutil"
 	"github.com/uber/kraken/utils/log"
 	"github.com/uber/kraken/utils/netutil"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
 )
 
@@ -44,6 +53,7 @@ type Flags struct {
 	AgentRegistryPort int
 	ConfigFile        string
 	Zone              string
+	Rack              string
 	KrakenCluster     string
 	SecretsFile       string
 }
@@ -63,6 +73,8 @@ func ParseFlags() *Flags {
 		&flags.ConfigFile, "config", "", "configuration file path")
 	flag.StringVar(
 		&flags.Zone, "zone", "", "zone/datacenter name")
+	flag.StringVar(
+		&flags.Rack, "rack", "", "rack name, enables rack-local download coordination")
 	flag.StringVar(
 		&flags.KrakenCluster, "cluster", "", "cluster name (e.g. prod01-zone1)")
 	flag.StringVar(
@@ -95,6 +107,8 @@ func Run(flags *Flags) {
 	zlog := log.ConfigureLogger(config.ZapLogging)
 	defer zlog.Sync()
 
+	log.Infof("Piece hash accelerations: %v", core.PieceHashAccelerations())
+
 	stats, closer, err := metrics.New(config.Metrics, flags.KrakenCluster)
 	if err != nil {
 		log.Fatalf("Failed to init metrics: %s", err)
@@ -116,6 +130,10 @@ func Run(flags *Flags) {
 	if err != nil {
 		log.Fatalf("Failed to create peer context: %s", err)
 	}
+	if strings.Contains(flags.Rack, ":") {
+		log.Fatalf("Invalid rack %q: must not contain ':'", flags.Rack)
+	}
+	pctx.Rack = flags.Rack
 
 	cads, err := store.NewCADownloadStore(config.CADownloadStore, stats)
 	if err != nil {
@@ -137,12 +155,41 @@ func Run(flags *Flags) {
 		log.Fatalf("Error building client tls config: %s", err)
 	}
 
+	var fallbackTrackers []hashring.PassiveRing
+	for _, c := range config.FallbackTrackers {
+		ring, err := c.Build()
+		if err != nil {
+			log.Fatalf("Error building fallback tracker upstream: %s", err)
+		}
+		fallbackTrackers = append(fallbackTrackers, ring)
+	}
+
 	sched, err := scheduler.NewAgentScheduler(
-		config.Scheduler, stats, pctx, cads, netevents, trackers, tls)
+		config.Scheduler, stats, pctx, cads, netevents, trackers, tls, fallbackTrackers...)
 	if err != nil {
 		log.Fatalf("Error creating scheduler: %s", err)
 	}
 
+	if config.RemoteConfig.Enable {
+		syncer := remoteconfig.New(
+			config.RemoteConfig,
+			config.Scheduler,
+			remoteconfig.NewHTTPSource(config.RemoteConfig.URL, tls),
+			sched,
+			clock.New(),
+			stats,
+			log.Default())
+		go syncer.Run(nil)
+	}
+
+	if config.AnnounceProxy.Enable {
+		proxy := announceproxy.New(
+			config.AnnounceProxy, stats, announceclient.NewForwarder(trackers, tls))
+		go func() {
+			log.Fatal(proxy.ListenAndServe())
+		}()
+	}
+
 	buildIndexes, err := config.BuildIndex.Build()
 	if err != nil {
 		log.Fatalf("Error building build-index upstream: %s", err)
@@ -157,7 +204,17 @@ func Run(flags *Flags) {
 		log.Fatalf("Failed to init registry: %s", err)
 	}
 
-	agentServer := agentserver.New(config.AgentServer, stats, cads, sched, tagClient)
+	var serverOpts []agentserver.Option
+	fallbackReader, err := config.Fallback.Build()
+	if err != nil {
+		log.Fatalf("Error building fallback reader: %s", err)
+	}
+	if fallbackReader != nil {
+		serverOpts = append(serverOpts, agentserver.WithFallback(fallbackReader))
+	}
+
+	agentServer := agentserver.New(
+		config.AgentServer, stats, cads, sched, tagClient, serverOpts...)
 	addr := fmt.Sprintf(":%d", flags.AgentServerPort)
 	log.Infof("Starting agent server on %s", addr)
 	go func() {
@@ -171,6 +228,8 @@ func Run(flags *Flags) {
 
 	go heartbeat(stats)
 
+	go drainOnSignal(sched, config.DrainTimeout)
+
 	// Wipe log files created by the old nginx process which ran as root.
 	// TODO(codyg): Swap these with the v2 log files once they are deleted.
 	for _, name := range []string{
@@ -190,6 +249,26 @@ func Run(flags *Flags) {
 		nginx.WithTLS(config.TLS)))
 }
 
+// drainOnSignal gracefully stops sched once the agent receives SIGTERM or
+// SIGINT, such that trackers stop handing out the agent before it exits.
+func drainOnSignal(sched scheduler.Scheduler, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigc
+	log.Infof("Received %s, draining scheduler", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sched.Stop(ctx); err != nil {
+		log.Errorf("Error draining scheduler: %s", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 // heartbeat periodically emits a counter metric which allows us to monitor the
 // number of active agents.
 func heartbeat(stats tally.Scope) {
@@ -14,15 +14,25 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/uber/kraken/agent/agentserver"
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/backend/s3backend"
 	"github.com/uber/kraken/lib/dockerregistry"
 	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/lib/torrent/fallback/httpfallback"
+	"github.com/uber/kraken/lib/torrent/fallback/s3fallback"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/lib/torrent/scheduler/remoteconfig"
 	"github.com/uber/kraken/lib/upstream"
 	"github.com/uber/kraken/metrics"
 	"github.com/uber/kraken/nginx"
+	"github.com/uber/kraken/tracker/announceproxy"
 	"github.com/uber/kraken/utils/httputil"
 
 	"go.uber.org/zap"
@@ -35,6 +45,7 @@ type Config struct {
 	CADownloadStore store.CADownloadStoreConfig    `yaml:"store"`
 	Registry        dockerregistry.Config          `yaml:"registry"`
 	Scheduler       scheduler.Config               `yaml:"scheduler"`
+	RemoteConfig    remoteconfig.Config            `yaml:"remote_config"`
 	PeerIDFactory   core.PeerIDFactory             `yaml:"peer_id_factory"`
 	NetworkEvent    networkevent.Config            `yaml:"network_event"`
 	Tracker         upstream.PassiveHashRingConfig `yaml:"tracker"`
@@ -43,4 +54,49 @@ type Config struct {
 	RegistryBackup  string                         `yaml:"registry_backup"`
 	Nginx           nginx.Config                   `yaml:"nginx"`
 	TLS             httputil.TLSConfig             `yaml:"tls"`
+	AnnounceProxy   announceproxy.Config           `yaml:"announce_proxy"`
+
+	// FallbackTrackers are additional tracker clusters which torrents are
+	// announced to alongside Tracker, such that a single tracker cluster is
+	// not a single point of failure for the swarm.
+	FallbackTrackers []upstream.PassiveHashRingConfig `yaml:"fallback_trackers"`
+
+	// Fallback configures the store torrents added with a deadline fetch
+	// missing pieces from once their deadline is at risk.
+	Fallback FallbackConfig `yaml:"fallback"`
+
+	// DrainTimeout bounds how long the scheduler drains on SIGTERM before
+	// the agent exits. Defaults to 30s.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+// FallbackConfig defines the fallback reader of the agent. At most one of S3
+// and HTTP may be set.
+type FallbackConfig struct {
+	S3     *s3fallback.Config       `yaml:"s3"`
+	S3Auth s3backend.UserAuthConfig `yaml:"s3_auth"`
+	HTTP   *httpfallback.Config     `yaml:"http"`
+}
+
+// Build creates the configured fallback reader. Returns nil if no fallback is
+// configured.
+func (c FallbackConfig) Build() (fallback.Reader, error) {
+	switch {
+	case c.S3 != nil && c.HTTP != nil:
+		return nil, errors.New("only one of s3 and http may be configured")
+	case c.S3 != nil:
+		r, err := s3fallback.New(*c.S3, c.S3Auth)
+		if err != nil {
+			return nil, fmt.Errorf("s3: %s", err)
+		}
+		return r, nil
+	case c.HTTP != nil:
+		r, err := httpfallback.New(*c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("http: %s", err)
+		}
+		return r, nil
+	default:
+		return nil, nil
+	}
 }
@@ -15,9 +15,11 @@ package core
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 
 	"github.com/jackpal/bencode-go"
@@ -32,6 +34,19 @@ type info struct {
 	PieceSums   []uint32
 	Name        string
 	Length      int64
+
+	// PieceHashAlgorithm and PieceDigests are only set for torrents which are
+	// not summed with CRC32 (in which case PieceSums is empty). Both are omitted
+	// when empty, such that the info hash of CRC32 torrents is unchanged.
+	PieceHashAlgorithm PieceHashAlgorithm `bencode:"PieceHashAlgorithm,omitempty" json:",omitempty"`
+	PieceDigests       [][]byte           `bencode:"PieceDigests,omitempty" json:",omitempty"`
+}
+
+func (info *info) numPieces() int {
+	if info.PieceHashAlgorithm == PieceHashCRC32 {
+		return len(info.PieceSums)
+	}
+	return len(info.PieceDigests)
 }
 
 // Hash computes the InfoHash of info.
@@ -50,18 +65,42 @@ type MetaInfo struct {
 	digest   Digest
 }
 
+type metaInfoOptions struct {
+	pieceHashAlgorithm PieceHashAlgorithm
+}
+
+// MetaInfoOption allows setting optional NewMetaInfo parameters.
+type MetaInfoOption func(*metaInfoOptions)
+
+// WithPieceHashAlgorithm configures the hash used to sum pieces. Defaults to
+// CRC32.
+func WithPieceHashAlgorithm(a PieceHashAlgorithm) MetaInfoOption {
+	return func(o *metaInfoOptions) { o.pieceHashAlgorithm = a }
+}
+
 // NewMetaInfo creates a new MetaInfo. Assumes that d is the valid digest for
 // blob (re-computing it is expensive).
-func NewMetaInfo(d Digest, blob io.Reader, pieceLength int64) (*MetaInfo, error) {
-	length, pieceSums, err := calcPieceSums(blob, pieceLength)
+func NewMetaInfo(
+	d Digest, blob io.Reader, pieceLength int64, opts ...MetaInfoOption) (*MetaInfo, error) {
+
+	var o metaInfoOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.pieceHashAlgorithm.Validate(); err != nil {
+		return nil, err
+	}
+	length, pieceSums, pieceDigests, err := calcPieceSums(blob, pieceLength, o.pieceHashAlgorithm)
 	if err != nil {
 		return nil, err
 	}
 	info := info{
-		PieceLength: pieceLength,
-		PieceSums:   pieceSums,
-		Name:        d.Hex(),
-		Length:      length,
+		PieceLength:        pieceLength,
+		PieceSums:          pieceSums,
+		Name:               d.Hex(),
+		Length:             length,
+		PieceHashAlgorithm: o.pieceHashAlgorithm,
+		PieceDigests:       pieceDigests,
 	}
 	var buf bytes.Buffer
 	if err := bencode.Marshal(&buf, info); err != nil {
@@ -95,7 +134,7 @@ func (mi *MetaInfo) Length() int64 {
 
 // NumPieces returns the number of pieces in the torrent.
 func (mi *MetaInfo) NumPieces() int {
-	return len(mi.info.PieceSums)
+	return mi.info.numPieces()
 }
 
 // PieceLength returns the piece length used to break up the original blob. Note,
@@ -107,21 +146,71 @@ func (mi *MetaInfo) PieceLength() int64 {
 
 // GetPieceLength returns the length of piece i.
 func (mi *MetaInfo) GetPieceLength(i int) int64 {
-	if i < 0 || i >= len(mi.info.PieceSums) {
+	if i < 0 || i >= mi.NumPieces() {
 		return 0
 	}
-	if i == len(mi.info.PieceSums)-1 {
+	if i == mi.NumPieces()-1 {
 		// Last piece.
 		return mi.info.Length - mi.info.PieceLength*int64(i)
 	}
 	return mi.info.PieceLength
 }
 
-// GetPieceSum returns the checksum of piece i. Does not check bounds.
+// GetPieceSum returns the CRC32 checksum of piece i. Does not check bounds.
+// Only valid for torrents summed with CRC32 -- prefer VerifyPieceSum.
 func (mi *MetaInfo) GetPieceSum(i int) uint32 {
 	return mi.info.PieceSums[i]
 }
 
+// PieceHashAlgorithm returns the algorithm used to sum pieces.
+func (mi *MetaInfo) PieceHashAlgorithm() PieceHashAlgorithm {
+	return mi.info.PieceHashAlgorithm
+}
+
+// NewPieceHash returns a new hash for summing pieces of mi.
+func (mi *MetaInfo) NewPieceHash() hash.Hash {
+	return mi.info.PieceHashAlgorithm.New()
+}
+
+// PieceHash returns the expected sum of piece i, encoded as the sum of a hash
+// created via NewPieceHash. Does not check bounds.
+func (mi *MetaInfo) PieceHash(i int) []byte {
+	if mi.info.PieceHashAlgorithm == PieceHashCRC32 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, mi.info.PieceSums[i])
+		return b
+	}
+	return append([]byte(nil), mi.info.PieceDigests[i]...)
+}
+
+// VerifyPieceSum returns true if h, which must have been created via
+// NewPieceHash, matches the sum of piece i. Does not check bounds.
+func (mi *MetaInfo) VerifyPieceSum(i int, h hash.Hash) bool {
+	if mi.info.PieceHashAlgorithm == PieceHashCRC32 {
+		return h.(hash.Hash32).Sum32() == mi.info.PieceSums[i]
+	}
+	return bytes.Equal(h.Sum(nil), mi.info.PieceDigests[i])
+}
+
+// EqualInfo returns true if mi and o break up and verify their blobs the same
+// way, i.e. if their infos including all piece hashes are identical.
+func (mi *MetaInfo) EqualInfo(o *MetaInfo) bool {
+	a, b := mi.info, o.info
+	if a.Name != b.Name ||
+		a.Length != b.Length ||
+		a.PieceLength != b.PieceLength ||
+		a.PieceHashAlgorithm != b.PieceHashAlgorithm ||
+		a.numPieces() != b.numPieces() {
+		return false
+	}
+	for i := 0; i < a.numPieces(); i++ {
+		if !bytes.Equal(mi.PieceHash(i), o.PieceHash(i)) {
+			return false
+		}
+	}
+	return true
+}
+
 // metaInfoJSON is used for serializing / deserializing MetaInfo.
 type metaInfoJSON struct {
 	// Only serialize info for backwards compatibility.
@@ -139,6 +228,9 @@ func DeserializeMetaInfo(data []byte) (*MetaInfo, error) {
 	if err := json.Unmarshal(data, &j); err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	if err := j.Info.PieceHashAlgorithm.Validate(); err != nil {
+		return nil, err
+	}
 	h, err := j.Info.Hash()
 	if err != nil {
 		return nil, fmt.Errorf("compute info hash: %s", err)
@@ -154,26 +246,34 @@ func DeserializeMetaInfo(data []byte) (*MetaInfo, error) {
 	}, nil
 }
 
-// calcPieceSums hashes blob content in pieceLength chunks.
-func calcPieceSums(blob io.Reader, pieceLength int64) (length int64, pieceSums []uint32, err error) {
+// calcPieceSums hashes blob content in pieceLength chunks. CRC32 sums are
+// returned as pieceSums, while all other algorithms are returned as pieceDigests.
+func calcPieceSums(
+	blob io.Reader,
+	pieceLength int64,
+	a PieceHashAlgorithm) (length int64, pieceSums []uint32, pieceDigests [][]byte, err error) {
+
 	if pieceLength <= 0 {
-		return 0, nil, errors.New("piece length must be positive")
+		return 0, nil, nil, errors.New("piece length must be positive")
 	}
 	for {
-		h := PieceHash()
+		h := a.New()
 		n, err := io.CopyN(h, blob, pieceLength)
 		if err != nil && err != io.EOF {
-			return 0, nil, fmt.Errorf("read blob: %s", err)
+			return 0, nil, nil, fmt.Errorf("read blob: %s", err)
 		}
 		length += n
 		if n == 0 {
 			break
 		}
-		sum := h.Sum32()
-		pieceSums = append(pieceSums, sum)
+		if a == PieceHashCRC32 {
+			pieceSums = append(pieceSums, h.(hash.Hash32).Sum32())
+		} else {
+			pieceDigests = append(pieceDigests, h.Sum(nil))
+		}
 		if n < pieceLength {
 			break
 		}
 	}
-	return length, pieceSums, nil
+	return length, pieceSums, pieceDigests, nil
 }
@@ -14,12 +14,14 @@
 package core
 
 import (
+	"bytes"
 	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/uber/kraken/utils/memsize"
+	"github.com/uber/kraken/utils/randutil"
 )
 
 func TestMetaInfoGetPieceLength(t *testing.T) {
@@ -118,3 +120,78 @@ func TestMetaInfoSerializationLimit(t *testing.T) {
 		})
 	}
 }
+
+func TestMetaInfoPieceHashAlgorithms(t *testing.T) {
+	for _, a := range []PieceHashAlgorithm{
+		PieceHashCRC32, PieceHashSHA1, PieceHashSHA256, PieceHashBLAKE3,
+	} {
+		t.Run(string(a), func(t *testing.T) {
+			require := require.New(t)
+
+			content := randutil.Text(10)
+
+			mi, err := NewMetaInfo(
+				DigestFixture(), bytes.NewReader(content), 4, WithPieceHashAlgorithm(a))
+			require.NoError(err)
+			require.Equal(a, mi.PieceHashAlgorithm())
+			require.Equal(3, mi.NumPieces())
+			require.Equal(int64(2), mi.GetPieceLength(2))
+
+			b, err := mi.Serialize()
+			require.NoError(err)
+			result, err := DeserializeMetaInfo(b)
+			require.NoError(err)
+			require.Equal(mi, result)
+
+			for i := 0; i < mi.NumPieces(); i++ {
+				start := int64(i) * mi.PieceLength()
+				piece := content[start : start+mi.GetPieceLength(i)]
+
+				h := result.NewPieceHash()
+				h.Write(piece)
+				require.True(result.VerifyPieceSum(i, h))
+				require.Equal(h.Sum(nil), result.PieceHash(i))
+
+				h = result.NewPieceHash()
+				h.Write(append([]byte{piece[0] ^ 1}, piece[1:]...))
+				require.False(result.VerifyPieceSum(i, h))
+			}
+		})
+	}
+}
+
+func TestNewMetaInfoRejectsUnsupportedPieceHashAlgorithm(t *testing.T) {
+	_, err := NewMetaInfo(
+		DigestFixture(), bytes.NewReader(randutil.Text(10)), 4, WithPieceHashAlgorithm("md5"))
+	require.Error(t, err)
+}
+
+func TestMetaInfoEqualInfo(t *testing.T) {
+	require := require.New(t)
+
+	d := DigestFixture()
+	content := randutil.Text(10)
+	corrupt := append([]byte{content[0] ^ 1}, content[1:]...)
+
+	mi, err := NewMetaInfo(d, bytes.NewReader(content), 4)
+	require.NoError(err)
+
+	same, err := NewMetaInfo(d, bytes.NewReader(content), 4)
+	require.NoError(err)
+	require.True(mi.EqualInfo(same))
+
+	for _, other := range []struct {
+		desc    string
+		d       Digest
+		content []byte
+		opts    []MetaInfoOption
+	}{
+		{"digest", DigestFixture(), content, nil},
+		{"piece hash", d, corrupt, nil},
+		{"piece hash algorithm", d, content, []MetaInfoOption{WithPieceHashAlgorithm(PieceHashSHA256)}},
+	} {
+		o, err := NewMetaInfo(other.d, bytes.NewReader(other.content), 4, other.opts...)
+		require.NoError(err)
+		require.False(mi.EqualInfo(o), other.desc)
+	}
+}
@@ -35,6 +35,10 @@ type PeerContext struct {
 	// Cluster is the Kraken cluster the peer is running within.
 	Cluster string `json:"cluster"`
 
+	// Rack is the rack the peer is running within. Optional, and enables
+	// rack-local download coordination on the tracker.
+	Rack string `json:"rack,omitempty"`
+
 	// Origin indicates whether the peer is an origin server or not.
 	Origin bool `json:"origin"`
 }
@@ -22,6 +22,22 @@ type PeerInfo struct {
 	Port     int    `json:"port"`
 	Origin   bool   `json:"origin"`
 	Complete bool   `json:"complete"`
+
+	// HaveRanges summarizes the pieces held by an incomplete peer. Peers which
+	// hold some pieces but are not complete may advertise themselves as partial
+	// seeders.
+	HaveRanges PieceRanges `json:"have_ranges,omitempty"`
+
+	// Rack is the rack of the peer, if known.
+	Rack string `json:"rack,omitempty"`
+
+	// LeechOnly marks a peer which downloads but never serves pieces, and
+	// therefore must not be handed out to other peers.
+	LeechOnly bool `json:"leech_only,omitempty"`
+
+	// Stopped marks a peer which is shutting down, and must no longer be
+	// handed out to other peers.
+	Stopped bool `json:"stopped,omitempty"`
 }
 
 // NewPeerInfo creates a new PeerInfo.
@@ -43,7 +59,15 @@ func NewPeerInfo(
 
 // PeerInfoFromContext derives PeerInfo from a PeerContext.
 func PeerInfoFromContext(pctx PeerContext, complete bool) *PeerInfo {
-	return NewPeerInfo(pctx.PeerID, pctx.IP, pctx.Port, pctx.Origin, complete)
+	p := NewPeerInfo(pctx.PeerID, pctx.IP, pctx.Port, pctx.Origin, complete)
+	p.Rack = pctx.Rack
+	return p
+}
+
+// Partial returns true if p is an incomplete peer which has advertised the
+// pieces it holds.
+func (p *PeerInfo) Partial() bool {
+	return !p.Complete && len(p.HaveRanges) > 0
 }
 
 // PeerInfos groups PeerInfo structs for sorting.
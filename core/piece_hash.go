@@ -14,10 +14,53 @@
 package core
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"hash"
 	"hash/crc32"
+
+	"github.com/minio/sha256-simd"
+	"github.com/zeebo/blake3"
+)
+
+// PieceHashAlgorithm identifies the hash function used to sum pieces.
+type PieceHashAlgorithm string
+
+// Supported piece hash algorithms. The empty algorithm is CRC32, which all
+// metainfo generated before algorithms were configurable uses.
+const (
+	PieceHashCRC32  PieceHashAlgorithm = ""
+	PieceHashSHA1   PieceHashAlgorithm = "sha1"
+	PieceHashSHA256 PieceHashAlgorithm = "sha256"
+	PieceHashBLAKE3 PieceHashAlgorithm = "blake3"
 )
 
+// Validate returns an error if a is not a supported algorithm.
+func (a PieceHashAlgorithm) Validate() error {
+	switch a {
+	case PieceHashCRC32, PieceHashSHA1, PieceHashSHA256, PieceHashBLAKE3:
+		return nil
+	}
+	return fmt.Errorf("unsupported piece hash algorithm %q", string(a))
+}
+
+// New returns a new hash for a. Panics if a is not supported, so a should be
+// validated first. Accelerated implementations are selected at runtime where
+// the host supports them -- see PieceHashAccelerations.
+func (a PieceHashAlgorithm) New() hash.Hash {
+	switch a {
+	case PieceHashCRC32:
+		return PieceHash()
+	case PieceHashSHA1:
+		return sha1.New()
+	case PieceHashSHA256:
+		return sha256.New()
+	case PieceHashBLAKE3:
+		return blake3.New()
+	}
+	panic(fmt.Sprintf("unsupported piece hash algorithm %q", string(a)))
+}
+
 // PieceHash returns the hash used to sum pieces.
 func PieceHash() hash.Hash32 {
 	return crc32.NewIEEE()
@@ -0,0 +1,41 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import "golang.org/x/sys/cpu"
+
+// PieceHashAccelerations returns the hardware features, detected at runtime,
+// which accelerate piece hashing on this host. SHA-1 and SHA-256 use the SHA
+// extensions on ARM, while SHA-256 and BLAKE3 use AVX2 / SSE4.1 on x86. SHA-NI
+// on x86 is detected by sha256-simd itself, and is not reported since
+// golang.org/x/sys/cpu does not expose it. Hosts without any of these features
+// fall back to generic implementations.
+func PieceHashAccelerations() []string {
+	var accels []string
+	for _, f := range []struct {
+		has  bool
+		name string
+	}{
+		{cpu.X86.HasAVX2, "avx2"},
+		{cpu.X86.HasSSE41, "sse4.1"},
+		{cpu.ARM64.HasSHA1, "arm-sha1"},
+		{cpu.ARM64.HasSHA2, "arm-sha2"},
+		{cpu.ARM64.HasASIMD, "neon"},
+	} {
+		if f.has {
+			accels = append(accels, f.name)
+		}
+	}
+	return accels
+}
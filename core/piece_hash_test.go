@@ -0,0 +1,47 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/utils/memsize"
+	"github.com/uber/kraken/utils/randutil"
+)
+
+// BenchmarkPieceHash reports single core piece hashing throughput of each
+// algorithm, e.g. go test -bench PieceHash -cpu 1 ./core.
+func BenchmarkPieceHash(b *testing.B) {
+	piece := randutil.Blob(4 * memsize.MB)
+
+	b.Logf("accelerations: %v", PieceHashAccelerations())
+
+	for _, a := range []PieceHashAlgorithm{
+		PieceHashCRC32, PieceHashSHA1, PieceHashSHA256, PieceHashBLAKE3,
+	} {
+		name := string(a)
+		if a == PieceHashCRC32 {
+			name = "crc32"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(piece)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h := a.New()
+				h.Write(piece)
+				h.Sum(nil)
+			}
+		})
+	}
+}
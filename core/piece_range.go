@@ -0,0 +1,115 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/willf/bitset"
+)
+
+// PieceRange is an inclusive range of piece indices.
+type PieceRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// PieceRanges is a compact summary of the pieces a peer holds, represented as
+// sorted, non-overlapping ranges.
+type PieceRanges []PieceRange
+
+// NewPieceRanges summarizes the set bits of b as PieceRanges.
+func NewPieceRanges(b *bitset.BitSet) PieceRanges {
+	var r PieceRanges
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		if n := len(r); n > 0 && r[n-1].End == int(i)-1 {
+			r[n-1].End = int(i)
+			continue
+		}
+		r = append(r, PieceRange{int(i), int(i)})
+	}
+	return r
+}
+
+// Has returns true if piece i is within r.
+func (r PieceRanges) Has(i int) bool {
+	for _, pr := range r {
+		if i >= pr.Start && i <= pr.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns the number of pieces within r.
+func (r PieceRanges) Count() int {
+	var n int
+	for _, pr := range r {
+		n += pr.End - pr.Start + 1
+	}
+	return n
+}
+
+// BitSet converts r into a bitset of length numPieces. Pieces outside of
+// [0, numPieces) are ignored.
+func (r PieceRanges) BitSet(numPieces int) *bitset.BitSet {
+	b := bitset.New(uint(numPieces))
+	for _, pr := range r {
+		for i := pr.Start; i <= pr.End && i < numPieces; i++ {
+			if i >= 0 {
+				b.Set(uint(i))
+			}
+		}
+	}
+	return b
+}
+
+// String encodes r as a comma separated list of ranges, e.g. "0-4,7-7".
+func (r PieceRanges) String() string {
+	parts := make([]string, len(r))
+	for i, pr := range r {
+		parts[i] = fmt.Sprintf("%d-%d", pr.Start, pr.End)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParsePieceRanges parses PieceRanges from the format produced by
+// PieceRanges.String.
+func ParsePieceRanges(s string) (PieceRanges, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var r PieceRanges
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid range %q: expected 'start-end'", part)
+		}
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse start: %s", err)
+		}
+		end, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse end: %s", err)
+		}
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		r = append(r, PieceRange{start, end})
+	}
+	return r, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/willf/bitset"
+)
+
+func TestNewPieceRanges(t *testing.T) {
+	tests := []struct {
+		desc     string
+		bits     []uint
+		expected PieceRanges
+	}{
+		{"empty", nil, nil},
+		{"single", []uint{3}, PieceRanges{{3, 3}}},
+		{"contiguous", []uint{0, 1, 2}, PieceRanges{{0, 2}}},
+		{"gaps", []uint{0, 1, 4, 6, 7}, PieceRanges{{0, 1}, {4, 4}, {6, 7}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			b := bitset.New(8)
+			for _, i := range test.bits {
+				b.Set(i)
+			}
+			r := NewPieceRanges(b)
+			require.Equal(test.expected, r)
+			require.Equal(len(test.bits), r.Count())
+			require.True(b.Equal(r.BitSet(8)))
+		})
+	}
+}
+
+func TestPieceRangesHas(t *testing.T) {
+	require := require.New(t)
+
+	r := PieceRanges{{0, 1}, {4, 6}}
+	for _, i := range []int{0, 1, 4, 5, 6} {
+		require.True(r.Has(i))
+	}
+	for _, i := range []int{2, 3, 7} {
+		require.False(r.Has(i))
+	}
+}
+
+func TestPieceRangesStringRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	r := PieceRanges{{0, 1}, {4, 4}, {6, 9}}
+	require.Equal("0-1,4-4,6-9", r.String())
+
+	result, err := ParsePieceRanges(r.String())
+	require.NoError(err)
+	require.Equal(r, result)
+}
+
+func TestParsePieceRangesErrors(t *testing.T) {
+	for _, s := range []string{"1", "a-2", "2-b", "3-1", "-1-2"} {
+		t.Run(s, func(t *testing.T) {
+			_, err := ParsePieceRanges(s)
+			require.Error(t, err)
+		})
+	}
+}
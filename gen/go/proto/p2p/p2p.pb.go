@@ -29,6 +29,12 @@ It has these top-level messages:
 	CancelPieceMessage
 	ErrorMessage
 	CompleteMessage
+	RejectMessage
+	GoodbyeMessage
+	HeartbeatMessage
+	PieceHashRequestMessage
+	PieceHashMessage
+	PieceRequestBatchMessage
 	Message
 */
 package p2p
@@ -52,13 +58,16 @@ type ErrorMessage_ErrorCode int32
 
 const (
 	ErrorMessage_PIECE_REQUEST_FAILED ErrorMessage_ErrorCode = 0
+	ErrorMessage_BUSY                 ErrorMessage_ErrorCode = 1
 )
 
 var ErrorMessage_ErrorCode_name = map[int32]string{
 	0: "PIECE_REQUEST_FAILED",
+	1: "BUSY",
 }
 var ErrorMessage_ErrorCode_value = map[string]int32{
 	"PIECE_REQUEST_FAILED": 0,
+	"BUSY":                 1,
 }
 
 func (x ErrorMessage_ErrorCode) String() string {
@@ -66,41 +75,86 @@ func (x ErrorMessage_ErrorCode) String() string {
 }
 func (ErrorMessage_ErrorCode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{5, 0} }
 
+type RejectMessage_Reason int32
+
+const (
+	RejectMessage_OTHER        RejectMessage_Reason = 0
+	RejectMessage_UNKNOWN_HASH RejectMessage_Reason = 1
+	RejectMessage_AT_CAPACITY  RejectMessage_Reason = 2
+	RejectMessage_DRAINING     RejectMessage_Reason = 3
+)
+
+var RejectMessage_Reason_name = map[int32]string{
+	0: "OTHER",
+	1: "UNKNOWN_HASH",
+	2: "AT_CAPACITY",
+	3: "DRAINING",
+}
+var RejectMessage_Reason_value = map[string]int32{
+	"OTHER":        0,
+	"UNKNOWN_HASH": 1,
+	"AT_CAPACITY":  2,
+	"DRAINING":     3,
+}
+
+func (x RejectMessage_Reason) String() string {
+	return proto.EnumName(RejectMessage_Reason_name, int32(x))
+}
+func (RejectMessage_Reason) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{7, 0} }
+
 type Message_Type int32
 
 const (
-	Message_BITFIELD      Message_Type = 0
-	Message_PIECE_REQUEST Message_Type = 1
-	Message_PIECE_PAYLOAD Message_Type = 2
-	Message_ANNOUCE_PIECE Message_Type = 3
-	Message_CANCEL_PIECE  Message_Type = 4
-	Message_ERROR         Message_Type = 5
-	Message_COMPLETE      Message_Type = 6
+	Message_BITFIELD            Message_Type = 0
+	Message_PIECE_REQUEST       Message_Type = 1
+	Message_PIECE_PAYLOAD       Message_Type = 2
+	Message_ANNOUCE_PIECE       Message_Type = 3
+	Message_CANCEL_PIECE        Message_Type = 4
+	Message_ERROR               Message_Type = 5
+	Message_COMPLETE            Message_Type = 6
+	Message_REJECT              Message_Type = 7
+	Message_GOODBYE             Message_Type = 8
+	Message_HEARTBEAT           Message_Type = 9
+	Message_PIECE_HASH_REQUEST  Message_Type = 10
+	Message_PIECE_HASH          Message_Type = 11
+	Message_PIECE_REQUEST_BATCH Message_Type = 12
 )
 
 var Message_Type_name = map[int32]string{
-	0: "BITFIELD",
-	1: "PIECE_REQUEST",
-	2: "PIECE_PAYLOAD",
-	3: "ANNOUCE_PIECE",
-	4: "CANCEL_PIECE",
-	5: "ERROR",
-	6: "COMPLETE",
+	0:  "BITFIELD",
+	1:  "PIECE_REQUEST",
+	2:  "PIECE_PAYLOAD",
+	3:  "ANNOUCE_PIECE",
+	4:  "CANCEL_PIECE",
+	5:  "ERROR",
+	6:  "COMPLETE",
+	7:  "REJECT",
+	8:  "GOODBYE",
+	9:  "HEARTBEAT",
+	10: "PIECE_HASH_REQUEST",
+	11: "PIECE_HASH",
+	12: "PIECE_REQUEST_BATCH",
 }
 var Message_Type_value = map[string]int32{
-	"BITFIELD":      0,
-	"PIECE_REQUEST": 1,
-	"PIECE_PAYLOAD": 2,
-	"ANNOUCE_PIECE": 3,
-	"CANCEL_PIECE":  4,
-	"ERROR":         5,
-	"COMPLETE":      6,
+	"BITFIELD":            0,
+	"PIECE_REQUEST":       1,
+	"PIECE_PAYLOAD":       2,
+	"ANNOUCE_PIECE":       3,
+	"CANCEL_PIECE":        4,
+	"ERROR":               5,
+	"COMPLETE":            6,
+	"REJECT":              7,
+	"GOODBYE":             8,
+	"HEARTBEAT":           9,
+	"PIECE_HASH_REQUEST":  10,
+	"PIECE_HASH":          11,
+	"PIECE_REQUEST_BATCH": 12,
 }
 
 func (x Message_Type) String() string {
 	return proto.EnumName(Message_Type_name, int32(x))
 }
-func (Message_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{7, 0} }
+func (Message_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{13, 0} }
 
 // Binary set of all pieces that peer has downloaded so far. Also serves as a
 // handshaking message, which each peer sends once at the beginning of the
@@ -122,6 +176,26 @@ type BitfieldMessage struct {
 	// remoteBitfieldBytes contains the binary sets of pieces downloaded of
 	// all peers that the sender is currently connected to.
 	RemoteBitfieldBytes map[string][]byte `protobuf:"bytes,7,rep,name=remoteBitfieldBytes" json:"remoteBitfieldBytes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// protocolVersion is the highest wire protocol version supported by the
+	// sender. Unset for peers which predate protocol versioning.
+	ProtocolVersion uint32 `protobuf:"varint,8,opt,name=protocolVersion" json:"protocolVersion,omitempty"`
+	// haveSeq identifies the bitfield sent in this message, such that the
+	// receiver may later ask for only the pieces completed since.
+	HaveSeq uint64 `protobuf:"varint,9,opt,name=haveSeq" json:"haveSeq,omitempty"`
+	// haveSince is the haveSeq of the last bitfield the sender received from
+	// the receiver. Unset if the sender has no such bitfield cached.
+	HaveSince uint64 `protobuf:"varint,10,opt,name=haveSince" json:"haveSince,omitempty"`
+	// haveDelta is set if bitfieldBytes is omitted in favor of havePieces,
+	// the pieces completed since the bitfield identified by haveSince.
+	HaveDelta  bool    `protobuf:"varint,11,opt,name=haveDelta" json:"haveDelta,omitempty"`
+	HavePieces []int32 `protobuf:"varint,12,rep,packed,name=havePieces" json:"havePieces,omitempty"`
+	// sessionToken is issued by the sender for this connection. Should the
+	// connection be interrupted, the receiver presents it as resumeToken to
+	// resume the session on a new connection.
+	SessionToken []byte `protobuf:"bytes,13,opt,name=sessionToken,proto3" json:"sessionToken,omitempty"`
+	// resumeToken is the sessionToken last issued by the receiver, if the
+	// sender wants to resume an interrupted session with the receiver.
+	ResumeToken []byte `protobuf:"bytes,14,opt,name=resumeToken,proto3" json:"resumeToken,omitempty"`
 }
 
 func (m *BitfieldMessage) Reset()                    { *m = BitfieldMessage{} }
@@ -136,6 +210,55 @@ func (m *BitfieldMessage) GetRemoteBitfieldBytes() map[string][]byte {
 	return nil
 }
 
+func (m *BitfieldMessage) GetProtocolVersion() uint32 {
+	if m != nil {
+		return m.ProtocolVersion
+	}
+	return 0
+}
+
+func (m *BitfieldMessage) GetHaveSeq() uint64 {
+	if m != nil {
+		return m.HaveSeq
+	}
+	return 0
+}
+
+func (m *BitfieldMessage) GetHaveSince() uint64 {
+	if m != nil {
+		return m.HaveSince
+	}
+	return 0
+}
+
+func (m *BitfieldMessage) GetHaveDelta() bool {
+	if m != nil {
+		return m.HaveDelta
+	}
+	return false
+}
+
+func (m *BitfieldMessage) GetHavePieces() []int32 {
+	if m != nil {
+		return m.HavePieces
+	}
+	return nil
+}
+
+func (m *BitfieldMessage) GetSessionToken() []byte {
+	if m != nil {
+		return m.SessionToken
+	}
+	return nil
+}
+
+func (m *BitfieldMessage) GetResumeToken() []byte {
+	if m != nil {
+		return m.ResumeToken
+	}
+	return nil
+}
+
 // Requests a piece of the given index. Note: offset and length are unused fields
 // and if set, will be rejected.
 type PieceRequestMessage struct {
@@ -174,7 +297,8 @@ func (m *AnnouncePieceMessage) String() string            { return proto.Compact
 func (*AnnouncePieceMessage) ProtoMessage()               {}
 func (*AnnouncePieceMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
-// Unused.
+// Cancels a piece request, e.g. a duplicate request sent during endgame which
+// was already served by another peer.
 type CancelPieceMessage struct {
 	Index int32 `protobuf:"varint,2,opt,name=index" json:"index,omitempty"`
 }
@@ -206,22 +330,137 @@ func (m *CompleteMessage) String() string            { return proto.CompactTextS
 func (*CompleteMessage) ProtoMessage()               {}
 func (*CompleteMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
 
+// Sent in place of a bitfield message when rejecting an incoming handshake,
+// immediately before closing the connection. Allows the connection opener to
+// decide whether to retry or blacklist based on the reason.
+type RejectMessage struct {
+	Reason RejectMessage_Reason `protobuf:"varint,1,opt,name=reason,enum=p2p.RejectMessage_Reason" json:"reason,omitempty"`
+	Error  string               `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *RejectMessage) Reset()                    { *m = RejectMessage{} }
+func (m *RejectMessage) String() string            { return proto.CompactTextString(m) }
+func (*RejectMessage) ProtoMessage()               {}
+func (*RejectMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+// Sent immediately before gracefully closing a connection, once all queued
+// messages have been flushed. Allows the receiver to release any state for
+// requests which will not be served.
+type GoodbyeMessage struct {
+}
+
+func (m *GoodbyeMessage) Reset()                    { *m = GoodbyeMessage{} }
+func (m *GoodbyeMessage) String() string            { return proto.CompactTextString(m) }
+func (*GoodbyeMessage) ProtoMessage()               {}
+func (*GoodbyeMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+// Periodically sent on idle conns, carrying the pieces the sender gained since
+// its previous heartbeat on the conn. Keeps availability of the receiver fresh
+// should any announce piece messages have been dropped.
+type HeartbeatMessage struct {
+	Pieces []int32 `protobuf:"varint,1,rep,packed,name=pieces" json:"pieces,omitempty"`
+}
+
+func (m *HeartbeatMessage) Reset()                    { *m = HeartbeatMessage{} }
+func (m *HeartbeatMessage) String() string            { return proto.CompactTextString(m) }
+func (*HeartbeatMessage) ProtoMessage()               {}
+func (*HeartbeatMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *HeartbeatMessage) GetPieces() []int32 {
+	if m != nil {
+		return m.Pieces
+	}
+	return nil
+}
+
+// Requests the expected hash of a piece from a peer which has the piece. Sent
+// when repeated hash mismatches of the piece from distinct peers suggest that
+// the local metainfo is corrupt, rather than the peers.
+type PieceHashRequestMessage struct {
+	Index int32 `protobuf:"varint,1,opt,name=index" json:"index,omitempty"`
+}
+
+func (m *PieceHashRequestMessage) Reset()                    { *m = PieceHashRequestMessage{} }
+func (m *PieceHashRequestMessage) String() string            { return proto.CompactTextString(m) }
+func (*PieceHashRequestMessage) ProtoMessage()               {}
+func (*PieceHashRequestMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *PieceHashRequestMessage) GetIndex() int32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+// Reply to a piece hash request. The hash is encoded as the sum of the piece
+// hash algorithm of the torrent, and is empty if the sender cannot vouch for
+// the piece.
+type PieceHashMessage struct {
+	Index int32  `protobuf:"varint,1,opt,name=index" json:"index,omitempty"`
+	Hash  []byte `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+}
+
+func (m *PieceHashMessage) Reset()                    { *m = PieceHashMessage{} }
+func (m *PieceHashMessage) String() string            { return proto.CompactTextString(m) }
+func (*PieceHashMessage) ProtoMessage()               {}
+func (*PieceHashMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *PieceHashMessage) GetIndex() int32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *PieceHashMessage) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+// Requests a batch of full pieces in a single frame. Indices are delta
+// encoded: the first delta is the first index, and every further delta is the
+// difference to the previous index. Indices are strictly increasing, such
+// that runs of pieces encode as small varints.
+type PieceRequestBatchMessage struct {
+	IndexDeltas []int32 `protobuf:"varint,1,rep,packed,name=indexDeltas" json:"indexDeltas,omitempty"`
+}
+
+func (m *PieceRequestBatchMessage) Reset()                    { *m = PieceRequestBatchMessage{} }
+func (m *PieceRequestBatchMessage) String() string            { return proto.CompactTextString(m) }
+func (*PieceRequestBatchMessage) ProtoMessage()               {}
+func (*PieceRequestBatchMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *PieceRequestBatchMessage) GetIndexDeltas() []int32 {
+	if m != nil {
+		return m.IndexDeltas
+	}
+	return nil
+}
+
 type Message struct {
-	Version       string                `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
-	Type          Message_Type          `protobuf:"varint,2,opt,name=type,enum=p2p.Message_Type" json:"type,omitempty"`
-	Bitfield      *BitfieldMessage      `protobuf:"bytes,3,opt,name=bitfield" json:"bitfield,omitempty"`
-	PieceRequest  *PieceRequestMessage  `protobuf:"bytes,4,opt,name=pieceRequest" json:"pieceRequest,omitempty"`
-	PiecePayload  *PiecePayloadMessage  `protobuf:"bytes,5,opt,name=piecePayload" json:"piecePayload,omitempty"`
-	AnnouncePiece *AnnouncePieceMessage `protobuf:"bytes,6,opt,name=announcePiece" json:"announcePiece,omitempty"`
-	CancelPiece   *CancelPieceMessage   `protobuf:"bytes,7,opt,name=cancelPiece" json:"cancelPiece,omitempty"`
-	Error         *ErrorMessage         `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
-	Complete      *CompleteMessage      `protobuf:"bytes,9,opt,name=complete" json:"complete,omitempty"`
+	Version           string                    `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
+	Type              Message_Type              `protobuf:"varint,2,opt,name=type,enum=p2p.Message_Type" json:"type,omitempty"`
+	Bitfield          *BitfieldMessage          `protobuf:"bytes,3,opt,name=bitfield" json:"bitfield,omitempty"`
+	PieceRequest      *PieceRequestMessage      `protobuf:"bytes,4,opt,name=pieceRequest" json:"pieceRequest,omitempty"`
+	PiecePayload      *PiecePayloadMessage      `protobuf:"bytes,5,opt,name=piecePayload" json:"piecePayload,omitempty"`
+	AnnouncePiece     *AnnouncePieceMessage     `protobuf:"bytes,6,opt,name=announcePiece" json:"announcePiece,omitempty"`
+	CancelPiece       *CancelPieceMessage       `protobuf:"bytes,7,opt,name=cancelPiece" json:"cancelPiece,omitempty"`
+	Error             *ErrorMessage             `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
+	Complete          *CompleteMessage          `protobuf:"bytes,9,opt,name=complete" json:"complete,omitempty"`
+	Reject            *RejectMessage            `protobuf:"bytes,10,opt,name=reject" json:"reject,omitempty"`
+	Goodbye           *GoodbyeMessage           `protobuf:"bytes,11,opt,name=goodbye" json:"goodbye,omitempty"`
+	Heartbeat         *HeartbeatMessage         `protobuf:"bytes,12,opt,name=heartbeat" json:"heartbeat,omitempty"`
+	PieceHashRequest  *PieceHashRequestMessage  `protobuf:"bytes,13,opt,name=pieceHashRequest" json:"pieceHashRequest,omitempty"`
+	PieceHash         *PieceHashMessage         `protobuf:"bytes,14,opt,name=pieceHash" json:"pieceHash,omitempty"`
+	PieceRequestBatch *PieceRequestBatchMessage `protobuf:"bytes,15,opt,name=pieceRequestBatch" json:"pieceRequestBatch,omitempty"`
 }
 
 func (m *Message) Reset()                    { *m = Message{} }
 func (m *Message) String() string            { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()               {}
-func (*Message) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+func (*Message) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
 
 func (m *Message) GetBitfield() *BitfieldMessage {
 	if m != nil {
@@ -272,6 +511,48 @@ func (m *Message) GetComplete() *CompleteMessage {
 	return nil
 }
 
+func (m *Message) GetReject() *RejectMessage {
+	if m != nil {
+		return m.Reject
+	}
+	return nil
+}
+
+func (m *Message) GetGoodbye() *GoodbyeMessage {
+	if m != nil {
+		return m.Goodbye
+	}
+	return nil
+}
+
+func (m *Message) GetHeartbeat() *HeartbeatMessage {
+	if m != nil {
+		return m.Heartbeat
+	}
+	return nil
+}
+
+func (m *Message) GetPieceHashRequest() *PieceHashRequestMessage {
+	if m != nil {
+		return m.PieceHashRequest
+	}
+	return nil
+}
+
+func (m *Message) GetPieceHash() *PieceHashMessage {
+	if m != nil {
+		return m.PieceHash
+	}
+	return nil
+}
+
+func (m *Message) GetPieceRequestBatch() *PieceRequestBatchMessage {
+	if m != nil {
+		return m.PieceRequestBatch
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*BitfieldMessage)(nil), "p2p.BitfieldMessage")
 	proto.RegisterType((*PieceRequestMessage)(nil), "p2p.PieceRequestMessage")
@@ -280,54 +561,88 @@ func init() {
 	proto.RegisterType((*CancelPieceMessage)(nil), "p2p.CancelPieceMessage")
 	proto.RegisterType((*ErrorMessage)(nil), "p2p.ErrorMessage")
 	proto.RegisterType((*CompleteMessage)(nil), "p2p.CompleteMessage")
+	proto.RegisterType((*RejectMessage)(nil), "p2p.RejectMessage")
+	proto.RegisterType((*GoodbyeMessage)(nil), "p2p.GoodbyeMessage")
+	proto.RegisterType((*HeartbeatMessage)(nil), "p2p.HeartbeatMessage")
+	proto.RegisterType((*PieceHashRequestMessage)(nil), "p2p.PieceHashRequestMessage")
+	proto.RegisterType((*PieceHashMessage)(nil), "p2p.PieceHashMessage")
+	proto.RegisterType((*PieceRequestBatchMessage)(nil), "p2p.PieceRequestBatchMessage")
 	proto.RegisterType((*Message)(nil), "p2p.Message")
 	proto.RegisterEnum("p2p.ErrorMessage_ErrorCode", ErrorMessage_ErrorCode_name, ErrorMessage_ErrorCode_value)
+	proto.RegisterEnum("p2p.RejectMessage_Reason", RejectMessage_Reason_name, RejectMessage_Reason_value)
 	proto.RegisterEnum("p2p.Message_Type", Message_Type_name, Message_Type_value)
 }
 
 func init() { proto.RegisterFile("proto/p2p/p2p.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 647 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xac, 0x54, 0x4f, 0x6f, 0xd3, 0x4e,
-	0x10, 0x6d, 0x12, 0x3b, 0x7f, 0x26, 0x69, 0xeb, 0x6c, 0xa3, 0xdf, 0xcf, 0x14, 0x0e, 0x95, 0x45,
-	0x45, 0x85, 0xa0, 0xad, 0xcc, 0x05, 0x10, 0x12, 0x4a, 0x1c, 0x57, 0x44, 0x4a, 0x9b, 0xb0, 0xa4,
-	0x07, 0xc4, 0xa1, 0x72, 0x9d, 0x49, 0x6b, 0x91, 0x7a, 0x8d, 0xed, 0x56, 0xcd, 0xd7, 0xe0, 0x43,
-	0x21, 0xf1, 0xad, 0xd0, 0x4e, 0xec, 0xc4, 0x6e, 0x02, 0xe2, 0xc0, 0x21, 0x92, 0xdf, 0xf3, 0x7b,
-	0xb3, 0xb3, 0x33, 0x2f, 0x86, 0x9d, 0x20, 0x14, 0xb1, 0x38, 0x0a, 0xcc, 0x40, 0xfe, 0x0e, 0x09,
-	0xb1, 0x52, 0x60, 0x06, 0xc6, 0x8f, 0x22, 0x6c, 0x77, 0xbc, 0x78, 0xe2, 0xe1, 0x74, 0x7c, 0x8a,
-	0x51, 0xe4, 0x5c, 0x21, 0xdb, 0x85, 0xaa, 0xe7, 0x4f, 0xc4, 0x07, 0x27, 0xba, 0xd6, 0x8b, 0x7b,
-	0x85, 0x83, 0x1a, 0x5f, 0x60, 0xc6, 0x40, 0xf1, 0x9d, 0x1b, 0xd4, 0x4b, 0xc4, 0xd3, 0x33, 0xfb,
-	0x0f, 0xca, 0x01, 0x62, 0xd8, 0xeb, 0xea, 0x0a, 0xb1, 0x09, 0x62, 0x4f, 0x61, 0xf3, 0x32, 0x29,
-	0xdd, 0x99, 0xc5, 0x18, 0xe9, 0xea, 0x5e, 0xe1, 0xa0, 0xc1, 0xf3, 0x24, 0x7b, 0x02, 0x35, 0x59,
-	0x25, 0x0a, 0x1c, 0x17, 0xf5, 0x32, 0x15, 0x58, 0x12, 0xec, 0x02, 0x76, 0x42, 0xbc, 0x11, 0x31,
-	0x76, 0x72, 0x95, 0x2a, 0x7b, 0xa5, 0x83, 0xba, 0xf9, 0xf2, 0x50, 0xde, 0xe6, 0x41, 0xfb, 0x87,
-	0x7c, 0x55, 0x6f, 0xfb, 0x71, 0x38, 0xe3, 0xeb, 0x2a, 0xed, 0x9e, 0x80, 0xfe, 0x3b, 0x03, 0xd3,
-	0xa0, 0xf4, 0x15, 0x67, 0x7a, 0x81, 0x9a, 0x92, 0x8f, 0xac, 0x05, 0xea, 0x9d, 0x33, 0xbd, 0x45,
-	0x9a, 0x4b, 0x83, 0xcf, 0xc1, 0xdb, 0xe2, 0xeb, 0x82, 0xf1, 0x05, 0x76, 0x86, 0x1e, 0xba, 0xc8,
-	0xf1, 0xdb, 0x2d, 0x46, 0x71, 0x3a, 0xcb, 0x16, 0xa8, 0x9e, 0x3f, 0xc6, 0x7b, 0x32, 0xa8, 0x7c,
-	0x0e, 0xe4, 0xc4, 0xc4, 0x64, 0x12, 0x61, 0x4c, 0x73, 0x54, 0x79, 0x82, 0x24, 0x3f, 0x45, 0xff,
-	0x2a, 0xbe, 0xa6, 0x49, 0xaa, 0x3c, 0x41, 0x46, 0x94, 0x14, 0x1f, 0x3a, 0xb3, 0xa9, 0x70, 0xc6,
-	0xff, 0xb4, 0xb8, 0xe4, 0xc7, 0xde, 0x15, 0x46, 0x31, 0xed, 0xa7, 0xc6, 0x13, 0x64, 0xbc, 0x80,
-	0x56, 0xdb, 0xf7, 0xc5, 0xad, 0xef, 0x22, 0x1d, 0xfe, 0xc7, 0x53, 0x8d, 0xe7, 0xc0, 0x2c, 0xc7,
-	0x77, 0x71, 0xfa, 0x17, 0xda, 0xef, 0x05, 0x68, 0xd8, 0x61, 0x28, 0xc2, 0x8c, 0x0c, 0x25, 0x4e,
-	0xe2, 0x36, 0x07, 0x4b, 0x73, 0x29, 0x7b, 0xbd, 0x23, 0x50, 0x5c, 0x31, 0x46, 0xba, 0xc4, 0x96,
-	0xf9, 0x98, 0x22, 0x90, 0x2d, 0x36, 0x07, 0x96, 0x18, 0x23, 0x27, 0xa1, 0xb1, 0x0f, 0xb5, 0x05,
-	0xc5, 0x74, 0x68, 0x0d, 0x7b, 0xb6, 0x65, 0x5f, 0x70, 0xfb, 0xe3, 0xb9, 0xfd, 0x69, 0x74, 0x71,
-	0xd2, 0xee, 0xf5, 0xed, 0xae, 0xb6, 0x61, 0x34, 0x61, 0xdb, 0x12, 0x37, 0xc1, 0x14, 0xe3, 0xb4,
-	0x7b, 0xe3, 0xa7, 0x02, 0x95, 0xb4, 0x45, 0x1d, 0x2a, 0x77, 0x18, 0x46, 0x9e, 0xf0, 0x93, 0x3c,
-	0xa4, 0x90, 0xed, 0x83, 0x12, 0xcf, 0x82, 0x79, 0x24, 0xb6, 0xcc, 0x26, 0x35, 0x94, 0xf6, 0x32,
-	0x9a, 0x05, 0xc8, 0xe9, 0x35, 0x3b, 0x86, 0x6a, 0x1a, 0x7c, 0xba, 0x50, 0xdd, 0x6c, 0xad, 0x8b,
-	0x2f, 0x5f, 0xa8, 0xd8, 0x3b, 0x68, 0x04, 0x99, 0x48, 0xd1, 0x8d, 0xeb, 0xa6, 0x4e, 0xae, 0x35,
-	0x59, 0xe3, 0x39, 0xf5, 0xc2, 0x9d, 0x64, 0x86, 0x96, 0x9b, 0x73, 0xe7, 0xc3, 0xc4, 0x73, 0x6a,
-	0xf6, 0x1e, 0x36, 0x9d, 0xec, 0xf2, 0xe9, 0x9f, 0x59, 0x37, 0x1f, 0x91, 0x7d, 0x5d, 0x2c, 0x78,
-	0x5e, 0xcf, 0xde, 0x40, 0xdd, 0x5d, 0xe6, 0x41, 0xaf, 0x90, 0xfd, 0x7f, 0xb2, 0xaf, 0xe6, 0x84,
-	0x67, 0xb5, 0xec, 0x59, 0x9a, 0x86, 0x2a, 0x99, 0x9a, 0x2b, 0x2b, 0x4e, 0x03, 0x72, 0x0c, 0x55,
-	0x37, 0x59, 0x99, 0x5e, 0xcb, 0x8c, 0xf4, 0xc1, 0x1e, 0xf9, 0x42, 0x65, 0xdc, 0x83, 0x22, 0x57,
-	0xc2, 0x1a, 0x50, 0xed, 0xf4, 0x46, 0x27, 0x3d, 0xbb, 0xdf, 0xd5, 0x36, 0x58, 0x13, 0x36, 0x73,
-	0xa1, 0xd0, 0x0a, 0x4b, 0x6a, 0xd8, 0xfe, 0xdc, 0x1f, 0xb4, 0xbb, 0x5a, 0x51, 0x52, 0xed, 0xb3,
-	0xb3, 0xc1, 0xb9, 0x24, 0xe5, 0x2b, 0xad, 0xc4, 0x34, 0x68, 0x58, 0xed, 0x33, 0xcb, 0xee, 0x27,
-	0x8c, 0xc2, 0x6a, 0xa0, 0xda, 0x9c, 0x0f, 0xb8, 0xa6, 0xca, 0x33, 0xac, 0xc1, 0xe9, 0xb0, 0x6f,
-	0x8f, 0x6c, 0xad, 0x7c, 0x59, 0xa6, 0x8f, 0xee, 0xab, 0x5f, 0x01, 0x00, 0x00, 0xff, 0xff, 0xfd,
-	0x11, 0xd8, 0xe6, 0x8b, 0x05, 0x00, 0x00,
+	// 1084 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xdd, 0x6e, 0xdb, 0x46,
+	0x13, 0x0d, 0xad, 0xff, 0xa1, 0x24, 0xaf, 0xd7, 0xfe, 0x92, 0xfd, 0xd2, 0xb4, 0x10, 0x88, 0x16,
+	0x15, 0x8c, 0xc6, 0x4e, 0x95, 0x9b, 0xb6, 0x30, 0x50, 0x50, 0x14, 0x6d, 0xa9, 0x71, 0x24, 0x75,
+	0x4d, 0xb7, 0x30, 0x7a, 0x61, 0xd0, 0xd4, 0xda, 0x56, 0x23, 0x93, 0x0c, 0x49, 0x1b, 0xd5, 0x53,
+	0xf4, 0x05, 0x8a, 0x3e, 0x41, 0x5f, 0xaa, 0x6f, 0x52, 0xec, 0xf0, 0x47, 0xa4, 0xe4, 0x04, 0xbd,
+	0xe8, 0x85, 0x00, 0xce, 0xe1, 0x99, 0xd9, 0xd9, 0xdd, 0x39, 0x87, 0x82, 0x5d, 0x3f, 0xf0, 0x22,
+	0xef, 0xd0, 0xef, 0xf9, 0xf2, 0x77, 0x80, 0x11, 0x2d, 0xf9, 0x3d, 0x5f, 0xfb, 0xab, 0x0c, 0xdb,
+	0xfd, 0x79, 0x74, 0x3d, 0x17, 0x8b, 0xd9, 0x5b, 0x11, 0x86, 0xf6, 0x8d, 0xa0, 0xcf, 0xa1, 0x3e,
+	0x77, 0xaf, 0xbd, 0xa1, 0x1d, 0xde, 0xb2, 0xad, 0x8e, 0xd2, 0x6d, 0xf0, 0x2c, 0xa6, 0x14, 0xca,
+	0xae, 0x7d, 0x27, 0x58, 0x09, 0x71, 0x7c, 0xa6, 0x4f, 0xa1, 0xea, 0x0b, 0x11, 0x8c, 0x06, 0xac,
+	0x8c, 0x68, 0x12, 0xd1, 0xcf, 0xa1, 0x75, 0x95, 0x94, 0xee, 0x2f, 0x23, 0x11, 0xb2, 0x4a, 0x47,
+	0xe9, 0x36, 0x79, 0x11, 0xa4, 0x2f, 0xa0, 0x21, 0xab, 0x84, 0xbe, 0xed, 0x08, 0x56, 0xc5, 0x02,
+	0x2b, 0x80, 0x5e, 0xc2, 0x6e, 0x20, 0xee, 0xbc, 0x48, 0xf4, 0x0b, 0x95, 0x6a, 0x9d, 0x52, 0x57,
+	0xed, 0xbd, 0x3c, 0x90, 0xbb, 0x59, 0x6b, 0xff, 0x80, 0x6f, 0xf2, 0x4d, 0x37, 0x0a, 0x96, 0xfc,
+	0xb1, 0x4a, 0xb4, 0x0b, 0xdb, 0x78, 0x1c, 0x8e, 0xb7, 0xf8, 0x49, 0x04, 0xe1, 0xdc, 0x73, 0x59,
+	0xbd, 0xa3, 0x74, 0x5b, 0x7c, 0x1d, 0xa6, 0x0c, 0x6a, 0xb7, 0xf6, 0x83, 0x38, 0x13, 0xef, 0x59,
+	0xa3, 0xa3, 0x74, 0xcb, 0x3c, 0x0d, 0xe5, 0x16, 0xf0, 0x71, 0xee, 0x3a, 0x82, 0x01, 0xbe, 0x5b,
+	0x01, 0xe9, 0xdb, 0x81, 0x58, 0x44, 0x36, 0x53, 0x3b, 0x4a, 0xb7, 0xce, 0x57, 0x00, 0xfd, 0x0c,
+	0x40, 0x06, 0xd3, 0xb9, 0x70, 0x44, 0xc8, 0x9a, 0x9d, 0x52, 0xb7, 0xc2, 0x73, 0x08, 0xd5, 0xa0,
+	0x19, 0x8a, 0x50, 0x36, 0x60, 0x79, 0xef, 0x84, 0xcb, 0x5a, 0x78, 0x86, 0x05, 0x8c, 0x76, 0x40,
+	0x0d, 0x44, 0x78, 0x7f, 0x27, 0x62, 0x4a, 0x1b, 0x29, 0x79, 0xe8, 0xf9, 0x31, 0xb0, 0x0f, 0x1d,
+	0x0b, 0x25, 0x50, 0x7a, 0x27, 0x96, 0x4c, 0xc1, 0xa3, 0x97, 0x8f, 0x74, 0x0f, 0x2a, 0x0f, 0xf6,
+	0xe2, 0x5e, 0xe0, 0xed, 0x37, 0x79, 0x1c, 0x7c, 0xb7, 0xf5, 0x8d, 0xa2, 0xfd, 0x02, 0xbb, 0xd8,
+	0x17, 0x17, 0xef, 0xef, 0x45, 0x18, 0xa5, 0x13, 0xb3, 0x07, 0x95, 0xb9, 0x3b, 0x13, 0xbf, 0x61,
+	0x42, 0x85, 0xc7, 0x81, 0x9c, 0x0b, 0xef, 0xfa, 0x3a, 0x14, 0x11, 0x4e, 0x4b, 0x85, 0x27, 0x91,
+	0xc4, 0x17, 0xc2, 0xbd, 0x89, 0x6e, 0x71, 0x5e, 0x2a, 0x3c, 0x89, 0xb4, 0x30, 0x29, 0x3e, 0xb5,
+	0x97, 0x0b, 0xcf, 0x9e, 0xfd, 0xa7, 0xc5, 0x25, 0x3e, 0x9b, 0xdf, 0x88, 0x30, 0xc2, 0x29, 0x6c,
+	0xf0, 0x24, 0xd2, 0xbe, 0x82, 0x3d, 0xdd, 0x75, 0xbd, 0x7b, 0xd7, 0x89, 0x4f, 0xfc, 0xa3, 0xab,
+	0x6a, 0xfb, 0x40, 0x0d, 0xdb, 0x75, 0xc4, 0xe2, 0x5f, 0x70, 0xff, 0x50, 0xa0, 0x69, 0x06, 0x81,
+	0x17, 0xe4, 0x68, 0x42, 0xc6, 0x89, 0xa8, 0xe2, 0x60, 0x95, 0x5c, 0xca, 0x6f, 0xef, 0x10, 0xca,
+	0x8e, 0x37, 0x13, 0xb8, 0x89, 0x76, 0xef, 0x13, 0x1c, 0xf4, 0x7c, 0xb1, 0x38, 0x30, 0xbc, 0x99,
+	0xe0, 0x48, 0xd4, 0x0e, 0xa1, 0x91, 0x41, 0x94, 0xc1, 0xde, 0x74, 0x64, 0x1a, 0xe6, 0x25, 0x37,
+	0x7f, 0x3c, 0x37, 0xcf, 0xac, 0xcb, 0x63, 0x7d, 0x74, 0x6a, 0x0e, 0xc8, 0x13, 0x5a, 0x87, 0x72,
+	0xff, 0xfc, 0xec, 0x82, 0x28, 0xda, 0x0e, 0x6c, 0x1b, 0xde, 0x9d, 0xbf, 0x10, 0x51, 0xba, 0x0f,
+	0xed, 0x4f, 0x05, 0x5a, 0x5c, 0xfc, 0x2a, 0x9c, 0xec, 0x62, 0xbf, 0x86, 0x6a, 0x20, 0xec, 0xd0,
+	0x73, 0x71, 0x3c, 0xda, 0xbd, 0xff, 0x63, 0x23, 0x05, 0xce, 0x01, 0x47, 0x02, 0x4f, 0x88, 0x8f,
+	0xef, 0x52, 0x1b, 0x40, 0x35, 0xe6, 0xd1, 0x06, 0x54, 0x26, 0xd6, 0xd0, 0xe4, 0xe4, 0x09, 0x25,
+	0xd0, 0x3c, 0x1f, 0xbf, 0x19, 0x4f, 0x7e, 0x1e, 0x5f, 0x0e, 0xf5, 0xb3, 0x21, 0x51, 0xe8, 0x36,
+	0xa8, 0xba, 0x75, 0x69, 0xe8, 0x53, 0xdd, 0x18, 0x59, 0x17, 0x64, 0x8b, 0x36, 0xa1, 0x3e, 0xe0,
+	0xfa, 0x68, 0x3c, 0x1a, 0x9f, 0x90, 0x92, 0x46, 0xa0, 0x7d, 0xe2, 0x79, 0xb3, 0xab, 0x65, 0xd6,
+	0xf2, 0x3e, 0x90, 0xa1, 0xb0, 0x83, 0xe8, 0x4a, 0xd8, 0x59, 0xd3, 0xd2, 0x8f, 0x62, 0x39, 0x29,
+	0x28, 0xa7, 0x24, 0xd2, 0x0e, 0xe1, 0x19, 0x5e, 0x9b, 0x34, 0xb2, 0x0f, 0x0d, 0xb0, 0x92, 0xbf,
+	0xc1, 0x23, 0x20, 0x59, 0xc2, 0x47, 0x99, 0xd2, 0x16, 0x6f, 0x53, 0xbb, 0x6c, 0x72, 0x7c, 0xd6,
+	0x8e, 0x80, 0xe5, 0xb5, 0xd2, 0xb7, 0x23, 0x27, 0xab, 0xd2, 0x01, 0x15, 0x13, 0xd1, 0x03, 0xd2,
+	0x3e, 0xf3, 0x90, 0xf6, 0x7b, 0x1d, 0x6a, 0x29, 0x9b, 0x41, 0xed, 0x21, 0xf1, 0xa6, 0x58, 0xa5,
+	0x69, 0x48, 0xbf, 0x80, 0x72, 0xb4, 0xf4, 0x63, 0xa1, 0xb6, 0x7b, 0x3b, 0x78, 0x3b, 0xe9, 0xbd,
+	0x58, 0x4b, 0x5f, 0x70, 0x7c, 0x4d, 0x5f, 0x41, 0x3d, 0x35, 0x5d, 0x1c, 0x33, 0xb5, 0xb7, 0xf7,
+	0x98, 0x75, 0xf2, 0x8c, 0x45, 0x8f, 0xa0, 0xe9, 0xe7, 0x9a, 0xc7, 0x39, 0x54, 0x7b, 0x0c, 0xb3,
+	0x1e, 0x71, 0x00, 0x5e, 0x60, 0x67, 0xd9, 0x89, 0x92, 0x59, 0x65, 0x3d, 0xbb, 0x28, 0x71, 0x5e,
+	0x60, 0xd3, 0xef, 0xa1, 0x65, 0xe7, 0x25, 0x89, 0x5f, 0x05, 0x35, 0x99, 0xbd, 0xc7, 0xc4, 0xca,
+	0x8b, 0x7c, 0xfa, 0x2d, 0xa8, 0xce, 0x4a, 0xa5, 0xac, 0x86, 0xe9, 0xcf, 0x30, 0x7d, 0x53, 0xbd,
+	0x3c, 0xcf, 0xa5, 0x5f, 0xa6, 0xd3, 0x5b, 0xc7, 0xa4, 0x9d, 0x0d, 0xe1, 0xa5, 0xb2, 0x7d, 0x05,
+	0x75, 0x27, 0x91, 0x0f, 0x6b, 0xe4, 0x8e, 0x74, 0x4d, 0x53, 0x3c, 0x63, 0xd1, 0x7d, 0xa9, 0x25,
+	0x29, 0x1c, 0xfc, 0x44, 0xa8, 0x3d, 0xba, 0xa9, 0x25, 0x9e, 0x30, 0xe8, 0x4b, 0xa8, 0xdd, 0xc4,
+	0x83, 0x8e, 0x5f, 0x0c, 0xb5, 0xb7, 0x8b, 0xe4, 0xe2, 0xf0, 0xf3, 0x94, 0x43, 0x5f, 0x43, 0xe3,
+	0x36, 0x55, 0x01, 0x6b, 0x62, 0xc2, 0xff, 0x30, 0x61, 0x5d, 0x1b, 0x7c, 0xc5, 0xa3, 0x43, 0x20,
+	0xfe, 0x9a, 0x1c, 0xf0, 0xeb, 0xa2, 0xf6, 0x5e, 0xac, 0x2e, 0x6a, 0x53, 0x2b, 0x7c, 0x23, 0x4b,
+	0x2e, 0x9f, 0x61, 0xac, 0x9d, 0x5b, 0x7e, 0x5d, 0x3d, 0x7c, 0xc5, 0xa3, 0x6f, 0x60, 0xc7, 0x5f,
+	0x97, 0x07, 0xdb, 0xc6, 0xe4, 0x4f, 0x37, 0xc6, 0x2c, 0x2f, 0x1e, 0xbe, 0x99, 0xa7, 0xfd, 0xad,
+	0x40, 0x59, 0xce, 0xbb, 0xf4, 0x8b, 0xfe, 0xc8, 0x3a, 0x1e, 0x99, 0xa7, 0xd2, 0xed, 0x76, 0xa0,
+	0x55, 0xf0, 0x41, 0xa2, 0xac, 0xa0, 0xa9, 0x7e, 0x71, 0x3a, 0xd1, 0x07, 0x64, 0x4b, 0x42, 0xfa,
+	0x78, 0x3c, 0x39, 0x97, 0xa0, 0x7c, 0x45, 0x4a, 0xd2, 0x99, 0x0c, 0x7d, 0x6c, 0x98, 0xa7, 0x09,
+	0x52, 0x96, 0xb6, 0x65, 0x72, 0x3e, 0xe1, 0xa4, 0x22, 0xd7, 0x30, 0x26, 0x6f, 0xa7, 0xa7, 0xa6,
+	0x65, 0x92, 0x2a, 0x05, 0xa8, 0x72, 0xf3, 0x07, 0xd3, 0xb0, 0x48, 0x8d, 0xaa, 0x50, 0x3b, 0x99,
+	0x4c, 0x06, 0xfd, 0x0b, 0x93, 0xd4, 0x69, 0x0b, 0x1a, 0x43, 0x53, 0xe7, 0x56, 0xdf, 0xd4, 0x2d,
+	0xd2, 0xa0, 0x4f, 0x81, 0xc6, 0x0b, 0x4b, 0xab, 0xcb, 0x1a, 0x02, 0xda, 0x06, 0x58, 0xe1, 0x44,
+	0xa5, 0xcf, 0x60, 0xb7, 0xe8, 0xdd, 0x7d, 0xdd, 0x32, 0x86, 0xa4, 0x79, 0x55, 0xc5, 0x3f, 0x24,
+	0xaf, 0xff, 0x19, 0x00, 0x9a, 0x74, 0xf0, 0x3a, 0xcd, 0x09, 0x00, 0x00,
 }
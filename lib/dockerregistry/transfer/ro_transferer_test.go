@@ -15,6 +15,7 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -72,7 +73,7 @@ func TestReadOnlyTransfererDownloadCachesBlob(t *testing.T) {
 	blob := core.NewBlobFixture()
 
 	mocks.sched.EXPECT().Download(
-		namespace, blob.Digest).DoAndReturn(func(namespace string, d core.Digest) error {
+		gomock.Any(), namespace, blob.Digest).DoAndReturn(func(ctx context.Context, namespace string, d core.Digest) error {
 
 		return store.RunDownload(mocks.cads, d, blob.Content)
 	})
@@ -99,7 +100,7 @@ func TestReadOnlyTransfererStat(t *testing.T) {
 	blob := core.NewBlobFixture()
 
 	mocks.sched.EXPECT().Download(
-		namespace, blob.Digest).DoAndReturn(func(namespace string, d core.Digest) error {
+		gomock.Any(), namespace, blob.Digest).DoAndReturn(func(ctx context.Context, namespace string, d core.Digest) error {
 
 		return store.RunDownload(mocks.cads, d, blob.Content)
 	})
@@ -169,7 +170,7 @@ func TestReadOnlyTransfererMultipleDownloadsOfSameBlob(t *testing.T) {
 	commit := make(chan struct{})
 
 	mocks.sched.EXPECT().Download(
-		namespace, blob.Digest).DoAndReturn(func(namespace string, d core.Digest) error {
+		gomock.Any(), namespace, blob.Digest).DoAndReturn(func(ctx context.Context, namespace string, d core.Digest) error {
 
 		<-commit
 
@@ -17,12 +17,19 @@ import (
 	"errors"
 	"sort"
 
+	"github.com/uber/kraken/core"
+
 	"github.com/c2h5oh/datasize"
 )
 
 // Config defines Generator configuration.
 type Config struct {
 	PieceLengths map[datasize.ByteSize]datasize.ByteSize `yaml:"piece_lengths"`
+
+	// PieceHashAlgorithm is the hash used to sum pieces of generated metainfo.
+	// Must be one of "sha1", "sha256", or "blake3". Defaults to CRC32. Note,
+	// agents must support the configured algorithm before it is changed.
+	PieceHashAlgorithm core.PieceHashAlgorithm `yaml:"piece_hash_algorithm"`
 }
 
 type rangeConfig struct {
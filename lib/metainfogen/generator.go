@@ -24,8 +24,9 @@ import (
 // Generator wraps static piece length configuration in order to determinstically
 // generate metainfo.
 type Generator struct {
-	pieceLengthConfig *pieceLengthConfig
-	cas               *store.CAStore
+	pieceLengthConfig  *pieceLengthConfig
+	pieceHashAlgorithm core.PieceHashAlgorithm
+	cas                *store.CAStore
 }
 
 // New creates a new Generator.
@@ -34,7 +35,10 @@ func New(config Config, cas *store.CAStore) (*Generator, error) {
 	if err != nil {
 		return nil, fmt.Errorf("piece length config: %s", err)
 	}
-	return &Generator{plConfig, cas}, nil
+	if err := config.PieceHashAlgorithm.Validate(); err != nil {
+		return nil, fmt.Errorf("piece hash algorithm: %s", err)
+	}
+	return &Generator{plConfig, config.PieceHashAlgorithm, cas}, nil
 }
 
 // Generate generates metainfo for the blob of d and writes it to disk.
@@ -48,7 +52,8 @@ func (g *Generator) Generate(d core.Digest) error {
 		return fmt.Errorf("get cache file: %s", err)
 	}
 	pieceLength := g.pieceLengthConfig.get(info.Size())
-	mi, err := core.NewMetaInfo(d, f, pieceLength)
+	mi, err := core.NewMetaInfo(
+		d, f, pieceLength, core.WithPieceHashAlgorithm(g.pieceHashAlgorithm))
 	if err != nil {
 		return fmt.Errorf("create metainfo: %s", err)
 	}
@@ -17,11 +17,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/uber/kraken/lib/store/metadata"
 	"github.com/uber/kraken/utils/stringset"
@@ -397,7 +399,7 @@ func (entry *localFileEntry) Move(targetState FileState) error {
 	}
 
 	// Move data. This could be a slow operation if source and target are not on the same FS.
-	if err := os.Rename(sourcePath, targetPath); err != nil {
+	if err := moveData(sourcePath, targetPath); err != nil {
 		return err
 	}
 
@@ -408,6 +410,42 @@ func (entry *localFileEntry) Move(targetState FileState) error {
 	return os.RemoveAll(filepath.Dir(sourcePath))
 }
 
+// moveData renames sourcePath to targetPath, falling back to copying the data if
+// the paths are on different filesystems. The source is left in place if the
+// data was copied.
+func moveData(sourcePath, targetPath string) error {
+	err := os.Rename(sourcePath, targetPath)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	// Copy to a temporary file first, such that an interrupted copy never
+	// leaves a truncated file at targetPath.
+	tmpPath := targetPath + ".tmp"
+	target, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("copy: %s", err)
+	}
+	if err := target.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, targetPath)
+}
+
 // LinkTo creates a hardlink to an unmanaged path.
 func (entry *localFileEntry) LinkTo(targetPath string) error {
 	// Create dir.
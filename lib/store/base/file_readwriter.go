@@ -63,6 +63,11 @@ func (readWriter localFileReadWriter) WriteAt(p []byte, offset int64) (int, erro
 	return readWriter.descriptor.WriteAt(p, offset)
 }
 
+// Sync commits the contents of the file to disk.
+func (readWriter localFileReadWriter) Sync() error {
+	return readWriter.descriptor.Sync()
+}
+
 // Read reads up to len(b) bytes from the File.
 func (readWriter localFileReadWriter) Read(p []byte) (int, error) {
 	return readWriter.descriptor.Read(p)
@@ -82,6 +87,11 @@ func (readWriter localFileReadWriter) Seek(offset int64, whence int) (int64, err
 	return readWriter.descriptor.Seek(offset, whence)
 }
 
+// Fd returns the file descriptor of the underlying OS.File object.
+func (readWriter localFileReadWriter) Fd() uintptr {
+	return readWriter.descriptor.Fd()
+}
+
 // Size returns the size of the file.
 func (readWriter localFileReadWriter) Size() int64 {
 	// Use file entry instead of descriptor, because descriptor could have been closed.
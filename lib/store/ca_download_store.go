@@ -14,12 +14,15 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/uber/kraken/lib/store/base"
 	"github.com/uber/kraken/lib/store/metadata"
 	"github.com/andres-erbsen/clock"
+	"github.com/docker/distribution/uuid"
 	"github.com/uber-go/tally"
 )
 
@@ -29,6 +32,8 @@ type CADownloadStore struct {
 	backend       base.FileStore
 	downloadState base.FileState
 	cacheState    base.FileState
+	coldState     base.FileState
+	tiered        bool // Whether coldState is enabled.
 	cleanup       *cleanupManager
 }
 
@@ -38,7 +43,11 @@ func NewCADownloadStore(config CADownloadStoreConfig, stats tally.Scope) (*CADow
 		"module": "cadownloadstore",
 	})
 
-	for _, dir := range []string{config.DownloadDir, config.CacheDir} {
+	dirs := []string{config.DownloadDir, config.CacheDir}
+	if config.ColdCacheDir != "" {
+		dirs = append(dirs, config.ColdCacheDir)
+	}
+	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0775); err != nil {
 			return nil, fmt.Errorf("mkdir %s: %s", dir, err)
 		}
@@ -61,10 +70,21 @@ func NewCADownloadStore(config CADownloadStoreConfig, stats tally.Scope) (*CADow
 		config.CacheCleanup,
 		backend.NewFileOp().AcceptState(cacheState))
 
+	var coldState base.FileState
+	if config.ColdCacheDir != "" {
+		coldState = base.NewFileState(config.ColdCacheDir)
+		cleanup.addJob(
+			"cold_cache",
+			config.ColdCacheCleanup,
+			backend.NewFileOp().AcceptState(coldState))
+	}
+
 	return &CADownloadStore{
 		backend:       backend,
 		downloadState: downloadState,
 		cacheState:    cacheState,
+		coldState:     coldState,
+		tiered:        config.ColdCacheDir != "",
 		cleanup:       cleanup,
 	}, nil
 }
@@ -89,6 +109,74 @@ func (s *CADownloadStore) MoveDownloadFileToCache(name string) error {
 	return s.backend.NewFileOp().AcceptState(s.downloadState).MoveFile(name, s.cacheState)
 }
 
+// MoveCacheFileToDownload moves a cache file of either tier back to the download
+// directory, such that it may be partially rewritten.
+func (s *CADownloadStore) MoveCacheFileToDownload(name string) error {
+	return s.Cache().op.MoveFile(name, s.downloadState)
+}
+
+// ColdTierEnabled returns true if s has a cold tier of cache files.
+func (s *CADownloadStore) ColdTierEnabled() bool {
+	return s.tiered
+}
+
+// MoveCacheFileToCold moves a cache file to the cold tier. Returns os.ErrExist
+// if the file is already in the cold tier.
+func (s *CADownloadStore) MoveCacheFileToCold(name string) error {
+	if !s.tiered {
+		return errors.New("cold tier disabled")
+	}
+	return s.backend.NewFileOp().AcceptState(s.cacheState).MoveFile(name, s.coldState)
+}
+
+// MoveColdFileToCache moves a cache file from the cold tier back to the hot
+// tier. Returns os.ErrExist if the file is already in the hot tier.
+func (s *CADownloadStore) MoveColdFileToCache(name string) error {
+	if !s.tiered {
+		return errors.New("cold tier disabled")
+	}
+	return s.backend.NewFileOp().AcceptState(s.coldState).MoveFile(name, s.cacheState)
+}
+
+// InColdTier returns true if cache file name is in the cold tier.
+func (s *CADownloadStore) InColdTier(name string) bool {
+	if !s.tiered {
+		return false
+	}
+	_, err := s.backend.NewFileOp().AcceptState(s.coldState).GetFileStat(name)
+	return err == nil
+}
+
+// LinkCacheFile registers the existing file at path as cache file name via a
+// symlink, such that it may be served without being copied. The file at path
+// must not be modified nor removed while linked. Deleting the cache file only
+// removes the link.
+func (s *CADownloadStore) LinkCacheFile(name, path string) error {
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("abs: %s", err)
+	}
+	tmp := filepath.Join(
+		s.downloadState.GetDirectory(), fmt.Sprintf("%s.%s.link", name, uuid.Generate().String()))
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("symlink: %s", err)
+	}
+	// No-op if the link was successfully moved.
+	defer os.Remove(tmp)
+
+	return s.backend.NewFileOp().MoveFileFrom(name, s.cacheState, tmp)
+}
+
+// DownloadDir returns the directory download files are stored in.
+func (s *CADownloadStore) DownloadDir() string {
+	return s.downloadState.GetDirectory()
+}
+
+// CacheDir returns the directory cache files are stored in.
+func (s *CADownloadStore) CacheDir() string {
+	return s.cacheState.GetDirectory()
+}
+
 // GetCacheFileReader gets a cache file reader. Implemented for compatibility with
 // other stores.
 func (s *CADownloadStore) GetCacheFileReader(name string) (FileReader, error) {
@@ -105,7 +193,7 @@ func (s *CADownloadStore) GetCacheFileStat(name string) (os.FileInfo, error) {
 // which do not accept files in cache state.
 func (s *CADownloadStore) InCacheError(err error) bool {
 	fse, ok := err.(*base.FileStateError)
-	return ok && fse.State == s.cacheState
+	return ok && (fse.State == s.cacheState || (s.tiered && fse.State == s.coldState))
 }
 
 // InDownloadError returns true for errors originating from file store operations
@@ -137,6 +225,9 @@ func (a *CADownloadStoreScope) download() *CADownloadStoreScope {
 
 func (a *CADownloadStoreScope) cache() *CADownloadStoreScope {
 	a.op = a.op.AcceptState(a.store.cacheState)
+	if a.store.tiered {
+		a.op = a.op.AcceptState(a.store.coldState)
+	}
 	return a
 }
 
@@ -145,7 +236,7 @@ func (s *CADownloadStore) Download() *CADownloadStoreScope {
 	return s.states().download()
 }
 
-// Cache scopes the store to files in the cache state.
+// Cache scopes the store to files in the cache state, of either tier.
 func (s *CADownloadStore) Cache() *CADownloadStoreScope {
 	return s.states().cache()
 }
@@ -170,6 +261,33 @@ func (a *CADownloadStoreScope) DeleteFile(name string) error {
 	return a.op.DeleteFile(name)
 }
 
+// ListNames returns the names of all files in the scoped states.
+func (a *CADownloadStoreScope) ListNames() ([]string, error) {
+	return a.op.ListNames()
+}
+
+// QuarantineFile moves name, along with its metadata, into a directory of the
+// same name under dir rather than deleting it. dir must be on the same
+// filesystem as the store. Returns base.ErrFilePersisted if name is persisted.
+func (a *CADownloadStoreScope) QuarantineFile(name, dir string) error {
+	path, err := a.op.GetFilePath(name)
+	if err != nil {
+		return err
+	}
+	var persist metadata.Persist
+	if err := a.op.GetFileMetadata(name, &persist); err == nil && persist.Value {
+		return base.ErrFilePersisted
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return fmt.Errorf("mkdir: %s", err)
+	}
+	if err := os.Rename(filepath.Dir(path), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+	// Only evicts name from the store, since its files were already moved.
+	return a.op.DeleteFile(name)
+}
+
 // GetMetadata returns the metadata content of md for name.
 func (a *CADownloadStoreScope) GetMetadata(name string, md metadata.Metadata) error {
 	return a.op.GetFileMetadata(name, md)
@@ -189,6 +307,11 @@ func (a *CADownloadStoreScope) SetMetadataAt(
 	return a.op.SetFileMetadataAt(name, md, b, offset)
 }
 
+// DeleteMetadata deletes the metadata content of md for name.
+func (a *CADownloadStoreScope) DeleteMetadata(name string, md metadata.Metadata) error {
+	return a.op.DeleteFileMetadata(name, md)
+}
+
 // GetOrSetMetadata returns the metadata content of md for name, or
 // initializes the metadata content to b if not set.
 func (a *CADownloadStoreScope) GetOrSetMetadata(name string, md metadata.Metadata) error {
@@ -14,7 +14,9 @@
 package store
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -49,3 +51,125 @@ func TestCADownloadStoreDownloadAndDeleteFiles(t *testing.T) {
 		require.True(os.IsNotExist(err))
 	}
 }
+
+func TestCADownloadStoreMoveCacheFileToDownload(t *testing.T) {
+	require := require.New(t)
+
+	s, cleanup := CADownloadStoreFixture()
+	defer cleanup()
+
+	name := core.DigestFixture().Hex()
+
+	require.NoError(s.CreateDownloadFile(name, 1))
+	require.Error(s.MoveCacheFileToDownload(name))
+
+	require.NoError(s.MoveDownloadFileToCache(name))
+	require.NoError(s.MoveCacheFileToDownload(name))
+
+	_, err := s.Download().GetFileStat(name)
+	require.NoError(err)
+	_, err = s.Cache().GetFileStat(name)
+	require.Error(err)
+}
+
+func TestCADownloadStoreLinkCacheFile(t *testing.T) {
+	require := require.New(t)
+
+	s, cleanup := CADownloadStoreFixture()
+	defer cleanup()
+
+	f, err := ioutil.TempFile("", "")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("some content"))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	name := core.DigestFixture().Hex()
+
+	require.NoError(s.LinkCacheFile(name, f.Name()))
+
+	r, err := s.Cache().GetFileReader(name)
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.NoError(r.Close())
+	require.Equal("some content", string(b))
+
+	// Deleting the cache file leaves the linked file untouched.
+	require.NoError(s.Cache().DeleteFile(name))
+	_, err = os.Stat(f.Name())
+	require.NoError(err)
+}
+
+func TestCADownloadStoreColdTier(t *testing.T) {
+	require := require.New(t)
+
+	s, cleanup := TieredCADownloadStoreFixture()
+	defer cleanup()
+
+	name := core.DigestFixture().Hex()
+
+	require.NoError(s.CreateDownloadFile(name, 1))
+	require.Error(s.MoveCacheFileToCold(name))
+
+	require.NoError(s.MoveDownloadFileToCache(name))
+	require.False(s.InColdTier(name))
+
+	require.NoError(s.MoveCacheFileToCold(name))
+	require.True(s.InColdTier(name))
+	require.True(os.IsExist(s.MoveCacheFileToCold(name)))
+
+	// Cold files are still cache files.
+	_, err := s.Cache().GetFileStat(name)
+	require.NoError(err)
+	_, err = s.Download().GetFileStat(name)
+	require.True(s.InCacheError(err))
+
+	require.NoError(s.MoveColdFileToCache(name))
+	require.False(s.InColdTier(name))
+	require.True(os.IsExist(s.MoveColdFileToCache(name)))
+}
+
+func TestCADownloadStoreColdTierDisabled(t *testing.T) {
+	require := require.New(t)
+
+	s, cleanup := CADownloadStoreFixture()
+	defer cleanup()
+
+	name := core.DigestFixture().Hex()
+
+	require.NoError(s.CreateDownloadFile(name, 1))
+	require.NoError(s.MoveDownloadFileToCache(name))
+
+	require.False(s.ColdTierEnabled())
+	require.Error(s.MoveCacheFileToCold(name))
+	require.False(s.InColdTier(name))
+}
+
+func TestCADownloadStoreQuarantineFile(t *testing.T) {
+	require := require.New(t)
+
+	s, cleanup := CADownloadStoreFixture()
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "quarantine")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	name := core.DigestFixture().Hex()
+	require.NoError(s.CreateDownloadFile(name, 1))
+
+	names, err := s.Download().ListNames()
+	require.NoError(err)
+	require.Equal([]string{name}, names)
+
+	require.NoError(s.Download().QuarantineFile(name, dir))
+
+	_, err = s.Download().GetFileStat(name)
+	require.True(os.IsNotExist(err))
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, name))
+	require.NoError(err)
+	require.NotEmpty(entries)
+}
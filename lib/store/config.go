@@ -53,4 +53,10 @@ type CADownloadStoreConfig struct {
 	CacheDir        string        `yaml:"cache_dir"`
 	DownloadCleanup CleanupConfig `yaml:"download_cleanup"`
 	CacheCleanup    CleanupConfig `yaml:"cache_cleanup"`
+
+	// ColdCacheDir, if set, enables a cold tier of cache files, typically on
+	// slower but larger disks than CacheDir. Cache files are moved between
+	// tiers explicitly, and may be read from either tier.
+	ColdCacheDir     string        `yaml:"cold_cache_dir"`
+	ColdCacheCleanup CleanupConfig `yaml:"cold_cache_cleanup"`
 }
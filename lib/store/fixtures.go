@@ -83,6 +83,26 @@ func CADownloadStoreFixture() (*CADownloadStore, func()) {
 	return s, cleanup.Run
 }
 
+// TieredCADownloadStoreFixture returns a CADownloadStore with a cold tier for
+// testing purposes.
+func TieredCADownloadStoreFixture() (*CADownloadStore, func()) {
+	cleanup := &testutil.Cleanup{}
+	defer cleanup.Recover()
+
+	config := CADownloadStoreConfig{
+		DownloadDir:  tempdir(cleanup, "download"),
+		CacheDir:     tempdir(cleanup, "cache"),
+		ColdCacheDir: tempdir(cleanup, "coldcache"),
+	}
+	s, err := NewCADownloadStore(config, tally.NoopScope)
+	if err != nil {
+		panic(err)
+	}
+	cleanup.Add(s.Close)
+
+	return s, cleanup.Run
+}
+
 // SimpleStoreFixture returns a SimpleStore for testing purposes.
 func SimpleStoreFixture() (*SimpleStore, func()) {
 	cleanup := &testutil.Cleanup{}
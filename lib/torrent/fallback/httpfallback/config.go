@@ -0,0 +1,55 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpfallback
+
+import (
+	"time"
+
+	"github.com/uber/kraken/utils/bandwidth"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// Config defines how blob ranges are fetched over HTTP.
+type Config struct {
+	// Namespaces defines URL templates per namespace. The first namespace
+	// which matches is used.
+	Namespaces []NamespaceConfig `yaml:"namespaces"`
+
+	Timeout time.Duration                     `yaml:"timeout"`
+	BackOff httputil.ExponentialBackOffConfig `yaml:"backoff"`
+
+	// Bandwidth limits the rate at which ranges are fetched.
+	Bandwidth bandwidth.Config `yaml:"bandwidth"`
+}
+
+// NamespaceConfig defines the URL blobs within a namespace are fetched from.
+type NamespaceConfig struct {
+	// Namespace is a regular expression matched against namespaces.
+	Namespace string `yaml:"namespace"`
+
+	// URL is a text/template which is executed with the fields of URLParams,
+	// e.g. "https://artifacts.example.com/{{.Namespace}}/sha256/{{.Hex}}".
+	// Pre-signed URLs may embed their signature in the query string.
+	URL string `yaml:"url"`
+
+	// Headers are added to every request, e.g. for authorization.
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+	return c
+}
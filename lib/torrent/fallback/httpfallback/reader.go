@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpfallback
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"text/template"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/utils/bandwidth"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/log"
+)
+
+// URLParams defines the fields available to URL templates.
+type URLParams struct {
+	Namespace string
+	Digest    string // e.g. "sha256:abc..."
+	Algo      string // e.g. "sha256"
+	Hex       string // e.g. "abc..."
+}
+
+type namespace struct {
+	re      *regexp.Regexp
+	url     *template.Template
+	headers map[string]string
+}
+
+// Reader implements fallback.Reader by fetching byte ranges from templated
+// HTTP(S) URLs.
+type Reader struct {
+	config     Config
+	namespaces []namespace
+	limiter    *bandwidth.Limiter
+}
+
+var _ fallback.Reader = (*Reader)(nil)
+
+// New creates a new Reader.
+func New(config Config) (*Reader, error) {
+	config = config.applyDefaults()
+
+	if len(config.Namespaces) == 0 {
+		return nil, errors.New("invalid config: no namespaces configured")
+	}
+	var namespaces []namespace
+	for _, nc := range config.Namespaces {
+		re, err := regexp.Compile(nc.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace %q: %s", nc.Namespace, err)
+		}
+		tmpl, err := template.New(nc.Namespace).Option("missingkey=error").Parse(nc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url template for namespace %q: %s", nc.Namespace, err)
+		}
+		namespaces = append(namespaces, namespace{re, tmpl, nc.Headers})
+	}
+
+	limiter, err := bandwidth.NewLimiter(config.Bandwidth, bandwidth.WithLogger(log.Default()))
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth: %s", err)
+	}
+
+	return &Reader{config, namespaces, limiter}, nil
+}
+
+func (r *Reader) getNamespace(ns string) (namespace, error) {
+	for _, n := range r.namespaces {
+		if n.re.MatchString(ns) {
+			return n, nil
+		}
+	}
+	return namespace{}, fmt.Errorf("no fallback url configured for namespace %s", ns)
+}
+
+// ReadRange fetches length bytes of the blob for d starting at offset.
+func (r *Reader) ReadRange(
+	namespace string, d core.Digest, offset, length int64) ([]byte, error) {
+
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range: offset=%d length=%d", offset, length)
+	}
+	n, err := r.getNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	var u bytes.Buffer
+	params := URLParams{
+		Namespace: namespace,
+		Digest:    d.String(),
+		Algo:      d.Algo(),
+		Hex:       d.Hex(),
+	}
+	if err := n.url.Execute(&u, params); err != nil {
+		return nil, fmt.Errorf("execute url template: %s", err)
+	}
+	headers := map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	}
+	for k, v := range n.headers {
+		headers[k] = v
+	}
+
+	if err := r.limiter.ReserveIngress(length); err != nil {
+		return nil, fmt.Errorf("reserve ingress: %s", err)
+	}
+	resp, err := httputil.Get(
+		u.String(),
+		httputil.SendHeaders(headers),
+		httputil.SendTimeout(r.config.Timeout),
+		httputil.SendRetry(httputil.RetryBackoff(r.config.BackOff.Build())),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusPartialContent),
+		httputil.DisableHTTPFallback())
+	if err != nil {
+		if httputil.IsNotFound(err) {
+			return nil, fallback.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		// Server ignored the range header and is sending the full blob.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return nil, fmt.Errorf("skip to offset: %s", err)
+		}
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, fmt.Errorf("read body: %s", err)
+	}
+	return b, nil
+}
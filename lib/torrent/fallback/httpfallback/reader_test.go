@@ -0,0 +1,119 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpfallback
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blobServer serves blobs by path, optionally ignoring range headers.
+func blobServer(blobs map[string][]byte, ignoreRange bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, ok := blobs[r.URL.Path]
+		if !ok || r.URL.Query().Get("sig") != "abc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if ignoreRange {
+			w.Write(b)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	})
+}
+
+func newTestReader(t *testing.T, addr string) *Reader {
+	r, err := New(Config{
+		Namespaces: []NamespaceConfig{{
+			Namespace: "library/.*",
+			URL:       fmt.Sprintf("http://%s/{{.Namespace}}/{{.Algo}}/{{.Hex}}?sig=abc", addr),
+			Headers:   map[string]string{"Authorization": "Bearer token"},
+		}},
+	})
+	require.NoError(t, err)
+	return r
+}
+
+func TestReaderReadRange(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignore_range=%t", ignoreRange), func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(32, 8)
+			path := fmt.Sprintf("/library/ubuntu/sha256/%s", blob.Digest.Hex())
+
+			addr, stop := testutil.StartServer(
+				blobServer(map[string][]byte{path: blob.Content}, ignoreRange))
+			defer stop()
+
+			r := newTestReader(t, addr)
+
+			result, err := r.ReadRange("library/ubuntu", blob.Digest, 8, 16)
+			require.NoError(err)
+			require.Equal(blob.Content[8:24], result)
+		})
+	}
+}
+
+func TestReaderReadRangeNotFound(t *testing.T) {
+	require := require.New(t)
+
+	addr, stop := testutil.StartServer(blobServer(map[string][]byte{}, false))
+	defer stop()
+
+	r := newTestReader(t, addr)
+
+	_, err := r.ReadRange("library/ubuntu", core.DigestFixture(), 0, 8)
+	require.Equal(fallback.ErrBlobNotFound, err)
+}
+
+func TestReaderReadRangeUnknownNamespace(t *testing.T) {
+	require := require.New(t)
+
+	r := newTestReader(t, "localhost:0")
+
+	_, err := r.ReadRange("other/ubuntu", core.DigestFixture(), 0, 8)
+	require.Error(err)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config Config
+	}{
+		{"no namespaces", Config{}},
+		{"bad namespace", Config{Namespaces: []NamespaceConfig{{Namespace: "(", URL: "x"}}}},
+		{"bad template", Config{Namespaces: []NamespaceConfig{{Namespace: ".*", URL: "{{"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(test.config)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fallback
+
+import (
+	"errors"
+
+	"github.com/uber/kraken/core"
+)
+
+// ErrBlobNotFound is returned when the fallback store does not have the blob.
+var ErrBlobNotFound = errors.New("blob not found in fallback store")
+
+// Reader reads byte ranges of blobs directly from a store outside of the p2p
+// network, such that torrents may still complete when no peer or origin can
+// serve a piece.
+//
+// Implementations of Reader must be thread-safe.
+type Reader interface {
+	// ReadRange returns length bytes of the blob for d starting at offset.
+	// Returns ErrBlobNotFound if the blob does not exist.
+	ReadRange(namespace string, d core.Digest, offset, length int64) ([]byte, error)
+}
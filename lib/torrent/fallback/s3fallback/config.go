@@ -0,0 +1,59 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3fallback
+
+import (
+	"time"
+
+	"github.com/uber/kraken/lib/backend/namepath"
+	"github.com/uber/kraken/utils/bandwidth"
+)
+
+// Config defines the S3 bucket blobs are read from. Blobs are keyed by
+// digest hex under RootDirectory.
+type Config struct {
+	Username string `yaml:"username"` // IAM username for selecting credentials.
+	Region   string `yaml:"region"`   // AWS S3 region
+	Bucket   string `yaml:"bucket"`   // S3 bucket
+
+	RootDirectory string `yaml:"root_directory"`
+
+	// NamePath identifies which namepath.Pather to use.
+	NamePath string `yaml:"name_path"`
+
+	// MaxRetries is the number of times a failed range read is retried.
+	MaxRetries uint64 `yaml:"max_retries"`
+
+	// RetryInterval is the delay between retries.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// Bandwidth limits the rate at which ranges are read from S3.
+	Bandwidth bandwidth.Config `yaml:"bandwidth"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.RootDirectory == "" {
+		c.RootDirectory = "/"
+	}
+	if c.NamePath == "" {
+		c.NamePath = namepath.Identity
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 500 * time.Millisecond
+	}
+	return c
+}
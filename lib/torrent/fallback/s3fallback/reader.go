@@ -0,0 +1,162 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3fallback
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/backend/namepath"
+	"github.com/uber/kraken/lib/backend/s3backend"
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/utils/bandwidth"
+	"github.com/uber/kraken/utils/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 defines the operations we use in the s3 api. Useful for mocking.
+type S3 interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// Reader implements fallback.Reader by reading byte ranges from S3.
+type Reader struct {
+	config  Config
+	pather  namepath.Pather
+	s3      S3
+	limiter *bandwidth.Limiter
+}
+
+var _ fallback.Reader = (*Reader)(nil)
+
+// Option allows setting optional Reader parameters.
+type Option func(*Reader)
+
+// WithS3 configures a Reader with a custom S3 implementation.
+func WithS3(s3 S3) Option {
+	return func(r *Reader) { r.s3 = s3 }
+}
+
+// New creates a new Reader. Credentials are selected from userAuth by the
+// configured username.
+func New(config Config, userAuth s3backend.UserAuthConfig, opts ...Option) (*Reader, error) {
+	config = config.applyDefaults()
+	if config.Username == "" {
+		return nil, errors.New("invalid config: username required")
+	}
+	if config.Region == "" {
+		return nil, errors.New("invalid config: region required")
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("invalid config: bucket required")
+	}
+	if !path.IsAbs(config.RootDirectory) {
+		return nil, errors.New("invalid config: root_directory must be absolute path")
+	}
+
+	pather, err := namepath.New(config.RootDirectory, config.NamePath)
+	if err != nil {
+		return nil, fmt.Errorf("namepath: %s", err)
+	}
+
+	auth, ok := userAuth[config.Username]
+	if !ok {
+		return nil, errors.New("auth not configured for username")
+	}
+	creds := credentials.NewStaticCredentials(
+		auth.S3.AccessKeyID, auth.S3.AccessSecretKey, auth.S3.SessionToken)
+
+	limiter, err := bandwidth.NewLimiter(config.Bandwidth, bandwidth.WithLogger(log.Default()))
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth: %s", err)
+	}
+
+	r := &Reader{
+		config:  config,
+		pather:  pather,
+		s3:      s3.New(session.New(), aws.NewConfig().WithRegion(config.Region).WithCredentials(creds)),
+		limiter: limiter,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// ReadRange reads length bytes of the blob for d starting at offset. Failed
+// reads are retried, except when the blob does not exist.
+func (r *Reader) ReadRange(
+	namespace string, d core.Digest, offset, length int64) ([]byte, error) {
+
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range: offset=%d length=%d", offset, length)
+	}
+	key, err := r.pather.BlobPath(d.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("blob path: %s", err)
+	}
+	if err := r.limiter.ReserveIngress(length); err != nil {
+		return nil, fmt.Errorf("reserve ingress: %s", err)
+	}
+
+	for attempt := uint64(0); ; attempt++ {
+		b, err := r.getRange(key, offset, length)
+		if err == nil {
+			return b, nil
+		}
+		if err == fallback.ErrBlobNotFound || attempt >= r.config.MaxRetries {
+			return nil, err
+		}
+		log.With("digest", d, "offset", offset).Infof("Error reading range from s3, retrying: %s", err)
+		time.Sleep(r.config.RetryInterval)
+	}
+}
+
+func (r *Reader) getRange(key string, offset, length int64) ([]byte, error) {
+	output, err := r.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.config.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, fallback.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	b, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %s", err)
+	}
+	if int64(len(b)) != length {
+		return nil, fmt.Errorf("short read: expected %d bytes, got %d", length, len(b))
+	}
+	return b, nil
+}
+
+func isNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound")
+}
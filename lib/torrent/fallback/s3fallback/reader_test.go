@@ -0,0 +1,116 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3fallback
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/backend/s3backend"
+	"github.com/uber/kraken/lib/torrent/fallback"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 serves ranges of blobs keyed by path, failing the first failures
+// requests.
+type fakeS3 struct {
+	blobs    map[string][]byte
+	failures int
+	inputs   []*s3.GetObjectInput
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.inputs = append(f.inputs, input)
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("some error")
+	}
+	b, ok := f.blobs[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(b[start : end+1])),
+	}, nil
+}
+
+func newTestReader(t *testing.T, s *fakeS3) *Reader {
+	config := Config{
+		Username:      "test-user",
+		Region:        "test-region",
+		Bucket:        "test-bucket",
+		RootDirectory: "/root",
+		RetryInterval: time.Millisecond,
+	}
+	auth := s3backend.UserAuthConfig{"test-user": s3backend.AuthConfig{}}
+	r, err := New(config, auth, WithS3(s))
+	require.NoError(t, err)
+	return r
+}
+
+func TestReaderReadRange(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(32, 8)
+	s := &fakeS3{blobs: map[string][]byte{"/root/" + blob.Digest.Hex(): blob.Content}}
+	r := newTestReader(t, s)
+
+	result, err := r.ReadRange("noexist", blob.Digest, 8, 16)
+	require.NoError(err)
+	require.Equal(blob.Content[8:24], result)
+
+	require.Len(s.inputs, 1)
+	require.Equal("test-bucket", aws.StringValue(s.inputs[0].Bucket))
+	require.Equal("bytes=8-23", aws.StringValue(s.inputs[0].Range))
+}
+
+func TestReaderReadRangeRetries(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(32, 8)
+	s := &fakeS3{
+		blobs:    map[string][]byte{"/root/" + blob.Digest.Hex(): blob.Content},
+		failures: 2,
+	}
+	r := newTestReader(t, s)
+
+	result, err := r.ReadRange("noexist", blob.Digest, 0, 8)
+	require.NoError(err)
+	require.Equal(blob.Content[:8], result)
+	require.Len(s.inputs, 3)
+}
+
+func TestReaderReadRangeNotFoundIsNotRetried(t *testing.T) {
+	require := require.New(t)
+
+	s := &fakeS3{blobs: map[string][]byte{}}
+	r := newTestReader(t, s)
+
+	_, err := r.ReadRange("noexist", core.DigestFixture(), 0, 8)
+	require.Equal(fallback.ErrBlobNotFound, err)
+	require.Len(s.inputs, 1)
+}
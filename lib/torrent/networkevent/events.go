@@ -51,6 +51,13 @@ type Event struct {
 	Bitfield     []bool `json:"bitfield,omitempty"`
 	DurationMS   int64  `json:"duration_ms,omitempty"`
 	ConnCapacity int    `json:"conn_capacity,omitempty"`
+
+	// Bytes is the length of a received piece.
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Piece payload bytes transferred over a conn during its lifetime.
+	BytesSent     int64 `json:"bytes_sent,omitempty"`
+	BytesReceived int64 `json:"bytes_received,omitempty"`
 }
 
 func baseEvent(name Name, h core.InfoHash, self core.PeerID) *Event {
@@ -91,10 +98,15 @@ func AddActiveConnEvent(h core.InfoHash, self core.PeerID, peer core.PeerID) *Ev
 	return e
 }
 
-// DropActiveConnEvent returns an event for a dropped active conn from self to peer.
-func DropActiveConnEvent(h core.InfoHash, self core.PeerID, peer core.PeerID) *Event {
+// DropActiveConnEvent returns an event for a dropped active conn from self to
+// peer, over which sent and received bytes of piece payloads were transferred.
+func DropActiveConnEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, sent, received int64) *Event {
+
 	e := baseEvent(DropActiveConn, h, self)
 	e.Peer = peer.String()
+	e.BytesSent = sent
+	e.BytesReceived = received
 	return e
 }
 
@@ -114,11 +126,15 @@ func RequestPieceEvent(h core.InfoHash, self core.PeerID, peer core.PeerID, piec
 	return e
 }
 
-// ReceivePieceEvent returns an event for a piece received from a peer.
-func ReceivePieceEvent(h core.InfoHash, self core.PeerID, peer core.PeerID, piece int) *Event {
+// ReceivePieceEvent returns an event for a piece of length bytes received from
+// a peer.
+func ReceivePieceEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, piece int, length int64) *Event {
+
 	e := baseEvent(ReceivePiece, h, self)
 	e.Peer = peer.String()
 	e.Piece = piece
+	e.Bytes = length
 	return e
 }
 
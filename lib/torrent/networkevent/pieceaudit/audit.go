@@ -0,0 +1,296 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package pieceaudit replays network event logs offline and verifies the piece
+// accounting invariants of the scheduler:
+//
+//   - Each piece is verified exactly once, and completed torrents have every
+//     piece verified.
+//   - Piece requests in flight on dropped conns are not lost, i.e. the piece is
+//     requested again, received, or the torrent ends.
+//   - Piece bytes received over a conn do not exceed its byte counters.
+package pieceaudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/networkevent"
+)
+
+// Violation kinds.
+const (
+	DuplicateVerification = "duplicate_verification"
+	MissingPiece          = "missing_piece"
+	LostRequest           = "lost_request"
+	ByteCounterMismatch   = "byte_counter_mismatch"
+)
+
+// Violation describes a broken invariant.
+type Violation struct {
+	Kind    string    `json:"kind"`
+	Self    string    `json:"self"`
+	Torrent string    `json:"torrent"`
+	Peer    string    `json:"peer,omitempty"`
+	Piece   int       `json:"piece"`
+	Time    time.Time `json:"ts"`
+	Detail  string    `json:"detail"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %s self=%s torrent=%s peer=%s piece=%d: %s",
+		v.Time.Format(time.RFC3339Nano), v.Kind, v.Self, v.Torrent, v.Peer, v.Piece, v.Detail)
+}
+
+// Report summarizes an audit.
+type Report struct {
+	Events         int `json:"events"`
+	Torrents       int `json:"torrents"`
+	Completed      int `json:"completed"`
+	Cancelled      int `json:"cancelled"`
+	PiecesVerified int `json:"pieces_verified"`
+	Requests       int `json:"requests"`
+
+	// InFlight is the number of requests still in flight on open conns when
+	// the log ends, which are not violations.
+	InFlight int `json:"in_flight"`
+
+	Violations []Violation `json:"violations"`
+}
+
+// OK returns true if no invariants were violated.
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// ReadEvents reads newline delimited network events, as written by
+// networkevent.Producer, from r.
+func ReadEvents(r io.Reader) ([]*networkevent.Event, error) {
+	var events []*networkevent.Event
+	dec := json.NewDecoder(r)
+	for {
+		e := new(networkevent.Event)
+		if err := dec.Decode(e); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return nil, fmt.Errorf("decode event %d: %s", len(events)+1, err)
+		}
+		events = append(events, e)
+	}
+}
+
+type torrentKey struct {
+	self    string
+	torrent string
+}
+
+// conn tracks the piece bytes received over a conn.
+type conn struct {
+	received int64
+}
+
+type orphan struct {
+	peer string
+	time time.Time
+}
+
+type torrent struct {
+	// numPieces is -1 if the log starts after the torrent was added.
+	numPieces int
+	verified  map[int]bool
+	ended     bool
+
+	// Requests in flight, by peer.
+	pending map[string]map[int]time.Time
+
+	// Pieces whose requests were in flight on a dropped conn, and which have
+	// not been requested again since.
+	orphaned map[int]orphan
+
+	conns map[string]*conn
+}
+
+func newTorrent(bitfield []bool) *torrent {
+	t := &torrent{
+		numPieces: -1,
+		verified:  make(map[int]bool),
+		pending:   make(map[string]map[int]time.Time),
+		orphaned:  make(map[int]orphan),
+		conns:     make(map[string]*conn),
+	}
+	if bitfield != nil {
+		t.numPieces = len(bitfield)
+		for i, ok := range bitfield {
+			if ok {
+				t.verified[i] = true
+			}
+		}
+	}
+	return t
+}
+
+// resolve marks all requests of piece i as resolved.
+func (t *torrent) resolve(i int) {
+	for _, pieces := range t.pending {
+		delete(pieces, i)
+	}
+	delete(t.orphaned, i)
+}
+
+func (t *torrent) end() {
+	t.ended = true
+	t.pending = make(map[string]map[int]time.Time)
+	t.orphaned = make(map[int]orphan)
+}
+
+type auditor struct {
+	report   *Report
+	torrents map[torrentKey]*torrent
+}
+
+// Audit replays events in order of their timestamps and reports all
+// invariants they violate. Events of multiple peers may be audited together.
+func Audit(events []*networkevent.Event) *Report {
+	events = append([]*networkevent.Event(nil), events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	a := &auditor{
+		report:   &Report{Events: len(events), Violations: []Violation{}},
+		torrents: make(map[torrentKey]*torrent),
+	}
+	for _, e := range events {
+		a.apply(e)
+	}
+	for k, t := range a.torrents {
+		a.finish(k, t)
+	}
+	sort.SliceStable(a.report.Violations, func(i, j int) bool {
+		return a.report.Violations[i].Time.Before(a.report.Violations[j].Time)
+	})
+	return a.report
+}
+
+func (a *auditor) violation(
+	kind string, k torrentKey, peer string, piece int, ts time.Time, format string, args ...interface{}) {
+
+	a.report.Violations = append(a.report.Violations, Violation{
+		Kind:    kind,
+		Self:    k.self,
+		Torrent: k.torrent,
+		Peer:    peer,
+		Piece:   piece,
+		Time:    ts,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (a *auditor) get(k torrentKey) *torrent {
+	t, ok := a.torrents[k]
+	if !ok {
+		t = newTorrent(nil)
+		a.torrents[k] = t
+		a.report.Torrents++
+	}
+	return t
+}
+
+func (a *auditor) apply(e *networkevent.Event) {
+	k := torrentKey{e.Self, e.Torrent}
+
+	switch e.Name {
+	case networkevent.AddTorrent:
+		if t, ok := a.torrents[k]; ok {
+			// The torrent was removed and added again.
+			a.finish(k, t)
+		}
+		a.torrents[k] = newTorrent(e.Bitfield)
+		a.report.Torrents++
+
+	case networkevent.AddActiveConn:
+		a.get(k).conns[e.Peer] = &conn{}
+
+	case networkevent.DropActiveConn:
+		t := a.get(k)
+		if c, ok := t.conns[e.Peer]; ok {
+			if c.received > e.BytesReceived {
+				a.violation(ByteCounterMismatch, k, e.Peer, 0, e.Time,
+					"received %d piece bytes, but conn counted %d", c.received, e.BytesReceived)
+			}
+			delete(t.conns, e.Peer)
+		}
+		for i, ts := range t.pending[e.Peer] {
+			if !t.verified[i] {
+				t.orphaned[i] = orphan{e.Peer, ts}
+			}
+		}
+		delete(t.pending, e.Peer)
+
+	case networkevent.RequestPiece:
+		t := a.get(k)
+		a.report.Requests++
+		pieces, ok := t.pending[e.Peer]
+		if !ok {
+			pieces = make(map[int]time.Time)
+			t.pending[e.Peer] = pieces
+		}
+		pieces[e.Piece] = e.Time
+		delete(t.orphaned, e.Piece)
+
+	case networkevent.ReceivePiece:
+		t := a.get(k)
+		if t.verified[e.Piece] {
+			a.violation(DuplicateVerification, k, e.Peer, e.Piece, e.Time, "piece verified again")
+		} else {
+			t.verified[e.Piece] = true
+			a.report.PiecesVerified++
+		}
+		t.resolve(e.Piece)
+		if c, ok := t.conns[e.Peer]; ok {
+			c.received += e.Bytes
+		}
+
+	case networkevent.TorrentComplete:
+		t := a.get(k)
+		for i := 0; i < t.numPieces; i++ {
+			if !t.verified[i] {
+				a.violation(MissingPiece, k, "", i, e.Time, "torrent completed without piece")
+			}
+		}
+		t.end()
+		a.report.Completed++
+
+	case networkevent.TorrentCancelled:
+		a.get(k).end()
+		a.report.Cancelled++
+	}
+}
+
+// finish reports the requests of t which were lost once the log ends.
+func (a *auditor) finish(k torrentKey, t *torrent) {
+	if t.ended {
+		return
+	}
+	for i, o := range t.orphaned {
+		a.violation(LostRequest, k, o.peer, i, o.time,
+			"request in flight on dropped conn was never retried")
+	}
+	for _, pieces := range t.pending {
+		a.report.InFlight += len(pieces)
+	}
+	t.end()
+}
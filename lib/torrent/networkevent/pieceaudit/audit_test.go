@@ -0,0 +1,137 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pieceaudit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// sequence timestamps events in order.
+func sequence(events ...*networkevent.Event) []*networkevent.Event {
+	start := time.Now()
+	for i, e := range events {
+		e.Time = start.Add(time.Duration(i) * time.Millisecond)
+	}
+	return events
+}
+
+func TestAuditHealthyDownload(t *testing.T) {
+	require := require.New(t)
+
+	h := core.InfoHashFixture()
+	self := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	events := sequence(
+		networkevent.AddTorrentEvent(h, self, bitsetutil.FromBools(true, false, false), 10),
+		networkevent.AddActiveConnEvent(h, self, p1),
+		networkevent.AddActiveConnEvent(h, self, p2),
+		networkevent.RequestPieceEvent(h, self, p1, 1),
+		networkevent.RequestPieceEvent(h, self, p1, 2),
+		// The request of piece 2 is retried after p1 is dropped.
+		networkevent.ReceivePieceEvent(h, self, p1, 1, 4),
+		networkevent.DropActiveConnEvent(h, self, p1, 0, 4),
+		networkevent.RequestPieceEvent(h, self, p2, 2),
+		networkevent.ReceivePieceEvent(h, self, p2, 2, 4),
+		networkevent.TorrentCompleteEvent(h, self),
+		networkevent.DropActiveConnEvent(h, self, p2, 0, 4))
+
+	report := Audit(events)
+	require.True(report.OK(), "violations: %v", report.Violations)
+	require.Equal(1, report.Torrents)
+	require.Equal(1, report.Completed)
+	require.Equal(2, report.PiecesVerified)
+	require.Equal(3, report.Requests)
+	require.Equal(0, report.InFlight)
+}
+
+func TestAuditViolations(t *testing.T) {
+	require := require.New(t)
+
+	h := core.InfoHashFixture()
+	self := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	events := sequence(
+		networkevent.AddTorrentEvent(h, self, bitsetutil.FromBools(false, false, false, false), 10),
+		networkevent.AddActiveConnEvent(h, self, p1),
+		networkevent.AddActiveConnEvent(h, self, p2),
+		networkevent.RequestPieceEvent(h, self, p1, 0),
+		networkevent.RequestPieceEvent(h, self, p1, 1),
+		networkevent.RequestPieceEvent(h, self, p2, 2),
+		networkevent.ReceivePieceEvent(h, self, p1, 0, 4),
+		networkevent.ReceivePieceEvent(h, self, p2, 0, 4),
+		networkevent.DropActiveConnEvent(h, self, p1, 0, 2))
+
+	report := Audit(events)
+	require.False(report.OK())
+
+	var kinds []string
+	for _, v := range report.Violations {
+		kinds = append(kinds, v.Kind)
+	}
+	// Lost requests are reported at the time they were made.
+	require.Equal([]string{LostRequest, DuplicateVerification, ByteCounterMismatch}, kinds)
+	require.Equal(1, report.Violations[0].Piece)
+
+	// The request of piece 2 is still in flight on an open conn.
+	require.Equal(1, report.InFlight)
+}
+
+func TestAuditCompletedWithMissingPieces(t *testing.T) {
+	require := require.New(t)
+
+	h := core.InfoHashFixture()
+	self := core.PeerIDFixture()
+
+	report := Audit(sequence(
+		networkevent.AddTorrentEvent(h, self, bitsetutil.FromBools(true, false), 10),
+		networkevent.TorrentCompleteEvent(h, self)))
+
+	require.Len(report.Violations, 1)
+	require.Equal(MissingPiece, report.Violations[0].Kind)
+	require.Equal(1, report.Violations[0].Piece)
+}
+
+func TestReadEvents(t *testing.T) {
+	require := require.New(t)
+
+	h := core.InfoHashFixture()
+	self := core.PeerIDFixture()
+	events := sequence(
+		networkevent.AddTorrentEvent(h, self, bitsetutil.FromBools(true), 10),
+		networkevent.TorrentCompleteEvent(h, self))
+
+	var buf bytes.Buffer
+	for _, e := range events {
+		buf.WriteString(e.JSON() + "\n")
+	}
+	result, err := ReadEvents(&buf)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.Equal(networkevent.TorrentComplete, result[1].Name)
+
+	_, err = ReadEvents(bytes.NewBufferString("{\"event\": "))
+	require.Error(err)
+}
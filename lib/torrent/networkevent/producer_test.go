@@ -43,10 +43,10 @@ func TestProducerCreatesAndReusesFile(t *testing.T) {
 	}
 
 	events := []*Event{
-		ReceivePieceEvent(h, peer1, peer2, 1),
-		ReceivePieceEvent(h, peer1, peer2, 2),
-		ReceivePieceEvent(h, peer1, peer2, 3),
-		ReceivePieceEvent(h, peer1, peer2, 4),
+		ReceivePieceEvent(h, peer1, peer2, 1, 1),
+		ReceivePieceEvent(h, peer1, peer2, 2, 1),
+		ReceivePieceEvent(h, peer1, peer2, 3, 1),
+		ReceivePieceEvent(h, peer1, peer2, 4, 1),
 	}
 
 	// First producer should create the file.
@@ -91,5 +91,5 @@ func TestDisabledProducerNoops(t *testing.T) {
 	p, err := NewProducer(Config{})
 	require.NoError(err)
 
-	p.Produce(ReceivePieceEvent(h, peer1, peer2, 1))
+	p.Produce(ReceivePieceEvent(h, peer1, peer2, 1, 1))
 }
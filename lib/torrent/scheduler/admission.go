@@ -0,0 +1,161 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"github.com/uber/kraken/core"
+)
+
+// queuedTorrent is a torrent waiting for admission, along with the requests
+// made for it while queued.
+type queuedTorrent struct {
+	requests []newTorrentEvent
+}
+
+func (q *queuedTorrent) infoHash() core.InfoHash {
+	return q.requests[0].torrent.InfoHash()
+}
+
+// admissionQueue holds new torrents which could not be started because
+// Config.MaxConcurrentDownloads torrents were already leeching. Torrents are
+// admitted in the order they were first requested.
+type admissionQueue struct {
+	torrents []*queuedTorrent
+}
+
+func newAdmissionQueue() *admissionQueue {
+	return &admissionQueue{}
+}
+
+func (q *admissionQueue) len() int {
+	return len(q.torrents)
+}
+
+// position returns the 1-based position of h in the queue, or 0 if h is not
+// queued.
+func (q *admissionQueue) position(h core.InfoHash) int {
+	for i, t := range q.torrents {
+		if t.infoHash() == h {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// push queues e, merging it with any request already queued for the same
+// torrent.
+func (q *admissionQueue) push(e newTorrentEvent) {
+	if i := q.position(e.torrent.InfoHash()); i > 0 {
+		t := q.torrents[i-1]
+		t.requests = append(t.requests, e)
+		return
+	}
+	q.torrents = append(q.torrents, &queuedTorrent{requests: []newTorrentEvent{e}})
+}
+
+// pop removes the head of the queue. Returns nil if the queue is empty.
+func (q *admissionQueue) pop() *queuedTorrent {
+	if len(q.torrents) == 0 {
+		return nil
+	}
+	t := q.torrents[0]
+	q.torrents = q.torrents[1:]
+	return t
+}
+
+// remove removes h from the queue. Returns nil if h is not queued.
+func (q *admissionQueue) remove(h core.InfoHash) *queuedTorrent {
+	i := q.position(h)
+	if i == 0 {
+		return nil
+	}
+	t := q.torrents[i-1]
+	q.torrents = append(q.torrents[:i-1], q.torrents[i:]...)
+	return t
+}
+
+// abandon removes the request waiting on errc for h. Returns true if no
+// requests are left for h, in which case h is removed from the queue.
+func (q *admissionQueue) abandon(h core.InfoHash, errc chan error) bool {
+	i := q.position(h)
+	if i == 0 {
+		return false
+	}
+	t := q.torrents[i-1]
+	for j, e := range t.requests {
+		if e.errc == errc {
+			t.requests = append(t.requests[:j], t.requests[j+1:]...)
+			break
+		}
+	}
+	if len(t.requests) > 0 {
+		return false
+	}
+	q.torrents = append(q.torrents[:i-1], q.torrents[i:]...)
+	return true
+}
+
+// numLeeching returns the number of torrents which are currently downloading,
+// including paused torrents.
+func (s *state) numLeeching() int {
+	var n int
+	for _, ctrl := range s.torrentControls {
+		if !ctrl.seeding() {
+			n++
+		}
+	}
+	return n
+}
+
+// admissionFull returns true if no more torrents may begin leeching.
+func (s *state) admissionFull() bool {
+	max := s.sched.config.MaxConcurrentDownloads
+	return max > 0 && s.numLeeching() >= max
+}
+
+// queueTorrent queues e until a leeching torrent completes or is removed.
+func (s *state) queueTorrent(e newTorrentEvent) {
+	s.admission.push(e)
+	s.sched.stats.Gauge("queued_torrents").Update(float64(s.admission.len()))
+	s.log(
+		"torrent", e.torrent,
+		"position", s.admission.position(e.torrent.InfoHash())).Info("Queued new torrent for admission")
+}
+
+// admitTorrents starts queued torrents until the admission queue is empty or
+// the limit of concurrent downloads is reached again.
+func (s *state) admitTorrents() {
+	for s.admission.len() > 0 && !s.admissionFull() {
+		t := s.admission.pop()
+		s.sched.stats.Gauge("queued_torrents").Update(float64(s.admission.len()))
+		s.sched.stats.Counter("admitted_torrents").Inc(1)
+		for _, e := range t.requests {
+			e.apply(s)
+		}
+	}
+}
+
+// dequeueTorrent removes h from the admission queue, sending err to all
+// requests waiting on it. Returns false if h was not queued.
+func (s *state) dequeueTorrent(h core.InfoHash, err error) bool {
+	t := s.admission.remove(h)
+	if t == nil {
+		return false
+	}
+	s.sched.stats.Gauge("queued_torrents").Update(float64(s.admission.len()))
+	for _, e := range t.requests {
+		e.errc <- err
+	}
+	return true
+}
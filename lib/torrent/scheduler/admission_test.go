@@ -0,0 +1,169 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/announceclient"
+)
+
+func TestNewTorrentEventQueuesBeyondMaxConcurrentDownloads(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{MaxConcurrentDownloads: 1})
+
+	mocks.announceClient.EXPECT().
+		Announce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, time.Duration(0), announceclient.ErrDisabled).
+		AnyTimes()
+
+	t1 := mocks.newTorrent()
+	t2 := mocks.newTorrent()
+	t3 := mocks.newTorrent()
+
+	errc1 := make(chan error, 1)
+	errc2 := make(chan error, 1)
+	errc3 := make(chan error, 1)
+
+	newTorrentEvent{_testNamespace, t1, nil, errc1}.apply(state)
+	newTorrentEvent{_testNamespace, t2, nil, errc2}.apply(state)
+	newTorrentEvent{_testNamespace, t3, nil, errc3}.apply(state)
+
+	require.Contains(state.torrentControls, t1.InfoHash())
+	require.NotContains(state.torrentControls, t2.InfoHash())
+	require.NotContains(state.torrentControls, t3.InfoHash())
+	require.Equal(1, state.admission.position(t2.InfoHash()))
+	require.Equal(2, state.admission.position(t3.InfoHash()))
+
+	result := make(chan *Progress, 1)
+	progressEvent{t3.InfoHash(), result}.apply(state)
+	p := <-result
+	require.True(p.Queued)
+	require.Equal(2, p.QueuePosition)
+	require.Equal(t3.Digest(), p.Digest)
+
+	// Cancelling a queued torrent fails its callers without admitting it.
+	cancelc := make(chan error, 1)
+	cancelTorrentEvent{t3.InfoHash(), cancelc}.apply(state)
+	require.NoError(<-cancelc)
+	require.Equal(ErrTorrentCancelled, <-errc3)
+	require.Equal(1, state.admission.len())
+
+	// Removing the leeching torrent admits the next queued torrent.
+	cancelTorrentEvent{t1.InfoHash(), cancelc}.apply(state)
+	require.NoError(<-cancelc)
+	require.Equal(ErrTorrentCancelled, <-errc1)
+
+	require.Contains(state.torrentControls, t2.InfoHash())
+	require.Equal(0, state.admission.len())
+	require.Equal([]chan error{errc2}, state.torrentControls[t2.InfoHash()].errors)
+}
+
+func TestAbandonTorrentEventRemovesQueuedTorrentOnceAllCallersLeave(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{MaxConcurrentDownloads: 1})
+
+	mocks.announceClient.EXPECT().
+		Announce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, time.Duration(0), announceclient.ErrDisabled).
+		AnyTimes()
+
+	t1 := mocks.newTorrent()
+	t2 := mocks.newTorrent()
+
+	newTorrentEvent{_testNamespace, t1, nil, make(chan error, 1)}.apply(state)
+
+	errc1 := make(chan error, 1)
+	errc2 := make(chan error, 1)
+	newTorrentEvent{_testNamespace, t2, nil, errc1}.apply(state)
+	newTorrentEvent{_testNamespace, t2, nil, errc2}.apply(state)
+	require.Equal(1, state.admission.len())
+
+	abandonTorrentEvent{t2.InfoHash(), errc1}.apply(state)
+	require.Equal(1, state.admission.position(t2.InfoHash()))
+
+	abandonTorrentEvent{t2.InfoHash(), errc2}.apply(state)
+	require.Equal(0, state.admission.len())
+}
+
+func TestRestoreStateQueuesLeechersForAdmission(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{MaxConcurrentDownloads: 1})
+
+	mocks.announceClient.EXPECT().
+		Announce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, time.Duration(0), announceclient.ErrDisabled).
+		AnyTimes()
+
+	t1 := mocks.newTorrent()
+	t2 := mocks.newTorrent()
+	ps := &persistedState{
+		Version: persistedStateVersion,
+		Torrents: []persistedTorrent{
+			{Namespace: _testNamespace, Digest: t1.Digest(), InfoHash: t1.InfoHash(), Queued: true},
+			{Namespace: _testNamespace, Digest: t2.Digest(), InfoHash: t2.InfoHash(), Queued: true},
+		},
+	}
+	restoreStateEvent{ps}.apply(state)
+
+	require.Len(state.torrentControls, 1)
+	require.Contains(state.torrentControls, t1.InfoHash())
+	require.Equal(1, state.admission.position(t2.InfoHash()))
+
+	// The queued leecher is admitted once the first one is removed.
+	state.removeTorrent(t1.InfoHash(), ErrTorrentRemoved)
+	require.Len(state.torrentControls, 1)
+	require.Contains(state.torrentControls, t2.InfoHash())
+}
+
+func TestActiveDigestsIncludeQueuedTorrents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{MaxConcurrentDownloads: 1})
+
+	mocks.announceClient.EXPECT().
+		Announce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, time.Duration(0), announceclient.ErrDisabled).
+		AnyTimes()
+
+	t1 := mocks.newTorrent()
+	t2 := mocks.newTorrent()
+
+	newTorrentEvent{_testNamespace, t1, nil, make(chan error, 1)}.apply(state)
+	newTorrentEvent{_testNamespace, t2, nil, make(chan error, 1)}.apply(state)
+	require.Equal(1, state.admission.position(t2.InfoHash()))
+
+	result := make(chan map[core.Digest]bool, 1)
+	activeDigestsEvent{result}.apply(state)
+	require.Equal(map[core.Digest]bool{t1.Digest(): true, t2.Digest(): true}, <-result)
+}
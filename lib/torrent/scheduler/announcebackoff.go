@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/cenkalti/backoff"
+	"github.com/uber/kraken/core"
+)
+
+// AnnounceBackoffConfig defines the backoff of torrents whose announces fail.
+// Failed torrents are only ready to announce again once their backoff elapses,
+// such that an unavailable tracker is not hammered with retries. Backoff is
+// exponential with jitter, and resets once an announce succeeds.
+type AnnounceBackoffConfig struct {
+	// Disable makes torrents ready to announce again immediately after a
+	// failure.
+	Disable bool `yaml:"disable"`
+
+	InitialInterval     time.Duration `yaml:"initial_interval"`
+	Multiplier          float64       `yaml:"multiplier"`
+	RandomizationFactor float64       `yaml:"randomization_factor"`
+	MaxInterval         time.Duration `yaml:"max_interval"`
+}
+
+func (c AnnounceBackoffConfig) applyDefaults() AnnounceBackoffConfig {
+	if c.InitialInterval == 0 {
+		c.InitialInterval = time.Second
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = 2
+	}
+	if c.RandomizationFactor == 0 {
+		c.RandomizationFactor = 0.5
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = 2 * time.Minute
+	}
+	return c
+}
+
+// build creates an unrandomized backoff. Jitter is applied separately via the
+// seeded rand of the scheduler, as backoff randomizes with the global source.
+func (c AnnounceBackoffConfig) build(clk clock.Clock) *backoff.ExponentialBackOff {
+	b := &backoff.ExponentialBackOff{
+		InitialInterval:     c.InitialInterval,
+		Multiplier:          c.Multiplier,
+		RandomizationFactor: 0,
+		MaxInterval:         c.MaxInterval,
+		// Never stop retrying.
+		MaxElapsedTime: 0,
+		Clock:          clk,
+	}
+	b.Reset()
+	return b
+}
+
+// backOffAnnounce delays the next announce of ctrl after a failed announce. The
+// torrent waits in the announce queue until its backoff elapses.
+func (s *state) backOffAnnounce(h core.InfoHash, ctrl *torrentControl) {
+	if ctrl.announceBackoff == nil {
+		ctrl.announceBackoff = s.sched.config.AnnounceBackoff.build(s.sched.clock)
+	}
+	d := jitter(
+		ctrl.announceBackoff.NextBackOff(),
+		s.sched.config.AnnounceBackoff.RandomizationFactor,
+		s.sched.rand)
+	s.announceQueue.ReadyAt(h, s.sched.clock.Now().Add(d))
+	s.sched.stats.Counter("announce_backoffs").Inc(1)
+	s.log("hash", h).Infof("Backing off announce for %s", d)
+}
+
+// jitter returns a random duration within factor of d in either direction.
+func jitter(d time.Duration, factor float64, r *rand.Rand) time.Duration {
+	delta := factor * float64(d)
+	return time.Duration(float64(d) - delta + r.Float64()*(2*delta+1))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+)
+
+func TestAnnounceErrEventBacksOffExponentially(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	mocks.announceQueue = announcequeue.New(announcequeue.WithClock(clk))
+	state := mocks.newState(Config{
+		AnnounceBackoff: AnnounceBackoffConfig{
+			InitialInterval:     time.Second,
+			Multiplier:          2,
+			RandomizationFactor: 0.001,
+		},
+	}, withClock(clk))
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h, ok := state.announceQueue.Next()
+	require.True(ok)
+
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		announceErrEvent{h, errors.New("tracker unavailable")}.apply(state)
+		_, ok := state.announceQueue.Next()
+		require.False(ok)
+
+		clk.Add(d * 99 / 100)
+		_, ok = state.announceQueue.Next()
+		require.False(ok, "ready before backoff elapsed")
+
+		clk.Add(d * 2 / 100)
+		next, ok := state.announceQueue.Next()
+		require.True(ok, "not ready after backoff elapsed")
+		require.Equal(h, next)
+	}
+
+	// Successful announces reset the backoff.
+	announceResultEvent{infoHash: h}.apply(state)
+	require.Nil(ctrl.announceBackoff)
+}
+
+func TestAnnounceErrEventWithBackoffDisabled(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{AnnounceBackoff: AnnounceBackoffConfig{Disable: true}})
+
+	_, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h, ok := state.announceQueue.Next()
+	require.True(ok)
+
+	announceErrEvent{h, errors.New("tracker unavailable")}.apply(state)
+
+	next, ok := state.announceQueue.Next()
+	require.True(ok)
+	require.Equal(h, next)
+}
+
+func TestJitterIsDeterministicForSeed(t *testing.T) {
+	require := require.New(t)
+
+	a := rand.New(rand.NewSource(1))
+	b := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := jitter(10*time.Second, 0.5, a)
+		require.Equal(d, jitter(10*time.Second, 0.5, b))
+		require.True(d >= 5*time.Second && d <= 15*time.Second, "out of range: %s", d)
+	}
+	require.Equal(10*time.Second, jitter(10*time.Second, 0, a))
+}
@@ -14,35 +14,108 @@
 package announcequeue
 
 import (
-	"container/list"
+	"container/heap"
+	"sort"
+	"time"
+
+	"github.com/andres-erbsen/clock"
 
 	"github.com/uber/kraken/core"
 )
 
+// Announce priorities. Torrents of higher priority announce first.
+const (
+	PriorityDefault = 0
+
+	// PriorityLeecher is for in-progress torrents, which need peers more
+	// urgently than seeding torrents.
+	PriorityLeecher = 10
+)
+
 // Queue manages a queue of torrents waiting to announce.
 type Queue interface {
 	Next() (core.InfoHash, bool)
 	Add(core.InfoHash)
 	Ready(core.InfoHash)
+	ReadyAt(core.InfoHash, time.Time)
+	SetPriority(core.InfoHash, int)
 	Eject(core.InfoHash)
+	Take(core.InfoHash) bool
+	Snapshot() []Entry
+}
+
+// Entry statuses.
+const (
+	StatusReady   = "ready"
+	StatusWaiting = "waiting"
+	StatusPending = "pending"
+)
+
+// Entry describes a torrent in the queue.
+type Entry struct {
+	InfoHash core.InfoHash `json:"info_hash"`
+	Priority int           `json:"priority"`
+
+	// Status is ready if the torrent may announce, waiting if it becomes
+	// ready at ReadyAt, and pending if its announce is in flight.
+	Status  string    `json:"status"`
+	ReadyAt time.Time `json:"ready_at"`
 }
 
-// QueueImpl is the primary implementation of Queue. QueueImpl is not thread
-// safe -- synchronization must be provided by clients.
+// Option allows setting optional QueueImpl parameters.
+type Option func(*QueueImpl)
+
+// WithClock configures a QueueImpl with a custom clock.
+func WithClock(clk clock.Clock) Option {
+	return func(q *QueueImpl) { q.clk = clk }
+}
+
+// QueueImpl is the primary implementation of Queue. Torrents ready to announce
+// are kept in a heap ordered by priority, then by the order in which they
+// became ready. Torrents scheduled to become ready later are kept in a second
+// heap ordered by deadline, and are moved into the ready heap once their
+// deadline passes. All operations are O(log n).
+//
+// QueueImpl is not thread safe -- synchronization must be provided by clients.
 type QueueImpl struct {
-	// Main queue of torrents ready to announce.
-	readyQueue *list.List
+	clk clock.Clock
+
+	// All torrents in the queue, whether ready, waiting or pending.
+	entries map[core.InfoHash]*entry
+
+	ready   *entryHeap
+	waiting *entryHeap
 
 	// Set of torrents with pending announce requests.
 	pending map[core.InfoHash]bool
+
+	// seq orders torrents of equal priority by when they became ready.
+	seq uint64
 }
 
 // New returns a new QueueImpl.
-func New() *QueueImpl {
-	return &QueueImpl{
-		readyQueue: list.New(),
-		pending:    make(map[core.InfoHash]bool),
+func New(opts ...Option) *QueueImpl {
+	q := &QueueImpl{
+		clk:     clock.New(),
+		entries: make(map[core.InfoHash]*entry),
+		ready: newEntryHeap(func(a, b *entry) bool {
+			if a.priority != b.priority {
+				return a.priority > b.priority
+			}
+			return a.seq < b.seq
+		}),
+		waiting: newEntryHeap(func(a, b *entry) bool {
+			if !a.readyAt.Equal(b.readyAt) {
+				return a.readyAt.Before(b.readyAt)
+			}
+			return a.seq < b.seq
+		}),
+		pending: make(map[core.InfoHash]bool),
 	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
 }
 
 // Next returns the next torrent ready to announce. After Next is called,
@@ -50,20 +123,27 @@ func New() *QueueImpl {
 // again in Next until Ready is called with said torrent. Second return
 // value is false if no torrents are ready.
 func (q *QueueImpl) Next() (core.InfoHash, bool) {
-	next := q.readyQueue.Front()
-	if next == nil {
+	now := q.clk.Now()
+	for q.waiting.Len() > 0 && !q.waiting.peek().readyAt.After(now) {
+		q.push(q.ready, heap.Pop(q.waiting).(*entry))
+	}
+	if q.ready.Len() == 0 {
 		return core.InfoHash{}, false
 	}
-	q.readyQueue.Remove(next)
-	h := next.Value.(core.InfoHash)
-	q.pending[h] = true
-	return h, true
+	e := heap.Pop(q.ready).(*entry)
+	q.pending[e.h] = true
+	return e.h, true
 }
 
-// Add adds a torrent to the back of the queue. Behavior is undefined if called
-// twice on the same torrent.
+// Add adds a torrent to the back of the queue of its priority. Noops if the
+// torrent is already in the queue.
 func (q *QueueImpl) Add(h core.InfoHash) {
-	q.readyQueue.PushBack(h)
+	if _, ok := q.entries[h]; ok {
+		return
+	}
+	e := &entry{h: h, priority: PriorityDefault}
+	q.entries[h] = e
+	q.push(q.ready, e)
 }
 
 // Ready places a pending torrent back in the queue. Should be called once an
@@ -73,18 +153,164 @@ func (q *QueueImpl) Ready(h core.InfoHash) {
 		return
 	}
 	delete(q.pending, h)
-	q.readyQueue.PushBack(h)
+	q.push(q.ready, q.entries[h])
+}
+
+// ReadyAt places a pending torrent back in the queue once t passes. Torrents
+// already waiting in the queue are rescheduled to t.
+func (q *QueueImpl) ReadyAt(h core.InfoHash, t time.Time) {
+	e, ok := q.entries[h]
+	if !ok {
+		return
+	}
+	if q.pending[h] {
+		delete(q.pending, h)
+	} else {
+		q.remove(e)
+	}
+	e.readyAt = t
+	q.push(q.waiting, e)
+}
+
+// SetPriority sets the priority of h, which is retained until h is ejected.
+func (q *QueueImpl) SetPriority(h core.InfoHash, priority int) {
+	e, ok := q.entries[h]
+	if !ok || e.priority == priority {
+		return
+	}
+	e.priority = priority
+	if e.heap == q.ready {
+		heap.Fix(q.ready, e.index)
+	}
 }
 
 // Eject immediately ejects h from the announce queue, preventing it from
 // announcing further.
 func (q *QueueImpl) Eject(h core.InfoHash) {
+	e, ok := q.entries[h]
+	if !ok {
+		return
+	}
+	q.remove(e)
+	delete(q.entries, h)
 	delete(q.pending, h)
-	for e := q.readyQueue.Front(); e != nil; e = e.Next() {
-		if e.Value.(core.InfoHash) == h {
-			q.readyQueue.Remove(e)
-		}
+}
+
+// Take marks h as pending if it is ready, as if it were returned by Next, such
+// that h may be announced immediately. Returns false if h is not in the queue,
+// is waiting, or is already pending.
+func (q *QueueImpl) Take(h core.InfoHash) bool {
+	e, ok := q.entries[h]
+	if !ok || e.heap != q.ready {
+		return false
 	}
+	q.remove(e)
+	q.pending[h] = true
+	return true
+}
+
+// Len returns the number of torrents in the queue, including pending torrents.
+func (q *QueueImpl) Len() int {
+	return len(q.entries)
+}
+
+// Snapshot returns all torrents in the queue. Ready torrents are listed first,
+// in the order they would be returned by Next, followed by waiting torrents by
+// deadline and pending torrents.
+func (q *QueueImpl) Snapshot() []Entry {
+	ready := append([]*entry(nil), q.ready.entries...)
+	sort.Slice(ready, func(i, j int) bool { return q.ready.less(ready[i], ready[j]) })
+	waiting := append([]*entry(nil), q.waiting.entries...)
+	sort.Slice(waiting, func(i, j int) bool { return q.waiting.less(waiting[i], waiting[j]) })
+
+	entries := make([]Entry, 0, len(q.entries))
+	for _, e := range ready {
+		entries = append(entries, Entry{InfoHash: e.h, Priority: e.priority, Status: StatusReady})
+	}
+	for _, e := range waiting {
+		entries = append(entries, Entry{
+			InfoHash: e.h,
+			Priority: e.priority,
+			Status:   StatusWaiting,
+			ReadyAt:  e.readyAt,
+		})
+	}
+	var pending []Entry
+	for h := range q.pending {
+		pending = append(pending, Entry{
+			InfoHash: h,
+			Priority: q.entries[h].priority,
+			Status:   StatusPending,
+		})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].InfoHash.String() < pending[j].InfoHash.String()
+	})
+	return append(entries, pending...)
+}
+
+func (q *QueueImpl) push(hp *entryHeap, e *entry) {
+	q.seq++
+	e.seq = q.seq
+	heap.Push(hp, e)
+}
+
+func (q *QueueImpl) remove(e *entry) {
+	if e.heap != nil {
+		heap.Remove(e.heap, e.index)
+	}
+}
+
+type entry struct {
+	h        core.InfoHash
+	priority int
+	readyAt  time.Time
+	seq      uint64
+
+	// heap is the heap containing the entry, or nil if pending.
+	heap  *entryHeap
+	index int
+}
+
+// entryHeap implements heap.Interface, tracking the index of each entry such
+// that entries may be removed or fixed in O(log n).
+type entryHeap struct {
+	entries []*entry
+	less    func(a, b *entry) bool
+}
+
+func newEntryHeap(less func(a, b *entry) bool) *entryHeap {
+	return &entryHeap{less: less}
+}
+
+func (h *entryHeap) Len() int { return len(h.entries) }
+
+func (h *entryHeap) Less(i, j int) bool { return h.less(h.entries[i], h.entries[j]) }
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.heap = h
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	n := len(h.entries)
+	e := h.entries[n-1]
+	h.entries[n-1] = nil
+	h.entries = h.entries[:n-1]
+	e.heap = nil
+	return e
+}
+
+func (h *entryHeap) peek() *entry {
+	return h.entries[0]
 }
 
 // DisabledQueue is a Queue which ignores all input and constantly returns that
@@ -106,5 +332,17 @@ func (q DisabledQueue) Add(core.InfoHash) {}
 // Ready noops.
 func (q DisabledQueue) Ready(core.InfoHash) {}
 
+// ReadyAt noops.
+func (q DisabledQueue) ReadyAt(core.InfoHash, time.Time) {}
+
+// SetPriority noops.
+func (q DisabledQueue) SetPriority(core.InfoHash, int) {}
+
 // Eject noops.
 func (q DisabledQueue) Eject(core.InfoHash) {}
+
+// Take never takes a torrent.
+func (q DisabledQueue) Take(core.InfoHash) bool { return false }
+
+// Snapshot returns no torrents.
+func (q DisabledQueue) Snapshot() []Entry { return nil }
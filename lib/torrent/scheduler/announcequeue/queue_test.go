@@ -15,9 +15,11 @@ package announcequeue
 
 import (
 	"testing"
+	"time"
 
 	"github.com/uber/kraken/core"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -59,6 +61,11 @@ func TestQueueEjectDeletesTorrentInAllStates(t *testing.T) {
 			q.Add(h)
 			q.Next()
 		}},
+		{"torrent waiting", func(q *QueueImpl, h core.InfoHash) {
+			q.Add(h)
+			q.Next()
+			q.ReadyAt(h, time.Time{})
+		}},
 	}
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
@@ -81,3 +88,197 @@ func TestQueueEjectDeletesTorrentInAllStates(t *testing.T) {
 		})
 	}
 }
+
+func TestQueueNextOrdersByPriorityThenReadiness(t *testing.T) {
+	require := require.New(t)
+	q := New()
+
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+	h3 := core.InfoHashFixture()
+	h4 := core.InfoHashFixture()
+
+	q.Add(h1)
+	q.Add(h2)
+	q.Add(h3)
+	q.Add(h4)
+	q.SetPriority(h3, PriorityLeecher)
+	q.SetPriority(h4, PriorityLeecher)
+
+	var order []core.InfoHash
+	for {
+		h, ok := q.Next()
+		if !ok {
+			break
+		}
+		order = append(order, h)
+	}
+	require.Equal([]core.InfoHash{h3, h4, h1, h2}, order)
+
+	// Priorities are retained while torrents are pending.
+	q.Ready(h1)
+	q.Ready(h4)
+	h, ok := q.Next()
+	require.True(ok)
+	require.Equal(h4, h)
+}
+
+func TestQueueReadyAtDelaysTorrentUntilDeadline(t *testing.T) {
+	require := require.New(t)
+	clk := clock.NewMock()
+	q := New(WithClock(clk))
+
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+
+	q.Add(h1)
+	q.Add(h2)
+	q.Next()
+	q.Next()
+
+	q.ReadyAt(h1, clk.Now().Add(2*time.Second))
+	q.ReadyAt(h2, clk.Now().Add(time.Second))
+
+	_, ok := q.Next()
+	require.False(ok)
+
+	clk.Add(time.Second)
+	h, ok := q.Next()
+	require.True(ok)
+	require.Equal(h2, h)
+
+	_, ok = q.Next()
+	require.False(ok)
+
+	clk.Add(time.Second)
+	h, ok = q.Next()
+	require.True(ok)
+	require.Equal(h1, h)
+}
+
+func TestQueueAddIsIdempotent(t *testing.T) {
+	require := require.New(t)
+	q := New()
+	h := core.InfoHashFixture()
+
+	q.Add(h)
+	q.Add(h)
+	require.Equal(1, q.Len())
+
+	_, ok := q.Next()
+	require.True(ok)
+	_, ok = q.Next()
+	require.False(ok)
+
+	q.Eject(h)
+	require.Equal(0, q.Len())
+}
+
+func TestQueueSnapshot(t *testing.T) {
+	require := require.New(t)
+	clk := clock.NewMock()
+	q := New(WithClock(clk))
+
+	pending := core.InfoHashFixture()
+	waiting := core.InfoHashFixture()
+	ready := core.InfoHashFixture()
+	leecher := core.InfoHashFixture()
+
+	q.Add(pending)
+	q.Add(waiting)
+	q.Next()
+	q.Next()
+	q.ReadyAt(waiting, clk.Now().Add(time.Second))
+	q.Add(ready)
+	q.Add(leecher)
+	q.SetPriority(leecher, PriorityLeecher)
+
+	require.Equal([]Entry{
+		{InfoHash: leecher, Priority: PriorityLeecher, Status: StatusReady},
+		{InfoHash: ready, Status: StatusReady},
+		{InfoHash: waiting, Status: StatusWaiting, ReadyAt: clk.Now().Add(time.Second)},
+		{InfoHash: pending, Status: StatusPending},
+	}, q.Snapshot())
+}
+
+const _benchmarkTorrents = 100000
+
+func benchmarkQueue(b *testing.B, opts ...Option) (*QueueImpl, []core.InfoHash) {
+	q := New(opts...)
+	hashes := make([]core.InfoHash, _benchmarkTorrents)
+	for i := range hashes {
+		hashes[i] = core.InfoHashFixture()
+		q.Add(hashes[i])
+		if i%10 == 0 {
+			q.SetPriority(hashes[i], PriorityLeecher)
+		}
+	}
+	b.ResetTimer()
+	return q, hashes
+}
+
+func BenchmarkQueueNextReady(b *testing.B) {
+	q, _ := benchmarkQueue(b)
+	for i := 0; i < b.N; i++ {
+		h, _ := q.Next()
+		q.Ready(h)
+	}
+}
+
+func BenchmarkQueueNextReadyAt(b *testing.B) {
+	clk := clock.NewMock()
+	q, _ := benchmarkQueue(b, WithClock(clk))
+	for i := 0; i < b.N; i++ {
+		h, ok := q.Next()
+		if !ok {
+			clk.Add(time.Second)
+			continue
+		}
+		q.ReadyAt(h, clk.Now().Add(time.Duration(i%1000)*time.Millisecond))
+	}
+}
+
+func BenchmarkQueueSetPriority(b *testing.B) {
+	q, hashes := benchmarkQueue(b)
+	for i := 0; i < b.N; i++ {
+		q.SetPriority(hashes[i%len(hashes)], i%3)
+	}
+}
+
+func BenchmarkQueueEjectAdd(b *testing.B) {
+	q, hashes := benchmarkQueue(b)
+	for i := 0; i < b.N; i++ {
+		h := hashes[i%len(hashes)]
+		q.Eject(h)
+		q.Add(h)
+	}
+}
+
+func TestQueueTake(t *testing.T) {
+	require := require.New(t)
+	clk := clock.NewMock()
+	q := New(WithClock(clk))
+
+	h := core.InfoHashFixture()
+	waiting := core.InfoHashFixture()
+
+	require.False(q.Take(h))
+
+	q.Add(waiting)
+	q.Next()
+	q.ReadyAt(waiting, clk.Now().Add(time.Second))
+	q.Add(h)
+
+	require.True(q.Take(h))
+	require.False(q.Take(h))
+	require.False(q.Take(waiting))
+
+	// Taken torrents are pending until ready.
+	_, ok := q.Next()
+	require.False(ok)
+
+	q.Ready(h)
+	next, ok := q.Next()
+	require.True(ok)
+	require.Equal(h, next)
+}
@@ -14,6 +14,7 @@
 package announcer
 
 import (
+	"sync"
 	"time"
 
 	"github.com/uber/kraken/core"
@@ -28,6 +29,10 @@ import (
 type Config struct {
 	DefaultInterval time.Duration `yaml:"default_interval"`
 	MaxInterval     time.Duration `yaml:"max_interval"`
+
+	// Version is the announce protocol version used for all announces of a
+	// torrent, including stopped announces. Defaults to announceclient.V1.
+	Version int `yaml:"version"`
 }
 
 func (c Config) applyDefaults() Config {
@@ -37,6 +42,9 @@ func (c Config) applyDefaults() Config {
 	if c.MaxInterval == 0 {
 		c.MaxInterval = time.Minute
 	}
+	if c.Version == 0 {
+		c.Version = announceclient.V1
+	}
 	return c
 }
 
@@ -48,6 +56,7 @@ type Events interface {
 // Announcer is a thin wrapper around an announceclient.Client which handles
 // changes to the announce interval.
 type Announcer struct {
+	mu       sync.Mutex // Protects config.
 	config   Config
 	client   announceclient.Client
 	events   Events
@@ -85,29 +94,77 @@ func Default(
 }
 
 // Announce announces through the underlying client and returns the resulting
-// peer handout. Updates the announce interval if it has changed.
+// peer handout, and the blob content if the tracker inlined it. Updates the
+// announce interval if it has changed.
 func (a *Announcer) Announce(
-	d core.Digest, h core.InfoHash, complete bool) ([]*core.PeerInfo, error) {
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges) (peers []*core.PeerInfo, content []byte, err error) {
 
-	peers, interval, err := a.client.Announce(d, h, complete, announceclient.V1)
+	config := a.currentConfig()
+	var interval time.Duration
+	if ic, ok := a.client.(announceclient.InlineClient); ok {
+		var resp *announceclient.Response
+		resp, err = ic.AnnounceInline(d, h, complete, have, config.Version)
+		if resp != nil {
+			peers, interval, content = resp.Peers, resp.Interval, resp.Content
+		}
+	} else {
+		peers, interval, err = a.client.Announce(d, h, complete, have, config.Version)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if interval == 0 {
 		// Protect against unset intervals.
-		interval = a.config.DefaultInterval
+		interval = config.DefaultInterval
 	}
-	if interval > a.config.MaxInterval {
+	if interval > config.MaxInterval {
 		// Since the timer is only reset on ticks, a wildly high interval can lock
 		// down future updates to interval. The max interval protects against a
 		// mistake in the central authority which will become impossible to correct.
-		interval = a.config.DefaultInterval
+		interval = config.DefaultInterval
 	}
 	if a.interval.Swap(int64(interval)) != int64(interval) {
 		// Note: updated interval will take effect after next tick.
 		a.logger.Infof("Announce interval updated to %s", interval)
 	}
-	return peers, nil
+	return peers, content, nil
+}
+
+// SetConfig replaces the config of a. If the current interval is the previous
+// default or exceeds the new max, it is replaced by the new default. As with
+// interval updates from the tracker, changes take effect after the next tick.
+func (a *Announcer) SetConfig(config Config) {
+	config = config.applyDefaults()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	interval := time.Duration(a.interval.Load())
+	if interval == a.config.DefaultInterval || interval > config.MaxInterval {
+		a.interval.Store(int64(config.DefaultInterval))
+	}
+	a.config = config
+}
+
+func (a *Announcer) currentConfig() Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.config
+}
+
+// AnnounceStopped notifies the tracker that the torrent identified by (d, h)
+// is no longer served, using the same version as Announce. No-ops if the
+// underlying client does not support stopped announces.
+func (a *Announcer) AnnounceStopped(d core.Digest, h core.InfoHash) error {
+	sc, ok := a.client.(announceclient.StoppedClient)
+	if !ok {
+		return nil
+	}
+	return sc.AnnounceStopped(d, h, a.currentConfig().Version)
 }
 
 // Ticker emits AnnounceTick events at the current announce interval, which may be
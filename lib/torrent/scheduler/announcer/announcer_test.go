@@ -97,9 +97,9 @@ func TestAnnouncerAnnounceUpdatesInterval(t *testing.T) {
 	interval := 10 * time.Second
 	peers := []*core.PeerInfo{core.PeerInfoFixture()}
 
-	mocks.client.EXPECT().Announce(d, hash, false, announceclient.V1).Return(peers, interval, nil)
+	mocks.client.EXPECT().Announce(d, hash, false, nil, announceclient.V1).Return(peers, interval, nil)
 
-	result, err := announcer.Announce(d, hash, false)
+	result, _, err := announcer.Announce(d, hash, false, nil)
 	require.NoError(err)
 	require.Equal(peers, result)
 
@@ -129,8 +129,60 @@ func TestAnnouncerAnnounceErr(t *testing.T) {
 	hash := core.InfoHashFixture()
 	err := errors.New("some error")
 
-	mocks.client.EXPECT().Announce(d, hash, false, announceclient.V1).Return(nil, time.Duration(0), err)
+	mocks.client.EXPECT().Announce(d, hash, false, nil, announceclient.V1).Return(nil, time.Duration(0), err)
 
-	_, aErr := announcer.Announce(d, hash, false)
+	_, _, aErr := announcer.Announce(d, hash, false, nil)
 	require.Equal(err, aErr)
 }
+
+func TestAnnouncerSetConfigUpdatesDefaultInterval(t *testing.T) {
+	mocks, cleanup := newAnnouncerMocks(t)
+	defer cleanup()
+
+	announcer := mocks.newAnnouncer(Config{DefaultInterval: 5 * time.Second})
+
+	go announcer.Ticker(nil)
+
+	announcer.SetConfig(Config{DefaultInterval: 10 * time.Second})
+
+	// The new interval takes effect after the next tick.
+	mocks.clk.Add(5 * time.Second)
+	mocks.events.expectTick(t)
+
+	mocks.clk.Add(5 * time.Second)
+	mocks.events.expectNoTick(t)
+
+	mocks.clk.Add(5 * time.Second)
+	mocks.events.expectTick(t)
+}
+
+type stoppedClient struct {
+	*mockannounceclient.MockClient
+	versions []int
+}
+
+func (c *stoppedClient) AnnounceStopped(d core.Digest, h core.InfoHash, version int) error {
+	c.versions = append(c.versions, version)
+	return nil
+}
+
+func TestAnnouncerUsesConfiguredVersion(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newAnnouncerMocks(t)
+	defer cleanup()
+
+	client := &stoppedClient{MockClient: mocks.client}
+	announcer := New(
+		Config{Version: announceclient.V2}, client, mocks.events, mocks.clk, zap.NewNop().Sugar())
+
+	d := core.DigestFixture()
+	hash := core.InfoHashFixture()
+
+	mocks.client.EXPECT().Announce(d, hash, true, nil, announceclient.V2).Return(nil, time.Second, nil)
+
+	_, _, err := announcer.Announce(d, hash, true, nil)
+	require.NoError(err)
+	require.NoError(announcer.AnnounceStopped(d, hash))
+	require.Equal([]int{announceclient.V2}, client.versions)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// BandwidthReportConfig defines the aggregation of bytes uploaded and
+// downloaded per namespace over fixed windows, such that network costs may be
+// attributed to the teams whose content is distributed.
+type BandwidthReportConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Window is the duration of each aggregation window. Windows are aligned
+	// to multiples of Window.
+	Window time.Duration `yaml:"window"`
+
+	// SampleInterval is the interval in which bytes transferred by in-progress
+	// and seeding torrents are attributed to the current window.
+	SampleInterval time.Duration `yaml:"sample_interval"`
+
+	// MaxWindows is the number of closed windows retained for Stats.
+	MaxWindows int `yaml:"max_windows"`
+
+	// SinkURL, if set, receives every closed window as a JSON BandwidthReport.
+	SinkURL string `yaml:"sink_url"`
+}
+
+func (c BandwidthReportConfig) applyDefaults() BandwidthReportConfig {
+	if c.Window == 0 {
+		c.Window = time.Hour
+	}
+	if c.SampleInterval == 0 {
+		c.SampleInterval = 10 * time.Second
+	}
+	if c.MaxWindows == 0 {
+		c.MaxWindows = 24
+	}
+	return c
+}
+
+// NamespaceBandwidth is the number of bytes transferred for a namespace.
+type NamespaceBandwidth struct {
+	UploadedBytes   int64 `json:"uploaded_bytes"`
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+}
+
+// BandwidthWindow is the bandwidth used per namespace within [Start, End).
+type BandwidthWindow struct {
+	Start      time.Time                     `json:"start"`
+	End        time.Time                     `json:"end"`
+	Namespaces map[string]NamespaceBandwidth `json:"namespaces"`
+}
+
+// BandwidthReport is sent to the configured sink once a window closes.
+type BandwidthReport struct {
+	PeerID core.PeerID     `json:"peer_id"`
+	Window BandwidthWindow `json:"window"`
+}
+
+// BandwidthSink receives closed bandwidth windows.
+type BandwidthSink interface {
+	Report(r *BandwidthReport) error
+}
+
+type httpBandwidthSink struct {
+	url string
+}
+
+func (s httpBandwidthSink) Report(r *BandwidthReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal report: %s", err)
+	}
+	resp, err := httputil.Post(
+		s.url,
+		httputil.SendBody(bytes.NewReader(body)),
+		httputil.SendTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func withBandwidthSink(sink BandwidthSink) option {
+	return func(o *schedOverrides) { o.bandwidthSink = sink }
+}
+
+// bandwidthUsage aggregates bandwidth per namespace into windows. It is only
+// accessed from the event loop.
+type bandwidthUsage struct {
+	window     time.Duration
+	maxWindows int
+
+	current BandwidthWindow
+	closed  []BandwidthWindow
+}
+
+func newBandwidthUsage(config BandwidthReportConfig, now time.Time) *bandwidthUsage {
+	u := &bandwidthUsage{
+		window:     config.Window,
+		maxWindows: config.MaxWindows,
+	}
+	u.open(now)
+	return u
+}
+
+func (u *bandwidthUsage) open(now time.Time) {
+	start := now.Truncate(u.window)
+	u.current = BandwidthWindow{
+		Start:      start,
+		End:        start.Add(u.window),
+		Namespaces: make(map[string]NamespaceBandwidth),
+	}
+}
+
+func (u *bandwidthUsage) add(namespace string, uploaded, downloaded int64) {
+	if uploaded == 0 && downloaded == 0 {
+		return
+	}
+	b := u.current.Namespaces[namespace]
+	b.UploadedBytes += uploaded
+	b.DownloadedBytes += downloaded
+	u.current.Namespaces[namespace] = b
+}
+
+// roll closes the current window if now is past its end, and returns the
+// closed window. Bytes sampled late are attributed to the window they were
+// sampled in.
+func (u *bandwidthUsage) roll(now time.Time) (BandwidthWindow, bool) {
+	if now.Before(u.current.End) {
+		return BandwidthWindow{}, false
+	}
+	w := u.current
+	u.closed = append(u.closed, w)
+	if len(u.closed) > u.maxWindows {
+		u.closed = u.closed[len(u.closed)-u.maxWindows:]
+	}
+	u.open(now)
+	return w, true
+}
+
+// windows returns all retained windows, oldest first, including the current
+// window.
+func (u *bandwidthUsage) windows() []BandwidthWindow {
+	windows := make([]BandwidthWindow, 0, len(u.closed)+1)
+	windows = append(windows, u.closed...)
+	current := u.current
+	current.Namespaces = make(map[string]NamespaceBandwidth, len(u.current.Namespaces))
+	for ns, b := range u.current.Namespaces {
+		current.Namespaces[ns] = b
+	}
+	return append(windows, current)
+}
+
+// sampleBandwidth attributes the bytes transferred by ctrl since the last
+// sample to its namespace.
+func (s *state) sampleBandwidth(ctrl *torrentControl) {
+	if s.sched.bandwidth == nil {
+		return
+	}
+	up := ctrl.dispatcher.BytesUploaded()
+	down := ctrl.dispatcher.BytesDownloaded()
+	s.sched.bandwidth.add(ctrl.namespace, up-ctrl.sampledUploaded, down-ctrl.sampledDownloaded)
+	ctrl.sampledUploaded = up
+	ctrl.sampledDownloaded = down
+}
+
+// bandwidthTickEvent occurs periodically to sample bandwidth per namespace.
+type bandwidthTickEvent struct{}
+
+func (e bandwidthTickEvent) apply(s *state) {
+	for _, ctrl := range s.torrentControls {
+		s.sampleBandwidth(ctrl)
+	}
+	w, ok := s.sched.bandwidth.roll(s.sched.clock.Now())
+	if !ok {
+		return
+	}
+	if s.sched.bandwidthSink != nil {
+		go s.sched.reportBandwidth(&BandwidthReport{s.sched.pctx.PeerID, w})
+	}
+}
+
+func (s *scheduler) reportBandwidth(r *BandwidthReport) {
+	if err := s.bandwidthSink.Report(r); err != nil {
+		s.stats.Counter("bandwidth_report_errors").Inc(1)
+		s.log().Errorf("Error reporting bandwidth: %s", err)
+		return
+	}
+	s.stats.Counter("bandwidth_reports").Inc(1)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func TestBandwidthUsageRollsWindows(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC)
+	u := newBandwidthUsage(BandwidthReportConfig{Window: time.Hour, MaxWindows: 2}, start)
+
+	u.add("a", 1, 2)
+	u.add("a", 3, 4)
+	u.add("b", 0, 0)
+
+	_, ok := u.roll(start.Add(29 * time.Minute))
+	require.False(ok)
+
+	w, ok := u.roll(start.Add(30 * time.Minute))
+	require.True(ok)
+	require.Equal(BandwidthWindow{
+		Start:      start.Truncate(time.Hour),
+		End:        start.Truncate(time.Hour).Add(time.Hour),
+		Namespaces: map[string]NamespaceBandwidth{"a": {4, 6}},
+	}, w)
+
+	u.add("b", 5, 0)
+	u.roll(start.Add(90 * time.Minute))
+	u.roll(start.Add(150 * time.Minute))
+
+	// Only the latest closed windows are retained.
+	windows := u.windows()
+	require.Len(windows, 3)
+	require.Equal(map[string]NamespaceBandwidth{"b": {5, 0}}, windows[0].Namespaces)
+	require.Empty(windows[1].Namespaces)
+	require.Empty(windows[2].Namespaces)
+}
+
+type bandwidthReportChan chan *BandwidthReport
+
+func (c bandwidthReportChan) Report(r *BandwidthReport) error {
+	c <- r
+	return nil
+}
+
+func TestBandwidthReportedPerNamespace(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+	config.BandwidthReport = BandwidthReportConfig{
+		Enable:         true,
+		Window:         20 * time.Millisecond,
+		SampleInterval: 5 * time.Millisecond,
+	}
+
+	seeder := mocks.newPeer(config)
+
+	reports := make(bandwidthReportChan, 100)
+	leecher := mocks.newPeer(config, withBandwidthSink(reports))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	// Downloaded bytes may be spread across several windows.
+	var downloaded int64
+	timeout := time.After(5 * time.Second)
+	for downloaded < blob.Length() {
+		select {
+		case r := <-reports:
+			require.Equal(leecher.pctx.PeerID, r.PeerID)
+			downloaded += r.Window.Namespaces[namespace].DownloadedBytes
+		case <-timeout:
+			require.FailNow("bandwidth not reported")
+		}
+	}
+	require.Equal(blob.Length(), downloaded)
+
+	stats, err := seeder.scheduler.Stats()
+	require.NoError(err)
+	var uploaded int64
+	for _, w := range stats.Bandwidth {
+		uploaded += w.Namespaces[namespace].UploadedBytes
+	}
+	require.Equal(blob.Length(), uploaded)
+}
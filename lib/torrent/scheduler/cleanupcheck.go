@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// CleanupCheckConfig defines the verification that removed or evicted
+// torrents released all of their resources: conns, conn capacity, announce
+// queue entries and storage handles. Resources which remain are reported as
+// leaks, attributed to the peer, queue entry or holder which retains them.
+// Debug builds verify every removed torrent and panic on leaks.
+type CleanupCheckConfig struct {
+	// SampleRate is the fraction of removed torrents which are verified.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// Delay is the duration after removal at which torrents are verified,
+	// such that closed conns and released storage handles may drain first.
+	Delay time.Duration `yaml:"delay"`
+}
+
+func (c CleanupCheckConfig) applyDefaults() CleanupCheckConfig {
+	if c.Delay == 0 {
+		c.Delay = time.Minute
+	}
+	return c
+}
+
+// cleanupLeak is a resource which a torrent retained after its removal.
+type cleanupLeak struct {
+	resource string
+	detail   string
+}
+
+func (l cleanupLeak) String() string {
+	return fmt.Sprintf("%s: %s", l.resource, l.detail)
+}
+
+// scheduleCleanupCheck sends a cleanupCheckEvent for h once the cleanup check
+// delay elapses, if h is sampled.
+func (s *state) scheduleCleanupCheck(h core.InfoHash) {
+	config := s.sched.config.CleanupCheck
+	if !debugBuild && (config.SampleRate <= 0 || s.sched.rand.Float64() >= config.SampleRate) {
+		return
+	}
+	s.sched.clock.AfterFunc(config.Delay, func() {
+		s.sched.eventLoop.send(cleanupCheckEvent{h})
+	})
+}
+
+// cleanupLeaks returns all resources which are still held for h.
+func (s *state) cleanupLeaks(h core.InfoHash) []cleanupLeak {
+	var leaks []cleanupLeak
+	conns, capacity := s.conns.Retained(h)
+	for _, c := range conns {
+		leaks = append(leaks, cleanupLeak{"conn", c})
+	}
+	for _, c := range capacity {
+		leaks = append(leaks, cleanupLeak{"capacity", c})
+	}
+	for _, e := range s.announceQueue.Snapshot() {
+		if e.InfoHash == h {
+			leaks = append(leaks, cleanupLeak{"announce_queue", fmt.Sprintf("%s entry", e.Status)})
+		}
+	}
+	for _, l := range s.sched.handles.Released() {
+		if l.InfoHash == h {
+			leaks = append(leaks, cleanupLeak{
+				"storage_handle",
+				fmt.Sprintf("released by %s, held by %v", l.Owner, l.References),
+			})
+		}
+	}
+	return leaks
+}
+
+// cleanupCheckEvent occurs when a removed torrent is due for verification that
+// it released all of its resources.
+type cleanupCheckEvent struct {
+	infoHash core.InfoHash
+}
+
+func (e cleanupCheckEvent) apply(s *state) {
+	if _, ok := s.torrentControls[e.infoHash]; ok {
+		// The torrent was added again since its removal, so its resources
+		// are legitimately held.
+		return
+	}
+	s.sched.stats.Counter("cleanup_checks").Inc(1)
+	leaks := s.cleanupLeaks(e.infoHash)
+	if len(leaks) == 0 {
+		return
+	}
+	details := make([]string, len(leaks))
+	for i, l := range leaks {
+		s.sched.stats.Tagged(map[string]string{
+			"resource": l.resource,
+		}).Counter("cleanup_leaks").Inc(1)
+		details[i] = l.String()
+	}
+	if debugBuild {
+		panic(fmt.Sprintf("removed torrent %s leaked resources: %v", e.infoHash, details))
+	}
+	s.log("hash", e.infoHash, "leaks", details).Error("Removed torrent leaked resources")
+}
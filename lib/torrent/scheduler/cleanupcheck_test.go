@@ -0,0 +1,136 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+func TestRemoveTorrentSchedulesCleanupCheck(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	state := mocks.newState(Config{
+		CleanupCheck: CleanupCheckConfig{SampleRate: 1},
+	}, withClock(clk))
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	state.removeTorrent(h, ErrTorrentCancelled)
+
+	// Timers of the mock clock fire synchronously, blocking on the event loop.
+	go clk.Add(time.Minute)
+	mocks.eventLoop.expect(cleanupCheckEvent{h})
+
+	// The dispatcher drops its storage handle references asynchronously.
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		return len(state.cleanupLeaks(h)) == 0
+	}))
+}
+
+func TestPieceEvictionSchedulesCleanupCheck(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	state := mocks.newState(Config{
+		PieceEviction: PieceEvictionConfig{
+			Enable:             true,
+			DiskUsageThreshold: 1e-9,
+			KeepFraction:       0.5,
+			MinTorrentSize:     1,
+		},
+		CleanupCheck: CleanupCheckConfig{SampleRate: 1},
+	}, withClock(clk))
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+
+	tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+
+	ctrl, err := state.addTorrent(_testNamespace, tor, false)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	require.NoError(ctrl.dispatcher.Ingest(bytes.NewReader(blob.Content)))
+
+	pieceEvictionTickEvent{}.apply(state)
+	require.Empty(state.torrentControls)
+
+	// Timers of the mock clock fire synchronously, blocking on the event loop.
+	// The events of the ingested torrent completing may occur first.
+	go clk.Add(time.Minute)
+	mocks.eventLoop.waitFor(cleanupCheckEvent{h})
+
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		return len(state.cleanupLeaks(h)) == 0
+	}))
+}
+
+func TestCleanupLeaksAttributesRetainedResources(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	state.removeTorrent(h, ErrTorrentCancelled)
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		return state.sched.handles.NumOpen() == 0
+	}))
+
+	peerID := core.PeerIDFixture()
+	require.NoError(state.conns.AddPending(peerID, h, nil))
+	state.conns.SetExtraCapacity(h, 2)
+	state.announceQueue.Add(h)
+
+	require.Equal([]cleanupLeak{
+		{"conn", "pending conn to " + peerID.String()},
+		{"capacity", "extra capacity of 2 conns"},
+		{"announce_queue", "ready entry"},
+	}, state.cleanupLeaks(h))
+
+	// Other torrents are unaffected.
+	require.Empty(state.cleanupLeaks(core.InfoHashFixture()))
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package completion
+
+import "time"
+
+// Config defines Notifier configuration.
+type Config struct {
+	// JournalPath is the file pending callbacks are persisted to. Durable
+	// callbacks are disabled if empty.
+	JournalPath string `yaml:"journal_path"`
+
+	// RetryInterval is the interval in which undelivered callbacks are retried.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// Timeout is the timeout of a single callback delivery.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxAge is the duration after which callbacks are dropped, whether or not
+	// their blob landed.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 10 * time.Second
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 24 * time.Hour
+	}
+	return c
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package completion
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/log"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+)
+
+// ErrDisabled is returned when registering callbacks on a Notifier without a
+// journal.
+var ErrDisabled = errors.New("durable completion callbacks disabled")
+
+// Callback is a request to notify URL once the blob of Digest lands locally.
+type Callback struct {
+	Namespace    string      `json:"namespace"`
+	Digest       core.Digest `json:"digest"`
+	URL          string      `json:"url"`
+	RegisteredAt time.Time   `json:"registered_at"`
+
+	// Metadata is the metadata of the torrent the callback was registered
+	// for, which is echoed in the Notification.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Landed marks that the blob is available and the callback only awaits
+	// delivery.
+	Landed bool `json:"landed"`
+}
+
+type callbackKey struct {
+	digest core.Digest
+	url    string
+}
+
+func (c *Callback) key() callbackKey {
+	return callbackKey{c.Digest, c.URL}
+}
+
+// Notification is the body POSTed to callback URLs.
+type Notification struct {
+	Namespace string      `json:"namespace"`
+	Digest    core.Digest `json:"digest"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Notifier delivers completion callbacks with at-least-once semantics. Pending
+// callbacks are persisted to a local journal, such that they survive restarts
+// and are retried until delivered or expired.
+type Notifier struct {
+	config Config
+	stats  tally.Scope
+	clk    clock.Clock
+
+	mu        sync.Mutex // Protects callbacks and the journal.
+	callbacks map[callbackKey]*Callback
+
+	trigger  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a new Notifier, loading any callbacks pending from a previous
+// run.
+func New(config Config, stats tally.Scope, clk clock.Clock) (*Notifier, error) {
+	config = config.applyDefaults()
+
+	stats = stats.Tagged(map[string]string{
+		"module": "completion",
+	})
+
+	n := &Notifier{
+		config:    config,
+		stats:     stats,
+		clk:       clk,
+		callbacks: make(map[callbackKey]*Callback),
+		trigger:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if config.JournalPath != "" {
+		if err := n.load(); err != nil {
+			return nil, fmt.Errorf("load journal: %s", err)
+		}
+	}
+	return n, nil
+}
+
+// Start starts delivering callbacks in the background.
+func (n *Notifier) Start() {
+	n.wg.Add(1)
+	go n.deliveryLoop()
+}
+
+// Stop stops delivering callbacks. Undelivered callbacks remain in the
+// journal.
+func (n *Notifier) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		n.wg.Wait()
+	})
+}
+
+// Register durably records a callback to url for the blob of d, carrying md in
+// its Notification. The callback is recorded before returning, such that it is
+// delivered even if the process restarts before the blob lands.
+func (n *Notifier) Register(
+	namespace string, d core.Digest, url string, md map[string]string) error {
+
+	if n.config.JournalPath == "" {
+		return ErrDisabled
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := &Callback{
+		Namespace:    namespace,
+		Digest:       d,
+		URL:          url,
+		RegisteredAt: n.clk.Now(),
+		Metadata:     md,
+	}
+	if _, ok := n.callbacks[c.key()]; ok {
+		return nil
+	}
+	n.callbacks[c.key()] = c
+	if err := n.flush(); err != nil {
+		delete(n.callbacks, c.key())
+		return fmt.Errorf("flush journal: %s", err)
+	}
+	return nil
+}
+
+// Landed marks all callbacks of d as ready for delivery. Safe to call multiple
+// times, and for digests without callbacks.
+func (n *Notifier) Landed(d core.Digest) {
+	n.mu.Lock()
+	var changed bool
+	for _, c := range n.callbacks {
+		if c.Digest == d && !c.Landed {
+			c.Landed = true
+			changed = true
+		}
+	}
+	if changed {
+		if err := n.flush(); err != nil {
+			log.Errorf("Error flushing completion journal: %s", err)
+		}
+	}
+	n.mu.Unlock()
+
+	if changed {
+		select {
+		case n.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pending returns callbacks whose blob has not landed yet.
+func (n *Notifier) Pending() []Callback {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var result []Callback
+	for _, c := range n.callbacks {
+		if !c.Landed {
+			result = append(result, *c)
+		}
+	}
+	return result
+}
+
+func (n *Notifier) deliveryLoop() {
+	defer n.wg.Done()
+
+	tick := n.clk.Ticker(n.config.RetryInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.trigger:
+		case <-tick.C:
+		}
+		n.deliver()
+	}
+}
+
+// deliver attempts delivery of all landed callbacks and drops expired ones.
+func (n *Notifier) deliver() {
+	n.mu.Lock()
+	var ready []Callback
+	var expired int
+	for k, c := range n.callbacks {
+		if n.clk.Now().Sub(c.RegisteredAt) > n.config.MaxAge {
+			delete(n.callbacks, k)
+			expired++
+			continue
+		}
+		if c.Landed {
+			ready = append(ready, *c)
+		}
+	}
+	n.mu.Unlock()
+
+	if expired > 0 {
+		log.Infof("Dropping %d expired completion callbacks", expired)
+		n.stats.Counter("callbacks_expired").Inc(int64(expired))
+	}
+
+	var delivered []callbackKey
+	for _, c := range ready {
+		if err := n.send(c); err != nil {
+			log.With("digest", c.Digest, "url", c.URL).Infof(
+				"Error delivering completion callback, will retry: %s", err)
+			n.stats.Counter("callback_failures").Inc(1)
+			continue
+		}
+		n.stats.Counter("callbacks_delivered").Inc(1)
+		delivered = append(delivered, c.key())
+	}
+
+	if expired == 0 && len(delivered) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, k := range delivered {
+		delete(n.callbacks, k)
+	}
+	if err := n.flush(); err != nil {
+		// Delivered callbacks may be delivered again after a restart, which is
+		// permitted under at-least-once semantics.
+		log.Errorf("Error flushing completion journal: %s", err)
+	}
+}
+
+func (n *Notifier) send(c Callback) error {
+	body, err := json.Marshal(Notification{c.Namespace, c.Digest, c.Metadata})
+	if err != nil {
+		return fmt.Errorf("marshal notification: %s", err)
+	}
+	resp, err := httputil.Post(
+		c.URL,
+		httputil.SendBody(bytes.NewReader(body)),
+		httputil.SendTimeout(n.config.Timeout))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// load reads the journal into memory. A missing journal is not an error.
+func (n *Notifier) load() error {
+	b, err := ioutil.ReadFile(n.config.JournalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var callbacks []*Callback
+	if err := json.Unmarshal(b, &callbacks); err != nil {
+		return fmt.Errorf("unmarshal: %s", err)
+	}
+	for _, c := range callbacks {
+		n.callbacks[c.key()] = c
+	}
+	return nil
+}
+
+// flush atomically rewrites the journal with the current callbacks. Must be
+// called with n.mu held.
+func (n *Notifier) flush() error {
+	if n.config.JournalPath == "" {
+		return nil
+	}
+	callbacks := make([]*Callback, 0, len(n.callbacks))
+	for _, c := range n.callbacks {
+		callbacks = append(callbacks, c)
+	}
+	b, err := json.Marshal(callbacks)
+	if err != nil {
+		return fmt.Errorf("marshal: %s", err)
+	}
+	dir := filepath.Dir(n.config.JournalPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir: %s", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(n.config.JournalPath))
+	if err != nil {
+		return fmt.Errorf("temp file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %s", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), n.config.JournalPath); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package completion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+)
+
+type callbackServer struct {
+	*httptest.Server
+	notifications chan Notification
+}
+
+func newCallbackServer(status int) *callbackServer {
+	s := &callbackServer{notifications: make(chan Notification, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err == nil {
+			s.notifications <- n
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func journalFixture(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "completion")
+	require.NoError(t, err)
+	return filepath.Join(dir, "journal.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestNotifierDeliversLandedCallbacks(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := journalFixture(t)
+	defer cleanup()
+
+	server := newCallbackServer(http.StatusOK)
+	defer server.Close()
+
+	n, err := New(Config{JournalPath: path}, tally.NoopScope, clock.New())
+	require.NoError(err)
+	n.Start()
+	defer n.Stop()
+
+	d := core.DigestFixture()
+	md := map[string]string{"image": "foo/bar"}
+	require.NoError(n.Register("ns", d, server.URL, md))
+	require.Len(n.Pending(), 1)
+
+	n.Landed(d)
+
+	select {
+	case notification := <-server.notifications:
+		require.Equal(Notification{"ns", d, md}, notification)
+	case <-time.After(5 * time.Second):
+		require.FailNow("callback not delivered")
+	}
+}
+
+func TestNotifierCallbacksSurviveRestart(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := journalFixture(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+
+	n, err := New(Config{JournalPath: path}, tally.NoopScope, clock.New())
+	require.NoError(err)
+	require.NoError(n.Register("ns", d, "http://localhost:0", nil))
+
+	// Restart before the blob lands.
+	n, err = New(Config{JournalPath: path}, tally.NoopScope, clock.New())
+	require.NoError(err)
+	pending := n.Pending()
+	require.Len(pending, 1)
+	require.Equal(d, pending[0].Digest)
+}
+
+func TestNotifierRetriesFailedDeliveries(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := journalFixture(t)
+	defer cleanup()
+
+	server := newCallbackServer(http.StatusInternalServerError)
+	defer server.Close()
+
+	clk := clock.NewMock()
+	n, err := New(Config{JournalPath: path}, tally.NoopScope, clk)
+	require.NoError(err)
+
+	d := core.DigestFixture()
+	require.NoError(n.Register("ns", d, server.URL, nil))
+	n.Landed(d)
+
+	n.deliver()
+	<-server.notifications
+	n.deliver()
+	<-server.notifications
+
+	// Undelivered callbacks remain in the journal.
+	n, err = New(Config{JournalPath: path}, tally.NoopScope, clk)
+	require.NoError(err)
+	require.Len(n.callbacks, 1)
+}
+
+func TestNotifierDropsExpiredCallbacks(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := journalFixture(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	n, err := New(Config{JournalPath: path, MaxAge: time.Hour}, tally.NoopScope, clk)
+	require.NoError(err)
+
+	require.NoError(n.Register("ns", core.DigestFixture(), "http://localhost:0", nil))
+
+	clk.Add(2 * time.Hour)
+	n.deliver()
+
+	require.Empty(n.Pending())
+}
+
+func TestNotifierRegisterDisabledWithoutJournal(t *testing.T) {
+	n, err := New(Config{}, tally.NoopScope, clock.New())
+	require.NoError(t, err)
+	require.Equal(t, ErrDisabled, n.Register("ns", core.DigestFixture(), "http://localhost:0", nil))
+}
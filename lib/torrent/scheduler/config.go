@@ -16,10 +16,22 @@ package scheduler
 import (
 	"time"
 
+	"github.com/uber/kraken/lib/torrent/scheduler/announcer"
+	"github.com/uber/kraken/lib/torrent/scheduler/completion"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/conncapacity"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
+	"github.com/uber/kraken/lib/torrent/scheduler/warmup"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/tunnel"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/utils/dnscache"
 	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/memsize"
 )
 
 // Config is the Scheduler configuration.
@@ -40,6 +52,14 @@ type Config struct {
 	// ConnTTL is the max duration a connection may exist regardless of liveness.
 	ConnTTL time.Duration `yaml:"conn_ttl"`
 
+	// Announcer configures the interval of announce ticks, which the tracker
+	// may override per announce.
+	Announcer announcer.Config `yaml:"announcer"`
+
+	// TrackerFailover configures health tracking of tracker clusters when
+	// agents announce to more than one. Only applies to agents.
+	TrackerFailover announceclient.MultiConfig `yaml:"tracker_failover"`
+
 	// PreemptionInterval is the interval in which the Scheduler analyzes the
 	// status of existing conns and determines whether to preempt them.
 	PreemptionInterval time.Duration `yaml:"preemption_interval"`
@@ -48,22 +68,162 @@ type Config struct {
 	// the Scheduler.
 	EmitStatsInterval time.Duration `yaml:"emit_stats_interval"`
 
+	// Seeding bounds how long complete torrents are seeded.
+	Seeding SeedingConfig `yaml:"seeding"`
+
+	// UtilityPreemption preempts the least useful conns of torrents at conn
+	// capacity.
+	UtilityPreemption UtilityPreemptionConfig `yaml:"utility_preemption"`
+
 	// DisablePreemption disables resource preemption. Should only be used for
 	// testing purposes.
 	DisablePreemption bool `yaml:"disable_preemption"`
 
 	ProbeTimeout time.Duration `yaml:"probe_timeout"`
 
+	// LeechOnly disables seeding entirely, for constrained clients which
+	// should download torrents without serving pieces to others. Leech-only
+	// clients reject piece requests, reject incoming conns for torrents they
+	// are not downloading, drop torrents once complete, and announce as
+	// leech-only so the tracker never hands them out as a source.
+	LeechOnly bool `yaml:"leech_only"`
+
+	// MaxConcurrentDownloads limits the number of torrents which may be
+	// leeching at once. Additional torrents are queued and admitted in request
+	// order as others complete or are removed. If 0, unlimited.
+	MaxConcurrentDownloads int `yaml:"max_concurrent_downloads"`
+
+	// ExitOnPeerIDCollision exits the process when another host is observed
+	// using the local peer id, such that the peer id is regenerated on restart.
+	// Only effective with the random peer id factory. If unset, collisions are
+	// only reported.
+	ExitOnPeerIDCollision bool `yaml:"exit_on_peer_id_collision"`
+
+	// Seed seeds all randomized decisions made by the Scheduler. If unset, a
+	// seed is derived from the current time. The seed in use is logged on
+	// startup, such that a run may be reproduced by setting Seed to it.
+	Seed int64 `yaml:"seed"`
+
+	PieceEviction PieceEvictionConfig `yaml:"piece_eviction"`
+
+	Tiering TieringConfig `yaml:"tiering"`
+
+	OrphanGC OrphanGCConfig `yaml:"orphan_gc"`
+
+	// Deadline configures the escalation of torrents added with a deadline.
+	Deadline DeadlineConfig `yaml:"deadline"`
+
+	// EventLoop configures event loop queues and instrumentation.
+	EventLoop EventLoopConfig `yaml:"event_loop"`
+
+	// RampUp staggers announces and dials after startup.
+	RampUp RampUpConfig `yaml:"ramp_up"`
+
+	AnnounceBackoff AnnounceBackoffConfig `yaml:"announce_backoff"`
+
+	// Metadata configures the reporting of torrent metadata.
+	Metadata MetadataConfig `yaml:"metadata"`
+
 	ConnState connstate.Config `yaml:"connstate"`
 
 	Conn conn.Config `yaml:"conn"`
 
 	Dispatch dispatch.Config `yaml:"dispatch"`
 
+	// DiskIO configures admission control based on disk write latency.
+	DiskIO dispatch.DiskIOConfig `yaml:"disk_io"`
+
+	// PieceMemory bounds the memory of piece requests in flight, per torrent
+	// and in total.
+	PieceMemory dispatch.MemoryConfig `yaml:"piece_memory"`
+
+	// WriteOrder configures the reordering of agent piece writes for
+	// sequential disk layout.
+	WriteOrder agentstorage.WriteOrderConfig `yaml:"write_order"`
+
+	// SyncWrites fsyncs agent piece writes before marking pieces complete.
+	SyncWrites bool `yaml:"sync_writes"`
+
+	Timeline timeline.Config `yaml:"timeline"`
+
+	// Provenance configures the retention of per-piece download provenance of
+	// completed torrents.
+	Provenance provenance.Config `yaml:"provenance"`
+
+	// Tunnel configures reverse tunnels, for peers which cannot accept
+	// inbound connections, and for relays accepting on their behalf.
+	Tunnel tunnel.Config `yaml:"tunnel"`
+
+	// DNSCache configures caching of tracker and peer hostname lookups.
+	DNSCache dnscache.Config `yaml:"dns_cache"`
+
+	// SeededExport configures the export of seeded torrents for tracker
+	// reconciliation and neighbor warmup.
+	SeededExport SeededExportConfig `yaml:"seeded_export"`
+
+	// Completion configures durable completion callbacks.
+	Completion completion.Config `yaml:"completion_callbacks"`
+
+	// ConnCapacity adapts the conn capacity of each in-progress torrent to
+	// the throughput of its conns, up to
+	// ConnState.MaxOpenConnectionsPerTorrent.
+	ConnCapacity conncapacity.Config `yaml:"conn_capacity"`
+
+	// LeakWatch configures detection of storage handles which outlive their
+	// torrent.
+	LeakWatch leakwatch.Config `yaml:"leak_watch"`
+
+	// Warmup seeds torrents popular among neighbor agents on startup. Only
+	// applies to agents.
+	Warmup warmup.Config `yaml:"warmup"`
+
+	// ReputationExport configures the export of peer reputations to trackers.
+	ReputationExport ReputationExportConfig `yaml:"reputation_export"`
+
+	// Trace configures verbose tracing of individual torrents.
+	Trace TraceConfig `yaml:"trace"`
+
+	// Persist configures the persistence of scheduler state across restarts.
+	Persist PersistConfig `yaml:"persist"`
+
+	// Pinning configures the manifest of torrents which must always be seeded.
+	Pinning PinningConfig `yaml:"pinning"`
+
+	// BandwidthReport configures the aggregation of bandwidth per namespace.
+	BandwidthReport BandwidthReportConfig `yaml:"bandwidth_report"`
+
+	// Starvation configures the re-announce of leeching torrents which
+	// receive no new pieces.
+	Starvation StarvationConfig `yaml:"starvation"`
+
+	// KnownPeers configures the caching of peers which torrents successfully
+	// received pieces from.
+	KnownPeers KnownPeersConfig `yaml:"known_peers"`
+
+	// CleanupCheck configures the verification that removed torrents
+	// released all of their resources.
+	CleanupCheck CleanupCheckConfig `yaml:"cleanup_check"`
+
+	// Experiments assign fractions of torrents to alternative tunables.
+	Experiments []ExperimentConfig `yaml:"experiments"`
+
 	TorrentLog log.Config `yaml:"torrentlog"`
 	Log        log.Config `yaml:"log"`
 }
 
+// withoutHotReloadable returns c with all fields which may be reloaded without
+// restarting the Scheduler cleared. See reloadConfigEvent.
+func (c Config) withoutHotReloadable() Config {
+	c.SeederTTI = 0
+	c.LeecherTTI = 0
+	c.ConnTTI = 0
+	c.ConnTTL = 0
+	c.Announcer = announcer.Config{}
+	c.ConnState = connstate.Config{}
+	c.MaxConcurrentDownloads = 0
+	return c
+}
+
 func (c Config) applyDefaults() Config {
 	if c.SeederTTI == 0 {
 		c.SeederTTI = 5 * time.Minute
@@ -86,5 +246,65 @@ func (c Config) applyDefaults() Config {
 	if c.ProbeTimeout == 0 {
 		c.ProbeTimeout = 3 * time.Second
 	}
+	c.PieceEviction = c.PieceEviction.applyDefaults()
+	c.ConnCapacity = c.ConnCapacity.ApplyDefaults()
+	c.Tiering = c.Tiering.applyDefaults()
+	c.OrphanGC = c.OrphanGC.applyDefaults()
+	c.Deadline = c.Deadline.applyDefaults()
+	c.EventLoop = c.EventLoop.applyDefaults()
+	c.RampUp = c.RampUp.applyDefaults()
+	c.AnnounceBackoff = c.AnnounceBackoff.applyDefaults()
+	c.UtilityPreemption = c.UtilityPreemption.applyDefaults()
+	c.Seeding = c.Seeding.applyDefaults()
+	c.ReputationExport = c.ReputationExport.applyDefaults()
+	c.Persist = c.Persist.applyDefaults()
+	c.Pinning = c.Pinning.applyDefaults()
+	c.BandwidthReport = c.BandwidthReport.applyDefaults()
+	c.Metadata = c.Metadata.applyDefaults()
+	c.Starvation = c.Starvation.applyDefaults()
+	c.KnownPeers = c.KnownPeers.applyDefaults()
+	c.CleanupCheck = c.CleanupCheck.applyDefaults()
+	return c
+}
+
+// PieceEvictionConfig defines the eviction of individual pieces of large seeded
+// torrents when disk usage is high. Evicted pieces are downloaded again if the
+// torrent is later requested.
+type PieceEvictionConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Interval is the interval in which disk usage is checked.
+	Interval time.Duration `yaml:"interval"`
+
+	// DiskUsageThreshold is the fraction of disk usage above which pieces are
+	// evicted.
+	DiskUsageThreshold float64 `yaml:"disk_usage_threshold"`
+
+	// KeepFraction is the fraction of a torrent's pieces which are kept on disk
+	// after eviction.
+	KeepFraction float64 `yaml:"keep_fraction"`
+
+	// MinTorrentSize is the minimum length of torrents which are eligible for
+	// piece eviction.
+	MinTorrentSize uint64 `yaml:"min_torrent_size"`
+
+	// Namespaces orders eviction by namespace. Within the same namespace
+	// class, pieces of lower priority torrents are evicted first.
+	Namespaces NamespaceEvictionPolicy `yaml:"namespaces"`
+}
+
+func (c PieceEvictionConfig) applyDefaults() PieceEvictionConfig {
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.DiskUsageThreshold == 0 {
+		c.DiskUsageThreshold = 0.9
+	}
+	if c.KeepFraction == 0 {
+		c.KeepFraction = 0.25
+	}
+	if c.MinTorrentSize == 0 {
+		c.MinTorrentSize = memsize.GB
+	}
 	return c
 }
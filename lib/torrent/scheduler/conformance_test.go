@@ -0,0 +1,48 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn/conformance"
+)
+
+func TestSchedulerConformance(t *testing.T) {
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	seeder := mocks.newPeer(configFixture())
+
+	blob := core.SizedBlobFixture(32, 4)
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.writeTorrent(namespace, blob)
+
+	conformance.Run(t, conformance.Target{
+		Dial: func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", fmt.Sprintf("localhost:%d", seeder.pctx.Port))
+		},
+		Namespace: namespace,
+		MetaInfo:  blob.MetaInfo,
+		Content:   blob.Content,
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// ProtocolVersion identifies the wire codec spoken over a connection. Peers
+// advertise the highest version they support during handshake, and the
+// connection uses the highest version supported by both peers.
+type ProtocolVersion uint32
+
+// Protocol versions. Each version must be a superset of the previous one, and
+// message types must only ever be added in a new version, such that a peer
+// never receives a message type it cannot decode.
+const (
+	// ProtocolV1 is spoken by peers which predate protocol versioning.
+	ProtocolV1 ProtocolVersion = 1
+
+	// ProtocolV2 adds heartbeat messages.
+	ProtocolV2 ProtocolVersion = 2
+
+	// ProtocolV3 adds piece hash request and piece hash messages.
+	ProtocolV3 ProtocolVersion = 3
+
+	// ProtocolV4 adds piece request batch messages.
+	ProtocolV4 ProtocolVersion = 4
+
+	// CurrentProtocolVersion is the highest version supported by this peer.
+	CurrentProtocolVersion = ProtocolV4
+)
+
+// Framing constants. Every message is framed as a big endian uint32 length,
+// followed by the protobuf encoded message. Piece payloads follow their
+// message unframed.
+const (
+	frameHeaderSize = 4
+	maxMessageSize  = 32 * memsize.KB
+)
+
+// ErrUnsupportedMessage is returned when encoding a message type which the
+// negotiated protocol version does not support.
+var ErrUnsupportedMessage = errors.New("message type unsupported by protocol version")
+
+// codec encodes and decodes framed messages of a single protocol version.
+type codec struct {
+	version ProtocolVersion
+	types   map[p2p.Message_Type]bool
+}
+
+var _v1Types = []p2p.Message_Type{
+	p2p.Message_BITFIELD,
+	p2p.Message_PIECE_REQUEST,
+	p2p.Message_PIECE_PAYLOAD,
+	p2p.Message_ANNOUCE_PIECE,
+	p2p.Message_CANCEL_PIECE,
+	p2p.Message_ERROR,
+	p2p.Message_COMPLETE,
+	p2p.Message_REJECT,
+	p2p.Message_GOODBYE,
+}
+
+var _codecs = map[ProtocolVersion]*codec{
+	ProtocolV1: newCodec(ProtocolV1, _v1Types),
+	ProtocolV2: newCodec(ProtocolV2, _v1Types, p2p.Message_HEARTBEAT),
+	ProtocolV3: newCodec(
+		ProtocolV3, _v1Types,
+		p2p.Message_HEARTBEAT, p2p.Message_PIECE_HASH_REQUEST, p2p.Message_PIECE_HASH),
+	ProtocolV4: newCodec(
+		ProtocolV4, _v1Types,
+		p2p.Message_HEARTBEAT, p2p.Message_PIECE_HASH_REQUEST, p2p.Message_PIECE_HASH,
+		p2p.Message_PIECE_REQUEST_BATCH),
+}
+
+func newCodec(v ProtocolVersion, types []p2p.Message_Type, added ...p2p.Message_Type) *codec {
+	c := &codec{v, make(map[p2p.Message_Type]bool)}
+	for _, t := range append(append([]p2p.Message_Type(nil), types...), added...) {
+		c.types[t] = true
+	}
+	return c
+}
+
+// codecFor returns the codec of v, which must be a known version.
+func codecFor(v ProtocolVersion) *codec {
+	c, ok := _codecs[v]
+	if !ok {
+		panic(fmt.Sprintf("unknown protocol version %d", v))
+	}
+	return c
+}
+
+// _handshakeCodec encodes handshake messages, which are exchanged before a
+// version is negotiated and are therefore always encoded with the oldest
+// version.
+var _handshakeCodec = codecFor(ProtocolV1)
+
+// negotiateVersion returns the version spoken with a peer which advertised
+// remote, given the highest version local supported by this peer.
+func negotiateVersion(local ProtocolVersion, remote uint32) ProtocolVersion {
+	if remote == 0 {
+		// The remote peer predates protocol versioning.
+		return ProtocolV1
+	}
+	if ProtocolVersion(remote) < local {
+		return ProtocolVersion(remote)
+	}
+	return local
+}
+
+// supports returns true if messages of type t may be sent with c.
+func (c *codec) supports(t p2p.Message_Type) bool {
+	return c.types[t]
+}
+
+// encode writes msg to w as a single frame.
+func (c *codec) encode(w io.Writer, msg *p2p.Message) error {
+	if !c.supports(msg.Type) {
+		return ErrUnsupportedMessage
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %s", err)
+	}
+	return writeFrame(w, data)
+}
+
+// decode reads a single frame from r, which must be within limits. Message
+// types which c does not support are rejected rather than decoded, since their
+// fields are unknown to c.
+func (c *codec) decode(r io.Reader, limits MessageLimitsConfig) (*p2p.Message, error) {
+	data, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.check(msg, len(data)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *codec) unmarshal(data []byte) (*p2p.Message, error) {
+	msg := new(p2p.Message)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, violationf(ViolationMalformedMessage, "proto unmarshal: %s", err)
+	}
+	if !c.supports(msg.Type) {
+		return nil, violationf(
+			ViolationUnsupportedMessage,
+			"message type %s unsupported by protocol version %d", msg.Type, c.version)
+	}
+	if err := validateMessage(msg); err != nil {
+		return nil, ProtocolViolationError{ViolationMalformedMessage, err}
+	}
+	return msg, nil
+}
+
+// writeFrame writes data to w prefixed by its length.
+func writeFrame(w io.Writer, data []byte) error {
+	if uint64(len(data)) > maxMessageSize {
+		return fmt.Errorf("message exceeds max size: %d > %d", len(data), maxMessageSize)
+	}
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return fmt.Errorf("write data length: %s", err)
+	}
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return fmt.Errorf("write data: %s", err)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// readFrame reads a single length prefixed frame from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("read message length: %s", err)
+	}
+	dataLen := binary.BigEndian.Uint32(header[:])
+	if uint64(dataLen) > maxMessageSize {
+		return nil, violationf(
+			ViolationOversizedMessage, "message exceeds max size: %d > %d", dataLen, maxMessageSize)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read data: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/utils/bitsetutil"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+var _defaultLimits = MessageLimitsConfig{}.applyDefaults()
+
+// messageFixtures returns a populated message of every type.
+func messageFixtures() []*p2p.Message {
+	hs := &handshake{
+		peerID:          core.PeerIDFixture(),
+		digest:          core.DigestFixture(),
+		infoHash:        core.InfoHashFixture(),
+		bitfield:        bitsetutil.FromBools(true, false, true),
+		remoteBitfields: RemoteBitfields{core.PeerIDFixture(): bitsetutil.FromBools(false, true)},
+		namespace:       "some-namespace",
+		version:         CurrentProtocolVersion,
+	}
+	bitfield, err := hs.toP2PMessage()
+	if err != nil {
+		panic(err)
+	}
+	return []*p2p.Message{
+		bitfield,
+		NewPieceRequestMessage(3, 16).Message,
+		{Type: p2p.Message_PIECE_PAYLOAD, PiecePayload: &p2p.PiecePayloadMessage{Index: 3, Length: 16}},
+		NewAnnouncePieceMessage(5).Message,
+		{Type: p2p.Message_CANCEL_PIECE, CancelPiece: &p2p.CancelPieceMessage{Index: 7}},
+		NewErrorMessage(2, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errors.New("some error")).Message,
+		{Type: p2p.Message_COMPLETE, Complete: &p2p.CompleteMessage{}},
+		newRejectMessage(p2p.RejectMessage_AT_CAPACITY, errors.New("full")),
+		NewGoodbyeMessage().Message,
+		NewHeartbeatMessage([]int{1, 4, 9}).Message,
+		NewPieceHashRequestMessage(3).Message,
+		NewPieceHashMessage(3, []byte{0xde, 0xad, 0xbe, 0xef}).Message,
+		NewPieceRequestBatchMessage([]int{9, 2, 3, 4}).Message,
+	}
+}
+
+func TestMessageFixturesCoverAllTypes(t *testing.T) {
+	require := require.New(t)
+
+	types := make(map[p2p.Message_Type]bool)
+	for _, msg := range messageFixtures() {
+		types[msg.Type] = true
+	}
+	for _, v := range p2p.Message_Type_value {
+		require.True(types[p2p.Message_Type(v)], p2p.Message_Type(v).String())
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, v := range []ProtocolVersion{ProtocolV1, ProtocolV2, ProtocolV3, ProtocolV4} {
+		c := codecFor(v)
+		for _, msg := range messageFixtures() {
+			if !c.supports(msg.Type) {
+				continue
+			}
+			t.Run(fmt.Sprintf("v%d/%s", v, msg.Type), func(t *testing.T) {
+				require := require.New(t)
+
+				var buf bytes.Buffer
+				require.NoError(c.encode(&buf, msg))
+				result, err := c.decode(&buf, _defaultLimits)
+				require.NoError(err)
+				require.True(proto.Equal(msg, result), "expected %s, got %s", msg, result)
+				require.Equal(0, buf.Len())
+			})
+		}
+	}
+}
+
+func TestCodecSupportedTypes(t *testing.T) {
+	require := require.New(t)
+
+	v3Types := map[p2p.Message_Type]bool{
+		p2p.Message_PIECE_HASH_REQUEST: true,
+		p2p.Message_PIECE_HASH:         true,
+	}
+	v4Types := map[p2p.Message_Type]bool{
+		p2p.Message_PIECE_REQUEST_BATCH: true,
+	}
+	for _, msg := range messageFixtures() {
+		require.Equal(
+			msg.Type != p2p.Message_HEARTBEAT && !v3Types[msg.Type] && !v4Types[msg.Type],
+			codecFor(ProtocolV1).supports(msg.Type))
+		require.Equal(
+			!v3Types[msg.Type] && !v4Types[msg.Type], codecFor(ProtocolV2).supports(msg.Type))
+		require.Equal(!v4Types[msg.Type], codecFor(ProtocolV3).supports(msg.Type))
+		require.True(codecFor(ProtocolV4).supports(msg.Type))
+	}
+}
+
+func TestCodecRejectsUnsupportedMessages(t *testing.T) {
+	require := require.New(t)
+
+	heartbeat := NewHeartbeatMessage([]int{1}).Message
+
+	var buf bytes.Buffer
+	require.Equal(ErrUnsupportedMessage, codecFor(ProtocolV1).encode(&buf, heartbeat))
+	require.Equal(0, buf.Len())
+
+	require.NoError(codecFor(ProtocolV2).encode(&buf, heartbeat))
+	_, err := codecFor(ProtocolV1).decode(&buf, _defaultLimits)
+	require.Error(err)
+}
+
+func TestCodecRejectsOversizedFrames(t *testing.T) {
+	require := require.New(t)
+
+	c := codecFor(CurrentProtocolVersion)
+
+	msg := NewErrorMessage(
+		0, p2p.ErrorMessage_PIECE_REQUEST_FAILED,
+		errors.New(string(make([]byte, maxMessageSize))))
+	require.Error(c.encode(new(bytes.Buffer), msg.Message))
+
+	header := []byte{0xff, 0xff, 0xff, 0xff}
+	_, err := c.decode(bytes.NewReader(header), _defaultLimits)
+	require.Error(err)
+}
+
+func TestCodecEnforcesMessageLimits(t *testing.T) {
+	require := require.New(t)
+
+	c := codecFor(CurrentProtocolVersion)
+
+	msg := NewErrorMessage(
+		0, p2p.ErrorMessage_PIECE_REQUEST_FAILED,
+		errors.New(string(make([]byte, 8*memsize.KB))))
+	var buf bytes.Buffer
+	require.NoError(c.encode(&buf, msg.Message))
+	b := buf.Bytes()
+
+	_, err := c.decode(bytes.NewReader(b), _defaultLimits)
+	require.Equal(ViolationOversizedMessage, err.(ProtocolViolationError).Reason)
+
+	// Limits are per message type.
+	limits := MessageLimitsConfig{Control: 16 * memsize.KB}.applyDefaults()
+	result, err := c.decode(bytes.NewReader(b), limits)
+	require.NoError(err)
+	require.True(proto.Equal(msg.Message, result))
+}
+
+func TestMessageLimitsClampedToMaxMessageSize(t *testing.T) {
+	require := require.New(t)
+
+	limits := MessageLimitsConfig{
+		Handshake: 2 * maxMessageSize,
+		Bitfield:  2 * maxMessageSize,
+		Piece:     2 * maxMessageSize,
+		Control:   2 * maxMessageSize,
+	}.applyDefaults()
+
+	require.Equal(MessageLimitsConfig{
+		Handshake: maxMessageSize,
+		Bitfield:  maxMessageSize,
+		Piece:     maxMessageSize,
+		Control:   maxMessageSize,
+	}, limits)
+}
+
+func TestCodecRejectsMalformedMessages(t *testing.T) {
+	tests := []struct {
+		desc string
+		msg  *p2p.Message
+	}{
+		{"negative index", NewAnnouncePieceMessage(-1).Message},
+		{"negative heartbeat piece", NewHeartbeatMessage([]int{1, -1}).Message},
+		{"negative payload length", &p2p.Message{
+			Type:         p2p.Message_PIECE_PAYLOAD,
+			PiecePayload: &p2p.PiecePayloadMessage{Index: 1, Length: -1},
+		}},
+		{"missing piece request", &p2p.Message{Type: p2p.Message_PIECE_REQUEST}},
+		{"missing piece request batch", &p2p.Message{Type: p2p.Message_PIECE_REQUEST_BATCH}},
+		{"negative piece request batch delta", &p2p.Message{
+			Type:              p2p.Message_PIECE_REQUEST_BATCH,
+			PieceRequestBatch: &p2p.PieceRequestBatchMessage{IndexDeltas: []int32{4, -1}},
+		}},
+		{"duplicate piece request batch index", &p2p.Message{
+			Type:              p2p.Message_PIECE_REQUEST_BATCH,
+			PieceRequestBatch: &p2p.PieceRequestBatchMessage{IndexDeltas: []int32{4, 0}},
+		}},
+		{"piece request batch index overflow", &p2p.Message{
+			Type:              p2p.Message_PIECE_REQUEST_BATCH,
+			PieceRequestBatch: &p2p.PieceRequestBatchMessage{IndexDeltas: []int32{math.MaxInt32, 1}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			c := codecFor(CurrentProtocolVersion)
+
+			var buf bytes.Buffer
+			require.NoError(c.encode(&buf, test.msg))
+			_, err := c.decode(&buf, _defaultLimits)
+			require.Equal(ViolationMalformedMessage, err.(ProtocolViolationError).Reason)
+		})
+	}
+}
+
+func TestUnmarshalBitfield(t *testing.T) {
+	require := require.New(t)
+
+	b, err := bitsetutil.FromBools(true, false, true).MarshalBinary()
+	require.NoError(err)
+	result, err := unmarshalBitfield(b)
+	require.NoError(err)
+	require.Equal(bitsetutil.FromBools(true, false, true), result)
+
+	// A length which the encoded words cannot hold must not be allocated.
+	binary.BigEndian.PutUint64(b[:8], 1<<62)
+	_, err = unmarshalBitfield(b)
+	require.Equal(ViolationInvalidBitfield, err.(ProtocolViolationError).Reason)
+
+	_, err = unmarshalBitfield(b[:4])
+	require.Equal(ViolationInvalidBitfield, err.(ProtocolViolationError).Reason)
+}
+
+func TestCodecDecodeTruncatedFrame(t *testing.T) {
+	require := require.New(t)
+
+	c := codecFor(CurrentProtocolVersion)
+
+	var buf bytes.Buffer
+	require.NoError(c.encode(&buf, NewAnnouncePieceMessage(1).Message))
+
+	b := buf.Bytes()
+	for i := 0; i < len(b); i++ {
+		_, err := c.decode(bytes.NewReader(b[:i]), _defaultLimits)
+		require.Error(err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		desc     string
+		local    ProtocolVersion
+		remote   uint32
+		expected ProtocolVersion
+	}{
+		{"unversioned remote", ProtocolV2, 0, ProtocolV1},
+		{"older remote", ProtocolV2, 1, ProtocolV1},
+		{"same version", ProtocolV2, 2, ProtocolV2},
+		{"newer remote", ProtocolV2, 3, ProtocolV2},
+		{"pinned local", ProtocolV1, 2, ProtocolV1},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, negotiateVersion(test.local, test.remote))
+		})
+	}
+}
+
+func TestPieceRequestBatchMessage(t *testing.T) {
+	require := require.New(t)
+
+	msg := NewPieceRequestBatchMessage([]int{1000, 3, 4, 5, 1001})
+	require.Equal([]int32{3, 1, 1, 995, 1}, msg.Message.PieceRequestBatch.IndexDeltas)
+	require.Equal(
+		[]int{3, 4, 5, 1000, 1001}, PieceRequestBatchIndices(msg.Message.PieceRequestBatch))
+}
+
+// TestCodecDecodeCorpus checks that every fixture, and a few malformed frames,
+// either fail to decode or survive a round trip. See FuzzCodecDecode for the
+// go-fuzz target.
+func TestCodecDecodeCorpus(t *testing.T) {
+	var corpus [][]byte
+	for _, msg := range messageFixtures() {
+		var buf bytes.Buffer
+		require.NoError(t, codecFor(CurrentProtocolVersion).encode(&buf, msg))
+		corpus = append(corpus, buf.Bytes())
+	}
+	corpus = append(corpus, []byte{}, []byte{0, 0, 0, 1, 0xff}, []byte{0xff, 0xff, 0xff, 0xff})
+
+	for _, v := range []ProtocolVersion{ProtocolV1, ProtocolV2, ProtocolV3, ProtocolV4} {
+		c := codecFor(v)
+		for i, data := range corpus {
+			t.Run(fmt.Sprintf("v%d_%d", v, i), func(t *testing.T) {
+				require := require.New(t)
+
+				msg, err := c.decode(bytes.NewReader(data), _defaultLimits)
+				if err != nil {
+					return
+				}
+				var buf bytes.Buffer
+				require.NoError(c.encode(&buf, msg))
+				result, err := c.decode(&buf, _defaultLimits)
+				require.NoError(err)
+				require.True(proto.Equal(msg, result))
+			})
+		}
+	}
+}
+
+// TestParseHandshakeCorpus checks that handshakes parsed from every fixture,
+// and a few malformed frames, never hold bitfields exceeding the frame. See
+// FuzzParseHandshake for the go-fuzz target.
+func TestParseHandshakeCorpus(t *testing.T) {
+	var corpus [][]byte
+	for _, msg := range messageFixtures() {
+		var buf bytes.Buffer
+		if err := _handshakeCodec.encode(&buf, msg); err == nil {
+			corpus = append(corpus, buf.Bytes())
+		}
+	}
+	corpus = append(corpus, []byte{}, []byte{0, 0, 0, 2, 0x1a, 0})
+
+	for i, data := range corpus {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			msg, err := _handshakeCodec.decode(bytes.NewReader(data), _defaultLimits)
+			if err != nil {
+				return
+			}
+			hs, err := handshakeFromP2PMessage(msg)
+			if err != nil {
+				return
+			}
+			if hs.bitfield != nil {
+				require.True(t, uint64(hs.bitfield.Len()) <= 8*maxMessageSize)
+			}
+		})
+	}
+}
+
+// TestUnmarshalBitfieldCorpus checks that bitfields decoded from valid and
+// malformed encodings never hold more bits than their encoding. See
+// FuzzUnmarshalBitfield for the go-fuzz target.
+func TestUnmarshalBitfieldCorpus(t *testing.T) {
+	var corpus [][]byte
+	for _, bools := range [][]bool{{}, {true}, {true, false, true}, make([]bool, 130)} {
+		b, err := bitsetutil.FromBools(bools...).MarshalBinary()
+		require.NoError(t, err)
+		corpus = append(corpus, b)
+	}
+	corpus = append(corpus,
+		[]byte{},
+		[]byte{0x40, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 0, 0, 0, 0, 0, 0, 0x41, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	for i, data := range corpus {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			bitfield, err := unmarshalBitfield(data)
+			if err != nil {
+				return
+			}
+			require.True(t, uint64(bitfield.Len()) <= 8*uint64(len(data)))
+		})
+	}
+}
@@ -37,7 +37,61 @@ type Config struct {
 	// is taking a long time to process a message.
 	ReceiverBufferSize int `yaml:"receiver_buffer_size"`
 
+	// Bandwidth caps the piece payloads uploaded and downloaded across all
+	// conns of the scheduler. Payloads larger than one second worth of
+	// bandwidth are paced over multiple reservations.
 	Bandwidth bandwidth.Config `yaml:"bandwidth"`
+
+	// SourceRules select the local address outgoing connections are dialed
+	// from, per destination CIDR. The first matching rule wins.
+	SourceRules []SourceRule `yaml:"source_rules"`
+
+	DSCP DSCPConfig `yaml:"dscp"`
+
+	UploadFairness FairnessConfig `yaml:"upload_fairness"`
+
+	// GracefulCloseTimeout bounds the graceful close sequence of a connection,
+	// in which queued messages are flushed and a goodbye message is sent before
+	// the connection is closed.
+	GracefulCloseTimeout time.Duration `yaml:"graceful_close_timeout"`
+
+	// DisableGracefulClose closes connections immediately, discarding any
+	// queued messages.
+	DisableGracefulClose bool `yaml:"disable_graceful_close"`
+
+	PeerMetadataCache PeerMetadataCacheConfig `yaml:"peer_metadata_cache"`
+
+	HaveReplay HaveReplayConfig `yaml:"have_replay"`
+
+	Session SessionConfig `yaml:"session"`
+
+	// MessageLimits bounds the size of inbound messages. Peers which violate
+	// the limits are disconnected.
+	MessageLimits MessageLimitsConfig `yaml:"message_limits"`
+
+	// MaxProtocolVersion is the highest protocol version advertised during
+	// handshake. Pinning an older version allows rolling out a new version
+	// before any peer relies on it. Defaults to CurrentProtocolVersion.
+	MaxProtocolVersion ProtocolVersion `yaml:"max_protocol_version"`
+}
+
+// FairnessConfig defines weighted fair queueing of piece uploads across
+// conns, such that a single greedy leecher cannot consume the entire egress
+// budget. Only has effect when bandwidth limits are enabled.
+type FairnessConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// ReciprocityBoost is the additional weight given to a conn whose remote
+	// peer uploads to us at least as much as we upload to it. Conns which
+	// reciprocate partially are boosted proportionally.
+	ReciprocityBoost float64 `yaml:"reciprocity_boost"`
+}
+
+func (c FairnessConfig) applyDefaults() FairnessConfig {
+	if c.ReciprocityBoost == 0 {
+		c.ReciprocityBoost = 1
+	}
+	return c
 }
 
 func (c Config) applyDefaults() Config {
@@ -56,5 +110,13 @@ func (c Config) applyDefaults() Config {
 	if c.Bandwidth.IngressBitsPerSec == 0 {
 		c.Bandwidth.IngressBitsPerSec = 300 * 8 * memsize.Mbit
 	}
+	if c.GracefulCloseTimeout == 0 {
+		c.GracefulCloseTimeout = 2 * time.Second
+	}
+	if c.MaxProtocolVersion == 0 || c.MaxProtocolVersion > CurrentProtocolVersion {
+		c.MaxProtocolVersion = CurrentProtocolVersion
+	}
+	c.UploadFairness = c.UploadFairness.applyDefaults()
+	c.MessageLimits = c.MessageLimits.applyDefaults()
 	return c
 }
@@ -0,0 +1,230 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package conformance is a test suite for implementations of the Kraken peer
+// protocol. The suite drives a peer under test through sequences of messages
+// over connections it dials, and checks the peer responds as a Kraken agent
+// would. Cases only rely on the wire protocol, such that any implementation
+// reachable via a reliable, ordered byte stream may be tested.
+//
+// The peer under test plays the seeder: it must accept incoming connections
+// for a torrent it has fully downloaded.
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+)
+
+// Target is a peer under test.
+type Target struct {
+	// Dial opens a new connection to the peer.
+	Dial func() (io.ReadWriteCloser, error)
+
+	// Namespace, MetaInfo and Content describe a torrent which the peer has
+	// fully downloaded and is willing to seed.
+	Namespace string
+	MetaInfo  *core.MetaInfo
+	Content   []byte
+
+	// Timeout bounds each expectation. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (t Target) validate() error {
+	if t.Dial == nil {
+		return errors.New("no dial func")
+	}
+	if t.MetaInfo == nil {
+		return errors.New("no metainfo")
+	}
+	if int64(len(t.Content)) != t.MetaInfo.Length() {
+		return fmt.Errorf(
+			"content length %d does not match metainfo length %d",
+			len(t.Content), t.MetaInfo.Length())
+	}
+	return nil
+}
+
+func (t Target) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return t.Timeout
+}
+
+// piece returns the content of piece i.
+func (t Target) piece(i int) []byte {
+	start := int64(i) * t.MetaInfo.PieceLength()
+	return t.Content[start : start+t.MetaInfo.GetPieceLength(i)]
+}
+
+// Case is a named sequence of steps run over a single connection.
+type Case struct {
+	Name  string
+	Steps []Step
+}
+
+// Run dials target and runs the steps of c in order, stopping at the first
+// step which fails.
+func (c Case) Run(target Target) error {
+	if err := target.validate(); err != nil {
+		return fmt.Errorf("invalid target: %s", err)
+	}
+	s, err := newSession(target)
+	if err != nil {
+		return fmt.Errorf("new session: %s", err)
+	}
+	defer s.Close()
+
+	for i, step := range c.Steps {
+		if err := step(s); err != nil {
+			return fmt.Errorf("step %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Cases returns the cases of the suite.
+func Cases() []Case {
+	return []Case{{
+		Name: "handshake",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+		},
+	}, {
+		Name: "handshake_legacy",
+		Steps: []Step{
+			Handshake(LegacyVersion),
+			ExpectHandshake(),
+			RequestPiece(0),
+			ExpectPiece(0),
+		},
+	}, {
+		Name: "unknown_hash_rejected",
+		Steps: []Step{
+			HandshakeUnknownTorrent(),
+			ExpectReject(p2p.RejectMessage_UNKNOWN_HASH),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "first_message_not_handshake",
+		Steps: []Step{
+			RequestPiece(0),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "piece_transfer",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			RequestAllPieces(),
+			ExpectAllPieces(),
+		},
+	}, {
+		Name: "announce_piece",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			AnnouncePiece(0),
+			RequestPiece(0),
+			ExpectPiece(0),
+		},
+	}, {
+		Name: "piece_out_of_bounds",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			RequestPieceOutOfBounds(),
+			ExpectPieceRequestFailed(),
+			RequestPiece(0),
+			ExpectPiece(0),
+		},
+	}, {
+		Name: "partial_piece_rejected",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			RequestPartialPiece(0),
+			ExpectPieceRequestFailed(),
+			RequestPiece(0),
+			ExpectPiece(0),
+		},
+	}, {
+		Name: "malformed_message",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			SendFrame([]byte{0xff, 0xff, 0xff}),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "oversized_message",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			SendFrameHeader(MaxMessageSize + 1),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "goodbye",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			Goodbye(),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "heartbeat_negotiated",
+		Steps: []Step{
+			Handshake(CurrentVersion),
+			ExpectHandshake(),
+			Heartbeat(0),
+			RequestPiece(0),
+			ExpectPiece(0),
+		},
+	}, {
+		Name: "heartbeat_not_negotiated",
+		Steps: []Step{
+			Handshake(LegacyVersion),
+			ExpectHandshake(),
+			Heartbeat(0),
+			ExpectClosed(),
+		},
+	}, {
+		Name: "have_delta_in_handshake_rejected",
+		Steps: []Step{
+			HandshakeHaveDelta(),
+			ExpectClosed(),
+		},
+	}}
+}
+
+// Run runs every case of the suite against target as a subtest of t.
+func Run(t *testing.T, target Target) {
+	for _, c := range Cases() {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.Run(target); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
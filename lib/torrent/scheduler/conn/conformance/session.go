@@ -0,0 +1,211 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conformance
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// Protocol versions advertised by handshakes of the suite.
+const (
+	// LegacyVersion is advertised by peers which predate protocol versioning.
+	LegacyVersion uint32 = 0
+
+	// CurrentVersion is the highest protocol version known to the suite.
+	CurrentVersion = uint32(conn.CurrentProtocolVersion)
+)
+
+// MaxMessageSize is the largest frame a peer must accept.
+const MaxMessageSize = 32 * memsize.KB
+
+// ErrTimeout is returned when the peer does not respond in time.
+var ErrTimeout = errors.New("timed out waiting for peer")
+
+type received struct {
+	msg     *p2p.Message
+	payload []byte
+	err     error
+}
+
+// Session is a single connection to a Target.
+type Session struct {
+	target   Target
+	rwc      io.ReadWriteCloser
+	peerID   core.PeerID
+	incoming chan received
+	done     chan struct{}
+
+	// Index of the most recently requested piece.
+	lastRequest int
+}
+
+func newSession(target Target) (*Session, error) {
+	peerID, err := core.RandomPeerID()
+	if err != nil {
+		return nil, fmt.Errorf("peer id: %s", err)
+	}
+	rwc, err := target.Dial()
+	if err != nil {
+		return nil, fmt.Errorf("dial: %s", err)
+	}
+	s := &Session{
+		target:   target,
+		rwc:      rwc,
+		peerID:   peerID,
+		incoming: make(chan received, 16),
+		done:     make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// Target returns the target of s.
+func (s *Session) Target() Target {
+	return s.target
+}
+
+// PeerID returns the peer id s handshakes with.
+func (s *Session) PeerID() core.PeerID {
+	return s.peerID
+}
+
+// Close closes the connection of s.
+func (s *Session) Close() error {
+	close(s.done)
+	return s.rwc.Close()
+}
+
+// Send frames and writes msg.
+func (s *Session) Send(msg *p2p.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %s", err)
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	return s.Write(append(header[:], data...))
+}
+
+// Write writes b to the connection as is, without framing.
+func (s *Session) Write(b []byte) error {
+	if _, err := s.rwc.Write(b); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	return nil
+}
+
+// Receive returns the next message received from the peer, along with its
+// payload for piece payload messages. Returns io.EOF once the peer closes the
+// connection, and ErrTimeout if nothing is received within the timeout of
+// the target.
+func (s *Session) Receive() (*p2p.Message, []byte, error) {
+	timer := time.NewTimer(s.target.timeout())
+	defer timer.Stop()
+	select {
+	case r, ok := <-s.incoming:
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		return r.msg, r.payload, r.err
+	case <-timer.C:
+		return nil, nil, ErrTimeout
+	}
+}
+
+// informational returns true for message types which peers may send at any
+// time, and which the suite therefore skips while expecting others.
+func informational(t p2p.Message_Type) bool {
+	switch t {
+	case p2p.Message_ANNOUCE_PIECE, p2p.Message_COMPLETE, p2p.Message_HEARTBEAT:
+		return true
+	}
+	return false
+}
+
+// receive returns the next message which is not informational.
+func (s *Session) receive() (*p2p.Message, []byte, error) {
+	for {
+		msg, payload, err := s.Receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !informational(msg.Type) {
+			return msg, payload, nil
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	defer close(s.incoming)
+	for {
+		msg, payload, err := s.read()
+		if err == io.EOF {
+			return
+		}
+		select {
+		case s.incoming <- received{msg, payload, err}:
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Session) read() (*p2p.Message, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.rwc, header[:]); err != nil {
+		// Any error while waiting for a message means the peer closed the
+		// connection, whether gracefully or not.
+		return nil, nil, io.EOF
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if uint64(n) > MaxMessageSize {
+		return nil, nil, fmt.Errorf("peer sent oversized message: %d > %d", n, MaxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.rwc, data); err != nil {
+		return nil, nil, fmt.Errorf("read message: %s", err)
+	}
+	msg := new(p2p.Message)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, nil, fmt.Errorf("peer sent malformed message: %s", err)
+	}
+	if msg.Type != p2p.Message_PIECE_PAYLOAD {
+		return msg, nil, nil
+	}
+	if msg.PiecePayload == nil {
+		return nil, nil, errors.New("piece payload message missing piece payload")
+	}
+	i := int(msg.PiecePayload.Index)
+	if i < 0 || i >= s.target.MetaInfo.NumPieces() {
+		return nil, nil, fmt.Errorf("peer sent payload of unknown piece %d", i)
+	}
+	payload := make([]byte, s.target.MetaInfo.GetPieceLength(i))
+	if _, err := io.ReadFull(s.rwc, payload); err != nil {
+		return nil, nil, fmt.Errorf("read payload of piece %d: %s", i, err)
+	}
+	return msg, payload, nil
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+
+	"github.com/willf/bitset"
+)
+
+// Step is a single action or expectation of a Case.
+type Step func(*Session) error
+
+func handshakeMessage(
+	s *Session, h core.InfoHash, d core.Digest, version uint32) (*p2p.Message, error) {
+
+	b, err := bitset.New(uint(s.target.MetaInfo.NumPieces())).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("marshal bitfield: %s", err)
+	}
+	return &p2p.Message{
+		Type: p2p.Message_BITFIELD,
+		Bitfield: &p2p.BitfieldMessage{
+			PeerID:          s.peerID.String(),
+			Name:            d.Hex(),
+			InfoHash:        h.String(),
+			BitfieldBytes:   b,
+			Namespace:       s.target.Namespace,
+			ProtocolVersion: version,
+		},
+	}, nil
+}
+
+// Handshake sends a handshake for the torrent of the target, advertising
+// version and an empty bitfield.
+func Handshake(version uint32) Step {
+	return func(s *Session) error {
+		mi := s.target.MetaInfo
+		msg, err := handshakeMessage(s, mi.InfoHash(), mi.Digest(), version)
+		if err != nil {
+			return err
+		}
+		return s.Send(msg)
+	}
+}
+
+// HandshakeUnknownTorrent sends a handshake for a torrent the target does
+// not have.
+func HandshakeUnknownTorrent() Step {
+	return func(s *Session) error {
+		msg, err := handshakeMessage(
+			s, core.InfoHashFixture(), core.DigestFixture(), CurrentVersion)
+		if err != nil {
+			return err
+		}
+		return s.Send(msg)
+	}
+}
+
+// HandshakeHaveDelta sends a handshake which replays completed pieces in
+// place of a bitfield. Deltas are only valid in handshake responses.
+func HandshakeHaveDelta() Step {
+	return func(s *Session) error {
+		mi := s.target.MetaInfo
+		msg, err := handshakeMessage(s, mi.InfoHash(), mi.Digest(), CurrentVersion)
+		if err != nil {
+			return err
+		}
+		msg.Bitfield.BitfieldBytes = nil
+		msg.Bitfield.HaveSince = 1
+		msg.Bitfield.HaveDelta = true
+		msg.Bitfield.HavePieces = []int32{0}
+		return s.Send(msg)
+	}
+}
+
+// ExpectHandshake expects the target to respond to a handshake with its own,
+// declaring all pieces of the torrent complete.
+func ExpectHandshake() Step {
+	return func(s *Session) error {
+		msg, _, err := s.receive()
+		if err != nil {
+			return fmt.Errorf("receive handshake: %s", err)
+		}
+		if msg.Type != p2p.Message_BITFIELD || msg.Bitfield == nil {
+			return fmt.Errorf("expected bitfield message, got %s", msg.Type)
+		}
+		mi := s.target.MetaInfo
+		if msg.Bitfield.InfoHash != mi.InfoHash().String() {
+			return fmt.Errorf(
+				"expected info hash %s, got %s", mi.InfoHash(), msg.Bitfield.InfoHash)
+		}
+		if msg.Bitfield.Name != mi.Digest().Hex() {
+			return fmt.Errorf("expected name %s, got %s", mi.Digest().Hex(), msg.Bitfield.Name)
+		}
+		peerID, err := core.NewPeerID(msg.Bitfield.PeerID)
+		if err != nil {
+			return fmt.Errorf("peer id: %s", err)
+		}
+		if peerID == s.peerID {
+			return fmt.Errorf("peer id %s echoed back", peerID)
+		}
+		if msg.Bitfield.HaveDelta {
+			return fmt.Errorf("unexpected have delta for unsolicited replay")
+		}
+		bf := bitset.New(0)
+		if err := bf.UnmarshalBinary(msg.Bitfield.BitfieldBytes); err != nil {
+			return fmt.Errorf("bitfield: %s", err)
+		}
+		if bf.Count() != uint(mi.NumPieces()) {
+			return fmt.Errorf(
+				"expected %d complete pieces, got %d", mi.NumPieces(), bf.Count())
+		}
+		return nil
+	}
+}
+
+// ExpectReject expects the target to reject a handshake for reason.
+func ExpectReject(reason p2p.RejectMessage_Reason) Step {
+	return func(s *Session) error {
+		msg, _, err := s.receive()
+		if err != nil {
+			return fmt.Errorf("receive reject: %s", err)
+		}
+		if msg.Type != p2p.Message_REJECT || msg.Reject == nil {
+			return fmt.Errorf("expected reject message, got %s", msg.Type)
+		}
+		if msg.Reject.Reason != reason {
+			return fmt.Errorf("expected reason %s, got %s", reason, msg.Reject.Reason)
+		}
+		return nil
+	}
+}
+
+// ExpectClosed expects the target to close the connection. Any messages sent
+// before closing are ignored.
+func ExpectClosed() Step {
+	return func(s *Session) error {
+		for {
+			_, _, err := s.Receive()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("expected conn closed: %s", err)
+			}
+		}
+	}
+}
+
+func pieceRequest(i int, offset, length int64) *p2p.Message {
+	return &p2p.Message{
+		Type: p2p.Message_PIECE_REQUEST,
+		PieceRequest: &p2p.PieceRequestMessage{
+			Index:  int32(i),
+			Offset: int32(offset),
+			Length: int32(length),
+		},
+	}
+}
+
+// RequestPiece requests piece i in full.
+func RequestPiece(i int) Step {
+	return func(s *Session) error {
+		s.lastRequest = i
+		return s.Send(pieceRequest(i, 0, s.target.MetaInfo.GetPieceLength(i)))
+	}
+}
+
+// RequestAllPieces requests every piece of the torrent in full.
+func RequestAllPieces() Step {
+	return func(s *Session) error {
+		for i := 0; i < s.target.MetaInfo.NumPieces(); i++ {
+			if err := RequestPiece(i)(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// RequestPieceOutOfBounds requests the piece following the last piece of the
+// torrent.
+func RequestPieceOutOfBounds() Step {
+	return func(s *Session) error {
+		mi := s.target.MetaInfo
+		s.lastRequest = mi.NumPieces()
+		return s.Send(pieceRequest(mi.NumPieces(), 0, mi.PieceLength()))
+	}
+}
+
+// RequestPartialPiece requests all but the first byte of piece i. Requests
+// must cover a piece in full.
+func RequestPartialPiece(i int) Step {
+	return func(s *Session) error {
+		s.lastRequest = i
+		return s.Send(pieceRequest(i, 1, s.target.MetaInfo.GetPieceLength(i)-1))
+	}
+}
+
+func (s *Session) expectPiece() (int, error) {
+	msg, payload, err := s.receive()
+	if err != nil {
+		return 0, fmt.Errorf("receive piece: %s", err)
+	}
+	if msg.Type != p2p.Message_PIECE_PAYLOAD {
+		return 0, fmt.Errorf("expected piece payload message, got %s", msg.Type)
+	}
+	i := int(msg.PiecePayload.Index)
+	if !bytes.Equal(payload, s.target.piece(i)) {
+		return 0, fmt.Errorf("payload of piece %d does not match content", i)
+	}
+	return i, nil
+}
+
+// ExpectPiece expects the target to send piece i.
+func ExpectPiece(i int) Step {
+	return func(s *Session) error {
+		got, err := s.expectPiece()
+		if err != nil {
+			return err
+		}
+		if got != i {
+			return fmt.Errorf("expected piece %d, got %d", i, got)
+		}
+		return nil
+	}
+}
+
+// ExpectAllPieces expects the target to send every piece of the torrent
+// exactly once, in any order.
+func ExpectAllPieces() Step {
+	return func(s *Session) error {
+		received := bitset.New(uint(s.target.MetaInfo.NumPieces()))
+		for received.Count() < uint(s.target.MetaInfo.NumPieces()) {
+			i, err := s.expectPiece()
+			if err != nil {
+				return err
+			}
+			if received.Test(uint(i)) {
+				return fmt.Errorf("piece %d sent twice", i)
+			}
+			received.Set(uint(i))
+		}
+		return nil
+	}
+}
+
+// ExpectPieceRequestFailed expects the target to fail the most recent piece
+// request, while keeping the connection open.
+func ExpectPieceRequestFailed() Step {
+	return func(s *Session) error {
+		msg, _, err := s.receive()
+		if err != nil {
+			return fmt.Errorf("receive error: %s", err)
+		}
+		if msg.Type != p2p.Message_ERROR || msg.Error == nil {
+			return fmt.Errorf("expected error message, got %s", msg.Type)
+		}
+		if msg.Error.Code != p2p.ErrorMessage_PIECE_REQUEST_FAILED {
+			return fmt.Errorf("expected code %s, got %s",
+				p2p.ErrorMessage_PIECE_REQUEST_FAILED, msg.Error.Code)
+		}
+		if int(msg.Error.Index) != s.lastRequest {
+			return fmt.Errorf("expected index %d, got %d", s.lastRequest, msg.Error.Index)
+		}
+		return nil
+	}
+}
+
+// AnnouncePiece announces piece i as complete.
+func AnnouncePiece(i int) Step {
+	return func(s *Session) error {
+		return s.Send(&p2p.Message{
+			Type:          p2p.Message_ANNOUCE_PIECE,
+			AnnouncePiece: &p2p.AnnouncePieceMessage{Index: int32(i)},
+		})
+	}
+}
+
+// Heartbeat sends a heartbeat carrying pieces. Heartbeats are only valid once
+// protocol version 2 is negotiated.
+func Heartbeat(pieces ...int32) Step {
+	return func(s *Session) error {
+		return s.Send(&p2p.Message{
+			Type:      p2p.Message_HEARTBEAT,
+			Heartbeat: &p2p.HeartbeatMessage{Pieces: pieces},
+		})
+	}
+}
+
+// Goodbye notifies the target the connection is closing.
+func Goodbye() Step {
+	return func(s *Session) error {
+		return s.Send(&p2p.Message{
+			Type:    p2p.Message_GOODBYE,
+			Goodbye: &p2p.GoodbyeMessage{},
+		})
+	}
+}
+
+// SendFrame sends data framed as a message, regardless of whether data is a
+// valid message.
+func SendFrame(data []byte) Step {
+	return func(s *Session) error {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(data)))
+		return s.Write(append(header, data...))
+	}
+}
+
+// SendFrameHeader sends the header of a frame of length n, without the
+// frame itself.
+func SendFrameHeader(n uint64) Step {
+	return func(s *Session) error {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(n))
+		return s.Write(header)
+	}
+}
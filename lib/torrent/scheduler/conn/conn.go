@@ -32,12 +32,8 @@ import (
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/utils/bandwidth"
-	"github.com/uber/kraken/utils/memsize"
 )
 
-// Maximum support protocol message size. Does not include piece payload.
-const maxMessageSize = 32 * memsize.KB
-
 // Events defines Conn events.
 type Events interface {
 	ConnClosed(*Conn)
@@ -46,19 +42,40 @@ type Events interface {
 // Conn manages peer communication over a connection for multiple torrents. Inbound
 // messages are multiplexed based on the torrent they pertain to.
 type Conn struct {
-	peerID      core.PeerID
-	infoHash    core.InfoHash
-	createdAt   time.Time
+	peerID    core.PeerID
+	infoHash  core.InfoHash
+	createdAt time.Time
+
+	// maxPieceLength bounds the piece payloads accepted from the remote peer.
+	maxPieceLength int64
+
 	localPeerID core.PeerID
 	bandwidth   *bandwidth.Limiter
 
+	// flow schedules piece uploads fairly against other conns. Nil if upload
+	// fairness is disabled.
+	flow *bandwidth.Flow
+
+	// ingress limits the piece payloads received on the conn to the download
+	// rate of its torrent. Nil if the torrent download rate is not limited.
+	ingress *bandwidth.Bucket
+
+	// Piece payload bytes sent to / received from the remote peer.
+	bytesSent     *atomic.Int64
+	bytesReceived *atomic.Int64
+
 	events Events
 
 	mu                    sync.Mutex // Protects the following fields:
 	lastGoodPieceReceived time.Time
 	lastPieceSent         time.Time
 
+	// cancelled are the pieces whose requests the remote peer cancelled
+	// since last requesting them.
+	cancelled map[int32]bool
+
 	nc            net.Conn
+	codec         *codec
 	config        Config
 	clk           clock.Clock
 	stats         tally.Scope
@@ -67,15 +84,29 @@ type Conn struct {
 	// Marks whether the connection was opened by the remote peer, or the local peer.
 	openedByRemote bool
 
+	// sessions is set if session tokens were exchanged with the remote peer,
+	// such that the session may be resumed should the conn be interrupted.
+	sessions *sessionCache
+
+	// resumed marks whether the conn resumed an interrupted session.
+	resumed bool
+
+	// interrupted marks whether the conn was lost, rather than closed by
+	// either peer.
+	interrupted *atomic.Bool
+
 	startOnce sync.Once
+	started   *atomic.Bool
 
 	sender   chan *Message
 	receiver chan *Message
 
 	// The following fields orchestrate the closing of the connection:
-	closed *atomic.Bool
-	done   chan struct{}  // Signals to readLoop / writeLoop to exit.
-	wg     sync.WaitGroup // Waits for readLoop / writeLoop to exit.
+	closing *atomic.Bool
+	drain   chan struct{} // Signals to writeLoop to flush and say goodbye.
+	closed  *atomic.Bool
+	done    chan struct{}  // Signals to readLoop / writeLoop to exit.
+	wg      sync.WaitGroup // Waits for readLoop / writeLoop to exit.
 
 	logger *zap.SugaredLogger
 }
@@ -92,6 +123,7 @@ func newConn(
 	remotePeerID core.PeerID,
 	info *storage.TorrentInfo,
 	openedByRemote bool,
+	version ProtocolVersion,
 	logger *zap.SugaredLogger) (*Conn, error) {
 
 	// Clear all deadlines set during handshake. Once a Conn is created, we
@@ -103,31 +135,56 @@ func newConn(
 	c := &Conn{
 		peerID:         remotePeerID,
 		infoHash:       info.InfoHash(),
+		maxPieceLength: info.MaxPieceLength(),
 		createdAt:      clk.Now(),
 		localPeerID:    localPeerID,
 		bandwidth:      bandwidth,
+		bytesSent:      atomic.NewInt64(0),
+		bytesReceived:  atomic.NewInt64(0),
 		events:         events,
 		nc:             nc,
+		codec:          codecFor(version),
 		config:         config,
 		clk:            clk,
 		stats:          stats,
 		networkEvents:  networkEvents,
 		openedByRemote: openedByRemote,
+		cancelled:      make(map[int32]bool),
 		sender:         make(chan *Message, config.SenderBufferSize),
 		receiver:       make(chan *Message, config.ReceiverBufferSize),
+		started:        atomic.NewBool(false),
+		closing:        atomic.NewBool(false),
+		drain:          make(chan struct{}),
 		closed:         atomic.NewBool(false),
+		interrupted:    atomic.NewBool(false),
 		done:           make(chan struct{}),
 		logger:         logger,
 	}
+	if config.UploadFairness.Enable {
+		c.flow = c.bandwidth.NewFlow()
+	}
+	c.markDSCP(info.Bitfield().All())
 
 	return c, nil
 }
 
+// SetLogger replaces the logger of c. Must be called before Start.
+func (c *Conn) SetLogger(logger *zap.SugaredLogger) {
+	c.logger = logger
+}
+
+// SetIngressBucket limits the piece payloads received on c by b, which is
+// shared by all conns of the same torrent. Must be called before Start.
+func (c *Conn) SetIngressBucket(b *bandwidth.Bucket) {
+	c.ingress = b
+}
+
 // Start starts message processing on c. Note, once c has been started, it may
 // close itself if it encounters an error reading/writing to the underlying
 // socket.
 func (c *Conn) Start() {
 	c.startOnce.Do(func() {
+		c.started.Store(true)
 		c.wg.Add(2)
 		go c.readLoop()
 		go c.writeLoop()
@@ -150,13 +207,27 @@ func (c *Conn) CreatedAt() time.Time {
 	return c.createdAt
 }
 
+// ProtocolVersion returns the protocol version negotiated with the remote peer.
+func (c *Conn) ProtocolVersion() ProtocolVersion {
+	return c.codec.version
+}
+
 func (c *Conn) String() string {
 	return fmt.Sprintf("Conn(peer=%s, hash=%s, opened_by_remote=%t)",
 		c.peerID, c.infoHash, c.openedByRemote)
 }
 
+// SupportsPieceRequestBatches returns whether the protocol version negotiated
+// with the remote peer supports piece request batch messages.
+func (c *Conn) SupportsPieceRequestBatches() bool {
+	return c.codec.supports(p2p.Message_PIECE_REQUEST_BATCH)
+}
+
 // Send writes the given message to the underlying connection.
 func (c *Conn) Send(msg *Message) error {
+	if c.closing.Load() {
+		return errors.New("conn closing")
+	}
 	select {
 	case <-c.done:
 		return errors.New("conn closed")
@@ -176,8 +247,44 @@ func (c *Conn) Receiver() <-chan *Message {
 	return c.receiver
 }
 
-// Close starts the shutdown sequence for the Conn.
+// MarkSeeding applies the seeding DSCP mark to c. Should be called once the
+// local peer completes the torrent of c.
+func (c *Conn) MarkSeeding() {
+	c.markDSCP(true)
+}
+
+// markDSCP applies the leeching or seeding DSCP mark to c. Failures are logged
+// rather than returned, since marking is best-effort.
+func (c *Conn) markDSCP(seeding bool) {
+	if !c.config.DSCP.enabled() {
+		return
+	}
+	if err := setDSCP(c.nc, c.config.DSCP.mark(seeding)); err != nil {
+		c.log().Warnf("Error setting dscp mark: %s", err)
+	}
+}
+
+// Close starts the shutdown sequence for the Conn. Unless graceful close is
+// disabled, no new messages are accepted, queued messages are flushed and a
+// goodbye message is sent before the underlying connection is closed, such that
+// pieces already read from disk are not discarded. The sequence is bounded by
+// GracefulCloseTimeout.
 func (c *Conn) Close() {
+	if c.config.DisableGracefulClose || !c.started.Load() {
+		c.closeNow()
+		return
+	}
+	if !c.closing.CAS(false, true) {
+		return
+	}
+	close(c.drain)
+	c.clk.AfterFunc(c.config.GracefulCloseTimeout, c.closeNow)
+}
+
+// closeNow closes the underlying connection immediately, discarding any queued
+// messages.
+func (c *Conn) closeNow() {
+	c.closing.Store(true)
 	if !c.closed.CAS(false, true) {
 		return
 	}
@@ -185,31 +292,77 @@ func (c *Conn) Close() {
 		close(c.done)
 		c.nc.Close()
 		c.wg.Wait()
+		c.discardQueued()
+		if c.Resumable() {
+			c.sessions.interrupted(c.peerID, c.infoHash)
+		}
 		c.events.ConnClosed(c)
 	}()
 }
 
-// IsClosed returns true if the c is closed.
+// OpenedByRemote returns true if the remote peer dialed c.
+func (c *Conn) OpenedByRemote() bool {
+	return c.openedByRemote
+}
+
+// Resumed returns true if c resumed a session interrupted on a previous conn.
+func (c *Conn) Resumed() bool {
+	return c.resumed
+}
+
+// Resumable returns true if c was interrupted, rather than closed by either
+// peer, and its session may be resumed by a new conn. Only meaningful once c
+// is closed.
+func (c *Conn) Resumable() bool {
+	return c.sessions != nil && c.interrupted.Load()
+}
+
+// BytesSent returns the piece payload bytes sent to the remote peer.
+func (c *Conn) BytesSent() int64 {
+	return c.bytesSent.Load()
+}
+
+// BytesReceived returns the piece payload bytes received from the remote peer.
+func (c *Conn) BytesReceived() int64 {
+	return c.bytesReceived.Load()
+}
+
+// IsClosed returns true if the c is closed, or is in the process of closing.
 func (c *Conn) IsClosed() bool {
-	return c.closed.Load()
+	return c.closing.Load()
 }
 
 func (c *Conn) readPayload(length int32) ([]byte, error) {
-	if err := c.bandwidth.ReserveIngress(int64(length)); err != nil {
+	if int64(length) > c.maxPieceLength {
+		return nil, violationf(
+			ViolationInvalidPayloadLength,
+			"piece payload exceeds max piece length: %d > %d", length, c.maxPieceLength)
+	}
+	err := reserveChunked(int64(length), c.bandwidth.MaxIngressReservation(), c.bandwidth.ReserveIngress)
+	if err != nil {
 		c.log().Errorf("Error reserving ingress bandwidth for piece payload: %s", err)
 		return nil, fmt.Errorf("ingress bandwidth: %s", err)
 	}
+	if c.ingress != nil {
+		if err := c.ingress.Reserve(c.done, int64(length)); err != nil {
+			return nil, fmt.Errorf("ingress bucket: %s", err)
+		}
+	}
 	payload := make([]byte, length)
 	if _, err := io.ReadFull(c.nc, payload); err != nil {
 		return nil, err
 	}
 	c.countBandwidth("ingress", int64(8*length))
+	c.bytesReceived.Add(int64(length))
 	return payload, nil
 }
 
 func (c *Conn) readMessage() (*Message, error) {
-	p2pMessage, err := readMessage(c.nc)
+	p2pMessage, err := readMessage(c.nc, c.codec, c.config.MessageLimits)
 	if err != nil {
+		if _, ok := err.(ProtocolViolationError); ok {
+			return nil, err
+		}
 		return nil, fmt.Errorf("read message: %s", err)
 	}
 	var pr storage.PieceReader
@@ -218,6 +371,9 @@ func (c *Conn) readMessage() (*Message, error) {
 		// after reading the message.
 		payload, err := c.readPayload(p2pMessage.PiecePayload.Length)
 		if err != nil {
+			if _, ok := err.(ProtocolViolationError); ok {
+				return nil, err
+			}
 			return nil, fmt.Errorf("read payload: %s", err)
 		}
 		// TODO(codyg): Consider making this reader read directly from the socket.
@@ -233,7 +389,7 @@ func (c *Conn) readLoop() {
 	defer func() {
 		close(c.receiver)
 		c.wg.Done()
-		c.Close()
+		c.closeNow()
 	}()
 
 	for {
@@ -242,19 +398,67 @@ func (c *Conn) readLoop() {
 			return
 		default:
 			msg, err := c.readMessage()
+			if v, ok := err.(ProtocolViolationError); ok {
+				// Violations are never interrupted sessions, such that the
+				// remote peer is blacklisted.
+				c.log().Warnf("Closing conn: %s", v)
+				countViolation(c.stats, v)
+				return
+			}
 			if err != nil {
 				c.log().Infof("Error reading message from socket, exiting read loop: %s", err)
+				if !c.closing.Load() {
+					c.interrupted.Store(true)
+				}
+				return
+			}
+			if msg.Message.Type == p2p.Message_GOODBYE {
+				c.log().Info("Remote peer closed conn")
+				c.stats.Counter("goodbyes_received").Inc(1)
 				return
 			}
+			c.trackCancel(msg.Message)
 			c.receiver <- msg
 		}
 	}
 }
 
+// trackCancel records the piece requests cancelled by the remote peer, such
+// that queued payloads of cancelled requests are dropped. A later request of
+// the same piece revokes the cancellation.
+func (c *Conn) trackCancel(msg *p2p.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch msg.Type {
+	case p2p.Message_PIECE_REQUEST:
+		delete(c.cancelled, msg.PieceRequest.Index)
+	case p2p.Message_PIECE_REQUEST_BATCH:
+		for _, i := range PieceRequestBatchIndices(msg.PieceRequestBatch) {
+			delete(c.cancelled, int32(i))
+		}
+	case p2p.Message_CANCEL_PIECE:
+		c.cancelled[msg.CancelPiece.Index] = true
+	}
+}
+
+// takeCancelled returns whether the request of piece i was cancelled, and
+// clears the cancellation.
+func (c *Conn) takeCancelled(i int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.cancelled[i] {
+		return false
+	}
+	delete(c.cancelled, i)
+	return true
+}
+
 func (c *Conn) sendPiecePayload(pr storage.PieceReader) error {
 	defer pr.Close()
 
-	if err := c.bandwidth.ReserveEgress(int64(pr.Length())); err != nil {
+	if err := c.reserveEgress(int64(pr.Length())); err != nil {
 		// TODO(codyg): This is bad. Consider alerting here.
 		c.log().Errorf("Error reserving egress bandwidth for piece payload: %s", err)
 		return fmt.Errorf("egress bandwidth: %s", err)
@@ -264,11 +468,74 @@ func (c *Conn) sendPiecePayload(pr storage.PieceReader) error {
 		return fmt.Errorf("copy to socket: %s", err)
 	}
 	c.countBandwidth("egress", 8*n)
+	c.bytesSent.Add(n)
 	return nil
 }
 
+func (c *Conn) reserveEgress(nbytes int64) error {
+	return reserveChunked(nbytes, c.bandwidth.MaxEgressReservation(), func(n int64) error {
+		if c.flow == nil {
+			return c.bandwidth.ReserveEgress(n)
+		}
+		return c.flow.ReserveEgress(n, c.uploadWeight())
+	})
+}
+
+// reserveChunked reserves nbytes via reserve in chunks of at most max bytes,
+// such that payloads larger than one second worth of the scheduler-wide
+// bandwidth limit are paced instead of failing. A non-positive max reserves
+// nbytes at once.
+func reserveChunked(nbytes, max int64, reserve func(int64) error) error {
+	if max <= 0 {
+		return reserve(nbytes)
+	}
+	for nbytes > 0 {
+		n := nbytes
+		if n > max {
+			n = max
+		}
+		if err := reserve(n); err != nil {
+			return err
+		}
+		nbytes -= n
+	}
+	return nil
+}
+
+// uploadWeight returns the fair queueing weight of c, which grows with the
+// fraction of our uploads the remote peer reciprocates.
+func (c *Conn) uploadWeight() float64 {
+	sent := c.bytesSent.Load()
+	if sent == 0 {
+		sent = 1
+	}
+	reciprocity := float64(c.bytesReceived.Load()) / float64(sent)
+	if reciprocity > 1 {
+		reciprocity = 1
+	}
+	return 1 + c.config.UploadFairness.ReciprocityBoost*reciprocity
+}
+
 func (c *Conn) sendMessage(msg *Message) error {
-	if err := sendMessage(c.nc, msg.Message); err != nil {
+	if !c.codec.supports(msg.Message.Type) {
+		// The remote peer speaks an older version which cannot decode msg. Such
+		// messages are advisory, so they are dropped rather than failing the conn.
+		c.stats.Tagged(map[string]string{
+			"message_type": msg.Message.Type.String(),
+		}).Counter("unsupported_messages_dropped").Inc(1)
+		return nil
+	}
+	if msg.Message.Type == p2p.Message_PIECE_PAYLOAD && c.takeCancelled(msg.Message.PiecePayload.Index) {
+		// The remote peer received the piece elsewhere while the payload was
+		// queued, e.g. from a duplicate request sent during endgame.
+		msg.Payload.Close()
+		c.stats.Counter("cancelled_piece_payloads").Inc(1)
+		return nil
+	}
+	if err := sendMessage(c.nc, c.codec, msg.Message); err != nil {
+		if msg.Payload != nil {
+			msg.Payload.Close()
+		}
 		return fmt.Errorf("send message: %s", err)
 	}
 	if msg.Message.Type == p2p.Message_PIECE_PAYLOAD {
@@ -286,13 +553,18 @@ func (c *Conn) sendMessage(msg *Message) error {
 func (c *Conn) writeLoop() {
 	defer func() {
 		c.wg.Done()
-		c.Close()
+		c.closeNow()
 	}()
 
 	for {
 		select {
 		case <-c.done:
 			return
+		case <-c.drain:
+			if err := c.flush(); err != nil {
+				c.log().Infof("Error flushing conn, discarding queued messages: %s", err)
+			}
+			return
 		case msg := <-c.sender:
 			if err := c.sendMessage(msg); err != nil {
 				c.log().Infof("Error writing message to socket, exiting write loop: %s", err)
@@ -302,6 +574,40 @@ func (c *Conn) writeLoop() {
 	}
 }
 
+// discardQueued closes the payloads of all messages which remain queued once
+// the write loop exited, such that their piece readers are released.
+func (c *Conn) discardQueued() {
+	for {
+		select {
+		case msg := <-c.sender:
+			if msg.Payload != nil {
+				msg.Payload.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flush sends all queued messages followed by a goodbye message.
+func (c *Conn) flush() error {
+	// NOTE: We do not use the clock interface here because the net package uses
+	// the system clock when evaluating deadlines.
+	if err := c.nc.SetWriteDeadline(time.Now().Add(c.config.GracefulCloseTimeout)); err != nil {
+		return fmt.Errorf("set write deadline: %s", err)
+	}
+	for {
+		select {
+		case msg := <-c.sender:
+			if err := c.sendMessage(msg); err != nil {
+				return err
+			}
+		default:
+			return c.sendMessage(NewGoodbyeMessage())
+		}
+	}
+}
+
 func (c *Conn) countBandwidth(direction string, n int64) {
 	c.stats.Tagged(map[string]string{
 		"piece_bandwidth_direction": direction,
@@ -14,10 +14,22 @@
 package conn
 
 import (
+	"errors"
+	"io/ioutil"
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bandwidth"
+	"github.com/uber/kraken/utils/memsize"
 )
 
 func TestConnClose(t *testing.T) {
@@ -40,3 +52,214 @@ func TestConnClose(t *testing.T) {
 
 	require.True(c.IsClosed())
 }
+
+func TestConnGracefulCloseFlushesQueuedMessages(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := PipeFixture(ConfigFixture(), storage.TorrentInfoFixture(1, 1))
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(local.Send(NewAnnouncePieceMessage(i)))
+	}
+	local.Close()
+	require.True(local.IsClosed())
+	require.Error(local.Send(NewAnnouncePieceMessage(3)))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-remote.Receiver():
+			require.Equal(int32(i), msg.Message.AnnouncePiece.Index)
+		case <-time.After(5 * time.Second):
+			require.FailNow("queued message not flushed")
+		}
+	}
+
+	// The remote conn closes upon receiving goodbye.
+	select {
+	case _, ok := <-remote.Receiver():
+		require.False(ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow("goodbye not received")
+	}
+}
+
+func TestConnCloseWithoutGracefulClose(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+	config.DisableGracefulClose = true
+	local, remote, cleanup := PipeFixture(config, storage.TorrentInfoFixture(1, 1))
+	defer cleanup()
+
+	local.Close()
+
+	select {
+	case _, ok := <-remote.Receiver():
+		require.False(ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow("remote conn not closed")
+	}
+}
+
+func TestReserveChunked(t *testing.T) {
+	tests := []struct {
+		desc     string
+		nbytes   int64
+		max      int64
+		expected []int64
+	}{
+		{"unlimited", 10, 0, []int64{10}},
+		{"smaller than max", 3, 4, []int64{3}},
+		{"multiple of max", 8, 4, []int64{4, 4}},
+		{"remainder", 10, 4, []int64{4, 4, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			var chunks []int64
+			require.NoError(reserveChunked(test.nbytes, test.max, func(n int64) error {
+				chunks = append(chunks, n)
+				return nil
+			}))
+			require.Equal(test.expected, chunks)
+		})
+	}
+}
+
+func TestReserveChunkedStopsOnError(t *testing.T) {
+	require := require.New(t)
+
+	var calls int
+	err := reserveChunked(10, 4, func(int64) error {
+		calls++
+		return errors.New("some error")
+	})
+	require.Error(err)
+	require.Equal(1, calls)
+}
+
+func TestConnPacesPayloadsLargerThanBandwidthLimit(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+	config.Bandwidth = bandwidth.Config{
+		EgressBitsPerSec:  800, // 100 bytes.
+		IngressBitsPerSec: 800,
+		TokenSize:         8,
+		Enable:            true,
+	}
+	local, remote, cleanup := PipeFixture(config, storage.TorrentInfoFixture(1, 150))
+	defer cleanup()
+
+	payload := make([]byte, 150)
+	require.NoError(local.Send(NewPiecePayloadMessage(0, piecereader.NewBuffer(payload))))
+
+	select {
+	case msg := <-remote.Receiver():
+		b, err := ioutil.ReadAll(msg.Payload)
+		require.NoError(err)
+		require.Equal(payload, b)
+	case <-time.After(5 * time.Second):
+		require.FailNow("timed out waiting for piece payload")
+	}
+	require.False(local.IsClosed())
+	require.False(remote.IsClosed())
+}
+
+func TestConnDropsPayloadsOfCancelledRequests(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := PipeFixture(ConfigFixture(), storage.TorrentInfoFixture(2, 1))
+	defer cleanup()
+
+	receive := func(c *Conn) *Message {
+		select {
+		case msg := <-c.Receiver():
+			return msg
+		case <-time.After(5 * time.Second):
+			require.FailNow("timed out waiting for message")
+		}
+		return nil
+	}
+
+	require.NoError(remote.Send(NewCancelPieceMessage(0)))
+	require.Equal(p2p.Message_CANCEL_PIECE, receive(local).Message.Type)
+
+	require.NoError(local.Send(NewPiecePayloadMessage(0, piecereader.NewBuffer([]byte{1}))))
+	require.NoError(local.Send(NewAnnouncePieceMessage(1)))
+
+	// The payload of the cancelled request is dropped.
+	require.Equal(p2p.Message_ANNOUCE_PIECE, receive(remote).Message.Type)
+
+	// Requesting the piece again revokes the cancellation.
+	require.NoError(remote.Send(NewPieceRequestMessage(0, 1)))
+	require.Equal(p2p.Message_PIECE_REQUEST, receive(local).Message.Type)
+
+	require.NoError(local.Send(NewPiecePayloadMessage(0, piecereader.NewBuffer([]byte{1}))))
+	require.Equal(p2p.Message_PIECE_PAYLOAD, receive(remote).Message.Type)
+}
+
+func TestConnClosesOnProtocolViolation(t *testing.T) {
+	tests := []struct {
+		desc   string
+		msg    *p2p.Message
+		reason string
+	}{
+		{
+			"payload longer than piece",
+			&p2p.Message{
+				Type:         p2p.Message_PIECE_PAYLOAD,
+				PiecePayload: &p2p.PiecePayloadMessage{Index: 0, Length: 1 << 30},
+			},
+			ViolationInvalidPayloadLength,
+		}, {
+			"negative piece index",
+			NewAnnouncePieceMessage(-1).Message,
+			ViolationMalformedMessage,
+		}, {
+			"oversized control message",
+			NewErrorMessage(
+				0, p2p.ErrorMessage_PIECE_REQUEST_FAILED,
+				errors.New(string(make([]byte, 8*memsize.KB)))).Message,
+			ViolationOversizedMessage,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			nc1, nc2 := net.Pipe()
+			defer nc1.Close()
+			defer nc2.Close()
+
+			stats := tally.NewTestScope("", nil)
+			h := HandshakerFixture(ConfigFixture())
+			h.stats = stats
+			c, err := h.newConn(
+				noopDeadline{nc2}, core.PeerIDFixture(), storage.TorrentInfoFixture(1, 100),
+				true, CurrentProtocolVersion)
+			require.NoError(err)
+			c.Start()
+
+			go codecFor(CurrentProtocolVersion).encode(nc1, test.msg)
+
+			select {
+			case _, ok := <-c.Receiver():
+				require.False(ok)
+			case <-time.After(5 * time.Second):
+				require.FailNow("conn not closed")
+			}
+			require.False(c.Resumable())
+
+			var tags map[string]string
+			for _, counter := range stats.Snapshot().Counters() {
+				if counter.Name() == "protocol_violations" {
+					tags = counter.Tags()
+				}
+			}
+			require.Equal(test.reason, tags["reason"])
+		})
+	}
+}
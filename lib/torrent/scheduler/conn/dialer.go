@@ -0,0 +1,137 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// SourceRule binds outgoing connections to destinations within a CIDR to a
+// local source address, such that P2P traffic of multi-homed hosts stays on a
+// specific network. Exactly one of SourceIP or Interface must be set.
+type SourceRule struct {
+	// CIDR is the destination network the rule applies to, e.g. "10.0.0.0/8".
+	CIDR string `yaml:"cidr"`
+
+	// SourceIP is the local IP outgoing connections are bound to.
+	SourceIP string `yaml:"source_ip"`
+
+	// Interface is the name of the local interface whose address outgoing
+	// connections are bound to. The first address of the same family as the
+	// destination is used.
+	Interface string `yaml:"interface"`
+}
+
+type sourceRule struct {
+	dest   *net.IPNet
+	source net.IP
+	iface  string
+}
+
+// sourceDialer dials peers from the local address selected by the first rule
+// matching the destination IP. Destinations matching no rule are dialed from
+// the default address chosen by the OS.
+type sourceDialer struct {
+	rules []sourceRule
+}
+
+func newSourceDialer(rules []SourceRule) (*sourceDialer, error) {
+	var parsed []sourceRule
+	for _, r := range rules {
+		_, dest, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("parse cidr %q: %s", r.CIDR, err)
+		}
+		if (r.SourceIP == "") == (r.Interface == "") {
+			return nil, fmt.Errorf(
+				"rule %s: exactly one of source_ip or interface must be set", r.CIDR)
+		}
+		var source net.IP
+		if r.SourceIP != "" {
+			source = net.ParseIP(r.SourceIP)
+			if source == nil {
+				return nil, fmt.Errorf("rule %s: invalid source_ip %q", r.CIDR, r.SourceIP)
+			}
+		}
+		parsed = append(parsed, sourceRule{dest, source, r.Interface})
+	}
+	return &sourceDialer{parsed}, nil
+}
+
+// DialContext connects to addr, which must be an ip:port pair.
+func (d *sourceDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	local, err := d.sourceFor(addr)
+	if err != nil {
+		return nil, fmt.Errorf("source address: %s", err)
+	}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// sourceFor returns the local IP connections to addr should be bound to, or
+// nil if no rule matches.
+func (d *sourceDialer) sourceFor(addr string) (net.IP, error) {
+	if len(d.rules) == 0 {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Hostnames cannot be matched against rules.
+		return nil, nil
+	}
+	for _, r := range d.rules {
+		if !r.dest.Contains(ip) {
+			continue
+		}
+		if r.source != nil {
+			return r.source, nil
+		}
+		return interfaceIP(r.iface, ip.To4() != nil)
+	}
+	return nil, nil
+}
+
+// interfaceIP returns the first address of the named interface with the given
+// family. Interface addresses are looked up per dial, since they may change
+// over the lifetime of the process.
+func interfaceIP(name string, v4 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %s", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s addrs: %s", name, err)
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == v4 {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, errors.New("no address of matching family")
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceDialerSelectsFirstMatchingRule(t *testing.T) {
+	require := require.New(t)
+
+	d, err := newSourceDialer([]SourceRule{
+		{CIDR: "10.1.0.0/16", SourceIP: "192.168.1.1"},
+		{CIDR: "10.0.0.0/8", SourceIP: "192.168.2.1"},
+	})
+	require.NoError(err)
+
+	tests := []struct {
+		addr     string
+		expected net.IP
+	}{
+		{"10.1.2.3:80", net.ParseIP("192.168.1.1")},
+		{"10.2.2.3:80", net.ParseIP("192.168.2.1")},
+		{"11.0.0.1:80", nil},
+		{"some-host:80", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			ip, err := d.sourceFor(test.addr)
+			require.NoError(err)
+			require.Equal(test.expected, ip)
+		})
+	}
+}
+
+func TestSourceDialerInvalidRules(t *testing.T) {
+	tests := []struct {
+		desc string
+		rule SourceRule
+	}{
+		{"bad cidr", SourceRule{CIDR: "10.0.0.0", SourceIP: "10.0.0.1"}},
+		{"no source", SourceRule{CIDR: "10.0.0.0/8"}},
+		{"both sources", SourceRule{CIDR: "10.0.0.0/8", SourceIP: "10.0.0.1", Interface: "lo"}},
+		{"bad source ip", SourceRule{CIDR: "10.0.0.0/8", SourceIP: "x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newSourceDialer([]SourceRule{test.rule})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSourceDialerBindsLocalAddr(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	d, err := newSourceDialer([]SourceRule{{CIDR: "127.0.0.0/8", SourceIP: "127.0.0.1"}})
+	require.NoError(err)
+
+	nc, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(err)
+	defer nc.Close()
+
+	require.Equal("127.0.0.1", nc.LocalAddr().(*net.TCPAddr).IP.String())
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// _maxDSCP is the largest valid 6-bit DSCP value.
+const _maxDSCP = 63
+
+// DSCPConfig defines the DSCP marks applied to peer connection sockets, such
+// that network QoS policies may treat bulk P2P traffic differently from
+// production RPCs. Marks are chosen by whether the local peer is leeching or
+// seeding the torrent of a connection. Marking is disabled if both marks are 0.
+type DSCPConfig struct {
+	Leech int `yaml:"leech"`
+	Seed  int `yaml:"seed"`
+}
+
+func (c DSCPConfig) validate() error {
+	for _, m := range []int{c.Leech, c.Seed} {
+		if m < 0 || m > _maxDSCP {
+			return fmt.Errorf("invalid dscp mark %d: must be between 0 and %d", m, _maxDSCP)
+		}
+	}
+	return nil
+}
+
+func (c DSCPConfig) enabled() bool {
+	return c.Leech != 0 || c.Seed != 0
+}
+
+func (c DSCPConfig) mark(seeding bool) int {
+	if seeding {
+		return c.Seed
+	}
+	return c.Leech
+}
+
+// setDSCP sets the DSCP mark of nc. Connections which are not TCP sockets,
+// e.g. in-memory pipes, are ignored.
+func setDSCP(nc net.Conn, dscp int) error {
+	tc, ok := nc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	addr, ok := tc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	// DSCP occupies the upper 6 bits of the ToS / traffic class byte.
+	tos := dscp << 2
+	if addr.IP.To4() != nil {
+		return ipv4.NewConn(tc).SetTOS(tos)
+	}
+	return ipv6.NewConn(tc).SetTrafficClass(tos)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func TestDSCPConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(DSCPConfig{}.validate())
+	require.NoError(DSCPConfig{Leech: 8, Seed: 63}.validate())
+	require.Error(DSCPConfig{Leech: 64}.validate())
+	require.Error(DSCPConfig{Seed: -1}.validate())
+}
+
+func TestSetDSCP(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	nc, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(err)
+	defer nc.Close()
+
+	require.NoError(setDSCP(nc, 8))
+
+	tos, err := ipv4.NewConn(nc).TOS()
+	require.NoError(err)
+	require.Equal(8<<2, tos)
+}
+
+func TestSetDSCPIgnoresNonTCPConns(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	require.NoError(t, setDSCP(a, 8))
+}
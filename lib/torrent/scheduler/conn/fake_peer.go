@@ -81,7 +81,8 @@ func (p *FakePeer) handshakeConns() error {
 		if err != nil {
 			return err
 		}
-		reqMsg, err := readMessageWithTimeout(nc, p.msgTimeout)
+		reqMsg, err := readMessageWithTimeout(
+			nc, _handshakeCodec, MessageLimitsConfig{}.applyDefaults(), p.msgTimeout)
 		if err != nil {
 			return err
 		}
@@ -101,7 +102,7 @@ func (p *FakePeer) handshakeConns() error {
 		if err != nil {
 			return err
 		}
-		if err := sendMessageWithTimeout(nc, respMsg, p.msgTimeout); err != nil {
+		if err := sendMessageWithTimeout(nc, _handshakeCodec, respMsg, p.msgTimeout); err != nil {
 			return err
 		}
 	}
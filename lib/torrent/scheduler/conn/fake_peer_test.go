@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -19,7 +20,7 @@ func TestFakePeer(t *testing.T) {
 
 	info := storage.TorrentInfoFixture(32, 4)
 
-	res, err := h.Initialize(p.PeerID(), p.Addr(), info, nil, "noexist")
+	res, err := h.Initialize(context.Background(), p.PeerID(), p.Addr(), info, nil, "noexist")
 	require.NoError(err)
 
 	require.Equal(p.PeerID(), res.Conn.PeerID())
@@ -0,0 +1,85 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// FuzzCodecDecode is a go-fuzz target for frame decoding. The first byte of
+// data selects the protocol version, the rest is the frame. Anything which
+// decodes must survive a round trip.
+func FuzzCodecDecode(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	c, ok := _codecs[ProtocolVersion(data[0])]
+	if !ok {
+		return -1
+	}
+	limits := MessageLimitsConfig{}.applyDefaults()
+	msg, err := c.decode(bytes.NewReader(data[1:]), limits)
+	if err != nil {
+		return 0
+	}
+	var buf bytes.Buffer
+	if err := c.encode(&buf, msg); err != nil {
+		panic(fmt.Sprintf("encode decoded message: %s", err))
+	}
+	result, err := c.decode(&buf, limits)
+	if err != nil {
+		panic(fmt.Sprintf("decode re-encoded message: %s", err))
+	}
+	if !proto.Equal(msg, result) {
+		panic(fmt.Sprintf("round trip mismatch: expected %s, got %s", msg, result))
+	}
+	return 1
+}
+
+// FuzzParseHandshake is a go-fuzz target for handshake parsing. Parsed
+// bitfields must never exceed the frame they were decoded from.
+func FuzzParseHandshake(data []byte) int {
+	msg, err := _handshakeCodec.decode(bytes.NewReader(data), MessageLimitsConfig{}.applyDefaults())
+	if err != nil {
+		return 0
+	}
+	hs, err := handshakeFromP2PMessage(msg)
+	if err != nil {
+		return 0
+	}
+	if hs.bitfield != nil && uint64(hs.bitfield.Len()) > 8*maxMessageSize {
+		panic(fmt.Sprintf("bitfield of %d bits exceeds frame", hs.bitfield.Len()))
+	}
+	return 1
+}
+
+// FuzzUnmarshalBitfield is a go-fuzz target for bitfield decoding. Decoded
+// bitfields must never hold more bits than the bytes they were decoded from.
+func FuzzUnmarshalBitfield(data []byte) int {
+	bitfield, err := unmarshalBitfield(data)
+	if err != nil {
+		return 0
+	}
+	if uint64(bitfield.Len()) > 8*uint64(len(data)) {
+		panic(fmt.Sprintf("bitfield of %d bits decoded from %d bytes", bitfield.Len(), len(data)))
+	}
+	return 1
+}
@@ -14,6 +14,7 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -23,6 +24,7 @@ import (
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/bandwidth"
+	"github.com/uber/kraken/utils/dnscache"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
@@ -51,8 +53,8 @@ func (rb RemoteBitfields) unmarshalBinary(rbBytes map[string][]byte) error {
 		if err != nil {
 			return fmt.Errorf("peer id: %s", err)
 		}
-		bitfield := bitset.New(0)
-		if err := bitfield.UnmarshalBinary(bitfieldBytes); err != nil {
+		bitfield, err := unmarshalBitfield(bitfieldBytes)
+		if err != nil {
 			return err
 		}
 		rb[peerID] = bitfield
@@ -70,12 +72,33 @@ type handshake struct {
 	bitfield        *bitset.BitSet
 	remoteBitfields RemoteBitfields
 	namespace       string
+
+	// version is the highest protocol version supported by the sender. Zero
+	// if the sender predates protocol versioning.
+	version ProtocolVersion
+
+	// haveSeq identifies bitfield for future replays. haveSince requests a
+	// replay of the pieces completed since the bitfield identified by it.
+	// If haveDelta is set, bitfield is omitted in favor of havePieces.
+	haveSeq    uint64
+	haveSince  uint64
+	haveDelta  bool
+	havePieces []int32
+
+	// sessionToken is issued by the sender for the conn, and resumeToken is
+	// the token last issued by the receiver if the sender resumes a session.
+	sessionToken []byte
+	resumeToken  []byte
 }
 
 func (h *handshake) toP2PMessage() (*p2p.Message, error) {
-	b, err := h.bitfield.MarshalBinary()
-	if err != nil {
-		return nil, err
+	var b []byte
+	if !h.haveDelta {
+		var err error
+		b, err = h.bitfield.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
 	}
 	rb, err := h.remoteBitfields.marshalBinary()
 	if err != nil {
@@ -90,15 +113,30 @@ func (h *handshake) toP2PMessage() (*p2p.Message, error) {
 			BitfieldBytes:       b,
 			RemoteBitfieldBytes: rb,
 			Namespace:           h.namespace,
+			ProtocolVersion:     uint32(h.version),
+			HaveSeq:             h.haveSeq,
+			HaveSince:           h.haveSince,
+			HaveDelta:           h.haveDelta,
+			HavePieces:          h.havePieces,
+			SessionToken:        h.sessionToken,
+			ResumeToken:         h.resumeToken,
 		},
 	}, nil
 }
 
 func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
+	return parseHandshake(m, core.NewPeerID)
+}
+
+// parseHandshake converts m into a handshake, parsing the peer id of m with
+// parsePeerID.
+func parseHandshake(
+	m *p2p.Message, parsePeerID func(string) (core.PeerID, error)) (*handshake, error) {
+
 	if m.Type != p2p.Message_BITFIELD {
 		return nil, fmt.Errorf("expected bitfield message, got %s", m.Type)
 	}
-	peerID, err := core.NewPeerID(m.Bitfield.PeerID)
+	peerID, err := parsePeerID(m.Bitfield.PeerID)
 	if err != nil {
 		return nil, fmt.Errorf("peer id: %s", err)
 	}
@@ -110,9 +148,13 @@ func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
 	if err != nil {
 		return nil, fmt.Errorf("name: %s", err)
 	}
-	bitfield := bitset.New(0)
-	if err := bitfield.UnmarshalBinary(m.Bitfield.BitfieldBytes); err != nil {
-		return nil, err
+	// Delta bitfields are reconstructed by the receiver.
+	var bitfield *bitset.BitSet
+	if !m.Bitfield.HaveDelta {
+		bitfield, err = unmarshalBitfield(m.Bitfield.BitfieldBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
 	remoteBitfields := make(RemoteBitfields)
 	if err := remoteBitfields.unmarshalBinary(m.Bitfield.RemoteBitfieldBytes); err != nil {
@@ -126,14 +168,49 @@ func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
 		digest:          d,
 		namespace:       m.Bitfield.Namespace,
 		remoteBitfields: remoteBitfields,
+		version:         ProtocolVersion(m.Bitfield.ProtocolVersion),
+		haveSeq:         m.Bitfield.HaveSeq,
+		haveSince:       m.Bitfield.HaveSince,
+		haveDelta:       m.Bitfield.HaveDelta,
+		havePieces:      m.Bitfield.HavePieces,
+		sessionToken:    m.Bitfield.SessionToken,
+		resumeToken:     m.Bitfield.ResumeToken,
 	}, nil
 }
 
+// RejectionError is returned when the remote peer rejects a handshake, e.g.
+// because it does not know the torrent or has no capacity for new conns.
+type RejectionError struct {
+	Reason  p2p.RejectMessage_Reason
+	Message string
+}
+
+func (e RejectionError) Error() string {
+	return fmt.Sprintf("handshake rejected (%s): %s", e.Reason, e.Message)
+}
+
+// IsRejectionError returns true if err is a RejectionError.
+func IsRejectionError(err error) bool {
+	_, ok := err.(RejectionError)
+	return ok
+}
+
+func newRejectMessage(reason p2p.RejectMessage_Reason, err error) *p2p.Message {
+	return &p2p.Message{
+		Type: p2p.Message_REJECT,
+		Reject: &p2p.RejectMessage{
+			Reason: reason,
+			Error:  err.Error(),
+		},
+	}
+}
+
 // PendingConn represents half-opened, pending connection initialized by a
 // remote peer.
 type PendingConn struct {
 	handshake *handshake
 	nc        net.Conn
+	resumed   bool
 }
 
 // PeerID returns the remote peer id.
@@ -166,6 +243,16 @@ func (pc *PendingConn) Namespace() string {
 	return pc.handshake.namespace
 }
 
+// Resumed returns true if the remote peer resumes an interrupted session.
+func (pc *PendingConn) Resumed() bool {
+	return pc.resumed
+}
+
+// RemoteAddr returns the network address of the remote peer.
+func (pc *PendingConn) RemoteAddr() net.Addr {
+	return pc.nc.RemoteAddr()
+}
+
 // Close closes the connection.
 func (pc *PendingConn) Close() {
 	pc.nc.Close()
@@ -188,6 +275,26 @@ type Handshaker struct {
 	networkEvents networkevent.Producer
 	peerID        core.PeerID
 	events        Events
+	resolver      *dnscache.Resolver
+	dial          dnscache.DialFunc
+	fallbackDial  dnscache.DialFunc
+	peerMeta      *peerMetadataCache
+	haveReplay    *haveReplayCache
+	sessions      *sessionCache
+}
+
+// Option allows setting optional parameters in Handshaker.
+type Option func(*Handshaker)
+
+// WithResolver configures a Handshaker to resolve peer hostnames through r.
+func WithResolver(r *dnscache.Resolver) Option {
+	return func(h *Handshaker) { h.resolver = r }
+}
+
+// WithFallbackDial configures a Handshaker to dial peers through dial when
+// they cannot be dialed directly, e.g. through relays.
+func WithFallbackDial(dial dnscache.DialFunc) Option {
+	return func(h *Handshaker) { h.fallbackDial = dial }
 }
 
 // NewHandshaker creates a new Handshaker.
@@ -198,7 +305,8 @@ func NewHandshaker(
 	networkEvents networkevent.Producer,
 	peerID core.PeerID,
 	events Events,
-	logger *zap.SugaredLogger) (*Handshaker, error) {
+	logger *zap.SugaredLogger,
+	opts ...Option) (*Handshaker, error) {
 
 	config = config.applyDefaults()
 
@@ -211,7 +319,16 @@ func NewHandshaker(
 		return nil, fmt.Errorf("bandwidth: %s", err)
 	}
 
-	return &Handshaker{
+	if err := config.DSCP.validate(); err != nil {
+		return nil, fmt.Errorf("dscp: %s", err)
+	}
+
+	sd, err := newSourceDialer(config.SourceRules)
+	if err != nil {
+		return nil, fmt.Errorf("source rules: %s", err)
+	}
+
+	h := &Handshaker{
 		config:        config,
 		stats:         stats,
 		clk:           clk,
@@ -219,7 +336,24 @@ func NewHandshaker(
 		networkEvents: networkEvents,
 		peerID:        peerID,
 		events:        events,
-	}, nil
+		dial:          sd.DialContext,
+		peerMeta:      newPeerMetadataCache(config.PeerMetadataCache, clk, stats),
+		haveReplay:    newHaveReplayCache(config.HaveReplay, clk, stats),
+		sessions:      newSessionCache(config.Session, clk, stats),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.resolver != nil {
+		h.dial = h.resolver.WrapDial(h.dial)
+	}
+	return h, nil
+}
+
+// BandwidthUsage returns the total bytes sent and received over all Conns
+// created by h.
+func (h *Handshaker) BandwidthUsage() (egress, ingress int64) {
+	return h.bandwidth.EgressBytes(), h.bandwidth.IngressBytes()
 }
 
 // Accept upgrades a raw network connection opened by a remote peer into a
@@ -229,7 +363,12 @@ func (h *Handshaker) Accept(nc net.Conn) (*PendingConn, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read handshake: %s", err)
 	}
-	return &PendingConn{hs, nc}, nil
+	if hs.haveDelta {
+		// Deltas are only replayed in response to a handshake.
+		return nil, errors.New("unexpected have delta")
+	}
+	resumed := h.sessions.resumes(hs.peerID, hs.infoHash, hs.resumeToken)
+	return &PendingConn{hs, nc, resumed}, nil
 }
 
 // Establish upgrades a PendingConn returned via Accept into a fully
@@ -239,33 +378,101 @@ func (h *Handshaker) Establish(
 	info *storage.TorrentInfo,
 	remoteBitfields RemoteBitfields) (*Conn, error) {
 
+	peerID := pc.handshake.peerID
+	session := h.sessions.issue()
+
 	// Namespace is one-directional: it is only supplied by the connection opener
 	// and is not reciprocated by the connection acceptor.
-	if err := h.sendHandshake(pc.nc, info, remoteBitfields, ""); err != nil {
+	err := h.sendHandshake(
+		pc.nc, peerID, info, remoteBitfields, "", 0, pc.handshake.haveSince,
+		session, h.sessions.resumeToken(peerID, info.InfoHash()))
+	if err != nil {
 		return nil, fmt.Errorf("send handshake: %s", err)
 	}
-	c, err := h.newConn(pc.nc, pc.handshake.peerID, info, true)
+	h.haveReplay.received(
+		peerID, info.InfoHash(), pc.handshake.haveSeq, pc.handshake.bitfield)
+	c, err := h.newConn(pc.nc, peerID, info, true, pc.handshake.version)
 	if err != nil {
 		return nil, fmt.Errorf("new conn: %s", err)
 	}
+	h.attachSession(c, session, pc.handshake.sessionToken, pc.resumed)
 	return c, nil
 }
 
+// Reject notifies the remote peer of pc that its handshake was rejected for
+// the given reason and closes the connection. Failing to deliver the
+// rejection is not an error, since the remote peer will observe the closed
+// connection either way.
+func (h *Handshaker) Reject(
+	pc *PendingConn, reason p2p.RejectMessage_Reason, err error) {
+
+	defer pc.Close()
+
+	h.stats.Tagged(map[string]string{
+		"reason": reason.String(),
+	}).Counter("handshake_rejections_sent").Inc(1)
+
+	sendMessageWithTimeout(
+		pc.nc, _handshakeCodec, newRejectMessage(reason, err), h.config.HandshakeTimeout)
+}
+
 // Initialize returns a fully established Conn for the given torrent to the
 // given peer / address. Also returns the bitfield of the remote peer and
-// its connections for the torrent.
+// its connections for the torrent. The handshake is aborted once ctx is done,
+// in which case ctx.Err() is returned.
 func (h *Handshaker) Initialize(
+	ctx context.Context,
 	peerID core.PeerID,
 	addr string,
 	info *storage.TorrentInfo,
 	remoteBitfields RemoteBitfields,
 	namespace string) (*HandshakeResult, error) {
 
-	nc, err := net.DialTimeout("tcp", addr, h.config.HandshakeTimeout)
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, h.config.HandshakeTimeout)
+	defer cancel()
+	start := h.clk.Now()
+	dialCtx := ctx
+	if h.fallbackDial != nil {
+		// Leave time to fall back if the direct dial times out.
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeout(ctx, h.config.HandshakeTimeout/2)
+		defer cancelDial()
+	}
+	nc, err := h.dial(dialCtx, "tcp", addr)
+	if err != nil && h.fallbackDial != nil {
+		h.stats.Counter("fallback_dials").Inc(1)
+		nc, err = h.fallbackDial(ctx, "tcp", addr)
+	}
+	h.recordStage(StageDial, start, err)
 	if err != nil {
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
 		return nil, fmt.Errorf("dial: %s", err)
 	}
+	// Closing nc aborts the handshake once ctx is done.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-stop:
+		}
+	}()
 	r, err := h.fullHandshake(nc, peerID, info, remoteBitfields, namespace)
+	close(stop)
+	<-stopped
+	if parent.Err() != nil {
+		// nc may have been closed regardless of whether the handshake
+		// completed.
+		if err == nil {
+			r.Conn.Close()
+		}
+		err = parent.Err()
+	}
 	if err != nil {
 		nc.Close()
 		return nil, err
@@ -273,11 +480,20 @@ func (h *Handshaker) Initialize(
 	return r, nil
 }
 
+// sendHandshake sends the handshake of info to remotePeerID. haveSince
+// requests a replay of the remote bitfield, and replaySince is the replay
+// requested by the remote peer, if any. session is the token issued for the
+// conn, and resume the token presented to resume an interrupted session.
 func (h *Handshaker) sendHandshake(
 	nc net.Conn,
+	remotePeerID core.PeerID,
 	info *storage.TorrentInfo,
 	remoteBitfields RemoteBitfields,
-	namespace string) error {
+	namespace string,
+	haveSince uint64,
+	replaySince uint64,
+	session []byte,
+	resume []byte) error {
 
 	hs := &handshake{
 		peerID:          h.peerID,
@@ -286,21 +502,44 @@ func (h *Handshaker) sendHandshake(
 		bitfield:        info.Bitfield(),
 		remoteBitfields: remoteBitfields,
 		namespace:       namespace,
+		version:         h.config.MaxProtocolVersion,
+		haveSince:       haveSince,
+		sessionToken:    session,
+		resumeToken:     resume,
+	}
+	hs.haveSeq, hs.havePieces, hs.haveDelta = h.haveReplay.prepare(
+		remotePeerID, info.InfoHash(), replaySince, info.Bitfield())
+	if hs.haveDelta {
+		// Echo the requested replay, which the delta is relative to.
+		hs.haveSince = replaySince
 	}
 	msg, err := hs.toP2PMessage()
 	if err != nil {
 		return err
 	}
-	return sendMessageWithTimeout(nc, msg, h.config.HandshakeTimeout)
+	return sendMessageWithTimeout(nc, _handshakeCodec, msg, h.config.HandshakeTimeout)
 }
 
 func (h *Handshaker) readHandshake(nc net.Conn) (*handshake, error) {
-	m, err := readMessageWithTimeout(nc, h.config.HandshakeTimeout)
+	m, err := readMessageWithTimeout(
+		nc, _handshakeCodec, h.config.MessageLimits, h.config.HandshakeTimeout)
 	if err != nil {
+		if v, ok := err.(ProtocolViolationError); ok {
+			countViolation(h.stats, v)
+		}
 		return nil, fmt.Errorf("read message: %s", err)
 	}
-	hs, err := handshakeFromP2PMessage(m)
+	if m.Type == p2p.Message_REJECT && m.Reject != nil {
+		return nil, RejectionError{m.Reject.Reason, m.Reject.Error}
+	}
+	endpoint := endpointOf(nc)
+	hs, err := parseHandshake(m, func(raw string) (core.PeerID, error) {
+		return h.peerMeta.parsePeerID(endpoint, raw)
+	})
 	if err != nil {
+		if v, ok := err.(ProtocolViolationError); ok {
+			countViolation(h.stats, v)
+		}
 		return nil, fmt.Errorf("handshake from p2p message: %s", err)
 	}
 	return hs, nil
@@ -313,28 +552,66 @@ func (h *Handshaker) fullHandshake(
 	remoteBitfields RemoteBitfields,
 	namespace string) (*HandshakeResult, error) {
 
-	if err := h.sendHandshake(nc, info, remoteBitfields, namespace); err != nil {
+	start := h.clk.Now()
+	haveSince := h.haveReplay.since(peerID, info.InfoHash())
+	session := h.sessions.issue()
+	err := h.sendHandshake(
+		nc, peerID, info, remoteBitfields, namespace, haveSince, 0,
+		session, h.sessions.resumeToken(peerID, info.InfoHash()))
+	h.recordStage(StageHandshakeSend, start, err)
+	if err != nil {
 		return nil, fmt.Errorf("send handshake: %s", err)
 	}
+	start = h.clk.Now()
 	hs, err := h.readHandshake(nc)
+	h.recordStage(StageHandshakeReceive, start, err)
 	if err != nil {
+		if IsRejectionError(err) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("read handshake: %s", err)
 	}
 	if hs.peerID != peerID {
+		// The peer at this endpoint is not who we dialed, so the metadata
+		// cached for the identity it presented can no longer be trusted.
+		h.peerMeta.invalidate(endpointOf(nc), hs.peerID)
 		return nil, errors.New("unexpected peer id")
 	}
-	c, err := h.newConn(nc, peerID, info, false)
+	if hs.haveDelta {
+		if hs.haveSince != haveSince {
+			return nil, fmt.Errorf("have delta since %d, requested %d", hs.haveSince, haveSince)
+		}
+		b, err := h.haveReplay.replay(peerID, info.InfoHash(), haveSince, hs.havePieces)
+		if err != nil {
+			return nil, fmt.Errorf("replay have delta: %s", err)
+		}
+		hs.bitfield = b
+	}
+	h.haveReplay.received(peerID, info.InfoHash(), hs.haveSeq, hs.bitfield)
+	resumed := h.sessions.resumes(peerID, info.InfoHash(), hs.resumeToken)
+	c, err := h.newConn(nc, peerID, info, false, hs.version)
 	if err != nil {
 		return nil, fmt.Errorf("new conn: %s", err)
 	}
+	h.attachSession(c, session, hs.sessionToken, resumed)
 	return &HandshakeResult{c, hs.bitfield, hs.remoteBitfields}, nil
 }
 
+// attachSession records the session tokens exchanged for c. resumed marks
+// whether c resumes an interrupted session.
+func (h *Handshaker) attachSession(c *Conn, local, remote []byte, resumed bool) {
+	if h.sessions.established(c.peerID, c.infoHash, local, remote) {
+		c.sessions = h.sessions
+	}
+	c.resumed = resumed
+}
+
 func (h *Handshaker) newConn(
 	nc net.Conn,
 	peerID core.PeerID,
 	info *storage.TorrentInfo,
-	openedByRemote bool) (*Conn, error) {
+	openedByRemote bool,
+	remoteVersion ProtocolVersion) (*Conn, error) {
 
 	return newConn(
 		h.config,
@@ -348,5 +625,6 @@ func (h *Handshaker) newConn(
 		peerID,
 		info,
 		openedByRemote,
+		negotiateVersion(h.config.MaxProtocolVersion, uint32(remoteVersion)),
 		zap.NewNop().Sugar())
 }
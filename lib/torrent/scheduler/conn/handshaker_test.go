@@ -14,14 +14,23 @@
 package conn
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+	"go.uber.org/zap"
 
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/bitsetutil"
 )
@@ -76,7 +85,8 @@ func TestHandshakerSetsConnFieldsProperly(t *testing.T) {
 	go func() {
 		defer wg.Done()
 
-		r, err := h2.Initialize(h1.peerID, l1.Addr().String(), info, emptyRemoteBitfields, namespace)
+		r, err := h2.Initialize(
+			context.Background(), h1.peerID, l1.Addr().String(), info, emptyRemoteBitfields, namespace)
 		require.NoError(err)
 		require.Equal(h1.peerID, r.Conn.PeerID())
 		require.Equal(info.InfoHash(), r.Conn.InfoHash())
@@ -87,3 +97,300 @@ func TestHandshakerSetsConnFieldsProperly(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestHandshakerNegotiatesOldestProtocolVersion(t *testing.T) {
+	require := require.New(t)
+
+	h1 := HandshakerFixture(ConfigFixture())
+	l1, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer l1.Close()
+
+	v1Config := ConfigFixture()
+	v1Config.MaxProtocolVersion = ProtocolV1
+	h2 := HandshakerFixture(v1Config)
+
+	info := storage.TorrentInfoFixture(4, 1)
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		nc, err := l1.Accept()
+		require.NoError(err)
+		pc, err := h1.Accept(nc)
+		require.NoError(err)
+		c, err := h1.Establish(pc, info, make(RemoteBitfields))
+		require.NoError(err)
+		accepted <- c
+	}()
+
+	r, err := h2.Initialize(
+		context.Background(), h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+	require.NoError(err)
+	remote := r.Conn
+	defer remote.Close()
+	local := <-accepted
+	defer local.Close()
+
+	require.Equal(ProtocolV1, local.ProtocolVersion())
+	require.Equal(ProtocolV1, remote.ProtocolVersion())
+
+	local.Start()
+	remote.Start()
+
+	// Heartbeats are unsupported by v1, so they are dropped instead of being
+	// sent to a peer which cannot decode them.
+	require.NoError(local.Send(NewHeartbeatMessage([]int{1})))
+	require.NoError(local.Send(NewAnnouncePieceMessage(2)))
+
+	select {
+	case msg := <-remote.Receiver():
+		require.Equal(p2p.Message_ANNOUCE_PIECE, msg.Message.Type)
+	case <-time.After(5 * time.Second):
+		require.FailNow("announce not received")
+	}
+	require.False(local.IsClosed())
+}
+
+func TestHandshakerRejectReturnsRejectionErrorToInitializer(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+
+	h1 := HandshakerFixture(config)
+	l1, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer l1.Close()
+
+	h2 := HandshakerFixture(config)
+
+	info := storage.TorrentInfoFixture(4, 1)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		nc, err := l1.Accept()
+		require.NoError(err)
+
+		pc, err := h1.Accept(nc)
+		require.NoError(err)
+
+		h1.Reject(pc, p2p.RejectMessage_AT_CAPACITY, errors.New("some error"))
+	}()
+
+	_, err = h2.Initialize(
+		context.Background(), h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+	require.Error(err)
+	require.True(IsRejectionError(err))
+	require.Equal(p2p.RejectMessage_AT_CAPACITY, err.(RejectionError).Reason)
+	require.Equal("some error", err.(RejectionError).Message)
+
+	wg.Wait()
+}
+
+func TestHandshakerRecordsOutgoingStageFailures(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	h, err := NewHandshaker(
+		ConfigFixture(),
+		stats,
+		clock.New(),
+		networkevent.NewTestProducer(),
+		core.PeerIDFixture(),
+		noopEvents{},
+		zap.NewNop().Sugar())
+	require.NoError(err)
+
+	// Reserve a port which nothing listens on.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = h.Initialize(
+		context.Background(), core.PeerIDFixture(), addr,
+		storage.TorrentInfoFixture(1, 1), nil, "noexist")
+	require.Error(err)
+
+	failures := make(map[string]int64)
+	for _, c := range stats.Snapshot().Counters() {
+		if c.Name() == "outgoing_conn_stage_failures" {
+			failures[c.Tags()["stage"]] += c.Value()
+		}
+	}
+	require.Equal(map[string]int64{StageDial: 1}, failures)
+}
+
+func TestHandshakerInitializeAbortsOnContextDone(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+	config.HandshakeTimeout = time.Minute
+	h := HandshakerFixture(config)
+
+	// The remote peer accepts the conn, but never responds to the handshake.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		nc, err := l.Accept()
+		if err == nil {
+			defer nc.Close()
+			ioutil.ReadAll(nc)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = h.Initialize(
+		ctx, core.PeerIDFixture(), l.Addr().String(), storage.TorrentInfoFixture(1, 1), nil, "")
+	require.Equal(context.Canceled, err)
+	require.True(time.Since(start) < 10*time.Second)
+}
+
+func TestHandshakerReplaysHaveDeltaOnReconnect(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+
+	h1 := HandshakerFixture(config)
+	l1, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer l1.Close()
+
+	h2 := HandshakerFixture(config)
+
+	mi := core.SizedBlobFixture(4, 1).MetaInfo
+
+	for _, bitfield := range []*bitset.BitSet{
+		bitsetutil.FromBools(true, false, false, false),
+		bitsetutil.FromBools(true, false, true, true),
+	} {
+		info := storage.NewTorrentInfo(mi, bitfield)
+
+		accepted := make(chan error, 1)
+		go func() {
+			nc, err := l1.Accept()
+			if err != nil {
+				accepted <- err
+				return
+			}
+			pc, err := h1.Accept(nc)
+			if err != nil {
+				accepted <- err
+				return
+			}
+			c, err := h1.Establish(pc, info, make(RemoteBitfields))
+			if err == nil {
+				c.Close()
+			}
+			accepted <- err
+		}()
+
+		r, err := h2.Initialize(
+			context.Background(), h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+		require.NoError(err)
+		require.NoError(<-accepted)
+		r.Conn.Close()
+		require.Equal(bitfield, r.Bitfield)
+	}
+
+	hits := h1.stats.(tally.TestScope).Snapshot().Counters()["have_replay_hits+module=conn"]
+	require.NotNil(hits)
+	require.Equal(int64(1), hits.Value())
+}
+
+type closedEvents chan *Conn
+
+func (e closedEvents) ConnClosed(c *Conn) { e <- c }
+
+func TestHandshakerResumesInterruptedSession(t *testing.T) {
+	require := require.New(t)
+
+	config := ConfigFixture()
+	config.Session = SessionConfig{Enable: true}
+
+	closed := make(closedEvents, 2)
+
+	newHandshaker := func() *Handshaker {
+		h, err := NewHandshaker(
+			config,
+			tally.NewTestScope("", nil),
+			clock.New(),
+			networkevent.NewTestProducer(),
+			core.PeerIDFixture(),
+			closed,
+			zap.NewNop().Sugar())
+		require.NoError(err)
+		return h
+	}
+	h1 := newHandshaker()
+	h2 := newHandshaker()
+
+	l1, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer l1.Close()
+
+	info := storage.TorrentInfoFixture(4, 1)
+
+	handshake := func() (accepted *Conn, initialized *Conn) {
+		result := make(chan *Conn, 1)
+		go func() {
+			defer close(result)
+			nc, err := l1.Accept()
+			if err != nil {
+				return
+			}
+			pc, err := h1.Accept(nc)
+			if err != nil {
+				return
+			}
+			c, err := h1.Establish(pc, info, make(RemoteBitfields))
+			if err != nil {
+				return
+			}
+			result <- c
+		}()
+		r, err := h2.Initialize(
+			context.Background(), h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+		require.NoError(err)
+		c := <-result
+		require.NotNil(c)
+		c.Start()
+		r.Conn.Start()
+		return c, r.Conn
+	}
+
+	c1, c2 := handshake()
+	require.False(c1.Resumed())
+	require.False(c2.Resumed())
+
+	// Interrupt the conn without either peer closing it.
+	c1.nc.Close()
+	<-closed
+	<-closed
+	require.True(c1.Resumable())
+	require.True(c2.Resumable())
+
+	c1, c2 = handshake()
+	require.True(c1.Resumed())
+	require.True(c2.Resumed())
+
+	// Conns closed by either peer cannot be resumed.
+	c2.Close()
+	<-closed
+	<-closed
+	require.False(c1.Resumable())
+	require.False(c2.Resumable())
+
+	c1, c2 = handshake()
+	require.False(c1.Resumed())
+	require.False(c2.Resumed())
+	c1.Close()
+	c2.Close()
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+)
+
+// HaveReplayConfig defines replay of missed piece availability during
+// handshake. Peers remember the bitfields exchanged with each other, such
+// that a peer which reconnects shortly after a dropped conn receives only
+// the pieces completed since its last handshake instead of a full bitfield.
+type HaveReplayConfig struct {
+	Disable bool `yaml:"disable"`
+
+	// Size is the maximum number of bitfields remembered, across all peers
+	// and torrents. The least recently used bitfield is evicted once exceeded.
+	Size int `yaml:"size"`
+
+	// TTL is the duration for which a bitfield is remembered after being
+	// exchanged.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c HaveReplayConfig) applyDefaults() HaveReplayConfig {
+	if c.Size == 0 {
+		c.Size = 4096
+	}
+	if c.TTL == 0 {
+		c.TTL = 5 * time.Minute
+	}
+	return c
+}
+
+type haveKey struct {
+	// sent distinguishes bitfields sent to the peer from bitfields received
+	// from the peer.
+	sent     bool
+	peerID   core.PeerID
+	infoHash core.InfoHash
+}
+
+type haveEntry struct {
+	key      haveKey
+	seq      uint64
+	bitfield *bitset.BitSet
+	cachedAt time.Time
+}
+
+// haveReplayCache is a bounded LRU cache of the bitfields exchanged with
+// remote peers, identified by sequence numbers. A nil haveReplayCache
+// disables replay.
+type haveReplayCache struct {
+	config HaveReplayConfig
+	clk    clock.Clock
+	stats  tally.Scope
+
+	mu      sync.Mutex
+	seq     uint64
+	entries map[haveKey]*list.Element
+	lru     *list.List
+}
+
+func newHaveReplayCache(
+	config HaveReplayConfig, clk clock.Clock, stats tally.Scope) *haveReplayCache {
+
+	if config.Disable {
+		return nil
+	}
+	return &haveReplayCache{
+		config: config.applyDefaults(),
+		clk:    clk,
+		stats:  stats,
+		// Seeding the sequence with the current time avoids reusing sequence
+		// numbers across restarts.
+		seq:     uint64(clk.Now().UnixNano()),
+		entries: make(map[haveKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// since returns the sequence number of the last bitfield received from
+// peerID for h, or 0 if none is remembered.
+func (c *haveReplayCache) since(peerID core.PeerID, h core.InfoHash) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.lookup(haveKey{false, peerID, h}); e != nil {
+		return e.seq
+	}
+	return 0
+}
+
+// prepare records bitfield as sent to peerID for h under a new sequence
+// number. If since identifies the last bitfield sent to peerID and bitfield
+// is a superset of it, the pieces completed since are returned as delta.
+func (c *haveReplayCache) prepare(
+	peerID core.PeerID,
+	h core.InfoHash,
+	since uint64,
+	bitfield *bitset.BitSet) (seq uint64, delta []int32, ok bool) {
+
+	if c == nil {
+		return 0, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := haveKey{true, peerID, h}
+	if since != 0 {
+		if e := c.lookup(k); e != nil && e.seq == since &&
+			e.bitfield.Len() == bitfield.Len() && bitfield.IsSuperSet(e.bitfield) {
+
+			diff := bitfield.Difference(e.bitfield)
+			for i, more := diff.NextSet(0); more; i, more = diff.NextSet(i + 1) {
+				delta = append(delta, int32(i))
+			}
+			ok = true
+			c.stats.Counter("have_replay_hits").Inc(1)
+		} else {
+			c.stats.Counter("have_replay_misses").Inc(1)
+		}
+	}
+	c.seq++
+	c.add(k, c.seq, bitfield)
+	return c.seq, delta, ok
+}
+
+// replay reconstructs the bitfield of peerID for h by applying delta to the
+// last bitfield received from peerID, identified by since.
+func (c *haveReplayCache) replay(
+	peerID core.PeerID, h core.InfoHash, since uint64, delta []int32) (*bitset.BitSet, error) {
+
+	if c == nil {
+		return nil, errors.New("have replay disabled")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(haveKey{false, peerID, h})
+	if e == nil || e.seq != since {
+		return nil, fmt.Errorf("no bitfield cached for seq %d", since)
+	}
+	b := e.bitfield.Clone()
+	for _, i := range delta {
+		if i < 0 || uint(i) >= b.Len() {
+			return nil, fmt.Errorf("piece %d out of bounds", i)
+		}
+		b.Set(uint(i))
+	}
+	return b, nil
+}
+
+// received records bitfield as received from peerID for h under seq.
+func (c *haveReplayCache) received(
+	peerID core.PeerID, h core.InfoHash, seq uint64, bitfield *bitset.BitSet) {
+
+	if c == nil || seq == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(haveKey{false, peerID, h}, seq, bitfield)
+}
+
+func (c *haveReplayCache) lookup(k haveKey) *haveEntry {
+	e, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*haveEntry)
+	if c.clk.Now().Sub(entry.cachedAt) >= c.config.TTL {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return entry
+}
+
+func (c *haveReplayCache) add(k haveKey, seq uint64, bitfield *bitset.BitSet) {
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	c.entries[k] = c.lru.PushFront(&haveEntry{k, seq, bitfield.Clone(), c.clk.Now()})
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *haveReplayCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*haveEntry).key)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestHaveReplayCacheReplaysDelta(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	sender := newHaveReplayCache(HaveReplayConfig{}, clock.NewMock(), stats)
+	receiver := newHaveReplayCache(HaveReplayConfig{}, clock.NewMock(), tally.NoopScope)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	old := bitsetutil.FromBools(true, false, false, true)
+	seq, delta, ok := sender.prepare(p2, h, receiver.since(p1, h), old)
+	require.False(ok)
+	require.Empty(delta)
+	receiver.received(p1, h, seq, old)
+
+	cur := bitsetutil.FromBools(true, true, false, true)
+	since := receiver.since(p1, h)
+	require.Equal(seq, since)
+	next, delta, ok := sender.prepare(p2, h, since, cur)
+	require.True(ok)
+	require.Equal([]int32{1}, delta)
+	require.NotEqual(seq, next)
+
+	b, err := receiver.replay(p1, h, since, delta)
+	require.NoError(err)
+	require.Equal(cur, b)
+	require.Equal(int64(1), counter(stats, "have_replay_hits"))
+}
+
+func TestHaveReplayCacheMisses(t *testing.T) {
+	p := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+	old := bitsetutil.FromBools(true, true, false)
+
+	tests := []struct {
+		desc    string
+		advance time.Duration
+		since   func(seq uint64) uint64
+		cur     *bitset.BitSet
+	}{
+		{"unknown seq", 0, func(seq uint64) uint64 { return seq + 1 }, bitsetutil.FromBools(true, true, true)},
+		{"expired", time.Hour, func(seq uint64) uint64 { return seq }, bitsetutil.FromBools(true, true, true)},
+		{"pieces removed", 0, func(seq uint64) uint64 { return seq }, bitsetutil.FromBools(true, false, true)},
+		{"length changed", 0, func(seq uint64) uint64 { return seq }, bitsetutil.FromBools(true, true, false, true)},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
+			c := newHaveReplayCache(HaveReplayConfig{}, clk, stats)
+
+			seq, _, _ := c.prepare(p, h, 0, old)
+			clk.Add(test.advance)
+
+			_, delta, ok := c.prepare(p, h, test.since(seq), test.cur)
+			require.False(ok)
+			require.Empty(delta)
+			require.Equal(int64(1), counter(stats, "have_replay_misses"))
+		})
+	}
+}
+
+func TestHaveReplayCacheRejectsOutOfBoundsDelta(t *testing.T) {
+	require := require.New(t)
+
+	c := newHaveReplayCache(HaveReplayConfig{}, clock.NewMock(), tally.NoopScope)
+
+	p := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+	c.received(p, h, 7, bitsetutil.FromBools(true, false))
+
+	_, err := c.replay(p, h, 7, []int32{2})
+	require.Error(err)
+
+	_, err = c.replay(p, h, 8, []int32{1})
+	require.Error(err)
+}
+
+func TestHaveReplayCacheDisabled(t *testing.T) {
+	require := require.New(t)
+
+	c := newHaveReplayCache(HaveReplayConfig{Disable: true}, clock.NewMock(), tally.NoopScope)
+	require.Nil(c)
+
+	p := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+	seq, _, ok := c.prepare(p, h, 0, bitsetutil.FromBools(true))
+	require.Zero(seq)
+	require.False(ok)
+	require.Zero(c.since(p, h))
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/uber-go/tally"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/utils/memsize"
+	"github.com/willf/bitset"
+)
+
+// Protocol violation reasons.
+const (
+	ViolationOversizedMessage     = "oversized_message"
+	ViolationMalformedMessage     = "malformed_message"
+	ViolationUnsupportedMessage   = "unsupported_message"
+	ViolationInvalidBitfield      = "invalid_bitfield"
+	ViolationInvalidPayloadLength = "invalid_payload_length"
+)
+
+// ProtocolViolationError is returned when a remote peer sends a message which
+// is malformed or exceeds its size limit. Conns are closed on violations, and
+// never resumed.
+type ProtocolViolationError struct {
+	Reason string
+	Err    error
+}
+
+func (e ProtocolViolationError) Error() string {
+	return fmt.Sprintf("protocol violation (%s): %s", e.Reason, e.Err)
+}
+
+// countViolation records v in the security metrics of stats.
+func countViolation(stats tally.Scope, v ProtocolViolationError) {
+	stats.Tagged(map[string]string{
+		"reason": v.Reason,
+	}).Counter("protocol_violations").Inc(1)
+}
+
+func violationf(reason string, format string, args ...interface{}) error {
+	return ProtocolViolationError{reason, fmt.Errorf(format, args...)}
+}
+
+// MessageLimitsConfig defines the maximum encoded size of inbound messages,
+// by message type. Frames are read before their type is known, so every limit
+// is capped at the maximum frame size, which bounds the allocation of any
+// single read.
+type MessageLimitsConfig struct {
+	// Handshake limits bitfield messages, which carry the piece set of the
+	// remote peer during handshake, and handshake rejections.
+	Handshake uint64 `yaml:"handshake"`
+
+	// Bitfield limits heartbeats, which carry piece sets after handshake.
+	Bitfield uint64 `yaml:"bitfield"`
+
+	// Piece limits piece payload and piece hash messages. The payload which
+	// follows a piece payload message is not included, and is instead limited
+	// to the piece length of the torrent.
+	Piece uint64 `yaml:"piece"`
+
+	// Control limits all other messages, e.g. piece requests, announcements,
+	// cancellations and errors.
+	Control uint64 `yaml:"control"`
+}
+
+func (c MessageLimitsConfig) applyDefaults() MessageLimitsConfig {
+	if c.Handshake == 0 {
+		c.Handshake = maxMessageSize
+	}
+	if c.Bitfield == 0 {
+		c.Bitfield = maxMessageSize
+	}
+	if c.Piece == 0 {
+		c.Piece = memsize.KB
+	}
+	if c.Control == 0 {
+		c.Control = 4 * memsize.KB
+	}
+	c.Handshake = clampMessageSize(c.Handshake)
+	c.Bitfield = clampMessageSize(c.Bitfield)
+	c.Piece = clampMessageSize(c.Piece)
+	c.Control = clampMessageSize(c.Control)
+	return c
+}
+
+func clampMessageSize(limit uint64) uint64 {
+	if limit > maxMessageSize {
+		return maxMessageSize
+	}
+	return limit
+}
+
+// limit returns the maximum encoded size of messages of type t.
+func (c MessageLimitsConfig) limit(t p2p.Message_Type) uint64 {
+	switch t {
+	case p2p.Message_BITFIELD, p2p.Message_REJECT:
+		return c.Handshake
+	case p2p.Message_HEARTBEAT:
+		return c.Bitfield
+	case p2p.Message_PIECE_PAYLOAD, p2p.Message_PIECE_HASH:
+		return c.Piece
+	default:
+		return c.Control
+	}
+}
+
+// check returns an error if msg, encoded in size bytes, exceeds its limit.
+func (c MessageLimitsConfig) check(msg *p2p.Message, size int) error {
+	if limit := c.limit(msg.Type); uint64(size) > limit {
+		return violationf(
+			ViolationOversizedMessage, "%s message exceeds max size: %d > %d", msg.Type, size, limit)
+	}
+	return nil
+}
+
+// validateMessage returns an error if fields of msg which peers act upon are
+// out of range.
+func validateMessage(msg *p2p.Message) error {
+	var indices []int32
+	switch msg.Type {
+	case p2p.Message_PIECE_REQUEST:
+		if msg.PieceRequest == nil {
+			return errors.New("piece request message missing piece request")
+		}
+		indices = append(indices, msg.PieceRequest.Index)
+	case p2p.Message_PIECE_PAYLOAD:
+		if msg.PiecePayload == nil {
+			return errors.New("piece payload message missing piece payload")
+		}
+		if msg.PiecePayload.Length < 0 {
+			return fmt.Errorf("negative piece payload length: %d", msg.PiecePayload.Length)
+		}
+		indices = append(indices, msg.PiecePayload.Index)
+	case p2p.Message_ANNOUCE_PIECE:
+		if msg.AnnouncePiece == nil {
+			return errors.New("announce piece message missing announce piece")
+		}
+		indices = append(indices, msg.AnnouncePiece.Index)
+	case p2p.Message_CANCEL_PIECE:
+		if msg.CancelPiece == nil {
+			return errors.New("cancel piece message missing cancel piece")
+		}
+		indices = append(indices, msg.CancelPiece.Index)
+	case p2p.Message_BITFIELD:
+		if msg.Bitfield == nil {
+			return errors.New("bitfield message missing bitfield")
+		}
+		indices = msg.Bitfield.HavePieces
+	case p2p.Message_HEARTBEAT:
+		if msg.Heartbeat != nil {
+			indices = msg.Heartbeat.Pieces
+		}
+	case p2p.Message_PIECE_HASH_REQUEST:
+		if msg.PieceHashRequest == nil {
+			return errors.New("piece hash request message missing piece hash request")
+		}
+		indices = append(indices, msg.PieceHashRequest.Index)
+	case p2p.Message_PIECE_HASH:
+		if msg.PieceHash == nil {
+			return errors.New("piece hash message missing piece hash")
+		}
+		indices = append(indices, msg.PieceHash.Index)
+	case p2p.Message_PIECE_REQUEST_BATCH:
+		if msg.PieceRequestBatch == nil {
+			return errors.New("piece request batch message missing piece request batch")
+		}
+		if _, err := decodePieceRequestBatch(msg.PieceRequestBatch); err != nil {
+			return err
+		}
+	}
+	for _, i := range indices {
+		if i < 0 {
+			return fmt.Errorf("negative piece index: %d", i)
+		}
+	}
+	return nil
+}
+
+// unmarshalBitfield decodes a bitfield encoded by bitset.MarshalBinary. The
+// encoded length is checked against the encoded words before decoding, since
+// bitset allocates the length it reads.
+func unmarshalBitfield(b []byte) (*bitset.BitSet, error) {
+	if len(b) < 8 {
+		return nil, violationf(ViolationInvalidBitfield, "bitfield too short: %d bytes", len(b))
+	}
+	length := binary.BigEndian.Uint64(b[:8])
+	words := uint64(len(b)-8) / 8
+	if length > words*64 {
+		return nil, violationf(
+			ViolationInvalidBitfield, "bitfield length %d does not match %d bytes", length, len(b))
+	}
+	bitfield := bitset.New(0)
+	if err := bitfield.UnmarshalBinary(b); err != nil {
+		return nil, violationf(ViolationInvalidBitfield, "%s", err)
+	}
+	return bitfield, nil
+}
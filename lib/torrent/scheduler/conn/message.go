@@ -14,13 +14,12 @@
 package conn
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
+	"math"
 	"net"
+	"sort"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/storage"
 )
@@ -75,6 +74,53 @@ func NewErrorMessage(index int, code p2p.ErrorMessage_ErrorCode, err error) *Mes
 	}
 }
 
+// NewPieceRequestBatchMessage returns a Message for requesting the full pieces
+// of indices, which must be distinct.
+func NewPieceRequestBatchMessage(indices []int) *Message {
+	sorted := append([]int(nil), indices...)
+	sort.Ints(sorted)
+	deltas := make([]int32, len(sorted))
+	var prev int
+	for i, index := range sorted {
+		deltas[i] = int32(index - prev)
+		prev = index
+	}
+	return &Message{
+		Message: &p2p.Message{
+			Type:              p2p.Message_PIECE_REQUEST_BATCH,
+			PieceRequestBatch: &p2p.PieceRequestBatchMessage{IndexDeltas: deltas},
+		},
+	}
+}
+
+// PieceRequestBatchIndices returns the piece indices requested by msg, in
+// increasing order. msg must have been validated on receipt.
+func PieceRequestBatchIndices(msg *p2p.PieceRequestBatchMessage) []int {
+	indices, err := decodePieceRequestBatch(msg)
+	if err != nil {
+		panic(err)
+	}
+	return indices
+}
+
+// decodePieceRequestBatch returns the piece indices requested by msg. Returns
+// error if the indices are not strictly increasing or overflow.
+func decodePieceRequestBatch(msg *p2p.PieceRequestBatchMessage) ([]int, error) {
+	indices := make([]int, len(msg.IndexDeltas))
+	var index int64
+	for i, delta := range msg.IndexDeltas {
+		if delta < 0 || (i > 0 && delta == 0) {
+			return nil, fmt.Errorf("invalid piece request batch delta at %d: %d", i, delta)
+		}
+		index += int64(delta)
+		if index > math.MaxInt32 {
+			return nil, fmt.Errorf("piece request batch index overflow at %d", i)
+		}
+		indices[i] = int(index)
+	}
+	return indices, nil
+}
+
 // NewAnnouncePieceMessage returns a Message for announcing a piece.
 func NewAnnouncePieceMessage(index int) *Message {
 	return &Message{
@@ -87,6 +133,18 @@ func NewAnnouncePieceMessage(index int) *Message {
 	}
 }
 
+// NewCancelPieceMessage returns a Message for cancelling a piece request.
+func NewCancelPieceMessage(index int) *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_CANCEL_PIECE,
+			CancelPiece: &p2p.CancelPieceMessage{
+				Index: int32(index),
+			},
+		},
+	}
+}
+
 // NewCompleteMessage returns a Message for a completed torrent.
 func NewCompleteMessage() *Message {
 	return &Message{
@@ -96,58 +154,79 @@ func NewCompleteMessage() *Message {
 	}
 }
 
-func sendMessage(nc net.Conn, msg *p2p.Message) error {
-	data, err := proto.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("proto marshal: %s", err)
+// NewGoodbyeMessage returns a Message for gracefully closing a connection.
+func NewGoodbyeMessage() *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type:    p2p.Message_GOODBYE,
+			Goodbye: &p2p.GoodbyeMessage{},
+		},
 	}
-	if err := binary.Write(nc, binary.BigEndian, uint32(len(data))); err != nil {
-		return fmt.Errorf("write data length: %s", err)
+}
+
+// NewHeartbeatMessage returns a Message carrying the pieces gained since the
+// previous heartbeat.
+func NewHeartbeatMessage(pieces []int) *Message {
+	indices := make([]int32, len(pieces))
+	for j, i := range pieces {
+		indices[j] = int32(i)
 	}
-	for len(data) > 0 {
-		n, err := nc.Write(data)
-		if err != nil {
-			return fmt.Errorf("write data: %s", err)
-		}
-		data = data[n:]
+	return &Message{
+		Message: &p2p.Message{
+			Type:      p2p.Message_HEARTBEAT,
+			Heartbeat: &p2p.HeartbeatMessage{Pieces: indices},
+		},
 	}
-	return nil
 }
 
-func sendMessageWithTimeout(nc net.Conn, msg *p2p.Message, timeout time.Duration) error {
+// NewPieceHashRequestMessage returns a Message for requesting the expected hash
+// of piece index.
+func NewPieceHashRequestMessage(index int) *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type:             p2p.Message_PIECE_HASH_REQUEST,
+			PieceHashRequest: &p2p.PieceHashRequestMessage{Index: int32(index)},
+		},
+	}
+}
+
+// NewPieceHashMessage returns a Message carrying the expected hash of piece
+// index. An empty hash declines the request.
+func NewPieceHashMessage(index int, hash []byte) *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type:      p2p.Message_PIECE_HASH,
+			PieceHash: &p2p.PieceHashMessage{Index: int32(index), Hash: hash},
+		},
+	}
+}
+
+func sendMessage(nc net.Conn, c *codec, msg *p2p.Message) error {
+	return c.encode(nc, msg)
+}
+
+func sendMessageWithTimeout(
+	nc net.Conn, c *codec, msg *p2p.Message, timeout time.Duration) error {
+
 	// NOTE: We do not use the clock interface here because the net package uses
 	// the system clock when evaluating deadlines.
 	if err := nc.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 		return fmt.Errorf("set write deadline: %s", err)
 	}
-	return sendMessage(nc, msg)
+	return sendMessage(nc, c, msg)
 }
 
-func readMessage(nc net.Conn) (*p2p.Message, error) {
-	var msglen [4]byte
-	if _, err := io.ReadFull(nc, msglen[:]); err != nil {
-		return nil, fmt.Errorf("read message length: %s", err)
-	}
-	dataLen := binary.BigEndian.Uint32(msglen[:])
-	if uint64(dataLen) > maxMessageSize {
-		return nil, fmt.Errorf("message exceeds max size: %d > %d", dataLen, maxMessageSize)
-	}
-	data := make([]byte, dataLen)
-	if _, err := io.ReadFull(nc, data); err != nil {
-		return nil, fmt.Errorf("read data: %s", err)
-	}
-	p2pMessage := new(p2p.Message)
-	if err := proto.Unmarshal(data, p2pMessage); err != nil {
-		return nil, fmt.Errorf("proto unmarshal: %s", err)
-	}
-	return p2pMessage, nil
+func readMessage(nc net.Conn, c *codec, limits MessageLimitsConfig) (*p2p.Message, error) {
+	return c.decode(nc, limits)
 }
 
-func readMessageWithTimeout(nc net.Conn, timeout time.Duration) (*p2p.Message, error) {
+func readMessageWithTimeout(
+	nc net.Conn, c *codec, limits MessageLimitsConfig, timeout time.Duration) (*p2p.Message, error) {
+
 	// NOTE: We do not use the clock interface here because the net package uses
 	// the system clock when evaluating deadlines.
 	if err := nc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, fmt.Errorf("set read deadline: %s", err)
 	}
-	return readMessage(nc)
+	return readMessage(nc, c, limits)
 }
@@ -0,0 +1,201 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+// NetemConfig defines the impairments a netem pipe applies to traffic, in the
+// spirit of Linux netem. Impairments operate on whole frames, i.e. a message
+// plus its payload if any, such that framing survives while messages are lost,
+// duplicated, reordered and delayed. All randomness is derived from Seed, so
+// tests are deterministic.
+type NetemConfig struct {
+	// Loss is the probability of a frame being dropped.
+	Loss float64
+
+	// Duplicate is the probability of a frame being delivered twice.
+	Duplicate float64
+
+	// Reorder is the probability of a frame being held back and delivered
+	// after the frame which follows it.
+	Reorder float64
+
+	// Latency delays every frame. Jitter adds a uniformly random delay in
+	// [-Jitter, Jitter] on top of Latency.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	Seed int64
+}
+
+type netemFrame []byte
+
+// netemLink forwards frames in a single direction, applying impairments.
+type netemLink struct {
+	config NetemConfig
+	rand   *rand.Rand
+	src    net.Conn
+	dst    net.Conn
+}
+
+func (l *netemLink) readFrame() (netemFrame, error) {
+	data, err := readFrame(l.src)
+	if err != nil {
+		return nil, err
+	}
+	// Frames are forwarded verbatim, so they are decoded with the current
+	// version, which is a superset of all versions, regardless of which version
+	// the endpoints negotiated.
+	msg, err := codecFor(CurrentProtocolVersion).unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	frame := append(header[:], data...)
+	if msg.Type == p2p.Message_PIECE_PAYLOAD {
+		payload := make([]byte, msg.PiecePayload.Length)
+		if _, err := io.ReadFull(l.src, payload); err != nil {
+			return nil, fmt.Errorf("read payload: %s", err)
+		}
+		frame = append(frame, payload...)
+	}
+	return frame, nil
+}
+
+func (l *netemLink) delay() time.Duration {
+	d := l.config.Latency
+	if l.config.Jitter > 0 {
+		d += time.Duration(l.rand.Int63n(int64(2*l.config.Jitter))) - l.config.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (l *netemLink) deliver(f netemFrame) error {
+	if d := l.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	_, err := l.dst.Write(f)
+	return err
+}
+
+func (l *netemLink) run() {
+	defer l.src.Close()
+	defer l.dst.Close()
+
+	var held netemFrame
+	for {
+		f, err := l.readFrame()
+		if err != nil {
+			if held != nil {
+				l.deliver(held)
+			}
+			return
+		}
+		if l.rand.Float64() < l.config.Loss {
+			continue
+		}
+		n := 1
+		if l.rand.Float64() < l.config.Duplicate {
+			n = 2
+		}
+		if held == nil && l.rand.Float64() < l.config.Reorder {
+			held = f
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if err := l.deliver(f); err != nil {
+				return
+			}
+		}
+		if held != nil {
+			if err := l.deliver(held); err != nil {
+				return
+			}
+			held = nil
+		}
+	}
+}
+
+// NetemPipe returns both ends of an in-process connection which carries the
+// p2p protocol and impairs traffic in both directions according to config.
+func NetemPipe(config NetemConfig) (local net.Conn, remote net.Conn, cleanupFunc func()) {
+	local, localInner := net.Pipe()
+	remote, remoteInner := net.Pipe()
+
+	go (&netemLink{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+		src:    localInner,
+		dst:    remoteInner,
+	}).run()
+	go (&netemLink{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed + 1)),
+		src:    remoteInner,
+		dst:    localInner,
+	}).run()
+
+	return local, remote, func() {
+		local.Close()
+		remote.Close()
+	}
+}
+
+// NetemPipeFixture returns Conns for both sides of a live connection whose
+// traffic is impaired according to netem.
+func NetemPipeFixture(
+	config Config,
+	netem NetemConfig,
+	info *storage.TorrentInfo) (local *Conn, remote *Conn, cleanupFunc func()) {
+
+	var cleanup testutil.Cleanup
+	defer cleanup.Recover()
+
+	nc1, nc2, closePipe := NetemPipe(netem)
+	cleanup.Add(closePipe)
+
+	var err error
+
+	local, err = HandshakerFixture(config).newConn(
+		noopDeadline{nc1}, core.PeerIDFixture(), info, false, CurrentProtocolVersion)
+	if err != nil {
+		panic(err)
+	}
+	local.Start()
+
+	remote, err = HandshakerFixture(config).newConn(
+		noopDeadline{nc2}, core.PeerIDFixture(), info, true, CurrentProtocolVersion)
+	if err != nil {
+		panic(err)
+	}
+	remote.Start()
+
+	return local, remote, cleanup.Run
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+func receiveAnnounced(t *testing.T, c *Conn, timeout time.Duration) []int {
+	var indices []int
+	for {
+		select {
+		case msg := <-c.Receiver():
+			indices = append(indices, int(msg.Message.AnnouncePiece.Index))
+		case <-time.After(timeout):
+			return indices
+		}
+	}
+}
+
+func TestNetemPipe(t *testing.T) {
+	tests := []struct {
+		desc     string
+		netem    NetemConfig
+		expected []int
+	}{
+		{"no impairments", NetemConfig{}, []int{0, 1, 2}},
+		{"loss", NetemConfig{Loss: 1}, nil},
+		{"duplicate", NetemConfig{Duplicate: 1}, []int{0, 0, 1, 1, 2, 2}},
+		{"reorder", NetemConfig{Reorder: 1}, []int{1, 0, 3, 2}},
+		{"latency", NetemConfig{Latency: 10 * time.Millisecond}, []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			local, remote, cleanup := NetemPipeFixture(
+				Config{}, test.netem, storage.TorrentInfoFixture(4, 1))
+			defer cleanup()
+
+			n := 3
+			if test.netem.Reorder > 0 {
+				n = 4
+			}
+			for i := 0; i < n; i++ {
+				require.NoError(local.Send(NewAnnouncePieceMessage(i)))
+			}
+			require.Equal(test.expected, receiveAnnounced(t, remote, 200*time.Millisecond))
+		})
+	}
+}
+
+func TestNetemPipeIsDeterministic(t *testing.T) {
+	require := require.New(t)
+
+	netem := NetemConfig{Loss: 0.3, Duplicate: 0.3, Reorder: 0.3, Seed: 42}
+
+	var results [][]int
+	for i := 0; i < 2; i++ {
+		local, remote, cleanup := NetemPipeFixture(Config{}, netem, storage.TorrentInfoFixture(20, 1))
+		for j := 0; j < 20; j++ {
+			require.NoError(local.Send(NewAnnouncePieceMessage(j)))
+		}
+		results = append(results, receiveAnnounced(t, remote, 200*time.Millisecond))
+		cleanup()
+	}
+	require.Equal(results[0], results[1])
+	require.NotEqual(20, len(results[0]))
+}
+
+func TestNetemPipePreservesPiecePayloadFraming(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := NetemPipeFixture(
+		Config{}, NetemConfig{Duplicate: 1}, storage.TorrentInfoFixture(1, 4))
+	defer cleanup()
+
+	payload := []byte("abcd")
+	require.NoError(local.Send(NewPiecePayloadMessage(0, piecereader.NewBuffer(payload))))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-remote.Receiver():
+			require.Equal(p2p.Message_PIECE_PAYLOAD, msg.Message.Type)
+			b, err := ioutil.ReadAll(msg.Payload)
+			require.NoError(err)
+			require.Equal(payload, b)
+		case <-time.After(time.Second):
+			require.FailNow("timed out waiting for piece payload")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+)
+
+// PeerMetadataCacheConfig defines caching of validated peer metadata, keyed
+// by remote endpoint and peer id, such that rapid reconnects from the same
+// peer skip repeated validation during handshakes.
+type PeerMetadataCacheConfig struct {
+	Disable bool `yaml:"disable"`
+
+	// Size is the maximum number of peers cached. The least recently used
+	// peer is evicted once exceeded.
+	Size int `yaml:"size"`
+
+	// TTL is the duration for which cached metadata is trusted.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c PeerMetadataCacheConfig) applyDefaults() PeerMetadataCacheConfig {
+	if c.Size == 0 {
+		c.Size = 4096
+	}
+	if c.TTL == 0 {
+		c.TTL = 10 * time.Minute
+	}
+	return c
+}
+
+// peerMetadata is the validated metadata of a remote peer. Handshakes only
+// carry the peer id as identity, so it is the only metadata cached.
+type peerMetadata struct {
+	key      peerMetadataKey
+	peerID   core.PeerID
+	cachedAt time.Time
+}
+
+// peerMetadataKey identifies a peer by both its endpoint and raw peer id,
+// since several peers may share an endpoint, e.g. behind a NAT.
+type peerMetadataKey struct {
+	endpoint  string
+	rawPeerID string
+}
+
+// peerMetadataCache is a bounded LRU cache of peerMetadata. A nil
+// peerMetadataCache disables caching.
+type peerMetadataCache struct {
+	config PeerMetadataCacheConfig
+	clk    clock.Clock
+	stats  tally.Scope
+
+	mu      sync.Mutex
+	entries map[peerMetadataKey]*list.Element
+	lru     *list.List
+}
+
+func newPeerMetadataCache(
+	config PeerMetadataCacheConfig, clk clock.Clock, stats tally.Scope) *peerMetadataCache {
+
+	if config.Disable {
+		return nil
+	}
+	return &peerMetadataCache{
+		config:  config.applyDefaults(),
+		clk:     clk,
+		stats:   stats,
+		entries: make(map[peerMetadataKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// endpointOf returns the cache key of nc. The remote port is excluded since
+// it differs between conns opened by the same remote peer.
+func endpointOf(nc net.Conn) string {
+	addr := nc.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// parsePeerID returns the peer id of raw, received from endpoint. Validation
+// of raw is skipped if the same raw peer id was recently validated for
+// endpoint. Other peers at endpoint do not affect the cached metadata.
+func (c *peerMetadataCache) parsePeerID(endpoint, raw string) (core.PeerID, error) {
+	if c == nil {
+		return core.NewPeerID(raw)
+	}
+	k := peerMetadataKey{endpoint, raw}
+	if p, ok := c.lookup(k); ok {
+		c.stats.Counter("peer_metadata_cache_hits").Inc(1)
+		return p, nil
+	}
+	c.stats.Counter("peer_metadata_cache_misses").Inc(1)
+	p, err := core.NewPeerID(raw)
+	if err != nil {
+		return core.PeerID{}, err
+	}
+	c.add(k, p)
+	return p, nil
+}
+
+// invalidate removes the cached metadata of the peer presenting p at
+// endpoint, e.g. when it does not present the identity it was dialed for.
+func (c *peerMetadataCache) invalidate(endpoint string, p core.PeerID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[peerMetadataKey{endpoint, p.String()}]; ok {
+		c.remove(e)
+		c.stats.Counter("peer_metadata_cache_invalidations").Inc(1)
+	}
+}
+
+func (c *peerMetadataCache) lookup(k peerMetadataKey) (core.PeerID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[k]
+	if !ok {
+		return core.PeerID{}, false
+	}
+	m := e.Value.(*peerMetadata)
+	if c.clk.Now().Sub(m.cachedAt) >= c.config.TTL {
+		c.remove(e)
+		return core.PeerID{}, false
+	}
+	c.lru.MoveToFront(e)
+	return m.peerID, true
+}
+
+func (c *peerMetadataCache) add(k peerMetadataKey, p core.PeerID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	c.entries[k] = c.lru.PushFront(&peerMetadata{k, p, c.clk.Now()})
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *peerMetadataCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*peerMetadata).key)
+}
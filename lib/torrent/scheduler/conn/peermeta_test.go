@@ -0,0 +1,125 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+)
+
+func counter(stats tally.TestScope, name string) int64 {
+	c, ok := stats.Snapshot().Counters()[name+"+"]
+	if !ok {
+		return 0
+	}
+	return c.Value()
+}
+
+func TestPeerMetadataCacheHit(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	c := newPeerMetadataCache(PeerMetadataCacheConfig{}, clock.NewMock(), stats)
+
+	p := core.PeerIDFixture()
+	for i := 0; i < 3; i++ {
+		result, err := c.parsePeerID("10.0.0.1", p.String())
+		require.NoError(err)
+		require.Equal(p, result)
+	}
+	require.Equal(int64(1), counter(stats, "peer_metadata_cache_misses"))
+	require.Equal(int64(2), counter(stats, "peer_metadata_cache_hits"))
+}
+
+func TestPeerMetadataCacheKeysPeersSharingEndpoint(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	c := newPeerMetadataCache(PeerMetadataCacheConfig{}, clock.NewMock(), stats)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	for i := 0; i < 2; i++ {
+		for _, p := range []core.PeerID{p1, p2} {
+			result, err := c.parsePeerID("10.0.0.1", p.String())
+			require.NoError(err)
+			require.Equal(p, result)
+		}
+	}
+	require.Equal(int64(2), counter(stats, "peer_metadata_cache_misses"))
+	require.Equal(int64(2), counter(stats, "peer_metadata_cache_hits"))
+
+	// Invalid peer ids are never cached.
+	_, err := c.parsePeerID("10.0.0.1", "invalid")
+	require.Error(err)
+	_, err = c.parsePeerID("10.0.0.1", "invalid")
+	require.Error(err)
+
+	// Invalidation only affects the given peer.
+	c.invalidate("10.0.0.1", p1)
+	require.Equal(int64(1), counter(stats, "peer_metadata_cache_invalidations"))
+	_, err = c.parsePeerID("10.0.0.1", p2.String())
+	require.NoError(err)
+	require.Equal(int64(3), counter(stats, "peer_metadata_cache_hits"))
+	_, err = c.parsePeerID("10.0.0.1", p1.String())
+	require.NoError(err)
+	require.Equal(int64(5), counter(stats, "peer_metadata_cache_misses"))
+}
+
+func TestPeerMetadataCacheExpiresAndEvicts(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	c := newPeerMetadataCache(
+		PeerMetadataCacheConfig{Size: 2, TTL: time.Minute}, clk, stats)
+
+	p := core.PeerIDFixture()
+
+	_, err := c.parsePeerID("a", p.String())
+	require.NoError(err)
+	clk.Add(time.Minute)
+	_, err = c.parsePeerID("a", p.String())
+	require.NoError(err)
+	require.Equal(int64(2), counter(stats, "peer_metadata_cache_misses"))
+
+	_, err = c.parsePeerID("b", p.String())
+	require.NoError(err)
+	_, err = c.parsePeerID("c", p.String())
+	require.NoError(err)
+	require.Len(c.entries, 2)
+	_, ok := c.entries[peerMetadataKey{"a", p.String()}]
+	require.False(ok)
+}
+
+func TestPeerMetadataCacheDisabled(t *testing.T) {
+	require := require.New(t)
+
+	c := newPeerMetadataCache(
+		PeerMetadataCacheConfig{Disable: true}, clock.NewMock(), tally.NoopScope)
+	require.Nil(c)
+
+	p := core.PeerIDFixture()
+	result, err := c.parsePeerID("a", p.String())
+	require.NoError(err)
+	require.Equal(p, result)
+	c.invalidate("a", p)
+}
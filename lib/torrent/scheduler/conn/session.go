@@ -0,0 +1,206 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+)
+
+// SessionConfig defines resumption of sessions interrupted by transient
+// network failures. Peers exchange session tokens during handshake. A peer
+// which reconnects shortly after its conn was interrupted presents the token of
+// the interrupted conn, such that the new conn resumes the session: it is not
+// blacklisted, and piece requests in flight on the interrupted conn are sent
+// again instead of being reassigned. Sessions are identified by peer and
+// torrent, so the reconnecting peer may use a different address.
+type SessionConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Size is the maximum number of sessions remembered, across all peers and
+	// torrents. The least recently used session is evicted once exceeded.
+	Size int `yaml:"size"`
+
+	// TTL is the duration after an interruption during which a session may be
+	// resumed.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c SessionConfig) applyDefaults() SessionConfig {
+	if c.Size == 0 {
+		c.Size = 4096
+	}
+	if c.TTL == 0 {
+		c.TTL = 30 * time.Second
+	}
+	return c
+}
+
+const _sessionTokenSize = 16
+
+type sessionKey struct {
+	peerID   core.PeerID
+	infoHash core.InfoHash
+}
+
+type sessionEntry struct {
+	key sessionKey
+
+	// local is the token issued to the remote peer, and remote is the token
+	// issued by the remote peer.
+	local  []byte
+	remote []byte
+
+	// interruptedAt is zero while the conn of the session is alive.
+	interruptedAt time.Time
+}
+
+// sessionCache is a bounded LRU cache of the session tokens exchanged with
+// remote peers. A nil sessionCache disables resumption.
+type sessionCache struct {
+	config SessionConfig
+	clk    clock.Clock
+	stats  tally.Scope
+
+	mu      sync.Mutex
+	entries map[sessionKey]*list.Element
+	lru     *list.List
+}
+
+func newSessionCache(config SessionConfig, clk clock.Clock, stats tally.Scope) *sessionCache {
+	if !config.Enable {
+		return nil
+	}
+	return &sessionCache{
+		config:  config.applyDefaults(),
+		clk:     clk,
+		stats:   stats,
+		entries: make(map[sessionKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// issue returns a new session token to send in a handshake, or nil if
+// resumption is disabled.
+func (c *sessionCache) issue() []byte {
+	if c == nil {
+		return nil
+	}
+	token := make([]byte, _sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		// Without a token, the session is simply not resumable.
+		return nil
+	}
+	return token
+}
+
+// resumeToken returns the token issued by peerID for an interrupted session
+// of h, or nil if there is no such session to resume.
+func (c *sessionCache) resumeToken(peerID core.PeerID, h core.InfoHash) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.lookupInterrupted(sessionKey{peerID, h}); e != nil {
+		return e.remote
+	}
+	return nil
+}
+
+// resumes returns true if token, presented by peerID, resumes an interrupted
+// session of h.
+func (c *sessionCache) resumes(peerID core.PeerID, h core.InfoHash, token []byte) bool {
+	if c == nil || len(token) == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookupInterrupted(sessionKey{peerID, h})
+	if e == nil || !bytes.Equal(e.local, token) {
+		c.stats.Counter("session_resume_misses").Inc(1)
+		return false
+	}
+	c.stats.Counter("session_resume_hits").Inc(1)
+	return true
+}
+
+// established records the tokens exchanged with peerID for h, replacing any
+// previous session. Returns false if the remote peer issued no token, in
+// which case the session cannot be resumed.
+func (c *sessionCache) established(peerID core.PeerID, h core.InfoHash, local, remote []byte) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := sessionKey{peerID, h}
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	if len(local) == 0 || len(remote) == 0 {
+		return false
+	}
+	c.entries[k] = c.lru.PushFront(&sessionEntry{key: k, local: local, remote: remote})
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back())
+	}
+	return true
+}
+
+// interrupted marks the session with peerID for h as resumable.
+func (c *sessionCache) interrupted(peerID core.PeerID, h core.InfoHash) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[sessionKey{peerID, h}]; ok {
+		e.Value.(*sessionEntry).interruptedAt = c.clk.Now()
+		c.lru.MoveToFront(e)
+	}
+}
+
+func (c *sessionCache) lookupInterrupted(k sessionKey) *sessionEntry {
+	e, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*sessionEntry)
+	if entry.interruptedAt.IsZero() {
+		return nil
+	}
+	if c.clk.Now().Sub(entry.interruptedAt) >= c.config.TTL {
+		c.remove(e)
+		return nil
+	}
+	return entry
+}
+
+func (c *sessionCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*sessionEntry).key)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+)
+
+func TestSessionCacheResumesInterruptedSessions(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	c := newSessionCache(SessionConfig{Enable: true, TTL: time.Minute}, clk, tally.NoopScope)
+
+	peerID := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	local := c.issue()
+	remote := c.issue()
+	require.Len(local, _sessionTokenSize)
+	require.NotEqual(local, remote)
+
+	require.True(c.established(peerID, h, local, remote))
+
+	// Sessions of live conns cannot be resumed.
+	require.Nil(c.resumeToken(peerID, h))
+	require.False(c.resumes(peerID, h, local))
+
+	c.interrupted(peerID, h)
+	require.Equal(remote, c.resumeToken(peerID, h))
+	require.True(c.resumes(peerID, h, local))
+	require.False(c.resumes(peerID, h, remote))
+	require.False(c.resumes(peerID, h, nil))
+	require.False(c.resumes(core.PeerIDFixture(), h, local))
+
+	clk.Add(time.Minute)
+	require.Nil(c.resumeToken(peerID, h))
+	require.False(c.resumes(peerID, h, local))
+}
+
+func TestSessionCacheIgnoresPeersWithoutTokens(t *testing.T) {
+	require := require.New(t)
+
+	c := newSessionCache(SessionConfig{Enable: true}, clock.NewMock(), tally.NoopScope)
+
+	peerID := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	require.False(c.established(peerID, h, c.issue(), nil))
+	c.interrupted(peerID, h)
+	require.Nil(c.resumeToken(peerID, h))
+}
+
+func TestSessionCacheDisabled(t *testing.T) {
+	require := require.New(t)
+
+	c := newSessionCache(SessionConfig{}, clock.NewMock(), tally.NoopScope)
+	require.Nil(c)
+	require.Nil(c.issue())
+	require.False(c.established(core.PeerIDFixture(), core.InfoHashFixture(), nil, nil))
+	require.False(c.resumes(core.PeerIDFixture(), core.InfoHashFixture(), []byte("token")))
+}
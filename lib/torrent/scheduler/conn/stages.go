@@ -0,0 +1,50 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+// Stages of establishing an outgoing conn, emitted as the "stage" tag of
+// outgoing conn metrics, such that slow conn setup may be attributed to either
+// the network or disk. StageStorageOpen is recorded once per download, when the
+// torrent is opened before any conn is dialed, and includes the metainfo
+// download of torrents which are not on disk yet.
+const (
+	StageStorageOpen      = "storage_open"
+	StageDial             = "dial"
+	StageHandshakeSend    = "handshake_send"
+	StageHandshakeReceive = "handshake_receive"
+)
+
+// RecordOutgoingStage records the latency and outcome of an outgoing conn
+// establishment stage.
+func RecordOutgoingStage(stats tally.Scope, stage string, latency time.Duration, err error) {
+	stats = stats.Tagged(map[string]string{
+		"stage": stage,
+	})
+	stats.Timer("outgoing_conn_stage_latency").Record(latency)
+	if err != nil {
+		stats.Counter("outgoing_conn_stage_failures").Inc(1)
+	} else {
+		stats.Counter("outgoing_conn_stage_successes").Inc(1)
+	}
+}
+
+func (h *Handshaker) recordStage(stage string, start time.Time, err error) {
+	RecordOutgoingStage(h.stats, stage, h.clk.Now().Sub(start), err)
+}
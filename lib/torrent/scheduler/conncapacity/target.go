@@ -0,0 +1,173 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package conncapacity adapts the conn capacity of a torrent to the marginal
+// throughput gained by its most recent conns. Capacity grows while each step
+// of additional conns increases aggregate throughput, and backs off once
+// throughput plateaus, such that slots are not spent on peers which add no
+// bandwidth.
+package conncapacity
+
+import (
+	"time"
+)
+
+// Config defines dynamic conn capacity configuration.
+type Config struct {
+	Enable bool `yaml:"enable"`
+
+	// Interval is the interval in which throughput is sampled and capacity is
+	// adjusted.
+	Interval time.Duration `yaml:"interval"`
+
+	// MinConns is the capacity torrents start with, and the floor capacity
+	// never drops below.
+	MinConns int `yaml:"min_conns"`
+
+	// Step is the number of conns capacity is adjusted by each interval.
+	Step int `yaml:"step"`
+
+	// MinGain is the fractional throughput increase which the most recently
+	// added conns must provide for capacity to keep growing.
+	MinGain float64 `yaml:"min_gain"`
+
+	// PlateauHold is the number of intervals capacity is held for after a
+	// plateau is detected, before probing for more throughput again.
+	PlateauHold int `yaml:"plateau_hold"`
+}
+
+// ApplyDefaults sets default values for unset fields.
+func (c Config) ApplyDefaults() Config {
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Second
+	}
+	if c.MinConns == 0 {
+		c.MinConns = 4
+	}
+	if c.Step == 0 {
+		c.Step = 2
+	}
+	if c.MinGain == 0 {
+		c.MinGain = 0.1
+	}
+	if c.PlateauHold == 0 {
+		c.PlateauHold = 6
+	}
+	return c
+}
+
+// Target tracks the adaptive conn capacity of a single torrent. Target is not
+// thread-safe.
+type Target struct {
+	config Config
+	max    int
+
+	capacity int
+
+	sampled   bool
+	lastBytes int64
+	lastTime  time.Time
+	lastRate  float64
+
+	// grew marks whether capacity was increased after the previous sample,
+	// i.e. whether the current sample measures the gain of the added conns.
+	grew bool
+
+	// hold is the number of remaining intervals to hold capacity for.
+	hold int
+}
+
+// New creates a new Target which never exceeds max conns.
+func New(config Config, max int) *Target {
+	config = config.ApplyDefaults()
+	if config.MinConns > max {
+		config.MinConns = max
+	}
+	return &Target{
+		config:   config,
+		max:      max,
+		capacity: config.MinConns,
+	}
+}
+
+// SetMax changes the conn limit of t, e.g. when config is reloaded. Capacity
+// above the new limit is released immediately.
+func (t *Target) SetMax(max int) {
+	t.max = max
+	if t.config.MinConns > max {
+		t.config.MinConns = max
+	}
+	if t.capacity > max {
+		t.capacity = max
+	}
+}
+
+// Capacity returns the current capacity.
+func (t *Target) Capacity() int {
+	return t.capacity
+}
+
+// Update samples the total bytes downloaded by the torrent at now, and
+// returns the adjusted capacity. saturated indicates whether all capacity is
+// in use by active conns, since capacity which is not in use says nothing
+// about the marginal throughput of conns.
+func (t *Target) Update(bytes int64, now time.Time, saturated bool) int {
+	if !t.sampled {
+		t.sampled = true
+		t.lastBytes, t.lastTime = bytes, now
+		return t.capacity
+	}
+	elapsed := now.Sub(t.lastTime)
+	if elapsed <= 0 {
+		return t.capacity
+	}
+	rate := float64(bytes-t.lastBytes) / elapsed.Seconds()
+	t.lastBytes, t.lastTime = bytes, now
+	defer func() { t.lastRate = rate }()
+
+	grew := t.grew
+	t.grew = false
+
+	if t.hold > 0 {
+		t.hold--
+		return t.capacity
+	}
+	if !saturated {
+		return t.capacity
+	}
+	if grew && rate < t.lastRate*(1+t.config.MinGain) {
+		// The most recently added conns did not pay for themselves.
+		t.capacity = max(t.capacity-t.config.Step, t.config.MinConns)
+		t.hold = t.config.PlateauHold
+		return t.capacity
+	}
+	if t.capacity < t.max {
+		t.capacity = min(t.capacity+t.config.Step, t.max)
+		t.grew = true
+	}
+	return t.capacity
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
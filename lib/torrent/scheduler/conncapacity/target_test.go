@@ -0,0 +1,113 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conncapacity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _mb = 1 << 20
+
+// sampler drives a Target with a fixed interval.
+type sampler struct {
+	target *Target
+	now    time.Time
+	bytes  int64
+}
+
+func newSampler(config Config, max int) *sampler {
+	s := &sampler{target: New(config, max), now: time.Now()}
+	s.target.Update(0, s.now, true)
+	return s
+}
+
+// next downloads at rate bytes/sec for one interval and returns the capacity.
+func (s *sampler) next(rate int64, saturated bool) int {
+	s.now = s.now.Add(time.Second)
+	s.bytes += rate
+	return s.target.Update(s.bytes, s.now, saturated)
+}
+
+func TestTargetGrowsWhileThroughputIncreases(t *testing.T) {
+	require := require.New(t)
+
+	s := newSampler(Config{MinConns: 2, Step: 2, MinGain: 0.1}, 8)
+	require.Equal(2, s.target.Capacity())
+
+	require.Equal(4, s.next(10*_mb, true))
+	require.Equal(6, s.next(20*_mb, true))
+	require.Equal(8, s.next(30*_mb, true))
+
+	// Capped at max.
+	require.Equal(8, s.next(40*_mb, true))
+	require.Equal(8, s.next(40*_mb, true))
+}
+
+func TestTargetBacksOffOnPlateau(t *testing.T) {
+	require := require.New(t)
+
+	s := newSampler(Config{MinConns: 2, Step: 2, MinGain: 0.1, PlateauHold: 2}, 20)
+
+	require.Equal(4, s.next(10*_mb, true))
+	require.Equal(6, s.next(20*_mb, true))
+
+	// The latest conns add less than 10% throughput.
+	require.Equal(4, s.next(21*_mb, true))
+
+	// Capacity is held before probing again.
+	require.Equal(4, s.next(21*_mb, true))
+	require.Equal(4, s.next(21*_mb, true))
+	require.Equal(6, s.next(21*_mb, true))
+}
+
+func TestTargetHoldsWhenNotSaturated(t *testing.T) {
+	require := require.New(t)
+
+	s := newSampler(Config{MinConns: 2, Step: 2}, 20)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(2, s.next(int64(i)*_mb, false))
+	}
+}
+
+func TestTargetNeverDropsBelowMinConns(t *testing.T) {
+	require := require.New(t)
+
+	s := newSampler(Config{MinConns: 4, Step: 4, MinGain: 0.5}, 20)
+
+	require.Equal(8, s.next(10*_mb, true))
+	require.Equal(4, s.next(10*_mb, true))
+}
+
+func TestTargetSetMax(t *testing.T) {
+	require := require.New(t)
+
+	s := newSampler(Config{MinConns: 4, Step: 2, MinGain: 0.1}, 10)
+
+	// Lowering max releases capacity immediately.
+	s.target.SetMax(3)
+	require.Equal(3, s.target.Capacity())
+
+	s.target.SetMax(6)
+	require.Equal(5, s.next(10*_mb, true))
+	require.Equal(6, s.next(20*_mb, true))
+	require.Equal(6, s.next(30*_mb, true))
+}
+
+func TestTargetMinConnsCappedAtMax(t *testing.T) {
+	require.Equal(t, 3, New(Config{MinConns: 10}, 3).Capacity())
+}
@@ -26,12 +26,81 @@ type Config struct {
 	// can have and still connect with us.
 	MaxMutualConnections int `yaml:"max_mutual_conn"`
 
+	// MaxConnectionsPerIP is the maximum number of connections per torrent to
+	// peers sharing the same IP, e.g. multiple agents on one host or peers
+	// behind a NAT. Capping it keeps sources diverse, such that losing a single
+	// host does not drop most of a torrent's connections.
+	MaxConnectionsPerIP int `yaml:"max_conn_per_ip"`
+
 	// DisableBlacklist disables the blacklisting of peers. Should only be used
 	// for testing purposes.
 	DisableBlacklist bool `yaml:"disable_blacklist"`
 
-	// BlacklistDuration is the duration a connection will remain blacklisted.
+	// BlacklistDuration is the duration a connection will remain blacklisted
+	// after its first failure. Used as the default InitialDuration of the
+	// blacklist policies.
 	BlacklistDuration time.Duration `yaml:"blacklist_duration"`
+
+	// Trusted whitelists peers which are always admitted.
+	Trusted TrustedConfig `yaml:"trusted"`
+
+	// HandshakeBlacklist is the blacklist policy of connections which failed
+	// to handshake.
+	HandshakeBlacklist BlacklistPolicy `yaml:"handshake_blacklist"`
+
+	// TransferBlacklist is the blacklist policy of established connections
+	// which were dropped mid-transfer.
+	TransferBlacklist BlacklistPolicy `yaml:"transfer_blacklist"`
+
+	// MaxInterruptions is the number of times a connection may be interrupted
+	// and resumed without being blacklisted. Interruptions beyond the limit
+	// are blacklisted as transfer failures. Interruptions are forgotten once
+	// a connection is not interrupted for TransferBlacklist.ResetAfter.
+	MaxInterruptions int `yaml:"max_interruptions"`
+}
+
+// BlacklistPolicy defines how long a connection is blacklisted for. The first
+// failure blacklists the connection for InitialDuration, and each repeated
+// failure multiplies the previous duration by Multiplier, up to MaxDuration.
+// Failures are forgotten once a connection stays out of the blacklist for
+// ResetAfter.
+type BlacklistPolicy struct {
+	InitialDuration time.Duration `yaml:"initial_duration"`
+	Multiplier      float64       `yaml:"multiplier"`
+	MaxDuration     time.Duration `yaml:"max_duration"`
+	ResetAfter      time.Duration `yaml:"reset_after"`
+}
+
+func (p BlacklistPolicy) applyDefaults(initial time.Duration) BlacklistPolicy {
+	if p.InitialDuration == 0 {
+		p.InitialDuration = initial
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if p.MaxDuration == 0 {
+		p.MaxDuration = 5 * time.Minute
+	}
+	if p.MaxDuration < p.InitialDuration {
+		p.MaxDuration = p.InitialDuration
+	}
+	if p.ResetAfter == 0 {
+		p.ResetAfter = 10 * time.Minute
+	}
+	return p
+}
+
+// duration returns the blacklist duration of the nth consecutive failure,
+// starting at 1.
+func (p BlacklistPolicy) duration(n int) time.Duration {
+	d := float64(p.InitialDuration)
+	for i := 1; i < n && d < float64(p.MaxDuration); i++ {
+		d *= p.Multiplier
+	}
+	if d > float64(p.MaxDuration) {
+		return p.MaxDuration
+	}
+	return time.Duration(d)
 }
 
 func (c Config) applyDefaults() Config {
@@ -42,8 +111,18 @@ func (c Config) applyDefaults() Config {
 	if c.MaxMutualConnections == 0 {
 		c.MaxMutualConnections = c.MaxOpenConnectionsPerTorrent
 	}
+	// Defaults to no per-IP connection limit.
+	if c.MaxConnectionsPerIP == 0 {
+		c.MaxConnectionsPerIP = c.MaxOpenConnectionsPerTorrent
+	}
 	if c.BlacklistDuration == 0 {
 		c.BlacklistDuration = 30 * time.Second
 	}
+	if c.MaxInterruptions == 0 {
+		c.MaxInterruptions = 3
+	}
+	c.Trusted = c.Trusted.applyDefaults()
+	c.HandshakeBlacklist = c.HandshakeBlacklist.applyDefaults(c.BlacklistDuration)
+	c.TransferBlacklist = c.TransferBlacklist.applyDefaults(c.BlacklistDuration)
 	return c
 }
@@ -15,6 +15,8 @@ package connstate
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/andres-erbsen/clock"
@@ -32,6 +34,7 @@ var (
 	ErrConnClosed              = errors.New("conn is closed")
 	ErrInvalidActiveTransition = errors.New("conn must be pending to transition to active")
 	ErrTooManyMutualConns      = errors.New("conn has too many mutual connections")
+	ErrTooManyConnsFromIP      = errors.New("too many conns to peers sharing the same ip")
 
 	// This should NEVER happen.
 	errUnknownStatus = errors.New("invariant violation: unknown status")
@@ -50,6 +53,13 @@ const (
 type entry struct {
 	status status
 	conn   *conn.Conn
+
+	// ip is the address of the peer, if known. Empty ips are never counted
+	// towards MaxConnectionsPerIP.
+	ip string
+
+	// trusted marks conns to trusted peers, which may occupy reserved slots.
+	trusted bool
 }
 
 type connKey struct {
@@ -57,8 +67,53 @@ type connKey struct {
 	peerID core.PeerID
 }
 
+// Failure classifies why a connection is blacklisted.
+type Failure int
+
+const (
+	// HandshakeFailure indicates the connection failed to handshake.
+	HandshakeFailure Failure = iota
+
+	// TransferFailure indicates an established connection was dropped.
+	TransferFailure
+)
+
+func (f Failure) String() string {
+	switch f {
+	case HandshakeFailure:
+		return "handshake"
+	case TransferFailure:
+		return "transfer"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes f as its name.
+func (f Failure) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText decodes f from its name.
+func (f *Failure) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "handshake":
+		*f = HandshakeFailure
+	case "transfer":
+		*f = TransferFailure
+	default:
+		return fmt.Errorf("unknown failure: %q", b)
+	}
+	return nil
+}
+
 type blacklistEntry struct {
 	expiration time.Time
+
+	// Consecutive failures of the connection, used to escalate the duration
+	// of each blacklisting.
+	failures int
+	failure  Failure
 }
 
 func (e *blacklistEntry) Blacklisted(now time.Time) bool {
@@ -78,6 +133,9 @@ func (e *blacklistEntry) Remaining(now time.Time) time.Duration {
 // should be skipped in each peer handout.
 //
 // Note, State is NOT thread-safe. Synchronization must be provided by the client.
+// The scheduler confines State to its event loop, so State has no internal
+// locks to contend on; contention instead surfaces as event loop backlog, which
+// is reported by the scheduler as EventLoopDepth in its stats.
 type State struct {
 	config      Config
 	clk         clock.Clock
@@ -90,6 +148,22 @@ type State struct {
 
 	// All blacklisted conns. These do not count towards conn capacity.
 	blacklist map[connKey]*blacklistEntry
+
+	// Recent interruptions of conns which were resumable.
+	interruptions map[connKey]*interruptionEntry
+
+	trust *trustList
+
+	// Peers trusted by ip, which is only known while they have a conn, such
+	// that they remain trusted when their conns fail. Maps to the expiration
+	// of the trust, which is revoked if the peer id is seen from another ip.
+	trustedByIP map[core.PeerID]time.Time
+
+	// Capacity granted to torrents on top of MaxOpenConnectionsPerTorrent.
+	extraCapacity map[core.InfoHash]int
+
+	// Capacity of torrents which are limited below MaxOpenConnectionsPerTorrent.
+	targetCapacity map[core.InfoHash]int
 }
 
 // New creates a new State.
@@ -102,17 +176,78 @@ func New(
 
 	config = config.applyDefaults()
 
+	trust, err := newTrustList(config.Trusted)
+	if err != nil {
+		logger.Errorf("Ignoring invalid trusted peers: %s", err)
+		trust, _ = newTrustList(TrustedConfig{})
+	}
+
 	return &State{
-		config:      config,
-		clk:         clk,
-		netevents:   netevents,
-		localPeerID: localPeerID,
-		logger:      logger,
-		conns:       make(map[core.InfoHash]map[core.PeerID]entry),
-		blacklist:   make(map[connKey]*blacklistEntry),
+		config:        config,
+		clk:           clk,
+		netevents:     netevents,
+		localPeerID:   localPeerID,
+		logger:        logger,
+		conns:         make(map[core.InfoHash]map[core.PeerID]entry),
+		blacklist:     make(map[connKey]*blacklistEntry),
+		interruptions: make(map[connKey]*interruptionEntry),
+		trust:         trust,
+		trustedByIP:   make(map[core.PeerID]time.Time),
+
+		extraCapacity:  make(map[core.InfoHash]int),
+		targetCapacity: make(map[core.InfoHash]int),
+	}
+}
+
+// SetConfig replaces the config of s. Conns exceeding new limits are not
+// closed, but no conns are added until they are back under the limits. config
+// must be valid per Config.Validate.
+func (s *State) SetConfig(config Config) {
+	s.config = config.applyDefaults()
+	if trust, err := newTrustList(s.config.Trusted); err == nil {
+		s.trust = trust
+		s.trustedByIP = make(map[core.PeerID]time.Time)
 	}
 }
 
+// Trusted returns true if peerID is a trusted peer, either by peer id, or
+// because its last conn was from a trusted ip within Trusted.IPTrustTTL.
+func (s *State) Trusted(peerID core.PeerID) bool {
+	if s.trust.trusts(peerID, "") {
+		return true
+	}
+	expiration, ok := s.trustedByIP[peerID]
+	if ok && !s.clk.Now().Before(expiration) {
+		delete(s.trustedByIP, peerID)
+		return false
+	}
+	return ok
+}
+
+// observeIP records the ip of a conn of peerID, and returns whether the peer
+// is trusted at ip.
+func (s *State) observeIP(peerID core.PeerID, ip string) bool {
+	now := s.clk.Now()
+	for p, expiration := range s.trustedByIP {
+		if !now.Before(expiration) {
+			delete(s.trustedByIP, p)
+		}
+	}
+	if s.trust.trusts(peerID, "") {
+		return true
+	}
+	if ip == "" {
+		return false
+	}
+	if !s.trust.trusts(peerID, ip) {
+		// Trust by ip does not follow the peer id to other ips.
+		delete(s.trustedByIP, peerID)
+		return false
+	}
+	s.trustedByIP[peerID] = now.Add(s.config.Trusted.IPTrustTTL)
+	return true
+}
+
 // ActiveConns returns a list of all active connections.
 func (s *State) ActiveConns() []*conn.Conn {
 	var active []*conn.Conn
@@ -126,6 +261,20 @@ func (s *State) ActiveConns() []*conn.Conn {
 	return active
 }
 
+// NumConns returns the number of pending and active connections.
+func (s *State) NumConns() (pending, active int) {
+	for _, peers := range s.conns {
+		for _, e := range peers {
+			if e.status == _active {
+				active++
+			} else {
+				pending++
+			}
+		}
+	}
+	return pending, active
+}
+
 // Saturated returns true if h is at capacity and all the conns are active.
 func (s *State) Saturated(h core.InfoHash) bool {
 	peers, ok := s.conns[h]
@@ -138,57 +287,177 @@ func (s *State) Saturated(h core.InfoHash) bool {
 			active++
 		}
 	}
-	return active == s.config.MaxOpenConnectionsPerTorrent
+	return active >= s.limit(h)
+}
+
+// SetExtraCapacity allows h to open n conns beyond MaxOpenConnectionsPerTorrent,
+// e.g. for torrents which are at risk of missing a deadline. Setting n to zero
+// restores the default capacity.
+func (s *State) SetExtraCapacity(h core.InfoHash, n int) {
+	if n <= 0 {
+		delete(s.extraCapacity, h)
+		return
+	}
+	s.extraCapacity[h] = n
+}
+
+// SetTargetCapacity limits h to n conns, e.g. when additional conns are not
+// expected to increase throughput. n is capped at MaxOpenConnectionsPerTorrent,
+// and extra capacity is granted on top of n. Existing conns beyond n are not
+// closed. Setting n to zero restores the default capacity.
+func (s *State) SetTargetCapacity(h core.InfoHash, n int) {
+	if n <= 0 {
+		delete(s.targetCapacity, h)
+		return
+	}
+	s.targetCapacity[h] = n
 }
 
-// Blacklist blacklists peerID/h for the configured BlacklistDuration.
+// Blacklist blacklists peerID/h for a duration determined by the blacklist
+// policy of f, which escalates with each repeated failure of the connection.
 // Returns error if the connection is already blacklisted.
-func (s *State) Blacklist(peerID core.PeerID, h core.InfoHash) error {
+func (s *State) Blacklist(peerID core.PeerID, h core.InfoHash, f Failure) error {
 	if s.config.DisableBlacklist {
 		return nil
 	}
+	if s.Trusted(peerID) {
+		s.log("peer", peerID, "hash", h).Infof("Not blacklisting trusted peer after %s failure", f)
+		return nil
+	}
+
+	now := s.clk.Now()
+	policy := s.policy(f)
 
 	k := connKey{h, peerID}
-	if e, ok := s.blacklist[k]; ok && e.Blacklisted(s.clk.Now()) {
+	e, ok := s.blacklist[k]
+	if ok && e.Blacklisted(now) {
 		return errors.New("conn is already blacklisted")
 	}
-	s.blacklist[k] = &blacklistEntry{s.clk.Now().Add(s.config.BlacklistDuration)}
+	if !ok || e.failure != f || now.Sub(e.expiration) >= policy.ResetAfter {
+		e = &blacklistEntry{failure: f}
+		s.blacklist[k] = e
+	}
+	e.failures++
+	d := policy.duration(e.failures)
+	e.expiration = now.Add(d)
 
 	s.log("peer", peerID, "hash", h).Infof(
-		"Connection blacklisted for %s", s.config.BlacklistDuration)
+		"Connection blacklisted for %s after %d %s failure(s)", d, e.failures, f)
 	s.netevents.Produce(
-		networkevent.BlacklistConnEvent(h, s.localPeerID, peerID, s.config.BlacklistDuration))
+		networkevent.BlacklistConnEvent(h, s.localPeerID, peerID, d))
 
 	return nil
 }
 
-// Blacklisted returns true if peerID/h is blacklisted.
+// RestoreBlacklist blacklists c.PeerID/c.InfoHash for c.Remaining, e.g. to
+// restore a blacklist entry persisted across restarts. Further failures of the
+// connection escalate from c.Failures.
+func (s *State) RestoreBlacklist(c BlacklistedConn) {
+	if s.config.DisableBlacklist || s.Trusted(c.PeerID) || c.Remaining <= 0 {
+		return
+	}
+	s.blacklist[connKey{c.InfoHash, c.PeerID}] = &blacklistEntry{
+		expiration: s.clk.Now().Add(c.Remaining),
+		failures:   c.Failures,
+		failure:    c.Failure,
+	}
+}
+
+func (s *State) policy(f Failure) BlacklistPolicy {
+	if f == TransferFailure {
+		return s.config.TransferBlacklist
+	}
+	return s.config.HandshakeBlacklist
+}
+
+// Blacklisted returns true if peerID/h is blacklisted. Trusted peers are never
+// blacklisted.
 func (s *State) Blacklisted(peerID core.PeerID, h core.InfoHash) bool {
+	if s.Trusted(peerID) {
+		return false
+	}
 	e, ok := s.blacklist[connKey{h, peerID}]
 	return ok && e.Blacklisted(s.clk.Now())
 }
 
-// ClearBlacklist un-blacklists all connections for h.
+// ClearBlacklist un-blacklists all connections for h, and forgets their
+// interruptions.
 func (s *State) ClearBlacklist(h core.InfoHash) {
 	for k := range s.blacklist {
 		if k.hash == h {
 			delete(s.blacklist, k)
 		}
 	}
+	for k := range s.interruptions {
+		if k.hash == h {
+			delete(s.interruptions, k)
+		}
+	}
+}
+
+type interruptionEntry struct {
+	count int
+	last  time.Time
+}
+
+// Interrupted records an interruption of the conn of peerID/h. Returns true if
+// the peer may resume its session, or false once the conn was interrupted more
+// than MaxInterruptions times, in which case the conn should be blacklisted.
+func (s *State) Interrupted(peerID core.PeerID, h core.InfoHash) bool {
+	now := s.clk.Now()
+	resetAfter := s.config.TransferBlacklist.ResetAfter
+	for k, e := range s.interruptions {
+		if now.Sub(e.last) >= resetAfter {
+			delete(s.interruptions, k)
+		}
+	}
+	k := connKey{h, peerID}
+	e, ok := s.interruptions[k]
+	if !ok {
+		e = &interruptionEntry{}
+		s.interruptions[k] = e
+	}
+	e.count++
+	e.last = now
+	if e.count > s.config.MaxInterruptions {
+		delete(s.interruptions, k)
+		return false
+	}
+	return true
 }
 
 // AddPending sets the connection for peerID/h as pending and reserves capacity
 // for it.
 func (s *State) AddPending(peerID core.PeerID, h core.InfoHash, neighbors []core.PeerID) error {
-	if len(s.conns[h]) == s.config.MaxOpenConnectionsPerTorrent {
+	return s.AddPendingFromIP(peerID, h, "", neighbors)
+}
+
+// AddPendingFromIP is like AddPending, but also enforces MaxConnectionsPerIP
+// against other connections of h to peers with the same ip. Distinct peer ids
+// may share an ip if multiple agents run on the same host or behind a NAT.
+//
+// Trusted peers are exempt from the mutual and per-ip limits, and may
+// additionally occupy the conn slots reserved for trusted peers.
+func (s *State) AddPendingFromIP(
+	peerID core.PeerID, h core.InfoHash, ip string, neighbors []core.PeerID) error {
+
+	trusted := s.observeIP(peerID, ip)
+	limit := s.limit(h)
+	if trusted && s.numTrustedConns(h) < s.config.Trusted.ReservedConns {
+		limit++
+	}
+	if len(s.conns[h]) >= limit {
 		return ErrTorrentAtCapacity
 	}
 	switch s.get(h, peerID).status {
 	case _uninit:
-		if s.numMutualConns(h, neighbors) > s.config.MaxMutualConnections {
+		if !trusted && s.numMutualConns(h, neighbors) > s.config.MaxMutualConnections {
 			return ErrTooManyMutualConns
 		}
-		s.put(h, peerID, entry{status: _pending})
+		if !trusted && ip != "" && s.numConnsFromIP(h, ip) >= s.config.MaxConnectionsPerIP {
+			return ErrTooManyConnsFromIP
+		}
+		s.put(h, peerID, entry{status: _pending, ip: ip, trusted: trusted})
 		s.log("hash", h, "peer", peerID).Infof(
 			"Added pending conn, capacity now at %d", s.capacity(h))
 		return nil
@@ -216,10 +485,11 @@ func (s *State) MovePendingToActive(c *conn.Conn) error {
 	if c.IsClosed() {
 		return ErrConnClosed
 	}
-	if s.get(c.InfoHash(), c.PeerID()).status != _pending {
+	e := s.get(c.InfoHash(), c.PeerID())
+	if e.status != _pending {
 		return ErrInvalidActiveTransition
 	}
-	s.put(c.InfoHash(), c.PeerID(), entry{status: _active, conn: c})
+	s.put(c.InfoHash(), c.PeerID(), entry{status: _active, conn: c, ip: e.ip, trusted: e.trusted})
 
 	s.log("hash", c.InfoHash(), "peer", c.PeerID()).Info("Moved conn from pending to active")
 	s.netevents.Produce(networkevent.AddActiveConnEvent(c.InfoHash(), s.localPeerID, c.PeerID()))
@@ -243,7 +513,7 @@ func (s *State) DeleteActive(c *conn.Conn) {
 	s.log("hash", c.InfoHash(), "peer", c.PeerID()).Infof(
 		"Deleted active conn, capacity now at %d", s.capacity(c.InfoHash()))
 	s.netevents.Produce(networkevent.DropActiveConnEvent(
-		c.InfoHash(), s.localPeerID, c.PeerID()))
+		c.InfoHash(), s.localPeerID, c.PeerID(), c.BytesSent(), c.BytesReceived()))
 }
 
 func (s *State) numMutualConns(h core.InfoHash, neighbors []core.PeerID) int {
@@ -257,11 +527,23 @@ func (s *State) numMutualConns(h core.InfoHash, neighbors []core.PeerID) int {
 	return n
 }
 
+func (s *State) numConnsFromIP(h core.InfoHash, ip string) int {
+	var n int
+	for _, e := range s.conns[h] {
+		if e.ip == ip {
+			n++
+		}
+	}
+	return n
+}
+
 // BlacklistedConn represents a connection which has been blacklisted.
 type BlacklistedConn struct {
 	PeerID    core.PeerID   `json:"peer_id"`
 	InfoHash  core.InfoHash `json:"info_hash"`
 	Remaining time.Duration `json:"remaining"`
+	Failures  int           `json:"failures"`
+	Failure   Failure       `json:"failure"`
 }
 
 // BlacklistSnapshot returns a snapshot of all valid blacklist entries.
@@ -272,12 +554,72 @@ func (s *State) BlacklistSnapshot() []BlacklistedConn {
 			PeerID:    k.peerID,
 			InfoHash:  k.hash,
 			Remaining: e.Remaining(s.clk.Now()),
+			Failures:  e.failures,
+			Failure:   e.failure,
 		}
 		conns = append(conns, c)
 	}
 	return conns
 }
 
+// ConnInfo describes a pending or active connection.
+type ConnInfo struct {
+	PeerID   core.PeerID   `json:"peer_id"`
+	InfoHash core.InfoHash `json:"info_hash"`
+	Active   bool          `json:"active"`
+	IP       string        `json:"ip,omitempty"`
+	Trusted  bool          `json:"trusted"`
+
+	// Only set for active conns.
+	CreatedAt     time.Time `json:"created_at"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+}
+
+// ConnSnapshot returns a snapshot of all pending and active connections.
+func (s *State) ConnSnapshot() []ConnInfo {
+	var conns []ConnInfo
+	for h, peers := range s.conns {
+		for peerID, e := range peers {
+			c := ConnInfo{
+				PeerID:   peerID,
+				InfoHash: h,
+				Active:   e.status == _active,
+				IP:       e.ip,
+				Trusted:  e.trusted,
+			}
+			if e.status == _active {
+				c.CreatedAt = e.conn.CreatedAt()
+				c.BytesSent = e.conn.BytesSent()
+				c.BytesReceived = e.conn.BytesReceived()
+			}
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// Retained describes the conns and capacity which s still holds for h, e.g. to
+// verify that they were released once the torrent of h was removed.
+func (s *State) Retained(h core.InfoHash) (conns []string, capacity []string) {
+	for peerID, e := range s.conns[h] {
+		switch e.status {
+		case _pending:
+			conns = append(conns, fmt.Sprintf("pending conn to %s", peerID))
+		case _active:
+			conns = append(conns, fmt.Sprintf("active conn to %s", peerID))
+		}
+	}
+	sort.Strings(conns)
+	if n, ok := s.extraCapacity[h]; ok {
+		capacity = append(capacity, fmt.Sprintf("extra capacity of %d conns", n))
+	}
+	if n, ok := s.targetCapacity[h]; ok {
+		capacity = append(capacity, fmt.Sprintf("target capacity of %d conns", n))
+	}
+	return conns, capacity
+}
+
 func (s *State) get(h core.InfoHash, peerID core.PeerID) entry {
 	peers, ok := s.conns[h]
 	if !ok {
@@ -306,8 +648,36 @@ func (s *State) delete(h core.InfoHash, peerID core.PeerID) {
 	}
 }
 
+func (s *State) maxConns(h core.InfoHash) int {
+	n := s.config.MaxOpenConnectionsPerTorrent
+	if t, ok := s.targetCapacity[h]; ok && t < n {
+		n = t
+	}
+	return n + s.extraCapacity[h]
+}
+
+// limit returns the number of conns h may have, including the reserved slots
+// occupied by trusted conns.
+func (s *State) limit(h core.InfoHash) int {
+	reserved := s.numTrustedConns(h)
+	if reserved > s.config.Trusted.ReservedConns {
+		reserved = s.config.Trusted.ReservedConns
+	}
+	return s.maxConns(h) + reserved
+}
+
+func (s *State) numTrustedConns(h core.InfoHash) int {
+	var n int
+	for _, e := range s.conns[h] {
+		if e.trusted {
+			n++
+		}
+	}
+	return n
+}
+
 func (s *State) capacity(h core.InfoHash) int {
-	return s.config.MaxOpenConnectionsPerTorrent - len(s.conns[h])
+	return s.limit(h) - len(s.conns[h])
 }
 
 func (s *State) log(args ...interface{}) *zap.SugaredLogger {
@@ -14,6 +14,7 @@
 package connstate
 
 import (
+	"sort"
 	"testing"
 	"time"
 
@@ -43,14 +44,66 @@ func TestStateBlacklist(t *testing.T) {
 	p := core.PeerIDFixture()
 	h := core.InfoHashFixture()
 
-	require.NoError(s.Blacklist(p, h))
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
 	require.True(s.Blacklisted(p, h))
-	require.Error(s.Blacklist(p, h))
+	require.Error(s.Blacklist(p, h, HandshakeFailure))
 
 	clk.Add(config.BlacklistDuration + 1)
 
 	require.False(s.Blacklisted(p, h))
-	require.NoError(s.Blacklist(p, h))
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+}
+
+func TestStateBlacklistEscalatesRepeatedFailures(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		HandshakeBlacklist: BlacklistPolicy{
+			InitialDuration: 10 * time.Second,
+			Multiplier:      3,
+			MaxDuration:     time.Minute,
+			ResetAfter:      5 * time.Minute,
+		},
+		TransferBlacklist: BlacklistPolicy{
+			InitialDuration: time.Second,
+		},
+	}
+	clk := clock.NewMock()
+	s := testState(config, clk)
+
+	p := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	remaining := func() time.Duration {
+		snapshot := s.BlacklistSnapshot()
+		require.Len(snapshot, 1)
+		return snapshot[0].Remaining
+	}
+
+	for _, d := range []time.Duration{10 * time.Second, 30 * time.Second, time.Minute, time.Minute} {
+		require.NoError(s.Blacklist(p, h, HandshakeFailure))
+		require.Equal(d, remaining())
+		clk.Add(d)
+		require.False(s.Blacklisted(p, h))
+	}
+
+	// Failures of a different kind follow their own policy.
+	require.NoError(s.Blacklist(p, h, TransferFailure))
+	require.Equal(time.Second, remaining())
+	clk.Add(time.Second)
+
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+	require.Equal(10*time.Second, remaining())
+	clk.Add(10 * time.Second)
+
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+	require.Equal(30*time.Second, remaining())
+
+	// Failures are forgotten once the conn stays out of the blacklist for
+	// ResetAfter.
+	clk.Add(30*time.Second + 5*time.Minute)
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+	require.Equal(10*time.Second, remaining())
 }
 
 func TestStateBlacklistSnapshot(t *testing.T) {
@@ -65,12 +118,67 @@ func TestStateBlacklistSnapshot(t *testing.T) {
 	p := core.PeerIDFixture()
 	h := core.InfoHashFixture()
 
-	require.NoError(s.Blacklist(p, h))
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
 
-	expected := []BlacklistedConn{{p, h, config.BlacklistDuration}}
+	expected := []BlacklistedConn{{p, h, config.BlacklistDuration, 1, HandshakeFailure}}
 	require.Equal(expected, s.BlacklistSnapshot())
 }
 
+func TestStateRestoreBlacklist(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		BlacklistDuration: 30 * time.Second,
+	}
+	clk := clock.NewMock()
+	s := testState(config, clk)
+
+	c := BlacklistedConn{
+		PeerID:    core.PeerIDFixture(),
+		InfoHash:  core.InfoHashFixture(),
+		Remaining: 10 * time.Second,
+		Failures:  2,
+		Failure:   TransferFailure,
+	}
+	s.RestoreBlacklist(c)
+	require.Equal([]BlacklistedConn{c}, s.BlacklistSnapshot())
+
+	clk.Add(10 * time.Second)
+	require.False(s.Blacklisted(c.PeerID, c.InfoHash))
+
+	// Expired entries are not restored.
+	expired := BlacklistedConn{PeerID: core.PeerIDFixture(), InfoHash: core.InfoHashFixture()}
+	s.RestoreBlacklist(expired)
+	require.False(s.Blacklisted(expired.PeerID, expired.InfoHash))
+}
+
+func TestStateConnSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	s := testState(Config{}, clock.New())
+
+	c, cleanup := conn.Fixture()
+	defer cleanup()
+
+	p := core.PeerIDFixture()
+	require.NoError(s.AddPendingFromIP(p, c.InfoHash(), "10.0.0.1", nil))
+	require.NoError(s.AddPending(c.PeerID(), c.InfoHash(), nil))
+	require.NoError(s.MovePendingToActive(c))
+
+	conns := s.ConnSnapshot()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Active && !conns[j].Active })
+	require.Equal([]ConnInfo{{
+		PeerID:    c.PeerID(),
+		InfoHash:  c.InfoHash(),
+		Active:    true,
+		CreatedAt: c.CreatedAt(),
+	}, {
+		PeerID:   p,
+		InfoHash: c.InfoHash(),
+		IP:       "10.0.0.1",
+	}}, conns)
+}
+
 func TestStateClearBlacklist(t *testing.T) {
 	require := require.New(t)
 
@@ -82,7 +190,7 @@ func TestStateClearBlacklist(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		p := core.PeerIDFixture()
 		peers = append(peers, p)
-		require.NoError(s.Blacklist(p, h))
+		require.NoError(s.Blacklist(p, h, HandshakeFailure))
 		require.True(s.Blacklisted(p, h))
 	}
 
@@ -122,6 +230,98 @@ func TestStateAddPendingReservesCapacity(t *testing.T) {
 	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
 }
 
+func TestStateSetExtraCapacity(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		MaxOpenConnectionsPerTorrent: 2,
+	}
+	s := testState(config, clock.New())
+
+	h := core.InfoHashFixture()
+
+	s.SetExtraCapacity(h, 1)
+	for i := 0; i < 3; i++ {
+		require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	}
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+
+	// Other torrents are unaffected.
+	other := core.InfoHashFixture()
+	for i := 0; i < 2; i++ {
+		require.NoError(s.AddPending(core.PeerIDFixture(), other, nil))
+	}
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), other, nil))
+
+	s.SetExtraCapacity(h, 0)
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+}
+
+func TestStateRetained(t *testing.T) {
+	require := require.New(t)
+
+	s := testState(Config{}, clock.New())
+
+	h := core.InfoHashFixture()
+	p := core.PeerIDFixture()
+
+	conns, capacity := s.Retained(h)
+	require.Empty(conns)
+	require.Empty(capacity)
+
+	require.NoError(s.AddPending(p, h, nil))
+	s.SetExtraCapacity(h, 1)
+	s.SetTargetCapacity(h, 2)
+
+	conns, capacity = s.Retained(h)
+	require.Equal([]string{"pending conn to " + p.String()}, conns)
+	require.Equal([]string{"extra capacity of 1 conns", "target capacity of 2 conns"}, capacity)
+
+	// Other torrents retain nothing.
+	conns, capacity = s.Retained(core.InfoHashFixture())
+	require.Empty(conns)
+	require.Empty(capacity)
+
+	s.DeletePending(p, h)
+	s.SetExtraCapacity(h, 0)
+	s.SetTargetCapacity(h, 0)
+
+	conns, capacity = s.Retained(h)
+	require.Empty(conns)
+	require.Empty(capacity)
+}
+
+func TestStateSetTargetCapacity(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		MaxOpenConnectionsPerTorrent: 4,
+	}
+	s := testState(config, clock.New())
+
+	h := core.InfoHashFixture()
+
+	s.SetTargetCapacity(h, 2)
+	for i := 0; i < 2; i++ {
+		require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	}
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+
+	// Extra capacity is granted on top of the target.
+	s.SetExtraCapacity(h, 1)
+	require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+	s.SetExtraCapacity(h, 0)
+
+	// Targets never exceed the configured max.
+	s.SetTargetCapacity(h, 10)
+	require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+
+	s.SetTargetCapacity(h, 0)
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+}
+
 func TestStateDeletePendingAllowsFutureAddPending(t *testing.T) {
 	require := require.New(t)
 
@@ -302,3 +502,154 @@ func TestMaxMutualConns(t *testing.T) {
 	require.Equal(s.AddPending(core.PeerIDFixture(), h, neighbors[:mutualConnLimit+1]), ErrTooManyMutualConns)
 	require.NoError(s.AddPending(core.PeerIDFixture(), h, neighbors[:mutualConnLimit]))
 }
+
+func TestMaxConnsPerIP(t *testing.T) {
+	require := require.New(t)
+
+	s := testState(Config{MaxConnectionsPerIP: 2, MaxOpenConnectionsPerTorrent: 10}, clock.New())
+
+	h := core.InfoHashFixture()
+	p1 := core.PeerIDFixture()
+	require.NoError(s.AddPendingFromIP(p1, h, "10.0.0.1", nil))
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), h, "10.0.0.1", nil))
+	require.Equal(
+		ErrTooManyConnsFromIP, s.AddPendingFromIP(core.PeerIDFixture(), h, "10.0.0.1", nil))
+
+	// Other ips, other torrents and unknown ips are unaffected.
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), h, "10.0.0.2", nil))
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), core.InfoHashFixture(), "10.0.0.1", nil))
+	require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+
+	s.DeletePending(p1, h)
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), h, "10.0.0.1", nil))
+}
+
+func TestTrustedPeersUseReservedConns(t *testing.T) {
+	require := require.New(t)
+
+	origin := core.PeerIDFixture()
+	config := Config{
+		MaxOpenConnectionsPerTorrent: 2,
+		Trusted: TrustedConfig{
+			PeerIDs:       []string{origin.String()},
+			CIDRs:         []string{"10.1.0.0/16"},
+			ReservedConns: 2,
+		},
+	}
+	s := testState(config, clock.New())
+
+	h := core.InfoHashFixture()
+
+	require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	require.NoError(s.AddPending(core.PeerIDFixture(), h, nil))
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), h, nil))
+
+	// Trusted peers are admitted into the reserved slots, by peer id or ip.
+	require.NoError(s.AddPending(origin, h, nil))
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), h, "10.1.2.3", nil))
+	require.Equal(
+		ErrTorrentAtCapacity, s.AddPendingFromIP(core.PeerIDFixture(), h, "10.1.2.4", nil))
+
+	// Trusted conns do not consume regular slots while reserved slots remain.
+	other := core.InfoHashFixture()
+	require.NoError(s.AddPending(origin, other, nil))
+	require.NoError(s.AddPending(core.PeerIDFixture(), other, nil))
+	require.NoError(s.AddPending(core.PeerIDFixture(), other, nil))
+	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), other, nil))
+}
+
+func TestTrustedPeersBypassBlacklistAndLimits(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		MaxOpenConnectionsPerTorrent: 10,
+		MaxConnectionsPerIP:          1,
+		Trusted:                      TrustedConfig{CIDRs: []string{"10.1.0.0/16"}},
+	}
+	s := testState(config, clock.New())
+
+	h := core.InfoHashFixture()
+	p := core.PeerIDFixture()
+
+	require.NoError(s.AddPendingFromIP(p, h, "10.1.2.3", nil))
+	require.NoError(s.AddPendingFromIP(core.PeerIDFixture(), h, "10.1.2.3", nil))
+
+	// Peers trusted by ip remain trusted once their conn fails.
+	s.DeletePending(p, h)
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+	require.False(s.Blacklisted(p, h))
+	require.Empty(s.BlacklistSnapshot())
+}
+
+func TestTrustByIPExpiresAndDoesNotFollowPeerID(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	config := Config{
+		Trusted: TrustedConfig{CIDRs: []string{"10.1.0.0/16"}, IPTrustTTL: time.Minute},
+	}
+	s := testState(config, clk)
+
+	h := core.InfoHashFixture()
+	p := core.PeerIDFixture()
+
+	require.NoError(s.AddPendingFromIP(p, h, "10.1.2.3", nil))
+	s.DeletePending(p, h)
+	require.True(s.Trusted(p))
+
+	clk.Add(time.Minute)
+	require.False(s.Trusted(p))
+
+	require.NoError(s.AddPendingFromIP(p, h, "10.1.2.3", nil))
+	s.DeletePending(p, h)
+	require.True(s.Trusted(p))
+
+	// The same peer id from an untrusted ip is not trusted, and revokes the
+	// trust of the peer id.
+	require.NoError(s.AddPendingFromIP(p, h, "10.2.0.1", nil))
+	s.DeletePending(p, h)
+	require.False(s.Trusted(p))
+	require.NoError(s.Blacklist(p, h, HandshakeFailure))
+	require.True(s.Blacklisted(p, h))
+}
+
+func TestConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(Config{}.Validate())
+	require.Error(Config{Trusted: TrustedConfig{PeerIDs: []string{"foo"}}}.Validate())
+	require.Error(Config{Trusted: TrustedConfig{CIDRs: []string{"10.0.0.1"}}}.Validate())
+}
+
+func TestInterruptedBlacklistsAfterMaxInterruptions(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	config := Config{
+		MaxInterruptions:  2,
+		TransferBlacklist: BlacklistPolicy{ResetAfter: time.Minute},
+	}
+	s := testState(config, clk)
+
+	h := core.InfoHashFixture()
+	p := core.PeerIDFixture()
+
+	require.True(s.Interrupted(p, h))
+	require.True(s.Interrupted(p, h))
+	require.False(s.Interrupted(p, h))
+
+	// The count restarts once exceeded, and interruptions are forgotten after
+	// ResetAfter.
+	require.True(s.Interrupted(p, h))
+	clk.Add(time.Minute)
+	require.True(s.Interrupted(p, h))
+	require.True(s.Interrupted(p, h))
+	require.False(s.Interrupted(p, h))
+
+	// Interruptions are counted per peer and torrent.
+	require.True(s.Interrupted(core.PeerIDFixture(), h))
+	require.True(s.Interrupted(p, core.InfoHashFixture()))
+
+	s.ClearBlacklist(h)
+	require.Empty(s.interruptions[connKey{h, p}])
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package connstate
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// TrustedConfig defines peers which are trusted, e.g. origin servers. Conns to
+// trusted peers are never blacklisted, bypass the mutual and per-ip conn
+// limits, and are admitted into reserved conn slots when torrents are at
+// capacity.
+type TrustedConfig struct {
+	// PeerIDs are the hex encoded peer ids of trusted peers.
+	PeerIDs []string `yaml:"peer_ids"`
+
+	// CIDRs are the networks of trusted peers.
+	CIDRs []string `yaml:"cidrs"`
+
+	// ReservedConns is the number of conns per torrent reserved for trusted
+	// peers, on top of MaxOpenConnectionsPerTorrent. Trusted conns beyond the
+	// reserved slots compete for regular slots.
+	ReservedConns int `yaml:"reserved_conns"`
+
+	// IPTrustTTL is how long a peer trusted by ip remains trusted after its
+	// last conn from a trusted ip, such that its failures are not blacklisted
+	// once the conn is gone. A conn of the same peer id from an untrusted ip
+	// revokes the trust immediately.
+	IPTrustTTL time.Duration `yaml:"ip_trust_ttl"`
+}
+
+func (c TrustedConfig) applyDefaults() TrustedConfig {
+	if c.ReservedConns == 0 {
+		c.ReservedConns = 2
+	}
+	if c.IPTrustTTL == 0 {
+		c.IPTrustTTL = 10 * time.Minute
+	}
+	return c
+}
+
+// Validate returns an error if any trusted peer id or cidr is malformed.
+func (c Config) Validate() error {
+	_, err := newTrustList(c.Trusted)
+	return err
+}
+
+// trustList matches trusted peers.
+type trustList struct {
+	peerIDs map[core.PeerID]bool
+	nets    []*net.IPNet
+}
+
+func newTrustList(config TrustedConfig) (*trustList, error) {
+	l := &trustList{peerIDs: make(map[core.PeerID]bool)}
+	for _, s := range config.PeerIDs {
+		peerID, err := core.NewPeerID(s)
+		if err != nil {
+			return nil, fmt.Errorf("peer id %q: %s", s, err)
+		}
+		l.peerIDs[peerID] = true
+	}
+	for _, s := range config.CIDRs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("cidr %q: %s", s, err)
+		}
+		l.nets = append(l.nets, n)
+	}
+	return l, nil
+}
+
+// empty returns true if l trusts no peers.
+func (l *trustList) empty() bool {
+	return len(l.peerIDs) == 0 && len(l.nets) == 0
+}
+
+// trusts returns true if the peer of peerID at ip is trusted. ip may be empty
+// if unknown.
+func (l *trustList) trusts(peerID core.PeerID, ip string) bool {
+	if l.peerIDs[peerID] {
+		return true
+	}
+	if ip == "" || len(l.nets) == 0 {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
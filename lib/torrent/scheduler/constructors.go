@@ -14,6 +14,7 @@
 package scheduler
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 
@@ -23,15 +24,22 @@ import (
 	"github.com/uber/kraken/lib/store"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+	"github.com/uber/kraken/lib/torrent/scheduler/warmup"
 	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
 	"github.com/uber/kraken/lib/torrent/storage/originstorage"
 	"github.com/uber/kraken/tracker/announceclient"
 	"github.com/uber/kraken/tracker/metainfoclient"
+	"github.com/uber/kraken/tracker/reputation"
+	"github.com/uber/kraken/utils/dnscache"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
 )
 
-// NewAgentScheduler creates and starts a ReloadableScheduler configured for an agent.
+// NewAgentScheduler creates and starts a ReloadableScheduler configured for an
+// agent. Torrents are announced to trackers and to every cluster in
+// fallbackTrackers. Metainfo is fetched from trackers, failing over to each
+// cluster in fallbackTrackers.
 func NewAgentScheduler(
 	config Config,
 	stats tally.Scope,
@@ -39,25 +47,74 @@ func NewAgentScheduler(
 	cads *store.CADownloadStore,
 	netevents networkevent.Producer,
 	trackers hashring.PassiveRing,
-	tls *tls.Config) (ReloadableScheduler, error) {
+	tls *tls.Config,
+	fallbackTrackers ...hashring.PassiveRing) (ReloadableScheduler, error) {
+
+	resolver := dnscache.New(config.DNSCache, stats)
+
+	aopts := []announceclient.Option{announceclient.WithDialer(resolver.DialContext)}
+	if config.LeechOnly {
+		aopts = append(aopts, announceclient.WithLeechOnly())
+	}
+
+	announceClient := announceclient.New(pctx, trackers, tls, aopts...)
+	metainfoClient := metainfoclient.New(trackers, tls)
+	if len(fallbackTrackers) > 0 {
+		ts := []announceclient.Tracker{{Name: "primary", Client: announceClient}}
+		mcs := []metainfoclient.Client{metainfoClient}
+		for i, ring := range fallbackTrackers {
+			ts = append(ts, announceclient.Tracker{
+				Name:   fmt.Sprintf("fallback%d", i),
+				Client: announceclient.New(pctx, ring, tls, aopts...),
+			})
+			mcs = append(mcs, metainfoclient.New(ring, tls))
+		}
+		announceClient = announceclient.NewMulti(config.TrackerFailover, stats, clock.New(), ts)
+		metainfoClient = metainfoclient.NewFailover(mcs...)
+	}
+
+	sopts := []agentstorage.Option{agentstorage.WithWriteOrder(config.WriteOrder)}
+	if config.SyncWrites {
+		sopts = append(sopts, agentstorage.WithSyncWrites())
+	}
 
 	s, err := newScheduler(
 		config,
-		agentstorage.NewTorrentArchive(stats, cads, metainfoclient.New(trackers, tls)),
+		agentstorage.NewTorrentArchive(
+			stats, cads, metainfoClient, sopts...),
 		stats,
 		pctx,
-		announceclient.New(pctx, trackers, tls),
-		netevents)
+		announceClient,
+		netevents,
+		withResolver(resolver),
+		withReputationClient(reputation.NewClient(trackers, tls)))
 	if err != nil {
 		return nil, fmt.Errorf("new scheduler: %s", err)
 	}
 
-	aq := func() announcequeue.Queue { return announcequeue.New() }
+	aq := func() announcequeue.Queue {
+		return announcequeue.New(announcequeue.WithClock(s.clock))
+	}
 	rs := makeReloadable(s, aq)
 	if err := rs.start(aq()); err != nil {
 		return nil, fmt.Errorf("start: %s", err)
 	}
 
+	if config.Warmup.Enable {
+		// Warmup is best effort, and is not resumed if interrupted by a reload.
+		go warmup.Run(
+			config.Warmup,
+			warmup.NewClient(tls),
+			func(t warmup.Torrent, priority int) error {
+				return rs.AddTorrentWithOptions(
+					context.Background(),
+					t.Digest, WithNamespace(t.Namespace), WithPriority(priority))
+			},
+			stats,
+			s.logger,
+			s.done)
+	}
+
 	return rs, nil
 }
 
@@ -72,7 +129,7 @@ func NewOriginScheduler(
 
 	s, err := newScheduler(
 		config,
-		originstorage.NewTorrentArchive(cas, blobRefresher),
+		originstorage.NewTorrentArchive(cas, blobRefresher, originstorage.WithStats(stats)),
 		stats,
 		pctx,
 		announceclient.Disabled(),
@@ -0,0 +1,287 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
+)
+
+// DeadlineConfig defines how torrents added with a deadline are escalated as
+// the deadline approaches. Each stage triggers once the given fraction of the
+// time between adding the torrent and its deadline has elapsed.
+type DeadlineConfig struct {
+	// Interval is the interval in which deadlines are checked.
+	Interval time.Duration `yaml:"interval"`
+
+	// PriorityAt raises the torrent to the highest priority and exempts it
+	// from preemption.
+	PriorityAt float64 `yaml:"priority_at"`
+
+	// ReannounceAt forces an announce, regardless of the announce queue.
+	ReannounceAt float64 `yaml:"reannounce_at"`
+
+	// ExtraConnsAt allows the torrent to open ExtraConns conns beyond
+	// ConnState.MaxOpenConnectionsPerTorrent, and announces to find them.
+	ExtraConnsAt float64 `yaml:"extra_conns_at"`
+	ExtraConns   int     `yaml:"extra_conns"`
+
+	// FallbackAt fetches all missing pieces from the fallback reader of the
+	// torrent, if one was given via WithFallback.
+	FallbackAt float64 `yaml:"fallback_at"`
+}
+
+func (c DeadlineConfig) applyDefaults() DeadlineConfig {
+	if c.Interval == 0 {
+		c.Interval = time.Second
+	}
+	if c.PriorityAt == 0 {
+		c.PriorityAt = 0.5
+	}
+	if c.ReannounceAt == 0 {
+		c.ReannounceAt = 0.5
+	}
+	if c.ExtraConnsAt == 0 {
+		c.ExtraConnsAt = 0.75
+	}
+	if c.ExtraConns == 0 {
+		c.ExtraConns = 5
+	}
+	if c.FallbackAt == 0 {
+		c.FallbackAt = 0.9
+	}
+	return c
+}
+
+// DeadlineError is returned when a torrent is not complete by the deadline set
+// via WithDeadline. It summarizes the state of the download at the deadline.
+type DeadlineError struct {
+	Digest         core.Digest
+	Deadline       time.Time
+	PiecesComplete int
+	PiecesTotal    int
+	ActiveConns    int
+	LastWrite      time.Time
+	Escalations    []string
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf(
+		"torrent %s missed deadline %s: %d/%d pieces complete, %d active conns, "+
+			"last piece written at %s, escalations [%s]",
+		e.Digest.Hex(), e.Deadline.Format(time.RFC3339), e.PiecesComplete, e.PiecesTotal,
+		e.ActiveConns, e.LastWrite.Format(time.RFC3339), strings.Join(e.Escalations, ", "))
+}
+
+// escalation is a stage of deadline escalation.
+type escalation struct {
+	name  string
+	at    func(DeadlineConfig) float64
+	apply func(s *state, h core.InfoHash, ctrl *torrentControl)
+}
+
+var escalations = []escalation{{
+	name: "priority",
+	at:   func(c DeadlineConfig) float64 { return c.PriorityAt },
+	apply: func(s *state, h core.InfoHash, ctrl *torrentControl) {
+		ctrl.opts.priority = math.MaxInt32
+		ctrl.opts.preemptionExempt = true
+	},
+}, {
+	name: "reannounce",
+	at:   func(c DeadlineConfig) float64 { return c.ReannounceAt },
+	apply: func(s *state, h core.InfoHash, ctrl *torrentControl) {
+		s.forceAnnounce(ctrl.dispatcher)
+	},
+}, {
+	name: "extra_conns",
+	at:   func(c DeadlineConfig) float64 { return c.ExtraConnsAt },
+	apply: func(s *state, h core.InfoHash, ctrl *torrentControl) {
+		s.conns.SetExtraCapacity(h, s.sched.config.Deadline.ExtraConns)
+		s.forceAnnounce(ctrl.dispatcher)
+	},
+}, {
+	name: "fallback",
+	at:   func(c DeadlineConfig) float64 { return c.FallbackAt },
+	apply: func(s *state, h core.InfoHash, ctrl *torrentControl) {
+		if ctrl.opts.fallback != nil {
+			go s.sched.fetchFallback(ctrl.opts.fallback, ctrl.namespace, ctrl.dispatcher)
+		}
+	},
+}}
+
+// escalated returns true if the escalation of name was applied to ctrl.
+func (ctrl *torrentControl) escalated(name string) bool {
+	for _, e := range ctrl.escalations {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// forceAnnounce immediately announces d, regardless of the announce queue.
+func (s *state) forceAnnounce(d *dispatch.Dispatcher) {
+	go s.sched.announce(d.Digest(), d.InfoHash(), d.Complete(), d.HaveRanges())
+}
+
+// escalate applies all escalations of ctrl which are due.
+func (s *state) escalate(h core.InfoHash, ctrl *torrentControl, now time.Time) {
+	config := s.sched.config.Deadline
+	start := ctrl.dispatcher.CreatedAt()
+	total := ctrl.opts.deadline.Sub(start)
+	elapsed := float64(now.Sub(start)) / float64(total)
+	for _, e := range escalations {
+		if ctrl.escalated(e.name) || elapsed < e.at(config) {
+			continue
+		}
+		s.log("hash", h, "escalation", e.name).Info("Escalating torrent at risk of missing deadline")
+		e.apply(s, h, ctrl)
+		ctrl.escalations = append(ctrl.escalations, e.name)
+		ctrl.stats.Tagged(map[string]string{
+			"escalation": e.name,
+		}).Counter("deadline_escalations").Inc(1)
+		s.sched.timelines.Record(h, timeline.Escalated, e.name)
+	}
+}
+
+// deadlineError summarizes ctrl for a torrent which missed deadline.
+func (s *state) deadlineError(
+	h core.InfoHash, ctrl *torrentControl, deadline time.Time) *DeadlineError {
+
+	var conns int
+	for _, c := range s.conns.ActiveConns() {
+		if c.InfoHash() == h {
+			conns++
+		}
+	}
+	bitfield := ctrl.dispatcher.Stat().Bitfield()
+	return &DeadlineError{
+		Digest:         ctrl.dispatcher.Digest(),
+		Deadline:       deadline,
+		PiecesComplete: int(bitfield.Count()),
+		PiecesTotal:    int(bitfield.Len()),
+		ActiveConns:    conns,
+		LastWrite:      ctrl.dispatcher.LastWriteTime(),
+		Escalations:    append([]string(nil), ctrl.escalations...),
+	}
+}
+
+// deadlineTickEvent occurs periodically to escalate torrents as their
+// deadlines approach, and to fail torrents which missed their deadlines.
+type deadlineTickEvent struct{}
+
+func (e deadlineTickEvent) apply(s *state) {
+	now := s.sched.clock.Now()
+	for h, ctrl := range s.torrentControls {
+		if ctrl.opts.deadline.IsZero() || ctrl.seeding() {
+			continue
+		}
+		if now.Before(ctrl.opts.deadline) {
+			s.escalate(h, ctrl, now)
+			continue
+		}
+		s.missDeadline(h, ctrl)
+	}
+}
+
+// missDeadline removes the torrent of h for missing its deadline.
+func (s *state) missDeadline(h core.InfoHash, ctrl *torrentControl) {
+	err := s.deadlineError(h, ctrl, ctrl.opts.deadline)
+	s.log("hash", h).Infof("Removing torrent: %s", err)
+	ctrl.stats.Counter("deadline_misses").Inc(1)
+	// Conns which have not yet been added to the dispatcher are not closed by
+	// teardown.
+	s.closeConns(h)
+	s.removeTorrent(h, err)
+}
+
+// setDeadlineTimer sends e into the event loop at deadline, such that
+// deadlines are enforced when they pass instead of on the next deadline tick.
+func (s *state) setDeadlineTimer(ctrl *torrentControl, deadline time.Time, e deadlineEvent) {
+	e.deadline = deadline
+	t := s.sched.clock.AfterFunc(deadline.Sub(s.sched.clock.Now()), func() {
+		s.sched.eventLoop.send(e)
+	})
+	ctrl.timers = append(ctrl.timers, t)
+}
+
+// stopTimers stops all deadline and starvation timers of ctrl.
+func (ctrl *torrentControl) stopTimers() {
+	for _, t := range ctrl.timers {
+		t.Stop()
+	}
+	ctrl.timers = nil
+	if ctrl.starvationTimer != nil {
+		ctrl.starvationTimer.Stop()
+		ctrl.starvationTimer = nil
+	}
+}
+
+// deadlineEvent occurs when the deadline of a torrent, or of a single request
+// waiting on the torrent, passes.
+type deadlineEvent struct {
+	infoHash core.InfoHash
+	deadline time.Time
+
+	// errc is the request whose deadline passed. Nil if the deadline of the
+	// torrent itself passed.
+	errc chan error
+}
+
+// apply fails the torrent if its own deadline passed. Otherwise, only the
+// request whose deadline passed fails, so its caller can fall back to another
+// source, and the torrent is removed once no requests are left waiting on it.
+func (e deadlineEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		return
+	}
+	if e.errc == nil {
+		if ctrl.opts.deadline.Equal(e.deadline) {
+			s.missDeadline(e.infoHash, ctrl)
+		}
+		return
+	}
+	for i, errc := range ctrl.errors {
+		if errc != e.errc {
+			continue
+		}
+		err := s.deadlineError(e.infoHash, ctrl, e.deadline)
+		ctrl.errors = append(ctrl.errors[:i], ctrl.errors[i+1:]...)
+		ctrl.stats.Counter("request_deadline_misses").Inc(1)
+		errc <- err
+		if len(ctrl.errors) == 0 {
+			s.log("hash", e.infoHash).Infof("Removing torrent: %s", err)
+			s.closeConns(e.infoHash)
+			s.removeTorrent(e.infoHash, err)
+		}
+		return
+	}
+}
+
+// fetchFallback fetches all missing pieces of d from r.
+func (s *scheduler) fetchFallback(r fallback.Reader, namespace string, d *dispatch.Dispatcher) {
+	if err := d.FetchFallback(r, namespace); err != nil {
+		s.stats.Counter("fallback_errors").Inc(1)
+		s.log("hash", d.InfoHash()).Errorf("Error fetching pieces from fallback: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+type blobFallback struct {
+	blob *core.BlobFixture
+}
+
+func (f blobFallback) ReadRange(
+	namespace string, d core.Digest, offset, length int64) ([]byte, error) {
+
+	return f.blob.Content[offset : offset+length], nil
+}
+
+func TestDeadlineTickEventEscalatesAndFails(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		ConnState: connstate.Config{MaxOpenConnectionsPerTorrent: 1},
+		Deadline:  DeadlineConfig{ExtraConns: 3},
+	})
+
+	torrent := mocks.newTorrent()
+	h := torrent.InfoHash()
+
+	ctrl, err := state.addTorrent(_testNamespace, torrent, true)
+	require.NoError(err)
+	start := ctrl.dispatcher.CreatedAt()
+	ctrl.opts.deadline = start.Add(100 * time.Second)
+
+	errc := make(chan error, 1)
+	ctrl.errors = append(ctrl.errors, errc)
+
+	mocks.announceClient.EXPECT().
+		Announce(ctrl.dispatcher.Digest(), h, false, gomock.Any(), gomock.Any()).
+		Return(nil, time.Second, nil).
+		Times(2)
+
+	state.escalate(h, ctrl, start.Add(60*time.Second))
+	require.Equal([]string{"priority", "reannounce"}, ctrl.escalations)
+	require.Equal(math.MaxInt32, ctrl.opts.priority)
+	require.True(ctrl.opts.preemptionExempt)
+	mocks.eventLoop.expect(announceResultEvent{infoHash: h})
+
+	state.escalate(h, ctrl, start.Add(80*time.Second))
+	require.Equal([]string{"priority", "reannounce", "extra_conns"}, ctrl.escalations)
+	for i := 0; i < 4; i++ {
+		require.NoError(state.conns.AddPending(core.PeerIDFixture(), h, nil))
+	}
+	require.Equal(
+		connstate.ErrTorrentAtCapacity, state.conns.AddPending(core.PeerIDFixture(), h, nil))
+	mocks.eventLoop.expect(announceResultEvent{infoHash: h})
+
+	// No fallback reader was given, so the stage has no effect.
+	state.escalate(h, ctrl, start.Add(95*time.Second))
+	require.Equal(
+		[]string{"priority", "reannounce", "extra_conns", "fallback"}, ctrl.escalations)
+
+	ctrl.opts.deadline = time.Now().Add(-time.Second)
+
+	deadlineTickEvent{}.apply(state)
+
+	require.NotContains(state.torrentControls, h)
+
+	err = <-errc
+	derr, ok := err.(*DeadlineError)
+	require.True(ok)
+	require.Equal(torrent.Digest(), derr.Digest)
+	require.Equal(torrent.NumPieces(), derr.PiecesTotal)
+	require.Equal(0, derr.PiecesComplete)
+	require.Equal(
+		[]string{"priority", "reannounce", "extra_conns", "fallback"}, derr.Escalations)
+	require.Contains(err.Error(), "missed deadline")
+}
+
+func TestDeadlineTimerFailsTorrentAtDeadline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	torrent := mocks.newTorrent()
+	h := torrent.InfoHash()
+	deadline := time.Now().Add(10 * time.Millisecond)
+
+	ctrl, err := state.addTorrent(_testNamespace, torrent, true, WithDeadline(deadline))
+	require.NoError(err)
+
+	errc := make(chan error, 1)
+	ctrl.errors = append(ctrl.errors, errc)
+
+	// Fires without waiting for the next deadline tick.
+	e := deadlineEvent{infoHash: h, deadline: deadline}
+	mocks.eventLoop.expect(e)
+	e.apply(state)
+
+	require.NotContains(state.torrentControls, h)
+	derr, ok := (<-errc).(*DeadlineError)
+	require.True(ok)
+	require.Equal(deadline, derr.Deadline)
+}
+
+func TestDeadlineEventFailsOnlyExpiredRequest(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	expired := make(chan error, 1)
+	waiting := make(chan error, 1)
+	ctrl.errors = append(ctrl.errors, expired, waiting)
+
+	deadline := time.Now()
+	deadlineEvent{h, deadline, expired}.apply(state)
+
+	derr, ok := (<-expired).(*DeadlineError)
+	require.True(ok)
+	require.Equal(deadline, derr.Deadline)
+
+	// Other requests keep waiting on the torrent.
+	require.Contains(state.torrentControls, h)
+	require.Equal([]chan error{waiting}, ctrl.errors)
+
+	// Once the last request misses its deadline, the torrent is removed.
+	deadlineEvent{h, deadline, waiting}.apply(state)
+	_, ok = (<-waiting).(*DeadlineError)
+	require.True(ok)
+	require.NotContains(state.torrentControls, h)
+}
+
+func TestRequestDeadlineFailsRequestWithoutEscalating(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	torrent := mocks.newTorrent()
+	h := torrent.InfoHash()
+	deadline := time.Now().Add(100 * time.Millisecond)
+
+	mocks.announceClient.EXPECT().
+		Announce(torrent.Digest(), h, false, nil, announceclient.V1).
+		Return(nil, time.Second, nil)
+
+	errc := make(chan error, 1)
+	newTorrentEvent{
+		_testNamespace, torrent, []TorrentOption{withRequestDeadline(deadline)}, errc,
+	}.apply(state)
+
+	ctrl := state.torrentControls[h]
+	require.True(ctrl.opts.deadline.IsZero())
+
+	e := deadlineEvent{h, deadline, errc}
+	mocks.eventLoop.waitFor(e)
+	e.apply(state)
+
+	_, ok := (<-errc).(*DeadlineError)
+	require.True(ok)
+	require.Empty(ctrl.escalations)
+	require.NotContains(state.torrentControls, h)
+
+	// Pending outgoing handshakes of the torrent are aborted.
+	require.Error(ctrl.dials.Err())
+}
+
+func TestDeadlineEventIgnoresStaleTorrentDeadline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+	ctrl.opts.deadline = time.Now().Add(time.Hour)
+
+	deadlineEvent{infoHash: h, deadline: time.Now()}.apply(state)
+
+	require.Contains(state.torrentControls, h)
+}
+
+func TestDeadlineEscalationFetchesFromFallback(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	blob := core.SizedBlobFixture(100, 10)
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+	torrent, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+
+	ctrl, err := state.addTorrent(
+		_testNamespace, torrent, true,
+		WithDeadline(time.Now().Add(time.Hour)), WithFallback(blobFallback{blob}))
+	require.NoError(err)
+
+	mocks.announceClient.EXPECT().
+		Announce(blob.Digest, torrent.InfoHash(), false, gomock.Any(), gomock.Any()).
+		Return(nil, time.Second, nil).
+		AnyTimes()
+	go func() {
+		for range mocks.eventLoop.c {
+		}
+	}()
+
+	state.escalate(torrent.InfoHash(), ctrl, ctrl.opts.deadline)
+
+	require.NoError(testutil.PollUntilTrue(5*time.Second, ctrl.dispatcher.Complete))
+}
+
+func TestDeadlineTickEventIgnoresTorrentsWithoutDeadline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+
+	deadlineTickEvent{}.apply(state)
+
+	require.Contains(state.torrentControls, ctrl.dispatcher.InfoHash())
+	require.Empty(ctrl.escalations)
+}
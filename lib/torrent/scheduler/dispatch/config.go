@@ -34,7 +34,7 @@ type Config struct {
 	PieceRequestTimeoutPerMb time.Duration `yaml:"piece_request_timeout_per_mb"`
 
 	// PieceRequestPolicy is the policy that is used to decide which pieces to request
-	// from a peer.
+	// from a peer. Defaults to rarest first.
 	PieceRequestPolicy string `yaml:"piece_request_policy"`
 
 	// PipelineLimit limits the total number of requests can be sent to a peer
@@ -47,11 +47,19 @@ type Config struct {
 	EndgameThreshold int `yaml:"endgame_threshold"`
 
 	DisableEndgame bool `yaml:"disable_endgame"`
+
+	// DisableRequestBatching sends every piece request in its own message,
+	// even to peers which support piece request batches.
+	DisableRequestBatching bool `yaml:"disable_request_batching"`
+
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+
+	HashProofs HashProofConfig `yaml:"hash_proofs"`
 }
 
 func (c Config) applyDefaults() Config {
 	if c.PieceRequestPolicy == "" {
-		c.PieceRequestPolicy = piecerequest.DefaultPolicy
+		c.PieceRequestPolicy = piecerequest.RarestFirstPolicy
 	}
 	if c.PieceRequestMinTimeout == 0 {
 		c.PieceRequestMinTimeout = 4 * time.Second
@@ -65,6 +73,8 @@ func (c Config) applyDefaults() Config {
 	if c.EndgameThreshold == 0 {
 		c.EndgameThreshold = c.PipelineLimit
 	}
+	c.Heartbeat = c.Heartbeat.applyDefaults()
+	c.HashProofs = c.HashProofs.applyDefaults()
 	return c
 }
 
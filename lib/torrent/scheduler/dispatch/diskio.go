@@ -0,0 +1,154 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+)
+
+// DiskIOConfig defines admission control based on disk write latency. When the
+// disk is saturated, piece requests are throttled and incoming piece requests
+// are rejected as busy, rather than queueing behind the disk until they time
+// out.
+type DiskIOConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// SaturationLatency is the smoothed piece write latency above which the
+	// disk is considered saturated. The disk is considered recovered once the
+	// smoothed latency drops below half of SaturationLatency.
+	SaturationLatency time.Duration `yaml:"saturation_latency"`
+
+	// Smoothing is the weight of each new latency sample in the moving
+	// average, in (0, 1].
+	Smoothing float64 `yaml:"smoothing"`
+
+	// RecoveryHalfLife is the duration after which the smoothed latency is
+	// halved if no piece is written. Otherwise, a disk which is saturated
+	// would stay saturated once writes stop, e.g. while seeding, since busy
+	// rejections prevent new samples.
+	RecoveryHalfLife time.Duration `yaml:"recovery_half_life"`
+
+	// SaturatedPipelineLimit limits the number of outstanding piece requests
+	// per peer while the disk is saturated.
+	SaturatedPipelineLimit int `yaml:"saturated_pipeline_limit"`
+}
+
+func (c DiskIOConfig) applyDefaults() DiskIOConfig {
+	if c.SaturationLatency == 0 {
+		c.SaturationLatency = 500 * time.Millisecond
+	}
+	if c.Smoothing == 0 {
+		c.Smoothing = 0.2
+	}
+	if c.RecoveryHalfLife == 0 {
+		c.RecoveryHalfLife = 5 * time.Second
+	}
+	if c.SaturatedPipelineLimit == 0 {
+		c.SaturatedPipelineLimit = 1
+	}
+	return c
+}
+
+// DiskMonitor tracks piece write latency across all Dispatchers to detect
+// when the disk is saturated. DiskMonitor is thread-safe, and a nil
+// DiskMonitor never reports saturation.
+type DiskMonitor struct {
+	config DiskIOConfig
+	stats  tally.Scope
+	clk    clock.Clock
+
+	mu         sync.Mutex
+	latency    time.Duration // Exponential moving average.
+	lastSample time.Time
+	saturated  bool
+}
+
+// NewDiskMonitor creates a new DiskMonitor.
+func NewDiskMonitor(config DiskIOConfig, stats tally.Scope, clk clock.Clock) *DiskMonitor {
+	return &DiskMonitor{
+		config: config.applyDefaults(),
+		stats: stats.Tagged(map[string]string{
+			"module": "diskmonitor",
+		}),
+		clk: clk,
+	}
+}
+
+// Observe records the latency of a single piece write.
+func (m *DiskMonitor) Observe(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay()
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency += time.Duration(m.config.Smoothing * float64(latency-m.latency))
+	}
+	m.stats.Gauge("write_latency_ms").Update(float64(m.latency) / float64(time.Millisecond))
+
+	if !m.saturated && m.latency > m.config.SaturationLatency {
+		m.saturated = true
+		m.stats.Counter("saturations").Inc(1)
+	} else {
+		m.checkRecovered()
+	}
+}
+
+// Saturated returns true if the disk is currently saturated.
+func (m *DiskMonitor) Saturated() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.decay()
+	m.checkRecovered()
+	return m.saturated
+}
+
+// decay halves the smoothed latency for every RecoveryHalfLife elapsed since
+// the last sample.
+func (m *DiskMonitor) decay() {
+	now := m.clk.Now()
+	if !m.lastSample.IsZero() {
+		elapsed := float64(now.Sub(m.lastSample)) / float64(m.config.RecoveryHalfLife)
+		m.latency = time.Duration(float64(m.latency) * math.Pow(0.5, elapsed))
+	}
+	m.lastSample = now
+}
+
+func (m *DiskMonitor) checkRecovered() {
+	if m.saturated && m.latency < m.config.SaturationLatency/2 {
+		m.saturated = false
+	}
+}
+
+// pipelineLimit returns the number of outstanding piece requests allowed per
+// peer, or false if requests are not throttled.
+func (m *DiskMonitor) pipelineLimit() (int, bool) {
+	if !m.Saturated() {
+		return 0, false
+	}
+	return m.config.SaturatedPipelineLimit, true
+}
@@ -14,9 +14,14 @@
 package dispatch
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/uber/kraken/core"
@@ -24,8 +29,11 @@ import (
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
 	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/bitsetutil"
 	"github.com/uber/kraken/utils/syncutil"
 
 	"github.com/andres-erbsen/clock"
@@ -40,11 +48,14 @@ var (
 	errPieceOutOfBounds        = errors.New("piece index out of bounds")
 	errChunkNotSupported       = errors.New("reading / writing chunk of piece not supported")
 	errRepeatedBitfieldMessage = errors.New("received repeated bitfield message")
+	errLeechOnly               = errors.New("leech-only peer does not serve pieces")
+	errDiskSaturated           = errors.New("disk is saturated")
 )
 
 // Events defines Dispatcher events.
 type Events interface {
 	DispatcherComplete(*Dispatcher)
+	DispatcherProgress(d *Dispatcher, percent int)
 	PeerRemoved(core.PeerID, core.InfoHash)
 }
 
@@ -56,6 +67,18 @@ type Messages interface {
 	Close()
 }
 
+// resumableMessages is implemented by Messages whose session may be resumed
+// by a new conn after being interrupted. See conn.SessionConfig.
+type resumableMessages interface {
+	Resumable() bool
+}
+
+// batchingMessages is implemented by Messages which may carry piece request
+// batches, depending on the protocol version negotiated with the peer.
+type batchingMessages interface {
+	SupportsPieceRequestBatches() bool
+}
+
 // Dispatcher coordinates torrent state with sending / receiving messages between multiple
 // peers. As such, Dispatcher and Torrent have a one-to-one relationship, while Dispatcher
 // and Conn have a one-to-many relationship.
@@ -74,13 +97,86 @@ type Dispatcher struct {
 	pieceRequestManager   *piecerequest.Manager
 	pendingPiecesDoneOnce sync.Once
 	pendingPiecesDone     chan struct{}
-	completeOnce          sync.Once
+	lifecycle             lifecycle
+	peersMu               sync.Mutex // Serializes peer-driven state changes.
+	lastMilestone         int32      // Accessed atomically.
+	paused                int32      // Accessed atomically.
+	bytesDownloaded       int64      // Accessed atomically.
+	bytesUploaded         int64      // Accessed atomically.
+	pendingWrites         int32      // Accessed atomically.
+	downloadRate          *rateMeter
+	uploadRate            *rateMeter
 	events                Events
 	logger                *zap.SugaredLogger
 	torrentlog            *torrentlog.Logger
+
+	// priorityPieces are requested before any other pieces. Immutable once
+	// the Dispatcher is created.
+	priorityPieces *bitset.BitSet
+
+	// leechOnly rejects all piece requests from remote peers.
+	leechOnly bool
+
+	// disk is nil unless disk IO admission control is enabled.
+	disk *DiskMonitor
+
+	// memory is nil unless piece request memory is budgeted.
+	memory         *MemoryBudget
+	memoryPriority int
+
+	provenanceMu sync.Mutex
+	provenance   map[int]provenance.Piece
+
+	// gained holds the pieces written by d, in order, for heartbeats.
+	gainedMu sync.Mutex
+	gained   []int
+
+	hashProofs *hashProofs
+
+	// tracer is nil unless tracing is configured.
+	tracer Tracer
 }
 
-// New creates a new Dispatcher.
+// Option allows setting optional parameters in Dispatcher.
+type Option func(*Dispatcher)
+
+// WithPriorityPieces configures a Dispatcher to request pieces in mask before
+// any other pieces.
+func WithPriorityPieces(mask *bitset.BitSet) Option {
+	return func(d *Dispatcher) { d.priorityPieces = mask }
+}
+
+// WithLeechOnly configures a Dispatcher to download pieces without serving
+// any pieces to remote peers.
+func WithLeechOnly() Option {
+	return func(d *Dispatcher) { d.leechOnly = true }
+}
+
+// WithDiskMonitor configures a Dispatcher to throttle piece requests and
+// reject incoming piece requests while m reports the disk as saturated.
+func WithDiskMonitor(m *DiskMonitor) Option {
+	return func(d *Dispatcher) { d.disk = m }
+}
+
+// WithMemoryBudget configures a Dispatcher to limit its piece requests in
+// flight to its share of b, per the priority of the torrent.
+func WithMemoryBudget(b *MemoryBudget, priority int) Option {
+	return func(d *Dispatcher) {
+		d.memory = b
+		d.memoryPriority = priority
+	}
+}
+
+// WithHandle configures a Dispatcher to hold a reference on h for each piece
+// reader it opens and each piece write in progress, such that storage handles
+// which outlive the torrent are detected.
+func WithHandle(h *leakwatch.Handle) Option {
+	return func(d *Dispatcher) { d.torrent.handle = h }
+}
+
+// New creates a new Dispatcher. All randomized decisions made by the
+// Dispatcher draw from rng, such that its behavior is reproducible given the
+// same seed.
 func New(
 	config Config,
 	stats tally.Scope,
@@ -90,18 +186,29 @@ func New(
 	peerID core.PeerID,
 	t storage.Torrent,
 	logger *zap.SugaredLogger,
-	tlog *torrentlog.Logger) (*Dispatcher, error) {
+	tlog *torrentlog.Logger,
+	rng *rand.Rand,
+	opts ...Option) (*Dispatcher, error) {
 
-	d, err := newDispatcher(config, stats, clk, netevents, events, peerID, t, logger, tlog)
+	d, err := newDispatcher(config, stats, clk, netevents, events, peerID, t, logger, tlog, rng)
 	if err != nil {
 		return nil, err
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
 
 	// Exits when d.pendingPiecesDone is closed.
 	go d.watchPendingPieceRequests()
+	if d.config.Heartbeat.Enable {
+		// Exits when d.pendingPiecesDone is closed.
+		go d.heartbeatLoop()
+	}
 
 	if t.Complete() {
 		d.complete()
+	} else {
+		d.setState(StateAnnouncing)
 	}
 
 	return d, nil
@@ -117,7 +224,8 @@ func newDispatcher(
 	peerID core.PeerID,
 	t storage.Torrent,
 	logger *zap.SugaredLogger,
-	tlog *torrentlog.Logger) (*Dispatcher, error) {
+	tlog *torrentlog.Logger,
+	rng *rand.Rand) (*Dispatcher, error) {
 
 	config = config.applyDefaults()
 
@@ -127,7 +235,7 @@ func newDispatcher(
 
 	pieceRequestTimeout := config.calcPieceRequestTimeout(t.MaxPieceLength())
 	pieceRequestManager, err := piecerequest.NewManager(
-		clk, pieceRequestTimeout, config.PieceRequestPolicy, config.PipelineLimit)
+		clk, pieceRequestTimeout, config.PieceRequestPolicy, config.PipelineLimit, rng)
 	if err != nil {
 		return nil, fmt.Errorf("piece request manager: %s", err)
 	}
@@ -147,6 +255,10 @@ func newDispatcher(
 		events:              events,
 		logger:              logger,
 		torrentlog:          tlog,
+		provenance:          make(map[int]provenance.Piece),
+		downloadRate:        newRateMeter(clk),
+		uploadRate:          newRateMeter(clk),
+		hashProofs:          newHashProofs(),
 	}, nil
 }
 
@@ -165,14 +277,141 @@ func (d *Dispatcher) Length() int64 {
 	return d.torrent.Length()
 }
 
+// CheckMetaInfo returns an error if the metainfo of t disagrees with the
+// metainfo of d's torrent, e.g. because either is corrupt.
+func (d *Dispatcher) CheckMetaInfo(t storage.Torrent) error {
+	switch {
+	case t.Digest() != d.torrent.Digest():
+		return fmt.Errorf("digest %s != %s", t.Digest(), d.torrent.Digest())
+	case t.Length() != d.torrent.Length():
+		return fmt.Errorf("length %d != %d", t.Length(), d.torrent.Length())
+	case t.NumPieces() != d.torrent.NumPieces():
+		return fmt.Errorf("num pieces %d != %d", t.NumPieces(), d.torrent.NumPieces())
+	case t.MaxPieceLength() != d.torrent.MaxPieceLength():
+		return fmt.Errorf("piece length %d != %d", t.MaxPieceLength(), d.torrent.MaxPieceLength())
+	case !t.MetaInfo().EqualInfo(d.torrent.MetaInfo()):
+		return errors.New("piece hashes differ")
+	}
+	return nil
+}
+
 // Stat returns d's TorrentInfo.
 func (d *Dispatcher) Stat() *storage.TorrentInfo {
 	return d.torrent.Stat()
 }
 
-// Complete returns true if d's torrent is complete.
+// Complete returns true if d is seeding its torrent, or was seeding it before
+// being torn down.
 func (d *Dispatcher) Complete() bool {
-	return d.torrent.Complete()
+	switch d.State() {
+	case StateSeeding:
+		return true
+	case StateDraining, StateClosed:
+		return d.lifecycle.hasSeeded()
+	default:
+		return false
+	}
+}
+
+// State returns the current lifecycle state of d.
+func (d *Dispatcher) State() State {
+	return d.lifecycle.get()
+}
+
+// AddStateChangeHook registers h to be called on all subsequent state changes
+// of d.
+func (d *Dispatcher) AddStateChangeHook(h StateChangeHook) {
+	d.lifecycle.addHook(h)
+}
+
+// setState transitions d to the to state, if the transition is valid from d's
+// current state. Returns whether the transition occurred.
+func (d *Dispatcher) setState(to State) bool {
+	from, ok := d.lifecycle.transition(to)
+	if !ok {
+		return false
+	}
+	d.log("from", from, "to", to).Debug("Dispatcher state changed")
+	d.lifecycle.runHooks(d, from, to)
+	return true
+}
+
+// HaveRanges returns a summary of the pieces d's torrent holds, for
+// advertising d as a partial seeder. Returns nil if the torrent is complete.
+func (d *Dispatcher) HaveRanges() core.PieceRanges {
+	if d.Complete() {
+		return nil
+	}
+	return core.NewPieceRanges(d.torrent.Bitfield())
+}
+
+// NeedsAnyPiece returns true if have includes at least one piece which d's
+// torrent is missing. Used to determine whether a partial seeder is worth
+// connecting to.
+func (d *Dispatcher) NeedsAnyPiece(have core.PieceRanges) bool {
+	b := d.torrent.Bitfield()
+	for _, r := range have {
+		for i := r.Start; i <= r.End && i < d.torrent.NumPieces(); i++ {
+			if !b.Test(uint(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ColdPieces returns the least recently read pieces of d's torrent, such that
+// evicting them would keep keepFraction of the torrent's pieces on disk. Pieces
+// which have never been read are considered coldest.
+func (d *Dispatcher) ColdPieces(keepFraction float64) []int {
+	readTimes := d.torrent.getLastPieceReadTimes()
+	keep := int(math.Ceil(keepFraction * float64(len(readTimes))))
+	if keep >= len(readTimes) {
+		return nil
+	}
+	pieces := make([]int, 0, len(readTimes))
+	for i := range readTimes {
+		if d.torrent.HasPiece(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	sort.SliceStable(pieces, func(i, j int) bool {
+		return readTimes[pieces[i]].Before(readTimes[pieces[j]])
+	})
+	n := len(pieces) - keep
+	if n <= 0 {
+		return nil
+	}
+	cold := pieces[:n]
+	sort.Ints(cold)
+	return cold
+}
+
+// Evicted returns true if d's torrent has had pieces evicted since it was last
+// complete.
+func (d *Dispatcher) Evicted() bool {
+	e, ok := d.torrent.Torrent.(storage.PieceEvictor)
+	return ok && e.Evicted()
+}
+
+// Flush waits for in-flight piece writes to finish, then syncs the torrent of
+// d to disk if its storage supports syncing. Should be called once conns are
+// closed, else writes may continue to arrive. Returns ctx.Err() if ctx is done
+// before in-flight writes finish.
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&d.pendingWrites) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if s, ok := d.torrent.Torrent.(storage.Syncer); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
 // CreatedAt returns when d was created.
@@ -209,6 +448,33 @@ func (d *Dispatcher) LastWriteTime() time.Time {
 	return d.torrent.getLastWriteTime()
 }
 
+// Provenance returns where each piece written by d was downloaded from,
+// ordered by piece index. Pieces which were already on disk when d was created
+// are omitted.
+func (d *Dispatcher) Provenance() []provenance.Piece {
+	d.provenanceMu.Lock()
+	defer d.provenanceMu.Unlock()
+
+	pieces := make([]provenance.Piece, 0, len(d.provenance))
+	for _, p := range d.provenance {
+		pieces = append(pieces, p)
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].Index < pieces[j].Index })
+	return pieces
+}
+
+func (d *Dispatcher) recordProvenance(i int, source, peerID string) {
+	d.provenanceMu.Lock()
+	defer d.provenanceMu.Unlock()
+
+	d.provenance[i] = provenance.Piece{
+		Index:  i,
+		Source: source,
+		PeerID: peerID,
+		Time:   d.clk.Now(),
+	}
+}
+
 // Empty returns true if the Dispatcher has no peers.
 func (d *Dispatcher) Empty() bool {
 	empty := true
@@ -219,6 +485,65 @@ func (d *Dispatcher) Empty() bool {
 	return empty
 }
 
+// PeerUtility summarizes how useful a peer currently is to a Dispatcher.
+type PeerUtility struct {
+	// Bytes per second of good pieces recently received from the peer.
+	DownloadRate float64
+	// Bytes per second of pieces recently sent to the peer.
+	UploadRate float64
+	// Rarity is the sum of 1 / availability over the pieces the peer has
+	// which d still needs, where availability is the number of connected
+	// peers with the piece. Peers holding rare needed pieces score highest.
+	Rarity float64
+}
+
+// PeerUtilities returns the utility of every peer connected to d.
+func (d *Dispatcher) PeerUtilities() map[core.PeerID]PeerUtility {
+	needed := d.torrent.Bitfield().Complement()
+	utilities := make(map[core.PeerID]PeerUtility)
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		var rarity float64
+		bitsetutil.ForEachSet(p.bitfield.Intersection(needed), func(i uint) bool {
+			if n := d.numPeersByPiece.Get(int(i)); n > 0 {
+				rarity += 1 / float64(n)
+			}
+			return true
+		})
+		utilities[p.id] = PeerUtility{
+			DownloadRate: p.downloadRate.rate(),
+			UploadRate:   p.uploadRate.rate(),
+			Rarity:       rarity,
+		}
+		return true
+	})
+	return utilities
+}
+
+// PeerExchange counts the pieces received from a peer.
+type PeerExchange struct {
+	// Good is the number of verified pieces received from the peer.
+	Good int
+	// Bad is the number of pieces received from the peer which failed
+	// verification, plus the number of piece requests the peer failed.
+	Bad int
+}
+
+// PeerExchanges returns the pieces received from every peer d exchanged pieces
+// with, including peers which have since disconnected.
+func (d *Dispatcher) PeerExchanges() map[core.PeerID]PeerExchange {
+	exchanges := make(map[core.PeerID]PeerExchange)
+	d.peerStats.Range(func(k, v interface{}) bool {
+		pstats := v.(*peerStats)
+		exchanges[k.(core.PeerID)] = PeerExchange{
+			Good: pstats.getGoodPiecesReceived(),
+			Bad:  pstats.getBadPiecesReceived(),
+		}
+		return true
+	})
+	return exchanges
+}
+
 // RemoteBitfields returns the bitfields of peers connected to the dispatcher.
 func (d *Dispatcher) RemoteBitfields() conn.RemoteBitfields {
 	remoteBitfields := make(conn.RemoteBitfields)
@@ -234,15 +559,48 @@ func (d *Dispatcher) RemoteBitfields() conn.RemoteBitfields {
 func (d *Dispatcher) AddPeer(
 	peerID core.PeerID, b *bitset.BitSet, messages Messages) error {
 
+	// Requests retained for an interrupted session of the peer are dropped,
+	// since the new conn does not resume it.
+	d.pieceRequestManager.ClearPeer(peerID)
+
+	p, err := d.addPeer(peerID, b, messages)
+	if err != nil {
+		return err
+	}
+	go d.maybeRequestMorePieces(p)
+	go d.feed(p)
+	return nil
+}
+
+// ResumePeer registers a new peer with the Dispatcher, which resumes a session
+// interrupted on a previous conn. Piece requests in flight on the interrupted
+// conn are sent again, rather than waiting for them to time out.
+func (d *Dispatcher) ResumePeer(
+	peerID core.PeerID, b *bitset.BitSet, messages Messages) error {
+
 	p, err := d.addPeer(peerID, b, messages)
 	if err != nil {
 		return err
 	}
+	d.resendPendingRequests(p)
 	go d.maybeRequestMorePieces(p)
 	go d.feed(p)
 	return nil
 }
 
+// resendPendingRequests sends the pending requests of p over its messages.
+func (d *Dispatcher) resendPendingRequests(p *peer) {
+	for _, i := range d.pieceRequestManager.PendingPieces(p.id) {
+		if err := p.messages.Send(conn.NewPieceRequestMessage(i, d.torrent.PieceLength(i))); err != nil {
+			// Connection closed.
+			d.pieceRequestManager.MarkUnsent(p.id, i)
+			return
+		}
+		d.stats.Counter("resumed_piece_requests").Inc(1)
+		p.pstats.incrementPieceRequestsSent()
+	}
+}
+
 // addPeer creates and inserts a new peer into the Dispatcher. Split from AddPeer
 // with no goroutine side-effects for testing purposes.
 func (d *Dispatcher) addPeer(
@@ -252,33 +610,59 @@ func (d *Dispatcher) addPeer(
 	if s, ok := d.peerStats.LoadOrStore(peerID, pstats); ok {
 		pstats = s.(*peerStats)
 	}
+	if d.tracer != nil {
+		messages = &tracedMessages{messages, d, peerID}
+	}
 
 	p := newPeer(peerID, b, messages, d.clk, pstats)
+	d.initHeartbeat(p)
+
+	d.peersMu.Lock()
+	defer d.peersMu.Unlock()
+
 	if _, ok := d.peers.LoadOrStore(peerID, p); ok {
 		return nil, errors.New("peer already exists")
 	}
 
-	for _, i := range p.bitfield.GetAllSet() {
+	p.bitfield.ForEachSet(func(i uint) bool {
 		d.numPeersByPiece.Increment(int(i))
-	}
+		return true
+	})
+	d.setState(StateDownloading)
 	return p, nil
 }
 
 func (d *Dispatcher) removePeer(p *peer) error {
+	d.peersMu.Lock()
+	defer d.peersMu.Unlock()
+
 	d.peers.Delete(p.id)
-	d.pieceRequestManager.ClearPeer(p.id)
+	if r, ok := p.messages.(resumableMessages); !ok || !r.Resumable() {
+		// Requests of interrupted sessions are kept for the peer to resume,
+		// and otherwise expire like any unanswered request.
+		d.pieceRequestManager.ClearPeer(p.id)
+	}
+	d.memory.set(d.torrent.InfoHash(), d.pendingBytes())
 
-	for _, i := range p.bitfield.GetAllSet() {
+	p.bitfield.ForEachSet(func(i uint) bool {
 		d.numPeersByPiece.Decrement(int(i))
+		return true
+	})
+	if d.Empty() {
+		d.setState(StateAnnouncing)
 	}
 	return nil
 }
 
 // TearDown closes all Dispatcher connections.
 func (d *Dispatcher) TearDown() {
+	d.setState(StateDraining)
+	defer d.setState(StateClosed)
+
 	d.pendingPiecesDoneOnce.Do(func() {
 		close(d.pendingPiecesDone)
 	})
+	d.memory.release(d.torrent.InfoHash())
 
 	d.peers.Range(func(k, v interface{}) bool {
 		p := v.(*peer)
@@ -305,12 +689,106 @@ func (d *Dispatcher) TearDown() {
 	}
 }
 
+// BytesDownloaded returns the total bytes of pieces d downloaded from peers.
+func (d *Dispatcher) BytesDownloaded() int64 {
+	return atomic.LoadInt64(&d.bytesDownloaded)
+}
+
+// PieceLength returns the length of piece i.
+func (d *Dispatcher) PieceLength(i int) int64 {
+	return d.torrent.PieceLength(i)
+}
+
+// BytesUploaded returns the total bytes of pieces d uploaded to peers.
+func (d *Dispatcher) BytesUploaded() int64 {
+	return atomic.LoadInt64(&d.bytesUploaded)
+}
+
+// BytesComplete returns the total bytes of complete pieces of d, regardless
+// of where they were downloaded from.
+func (d *Dispatcher) BytesComplete() int64 {
+	return d.torrent.BytesDownloaded()
+}
+
+// NumPeers returns the number of peers connected to d.
+func (d *Dispatcher) NumPeers() int {
+	var n int
+	d.peers.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// DownloadRate returns the bytes per second of pieces d recently downloaded
+// from peers.
+func (d *Dispatcher) DownloadRate() float64 {
+	return d.downloadRate.rate()
+}
+
+// UploadRate returns the bytes per second of pieces d recently uploaded to
+// peers.
+func (d *Dispatcher) UploadRate() float64 {
+	return d.uploadRate.rate()
+}
+
+// Pause stops d from requesting pieces. Pieces which were already requested
+// are still written, and d continues to serve pieces to remote peers.
+func (d *Dispatcher) Pause() {
+	atomic.StoreInt32(&d.paused, 1)
+}
+
+// Resume resumes requesting pieces after Pause.
+func (d *Dispatcher) Resume() {
+	if !atomic.CompareAndSwapInt32(&d.paused, 1, 0) {
+		return
+	}
+	d.peers.Range(func(k, v interface{}) bool {
+		d.maybeRequestMorePieces(v.(*peer))
+		return true
+	})
+}
+
+// Paused returns true if d is paused.
+func (d *Dispatcher) Paused() bool {
+	return atomic.LoadInt32(&d.paused) == 1
+}
+
 func (d *Dispatcher) String() string {
 	return fmt.Sprintf("Dispatcher(%s)", d.torrent)
 }
 
+// progressMilestones are the download percentages reported to Events, in
+// ascending order.
+var progressMilestones = []int{25, 50, 75}
+
+// maybeReportProgress reports the highest progress milestone reached by d's
+// torrent, if not already reported.
+func (d *Dispatcher) maybeReportProgress() {
+	length := d.torrent.Length()
+	if length == 0 {
+		return
+	}
+	percent := int(100 * d.torrent.BytesDownloaded() / length)
+	var reached int
+	for _, m := range progressMilestones {
+		if percent >= m {
+			reached = m
+		}
+	}
+	last := atomic.LoadInt32(&d.lastMilestone)
+	if reached > int(last) && atomic.CompareAndSwapInt32(&d.lastMilestone, last, int32(reached)) {
+		go d.events.DispatcherProgress(d, reached)
+	}
+}
+
+// complete transitions d to seeding. Has no effect if d is already seeding or
+// is being torn down.
 func (d *Dispatcher) complete() {
-	d.completeOnce.Do(func() { go d.events.DispatcherComplete(d) })
+	if !d.setState(StateSeeding) {
+		return
+	}
+	go d.events.DispatcherComplete(d)
 	d.pendingPiecesDoneOnce.Do(func() { close(d.pendingPiecesDone) })
 
 	d.peers.Range(func(k, v interface{}) bool {
@@ -365,17 +843,46 @@ func (d *Dispatcher) endgame() bool {
 func (d *Dispatcher) maybeRequestMorePieces(p *peer) (bool, error) {
 	candidates := p.bitfield.Intersection(d.torrent.Bitfield().Complement())
 
+	if d.priorityPieces != nil {
+		if priority := candidates.Intersection(d.priorityPieces); priority.Any() {
+			if sent, err := d.maybeSendPieceRequests(p, priority); sent || err != nil {
+				return sent, err
+			}
+		}
+	}
 	return d.maybeSendPieceRequests(p, candidates)
 }
 
 func (d *Dispatcher) maybeSendPieceRequests(p *peer, candidates *bitset.BitSet) (bool, error) {
-	pieces, err := d.pieceRequestManager.ReservePieces(p.id, candidates, d.numPeersByPiece, d.endgame())
+	if d.Paused() {
+		return false, nil
+	}
+	endgame := d.endgame()
+	if endgame {
+		d.setState(StateEndgame)
+	}
+	limit := d.config.PipelineLimit
+	if l, ok := d.disk.pipelineLimit(); ok && l < limit {
+		limit = l
+	}
+	d.pieceRequestManager.SetPipelineLimit(limit)
+	max := -1
+	if n, ok := d.memory.quota(
+		d.torrent.InfoHash(), d.memoryPriority, d.pendingBytes(), d.torrent.MaxPieceLength()); ok {
+		max = n
+	}
+	pieces, err := d.pieceRequestManager.ReservePiecesUpTo(
+		p.id, candidates, d.numPeersByPiece, endgame, max)
 	if err != nil {
 		return false, err
 	}
+	d.memory.set(d.torrent.InfoHash(), d.pendingBytes())
 	if len(pieces) == 0 {
 		return false, nil
 	}
+	if len(pieces) > 1 && d.batchRequests(p) {
+		return d.sendPieceRequestBatch(p, pieces)
+	}
 	for _, i := range pieces {
 		if err := p.messages.Send(conn.NewPieceRequestMessage(i, d.torrent.PieceLength(i))); err != nil {
 			// Connection closed.
@@ -389,6 +896,42 @@ func (d *Dispatcher) maybeSendPieceRequests(p *peer, candidates *bitset.BitSet)
 	return true, nil
 }
 
+// batchRequests returns whether multiple piece requests to p are sent as a
+// single batch.
+func (d *Dispatcher) batchRequests(p *peer) bool {
+	if d.config.DisableRequestBatching {
+		return false
+	}
+	b, ok := p.messages.(batchingMessages)
+	return ok && b.SupportsPieceRequestBatches()
+}
+
+func (d *Dispatcher) sendPieceRequestBatch(p *peer, pieces []int) (bool, error) {
+	if err := p.messages.Send(conn.NewPieceRequestBatchMessage(pieces)); err != nil {
+		// Connection closed.
+		for _, i := range pieces {
+			d.pieceRequestManager.MarkUnsent(p.id, i)
+		}
+		return false, err
+	}
+	d.stats.Counter("piece_request_batches").Inc(1)
+	for _, i := range pieces {
+		d.netevents.Produce(
+			networkevent.RequestPieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i))
+		p.pstats.incrementPieceRequestsSent()
+	}
+	return true, nil
+}
+
+// pendingBytes returns an upper bound of the bytes of piece requests in
+// flight.
+func (d *Dispatcher) pendingBytes() int64 {
+	if d.memory == nil {
+		return 0
+	}
+	return int64(d.pieceRequestManager.NumPending()) * d.torrent.MaxPieceLength()
+}
+
 func (d *Dispatcher) resendFailedPieceRequests() {
 	failedRequests := d.pieceRequestManager.GetFailedRequests()
 	if len(failedRequests) > 0 {
@@ -448,6 +991,8 @@ func (d *Dispatcher) feed(p *peer) {
 }
 
 func (d *Dispatcher) dispatch(p *peer, msg *conn.Message) error {
+	d.traceMessage("received", p.id, msg, nil)
+
 	switch msg.Message.Type {
 	case p2p.Message_ERROR:
 		d.handleError(p, msg.Message.Error)
@@ -455,6 +1000,8 @@ func (d *Dispatcher) dispatch(p *peer, msg *conn.Message) error {
 		d.handleAnnouncePiece(p, msg.Message.AnnouncePiece)
 	case p2p.Message_PIECE_REQUEST:
 		d.handlePieceRequest(p, msg.Message.PieceRequest)
+	case p2p.Message_PIECE_REQUEST_BATCH:
+		d.handlePieceRequestBatch(p, msg.Message.PieceRequestBatch)
 	case p2p.Message_PIECE_PAYLOAD:
 		d.handlePiecePayload(p, msg.Message.PiecePayload, msg.Payload)
 	case p2p.Message_CANCEL_PIECE:
@@ -463,6 +1010,12 @@ func (d *Dispatcher) dispatch(p *peer, msg *conn.Message) error {
 		d.handleBitfield(p, msg.Message.Bitfield)
 	case p2p.Message_COMPLETE:
 		d.handleComplete(p)
+	case p2p.Message_HEARTBEAT:
+		d.handleHeartbeat(p, msg.Message.Heartbeat)
+	case p2p.Message_PIECE_HASH_REQUEST:
+		d.handlePieceHashRequest(p, msg.Message.PieceHashRequest)
+	case p2p.Message_PIECE_HASH:
+		d.handlePieceHash(p, msg.Message.PieceHash)
 	default:
 		return fmt.Errorf("unknown message type: %d", msg.Message.Type)
 	}
@@ -473,7 +1026,13 @@ func (d *Dispatcher) handleError(p *peer, msg *p2p.ErrorMessage) {
 	switch msg.Code {
 	case p2p.ErrorMessage_PIECE_REQUEST_FAILED:
 		d.log().Errorf("Piece request failed: %s", msg.Error)
+		p.pstats.incrementBadPiecesReceived()
 		d.pieceRequestManager.MarkInvalid(p.id, int(msg.Index))
+	case p2p.ErrorMessage_BUSY:
+		// The peer is healthy but overloaded, so the piece may be requested
+		// again without penalizing the peer.
+		d.stats.Counter("busy_piece_requests").Inc(1)
+		d.pieceRequestManager.MarkUnsent(p.id, int(msg.Index))
 	}
 }
 
@@ -497,13 +1056,24 @@ func (d *Dispatcher) handlePieceRequest(p *peer, msg *p2p.PieceRequestMessage) {
 	p.pstats.incrementPieceRequestsReceived()
 
 	i := int(msg.Index)
+	if d.leechOnly {
+		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errLeechOnly))
+		return
+	}
+	if d.disk.Saturated() {
+		d.stats.Counter("busy_piece_rejections").Inc(1)
+		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_BUSY, errDiskSaturated))
+		return
+	}
 	if !d.isFullPiece(i, int(msg.Offset), int(msg.Length)) {
 		d.log("peer", p, "piece", i).Error("Rejecting piece request: chunk not supported")
 		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errChunkNotSupported))
 		return
 	}
 
+	start := time.Now()
 	payload, err := d.torrent.GetPieceReader(i)
+	d.traceStorage("read", i, start, err)
 	if err != nil {
 		d.log("peer", p, "piece", i).Errorf("Error getting reader for requested piece: %s", err)
 		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, err))
@@ -511,16 +1081,36 @@ func (d *Dispatcher) handlePieceRequest(p *peer, msg *p2p.PieceRequestMessage) {
 	}
 
 	if err := p.messages.Send(conn.NewPiecePayloadMessage(i, payload)); err != nil {
+		// Payloads are only closed by the conn once queued.
+		payload.Close()
 		return
 	}
 
 	p.touchLastPieceSent()
 	p.pstats.incrementPiecesSent()
+	atomic.AddInt64(&d.bytesUploaded, int64(msg.Length))
+	d.uploadRate.add(int64(msg.Length))
+	p.uploadRate.add(int64(msg.Length))
 
 	// Assume that the peer successfully received the piece.
 	p.bitfield.Set(uint(i), true)
 }
 
+// handlePieceRequestBatch handles every request of the batch as a request of
+// the full piece.
+func (d *Dispatcher) handlePieceRequestBatch(p *peer, msg *p2p.PieceRequestBatchMessage) {
+	for _, i := range conn.PieceRequestBatchIndices(msg) {
+		if i >= d.torrent.NumPieces() {
+			d.log("peer", p).Errorf("Piece request batch out of bounds: %d >= %d", i, d.torrent.NumPieces())
+			return
+		}
+		d.handlePieceRequest(p, &p2p.PieceRequestMessage{
+			Index:  int32(i),
+			Length: int32(d.torrent.PieceLength(i)),
+		})
+	}
+}
+
 func (d *Dispatcher) handlePiecePayload(
 	p *peer, msg *p2p.PiecePayloadMessage, payload storage.PieceReader) {
 
@@ -530,29 +1120,49 @@ func (d *Dispatcher) handlePiecePayload(
 	if !d.isFullPiece(i, int(msg.Offset), int(msg.Length)) {
 		d.log("peer", p, "piece", i).Error("Rejecting piece payload: chunk not supported")
 		d.pieceRequestManager.MarkInvalid(p.id, i)
+		p.pstats.incrementBadPiecesReceived()
 		return
 	}
 
-	if err := d.torrent.WritePiece(payload, i); err != nil {
+	start := time.Now()
+	atomic.AddInt32(&d.pendingWrites, 1)
+	err := d.torrent.WritePiece(payload, i)
+	atomic.AddInt32(&d.pendingWrites, -1)
+	d.disk.Observe(time.Since(start))
+	d.traceStorage("write", i, start, err)
+	if err != nil {
 		if err != storage.ErrPieceComplete {
 			d.log("peer", p, "piece", i).Errorf("Error writing piece payload: %s", err)
 			d.pieceRequestManager.MarkInvalid(p.id, i)
+			p.pstats.incrementBadPiecesReceived()
+			if err == storage.ErrInvalidPieceSum {
+				d.recordPieceHashMismatch(p, i)
+			}
 		} else {
 			p.pstats.incrementDuplicatePiecesReceived()
 		}
 		return
 	}
 
+	atomic.AddInt64(&d.bytesDownloaded, int64(msg.Length))
+	d.downloadRate.add(int64(msg.Length))
+	p.downloadRate.add(int64(msg.Length))
+	d.recordProvenance(i, provenance.SourcePeer, p.id.String())
+	d.recordGained(i)
 	d.netevents.Produce(
-		networkevent.ReceivePieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i))
+		networkevent.ReceivePieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i, int64(msg.Length)))
 
 	p.pstats.incrementGoodPiecesReceived()
 	p.touchLastGoodPieceReceived()
+	d.maybeReportProgress()
 	if d.torrent.Complete() {
 		d.complete()
 	}
 
+	duplicates := d.pieceRequestManager.PendingPeers(i)
 	d.pieceRequestManager.Clear(i)
+	d.memory.set(d.torrent.InfoHash(), d.pendingBytes())
+	d.cancelDuplicates(p, i, duplicates)
 
 	d.maybeRequestMorePieces(p)
 
@@ -568,10 +1178,28 @@ func (d *Dispatcher) handlePiecePayload(
 	})
 }
 
+// cancelDuplicates cancels the requests of piece i to peers other than p, the
+// peer which sent the piece. Requests are only duplicated during endgame.
+func (d *Dispatcher) cancelDuplicates(p *peer, i int, peerIDs []core.PeerID) {
+	for _, peerID := range peerIDs {
+		if peerID == p.id {
+			continue
+		}
+		v, ok := d.peers.Load(peerID)
+		if !ok {
+			continue
+		}
+		if err := v.(*peer).messages.Send(conn.NewCancelPieceMessage(i)); err != nil {
+			continue
+		}
+		d.stats.Counter("endgame_cancels").Inc(1)
+	}
+}
+
 func (d *Dispatcher) handleCancelPiece(p *peer, msg *p2p.CancelPieceMessage) {
-	// No-op: cancelling not supported because all received messages are synchronized,
-	// therefore if we receive a cancel it is already too late -- we've already read
-	// the piece.
+	// No-op: cancellations are handled by the conn, which drops the payload if
+	// it is still queued. Otherwise it is already too late -- the payload was
+	// already sent.
 }
 
 func (d *Dispatcher) handleBitfield(p *peer, msg *p2p.BitfieldMessage) {
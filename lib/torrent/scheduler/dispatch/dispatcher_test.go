@@ -14,7 +14,10 @@
 package dispatch
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"math/rand"
 	"sync"
 	"testing"
 	"time"
@@ -23,6 +26,9 @@ import (
 	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
@@ -30,6 +36,7 @@ import (
 	"github.com/uber/kraken/utils/bitsetutil"
 	"github.com/uber/kraken/utils/memsize"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
@@ -38,9 +45,11 @@ import (
 )
 
 type mockMessages struct {
-	sent     []*conn.Message
-	receiver chan *conn.Message
-	closed   bool
+	sent      []*conn.Message
+	receiver  chan *conn.Message
+	closed    bool
+	resumable bool
+	batching  bool
 }
 
 func newMockMessages() *mockMessages {
@@ -57,6 +66,10 @@ func (m *mockMessages) Send(msg *conn.Message) error {
 
 func (m *mockMessages) Receiver() <-chan *conn.Message { return m.receiver }
 
+func (m *mockMessages) Resumable() bool { return m.resumable }
+
+func (m *mockMessages) SupportsPieceRequestBatches() bool { return m.batching }
+
 func (m *mockMessages) Close() {
 	if m.closed {
 		return
@@ -102,6 +115,8 @@ type noopEvents struct{}
 
 func (e noopEvents) DispatcherComplete(*Dispatcher) {}
 
+func (e noopEvents) DispatcherProgress(*Dispatcher, int) {}
+
 func (e noopEvents) PeerRemoved(core.PeerID, core.InfoHash) {}
 
 func testDispatcher(config Config, clk clock.Clock, t storage.Torrent) *Dispatcher {
@@ -114,7 +129,8 @@ func testDispatcher(config Config, clk clock.Clock, t storage.Torrent) *Dispatch
 		core.PeerIDFixture(),
 		t,
 		zap.NewNop().Sugar(),
-		torrentlog.NewNopLogger())
+		torrentlog.NewNopLogger(),
+		rand.New(rand.NewSource(0)))
 	if err != nil {
 		panic(err)
 	}
@@ -174,6 +190,290 @@ func TestDispatcherSendUniquePieceRequestsWithinLimit(t *testing.T) {
 	}
 }
 
+func saturatedDiskMonitor() *DiskMonitor {
+	m := NewDiskMonitor(
+		DiskIOConfig{Enable: true, SaturationLatency: time.Second}, tally.NoopScope, clock.NewMock())
+	m.Observe(2 * time.Second)
+	return m
+}
+
+func TestDiskMonitorSaturation(t *testing.T) {
+	require := require.New(t)
+
+	m := NewDiskMonitor(DiskIOConfig{
+		Enable:            true,
+		SaturationLatency: 100 * time.Millisecond,
+		Smoothing:         0.5,
+	}, tally.NoopScope, clock.NewMock())
+	require.False(m.Saturated())
+
+	m.Observe(50 * time.Millisecond)
+	require.False(m.Saturated())
+
+	m.Observe(250 * time.Millisecond) // Average 150ms.
+	require.True(m.Saturated())
+
+	// Recovers only once latency drops below half the saturation latency.
+	m.Observe(70 * time.Millisecond) // Average 110ms.
+	m.Observe(70 * time.Millisecond) // Average 90ms.
+	require.True(m.Saturated())
+	m.Observe(0) // Average 45ms.
+	require.False(m.Saturated())
+
+	var nilMonitor *DiskMonitor
+	nilMonitor.Observe(time.Hour)
+	require.False(nilMonitor.Saturated())
+}
+
+func TestDiskMonitorRecoversWithoutWrites(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := NewDiskMonitor(DiskIOConfig{
+		Enable:            true,
+		SaturationLatency: 100 * time.Millisecond,
+		RecoveryHalfLife:  time.Second,
+	}, tally.NoopScope, clk)
+
+	m.Observe(300 * time.Millisecond)
+	require.True(m.Saturated())
+
+	clk.Add(time.Second) // Average 150ms.
+	require.True(m.Saturated())
+
+	clk.Add(time.Second) // Average 75ms.
+	require.True(m.Saturated())
+
+	clk.Add(time.Second) // Average 37.5ms.
+	require.False(m.Saturated())
+}
+
+func TestDispatcherThrottlesPieceRequestsWhenDiskSaturated(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit: 3,
+	}
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(100, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+	d.disk = saturatedDiskMonitor()
+
+	peerBitfield := bitset.New(uint(torrent.NumPieces())).Complement()
+	p, err := d.addPeer(core.PeerIDFixture(), peerBitfield, newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p)
+	d.maybeRequestMorePieces(p)
+	require.Len(numRequestsPerPiece(p.messages), 1)
+}
+
+func TestMemoryBudgetQuota(t *testing.T) {
+	require := require.New(t)
+
+	b := NewMemoryBudget(MemoryConfig{Budget: 100, TorrentShare: 0.25}, tally.NoopScope)
+
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+
+	// Priority 0 may use a quarter of the budget, priority 1 half.
+	n, ok := b.quota(h1, 0, 0, 10)
+	require.True(ok)
+	require.Equal(2, n)
+
+	n, ok = b.quota(h2, 1, 30, 10)
+	require.True(ok)
+	require.Equal(2, n)
+	require.Equal(int64(30), b.InFlight())
+
+	// Priority 0 is at its share.
+	n, ok = b.quota(h1, 0, 20, 10)
+	require.True(ok)
+	require.Equal(0, n)
+
+	// Global budget is exhausted by other torrents.
+	b.set(h1, 0)
+	b.set(h2, 100)
+	n, ok = b.quota(h1, 3, 10, 10)
+	require.True(ok)
+	require.Equal(0, n)
+
+	// Torrents with nothing in flight may always request a piece.
+	n, ok = b.quota(h1, 0, 0, 1000)
+	require.True(ok)
+	require.Equal(1, n)
+
+	b.release(h2)
+	require.Equal(int64(0), b.InFlight())
+}
+
+func TestNilMemoryBudgetDoesNotLimit(t *testing.T) {
+	require := require.New(t)
+
+	var b *MemoryBudget
+
+	_, ok := b.quota(core.InfoHashFixture(), 0, 100, 10)
+	require.False(ok)
+	b.set(core.InfoHashFixture(), 100)
+	require.Equal(int64(0), b.InFlight())
+}
+
+func TestDispatcherThrottlesPieceRequestsByMemoryBudget(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit: 3,
+	}
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(100, 1).MetaInfo)
+	defer cleanup()
+
+	budget := NewMemoryBudget(MemoryConfig{Budget: 4, TorrentShare: 0.5}, tally.NoopScope)
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+	WithMemoryBudget(budget, 0)(d)
+
+	peerBitfield := bitset.New(uint(torrent.NumPieces())).Complement()
+	p, err := d.addPeer(core.PeerIDFixture(), peerBitfield, newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p)
+	d.maybeRequestMorePieces(p)
+	require.Len(numRequestsPerPiece(p.messages), 2)
+	require.Equal(int64(2), budget.InFlight())
+
+	d.TearDown()
+	require.Equal(int64(0), budget.InFlight())
+}
+
+func TestDispatcherRejectsPieceRequestsWhenDiskSaturated(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.disk = saturatedDiskMonitor()
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+
+	sent := p.messages.(*mockMessages).sent
+	require.Len(sent, 1)
+	require.Equal(p2p.Message_ERROR, sent[0].Message.Type)
+	require.Equal(p2p.ErrorMessage_BUSY, sent[0].Message.Error.Code)
+}
+
+func TestDispatcherCountsBytesUploaded(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	for i := range blob.Content {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+
+	require.Equal(int64(2), d.BytesUploaded())
+}
+
+type staticTracer struct {
+	h      core.InfoHash
+	logger *zap.SugaredLogger
+}
+
+func (t staticTracer) Trace(h core.InfoHash) *zap.SugaredLogger {
+	if h == t.h {
+		return t.logger
+	}
+	return nil
+}
+
+func TestDispatcherTracesMessagesAndStorage(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	obs, logs := observer.New(zap.DebugLevel)
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	WithTracer(staticTracer{torrent.InfoHash(), zap.New(obs).Sugar()})(d)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+
+	var msgs []string
+	for _, e := range logs.All() {
+		msgs = append(msgs, e.Message)
+	}
+	require.Equal([]string{"Message received", "Storage read", "Message sent"}, msgs)
+}
+
+func TestDispatcherPeerExchanges(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	peerID := core.PeerIDFixture()
+	p, err := d.addPeer(peerID, bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	corrupt := []byte{^blob.Content[1]}
+
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[:1]))))
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(corrupt))))
+
+	require.Equal(map[core.PeerID]PeerExchange{peerID: {Good: 1, Bad: 1}}, d.PeerExchanges())
+}
+
+func TestDispatcherRetriesBusyPieceRequests(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p.messages))
+
+	require.NoError(d.dispatch(p, conn.NewErrorMessage(0, p2p.ErrorMessage_BUSY, errDiskSaturated)))
+
+	failed := d.pieceRequestManager.GetFailedRequests()
+	require.Len(failed, 1)
+	require.Equal(piecerequest.StatusUnsent, failed[0].Status)
+}
+
 func TestDispatcherResendFailedPieceRequests(t *testing.T) {
 	require := require.New(t)
 
@@ -316,6 +616,154 @@ func TestDispatcherEndgame(t *testing.T) {
 	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
 }
 
+func cancelledPieces(messages Messages) []int {
+	var ps []int
+	for _, msg := range messages.(*mockMessages).sent {
+		if msg.Message.Type == p2p.Message_CANCEL_PIECE {
+			ps = append(ps, int(msg.Message.CancelPiece.Index))
+		}
+	}
+	return ps
+}
+
+func TestDispatcherEndgameCancelsDuplicateRequests(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:    1,
+		EndgameThreshold: 2,
+	}
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		// Peers only hold the first piece, such that the torrent does not
+		// complete.
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+		require.NoError(err)
+		d.maybeRequestMorePieces(p)
+		require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p.messages))
+		peers = append(peers, p)
+	}
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	require.NoError(d.dispatch(peers[0], msg))
+
+	// Duplicate requests to other peers are cancelled.
+	require.Empty(cancelledPieces(peers[0].messages))
+	require.Equal([]int{0}, cancelledPieces(peers[1].messages))
+	require.Equal([]int{0}, cancelledPieces(peers[2].messages))
+}
+
+func TestDispatcherBatchesPieceRequests(t *testing.T) {
+	tests := []struct {
+		desc            string
+		batching        bool
+		disableBatching bool
+		expectBatch     bool
+	}{
+		{"peer supports batches", true, false, true},
+		{"peer does not support batches", false, false, false},
+		{"batching disabled", true, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			config := Config{
+				PipelineLimit:          3,
+				DisableEndgame:         true,
+				DisableRequestBatching: test.disableBatching,
+			}
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+			defer cleanup()
+
+			d := testDispatcher(config, clock.NewMock(), torrent)
+
+			messages := newMockMessages()
+			messages.batching = test.batching
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), messages)
+			require.NoError(err)
+
+			sent, err := d.maybeRequestMorePieces(p)
+			require.NoError(err)
+			require.True(sent)
+
+			pending := d.pieceRequestManager.PendingPieces(p.id)
+			require.Len(pending, 3)
+
+			if test.expectBatch {
+				require.Len(messages.sent, 1)
+				batch := messages.sent[0].Message
+				require.Equal(p2p.Message_PIECE_REQUEST_BATCH, batch.Type)
+				require.Equal(pending, conn.PieceRequestBatchIndices(batch.PieceRequestBatch))
+			} else {
+				require.Len(messages.sent, 3)
+				for _, msg := range messages.sent {
+					require.Equal(p2p.Message_PIECE_REQUEST, msg.Message.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherHandlePieceRequestBatch(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	for i := 0; i < 4; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestBatchMessage([]int{1, 3})))
+
+	var served []int
+	for _, msg := range p.messages.(*mockMessages).sent {
+		require.Equal(p2p.Message_PIECE_PAYLOAD, msg.Message.Type)
+		served = append(served, int(msg.Message.PiecePayload.Index))
+	}
+	require.Equal([]int{1, 3}, served)
+}
+
+func TestDispatcherCheckMetaInfo(t *testing.T) {
+	require := require.New(t)
+
+	mi := core.SizedBlobFixture(4, 1).MetaInfo
+
+	torrent, cleanup := agentstorage.TorrentFixture(mi)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	same, cleanup := agentstorage.TorrentFixture(mi)
+	defer cleanup()
+	require.NoError(d.CheckMetaInfo(same))
+
+	other, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(8, 1).MetaInfo)
+	defer cleanup()
+	require.Error(d.CheckMetaInfo(other))
+
+	// Same digest and layout, but different piece hashes.
+	corruptMI, err := core.NewMetaInfo(mi.Digest(), bytes.NewReader([]byte("abcd")), 1)
+	require.NoError(err)
+	corrupt, cleanup := agentstorage.TorrentFixture(corruptMI)
+	defer cleanup()
+	require.Error(d.CheckMetaInfo(corrupt))
+}
+
 func TestDispatcherHandlePiecePayloadAnnouncesPiece(t *testing.T) {
 	require := require.New(t)
 
@@ -343,6 +791,161 @@ func TestDispatcherHandlePiecePayloadAnnouncesPiece(t *testing.T) {
 	require.Equal([]int{0}, announcedPieces(p2.messages))
 }
 
+func pieceHashRequests(messages Messages) []int {
+	var ps []int
+	for _, msg := range messages.(*mockMessages).sent {
+		if msg.Message.Type == p2p.Message_PIECE_HASH_REQUEST {
+			ps = append(ps, int(msg.Message.PieceHashRequest.Index))
+		}
+	}
+	return ps
+}
+
+func TestDispatcherRecoversCorruptPieceHash(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(32, 32)
+
+	// The local metainfo of the torrent carries the wrong piece hash.
+	mi, err := core.NewMetaInfo(blob.Digest, bytes.NewReader(make([]byte, 32)), 32)
+	require.NoError(err)
+	torrent, cleanup := agentstorage.TorrentFixture(mi)
+	defer cleanup()
+
+	config := Config{
+		HashProofs: HashProofConfig{Enable: true, MismatchThreshold: 2, Quorum: 2},
+	}
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	// The last peer is not trusted to vouch for piece hashes.
+	d.TrustPeer(peers[0].id)
+	d.TrustPeer(peers[1].id)
+
+	payload := func() *conn.Message {
+		return conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content))
+	}
+
+	require.NoError(d.dispatch(peers[0], payload()))
+	require.Empty(pieceHashRequests(peers[0].messages))
+
+	require.NoError(d.dispatch(peers[1], payload()))
+	require.Equal([]int{0}, pieceHashRequests(peers[0].messages))
+	require.Equal([]int{0}, pieceHashRequests(peers[1].messages))
+	require.Empty(pieceHashRequests(peers[2].messages))
+
+	hash := blob.MetaInfo.PieceHash(0)
+	require.NoError(d.dispatch(peers[0], conn.NewPieceHashMessage(0, hash)))
+	require.NoError(d.dispatch(peers[2], conn.NewPieceHashMessage(0, hash)))
+	require.False(bytes.Equal(hash, torrent.ExpectedPieceHash(0)))
+
+	require.NoError(d.dispatch(peers[1], conn.NewPieceHashMessage(0, hash)))
+	require.Equal(hash, torrent.ExpectedPieceHash(0))
+
+	require.NoError(d.dispatch(peers[2], payload()))
+	require.True(torrent.Complete())
+}
+
+func TestDispatcherIgnoresPieceHashesOfUntrustedPeers(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(32, 32)
+
+	mi, err := core.NewMetaInfo(blob.Digest, bytes.NewReader(make([]byte, 32)), 32)
+	require.NoError(err)
+	torrent, cleanup := agentstorage.TorrentFixture(mi)
+	defer cleanup()
+
+	config := Config{
+		HashProofs: HashProofConfig{Enable: true, MismatchThreshold: 2, Quorum: 1},
+	}
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	// Untrusted peers may pose as any number of peers.
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	forged := make([]byte, 32)
+	forged[0] = 1
+	for _, p := range peers {
+		require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(forged))))
+		require.Empty(pieceHashRequests(p.messages))
+	}
+	h := mi.NewPieceHash()
+	h.Write(forged)
+	for _, p := range peers {
+		require.NoError(d.dispatch(p, conn.NewPieceHashMessage(0, h.Sum(nil))))
+	}
+	require.Equal(mi.PieceHash(0), torrent.ExpectedPieceHash(0))
+}
+
+func TestDispatcherRepliesToPieceHashRequests(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[:1]), 0))
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceHashRequestMessage(0)))
+	require.NoError(d.dispatch(p, conn.NewPieceHashRequestMessage(1)))
+
+	sent := p.messages.(*mockMessages).sent
+	require.Len(sent, 2)
+	require.Equal(blob.MetaInfo.PieceHash(0), sent[0].Message.PieceHash.Hash)
+
+	// Pieces which were not verified locally are not vouched for.
+	require.Empty(sent[1].Message.PieceHash.Hash)
+}
+
+func TestDispatcherRecordsPieceProvenance(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{}, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.writeLocalPiece(
+		piecereader.NewBuffer(blob.Content[1:2]), 1, provenance.SourceIngest))
+
+	clk.Add(time.Second)
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	require.NoError(d.dispatch(p, msg))
+
+	require.Equal([]provenance.Piece{{
+		Index:  0,
+		Source: provenance.SourcePeer,
+		PeerID: p.id.String(),
+		Time:   clk.Now(),
+	}, {
+		Index:  1,
+		Source: provenance.SourceIngest,
+		Time:   clk.Now().Add(-time.Second),
+	}}, d.Provenance())
+}
+
 func TestDispatcherHandlePiecePayloadSendsCompleteMessage(t *testing.T) {
 	require := require.New(t)
 
@@ -417,6 +1020,29 @@ func TestDispatcherHandleCompleteRequestsPieces(t *testing.T) {
 	require.False(closed(p.messages))
 }
 
+func TestDispatcherPauseStopsPieceRequestsUntilResumed(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{PipelineLimit: 4}, clock.NewMock(), torrent)
+
+	d.Pause()
+	require.True(d.Paused())
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p)
+	require.Empty(numRequestsPerPiece(p.messages))
+
+	d.Resume()
+	require.False(d.Paused())
+	require.Len(numRequestsPerPiece(p.messages), 4)
+}
+
 func TestDispatcherPeerPieceCounts(t *testing.T) {
 	require := require.New(t)
 
@@ -472,3 +1098,369 @@ func TestDispatcherPeerPieceCounts(t *testing.T) {
 	require.Equal(1, d.numPeersByPiece.Get(1))
 	require.Equal(2, d.numPeersByPiece.Get(2))
 }
+
+func TestDispatcherPeerUtilities(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{}, clk, torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, true), newMockMessages())
+	require.NoError(err)
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	require.NoError(d.dispatch(p1, msg))
+
+	utilities := d.PeerUtilities()
+
+	// Only p1 sent a piece. Piece 0 is no longer needed, and pieces 1 and 2
+	// are each only available from one peer.
+	require.Equal(PeerUtility{DownloadRate: 0.1, Rarity: 1}, utilities[p1.id])
+	require.Equal(PeerUtility{Rarity: 1}, utilities[p2.id])
+}
+
+func TestDispatcherPartialSeeding(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	require.Nil(d.HaveRanges())
+	require.True(d.NeedsAnyPiece(core.PieceRanges{{Start: 0, End: 0}}))
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, false, false), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		msg := conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))
+		require.NoError(d.dispatch(p, msg))
+	}
+
+	require.Equal(core.PieceRanges{{Start: 0, End: 1}}, d.HaveRanges())
+	require.False(d.NeedsAnyPiece(core.PieceRanges{{Start: 0, End: 1}}))
+	require.True(d.NeedsAnyPiece(core.PieceRanges{{Start: 1, End: 2}}))
+}
+
+type progressEvents struct {
+	noopEvents
+	percents chan int
+}
+
+func (e progressEvents) DispatcherProgress(d *Dispatcher, percent int) {
+	e.percents <- percent
+}
+
+func TestDispatcherReportsProgressMilestones(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	events := progressEvents{percents: make(chan int, 4)}
+	d, err := newDispatcher(
+		Config{},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		events,
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger(),
+		rand.New(rand.NewSource(0)))
+	require.NoError(err)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		msg := conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))
+		require.NoError(d.dispatch(p, msg))
+
+		select {
+		case percent := <-events.percents:
+			require.Equal(25*(i+1), percent)
+		case <-time.After(5 * time.Second):
+			require.FailNow("timed out waiting for progress")
+		}
+	}
+}
+
+func TestDispatcherStateTransitions(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{EndgameThreshold: 1}, clock.NewMock(), torrent)
+	require.Equal(StateInitializing, d.State())
+
+	var transitions []string
+	d.AddStateChangeHook(func(_ *Dispatcher, from, to State) {
+		transitions = append(transitions, fmt.Sprintf("%s->%s", from, to))
+	})
+
+	require.True(d.setState(StateAnnouncing))
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	require.Equal(StateDownloading, d.State())
+
+	require.NoError(d.removePeer(p1))
+	require.Equal(StateAnnouncing, d.State())
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p2, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.Equal(StateEndgame, d.State())
+
+	require.NoError(d.dispatch(p2, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))))
+	require.Equal(StateSeeding, d.State())
+
+	// Seeding is only left via teardown.
+	require.False(d.setState(StateDownloading))
+
+	d.TearDown()
+	require.Equal(StateClosed, d.State())
+
+	require.Equal([]string{
+		"initializing->announcing",
+		"announcing->downloading",
+		"downloading->announcing",
+		"announcing->downloading",
+		"downloading->endgame",
+		"endgame->seeding",
+		"seeding->draining",
+		"draining->closed",
+	}, transitions)
+}
+
+func TestDispatcherCompleteFollowsState(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	require.True(d.setState(StateAnnouncing))
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	require.False(d.Complete())
+
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content))))
+	require.Equal(StateSeeding, d.State())
+	require.True(d.Complete())
+
+	// Torn down dispatchers remain complete if they were seeding.
+	d.TearDown()
+	require.Equal(StateClosed, d.State())
+	require.True(d.Complete())
+}
+
+func TestDispatcherTornDownBeforeSeedingIsIncomplete(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	require.True(d.setState(StateAnnouncing))
+
+	d.TearDown()
+	require.Equal(StateClosed, d.State())
+	require.False(d.Complete())
+}
+
+func heartbeats(messages Messages) [][]int32 {
+	var hs [][]int32
+	for _, msg := range messages.(*mockMessages).sent {
+		if msg.Message.Type == p2p.Message_HEARTBEAT {
+			hs = append(hs, msg.Message.Heartbeat.Pieces)
+		}
+	}
+	return hs
+}
+
+func TestDispatcherHeartbeatsCarryGainedPieces(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	for _, i := range []int{2, 0} {
+		require.NoError(d.writeLocalPiece(
+			piecereader.NewBuffer(blob.Content[i:i+1]), i, provenance.SourceIngest))
+	}
+	d.sendHeartbeats()
+	d.sendHeartbeats()
+
+	require.Equal([][]int32{{2, 0}, {}}, heartbeats(p1.messages))
+
+	// Pieces gained before a peer is added are covered by its handshake.
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.writeLocalPiece(
+		piecereader.NewBuffer(blob.Content[1:2]), 1, provenance.SourceIngest))
+	d.sendHeartbeats()
+
+	require.Equal([][]int32{{2, 0}, {}, {1}}, heartbeats(p1.messages))
+	require.Equal([][]int32{{1}}, heartbeats(p2.messages))
+}
+
+func TestDispatcherHandleHeartbeatUpdatesPeerAvailability(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// Duplicate and out of bounds pieces are ignored.
+	require.NoError(d.dispatch(p, conn.NewHeartbeatMessage([]int{0, 2, 0, 7})))
+
+	require.Equal(1, d.numPeersByPiece.Get(0))
+	require.Equal(0, d.numPeersByPiece.Get(1))
+	require.Equal(1, d.numPeersByPiece.Get(2))
+	require.True(p.bitfield.Has(0))
+	require.True(p.bitfield.Has(2))
+
+	requests := numRequestsPerPiece(p.messages)
+	require.Equal(1, requests[0])
+	require.Equal(1, requests[2])
+
+	// Pieces already known to be available are not counted again.
+	require.NoError(d.dispatch(p, conn.NewHeartbeatMessage([]int{0})))
+	require.Equal(1, d.numPeersByPiece.Get(0))
+}
+
+func TestDispatcherWriteInline(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 4)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	require.Error(d.WriteInline(blob.Content[:9]))
+
+	corrupt := append([]byte(nil), blob.Content...)
+	corrupt[9]++
+	require.Error(d.WriteInline(corrupt))
+	require.False(d.Complete())
+
+	require.NoError(d.WriteInline(blob.Content))
+	require.True(d.Complete())
+	for _, p := range d.Provenance() {
+		require.Equal(provenance.SourceInline, p.Source)
+	}
+}
+
+func TestDispatcherResendsRequestsOfResumedSessions(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	peerID := core.PeerIDFixture()
+	bitfield := bitsetutil.FromBools(true, true, true, true)
+
+	interrupted := newMockMessages()
+	interrupted.resumable = true
+	p, err := d.addPeer(peerID, bitfield, interrupted)
+	require.NoError(err)
+	d.maybeRequestMorePieces(p)
+
+	pending := d.pieceRequestManager.PendingPieces(peerID)
+	require.NotEmpty(pending)
+
+	require.NoError(d.removePeer(p))
+	require.Equal(pending, d.pieceRequestManager.PendingPieces(peerID))
+
+	resumed := newMockMessages()
+	p, err = d.addPeer(peerID, bitfield, resumed)
+	require.NoError(err)
+	d.resendPendingRequests(p)
+
+	expected := make(map[int]int)
+	for _, i := range pending {
+		expected[i] = 1
+	}
+	require.Equal(expected, numRequestsPerPiece(resumed))
+
+	// Requests of conns which were closed rather than interrupted are dropped.
+	require.NoError(d.removePeer(p))
+	require.Empty(d.pieceRequestManager.PendingPieces(peerID))
+}
+
+func TestTorrentAccessWatcherReferencesHandleWhilePieceReadersAreOpen(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	w := leakwatch.New(leakwatch.Config{}, clk, tally.NoopScope, zap.NewNop().Sugar())
+	h := w.Open(torrent.InfoHash(), "torrent_control")
+
+	tw := newTorrentAccessWatcher(torrent, clk)
+	tw.handle = h
+
+	require.NoError(tw.WritePiece(piecereader.NewBuffer(blob.Content[:1]), 0))
+	pr, err := tw.GetPieceReader(0)
+	require.NoError(err)
+
+	// Reading a missing piece fails without holding a reference.
+	_, err = tw.GetPieceReader(1)
+	require.Error(err)
+
+	h.Release()
+	leaks := w.Released()
+	require.Len(leaks, 1)
+	require.Equal([]string{"piece_reader(0)"}, leaks[0].References)
+
+	require.NoError(pr.Close())
+	require.Equal(0, w.NumOpen())
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+var errTornDown = errors.New("dispatcher torn down")
+
+// FetchFallback writes all missing pieces of the torrent by reading them from
+// r, bypassing the swarm. Pieces are verified and announced to peers as they
+// are written, and pieces which peers deliver concurrently are skipped.
+func (d *Dispatcher) FetchFallback(r fallback.Reader, namespace string) error {
+	for _, i := range d.torrent.MissingPieces() {
+		if s := d.State(); s == StateDraining || s == StateClosed {
+			return errTornDown
+		}
+		if d.torrent.HasPiece(i) {
+			continue
+		}
+		offset := int64(i) * d.torrent.MaxPieceLength()
+		b, err := r.ReadRange(namespace, d.torrent.Digest(), offset, d.torrent.PieceLength(i))
+		if err != nil {
+			return fmt.Errorf("read piece %d: %s", i, err)
+		}
+		if err := d.writeLocalPiece(piecereader.NewBuffer(b), i, provenance.SourceFallback); err != nil {
+			return fmt.Errorf("write piece %d: %s", i, err)
+		}
+		d.stats.Counter("fallback_pieces").Inc(1)
+	}
+	return nil
+}
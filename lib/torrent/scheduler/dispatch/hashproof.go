@@ -0,0 +1,190 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// HashProofConfig defines the recovery of pieces whose expected hash in the
+// local metainfo is corrupt. Once payloads of a piece from several distinct
+// peers fail verification, the expected hash of the piece is requested from
+// all trusted peers which have it, and is overridden if enough of them agree
+// on a different hash. Without recovery, such pieces can never complete, and
+// the whole download has to be aborted.
+//
+// Since peer ids are self-declared, only peers marked via TrustPeer, i.e.
+// origins, are asked for hashes, and hashes from other peers are ignored.
+// Torrents completed with overridden hashes are still verified against the
+// digest of the blob by storage before they are committed.
+//
+// Peers always reply to piece hash requests, regardless of Enable.
+type HashProofConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// MismatchThreshold is the number of distinct peers whose payloads of a
+	// piece must fail verification before the hash of the piece is requested.
+	MismatchThreshold int `yaml:"mismatch_threshold"`
+
+	// Quorum is the number of trusted peers which must reply with the same hash
+	// before it is used over the local metainfo.
+	Quorum int `yaml:"quorum"`
+}
+
+func (c HashProofConfig) applyDefaults() HashProofConfig {
+	if c.MismatchThreshold == 0 {
+		c.MismatchThreshold = 3
+	}
+	if c.Quorum == 0 {
+		c.Quorum = 1
+	}
+	return c
+}
+
+// hashProofs tracks hash mismatches and outstanding hash requests per piece.
+type hashProofs struct {
+	sync.Mutex
+
+	// mismatches holds the peers whose payload of each piece failed
+	// verification.
+	mismatches map[int]map[core.PeerID]bool
+
+	// replies holds the hashes received from each peer for pieces whose hash
+	// was requested.
+	replies map[int]map[core.PeerID]string
+}
+
+// TrustPeer marks the peer of peerID as a source of expected piece hashes. Only
+// peers whose identity was established otherwise than by their self-declared
+// peer id may be trusted, e.g. origins dialed at the address handed out by the
+// tracker. No-ops if the peer was not added.
+func (d *Dispatcher) TrustPeer(peerID core.PeerID) {
+	if v, ok := d.peers.Load(peerID); ok {
+		v.(*peer).trusted.Store(true)
+	}
+}
+
+func newHashProofs() *hashProofs {
+	return &hashProofs{
+		mismatches: make(map[int]map[core.PeerID]bool),
+		replies:    make(map[int]map[core.PeerID]string),
+	}
+}
+
+// recordPieceHashMismatch records that the payload of piece i received from p
+// failed verification, and requests the hash of i from all peers which have
+// it once enough distinct peers sent mismatching payloads.
+func (d *Dispatcher) recordPieceHashMismatch(p *peer, i int) {
+	if !d.config.HashProofs.Enable {
+		return
+	}
+	if _, ok := d.torrent.Torrent.(storage.PieceHashOverrider); !ok {
+		return
+	}
+
+	d.hashProofs.Lock()
+	if d.hashProofs.mismatches[i] == nil {
+		d.hashProofs.mismatches[i] = make(map[core.PeerID]bool)
+	}
+	d.hashProofs.mismatches[i][p.id] = true
+	n := len(d.hashProofs.mismatches[i])
+	_, requested := d.hashProofs.replies[i]
+	if n < d.config.HashProofs.MismatchThreshold || requested {
+		d.hashProofs.Unlock()
+		return
+	}
+	d.hashProofs.replies[i] = make(map[core.PeerID]string)
+	d.hashProofs.Unlock()
+
+	d.log("piece", i).Warnf(
+		"Payloads from %d peers failed verification, requesting expected piece hash", n)
+	d.stats.Counter("piece_hash_requests").Inc(1)
+
+	d.peers.Range(func(k, v interface{}) bool {
+		pp := v.(*peer)
+		if pp.trusted.Load() && pp.bitfield.Has(uint(i)) {
+			pp.messages.Send(conn.NewPieceHashRequestMessage(i))
+		}
+		return true
+	})
+}
+
+func (d *Dispatcher) handlePieceHashRequest(p *peer, msg *p2p.PieceHashRequestMessage) {
+	i := int(msg.Index)
+	if i < 0 || i >= d.torrent.NumPieces() {
+		d.log("peer", p).Errorf("Piece hash request out of bounds: %d", i)
+		return
+	}
+	// Only vouch for pieces which were verified locally.
+	var hash []byte
+	if o, ok := d.torrent.Torrent.(storage.PieceHashOverrider); ok && d.torrent.HasPiece(i) {
+		hash = o.ExpectedPieceHash(i)
+	}
+	p.messages.Send(conn.NewPieceHashMessage(i, hash))
+}
+
+func (d *Dispatcher) handlePieceHash(p *peer, msg *p2p.PieceHashMessage) {
+	i := int(msg.Index)
+	if len(msg.Hash) == 0 {
+		return
+	}
+	if !p.trusted.Load() {
+		d.log("peer", p, "piece", i).Info("Ignoring piece hash from untrusted peer")
+		d.stats.Counter("piece_hash_untrusted").Inc(1)
+		return
+	}
+
+	d.hashProofs.Lock()
+	replies, ok := d.hashProofs.replies[i]
+	if !ok {
+		d.hashProofs.Unlock()
+		return
+	}
+	replies[p.id] = string(msg.Hash)
+	var agreed int
+	for _, h := range replies {
+		if h == string(msg.Hash) {
+			agreed++
+		}
+	}
+	if agreed < d.config.HashProofs.Quorum {
+		d.hashProofs.Unlock()
+		return
+	}
+	delete(d.hashProofs.replies, i)
+	delete(d.hashProofs.mismatches, i)
+	d.hashProofs.Unlock()
+
+	o := d.torrent.Torrent.(storage.PieceHashOverrider)
+	if bytes.Equal(o.ExpectedPieceHash(i), msg.Hash) {
+		// The local metainfo is sound, so the mismatching peers are at fault.
+		d.log("piece", i).Infof("%d trusted peers confirmed expected piece hash", agreed)
+		d.stats.Counter("piece_hash_confirmed").Inc(1)
+		return
+	}
+	if err := o.OverridePieceHash(i, msg.Hash); err != nil {
+		d.log("piece", i).Errorf("Error overriding piece hash: %s", err)
+		return
+	}
+	d.log("piece", i).Warnf("Overrode expected piece hash agreed on by %d trusted peers", agreed)
+	d.stats.Counter("piece_hash_overrides").Inc(1)
+
+	d.maybeRequestMorePieces(p)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"time"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// HeartbeatConfig defines periodic heartbeats sent to peers while the torrent
+// is in progress. Each heartbeat carries the pieces gained since the previous
+// heartbeat to the peer, such that peers which missed announce piece messages
+// still converge on an accurate view of our availability, without exchanging
+// full bitfields.
+//
+// Peers which predate heartbeats log an error per heartbeat received, so
+// heartbeats should only be enabled once all peers are upgraded.
+type HeartbeatConfig struct {
+	Enable bool `yaml:"enable"`
+
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c HeartbeatConfig) applyDefaults() HeartbeatConfig {
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	return c
+}
+
+// recordGained appends piece i to the pieces gained by d, to be included in
+// the next heartbeat to each peer.
+func (d *Dispatcher) recordGained(i int) {
+	d.gainedMu.Lock()
+	defer d.gainedMu.Unlock()
+
+	d.gained = append(d.gained, i)
+}
+
+// gainedSince returns the pieces gained since the previous heartbeat to p.
+func (d *Dispatcher) gainedSince(p *peer) []int {
+	d.gainedMu.Lock()
+	defer d.gainedMu.Unlock()
+
+	delta := d.gained[p.heartbeatSeq:]
+	p.heartbeatSeq = len(d.gained)
+	return delta
+}
+
+// initHeartbeat marks all pieces gained so far as known to p, since they are
+// included in the bitfield p received during handshake.
+func (d *Dispatcher) initHeartbeat(p *peer) {
+	d.gainedMu.Lock()
+	defer d.gainedMu.Unlock()
+
+	p.heartbeatSeq = len(d.gained)
+}
+
+func (d *Dispatcher) heartbeatLoop() {
+	for {
+		select {
+		case <-d.clk.After(d.config.Heartbeat.Interval):
+			d.sendHeartbeats()
+		case <-d.pendingPiecesDone:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) sendHeartbeats() {
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		p.messages.Send(conn.NewHeartbeatMessage(d.gainedSince(p)))
+		return true
+	})
+}
+
+func (d *Dispatcher) handleHeartbeat(p *peer, msg *p2p.HeartbeatMessage) {
+	var gained int
+	for _, i := range msg.GetPieces() {
+		if i < 0 || int(i) >= d.torrent.NumPieces() {
+			d.log("peer", p).Errorf("Heartbeat piece out of bounds: %d", i)
+			continue
+		}
+		if p.bitfield.Has(uint(i)) {
+			continue
+		}
+		p.bitfield.Set(uint(i), true)
+		d.numPeersByPiece.Increment(int(i))
+		gained++
+	}
+	if gained > 0 {
+		// Every gained piece should have been announced already, so any
+		// piece learned from a heartbeat indicates a lost announcement.
+		d.stats.Counter("heartbeat_repaired_pieces").Inc(int64(gained))
+		d.maybeRequestMorePieces(p)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+var errIngestTooLong = errors.New("content exceeds torrent length")
+
+// Ingest writes blob content read sequentially from r into the torrent, e.g.
+// as an upload arrives. Each piece is verified and announced to peers as soon
+// as it is written, such that it may be served to the swarm before the whole
+// blob is written. Pieces which are already complete are skipped.
+func (d *Dispatcher) Ingest(r io.Reader) error {
+	buf := make([]byte, d.torrent.MaxPieceLength())
+	for i := 0; i < d.torrent.NumPieces(); i++ {
+		b := buf[:d.torrent.PieceLength(i)]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("read piece %d: %s", i, err)
+		}
+		if err := d.writeLocalPiece(piecereader.NewBuffer(b), i, provenance.SourceIngest); err != nil {
+			return fmt.Errorf("write piece %d: %s", i, err)
+		}
+	}
+	if n, _ := io.CopyN(ioutil.Discard, r, 1); n > 0 {
+		return errIngestTooLong
+	}
+	return nil
+}
+
+// writeLocalPiece writes piece i from a local source and announces it to all
+// peers. source is recorded as the provenance of the piece.
+func (d *Dispatcher) writeLocalPiece(src storage.PieceReader, i int, source string) error {
+	start := time.Now()
+	err := d.torrent.WritePiece(src, i)
+	d.traceStorage("write", i, start, err)
+	if err != nil {
+		if err == storage.ErrPieceComplete {
+			return nil
+		}
+		return err
+	}
+	d.stats.Counter("ingested_pieces").Inc(1)
+	d.recordProvenance(i, source, "")
+	d.recordGained(i)
+
+	d.maybeReportProgress()
+	if d.torrent.Complete() {
+		d.complete()
+	}
+
+	d.pieceRequestManager.Clear(i)
+
+	d.peers.Range(func(k, v interface{}) bool {
+		v.(*peer).messages.Send(conn.NewAnnouncePieceMessage(i))
+		return true
+	})
+	return nil
+}
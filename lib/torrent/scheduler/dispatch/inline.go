@@ -0,0 +1,45 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+// WriteInline writes all missing pieces of the torrent from content, the full
+// blob as inlined by the tracker for blobs too small to be worth swarming.
+// Pieces are verified as they are written, so corrupt content is rejected
+// without affecting pieces which peers may still deliver.
+func (d *Dispatcher) WriteInline(content []byte) error {
+	if int64(len(content)) != d.torrent.Length() {
+		return fmt.Errorf(
+			"inline content has length %d, expected %d", len(content), d.torrent.Length())
+	}
+	for _, i := range d.torrent.MissingPieces() {
+		if s := d.State(); s == StateDraining || s == StateClosed {
+			return errTornDown
+		}
+		start := int64(i) * d.torrent.MaxPieceLength()
+		end := start + d.torrent.PieceLength(i)
+		src := piecereader.NewBuffer(content[start:end])
+		if err := d.writeLocalPiece(src, i, provenance.SourceInline); err != nil {
+			return fmt.Errorf("write piece %d: %s", i, err)
+		}
+		d.stats.Counter("inline_pieces").Inc(1)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// State is a stage in the lifecycle of a Dispatcher.
+type State int32
+
+// Dispatcher states.
+const (
+	// StateInitializing is the state of a Dispatcher which is being created.
+	StateInitializing State = iota
+
+	// StateAnnouncing is the state of an incomplete Dispatcher with no peers,
+	// i.e. waiting for the tracker to hand out peers.
+	StateAnnouncing
+
+	// StateDownloading is the state of an incomplete Dispatcher with peers.
+	StateDownloading
+
+	// StateEndgame is the state of an incomplete Dispatcher which is
+	// requesting its remaining pieces from multiple peers.
+	StateEndgame
+
+	// StateSeeding is the state of a complete Dispatcher.
+	StateSeeding
+
+	// StateDraining is the state of a Dispatcher which is being torn down and
+	// is closing its connections.
+	StateDraining
+
+	// StateClosed is the terminal state of a Dispatcher.
+	StateClosed
+)
+
+// States lists all Dispatcher states.
+var States = []State{
+	StateInitializing,
+	StateAnnouncing,
+	StateDownloading,
+	StateEndgame,
+	StateSeeding,
+	StateDraining,
+	StateClosed,
+}
+
+func (s State) String() string {
+	switch s {
+	case StateInitializing:
+		return "initializing"
+	case StateAnnouncing:
+		return "announcing"
+	case StateDownloading:
+		return "downloading"
+	case StateEndgame:
+		return "endgame"
+	case StateSeeding:
+		return "seeding"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("unknown(%d)", int32(s))
+}
+
+// _validTransitions maps each state to the states it may transition to.
+var _validTransitions = map[State][]State{
+	StateInitializing: {StateAnnouncing, StateSeeding, StateDraining},
+	StateAnnouncing:   {StateDownloading, StateSeeding, StateDraining},
+	StateDownloading:  {StateAnnouncing, StateEndgame, StateSeeding, StateDraining},
+	StateEndgame:      {StateAnnouncing, StateSeeding, StateDraining},
+	StateSeeding:      {StateDraining},
+	StateDraining:     {StateClosed},
+	StateClosed:       {},
+}
+
+func validTransition(from, to State) bool {
+	for _, s := range _validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateChangeHook is called after a Dispatcher transitions between states.
+// Hooks are called synchronously and must not block.
+type StateChangeHook func(d *Dispatcher, from, to State)
+
+// lifecycle tracks the state of a Dispatcher.
+type lifecycle struct {
+	state  int32 // Accessed atomically.
+	seeded int32 // Accessed atomically. Set once StateSeeding is reached.
+
+	mu    sync.RWMutex
+	hooks []StateChangeHook
+}
+
+func (l *lifecycle) get() State {
+	return State(atomic.LoadInt32(&l.state))
+}
+
+// hasSeeded returns true if l ever transitioned to StateSeeding.
+func (l *lifecycle) hasSeeded() bool {
+	return atomic.LoadInt32(&l.seeded) == 1
+}
+
+func (l *lifecycle) addHook(h StateChangeHook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, h)
+}
+
+// transition atomically moves l to the to state, if the transition from the
+// current state is valid. Returns the previous state and whether the
+// transition occurred.
+func (l *lifecycle) transition(to State) (State, bool) {
+	for {
+		cur := l.get()
+		if !validTransition(cur, to) {
+			return cur, false
+		}
+		if atomic.CompareAndSwapInt32(&l.state, int32(cur), int32(to)) {
+			if to == StateSeeding {
+				atomic.StoreInt32(&l.seeded, 1)
+			}
+			return cur, true
+		}
+	}
+}
+
+func (l *lifecycle) runHooks(d *Dispatcher, from, to State) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, h := range l.hooks {
+		h(d, from, to)
+	}
+}
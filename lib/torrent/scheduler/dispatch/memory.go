@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+	"sync"
+
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// MemoryConfig bounds the memory of pieces requested from peers, which are
+// buffered in full between being received and written to disk. Each torrent
+// may only use a share of the budget, such that a single torrent with many
+// peers cannot starve all other torrents.
+type MemoryConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Budget is the maximum bytes of piece requests in flight across all
+	// torrents.
+	Budget uint64 `yaml:"budget"`
+
+	// TorrentShare is the fraction of Budget which a torrent of priority 0
+	// may have in flight. The share doubles with each priority level above 0
+	// and halves with each level below, up to the whole budget.
+	TorrentShare float64 `yaml:"torrent_share"`
+}
+
+func (c MemoryConfig) applyDefaults() MemoryConfig {
+	if c.Budget == 0 {
+		c.Budget = 512 * memsize.MB
+	}
+	if c.TorrentShare == 0 {
+		c.TorrentShare = 0.25
+	}
+	return c
+}
+
+// MemoryBudget tracks the bytes of piece requests in flight across all
+// Dispatchers. MemoryBudget is thread-safe, and a nil MemoryBudget never
+// limits piece requests.
+type MemoryBudget struct {
+	config MemoryConfig
+	stats  tally.Scope
+
+	mu       sync.Mutex
+	inflight map[core.InfoHash]int64
+	total    int64
+}
+
+// NewMemoryBudget creates a new MemoryBudget.
+func NewMemoryBudget(config MemoryConfig, stats tally.Scope) *MemoryBudget {
+	return &MemoryBudget{
+		config: config.applyDefaults(),
+		stats: stats.Tagged(map[string]string{
+			"module": "memorybudget",
+		}),
+		inflight: make(map[core.InfoHash]int64),
+	}
+}
+
+// torrentLimit returns the bytes which a torrent of priority may have in
+// flight.
+func (b *MemoryBudget) torrentLimit(priority int) int64 {
+	share := math.Min(math.Ldexp(b.config.TorrentShare, priority), 1)
+	return int64(share * float64(b.config.Budget))
+}
+
+// quota records that the torrent of h has pending bytes in flight, and returns
+// the number of additional pieces of pieceLength it may request, or false if
+// requests are not limited. A torrent with nothing in flight may always
+// request a single piece, such that torrents with pieces larger than their
+// share still make progress.
+func (b *MemoryBudget) quota(
+	h core.InfoHash, priority int, pending, pieceLength int64) (int, bool) {
+
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setLocked(h, pending)
+
+	avail := b.torrentLimit(priority) - pending
+	if global := int64(b.config.Budget) - b.total; global < avail {
+		avail = global
+	}
+	n := 0
+	if avail > 0 && pieceLength > 0 {
+		n = int(avail / pieceLength)
+	}
+	if n == 0 {
+		if pending == 0 {
+			return 1, true
+		}
+		b.stats.Counter("throttled_piece_requests").Inc(1)
+	}
+	return n, true
+}
+
+// set records that the torrent of h has pending bytes in flight.
+func (b *MemoryBudget) set(h core.InfoHash, pending int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setLocked(h, pending)
+}
+
+// release removes the torrent of h from the budget.
+func (b *MemoryBudget) release(h core.InfoHash) {
+	b.set(h, 0)
+}
+
+func (b *MemoryBudget) setLocked(h core.InfoHash, pending int64) {
+	b.total += pending - b.inflight[h]
+	if pending == 0 {
+		delete(b.inflight, h)
+	} else {
+		b.inflight[h] = pending
+	}
+	b.stats.Gauge("inflight_piece_bytes").Update(float64(b.total))
+}
+
+// InFlight returns the total bytes of piece requests in flight.
+func (b *MemoryBudget) InFlight() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total
+}
@@ -18,8 +18,11 @@ import (
 	"time"
 
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/bitsetutil"
+
 	"github.com/andres-erbsen/clock"
 	"github.com/willf/bitset"
+	"go.uber.org/atomic"
 )
 
 // peer consolidates bookeeping for a remote peer.
@@ -27,7 +30,7 @@ type peer struct {
 	id core.PeerID
 
 	// Tracks the pieces which the remote peer has.
-	bitfield *syncBitfield
+	bitfield *bitsetutil.SyncBitSet
 
 	messages Messages
 
@@ -36,6 +39,18 @@ type peer struct {
 	// May be accessed outside of the peer struct.
 	pstats *peerStats
 
+	// Rates of good pieces received from and pieces sent to the peer.
+	downloadRate *rateMeter
+	uploadRate   *rateMeter
+
+	// trusted marks that the identity of the peer was verified, such that it
+	// may vouch for expected piece hashes.
+	trusted atomic.Bool
+
+	// heartbeatSeq is the number of gained pieces of the Dispatcher already
+	// sent to the peer. Protected by the Dispatcher gainedMu.
+	heartbeatSeq int
+
 	mu                    sync.Mutex // Protects the following fields:
 	lastGoodPieceReceived time.Time
 	lastPieceSent         time.Time
@@ -49,11 +64,13 @@ func newPeer(
 	pstats *peerStats) *peer {
 
 	return &peer{
-		id:       peerID,
-		bitfield: newSyncBitfield(b),
-		messages: messages,
-		clk:      clk,
-		pstats:   pstats,
+		id:           peerID,
+		bitfield:     bitsetutil.NewSyncBitSet(b),
+		messages:     messages,
+		clk:          clk,
+		pstats:       pstats,
+		downloadRate: newRateMeter(clk),
+		uploadRate:   newRateMeter(clk),
 	}
 }
 
@@ -100,6 +117,9 @@ type peerStats struct {
 	goodPiecesReceived int
 	// Pieces we received from the peer that we already had.
 	duplicatePiecesReceived int
+	// Pieces we received from the peer that failed verification, and piece
+	// requests the peer failed.
+	badPiecesReceived int
 }
 
 func (s *peerStats) getPieceRequestsSent() int {
@@ -171,3 +191,17 @@ func (s *peerStats) incrementDuplicatePiecesReceived() {
 
 	s.duplicatePiecesReceived++
 }
+
+func (s *peerStats) getBadPiecesReceived() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.badPiecesReceived
+}
+
+func (s *peerStats) incrementBadPiecesReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.badPiecesReceived++
+}
@@ -24,10 +24,12 @@ import (
 // DefaultPolicy randomly selects pieces to request.
 const DefaultPolicy = "default"
 
-type defaultPolicy struct{}
+type defaultPolicy struct {
+	rand *rand.Rand
+}
 
-func newDefaultPolicy() *defaultPolicy {
-	return &defaultPolicy{}
+func newDefaultPolicy(rng *rand.Rand) *defaultPolicy {
+	return &defaultPolicy{rng}
 }
 
 func (p *defaultPolicy) selectPieces(
@@ -54,7 +56,7 @@ func (p *defaultPolicy) selectPieces(
 
 			// Replace elements in the 'reservoir' with decreasing probability.
 		} else {
-			j := rand.Intn(k)
+			j := p.rand.Intn(k)
 			if j < limit {
 				pieces[j] = int(i)
 			}
@@ -15,6 +15,7 @@ package piecerequest
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -68,12 +69,14 @@ type Manager struct {
 	pipelineLimit int
 }
 
-// NewManager creates a new Manager.
+// NewManager creates a new Manager. Randomized piece selection draws from rng,
+// which is only accessed while holding the Manager lock.
 func NewManager(
 	clk clock.Clock,
 	timeout time.Duration,
 	policy string,
-	pipelineLimit int) (*Manager, error) {
+	pipelineLimit int,
+	rng *rand.Rand) (*Manager, error) {
 
 	m := &Manager{
 		requests:       make(map[int][]*Request),
@@ -85,15 +88,24 @@ func NewManager(
 
 	switch policy {
 	case DefaultPolicy:
-		m.policy = newDefaultPolicy()
+		m.policy = newDefaultPolicy(rng)
 	case RarestFirstPolicy:
-		m.policy = newRarestFirstPolicy()
+		m.policy = newRarestFirstPolicy(rng)
 	default:
 		return nil, fmt.Errorf("invalid piece selection policy: %s", policy)
 	}
 	return m, nil
 }
 
+// SetPipelineLimit sets the number of requests which may be pending per peer.
+// Requests which are already pending are unaffected.
+func (m *Manager) SetPipelineLimit(limit int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.pipelineLimit = limit
+}
+
 // ReservePieces selects the next piece(s) to be requested from given peer.
 // It selects peers on a rarity-first basis using numPeersByPiece.
 // If allowDuplicates is set, may return pieces which have already been
@@ -104,10 +116,25 @@ func (m *Manager) ReservePieces(
 	numPeersByPiece syncutil.Counters,
 	allowDuplicates bool) ([]int, error) {
 
+	return m.ReservePiecesUpTo(peerID, candidates, numPeersByPiece, allowDuplicates, -1)
+}
+
+// ReservePiecesUpTo is ReservePieces, but reserves at most max pieces. A
+// negative max reserves up to the pipeline limit.
+func (m *Manager) ReservePiecesUpTo(
+	peerID core.PeerID,
+	candidates *bitset.BitSet,
+	numPeersByPiece syncutil.Counters,
+	allowDuplicates bool,
+	max int) ([]int, error) {
+
 	m.Lock()
 	defer m.Unlock()
 
 	quota := m.requestQuota(peerID)
+	if max >= 0 && max < quota {
+		quota = max
+	}
 	if quota <= 0 {
 		return nil, nil
 	}
@@ -162,6 +189,21 @@ func (m *Manager) Clear(i int) {
 	}
 }
 
+// PendingPeers returns the peers with pending requests for piece i, which
+// includes multiple peers if the request was duplicated.
+func (m *Manager) PendingPeers(i int) []core.PeerID {
+	m.RLock()
+	defer m.RUnlock()
+
+	var peers []core.PeerID
+	for _, r := range m.requests[i] {
+		if r.Status == StatusPending && !m.expired(r) {
+			peers = append(peers, r.PeerID)
+		}
+	}
+	return peers
+}
+
 // PendingPieces returns the pieces for all pending requests to peerID in sorted
 // order. Intended primarily for testing purposes.
 func (m *Manager) PendingPieces(peerID core.PeerID) []int {
@@ -178,6 +220,22 @@ func (m *Manager) PendingPieces(peerID core.PeerID) []int {
 	return pieces
 }
 
+// NumPending returns the number of pending requests across all peers.
+func (m *Manager) NumPending() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	var n int
+	for _, pm := range m.requestsByPeer {
+		for _, r := range pm {
+			if r.Status == StatusPending && !m.expired(r) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
 // ClearPeer deletes all piece requests for peerID.
 func (m *Manager) ClearPeer(peerID core.PeerID) {
 	m.Lock()
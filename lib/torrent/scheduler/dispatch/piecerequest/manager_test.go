@@ -14,6 +14,7 @@
 package piecerequest
 
 import (
+	"math/rand"
 	"testing"
 	"time"
 
@@ -31,7 +32,7 @@ func newManager(
 	policy string,
 	pipelineLimit int) *Manager {
 
-	m, err := NewManager(clk, timeout, policy, pipelineLimit)
+	m, err := NewManager(clk, timeout, policy, pipelineLimit, rand.New(rand.NewSource(0)))
 	if err != nil {
 		panic(err)
 	}
@@ -62,6 +63,37 @@ func TestManagerPipelineLimit(t *testing.T) {
 	require.Len(m.PendingPieces(peerID), 3)
 }
 
+func TestManagerReservePiecesUpTo(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	timeout := 5 * time.Second
+
+	m := newManager(clk, timeout, DefaultPolicy, 3)
+
+	candidates := bitsetutil.FromBools(true, true, true, true)
+
+	peerA := core.PeerIDFixture()
+	pieces, err := m.ReservePiecesUpTo(peerA, candidates, countsFromInts(0, 0, 0, 0), false, 1)
+	require.NoError(err)
+	require.Len(pieces, 1)
+
+	peerB := core.PeerIDFixture()
+	pieces, err = m.ReservePiecesUpTo(peerB, candidates, countsFromInts(0, 0, 0, 0), false, 0)
+	require.NoError(err)
+	require.Empty(pieces)
+
+	pieces, err = m.ReservePiecesUpTo(peerB, candidates, countsFromInts(0, 0, 0, 0), false, 10)
+	require.NoError(err)
+	require.Len(pieces, 3)
+
+	require.Equal(4, m.NumPending())
+
+	clk.Add(timeout + 1)
+
+	require.Equal(0, m.NumPending())
+}
+
 func TestManagerReserveExpiredRequest(t *testing.T) {
 	require := require.New(t)
 
@@ -301,6 +333,31 @@ func TestManagerClearWhenAllowedDuplicates(t *testing.T) {
 	require.Equal([]int{1}, m.PendingPieces(p2))
 }
 
+func TestManagerPendingPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	timeout := 5 * time.Second
+
+	m := newManager(clk, timeout, DefaultPolicy, 1)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	for _, p := range []core.PeerID{p1, p2} {
+		pieces, err := m.ReservePieces(p, bitsetutil.FromBools(true), countsFromInts(0), true)
+		require.NoError(err)
+		require.Equal([]int{0}, pieces)
+	}
+	require.ElementsMatch([]core.PeerID{p1, p2}, m.PendingPeers(0))
+
+	m.MarkInvalid(p1, 0)
+	require.Equal([]core.PeerID{p2}, m.PendingPeers(0))
+
+	clk.Add(timeout + 1)
+	require.Empty(m.PendingPeers(0))
+}
+
 func TestManagerClearPeerWhenAllowedDuplicates(t *testing.T) {
 	require := require.New(t)
 
@@ -406,3 +463,47 @@ func TestRarestFirstPolicy(t *testing.T) {
 	require.NoError(err)
 	require.Empty(pieces)
 }
+
+func TestRarestFirstPolicyBreaksTiesRandomly(t *testing.T) {
+	require := require.New(t)
+
+	candidates := bitsetutil.FromBools(
+		true, true, true, true, true, true, true, true, true, true)
+	counts := countsFromInts(2, 2, 2, 2, 1, 2, 2, 2, 2, 2)
+
+	selected := make(map[int]bool)
+	for seed := int64(0); seed < 10; seed++ {
+		m, err := NewManager(
+			clock.NewMock(), 5*time.Second, RarestFirstPolicy, 2, rand.New(rand.NewSource(seed)))
+		require.NoError(err)
+		pieces, err := m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+		require.NoError(err)
+		require.Len(pieces, 2)
+
+		// The rarest piece is always selected first.
+		require.Equal(4, pieces[0])
+		selected[pieces[1]] = true
+	}
+	require.True(len(selected) > 1)
+}
+
+func TestDefaultPolicyIsDeterministicForSeed(t *testing.T) {
+	require := require.New(t)
+
+	candidates := bitsetutil.FromBools(
+		true, true, true, true, true, true, true, true, true, true)
+	counts := countsFromInts(0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	selectPieces := func(seed int64) []int {
+		m, err := NewManager(
+			clock.NewMock(), 5*time.Second, DefaultPolicy, 3, rand.New(rand.NewSource(seed)))
+		require.NoError(err)
+		pieces, err := m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+		require.NoError(err)
+		return pieces
+	}
+
+	for seed := int64(0); seed < 10; seed++ {
+		require.Equal(selectPieces(seed), selectPieces(seed))
+	}
+}
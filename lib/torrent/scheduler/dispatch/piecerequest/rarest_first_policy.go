@@ -14,19 +14,25 @@
 package piecerequest
 
 import (
-	"github.com/uber/kraken/utils/heap"
+	"math/rand"
+	"sort"
+
 	"github.com/uber/kraken/utils/syncutil"
 
 	"github.com/willf/bitset"
 )
 
 // RarestFirstPolicy selects pieces that the fewest of our peers have to request first.
+// Pieces which are equally rare are selected in random order, such that peers
+// downloading from the same seeder do not all request the same pieces.
 const RarestFirstPolicy = "rarest_first"
 
-type rarestFirstPolicy struct{}
+type rarestFirstPolicy struct {
+	rand *rand.Rand
+}
 
-func newRarestFirstPolicy() *rarestFirstPolicy {
-	return &rarestFirstPolicy{}
+func newRarestFirstPolicy(rng *rand.Rand) *rarestFirstPolicy {
+	return &rarestFirstPolicy{rng}
 }
 
 func (p *rarestFirstPolicy) selectPieces(
@@ -35,24 +41,34 @@ func (p *rarestFirstPolicy) selectPieces(
 	candidates *bitset.BitSet,
 	numPeersByPiece syncutil.Counters) ([]int, error) {
 
-	candidateQueue := heap.NewPriorityQueue()
+	pieces := make([]int, 0, limit)
+	if limit == 0 {
+		return pieces, nil
+	}
+
+	// Counts are snapshotted before sorting, since concurrent updates would
+	// otherwise break the ordering sort relies on.
+	type candidate struct {
+		piece    int
+		numPeers int
+	}
+	var ordered []candidate
 	for i, e := candidates.NextSet(0); e; i, e = candidates.NextSet(i + 1) {
-		candidateQueue.Push(&heap.Item{
-			Value:    int(i),
-			Priority: numPeersByPiece.Get(int(i)),
-		})
+		ordered = append(ordered, candidate{int(i), numPeersByPiece.Get(int(i))})
 	}
+	p.rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].numPeers < ordered[j].numPeers
+	})
 
-	pieces := make([]int, 0, limit)
-	for len(pieces) < limit && candidateQueue.Len() > 0 {
-		item, err := candidateQueue.Pop()
-		if err != nil {
-			return nil, err
+	for _, c := range ordered {
+		if len(pieces) == limit {
+			break
 		}
-
-		candidate := item.Value.(int)
-		if valid(candidate) {
-			pieces = append(pieces, candidate)
+		if valid(c.piece) {
+			pieces = append(pieces, c.piece)
 		}
 	}
 
@@ -0,0 +1,76 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/andres-erbsen/clock"
+)
+
+// _rateWindow is the number of seconds over which transfer rates are measured.
+const _rateWindow = 10
+
+// rateMeter measures a byte rate over a sliding window of one second buckets.
+type rateMeter struct {
+	clk clock.Clock
+
+	mu      sync.Mutex
+	buckets [_rateWindow]int64
+	last    int64 // Second of the most recent bucket.
+}
+
+func newRateMeter(clk clock.Clock) *rateMeter {
+	return &rateMeter{clk: clk, last: clk.Now().Unix()}
+}
+
+// add records n bytes transferred now.
+func (m *rateMeter) add(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.advance()
+	m.buckets[now%_rateWindow] += n
+}
+
+// rate returns the average bytes per second over the window.
+func (m *rateMeter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance()
+	var sum int64
+	for _, b := range m.buckets {
+		sum += b
+	}
+	return float64(sum) / float64(_rateWindow)
+}
+
+// advance clears the buckets of seconds which elapsed since the most recent
+// bucket, and returns the current second.
+func (m *rateMeter) advance() int64 {
+	now := m.clk.Now().Unix()
+	if now <= m.last {
+		return m.last
+	}
+	if now-m.last >= _rateWindow {
+		m.buckets = [_rateWindow]int64{}
+	} else {
+		for s := m.last + 1; s <= now; s++ {
+			m.buckets[s%_rateWindow] = 0
+		}
+	}
+	m.last = now
+	return now
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateMeter(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	m := newRateMeter(clk)
+
+	require.Zero(m.rate())
+
+	m.add(100)
+	clk.Add(time.Second)
+	m.add(300)
+	require.Equal(float64(400)/_rateWindow, m.rate())
+
+	// The first bucket falls out of the window first.
+	clk.Add((_rateWindow - 1) * time.Second)
+	require.Equal(float64(300)/_rateWindow, m.rate())
+
+	clk.Add(time.Hour)
+	require.Zero(m.rate())
+}
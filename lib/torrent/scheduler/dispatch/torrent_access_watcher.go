@@ -14,33 +14,54 @@
 package dispatch
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
 	"github.com/uber/kraken/lib/torrent/storage"
+
 	"github.com/andres-erbsen/clock"
 )
 
 // torrentAccessWatcher wraps a storage.Torrent and records when it is written to
 // and when it is read from. Read times are measured when piece readers are closed.
+// Additionally records when each individual piece was last opened for reading.
+// If a handle is set, open piece readers and piece writes in progress hold a
+// reference on it.
 type torrentAccessWatcher struct {
 	storage.Torrent
-	clk       clock.Clock
-	mu        sync.Mutex
-	lastWrite time.Time
-	lastRead  time.Time
+	clk            clock.Clock
+	handle         *leakwatch.Handle
+	mu             sync.Mutex
+	lastWrite      time.Time
+	lastRead       time.Time
+	lastPieceReads []time.Time
 }
 
 func newTorrentAccessWatcher(t storage.Torrent, clk clock.Clock) *torrentAccessWatcher {
 	return &torrentAccessWatcher{
-		Torrent:   t,
-		clk:       clk,
-		lastWrite: clk.Now(),
-		lastRead:  clk.Now(),
+		Torrent:        t,
+		clk:            clk,
+		lastWrite:      clk.Now(),
+		lastRead:       clk.Now(),
+		lastPieceReads: make([]time.Time, t.NumPieces()),
 	}
 }
 
+// acquire references the handle of w on behalf of holder. The returned
+// function drops the reference.
+func (w *torrentAccessWatcher) acquire(holder string) func() {
+	if w.handle == nil {
+		return func() {}
+	}
+	return w.handle.Acquire(holder)
+}
+
 func (w *torrentAccessWatcher) WritePiece(src storage.PieceReader, piece int) error {
+	drop := w.acquire(fmt.Sprintf("write_piece(%d)", piece))
+	defer drop()
+
 	err := w.Torrent.WritePiece(src, piece)
 	if err == nil {
 		w.touchLastWrite()
@@ -50,10 +71,13 @@ func (w *torrentAccessWatcher) WritePiece(src storage.PieceReader, piece int) er
 
 type pieceReaderCloseWatcher struct {
 	storage.PieceReader
-	w *torrentAccessWatcher
+	w    *torrentAccessWatcher
+	drop func()
 }
 
 func (w *pieceReaderCloseWatcher) Close() error {
+	defer w.drop()
+
 	err := w.PieceReader.Close()
 	if err != nil {
 		w.w.touchLastRead()
@@ -62,11 +86,14 @@ func (w *pieceReaderCloseWatcher) Close() error {
 }
 
 func (w *torrentAccessWatcher) GetPieceReader(piece int) (storage.PieceReader, error) {
+	drop := w.acquire(fmt.Sprintf("piece_reader(%d)", piece))
 	pr, err := w.Torrent.GetPieceReader(piece)
-	if err == nil {
-		pr = &pieceReaderCloseWatcher{pr, w}
+	if err != nil {
+		drop()
+		return nil, err
 	}
-	return pr, err
+	w.touchLastPieceRead(piece)
+	return &pieceReaderCloseWatcher{pr, w, drop}, nil
 }
 
 func (w *torrentAccessWatcher) touchLastWrite() {
@@ -81,6 +108,22 @@ func (w *torrentAccessWatcher) touchLastRead() {
 	w.lastRead = w.clk.Now()
 }
 
+func (w *torrentAccessWatcher) touchLastPieceRead(piece int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if piece >= 0 && piece < len(w.lastPieceReads) {
+		w.lastPieceReads[piece] = w.clk.Now()
+	}
+}
+
+func (w *torrentAccessWatcher) getLastPieceReadTimes() []time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := make([]time.Time, len(w.lastPieceReads))
+	copy(c, w.lastPieceReads)
+	return c
+}
+
 func (w *torrentAccessWatcher) getLastReadTime() time.Time {
 	w.mu.Lock()
 	defer w.mu.Unlock()
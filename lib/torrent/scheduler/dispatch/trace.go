@@ -0,0 +1,83 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+
+	"go.uber.org/zap"
+)
+
+// Tracer provides the trace loggers of torrents under investigation.
+type Tracer interface {
+	// Trace returns the logger which h is traced to, or nil if h is not being
+	// traced.
+	Trace(h core.InfoHash) *zap.SugaredLogger
+}
+
+// WithTracer configures a Dispatcher to trace all messages and storage
+// operations of its torrent to t, while t traces the torrent.
+func WithTracer(t Tracer) Option {
+	return func(d *Dispatcher) { d.tracer = t }
+}
+
+// trace returns the trace logger of d, or nil if d is not being traced.
+func (d *Dispatcher) trace() *zap.SugaredLogger {
+	if d.tracer == nil {
+		return nil
+	}
+	return d.tracer.Trace(d.torrent.InfoHash())
+}
+
+func (d *Dispatcher) traceMessage(dir string, peerID core.PeerID, msg *conn.Message, err error) {
+	if t := d.trace(); t != nil {
+		t.Debugw("Message "+dir,
+			"peer", peerID,
+			"type", msg.Message.Type.String(),
+			"message", msg.Message.String(),
+			"error", err)
+	}
+}
+
+func (d *Dispatcher) traceStorage(op string, i int, start time.Time, err error) {
+	if t := d.trace(); t != nil {
+		t.Debugw("Storage "+op,
+			"piece", i,
+			"latency", time.Since(start),
+			"error", err)
+	}
+}
+
+// tracedMessages wraps the Messages of a peer such that sent messages are
+// traced.
+type tracedMessages struct {
+	Messages
+	d      *Dispatcher
+	peerID core.PeerID
+}
+
+func (m *tracedMessages) Send(msg *conn.Message) error {
+	err := m.Messages.Send(msg)
+	m.d.traceMessage("sent", m.peerID, msg, err)
+	return err
+}
+
+// Resumable delegates to the wrapped Messages, if resumable.
+func (m *tracedMessages) Resumable() bool {
+	r, ok := m.Messages.(resumableMessages)
+	return ok && r.Resumable()
+}
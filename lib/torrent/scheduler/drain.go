@@ -0,0 +1,153 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+)
+
+// Stop gracefully shuts down the scheduler. New torrents and conns are refused
+// while in-flight handshakes finish. Conns are then closed, in-flight piece
+// writes are flushed to disk, and every torrent is announced as stopped, such
+// that the tracker stops handing out the local peer. Finally, the scheduler is
+// stopped and any pending downloads fail with ErrSchedulerStopped.
+//
+// If ctx is done before draining finishes, the scheduler is stopped
+// immediately and ctx.Err() is returned.
+func (s *scheduler) Stop(ctx context.Context) error {
+	var err error
+	s.drainOnce.Do(func() {
+		err = s.drain(ctx)
+	})
+	s.stop()
+	return err
+}
+
+func (s *scheduler) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *scheduler) drain(ctx context.Context) error {
+	s.log().Info("Draining scheduler...")
+	start := time.Now()
+
+	atomic.StoreInt32(&s.draining, 1)
+	// Wait for in-flight announces, such that none lands after the stopped
+	// announces.
+	s.announceMu.Lock()
+	s.announceMu.Unlock()
+
+	s.listener.Close()
+	if s.tunnelListener != nil {
+		s.tunnelListener.Close()
+	}
+
+	if err := s.waitForPendingConns(ctx); err != nil {
+		s.stats.Counter("drain_timeouts").Inc(1)
+		return err
+	}
+
+	result := make(chan []*dispatch.Dispatcher, 1)
+	if !s.eventLoop.send(drainConnsEvent{result}) {
+		return ErrSchedulerStopped
+	}
+	var dispatchers []*dispatch.Dispatcher
+	select {
+	case dispatchers = <-result:
+	case <-s.done:
+		return ErrSchedulerStopped
+	}
+
+	for _, d := range dispatchers {
+		if err := d.Flush(ctx); err != nil {
+			if err == ctx.Err() {
+				s.stats.Counter("drain_timeouts").Inc(1)
+				return err
+			}
+			s.log("hash", d.InfoHash()).Errorf("Error flushing torrent: %s", err)
+		}
+	}
+	for _, d := range dispatchers {
+		if err := ctx.Err(); err != nil {
+			s.stats.Counter("drain_timeouts").Inc(1)
+			return err
+		}
+		if err := s.announcer.AnnounceStopped(d.Digest(), d.InfoHash()); err != nil {
+			s.log("hash", d.InfoHash()).Errorf("Error announcing stopped torrent: %s", err)
+		}
+	}
+
+	s.stats.Timer("drain").Record(time.Since(start))
+	s.log().Infof("Drained %d torrents", len(dispatchers))
+	return nil
+}
+
+// waitForPendingConns blocks until no handshakes are in flight.
+func (s *scheduler) waitForPendingConns(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		result := make(chan int, 1)
+		if !s.eventLoop.send(pendingConnsEvent{result}) {
+			return ErrSchedulerStopped
+		}
+		select {
+		case pending := <-result:
+			if pending == 0 {
+				return nil
+			}
+		case <-s.done:
+			return ErrSchedulerStopped
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pendingConnsEvent occurs when the number of in-flight handshakes is
+// requested.
+type pendingConnsEvent struct {
+	result chan int
+}
+
+func (e pendingConnsEvent) apply(s *state) {
+	pending, _ := s.conns.NumConns()
+	e.result <- pending
+}
+
+// drainConnsEvent occurs once a draining scheduler has no handshakes in
+// flight. Closes all conns, such that no further pieces are written, and
+// returns the dispatchers of all torrents to be flushed.
+type drainConnsEvent struct {
+	result chan []*dispatch.Dispatcher
+}
+
+func (e drainConnsEvent) apply(s *state) {
+	for _, c := range s.conns.ActiveConns() {
+		s.log("conn", c).Info("Closing conn to drain scheduler")
+		c.Close()
+	}
+	var dispatchers []*dispatch.Dispatcher
+	for _, ctrl := range s.torrentControls {
+		dispatchers = append(dispatchers, ctrl.dispatcher)
+	}
+	e.result <- dispatchers
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// EventRecord describes an event applied to the Scheduler.
+type EventRecord struct {
+	Event    string            `json:"event"`
+	Class    string            `json:"class"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Applied  time.Time         `json:"applied"`
+	Duration time.Duration     `json:"duration"`
+}
+
+// eventFields holds the key fields of an event, e.g. the info hash of the
+// torrent it applies to.
+type eventFields map[string]string
+
+// eventAudit retains the most recently applied events in a ring buffer, such
+// that operators can reconstruct what led to a wedged swarm. eventAudit is
+// thread-safe, since it is read outside of the event loop, and a nil
+// eventAudit records nothing.
+type eventAudit struct {
+	mu      sync.Mutex
+	records []EventRecord
+	next    int
+	full    bool
+}
+
+// newEventAudit returns an eventAudit which retains the last size events, or
+// nil if size is not positive.
+func newEventAudit(size int) *eventAudit {
+	if size <= 0 {
+		return nil
+	}
+	return &eventAudit{records: make([]EventRecord, size)}
+}
+
+func (a *eventAudit) record(r EventRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.records[a.next] = r
+	a.next++
+	if a.next == len(a.records) {
+		a.next = 0
+		a.full = true
+	}
+}
+
+// snapshot returns the retained events, oldest first.
+func (a *eventAudit) snapshot() []EventRecord {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var result []EventRecord
+	if a.full {
+		result = append(result, a.records[a.next:]...)
+	}
+	return append(result, a.records[:a.next]...)
+}
+
+func hashFields(h core.InfoHash) eventFields {
+	return eventFields{"hash": h.String()}
+}
+
+func peerFields(peerID core.PeerID, h core.InfoHash) eventFields {
+	return eventFields{"peer": peerID.String(), "hash": h.String()}
+}
+
+func connFields(c *conn.Conn) eventFields {
+	if c == nil {
+		return nil
+	}
+	return peerFields(c.PeerID(), c.InfoHash())
+}
+
+func (e connClosedEvent) describe() eventFields { return connFields(e.c) }
+
+func (e incomingHandshakeEvent) describe() eventFields {
+	return peerFields(e.pc.PeerID(), e.pc.InfoHash())
+}
+
+func (e failedIncomingHandshakeEvent) describe() eventFields {
+	return peerFields(e.peerID, e.infoHash)
+}
+
+func (e incomingConnEvent) describe() eventFields {
+	f := connFields(e.c)
+	if f != nil {
+		f["namespace"] = e.namespace
+	}
+	return f
+}
+
+func (e failedOutgoingHandshakeEvent) describe() eventFields {
+	f := peerFields(e.peerID, e.infoHash)
+	f["error"] = e.err.Error()
+	return f
+}
+
+func (e outgoingConnEvent) describe() eventFields { return connFields(e.c) }
+
+func (e announceResultEvent) describe() eventFields {
+	f := hashFields(e.infoHash)
+	f["peers"] = strconv.Itoa(len(e.peers))
+	return f
+}
+
+func (e starvedTorrentEvent) describe() eventFields {
+	return hashFields(e.infoHash)
+}
+
+func (e cleanupCheckEvent) describe() eventFields {
+	return hashFields(e.infoHash)
+}
+
+func (e announceErrEvent) describe() eventFields {
+	f := hashFields(e.infoHash)
+	f["error"] = e.err.Error()
+	return f
+}
+
+func (e newTorrentEvent) describe() eventFields {
+	return eventFields{
+		"namespace": e.namespace,
+		"hash":      e.torrent.InfoHash().String(),
+		"digest":    e.torrent.Digest().Hex(),
+	}
+}
+
+func (e ingestTorrentEvent) describe() eventFields {
+	return eventFields{
+		"namespace": e.namespace,
+		"hash":      e.torrent.InfoHash().String(),
+		"digest":    e.torrent.Digest().Hex(),
+	}
+}
+
+func (e dispatcherCompleteEvent) describe() eventFields {
+	return hashFields(e.dispatcher.InfoHash())
+}
+
+func (e dispatcherProgressEvent) describe() eventFields {
+	f := hashFields(e.dispatcher.InfoHash())
+	f["percent"] = strconv.Itoa(e.percent)
+	return f
+}
+
+func (e peerRemovedEvent) describe() eventFields { return peerFields(e.peerID, e.infoHash) }
+
+func (e removeTorrentEvent) describe() eventFields {
+	return eventFields{"digest": e.digest.Hex()}
+}
+
+func (e cancelTorrentEvent) describe() eventFields  { return hashFields(e.infoHash) }
+func (e abandonTorrentEvent) describe() eventFields { return hashFields(e.infoHash) }
+func (e pauseTorrentEvent) describe() eventFields   { return hashFields(e.infoHash) }
+func (e resumeTorrentEvent) describe() eventFields  { return hashFields(e.infoHash) }
+func (e torrentPeersEvent) describe() eventFields   { return hashFields(e.infoHash) }
+func (e announceNowEvent) describe() eventFields    { return hashFields(e.infoHash) }
+func (e progressEvent) describe() eventFields       { return hashFields(e.infoHash) }
+
+func (e setTorrentRateLimitEvent) describe() eventFields {
+	f := hashFields(e.infoHash)
+	f["bytes_per_sec"] = strconv.FormatInt(e.bytesPerSec, 10)
+	return f
+}
+
+func (e deadlineEvent) describe() eventFields {
+	f := hashFields(e.infoHash)
+	f["deadline"] = e.deadline.Format(time.RFC3339)
+	return f
+}
+
+// Events without key fields.
+func (e deadlineTickEvent) describe() eventFields         { return nil }
+func (e pendingConnsEvent) describe() eventFields         { return nil }
+func (e drainConnsEvent) describe() eventFields           { return nil }
+func (e announceTickEvent) describe() eventFields         { return nil }
+func (e preemptionTickEvent) describe() eventFields       { return nil }
+func (e pieceEvictionTickEvent) describe() eventFields    { return nil }
+func (e connCapacityTickEvent) describe() eventFields     { return nil }
+func (e seedingPolicyTickEvent) describe() eventFields    { return nil }
+func (e emitStatsEvent) describe() eventFields            { return nil }
+func (e statsSnapshotEvent) describe() eventFields        { return nil }
+func (e blacklistSnapshotEvent) describe() eventFields    { return nil }
+func (e introspectionEvent) describe() eventFields        { return nil }
+func (e addTorrentListenerEvent) describe() eventFields   { return nil }
+func (e reputationExportTickEvent) describe() eventFields { return nil }
+func (e probeEvent) describe() eventFields                { return nil }
+func (e shutdownEvent) describe() eventFields             { return nil }
+func (e restoreStateEvent) describe() eventFields         { return nil }
+func (e setEvictionHookEvent) describe() eventFields      { return nil }
+func (e activeDigestsEvent) describe() eventFields        { return nil }
+func (e setPinsEvent) describe() eventFields              { return nil }
+func (e bandwidthTickEvent) describe() eventFields        { return nil }
+func (e torrentsEvent) describe() eventFields             { return nil }
+func (e seededExportEvent) describe() eventFields         { return nil }
+func (e supportBundleEvent) describe() eventFields        { return nil }
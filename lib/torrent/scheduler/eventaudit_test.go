@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func TestEventAuditRetainsMostRecentEvents(t *testing.T) {
+	require := require.New(t)
+
+	a := newEventAudit(3)
+	for _, name := range []string{"a", "b"} {
+		a.record(EventRecord{Event: name})
+	}
+
+	events := func() []string {
+		var names []string
+		for _, r := range a.snapshot() {
+			names = append(names, r.Event)
+		}
+		return names
+	}
+
+	require.Equal([]string{"a", "b"}, events())
+
+	for _, name := range []string{"c", "d", "e"} {
+		a.record(EventRecord{Event: name})
+	}
+	require.Equal([]string{"c", "d", "e"}, events())
+}
+
+func TestDisabledEventAudit(t *testing.T) {
+	require := require.New(t)
+
+	a := newEventAudit(-1)
+	require.Nil(a)
+
+	a.record(EventRecord{Event: "a"})
+	require.Empty(a.snapshot())
+}
+
+func TestApplyEventRecordsEventAudit(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	h := core.InfoHashFixture()
+	state.applyEvent(cancelTorrentEvent{h, make(chan error, 1)})
+	state.applyEvent(probeEvent{make(chan struct{})})
+
+	events := state.sched.RecentEvents()
+	require.Len(events, 2)
+
+	require.Equal("cancelTorrentEvent", events[0].Event)
+	require.Equal("control", events[0].Class)
+	require.Equal(map[string]string{"hash": h.String()}, events[0].Fields)
+
+	require.Equal("probeEvent", events[1].Event)
+	require.Equal("default", events[1].Class)
+	require.Nil(events[1].Fields)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+)
+
+// OverflowPolicy defines how an event queue handles sends once it is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the sender until the queue has room.
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDrop discards the event being sent.
+	OverflowDrop OverflowPolicy = "drop"
+)
+
+// EventQueueConfig defines the queue of a single event class.
+type EventQueueConfig struct {
+	// Size is the number of events which may be buffered before the overflow
+	// policy applies.
+	Size     int            `yaml:"size"`
+	Overflow OverflowPolicy `yaml:"overflow"`
+}
+
+func (c EventQueueConfig) applyDefaults(size int, overflow OverflowPolicy) EventQueueConfig {
+	if c.Size == 0 {
+		c.Size = size
+	}
+	if c.Overflow == "" {
+		c.Overflow = overflow
+	}
+	return c
+}
+
+func (c EventQueueConfig) validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("invalid size %d", c.Size)
+	}
+	switch c.Overflow {
+	case OverflowBlock, OverflowDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid overflow policy %q", c.Overflow)
+	}
+}
+
+// eventClass determines the priority of an event. Lower classes are applied
+// before higher classes, except on aged turns (see next), and events within a
+// class are applied in the order they were sent.
+type eventClass int
+
+const (
+	// eventClassControl covers events which change the lifecycle of torrents
+	// or the scheduler on behalf of callers, and must not wait behind
+	// bulk events. Lifecycle events share a class such that e.g. a torrent
+	// cannot be cancelled before it is added.
+	eventClassControl eventClass = iota
+
+	// eventClassDefault covers all events which do not declare a class.
+	eventClassDefault
+
+	// eventClassBulk covers high volume events whose latency does not matter,
+	// e.g. announce responses.
+	eventClassBulk
+
+	// eventClassTick covers periodic events, which are safe to skip since the
+	// next tick repeats the work.
+	eventClassTick
+
+	numEventClasses
+)
+
+func (c eventClass) String() string {
+	switch c {
+	case eventClassControl:
+		return "control"
+	case eventClassDefault:
+		return "default"
+	case eventClassBulk:
+		return "bulk"
+	case eventClassTick:
+		return "tick"
+	default:
+		return "unknown"
+	}
+}
+
+// classifiedEvent is implemented by events which do not belong to
+// eventClassDefault.
+type classifiedEvent interface {
+	class() eventClass
+}
+
+func classOf(e event) eventClass {
+	if ce, ok := e.(classifiedEvent); ok {
+		return ce.class()
+	}
+	return eventClassDefault
+}
+
+func (shutdownEvent) class() eventClass            { return eventClassControl }
+func (newTorrentEvent) class() eventClass          { return eventClassControl }
+func (ingestTorrentEvent) class() eventClass       { return eventClassControl }
+func (abandonTorrentEvent) class() eventClass      { return eventClassControl }
+func (cancelTorrentEvent) class() eventClass       { return eventClassControl }
+func (removeTorrentEvent) class() eventClass       { return eventClassControl }
+func (pauseTorrentEvent) class() eventClass        { return eventClassControl }
+func (resumeTorrentEvent) class() eventClass       { return eventClassControl }
+func (setTorrentRateLimitEvent) class() eventClass { return eventClassControl }
+func (pendingConnsEvent) class() eventClass        { return eventClassControl }
+func (drainConnsEvent) class() eventClass          { return eventClassControl }
+func (addTorrentListenerEvent) class() eventClass  { return eventClassControl }
+func (restoreStateEvent) class() eventClass        { return eventClassControl }
+
+func (announceResultEvent) class() eventClass     { return eventClassBulk }
+func (announceErrEvent) class() eventClass        { return eventClassBulk }
+func (dispatcherProgressEvent) class() eventClass { return eventClassBulk }
+
+func (announceTickEvent) class() eventClass         { return eventClassTick }
+func (preemptionTickEvent) class() eventClass       { return eventClassTick }
+func (emitStatsEvent) class() eventClass            { return eventClassTick }
+func (pieceEvictionTickEvent) class() eventClass    { return eventClassTick }
+func (deadlineTickEvent) class() eventClass         { return eventClassTick }
+func (connCapacityTickEvent) class() eventClass     { return eventClassTick }
+func (seedingPolicyTickEvent) class() eventClass    { return eventClassTick }
+func (reputationExportTickEvent) class() eventClass { return eventClassTick }
+func (bandwidthTickEvent) class() eventClass        { return eventClassTick }
+
+// _agingInterval is the number of events after which the bulk and tick
+// classes take precedence for a single event, such that sustained control and
+// default load cannot starve them.
+const _agingInterval = 16
+
+// eventQueue is a bounded queue of a single event class.
+type eventQueue struct {
+	class    eventClass
+	events   chan event
+	overflow OverflowPolicy
+}
+
+// priorityEventLoop is an eventLoop which buffers events in a bounded queue per
+// event class, and always applies events of lower classes first.
+type priorityEventLoop struct {
+	queues [numEventClasses]*eventQueue
+	done   chan struct{}
+	stats  tally.Scope
+
+	// Number of senders blocked on full queues.
+	blocked *atomic.Int64
+
+	// Number of events returned by next, and the number of aged turns taken.
+	// Only accessed by the goroutine running the loop.
+	served int
+	aged   int
+}
+
+func newEventLoop(config EventLoopConfig, stats tally.Scope) *priorityEventLoop {
+	config = config.applyDefaults()
+	l := &priorityEventLoop{
+		done:    make(chan struct{}),
+		stats:   stats,
+		blocked: atomic.NewInt64(0),
+	}
+	for c, qc := range config.queues() {
+		l.queues[c] = &eventQueue{c, make(chan event, qc.Size), qc.Overflow}
+	}
+	return l
+}
+
+// send sends a new event into l. Should never be called by the same goroutine
+// running l (i.e. within apply methods), else deadlock may occur. Returns false
+// if the l is not running. Events dropped by the overflow policy of their class
+// still return true, which is why only the tick class, whose events are
+// repeated periodically, may drop events.
+func (l *priorityEventLoop) send(e event) bool {
+	return l.enqueue(e, nil) == nil
+}
+
+func (l *priorityEventLoop) sendTimeout(e event, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return l.enqueue(e, timer.C)
+}
+
+func (l *priorityEventLoop) enqueue(e event, timeout <-chan time.Time) error {
+	select {
+	case <-l.done:
+		return ErrSchedulerStopped
+	default:
+	}
+	q := l.queues[classOf(e)]
+	select {
+	case q.events <- e:
+		return nil
+	default:
+	}
+	if q.overflow == OverflowDrop {
+		l.stats.Tagged(map[string]string{
+			"class": q.class.String(),
+			"event": eventName(e),
+		}).Counter("dropped_events").Inc(1)
+		return nil
+	}
+	l.blocked.Inc()
+	defer l.blocked.Dec()
+	select {
+	case q.events <- e:
+		return nil
+	case <-l.done:
+		return ErrSchedulerStopped
+	case <-timeout:
+		return ErrSendEventTimedOut
+	}
+}
+
+// next blocks until an event is available and returns the event of the lowest
+// class, except on every _agingInterval-th call, which prefers pending bulk
+// and tick events. Returns false if l was stopped.
+func (l *priorityEventLoop) next() (event, bool) {
+	control := l.queues[eventClassControl].events
+	def := l.queues[eventClassDefault].events
+	bulk := l.queues[eventClassBulk].events
+	tick := l.queues[eventClassTick].events
+
+	select {
+	case <-l.done:
+		return nil, false
+	default:
+	}
+	l.served++
+	if l.served%_agingInterval == 0 {
+		// Aged turns alternate between bulk and tick, such that neither starves
+		// the other.
+		l.aged++
+		lower := []chan event{bulk, tick}
+		if l.aged%2 == 0 {
+			lower[0], lower[1] = tick, bulk
+		}
+		for _, c := range lower {
+			select {
+			case e := <-c:
+				return e, true
+			default:
+			}
+		}
+	}
+	select {
+	case e := <-control:
+		return e, true
+	default:
+	}
+	select {
+	case e := <-control:
+		return e, true
+	case e := <-def:
+		return e, true
+	default:
+	}
+	select {
+	case <-l.done:
+		return nil, false
+	case e := <-control:
+		return e, true
+	case e := <-def:
+		return e, true
+	case e := <-bulk:
+		return e, true
+	case e := <-tick:
+		return e, true
+	}
+}
+
+func (l *priorityEventLoop) run(s *state) {
+	for {
+		e, ok := l.next()
+		if !ok {
+			return
+		}
+		s.applyEvent(e)
+	}
+}
+
+func (l *priorityEventLoop) stop() {
+	close(l.done)
+}
+
+// depth returns the number of events buffered or blocked waiting to be
+// applied.
+func (l *priorityEventLoop) depth() int {
+	n := int(l.blocked.Load())
+	for _, q := range l.queues {
+		n += len(q.events)
+	}
+	return n
+}
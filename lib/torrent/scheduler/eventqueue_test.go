@@ -0,0 +1,131 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestPriorityEventLoopAppliesLowerClassesFirst(t *testing.T) {
+	require := require.New(t)
+
+	l := newEventLoop(EventLoopConfig{}, tally.NoopScope)
+
+	require.True(l.send(announceTickEvent{}))
+	require.True(l.send(announceResultEvent{}))
+	require.True(l.send(probeEvent{}))
+	require.True(l.send(cancelTorrentEvent{}))
+	require.Equal(4, l.depth())
+
+	var classes []eventClass
+	for i := 0; i < 4; i++ {
+		e, ok := l.next()
+		require.True(ok)
+		classes = append(classes, classOf(e))
+	}
+	require.Equal(eventClassControl, classes[0])
+	require.Equal(eventClassDefault, classes[1])
+	require.ElementsMatch([]eventClass{eventClassBulk, eventClassTick}, classes[2:])
+	require.Equal(0, l.depth())
+}
+
+func TestPriorityEventLoopDropOverflow(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	l := newEventLoop(EventLoopConfig{
+		Tick: EventQueueConfig{Size: 1, Overflow: OverflowDrop},
+	}, stats)
+
+	require.True(l.send(announceTickEvent{}))
+	require.True(l.send(announceTickEvent{}))
+	require.Equal(1, l.depth())
+
+	var dropped int64
+	for _, c := range stats.Snapshot().Counters() {
+		if c.Name() == "dropped_events" {
+			require.Equal("tick", c.Tags()["class"])
+			dropped += c.Value()
+		}
+	}
+	require.Equal(int64(1), dropped)
+}
+
+func TestPriorityEventLoopBlockOverflow(t *testing.T) {
+	require := require.New(t)
+
+	l := newEventLoop(EventLoopConfig{
+		Default: EventQueueConfig{Size: 1, Overflow: OverflowBlock},
+	}, tally.NoopScope)
+
+	require.NoError(l.sendTimeout(probeEvent{}, time.Second))
+	require.Equal(ErrSendEventTimedOut, l.sendTimeout(probeEvent{}, 50*time.Millisecond))
+
+	// Control events are queued separately, and thus never blocked by default
+	// events.
+	require.NoError(l.sendTimeout(cancelTorrentEvent{}, time.Second))
+
+	l.stop()
+	require.False(l.send(probeEvent{}))
+	_, ok := l.next()
+	require.False(ok)
+}
+
+func TestEventLoopConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(EventLoopConfig{}.applyDefaults().validate())
+
+	config := EventLoopConfig{Bulk: EventQueueConfig{Overflow: "drop_oldest"}}.applyDefaults()
+	require.Error(config.validate())
+
+	// Dropped control and default events would leave their senders waiting
+	// on replies forever, and dropped bulk events would lose announce results.
+	config = EventLoopConfig{Control: EventQueueConfig{Overflow: OverflowDrop}}.applyDefaults()
+	require.Error(config.validate())
+	config = EventLoopConfig{Default: EventQueueConfig{Overflow: OverflowDrop}}.applyDefaults()
+	require.Error(config.validate())
+	config = EventLoopConfig{Bulk: EventQueueConfig{Overflow: OverflowDrop}}.applyDefaults()
+	require.Error(config.validate())
+	config = EventLoopConfig{Tick: EventQueueConfig{Overflow: OverflowBlock}}.applyDefaults()
+	require.NoError(config.validate())
+}
+
+func TestPriorityEventLoopAgesBulkAndTickEvents(t *testing.T) {
+	require := require.New(t)
+
+	l := newEventLoop(EventLoopConfig{}, tally.NoopScope)
+
+	require.True(l.send(announceResultEvent{}))
+	require.True(l.send(announceTickEvent{}))
+	for i := 0; i < 2*_agingInterval; i++ {
+		require.True(l.send(probeEvent{}))
+	}
+
+	// Despite pending default events, the bulk and tick events are each
+	// applied within an aging interval of each other.
+	var positions []int
+	for i := 0; i < 2*_agingInterval+2; i++ {
+		e, ok := l.next()
+		require.True(ok)
+		if c := classOf(e); c == eventClassBulk || c == eventClassTick {
+			positions = append(positions, i)
+		}
+	}
+	require.Equal([]int{_agingInterval - 1, 2*_agingInterval - 1}, positions)
+}
@@ -14,13 +14,20 @@
 package scheduler
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
 	"time"
 
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/memsize"
 	"github.com/uber/kraken/utils/timeutil"
@@ -32,6 +39,10 @@ import (
 // applying, it is guaranteed to be the only accessor of state.
 type event interface {
 	apply(*state)
+
+	// describe returns the key fields of the event for the event audit, or
+	// nil if it has none.
+	describe() eventFields
 }
 
 // eventLoop represents a serialized list of events to be applied to scheduler
@@ -41,58 +52,7 @@ type eventLoop interface {
 	sendTimeout(e event, timeout time.Duration) error
 	run(*state)
 	stop()
-}
-
-type baseEventLoop struct {
-	events chan event
-	done   chan struct{}
-}
-
-func newEventLoop() *baseEventLoop {
-	return &baseEventLoop{
-		events: make(chan event),
-		done:   make(chan struct{}),
-	}
-}
-
-// send sends a new event into l. Should never be called by the same goroutine
-// running l (i.e. within apply methods), else deadlock will occur. Returns false
-// if the l is not running.
-func (l *baseEventLoop) send(e event) bool {
-	select {
-	case l.events <- e:
-		return true
-	case <-l.done:
-		return false
-	}
-}
-
-func (l *baseEventLoop) sendTimeout(e event, timeout time.Duration) error {
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
-	select {
-	case l.events <- e:
-		return nil
-	case <-l.done:
-		return ErrSchedulerStopped
-	case <-timer.C:
-		return ErrSendEventTimedOut
-	}
-}
-
-func (l *baseEventLoop) run(s *state) {
-	for {
-		select {
-		case e := <-l.events:
-			e.apply(s)
-		case <-l.done:
-			return
-		}
-	}
-}
-
-func (l *baseEventLoop) stop() {
-	close(l.done)
+	depth() int
 }
 
 type liftedEventLoop struct {
@@ -112,6 +72,10 @@ func (l *liftedEventLoop) DispatcherComplete(d *dispatch.Dispatcher) {
 	l.send(dispatcherCompleteEvent{d})
 }
 
+func (l *liftedEventLoop) DispatcherProgress(d *dispatch.Dispatcher, percent int) {
+	l.send(dispatcherProgressEvent{d, percent})
+}
+
 func (l *liftedEventLoop) PeerRemoved(peerID core.PeerID, h core.InfoHash) {
 	l.send(peerRemovedEvent{peerID, h})
 }
@@ -125,10 +89,19 @@ type connClosedEvent struct {
 	c *conn.Conn
 }
 
-// apply ejects the conn from the scheduler's active connections.
+// apply ejects the conn from the scheduler's active connections. The remote
+// peer is blacklisted, unless the conn was interrupted and the peer may resume
+// its session, which is only allowed a limited number of times.
 func (e connClosedEvent) apply(s *state) {
 	s.conns.DeleteActive(e.c)
-	if err := s.conns.Blacklist(e.c.PeerID(), e.c.InfoHash()); err != nil {
+	if e.c.Resumable() {
+		if s.conns.Interrupted(e.c.PeerID(), e.c.InfoHash()) {
+			s.sched.stats.Counter("sessions_interrupted").Inc(1)
+			return
+		}
+		s.sched.stats.Counter("sessions_interruptions_exceeded").Inc(1)
+	}
+	if err := s.conns.Blacklist(e.c.PeerID(), e.c.InfoHash(), connstate.TransferFailure); err != nil {
 		s.log("conn", e.c).Infof("Cannot blacklist active conn: %s", err)
 	}
 }
@@ -143,21 +116,47 @@ type incomingHandshakeEvent struct {
 // to the scheduler's pending connections and asynchronously attempts to establish
 // the connection.
 func (e incomingHandshakeEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.pc.InfoHash()]
+	if s.sched.config.LeechOnly && (!ok || ctrl.seeding()) {
+		// Leech-only clients only accept conns for torrents they are actively
+		// downloading, since they have nothing to serve otherwise.
+		s.sched.stats.Counter("leech_only_rejected_conns").Inc(1)
+		go s.sched.handshaker.Reject(e.pc, p2p.RejectMessage_OTHER, errLeechOnly)
+		return
+	}
+	if s.sched.isDraining() {
+		go s.sched.handshaker.Reject(e.pc, p2p.RejectMessage_DRAINING, errSchedulerDraining)
+		return
+	}
+	if e.pc.PeerID() == s.sched.pctx.PeerID {
+		// We never dial ourselves, so the remote host must share our peer id.
+		s.sched.handlePeerIDCollision(e.pc.RemoteAddr().String())
+		go s.sched.handshaker.Reject(e.pc, p2p.RejectMessage_OTHER, errPeerIDCollision)
+		return
+	}
 	peerNeighbors := make([]core.PeerID, len(e.pc.RemoteBitfields()))
 	var i int
 	for peerID := range e.pc.RemoteBitfields() {
 		peerNeighbors[i] = peerID
 		i++
 	}
-	if err := s.conns.AddPending(e.pc.PeerID(), e.pc.InfoHash(), peerNeighbors); err != nil {
+	var ip string
+	if host, _, err := net.SplitHostPort(e.pc.RemoteAddr().String()); err == nil {
+		ip = host
+	}
+	if err := s.conns.AddPendingFromIP(e.pc.PeerID(), e.pc.InfoHash(), ip, peerNeighbors); err != nil {
 		s.log("peer", e.pc.PeerID(), "hash", e.pc.InfoHash()).Infof(
 			"Rejecting incoming handshake: %s", err)
 		s.sched.torrentlog.IncomingConnectionReject(e.pc.Digest(), e.pc.InfoHash(), e.pc.PeerID(), err)
-		e.pc.Close()
+		reason := p2p.RejectMessage_OTHER
+		if err == connstate.ErrTorrentAtCapacity {
+			reason = p2p.RejectMessage_AT_CAPACITY
+		}
+		go s.sched.handshaker.Reject(e.pc, reason, err)
 		return
 	}
 	var rb conn.RemoteBitfields
-	if ctrl, ok := s.torrentControls[e.pc.InfoHash()]; ok {
+	if ok {
 		rb = ctrl.dispatcher.RemoteBitfields()
 	}
 	go s.sched.establishIncomingHandshake(e.pc, rb)
@@ -197,11 +196,28 @@ func (e incomingConnEvent) apply(s *state) {
 type failedOutgoingHandshakeEvent struct {
 	peerID   core.PeerID
 	infoHash core.InfoHash
+	err      error
 }
 
+// apply blacklists the remote peer, unless the remote peer explicitly rejected
+// the handshake due to capacity, in which case the peer may be retried on the
+// next announce.
 func (e failedOutgoingHandshakeEvent) apply(s *state) {
 	s.conns.DeletePending(e.peerID, e.infoHash)
-	if err := s.conns.Blacklist(e.peerID, e.infoHash); err != nil {
+	if e.err == context.Canceled {
+		// The torrent was removed while handshaking, which is not the fault
+		// of the remote peer.
+		return
+	}
+	if rerr, ok := e.err.(conn.RejectionError); ok {
+		s.sched.stats.Tagged(map[string]string{
+			"reason": rerr.Reason.String(),
+		}).Counter("handshake_rejections").Inc(1)
+		if rerr.Reason == p2p.RejectMessage_AT_CAPACITY {
+			return
+		}
+	}
+	if err := s.conns.Blacklist(e.peerID, e.infoHash, connstate.HandshakeFailure); err != nil {
 		s.log("peer", e.peerID, "hash", e.infoHash).Infof("Cannot blacklist pending conn: %s", err)
 	}
 }
@@ -247,7 +263,10 @@ func (e announceTickEvent) apply(s *state) {
 			continue
 		}
 		go s.sched.announce(
-			ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), ctrl.dispatcher.Complete())
+			ctrl.dispatcher.Digest(),
+			ctrl.dispatcher.InfoHash(),
+			ctrl.seeding(),
+			ctrl.dispatcher.HaveRanges())
 		break
 	}
 	// Re-enqueue any torrents we pulled off and ignored, else we would never
@@ -258,10 +277,19 @@ func (e announceTickEvent) apply(s *state) {
 }
 
 // announceResultEvent occurs when a successfully announced response was received
-// from the tracker.
+// from the tracker. Sent via announceResult, which prepares the candidate peers.
 type announceResultEvent struct {
 	infoHash core.InfoHash
-	peers    []*core.PeerInfo
+
+	// peers are the candidates to open connections to, excluding the local peer.
+	peers []*core.PeerInfo
+
+	// content is the blob inlined by the tracker, if any.
+	content []byte
+
+	// collisions are the addresses of other hosts announced with the local
+	// peer id.
+	collisions []string
 }
 
 // apply selects new peers returned via an announce response to open connections to
@@ -275,27 +303,55 @@ func (e announceResultEvent) apply(s *state) {
 		s.log("hash", e.infoHash).Info("Dispatcher closed after announce response received")
 		return
 	}
+	ctrl.announceBackoff = nil
 	s.announceQueue.Ready(e.infoHash)
-	if ctrl.dispatcher.Complete() {
+	// Seeders are counted on every announce, such that seeding policies see
+	// the current swarm rather than the swarm at completion.
+	ctrl.swarmSeeders = 0
+	for _, p := range e.peers {
+		if p.Complete {
+			ctrl.swarmSeeders++
+		}
+		if p.Origin {
+			ctrl.origins[p.PeerID.String()] = true
+		}
+	}
+	if ctrl.seeding() {
 		// Torrent is already complete, don't open any new connections.
 		return
 	}
+	if ctrl.dispatcher.Paused() {
+		return
+	}
+	if e.content != nil {
+		// Tiny blobs are written directly, bypassing the swarm. The peers are
+		// only used if the inlined content turns out to be unusable.
+		go s.sched.writeInline(ctrl.dispatcher, e.content, e.peers)
+		return
+	}
+	for _, addr := range e.collisions {
+		s.sched.handlePeerIDCollision(addr)
+	}
 	for _, p := range e.peers {
-		if p.PeerID == s.sched.pctx.PeerID {
-			// Tracker may return our own peer.
+		if s.conns.Blacklisted(p.PeerID, e.infoHash) {
 			continue
 		}
-		if s.conns.Blacklisted(p.PeerID, e.infoHash) {
+		if p.Partial() && !ctrl.dispatcher.NeedsAnyPiece(p.HaveRanges) {
+			// Partial seeders are only useful if they hold pieces we're missing.
 			continue
 		}
-		if err := s.conns.AddPending(p.PeerID, e.infoHash, nil); err != nil {
+		if err := s.conns.AddPendingFromIP(p.PeerID, e.infoHash, p.IP, nil); err != nil {
 			if err == connstate.ErrTorrentAtCapacity {
 				break
 			}
+			if err == connstate.ErrTooManyConnsFromIP {
+				s.sched.stats.Counter("same_ip_conns_skipped").Inc(1)
+			}
 			continue
 		}
+		ctrl.dialed[p.PeerID] = p
 		go s.sched.initializeOutgoingHandshake(
-			p, ctrl.dispatcher.Stat(), ctrl.dispatcher.RemoteBitfields(), ctrl.namespace)
+			ctrl.dials, p, ctrl.dispatcher, ctrl.dispatcher.RemoteBitfields(), ctrl.namespace)
 	}
 }
 
@@ -305,39 +361,117 @@ type announceErrEvent struct {
 	err      error
 }
 
-// apply marks the dispatcher as ready to announce again.
+// apply marks the dispatcher as ready to announce again once its announce
+// backoff elapses.
 func (e announceErrEvent) apply(s *state) {
 	s.log("hash", e.infoHash).Errorf("Error announcing: %s", e.err)
-	s.announceQueue.Ready(e.infoHash)
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || s.sched.config.AnnounceBackoff.Disable {
+		s.announceQueue.Ready(e.infoHash)
+		return
+	}
+	s.backOffAnnounce(e.infoHash, ctrl)
 }
 
 // newTorrentEvent occurs when a new torrent was requested for download.
 type newTorrentEvent struct {
 	namespace string
 	torrent   storage.Torrent
+	opts      []TorrentOption
 	errc      chan error
 }
 
-// apply begins seeding / leeching a new torrent.
+// apply begins seeding / leeching a new torrent. New torrents are queued
+// instead if the limit of concurrent downloads is reached.
 func (e newTorrentEvent) apply(s *state) {
 	ctrl, ok := s.torrentControls[e.torrent.InfoHash()]
 	if !ok {
+		if !e.torrent.Complete() &&
+			(s.admission.position(e.torrent.InfoHash()) > 0 || s.admissionFull()) {
+			s.queueTorrent(e)
+			return
+		}
 		var err error
-		ctrl, err = s.addTorrent(e.namespace, e.torrent, true)
+		ctrl, err = s.addTorrent(e.namespace, e.torrent, true, e.opts...)
 		if err != nil {
 			e.errc <- err
 			return
 		}
-		s.log("torrent", e.torrent).Info("Added new torrent")
+		s.log("torrent", e.torrent, "caller", ctrl.opts.caller).Info("Added new torrent")
+		if e.torrent.Complete() && !s.sched.config.LeechOnly {
+			// Immediately announce torrents which are already complete,
+			// instead of waiting for the dispatcher to report completion.
+			ctrl.announcedComplete = true
+			go s.sched.announce(e.torrent.Digest(), e.torrent.InfoHash(), true, nil)
+		}
+	} else if err := ctrl.dispatcher.CheckMetaInfo(e.torrent); err != nil {
+		s.quarantineTorrent(e, err)
+		return
+	} else if o := newTorrentOptions(s.sched.config, e.opts...); !o.deadline.IsZero() &&
+		!ctrl.seeding() {
+		// The torrent is already in progress, so the deadline only applies to
+		// this request.
+		s.setDeadlineTimer(ctrl, o.deadline, deadlineEvent{infoHash: e.torrent.InfoHash(), errc: e.errc})
 	}
-	if ctrl.dispatcher.Complete() {
+	if ctrl.seeding() {
+		if s.sched.config.LeechOnly {
+			// Leech-only clients never seed, so there is no reason to keep
+			// a torrent which is already complete.
+			s.removeTorrent(e.torrent.InfoHash(), nil)
+		}
 		e.errc <- nil
 		return
 	}
 	ctrl.errors = append(ctrl.errors, e.errc)
+	if d := newTorrentOptions(s.sched.config, e.opts...).requestDeadline; !d.IsZero() {
+		s.setDeadlineTimer(ctrl, d, deadlineEvent{infoHash: e.torrent.InfoHash(), errc: e.errc})
+	}
 
-	// Immediately announce new torrents.
-	go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), ctrl.dispatcher.Complete())
+	// Immediately announce new torrents, and dial peers which served them
+	// before in parallel.
+	go s.sched.announce(
+		ctrl.dispatcher.Digest(),
+		ctrl.dispatcher.InfoHash(),
+		ctrl.seeding(),
+		ctrl.dispatcher.HaveRanges())
+	s.dialKnownPeers(ctrl.dispatcher.InfoHash(), ctrl)
+}
+
+// ingestTorrentEvent occurs when local content for a torrent begins being
+// ingested.
+type ingestTorrentEvent struct {
+	namespace string
+	torrent   storage.Torrent
+	result    chan *dispatch.Dispatcher
+	errc      chan error
+}
+
+// apply begins seeding the ingested torrent, and hands its dispatcher back to
+// the ingesting client. No dispatcher is returned if the torrent is already
+// complete.
+func (e ingestTorrentEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.torrent.InfoHash()]
+	if !ok {
+		var err error
+		ctrl, err = s.addTorrent(e.namespace, e.torrent, true)
+		if err != nil {
+			e.errc <- err
+			return
+		}
+		s.log("torrent", e.torrent).Info("Added new torrent for ingestion")
+	}
+	if ctrl.seeding() {
+		e.result <- nil
+		return
+	}
+	e.result <- ctrl.dispatcher
+
+	// Immediately announce, such that peers may find the ingested pieces.
+	go s.sched.announce(
+		ctrl.dispatcher.Digest(),
+		ctrl.dispatcher.InfoHash(),
+		false,
+		ctrl.dispatcher.HaveRanges())
 }
 
 // dispatcherCompleteEvent occurs when a dispatcher finishes downloading its torrent.
@@ -356,9 +490,16 @@ func (e dispatcherCompleteEvent) apply(s *state) {
 		s.log("dispatcher", e.dispatcher).Error("Completed dispatcher not found")
 		return
 	}
+	ctrl.stopTimers()
+	ctrl.seedingSince = s.sched.clock.Now()
 	for _, errc := range ctrl.errors {
 		errc <- nil
 	}
+	for _, c := range s.conns.ActiveConns() {
+		if c.InfoHash() == infoHash {
+			c.MarkSeeding()
+		}
+	}
 	if ctrl.localRequest {
 		// Normalize the download time for all torrent sizes to a per MB value.
 		// Skip torrents that are less than a MB in size because we can't measure
@@ -366,15 +507,44 @@ func (e dispatcherCompleteEvent) apply(s *state) {
 		downloadTime := s.sched.clock.Now().Sub(ctrl.dispatcher.CreatedAt())
 		lengthMB := ctrl.dispatcher.Length() / int64(memsize.MB)
 		if lengthMB > 0 {
-			s.sched.stats.Timer("download_time_per_mb").Record(downloadTime / time.Duration(lengthMB))
+			ctrl.stats.Timer("download_time_per_mb").Record(downloadTime / time.Duration(lengthMB))
 		}
 	}
 
 	s.log("hash", infoHash).Info("Torrent complete")
+	s.notifyListeners(ctrl, nil)
+	s.sched.timelines.Finish(infoHash, timeline.Completed, "")
+	go s.sched.recordProvenance(ctrl.namespace, ctrl.dispatcher)
 	s.sched.netevents.Produce(networkevent.TorrentCompleteEvent(infoHash, s.sched.pctx.PeerID))
+	go s.sched.completions.Landed(ctrl.dispatcher.Digest())
+
+	// The completed torrent no longer counts towards the limit of concurrent
+	// downloads.
+	s.admitTorrents()
+
+	if s.sched.config.LeechOnly {
+		// Leech-only clients drop completed torrents instead of seeding them.
+		s.closeConns(infoHash)
+		s.removeTorrent(infoHash, nil)
+		return
+	}
+
+	if !ctrl.announcedComplete {
+		// Immediately announce completed torrents.
+		go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), true, nil)
+	}
+}
+
+// dispatcherProgressEvent occurs when a dispatcher reaches a download progress
+// milestone.
+type dispatcherProgressEvent struct {
+	dispatcher *dispatch.Dispatcher
+	percent    int
+}
 
-	// Immediately announce completed torrents.
-	go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), true)
+func (e dispatcherProgressEvent) apply(s *state) {
+	s.sched.timelines.Record(
+		e.dispatcher.InfoHash(), timeline.Progress, fmt.Sprintf("%d%%", e.percent))
 }
 
 // peerRemovedEvent occurs when a dispatcher removes a peer with a closed
@@ -387,10 +557,12 @@ type peerRemovedEvent struct {
 func (e peerRemovedEvent) apply(s *state) {}
 
 // preemptionTickEvent occurs periodically to preempt unneeded conns and remove
-// idle torrentControls.
+// idle torrentControls. Besides idle and expired conns, the least useful conns
+// of saturated torrents are preempted if utility preemption is enabled.
 type preemptionTickEvent struct{}
 
 func (e preemptionTickEvent) apply(s *state) {
+	live := make(map[core.InfoHash][]*conn.Conn)
 	for _, c := range s.conns.ActiveConns() {
 		ctrl, ok := s.torrentControls[c.InfoHash()]
 		if !ok {
@@ -413,26 +585,158 @@ func (e preemptionTickEvent) apply(s *state) {
 			c.Close()
 			continue
 		}
+		live[c.InfoHash()] = append(live[c.InfoHash()], c)
+	}
+	for h, conns := range live {
+		s.preemptLowUtilityConns(h, s.torrentControls[h], conns)
 	}
 
 	for h, ctrl := range s.torrentControls {
+		if ctrl.opts.preemptionExempt || ctrl.pinned || ctrl.dispatcher.Paused() {
+			continue
+		}
+
+		sinceRead := s.sched.clock.Now().Sub(ctrl.dispatcher.LastReadTime())
 		idleSeeder :=
-			ctrl.dispatcher.Complete() &&
-				s.sched.clock.Now().Sub(ctrl.dispatcher.LastReadTime()) >= s.sched.config.SeederTTI
+			ctrl.seeding() &&
+				sinceRead >= ctrl.opts.seederTTI &&
+				s.approveEviction(h, ctrl, EvictionIdleSeeder, sinceRead)
 		if idleSeeder {
 			s.sched.torrentlog.SeedTimeout(ctrl.dispatcher.Digest(), h)
 		}
 
+		// Paused torrents write no pieces, so they are only considered idle
+		// relative to when they were last resumed.
+		sinceWrite := s.sched.clock.Now().Sub(
+			timeutil.MostRecent(ctrl.dispatcher.LastWriteTime(), ctrl.resumedAt))
 		idleLeecher :=
-			!ctrl.dispatcher.Complete() &&
-				s.sched.clock.Now().Sub(ctrl.dispatcher.LastWriteTime()) >= s.sched.config.LeecherTTI
+			!ctrl.seeding() &&
+				sinceWrite >= ctrl.opts.leecherTTI &&
+				s.approveEviction(h, ctrl, EvictionIdleLeecher, sinceWrite)
 		if idleLeecher {
 			s.sched.torrentlog.LeechTimeout(ctrl.dispatcher.Digest(), h)
+		} else if !ctrl.seeding() {
+			lastWrite := ctrl.dispatcher.LastWriteTime()
+			if s.sched.clock.Now().Sub(lastWrite) >= s.sched.config.ConnTTI {
+				s.sched.timelines.Record(
+					h, timeline.Stalled, fmt.Sprintf("no pieces written since %s", lastWrite))
+			}
 		}
 
 		if idleSeeder || idleLeecher {
-			s.log("hash", h, "inprogress", !ctrl.dispatcher.Complete()).Info("Removing idle torrent")
+			s.log("hash", h, "inprogress", !ctrl.seeding()).Info("Removing idle torrent")
 			s.removeTorrent(h, ErrTorrentTimeout)
+			if idleSeeder && s.sched.tiers != nil {
+				// Idle seeders are retained on disk, but no longer need
+				// to occupy the hot tier.
+				s.sched.tiers.demote(ctrl.dispatcher.Digest())
+			}
+		}
+	}
+}
+
+// pieceEvictionTickEvent occurs periodically to evict cold pieces of large
+// seeded torrents when disk usage exceeds the configured threshold.
+type pieceEvictionTickEvent struct{}
+
+func (e pieceEvictionTickEvent) apply(s *state) {
+	config := s.sched.config.PieceEviction
+
+	reporter, ok := s.sched.torrentArchive.(storage.DiskUsageReporter)
+	if !ok {
+		s.log().Error("Piece eviction enabled but torrent archive does not report disk usage")
+		return
+	}
+	usage, err := reporter.DiskUsage()
+	if err != nil {
+		s.log().Errorf("Error checking disk usage: %s", err)
+		return
+	}
+	if usage < config.DiskUsageThreshold {
+		return
+	}
+	// Evict pieces of lower class namespaces first, and of lower priority
+	// torrents within the same class.
+	classes := s.sched.evictionClasses
+	hashes := make([]core.InfoHash, 0, len(s.torrentControls))
+	for h := range s.torrentControls {
+		hashes = append(hashes, h)
+	}
+	sort.SliceStable(hashes, func(i, j int) bool {
+		ci := s.torrentControls[hashes[i]]
+		cj := s.torrentControls[hashes[j]]
+		if a, b := classes.classify(ci.namespace), classes.classify(cj.namespace); a != b {
+			return a < b
+		}
+		return ci.opts.priority < cj.opts.priority
+	})
+	for _, h := range hashes {
+		ctrl := s.torrentControls[h]
+		if usage < config.DiskUsageThreshold {
+			break
+		}
+		if !ctrl.seeding() || uint64(ctrl.dispatcher.Length()) < config.MinTorrentSize {
+			continue
+		}
+		if !classes.evictable(ctrl.namespace) || ctrl.pinned {
+			continue
+		}
+		pieces := ctrl.dispatcher.ColdPieces(config.KeepFraction)
+		if len(pieces) == 0 {
+			continue
+		}
+		s.log("hash", h, "disk_usage", usage).Infof(
+			"Evicting %d cold pieces of seeded torrent", len(pieces))
+
+		// Evicted torrents are no longer complete, so we must stop seeding them
+		// and allow the torrent to be re-initialized from disk.
+		s.releaseTorrent(h, nil, true)
+
+		if err := s.evictPieces(ctrl.namespace, ctrl.dispatcher.Digest(), pieces); err != nil {
+			s.log("hash", h).Errorf("Error evicting pieces: %s", err)
+			continue
+		}
+		s.sched.stats.Tagged(map[string]string{
+			"namespace_class": classes.classify(ctrl.namespace).String(),
+		}).Counter("pieces_evicted").Inc(int64(len(pieces)))
+
+		if usage, err = reporter.DiskUsage(); err != nil {
+			s.log().Errorf("Error checking disk usage: %s", err)
+			return
+		}
+	}
+}
+
+// connCapacityTickEvent occurs periodically to adapt the conn capacity of
+// in-progress torrents to their throughput.
+type connCapacityTickEvent struct{}
+
+func (e connCapacityTickEvent) apply(s *state) {
+	for h, ctrl := range s.torrentControls {
+		if ctrl.capacity == nil {
+			continue
+		}
+		if ctrl.seeding() {
+			// Seeders serve any peer which asks, so they are not limited.
+			ctrl.capacity = nil
+			s.conns.SetTargetCapacity(h, 0)
+			continue
+		}
+		if ctrl.dispatcher.Paused() {
+			continue
+		}
+		prev := ctrl.capacity.Capacity()
+		n := ctrl.capacity.Update(
+			ctrl.dispatcher.BytesDownloaded(), s.sched.clock.Now(), s.conns.Saturated(h))
+		s.conns.SetTargetCapacity(h, n)
+		if n != prev {
+			direction := "up"
+			if n < prev {
+				direction = "down"
+			}
+			ctrl.stats.Tagged(map[string]string{
+				"direction": direction,
+			}).Counter("conn_capacity_adjustments").Inc(1)
 		}
 	}
 }
@@ -442,6 +746,43 @@ type emitStatsEvent struct{}
 
 func (e emitStatsEvent) apply(s *state) {
 	s.sched.stats.Gauge("torrents").Update(float64(len(s.torrentControls)))
+	s.sched.stats.Gauge("event_loop_depth").Update(float64(s.sched.eventLoop.depth()))
+	s.sched.handles.Check()
+
+	byState := make(map[dispatch.State]int)
+	for _, ctrl := range s.torrentControls {
+		byState[ctrl.dispatcher.State()]++
+	}
+	for _, st := range dispatch.States {
+		s.sched.stats.Tagged(map[string]string{
+			"state": st.String(),
+		}).Gauge("dispatchers").Update(float64(byState[st]))
+	}
+}
+
+// statsSnapshotEvent occurs when a consolidated Stats snapshot is requested.
+type statsSnapshotEvent struct {
+	result chan *Stats
+}
+
+func (e statsSnapshotEvent) apply(s *state) {
+	stats := &Stats{
+		Version:         StatsVersion,
+		Torrents:        len(s.torrentControls),
+		TorrentsByState: make(map[string]int),
+	}
+	for _, ctrl := range s.torrentControls {
+		stats.TorrentsByState[ctrl.dispatcher.State().String()]++
+	}
+	stats.PendingConns, stats.ActiveConns = s.conns.NumConns()
+	stats.BlacklistedConns = len(s.conns.BlacklistSnapshot())
+	if s.sched.bandwidth != nil {
+		for _, ctrl := range s.torrentControls {
+			s.sampleBandwidth(ctrl)
+		}
+		stats.Bandwidth = s.sched.bandwidth.windows()
+	}
+	e.result <- stats
 }
 
 type blacklistSnapshotEvent struct {
@@ -459,36 +800,190 @@ type removeTorrentEvent struct {
 }
 
 func (e removeTorrentEvent) apply(s *state) {
+	// Queued torrents must be dropped first, else they may be admitted once
+	// the torrents below are removed.
+	var queued []core.InfoHash
+	for _, t := range s.admission.torrents {
+		if t.requests[0].torrent.Digest() == e.digest {
+			queued = append(queued, t.infoHash())
+		}
+	}
+	for _, h := range queued {
+		s.dequeueTorrent(h, ErrTorrentRemoved)
+	}
 	for h, ctrl := range s.torrentControls {
 		if ctrl.dispatcher.Digest() == e.digest {
 			s.log(
 				"hash", h,
-				"inprogress", !ctrl.dispatcher.Complete()).Info("Removing torrent")
+				"inprogress", !ctrl.seeding()).Info("Removing torrent")
 			s.removeTorrent(h, ErrTorrentRemoved)
 		}
 	}
 	e.errc <- s.sched.torrentArchive.DeleteTorrent(e.digest)
 }
 
-// probeEvent occurs when a probe is manually requested via scheduler API.
-// The event loop is unbuffered, so if a probe can be successfully sent, then
-// the event loop is healthy.
-type probeEvent struct{}
+// cancelTorrentEvent occurs when an in-progress torrent is cancelled via
+// scheduler API.
+type cancelTorrentEvent struct {
+	infoHash core.InfoHash
+	errc     chan error
+}
 
-func (e probeEvent) apply(*state) {}
+func (e cancelTorrentEvent) apply(s *state) {
+	if s.dequeueTorrent(e.infoHash, ErrTorrentCancelled) {
+		s.log("hash", e.infoHash).Info("Cancelling queued torrent")
+		e.errc <- nil
+		return
+	}
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		e.errc <- ErrTorrentNotFound
+		return
+	}
+	s.log("hash", e.infoHash).Info("Cancelling torrent")
+	// Conns which have not yet been added to the dispatcher are not closed by
+	// teardown.
+	s.closeConns(e.infoHash)
+	s.removeTorrent(e.infoHash, ErrTorrentCancelled)
+	e.errc <- nil
+}
+
+// abandonTorrentEvent occurs when the caller waiting on errc for an
+// in-progress torrent goes away, e.g. because its context was cancelled.
+type abandonTorrentEvent struct {
+	infoHash core.InfoHash
+	errc     chan error
+}
+
+// apply stops waiting on errc, and removes the torrent once no callers are
+// left waiting on it, such that abandoned torrents do not hold on to conns
+// and bandwidth until completion.
+func (e abandonTorrentEvent) apply(s *state) {
+	if s.admission.abandon(e.infoHash, e.errc) {
+		s.log("hash", e.infoHash).Info("Removing queued torrent abandoned by all callers")
+		s.sched.stats.Gauge("queued_torrents").Update(float64(s.admission.len()))
+		return
+	}
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		return
+	}
+	for i, errc := range ctrl.errors {
+		if errc != e.errc {
+			continue
+		}
+		ctrl.errors = append(ctrl.errors[:i], ctrl.errors[i+1:]...)
+		ctrl.stats.Counter("abandoned_requests").Inc(1)
+		if len(ctrl.errors) == 0 {
+			s.log("hash", e.infoHash).Info("Removing torrent abandoned by all callers")
+			// Conns which have not yet been added to the dispatcher are not
+			// closed by teardown.
+			s.closeConns(e.infoHash)
+			s.removeTorrent(e.infoHash, ErrTorrentCancelled)
+		}
+		return
+	}
+}
+
+// pauseTorrentEvent occurs when an in-progress torrent is paused via scheduler
+// API.
+type pauseTorrentEvent struct {
+	infoHash core.InfoHash
+	errc     chan error
+}
+
+// apply stops announcing and requesting pieces for the torrent, while keeping
+// its torrentControl, conns and downloaded pieces intact.
+func (e pauseTorrentEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		e.errc <- ErrTorrentNotFound
+		return
+	}
+	if !ctrl.dispatcher.Paused() {
+		s.log("hash", e.infoHash).Info("Pausing torrent")
+		ctrl.dispatcher.Pause()
+		s.announceQueue.Eject(e.infoHash)
+	}
+	e.errc <- nil
+}
+
+// resumeTorrentEvent occurs when a paused torrent is resumed via scheduler API.
+type resumeTorrentEvent struct {
+	infoHash core.InfoHash
+	errc     chan error
+}
+
+func (e resumeTorrentEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		e.errc <- ErrTorrentNotFound
+		return
+	}
+	if ctrl.dispatcher.Paused() {
+		s.log("hash", e.infoHash).Info("Resuming torrent")
+		ctrl.resumedAt = s.sched.clock.Now()
+		ctrl.dispatcher.Resume()
+		s.announceQueue.Add(e.infoHash)
+		s.announceQueue.SetPriority(e.infoHash, announcequeue.PriorityLeecher)
+	}
+	e.errc <- nil
+}
+
+// setTorrentRateLimitEvent occurs when the download rate of a torrent is
+// adjusted via scheduler API.
+type setTorrentRateLimitEvent struct {
+	infoHash    core.InfoHash
+	bytesPerSec int64
+	errc        chan error
+}
+
+func (e setTorrentRateLimitEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		e.errc <- ErrTorrentNotFound
+		return
+	}
+	s.log("hash", e.infoHash, "bytes_per_sec", e.bytesPerSec).Info("Setting torrent download rate limit")
+	ctrl.opts.downloadRate = e.bytesPerSec
+	ctrl.ingress.SetRate(e.bytesPerSec)
+	e.errc <- nil
+}
+
+// probeEvent occurs when a probe is manually requested via scheduler API. If a
+// probe is applied within the probe timeout, then the event loop is healthy.
+type probeEvent struct {
+	done chan struct{}
+}
+
+func (e probeEvent) apply(*state) {
+	close(e.done)
+}
 
 // shutdownEvent stops the event loop and tears down all active torrents and
 // connections.
 type shutdownEvent struct{}
 
 func (e shutdownEvent) apply(s *state) {
+	for h, ctrl := range s.torrentControls {
+		s.rememberKnownPeers(h, ctrl)
+	}
+	if s.sched.config.Persist.Path != "" {
+		if err := s.persistState(); err != nil {
+			s.sched.stats.Counter("persist_errors").Inc(1)
+			s.log().Errorf("Error persisting scheduler state: %s", err)
+		}
+	}
 	for _, c := range s.conns.ActiveConns() {
 		s.log("conn", c).Info("Closing conn to stop scheduler")
 		c.Close()
 	}
 	// Notify local clients of pending torrents that they will not complete.
 	for _, ctrl := range s.torrentControls {
+		s.sampleBandwidth(ctrl)
 		ctrl.dispatcher.TearDown()
+		ctrl.handle.Release()
+		ctrl.stopTimers()
 		for _, errc := range ctrl.errors {
 			errc <- ErrSchedulerStopped
 		}
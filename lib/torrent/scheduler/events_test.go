@@ -14,23 +14,34 @@
 package scheduler
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
 	"github.com/uber-go/tally"
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/store"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/conncapacity"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	mockannounceclient "github.com/uber/kraken/mocks/tracker/announceclient"
 	mockmetainfoclient "github.com/uber/kraken/mocks/tracker/metainfoclient"
 	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/reconcile"
 	"github.com/uber/kraken/utils/testutil"
 )
 
@@ -50,6 +61,21 @@ func (l *mockEventLoop) expect(e event) {
 	}
 }
 
+// waitFor discards events until e occurs.
+func (l *mockEventLoop) waitFor(e event) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case result := <-l.c:
+			if reflect.DeepEqual(e, result) {
+				return
+			}
+		case <-timeout:
+			l.t.Fatalf("timed out waiting for %T to occur", e)
+		}
+	}
+}
+
 func (l *mockEventLoop) send(e event) bool {
 	l.c <- e
 	return true
@@ -58,6 +84,7 @@ func (l *mockEventLoop) send(e event) bool {
 // Unimplemented.
 func (l *mockEventLoop) run(*state)                                       {}
 func (l *mockEventLoop) stop()                                            {}
+func (l *mockEventLoop) depth() int                                       { return 0 }
 func (l *mockEventLoop) sendTimeout(e event, timeout time.Duration) error { panic("unimplemented") }
 
 type stateMocks struct {
@@ -92,7 +119,7 @@ func newStateMocks(t *testing.T) (*stateMocks, func()) {
 	return mocks, cleanup.Run
 }
 
-func (m *stateMocks) newState(config Config) *state {
+func (m *stateMocks) newState(config Config, opts ...option) *state {
 	sched, err := newScheduler(
 		config,
 		m.torrentArchive,
@@ -100,7 +127,7 @@ func (m *stateMocks) newState(config Config) *state {
 		core.PeerContextFixture(),
 		m.announceClient,
 		networkevent.NewTestProducer(),
-		withEventLoop(m.eventLoop))
+		append([]option{withEventLoop(m.eventLoop)}, opts...)...)
 	if err != nil {
 		panic(err)
 	}
@@ -111,10 +138,10 @@ func (m *stateMocks) newTorrent() storage.Torrent {
 	mi := core.MetaInfoFixture()
 
 	m.metainfoClient.EXPECT().
-		Download(_testNamespace, mi.Digest()).
+		Download(gomock.Any(), _testNamespace, mi.Digest()).
 		Return(mi, nil)
 
-	t, err := m.torrentArchive.CreateTorrent(_testNamespace, mi.Digest())
+	t, err := m.torrentArchive.CreateTorrent(context.Background(), _testNamespace, mi.Digest())
 	if err != nil {
 		panic(err)
 	}
@@ -142,6 +169,7 @@ func TestAnnounceTickEvent(t *testing.T) {
 			ctrls[0].dispatcher.Digest(),
 			ctrls[0].dispatcher.InfoHash(),
 			false,
+			nil,
 			announceclient.V1).
 		Return(nil, time.Second, nil)
 
@@ -187,6 +215,7 @@ func TestAnnounceTickEventSkipsFullTorrents(t *testing.T) {
 			empty.dispatcher.Digest(),
 			empty.dispatcher.InfoHash(),
 			false,
+			nil,
 			announceclient.V1).
 		Return(nil, time.Second, nil)
 
@@ -219,6 +248,7 @@ func TestAnnounceTickEventSkipsFullTorrents(t *testing.T) {
 			full.dispatcher.Digest(),
 			full.dispatcher.InfoHash(),
 			false,
+			nil,
 			announceclient.V1).
 		Return(nil, time.Second, nil)
 
@@ -229,3 +259,754 @@ func TestAnnounceTickEventSkipsFullTorrents(t *testing.T) {
 		infoHash: full.dispatcher.InfoHash(),
 	})
 }
+
+func TestPieceEvictionTickEventEvictsColdPieces(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		PieceEviction: PieceEvictionConfig{
+			Enable:             true,
+			DiskUsageThreshold: 1e-9,
+			KeepFraction:       0.5,
+			MinTorrentSize:     1,
+		},
+	})
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+
+	tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+
+	ctrl, err := state.addTorrent(_testNamespace, tor, false)
+	require.NoError(err)
+
+	require.NoError(ctrl.dispatcher.Ingest(bytes.NewReader(blob.Content)))
+	require.True(ctrl.dispatcher.Complete())
+
+	pieceEvictionTickEvent{}.apply(state)
+
+	require.Empty(state.torrentControls)
+
+	tor, err = mocks.torrentArchive.GetTorrent(_testNamespace, blob.Digest)
+	require.NoError(err)
+	require.False(tor.Complete())
+	require.Len(tor.MissingPieces(), 2)
+}
+
+func TestPieceEvictionTickEventReleasesConnCapacity(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		PieceEviction: PieceEvictionConfig{
+			Enable:             true,
+			DiskUsageThreshold: 1e-9,
+			KeepFraction:       0.5,
+			MinTorrentSize:     1,
+		},
+	})
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+
+	tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+
+	ctrl, err := state.addTorrent(_testNamespace, tor, false)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	require.NoError(ctrl.dispatcher.Ingest(bytes.NewReader(blob.Content)))
+	state.conns.SetExtraCapacity(h, 2)
+
+	pieceEvictionTickEvent{}.apply(state)
+
+	require.Empty(state.torrentControls)
+	conns, capacity := state.conns.Retained(h)
+	require.Empty(conns)
+	require.Empty(capacity)
+	require.Empty(state.announceQueue.Snapshot())
+}
+
+func TestPieceEvictionTickEventSkipsProtectedNamespaces(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	guaranteed := "prod/" + _testNamespace
+
+	state := mocks.newState(Config{
+		PieceEviction: PieceEvictionConfig{
+			Enable:             true,
+			DiskUsageThreshold: 1e-9,
+			KeepFraction:       0.5,
+			MinTorrentSize:     1,
+			Namespaces: NamespaceEvictionPolicy{
+				BestEffort:        []string{"^" + _testNamespace + "$"},
+				Guaranteed:        []string{"^prod/"},
+				ProtectGuaranteed: true,
+			},
+		},
+	})
+
+	addComplete := func(namespace string) *torrentControl {
+		blob := core.SizedBlobFixture(4, 1)
+
+		mocks.metainfoClient.EXPECT().
+			Download(gomock.Any(), namespace, blob.Digest).
+			Return(blob.MetaInfo, nil)
+
+		tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), namespace, blob.Digest)
+		require.NoError(err)
+
+		ctrl, err := state.addTorrent(namespace, tor, false)
+		require.NoError(err)
+
+		require.NoError(ctrl.dispatcher.Ingest(bytes.NewReader(blob.Content)))
+		require.True(ctrl.dispatcher.Complete())
+		return ctrl
+	}
+
+	bestEffort := addComplete(_testNamespace)
+	protected := addComplete(guaranteed)
+
+	pieceEvictionTickEvent{}.apply(state)
+
+	require.NotContains(state.torrentControls, bestEffort.dispatcher.InfoHash())
+	require.Contains(state.torrentControls, protected.dispatcher.InfoHash())
+	require.True(protected.dispatcher.Complete())
+}
+
+func TestPauseAndResumeTorrentEvents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		LeecherTTI: time.Millisecond,
+	})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	errc := make(chan error, 1)
+	pauseTorrentEvent{h, errc}.apply(state)
+	require.NoError(<-errc)
+	require.True(ctrl.dispatcher.Paused())
+
+	// Paused torrents neither announce nor time out.
+	_, ok := mocks.announceQueue.Next()
+	require.False(ok)
+
+	time.Sleep(5 * time.Millisecond)
+	preemptionTickEvent{}.apply(state)
+	require.Contains(state.torrentControls, h)
+
+	resumeTorrentEvent{h, errc}.apply(state)
+	require.NoError(<-errc)
+	require.False(ctrl.dispatcher.Paused())
+
+	next, ok := mocks.announceQueue.Next()
+	require.True(ok)
+	require.Equal(h, next)
+
+	pauseTorrentEvent{core.InfoHashFixture(), errc}.apply(state)
+	require.Equal(ErrTorrentNotFound, <-errc)
+}
+
+func TestSetTorrentRateLimitEvent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true, WithDownloadRateLimit(1024))
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+	require.Equal(int64(1024), ctrl.ingress.Rate())
+
+	errc := make(chan error, 1)
+	setTorrentRateLimitEvent{h, 4096, errc}.apply(state)
+	require.NoError(<-errc)
+	require.Equal(int64(4096), ctrl.ingress.Rate())
+
+	setTorrentRateLimitEvent{h, 0, errc}.apply(state)
+	require.NoError(<-errc)
+	require.Equal(int64(0), ctrl.ingress.Rate())
+
+	setTorrentRateLimitEvent{core.InfoHashFixture(), 1024, errc}.apply(state)
+	require.Equal(ErrTorrentNotFound, <-errc)
+}
+
+func TestDynamicConnCapacityStartsAtMinConns(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		ConnState: connstate.Config{MaxOpenConnectionsPerTorrent: 10},
+		ConnCapacity: conncapacity.Config{
+			Enable:   true,
+			MinConns: 2,
+		},
+	})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(state.conns.AddPending(core.PeerIDFixture(), h, nil))
+	}
+	require.Equal(
+		connstate.ErrTorrentAtCapacity,
+		state.conns.AddPending(core.PeerIDFixture(), h, nil))
+
+	// Capacity is not adjusted until pending conns become active.
+	connCapacityTickEvent{}.apply(state)
+	connCapacityTickEvent{}.apply(state)
+	require.Equal(2, ctrl.capacity.Capacity())
+}
+
+func TestFailedOutgoingHandshakeEventSkipsBlacklistWhenRemoteAtCapacity(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	peerID := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	require.NoError(state.conns.AddPending(peerID, h, nil))
+	failedOutgoingHandshakeEvent{peerID, h, conn.RejectionError{
+		Reason: p2p.RejectMessage_AT_CAPACITY,
+	}}.apply(state)
+
+	require.False(state.conns.Blacklisted(peerID, h))
+
+	require.NoError(state.conns.AddPending(peerID, h, nil))
+	failedOutgoingHandshakeEvent{peerID, h, conn.RejectionError{
+		Reason: p2p.RejectMessage_UNKNOWN_HASH,
+	}}.apply(state)
+
+	require.True(state.conns.Blacklisted(peerID, h))
+}
+
+func TestFailedOutgoingHandshakeEventSkipsBlacklistWhenCancelled(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	peerID := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	require.NoError(state.conns.AddPending(peerID, h, nil))
+	failedOutgoingHandshakeEvent{peerID, h, context.Canceled}.apply(state)
+
+	require.False(state.conns.Blacklisted(peerID, h))
+	pending, _ := state.conns.NumConns()
+	require.Equal(0, pending)
+}
+
+func TestPreemptionTickEventHonorsTorrentOptions(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		LeecherTTI: time.Hour,
+	})
+
+	defaults, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+
+	short, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true, WithLeecherTTI(time.Millisecond))
+	require.NoError(err)
+
+	exempt, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true,
+		WithLeecherTTI(time.Millisecond), WithPreemptionExempt())
+	require.NoError(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	preemptionTickEvent{}.apply(state)
+
+	require.Contains(state.torrentControls, defaults.dispatcher.InfoHash())
+	require.NotContains(state.torrentControls, short.dispatcher.InfoHash())
+	require.Contains(state.torrentControls, exempt.dispatcher.InfoHash())
+}
+
+func TestAnnounceResultEventReportsPeerIDCollision(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+	stats := tally.NewTestScope("", nil)
+	state.sched.stats = stats
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+
+	self := core.PeerInfoFromContext(state.sched.pctx, false)
+	clone := core.PeerInfoFromContext(state.sched.pctx, false)
+	clone.IP = "10.0.0.1"
+
+	announceResult{
+		local:    state.sched.pctx,
+		infoHash: ctrl.dispatcher.InfoHash(),
+		peers:    []*core.PeerInfo{self, clone},
+	}.prepare().apply(state)
+
+	var collisions int64
+	for _, c := range stats.Snapshot().Counters() {
+		if c.Name() == "peer_id_collisions" {
+			collisions += c.Value()
+		}
+	}
+	require.Equal(int64(1), collisions)
+
+	pending, _ := state.conns.NumConns()
+	require.Equal(0, pending)
+}
+
+func TestSeededExportEventExportsCompleteTorrents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		SeededExport: SeededExportConfig{SigningKey: "key"},
+	})
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+
+	tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+	ctrl, err := state.addTorrent(_testNamespace, tor, false)
+	require.NoError(err)
+
+	// In-progress torrents are not seeded.
+	_, err = state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+
+	result := make(chan *reconcile.Export, 1)
+	seededExportEvent{result}.apply(state)
+	export := <-result
+	require.NoError(export.Verify([]byte("key")))
+	require.Empty(export.InfoHashes)
+	require.Empty(export.Torrents)
+
+	require.NoError(ctrl.dispatcher.Ingest(bytes.NewReader(blob.Content)))
+
+	seededExportEvent{result}.apply(state)
+	export = <-result
+	require.NoError(export.Verify([]byte("key")))
+	require.Equal([]string{blob.MetaInfo.InfoHash().Hex()}, export.InfoHashes)
+	require.Equal(
+		[]reconcile.Torrent{{Namespace: _testNamespace, Digest: blob.Digest}}, export.Torrents)
+	require.True(export.Peer.Complete)
+}
+
+func TestProgressEventReportsTorrentProgress(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	blob := core.SizedBlobFixture(4, 1)
+	mocks.metainfoClient.EXPECT().
+		Download(gomock.Any(), _testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+	tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+	require.NoError(err)
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[1:2]), 1))
+
+	_, err = state.addTorrent(_testNamespace, tor, false)
+	require.NoError(err)
+
+	result := make(chan *Progress, 1)
+	progressEvent{tor.InfoHash(), result}.apply(state)
+	require.Equal(&Progress{
+		InfoHash:       tor.InfoHash(),
+		Digest:         blob.Digest,
+		Length:         4,
+		BytesComplete:  1,
+		PiecesComplete: 1,
+		NumPieces:      4,
+	}, <-result)
+
+	progressEvent{core.InfoHashFixture(), result}.apply(state)
+	require.Nil(<-result)
+}
+
+func TestAddTorrentWithMetadata(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		Metadata: MetadataConfig{TagKeys: []string{"image", "team"}},
+	})
+	stats := tally.NewTestScope("", nil)
+	state.sched.stats = stats
+
+	md := map[string]string{"image": "foo/bar", "deploy": "1234"}
+	ctrl, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true, WithMetadata(md))
+	require.NoError(err)
+
+	result := make(chan *Progress, 1)
+	progressEvent{ctrl.dispatcher.InfoHash(), result}.apply(state)
+	require.Equal(md, (<-result).Metadata)
+
+	// Only configured keys are tagged.
+	ctrl.stats.Counter("test").Inc(1)
+	var tags map[string]string
+	for _, c := range stats.Snapshot().Counters() {
+		if c.Name() == "test" {
+			tags = c.Tags()
+		}
+	}
+	require.Equal(map[string]string{"image": "foo/bar", "team": _noMetadataTag}, tags)
+}
+
+func TestSeedingPolicyTickEventStopsTorrentsOverLimit(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	state := mocks.newState(Config{
+		Seeding: SeedingConfig{
+			SeedingPolicy: SeedingPolicy{MaxDuration: time.Minute, MinSeeders: 1},
+		},
+	}, withClock(clk))
+
+	addComplete := func(opts ...TorrentOption) *torrentControl {
+		blob := core.SizedBlobFixture(2, 1)
+
+		mocks.metainfoClient.EXPECT().
+			Download(gomock.Any(), _testNamespace, blob.Digest).
+			Return(blob.MetaInfo, nil)
+
+		tor, err := mocks.torrentArchive.CreateTorrent(context.Background(), _testNamespace, blob.Digest)
+		require.NoError(err)
+		for i := range blob.Content {
+			require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		}
+		ctrl, err := state.addTorrent(_testNamespace, tor, false, opts...)
+		require.NoError(err)
+		return ctrl
+	}
+
+	// Seeders are counted from announces after completion.
+	expired := addComplete()
+	seeder := core.PeerInfoFixture()
+	seeder.Complete = true
+	announceResultEvent{
+		infoHash: expired.dispatcher.InfoHash(),
+		peers:    []*core.PeerInfo{core.PeerInfoFixture(), seeder},
+	}.apply(state)
+	require.Equal(1, expired.swarmSeeders)
+
+	// The only seeder in the swarm keeps seeding past its max duration.
+	sole := addComplete()
+
+	unlimited := addComplete(WithSeedingPolicy(SeedingPolicy{}))
+	unlimited.swarmSeeders = 1
+
+	inProgress, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	inProgress.swarmSeeders = 1
+
+	clk.Add(2 * time.Minute)
+	seedingPolicyTickEvent{}.apply(state)
+
+	require.NotContains(state.torrentControls, expired.dispatcher.InfoHash())
+	require.Contains(state.torrentControls, sole.dispatcher.InfoHash())
+	require.Contains(state.torrentControls, unlimited.dispatcher.InfoHash())
+	require.Contains(state.torrentControls, inProgress.dispatcher.InfoHash())
+}
+
+func TestIntrospectionEvent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true, WithMetadata(map[string]string{"image": "foo"}))
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	result := make(chan *Introspection, 1)
+	introspectionEvent{result}.apply(state)
+	in := <-result
+
+	require.Len(in.Torrents, 1)
+	require.Equal(h, in.Torrents[0].InfoHash)
+	require.Equal(_testNamespace, in.Torrents[0].Namespace)
+	require.True(in.Torrents[0].LocalRequest)
+	require.Equal(map[string]string{"image": "foo"}, in.Torrents[0].Metadata)
+	require.Equal([]announcequeue.Entry{{
+		InfoHash: h,
+		Priority: announcequeue.PriorityLeecher,
+		Status:   announcequeue.StatusReady,
+	}}, in.AnnounceQueue)
+	require.Empty(in.Conns)
+	require.Empty(in.Queued)
+}
+
+func TestTorrentListenersNotifiedOnFailure(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	results := make(chan TorrentResult, 2)
+	addTorrentListenerEvent{TorrentResultChan(results)}.apply(state)
+	addTorrentListenerEvent{TorrentResultChan(results)}.apply(state)
+
+	ctrl, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), true, WithMetadata(map[string]string{"image": "foo"}))
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	state.removeTorrent(h, ErrTorrentCancelled)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			require.Equal(_testNamespace, r.Namespace)
+			require.Equal(h, r.InfoHash)
+			require.Equal(ctrl.dispatcher.Digest(), r.Digest)
+			require.Equal(ErrTorrentCancelled, r.Err)
+			require.Equal(map[string]string{"image": "foo"}, r.Metadata)
+			require.Equal(ctrl.dispatcher.Length(), r.Length)
+			require.Zero(r.BytesFromPeers + r.BytesFromOrigins + r.BytesFromFallback)
+		case <-time.After(5 * time.Second):
+			require.FailNow("listener not notified")
+		}
+	}
+}
+
+func TestTorrentListenersNotifiedInOrder(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	// The listener blocks until released, such that all results queue up.
+	release := make(chan struct{})
+	results := make(chan TorrentResult, 3)
+	addTorrentListenerEvent{TorrentListenerFunc(func(r TorrentResult) {
+		<-release
+		results <- r
+	})}.apply(state)
+
+	var hashes []core.InfoHash
+	for i := 0; i < 3; i++ {
+		ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+		require.NoError(err)
+		hashes = append(hashes, ctrl.dispatcher.InfoHash())
+	}
+	for _, h := range hashes {
+		state.removeTorrent(h, ErrTorrentCancelled)
+	}
+	close(release)
+
+	for _, h := range hashes {
+		select {
+		case r := <-results:
+			require.Equal(h, r.InfoHash)
+		case <-time.After(5 * time.Second):
+			require.FailNow("listener not notified")
+		}
+	}
+}
+
+func TestPersistAndRestoreState(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "persist")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		Persist: PersistConfig{Path: filepath.Join(dir, "state.json")},
+	}
+	state := mocks.newState(config)
+
+	paused, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	errc := make(chan error, 1)
+	pauseTorrentEvent{paused.dispatcher.InfoHash(), errc}.apply(state)
+	require.NoError(<-errc)
+
+	active, err := state.addTorrent(
+		_testNamespace, mocks.newTorrent(), false,
+		WithPriority(3), WithMetadata(map[string]string{"image": "foo"}))
+	require.NoError(err)
+
+	blacklisted := connstate.BlacklistedConn{
+		PeerID:    core.PeerIDFixture(),
+		InfoHash:  core.InfoHashFixture(),
+		Remaining: time.Minute,
+		Failures:  1,
+		Failure:   connstate.TransferFailure,
+	}
+	state.conns.RestoreBlacklist(blacklisted)
+
+	require.NoError(state.persistState())
+
+	ps, err := loadPersistedState(config.Persist.Path)
+	require.NoError(err)
+	require.NotNil(ps)
+
+	// Persisted state is restored at most once.
+	_, err = os.Stat(config.Persist.Path)
+	require.True(os.IsNotExist(err))
+
+	mocks.announceQueue = announcequeue.New()
+	restored := mocks.newState(config)
+	restoreStateEvent{ps}.apply(restored)
+
+	require.Len(restored.torrentControls, 2)
+	require.True(restored.torrentControls[paused.dispatcher.InfoHash()].dispatcher.Paused())
+
+	ctrl := restored.torrentControls[active.dispatcher.InfoHash()]
+	require.False(ctrl.dispatcher.Paused())
+	require.False(ctrl.localRequest)
+	require.Equal(3, ctrl.opts.priority)
+	require.Equal(map[string]string{"image": "foo"}, ctrl.opts.metadata)
+
+	// Only the active torrent is announced.
+	next, ok := mocks.announceQueue.Next()
+	require.True(ok)
+	require.Equal(active.dispatcher.InfoHash(), next)
+	_, ok = mocks.announceQueue.Next()
+	require.False(ok)
+
+	snapshot := restored.conns.BlacklistSnapshot()
+	require.Len(snapshot, 1)
+	require.Equal(blacklisted.PeerID, snapshot[0].PeerID)
+	require.Equal(connstate.TransferFailure, snapshot[0].Failure)
+}
+
+func TestLoadPersistedStateKeepsInvalidState(t *testing.T) {
+	tests := []struct {
+		desc     string
+		contents string
+	}{
+		{"invalid json", "{"},
+		{"unsupported version", `{"version": 1000}`},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			dir, err := ioutil.TempDir("", "persist")
+			require.NoError(err)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "state.json")
+			require.NoError(ioutil.WriteFile(path, []byte(test.contents), 0644))
+
+			_, err = loadPersistedState(path)
+			require.Error(err)
+
+			_, err = os.Stat(path)
+			require.NoError(err)
+		})
+	}
+}
+
+func TestStarvedTorrentEventReannounces(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	state := mocks.newState(Config{
+		Starvation: StarvationConfig{
+			Enable:         true,
+			Window:         time.Minute,
+			ClearBlacklist: true,
+		},
+	}, withClock(clk))
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	peerID := core.PeerIDFixture()
+	require.NoError(state.conns.Blacklist(peerID, h, connstate.TransferFailure))
+
+	// Timers of the mock clock fire synchronously, blocking on the event loop.
+	go clk.Add(time.Minute)
+	mocks.eventLoop.expect(starvedTorrentEvent{h})
+
+	mocks.announceClient.EXPECT().
+		Announce(ctrl.dispatcher.Digest(), h, false, nil, announceclient.V1).
+		Return(nil, time.Second, nil)
+
+	starvedTorrentEvent{h}.apply(state)
+
+	mocks.eventLoop.expect(announceResultEvent{infoHash: h})
+
+	require.False(state.conns.Blacklisted(peerID, h))
+
+	// The torrent was taken off the announce queue.
+	_, ok := state.announceQueue.Next()
+	require.False(ok)
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// EventLoopConfig defines the queues and instrumentation of the event loop.
+type EventLoopConfig struct {
+	// Queues of each event class. Control events, e.g. cancelling a torrent,
+	// are applied before default events, which are applied before bulk events,
+	// e.g. announce responses, and periodic tick events.
+	Control EventQueueConfig `yaml:"control"`
+	Default EventQueueConfig `yaml:"default"`
+	Bulk    EventQueueConfig `yaml:"bulk"`
+	Tick    EventQueueConfig `yaml:"tick"`
+
+	// LatencyBudget is the duration a single event may spend applying before
+	// a warning is logged. Since events are serialized, an event exceeding its
+	// budget stalls every other event behind it.
+	LatencyBudget time.Duration `yaml:"latency_budget"`
+
+	// AuditSize is the number of most recently applied events retained for
+	// debugging. Set to -1 to disable the event audit.
+	AuditSize int `yaml:"audit_size"`
+}
+
+func (c EventLoopConfig) applyDefaults() EventLoopConfig {
+	if c.LatencyBudget == 0 {
+		c.LatencyBudget = 100 * time.Millisecond
+	}
+	if c.AuditSize == 0 {
+		c.AuditSize = 256
+	}
+	c.Control = c.Control.applyDefaults(64, OverflowBlock)
+	c.Default = c.Default.applyDefaults(1024, OverflowBlock)
+	c.Bulk = c.Bulk.applyDefaults(1024, OverflowBlock)
+	c.Tick = c.Tick.applyDefaults(16, OverflowDrop)
+	return c
+}
+
+func (c EventLoopConfig) queues() map[eventClass]EventQueueConfig {
+	return map[eventClass]EventQueueConfig{
+		eventClassControl: c.Control,
+		eventClassDefault: c.Default,
+		eventClassBulk:    c.Bulk,
+		eventClassTick:    c.Tick,
+	}
+}
+
+func (c EventLoopConfig) validate() error {
+	for class, qc := range c.queues() {
+		if err := qc.validate(); err != nil {
+			return fmt.Errorf("%s queue: %s", class, err)
+		}
+		// Only tick events are safe to drop. Control and default events may
+		// carry reply channels, which their senders would wait on forever, and
+		// bulk events, e.g. announce results, carry state which is not resent.
+		if class != eventClassTick && qc.Overflow == OverflowDrop {
+			return fmt.Errorf("%s queue: overflow policy %q not supported", class, qc.Overflow)
+		}
+	}
+	return nil
+}
+
+// eventName returns the type name of e, used to tag event metrics.
+func eventName(e event) string {
+	t := reflect.TypeOf(e)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// applyEvent applies e to s, emitting the count and latency of e by event
+// type, recording e in the event audit, and warning if e exceeds the latency
+// budget.
+func (s *state) applyEvent(e event) {
+	applied := s.sched.clock.Now()
+	start := time.Now()
+	e.apply(s)
+	elapsed := time.Since(start)
+
+	name := eventName(e)
+	if s.sched.audit != nil {
+		s.sched.audit.record(EventRecord{
+			Event:    name,
+			Class:    classOf(e).String(),
+			Fields:   e.describe(),
+			Applied:  applied,
+			Duration: elapsed,
+		})
+	}
+	s.traceEvent(e, name, elapsed)
+	stats := s.sched.stats.Tagged(map[string]string{"event": name})
+	stats.Counter("events").Inc(1)
+	stats.Timer("event_apply_latency").Record(elapsed)
+
+	if budget := s.sched.config.EventLoop.LatencyBudget; budget > 0 && elapsed > budget {
+		stats.Counter("slow_events").Inc(1)
+		s.sched.logger.With(
+			"event", name,
+			"latency", elapsed,
+			"budget", budget,
+			"depth", s.sched.eventLoop.depth(),
+		).Warn("Event exceeded latency budget")
+	}
+}
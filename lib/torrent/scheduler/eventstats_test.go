@@ -0,0 +1,50 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+type sleepEvent struct {
+	d time.Duration
+}
+
+func (e sleepEvent) apply(*state)          { time.Sleep(e.d) }
+func (e sleepEvent) describe() eventFields { return nil }
+
+func TestApplyEventEmitsEventStats(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		EventLoop: EventLoopConfig{LatencyBudget: 10 * time.Millisecond},
+	})
+	stats := tally.NewTestScope("", nil)
+	state.sched.stats = stats
+
+	state.applyEvent(sleepEvent{0})
+	state.applyEvent(sleepEvent{20 * time.Millisecond})
+
+	snapshot := stats.Snapshot()
+	require.Equal(int64(2), snapshot.Counters()["events+event=sleepEvent"].Value())
+	require.Equal(int64(1), snapshot.Counters()["slow_events+event=sleepEvent"].Value())
+	require.Len(snapshot.Timers()["event_apply_latency+event=sleepEvent"].Values(), 2)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// Eviction reasons.
+const (
+	EvictionIdleSeeder  = "idle_seeder"
+	EvictionIdleLeecher = "idle_leecher"
+)
+
+// EvictionCandidate describes a torrent which the scheduler intends to remove
+// for being idle.
+type EvictionCandidate struct {
+	Namespace string
+	Digest    core.Digest
+	InfoHash  core.InfoHash
+	Complete  bool
+	Reason    string
+	IdleFor   time.Duration
+}
+
+// EvictionHook allows external cache managers, which may know of upcoming
+// demand the scheduler cannot observe, to keep torrents warm.
+type EvictionHook interface {
+	// ApproveEviction returns false to veto the removal of c. It is called
+	// from the scheduler event loop, and thus must return quickly. A vetoed
+	// torrent is reconsidered on every preemption tick.
+	ApproveEviction(c EvictionCandidate) bool
+}
+
+// EvictionHookFunc adapts a function to an EvictionHook.
+type EvictionHookFunc func(c EvictionCandidate) bool
+
+// ApproveEviction calls f(c).
+func (f EvictionHookFunc) ApproveEviction(c EvictionCandidate) bool {
+	return f(c)
+}
+
+// setEvictionHookEvent occurs when an external cache manager registers its
+// EvictionHook.
+type setEvictionHookEvent struct {
+	hook EvictionHook
+}
+
+func (e setEvictionHookEvent) apply(s *state) {
+	s.sched.evictionHook = e.hook
+}
+
+// approveEviction returns whether the idle torrent of ctrl may be removed.
+func (s *state) approveEviction(
+	h core.InfoHash, ctrl *torrentControl, reason string, idleFor time.Duration) bool {
+
+	if s.sched.evictionHook == nil {
+		return true
+	}
+	c := EvictionCandidate{
+		Namespace: ctrl.namespace,
+		Digest:    ctrl.dispatcher.Digest(),
+		InfoHash:  h,
+		Complete:  ctrl.seeding(),
+		Reason:    reason,
+		IdleFor:   idleFor,
+	}
+	if s.sched.evictionHook.ApproveEviction(c) {
+		return true
+	}
+	s.sched.stats.Tagged(map[string]string{
+		"reason": reason,
+	}).Counter("eviction_vetoes").Inc(1)
+	return false
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+)
+
+// controlExperiment tags the metrics of torrents which are not assigned to any
+// experiment.
+const controlExperiment = "control"
+
+// ExperimentConfig defines an alternative set of tunables which a fraction of
+// torrents is assigned to, such that algorithm changes may be measured in
+// production against the rest of the fleet. Metrics of all torrents are tagged
+// with the experiment they are assigned to.
+type ExperimentConfig struct {
+	Name string `yaml:"name"`
+
+	// Fraction is the fraction of torrents assigned to the experiment, between
+	// 0 and 1.
+	Fraction float64 `yaml:"fraction"`
+
+	// Dispatch overrides the dispatch configuration of assigned torrents. Only
+	// non-zero fields are overridden.
+	Dispatch dispatch.Config `yaml:"dispatch"`
+}
+
+// applyDispatch overrides base with the non-zero dispatch fields of e.
+func (e ExperimentConfig) applyDispatch(base dispatch.Config) dispatch.Config {
+	o := e.Dispatch
+	if o.PieceRequestMinTimeout != 0 {
+		base.PieceRequestMinTimeout = o.PieceRequestMinTimeout
+	}
+	if o.PieceRequestTimeoutPerMb != 0 {
+		base.PieceRequestTimeoutPerMb = o.PieceRequestTimeoutPerMb
+	}
+	if o.PieceRequestPolicy != "" {
+		base.PieceRequestPolicy = o.PieceRequestPolicy
+	}
+	if o.PipelineLimit != 0 {
+		base.PipelineLimit = o.PipelineLimit
+	}
+	if o.EndgameThreshold != 0 {
+		base.EndgameThreshold = o.EndgameThreshold
+	}
+	if o.DisableEndgame {
+		base.DisableEndgame = true
+	}
+	if o.Heartbeat.Enable {
+		base.Heartbeat = o.Heartbeat
+	}
+	return base
+}
+
+func validateExperiments(experiments []ExperimentConfig) error {
+	names := make(map[string]bool)
+	var total float64
+	for _, e := range experiments {
+		if e.Name == "" {
+			return errors.New("experiment name must be set")
+		}
+		if e.Name == controlExperiment {
+			return fmt.Errorf("experiment name %q is reserved", controlExperiment)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate experiment %q", e.Name)
+		}
+		names[e.Name] = true
+		if e.Fraction <= 0 || e.Fraction > 1 {
+			return fmt.Errorf("experiment %q: fraction must be in (0, 1]", e.Name)
+		}
+		total += e.Fraction
+	}
+	if total > 1 {
+		return fmt.Errorf("experiment fractions sum to %f, must be at most 1", total)
+	}
+	return nil
+}
+
+// assignExperiment assigns h to one of experiments. Assignment is derived from
+// h alone, such that every peer assigns a torrent to the same experiment, and
+// the swarm of a torrent runs a single parameter set. Returns nil if h belongs
+// to the control group.
+func assignExperiment(experiments []ExperimentConfig, h core.InfoHash) *ExperimentConfig {
+	x := float64(binary.BigEndian.Uint64(h.Bytes()[:8])) / math.MaxUint64
+	var upper float64
+	for i := range experiments {
+		upper += experiments[i].Fraction
+		if x < upper {
+			return &experiments[i]
+		}
+	}
+	return nil
+}
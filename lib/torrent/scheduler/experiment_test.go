@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignExperimentFractions(t *testing.T) {
+	require := require.New(t)
+
+	experiments := []ExperimentConfig{
+		{Name: "a", Fraction: 0.1},
+		{Name: "b", Fraction: 0.3},
+	}
+	require.NoError(validateExperiments(experiments))
+
+	counts := make(map[string]int)
+	n := 10000
+	for i := 0; i < n; i++ {
+		h := core.InfoHashFixture()
+		e := assignExperiment(experiments, h)
+		name := controlExperiment
+		if e != nil {
+			name = e.Name
+		}
+		counts[name]++
+
+		// Assignment is deterministic.
+		require.Equal(e, assignExperiment(experiments, h))
+	}
+	require.InDelta(0.1, float64(counts["a"])/float64(n), 0.02)
+	require.InDelta(0.3, float64(counts["b"])/float64(n), 0.02)
+	require.InDelta(0.6, float64(counts[controlExperiment])/float64(n), 0.02)
+}
+
+func TestValidateExperimentsErrors(t *testing.T) {
+	tests := []struct {
+		desc        string
+		experiments []ExperimentConfig
+	}{
+		{"empty name", []ExperimentConfig{{Fraction: 0.1}}},
+		{"reserved name", []ExperimentConfig{{Name: controlExperiment, Fraction: 0.1}}},
+		{"duplicate name", []ExperimentConfig{{Name: "a", Fraction: 0.1}, {Name: "a", Fraction: 0.1}}},
+		{"zero fraction", []ExperimentConfig{{Name: "a"}}},
+		{"fractions exceed 1", []ExperimentConfig{{Name: "a", Fraction: 0.6}, {Name: "b", Fraction: 0.6}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Error(t, validateExperiments(test.experiments))
+		})
+	}
+}
+
+func TestExperimentApplyDispatchOnlyOverridesSetFields(t *testing.T) {
+	require := require.New(t)
+
+	base := dispatch.Config{
+		PieceRequestPolicy: piecerequest.DefaultPolicy,
+		PipelineLimit:      3,
+		EndgameThreshold:   5,
+	}
+	e := ExperimentConfig{
+		Name:     "rarest",
+		Fraction: 0.5,
+		Dispatch: dispatch.Config{
+			PieceRequestPolicy: piecerequest.RarestFirstPolicy,
+		},
+	}
+	c := e.applyDispatch(base)
+	require.Equal(piecerequest.RarestFirstPolicy, c.PieceRequestPolicy)
+	require.Equal(3, c.PipelineLimit)
+	require.Equal(5, c.EndgameThreshold)
+}
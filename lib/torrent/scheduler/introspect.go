@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+)
+
+// Introspection is a read-only snapshot of the event loop state, captured by
+// a single event such that it is internally consistent.
+type Introspection struct {
+	Torrents []TorrentIntrospection `json:"torrents"`
+
+	// Queued are the info hashes of torrents waiting for admission, in order.
+	// See Config.MaxConcurrentDownloads.
+	Queued []core.InfoHash `json:"queued"`
+
+	AnnounceQueue []announcequeue.Entry       `json:"announce_queue"`
+	Conns         []connstate.ConnInfo        `json:"conns"`
+	Blacklist     []connstate.BlacklistedConn `json:"blacklist"`
+}
+
+// TorrentIntrospection describes the control state of an active torrent.
+type TorrentIntrospection struct {
+	InfoHash          core.InfoHash     `json:"info_hash"`
+	Digest            core.Digest       `json:"digest"`
+	Namespace         string            `json:"namespace"`
+	State             string            `json:"state"`
+	Paused            bool              `json:"paused"`
+	PercentDownloaded int               `json:"percent_downloaded"`
+	Peers             int               `json:"peers"`
+	CreatedAt         time.Time         `json:"created_at"`
+	LocalRequest      bool              `json:"local_request"`
+	Waiters           int               `json:"waiters"`
+	Priority          int               `json:"priority"`
+	PreemptionExempt  bool              `json:"preemption_exempt"`
+	Pinned            bool              `json:"pinned"`
+	Deadline          time.Time         `json:"deadline"`
+	Escalations       []string          `json:"escalations,omitempty"`
+	AnnounceBackoff   bool              `json:"announce_backoff"`
+	SeedingSince      time.Time         `json:"seeding_since"`
+	SwarmSeeders      int               `json:"swarm_seeders"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// introspectionEvent occurs when the event loop state is requested via
+// scheduler API.
+type introspectionEvent struct {
+	result chan *Introspection
+}
+
+func (e introspectionEvent) apply(s *state) {
+	in := &Introspection{
+		Torrents:      []TorrentIntrospection{},
+		Queued:        []core.InfoHash{},
+		AnnounceQueue: s.announceQueue.Snapshot(),
+		Conns:         s.conns.ConnSnapshot(),
+		Blacklist:     s.conns.BlacklistSnapshot(),
+	}
+	for h, ctrl := range s.torrentControls {
+		d := ctrl.dispatcher
+		in.Torrents = append(in.Torrents, TorrentIntrospection{
+			InfoHash:          h,
+			Digest:            d.Digest(),
+			Namespace:         ctrl.namespace,
+			State:             d.State().String(),
+			Paused:            d.Paused(),
+			PercentDownloaded: d.Stat().PercentDownloaded(),
+			Peers:             d.NumPeers(),
+			CreatedAt:         d.CreatedAt(),
+			LocalRequest:      ctrl.localRequest,
+			Waiters:           len(ctrl.errors),
+			Priority:          ctrl.opts.priority,
+			PreemptionExempt:  ctrl.opts.preemptionExempt,
+			Pinned:            ctrl.pinned,
+			Deadline:          ctrl.opts.deadline,
+			Escalations:       ctrl.escalations,
+			AnnounceBackoff:   ctrl.announceBackoff != nil,
+			SeedingSince:      ctrl.seedingSince,
+			SwarmSeeders:      ctrl.swarmSeeders,
+			Metadata:          ctrl.opts.metadata,
+		})
+	}
+	for _, t := range s.admission.torrents {
+		in.Queued = append(in.Queued, t.infoHash())
+	}
+	e.result <- in
+}
+
+// Introspect returns a snapshot of the torrents, announce queue, conns and
+// blacklist of the scheduler, for debugging. Torrents, conns and blacklist
+// entries are sorted by info hash.
+func (s *scheduler) Introspect() (*Introspection, error) {
+	result := make(chan *Introspection, 1)
+	if !s.eventLoop.send(introspectionEvent{result}) {
+		return nil, ErrSchedulerStopped
+	}
+	var in *Introspection
+	select {
+	case in = <-result:
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+	sort.Slice(in.Torrents, func(i, j int) bool {
+		return in.Torrents[i].InfoHash.String() < in.Torrents[j].InfoHash.String()
+	})
+	sort.Slice(in.Conns, func(i, j int) bool {
+		a, b := in.Conns[i], in.Conns[j]
+		if a.InfoHash != b.InfoHash {
+			return a.InfoHash.String() < b.InfoHash.String()
+		}
+		return a.PeerID.LessThan(b.PeerID)
+	})
+	sort.Slice(in.Blacklist, func(i, j int) bool {
+		a, b := in.Blacklist[i], in.Blacklist[j]
+		if a.InfoHash != b.InfoHash {
+			return a.InfoHash.String() < b.InfoHash.String()
+		}
+		return a.PeerID.LessThan(b.PeerID)
+	})
+	return in, nil
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+)
+
+// KnownPeersConfig defines the caching of known-good peers, i.e. peers a
+// torrent dialed and received pieces from. When the torrent is added again,
+// e.g. after it was evicted, its known-good peers are dialed immediately
+// alongside the first announce, shortening the time to the first piece.
+type KnownPeersConfig struct {
+	Disable bool `yaml:"disable"`
+
+	// Size is the maximum number of torrents cached. The least recently
+	// used torrent is evicted once exceeded.
+	Size int `yaml:"size"`
+
+	// PeersPerTorrent is the maximum number of peers cached per torrent.
+	// Peers which sent the most pieces are kept.
+	PeersPerTorrent int `yaml:"peers_per_torrent"`
+
+	// TTL is the duration for which cached peers are dialed. Peers likely
+	// left the swarm afterwards.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c KnownPeersConfig) applyDefaults() KnownPeersConfig {
+	if c.Size == 0 {
+		c.Size = 1024
+	}
+	if c.PeersPerTorrent == 0 {
+		c.PeersPerTorrent = 5
+	}
+	if c.TTL == 0 {
+		c.TTL = time.Hour
+	}
+	return c
+}
+
+// persistedKnownPeers are the known-good peers of a single torrent.
+type persistedKnownPeers struct {
+	InfoHash core.InfoHash    `json:"info_hash"`
+	Peers    []*core.PeerInfo `json:"peers"`
+	SavedAt  time.Time        `json:"saved_at"`
+}
+
+// knownPeers is a bounded LRU cache of known-good peers per torrent. It is
+// only accessed from the event loop. A nil knownPeers disables caching.
+type knownPeers struct {
+	config  KnownPeersConfig
+	entries map[core.InfoHash]*list.Element
+	lru     *list.List
+}
+
+func newKnownPeers(config KnownPeersConfig) *knownPeers {
+	if config.Disable {
+		return nil
+	}
+	return &knownPeers{
+		config:  config,
+		entries: make(map[core.InfoHash]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the known-good peers of h which were saved within the TTL.
+func (k *knownPeers) get(h core.InfoHash, now time.Time) []*core.PeerInfo {
+	if k == nil {
+		return nil
+	}
+	e, ok := k.entries[h]
+	if !ok {
+		return nil
+	}
+	kp := e.Value.(*persistedKnownPeers)
+	if now.Sub(kp.SavedAt) >= k.config.TTL {
+		k.remove(e)
+		return nil
+	}
+	k.lru.MoveToFront(e)
+	return kp.Peers
+}
+
+// set replaces the known-good peers of h.
+func (k *knownPeers) set(kp persistedKnownPeers) {
+	if k == nil || len(kp.Peers) == 0 {
+		return
+	}
+	if e, ok := k.entries[kp.InfoHash]; ok {
+		k.remove(e)
+	}
+	if len(kp.Peers) > k.config.PeersPerTorrent {
+		kp.Peers = kp.Peers[:k.config.PeersPerTorrent]
+	}
+	k.entries[kp.InfoHash] = k.lru.PushFront(&kp)
+	for k.lru.Len() > k.config.Size {
+		k.remove(k.lru.Back())
+	}
+}
+
+// snapshot returns all cached torrents, least recently used first.
+func (k *knownPeers) snapshot() []persistedKnownPeers {
+	if k == nil {
+		return nil
+	}
+	var result []persistedKnownPeers
+	for e := k.lru.Back(); e != nil; e = e.Prev() {
+		result = append(result, *e.Value.(*persistedKnownPeers))
+	}
+	return result
+}
+
+func (k *knownPeers) remove(e *list.Element) {
+	k.lru.Remove(e)
+	delete(k.entries, e.Value.(*persistedKnownPeers).InfoHash)
+}
+
+// rememberKnownPeers caches the peers ctrl dialed and only received good
+// pieces from. Peers which dialed ctrl are not cached, since their listening
+// port is unknown.
+func (s *state) rememberKnownPeers(h core.InfoHash, ctrl *torrentControl) {
+	if s.sched.knownPeers == nil {
+		return
+	}
+	exchanges := ctrl.dispatcher.PeerExchanges()
+	var peers []*core.PeerInfo
+	for peerID, p := range ctrl.dialed {
+		if x := exchanges[peerID]; x.Good > 0 && x.Bad == 0 {
+			// Handed out pieces are stale by the time the peer is dialed
+			// again, so only its address is kept.
+			peers = append(peers, &core.PeerInfo{
+				PeerID: p.PeerID,
+				IP:     p.IP,
+				Port:   p.Port,
+				Origin: p.Origin,
+			})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return exchanges[peers[i].PeerID].Good > exchanges[peers[j].PeerID].Good
+	})
+	s.sched.knownPeers.set(persistedKnownPeers{
+		InfoHash: h,
+		Peers:    peers,
+		SavedAt:  s.sched.clock.Now(),
+	})
+}
+
+// dialKnownPeers dials the known-good peers of the torrent of h, without
+// waiting for the tracker to hand them out.
+func (s *state) dialKnownPeers(h core.InfoHash, ctrl *torrentControl) {
+	if ctrl.seeding() || ctrl.dispatcher.Paused() {
+		return
+	}
+	for _, p := range s.sched.knownPeers.get(h, s.sched.clock.Now()) {
+		if s.conns.Blacklisted(p.PeerID, h) {
+			continue
+		}
+		if err := s.conns.AddPendingFromIP(p.PeerID, h, p.IP, nil); err != nil {
+			if err == connstate.ErrTorrentAtCapacity {
+				break
+			}
+			continue
+		}
+		ctrl.dialed[p.PeerID] = p
+		s.sched.stats.Counter("known_peer_dials").Inc(1)
+		go s.sched.initializeOutgoingHandshake(
+			ctrl.dials, p, ctrl.dispatcher, ctrl.dispatcher.RemoteBitfields(), ctrl.namespace)
+	}
+}
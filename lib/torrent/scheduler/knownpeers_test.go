@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/announceclient"
+)
+
+func TestKnownPeersEvictsLeastRecentlyUsed(t *testing.T) {
+	require := require.New(t)
+
+	k := newKnownPeers(KnownPeersConfig{Size: 2}.applyDefaults())
+	now := time.Now()
+
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+	h3 := core.InfoHashFixture()
+	for _, h := range []core.InfoHash{h1, h2} {
+		k.set(persistedKnownPeers{h, []*core.PeerInfo{core.PeerInfoFixture()}, now})
+	}
+
+	// Touch h1 such that h2 is evicted.
+	require.Len(k.get(h1, now), 1)
+	k.set(persistedKnownPeers{h3, []*core.PeerInfo{core.PeerInfoFixture()}, now})
+
+	require.Len(k.get(h1, now), 1)
+	require.Empty(k.get(h2, now))
+	require.Len(k.get(h3, now), 1)
+}
+
+func TestKnownPeersExpire(t *testing.T) {
+	require := require.New(t)
+
+	k := newKnownPeers(KnownPeersConfig{TTL: time.Minute}.applyDefaults())
+	now := time.Now()
+
+	h := core.InfoHashFixture()
+	k.set(persistedKnownPeers{h, []*core.PeerInfo{core.PeerInfoFixture()}, now})
+
+	require.Len(k.get(h, now.Add(59*time.Second)), 1)
+	require.Empty(k.get(h, now.Add(time.Minute)))
+	require.Empty(k.snapshot())
+}
+
+func TestKnownPeersTruncatesPeersPerTorrent(t *testing.T) {
+	require := require.New(t)
+
+	k := newKnownPeers(KnownPeersConfig{PeersPerTorrent: 2}.applyDefaults())
+	now := time.Now()
+
+	h := core.InfoHashFixture()
+	peers := []*core.PeerInfo{
+		core.PeerInfoFixture(), core.PeerInfoFixture(), core.PeerInfoFixture(),
+	}
+	k.set(persistedKnownPeers{h, peers, now})
+
+	require.Equal(peers[:2], k.get(h, now))
+}
+
+func TestNewTorrentEventDialsKnownPeers(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	torrent := mocks.newTorrent()
+	h := torrent.InfoHash()
+
+	// Nothing listens on the port, so the dial fails.
+	p := core.NewPeerInfo(core.PeerIDFixture(), "127.0.0.1", 1, false, false)
+	state.sched.knownPeers.set(persistedKnownPeers{h, []*core.PeerInfo{p}, time.Now()})
+
+	mocks.announceClient.EXPECT().
+		Announce(torrent.Digest(), h, false, nil, announceclient.V1).
+		Return(nil, time.Second, nil)
+
+	errc := make(chan error, 1)
+	newTorrentEvent{_testNamespace, torrent, nil, errc}.apply(state)
+
+	require.Equal(p, state.torrentControls[h].dialed[p.PeerID])
+
+	// The dial and the announce happen in parallel.
+	var announced, dialed bool
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-mocks.eventLoop.c:
+			switch e := e.(type) {
+			case announceResultEvent:
+				announced = true
+			case failedOutgoingHandshakeEvent:
+				require.Equal(p.PeerID, e.peerID)
+				dialed = true
+			default:
+				t.Fatalf("unexpected event %T", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+	require.True(announced)
+	require.True(dialed)
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package leakwatch
+
+import "time"
+
+// Config defines Watchdog configuration.
+type Config struct {
+	// TTL is how long a handle may remain open after its owner released it
+	// before it is reported as leaked.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.TTL == 0 {
+		c.TTL = 5 * time.Minute
+	}
+	return c
+}
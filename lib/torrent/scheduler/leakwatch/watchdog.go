@@ -0,0 +1,235 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package leakwatch detects storage.Torrent handles which outlive their
+// owner. A handle is opened by the owner of a torrent, e.g. its torrentControl,
+// and every storage handle acquired from the torrent, e.g. an open piece reader
+// or a piece write in progress, holds a reference on the handle until it is
+// released. Once the owner releases the handle, all references are expected to
+// be dropped shortly after. Handles with references remaining for longer than
+// a TTL are reported as leaked, along with the names of the remaining
+// references.
+package leakwatch
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+)
+
+// Leak describes a handle which remains open after its owner released it.
+type Leak struct {
+	InfoHash core.InfoHash `json:"info_hash"`
+	Owner    string        `json:"owner"`
+	Released time.Time     `json:"released"`
+
+	// References are the holders of the remaining references, sorted.
+	References []string `json:"references"`
+}
+
+func (l Leak) String() string {
+	return fmt.Sprintf(
+		"Leak(hash=%s, owner=%s, released=%s, references=%v)",
+		l.InfoHash, l.Owner, l.Released.Format(time.RFC3339), l.References)
+}
+
+// Watchdog tracks open handles and reports leaks.
+type Watchdog struct {
+	config Config
+	clk    clock.Clock
+	stats  tally.Scope
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex // Protects the following fields.
+	handles map[*Handle]struct{}
+}
+
+// New creates a new Watchdog.
+func New(
+	config Config, clk clock.Clock, stats tally.Scope, logger *zap.SugaredLogger) *Watchdog {
+
+	return &Watchdog{
+		config: config.applyDefaults(),
+		clk:    clk,
+		stats: stats.Tagged(map[string]string{
+			"module": "leakwatch",
+		}),
+		logger:  logger,
+		handles: make(map[*Handle]struct{}),
+	}
+}
+
+// Handle is a reference counted handle of a torrent. Handle is thread-safe.
+type Handle struct {
+	w        *Watchdog
+	infoHash core.InfoHash
+	owner    string
+
+	// The following fields are protected by w.mu.
+	refs     map[string]int
+	released time.Time
+	reported bool
+}
+
+// Open opens a handle of the torrent for h on behalf of owner. The handle
+// remains open until owner calls Release and all references are dropped.
+func (w *Watchdog) Open(h core.InfoHash, owner string) *Handle {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	handle := &Handle{
+		w:        w,
+		infoHash: h,
+		owner:    owner,
+		refs:     map[string]int{owner: 1},
+	}
+	w.handles[handle] = struct{}{}
+	return handle
+}
+
+// Acquire adds a reference to h held by holder. The returned function drops
+// the reference and must be called exactly once.
+func (h *Handle) Acquire(holder string) (drop func()) {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+
+	h.refs[holder]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { h.w.drop(h, holder) })
+	}
+}
+
+// Release drops the reference of the owner of h. No-ops if h was already
+// released.
+func (h *Handle) Release() {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+
+	if !h.released.IsZero() {
+		return
+	}
+	h.released = h.w.clk.Now()
+	h.w.dropLocked(h, h.owner)
+}
+
+func (w *Watchdog) drop(h *Handle, holder string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dropLocked(h, holder)
+}
+
+func (w *Watchdog) dropLocked(h *Handle, holder string) {
+	h.refs[holder]--
+	if h.refs[holder] <= 0 {
+		delete(h.refs, holder)
+	}
+	if len(h.refs) > 0 {
+		return
+	}
+	delete(w.handles, h)
+	if h.reported {
+		w.logger.With("hash", h.infoHash).Infof(
+			"Leaked storage handle closed %s after release", w.clk.Now().Sub(h.released))
+	}
+}
+
+// NumOpen returns the number of open handles, including handles which have
+// been released but still hold references.
+func (w *Watchdog) NumOpen() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.handles)
+}
+
+// Released returns all handles which have been released by their owner but
+// still hold references, regardless of TTL.
+func (w *Watchdog) Released() []Leak {
+	return w.collect(0)
+}
+
+// Leaks returns all handles which have been released by their owner for
+// longer than the configured TTL but still hold references.
+func (w *Watchdog) Leaks() []Leak {
+	return w.collect(w.config.TTL)
+}
+
+func (w *Watchdog) collect(ttl time.Duration) []Leak {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var leaks []Leak
+	for h := range w.handles {
+		if w.expiredLocked(h, ttl) {
+			leaks = append(leaks, h.leakLocked())
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].Released.Before(leaks[j].Released)
+	})
+	return leaks
+}
+
+func (w *Watchdog) expiredLocked(h *Handle, ttl time.Duration) bool {
+	return !h.released.IsZero() && w.clk.Now().Sub(h.released) >= ttl
+}
+
+func (h *Handle) leakLocked() Leak {
+	var refs []string
+	for holder, n := range h.refs {
+		for i := 0; i < n; i++ {
+			refs = append(refs, holder)
+		}
+	}
+	sort.Strings(refs)
+	return Leak{
+		InfoHash:   h.infoHash,
+		Owner:      h.owner,
+		Released:   h.released,
+		References: refs,
+	}
+}
+
+// Check emits handle metrics and logs newly detected leaks. Returns all
+// current leaks.
+func (w *Watchdog) Check() []Leak {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var leaks []Leak
+	for h := range w.handles {
+		if !w.expiredLocked(h, w.config.TTL) {
+			continue
+		}
+		leak := h.leakLocked()
+		if !h.reported {
+			h.reported = true
+			w.stats.Counter("storage_handles_leaked").Inc(1)
+			w.logger.With("hash", h.infoHash).Errorf("Detected storage handle leak: %s", leak)
+		}
+		leaks = append(leaks, leak)
+	}
+	w.stats.Gauge("storage_handles_open").Update(float64(len(w.handles)))
+	w.stats.Gauge("storage_handles_leaking").Update(float64(len(leaks)))
+	return leaks
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package leakwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+)
+
+func newTestWatchdog(ttl time.Duration) (*Watchdog, *clock.Mock, tally.TestScope) {
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	return New(Config{TTL: ttl}, clk, stats, zap.NewNop().Sugar()), clk, stats
+}
+
+func TestHandleClosesOnceReleasedAndAllReferencesDropped(t *testing.T) {
+	require := require.New(t)
+
+	w, _, _ := newTestWatchdog(time.Minute)
+
+	h := w.Open(core.InfoHashFixture(), "torrent_control")
+	drop1 := h.Acquire("piece_reader(0)")
+	drop2 := h.Acquire("piece_reader(0)")
+	require.Equal(1, w.NumOpen())
+
+	drop1()
+	drop1() // Dropping the same reference twice has no effect.
+	h.Release()
+	require.Equal(1, w.NumOpen())
+	require.Len(w.Released(), 1)
+
+	drop2()
+	require.Equal(0, w.NumOpen())
+	require.Empty(w.Released())
+}
+
+func TestHandleRemainsOpenUntilReleased(t *testing.T) {
+	require := require.New(t)
+
+	w, clk, _ := newTestWatchdog(time.Minute)
+
+	h := w.Open(core.InfoHashFixture(), "torrent_control")
+	h.Acquire("piece_reader(0)")()
+
+	clk.Add(time.Hour)
+	require.Equal(1, w.NumOpen())
+	require.Empty(w.Leaks())
+
+	h.Release()
+	h.Release()
+	require.Equal(0, w.NumOpen())
+}
+
+func TestCheckReportsLeaksAfterTTL(t *testing.T) {
+	require := require.New(t)
+
+	w, clk, stats := newTestWatchdog(time.Minute)
+
+	ih := core.InfoHashFixture()
+	h := w.Open(ih, "torrent_control")
+	h.Acquire("piece_reader(2)")
+	h.Acquire("piece_reader(1)")
+	h.Release()
+
+	clk.Add(30 * time.Second)
+	require.Empty(w.Check())
+	require.Len(w.Released(), 1)
+
+	clk.Add(30 * time.Second)
+	leaks := w.Check()
+	require.Equal([]Leak{{
+		InfoHash:   ih,
+		Owner:      "torrent_control",
+		Released:   clk.Now().Add(-time.Minute),
+		References: []string{"piece_reader(1)", "piece_reader(2)"},
+	}}, leaks)
+	require.Equal(leaks, w.Leaks())
+
+	// Leaks are only counted once.
+	w.Check()
+	require.Equal(int64(1), stats.Snapshot().Counters()["storage_handles_leaked+module=leakwatch"].Value())
+	require.Equal(float64(1), stats.Snapshot().Gauges()["storage_handles_leaking+module=leakwatch"].Value())
+}
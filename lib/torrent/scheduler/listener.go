@@ -0,0 +1,162 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+)
+
+// _listenerQueueSize bounds the results pending delivery to listeners.
+const _listenerQueueSize = 1000
+
+// TorrentResult describes a torrent which finished downloading, either because
+// it completed or because it failed.
+type TorrentResult struct {
+	Namespace string
+	Digest    core.Digest
+	InfoHash  core.InfoHash
+	Metadata  map[string]string
+
+	// Err is nil if the torrent completed, else the error sent to its waiters,
+	// e.g. ErrTorrentTimeout or ErrTorrentCancelled.
+	Err error
+
+	// Duration is the time since the torrent was added.
+	Duration time.Duration
+
+	// Length is the total length of the torrent.
+	Length int64
+
+	// Bytes of pieces downloaded by this peer, by source. Pieces which were
+	// already on disk or ingested are not counted. Origins are the peers
+	// handed out by the tracker as origins.
+	BytesFromPeers    int64
+	BytesFromOrigins  int64
+	BytesFromFallback int64
+}
+
+// TorrentListener is notified whenever a torrent completes or fails, e.g. to
+// update cache indexes without polling the scheduler.
+type TorrentListener interface {
+	// TorrentFinished is called outside of the scheduler event loop, from a
+	// single goroutine shared by all listeners. Results are delivered in order,
+	// and listeners are called in order of registration. Listeners may block,
+	// however results are dropped while too many are pending delivery.
+	TorrentFinished(r TorrentResult)
+}
+
+// TorrentListenerFunc adapts a function to a TorrentListener.
+type TorrentListenerFunc func(r TorrentResult)
+
+// TorrentFinished calls f(r).
+func (f TorrentListenerFunc) TorrentFinished(r TorrentResult) {
+	f(r)
+}
+
+// TorrentResultChan returns a TorrentListener which sends results to c.
+// Results are dropped if c is full.
+func TorrentResultChan(c chan<- TorrentResult) TorrentListener {
+	return TorrentListenerFunc(func(r TorrentResult) {
+		select {
+		case c <- r:
+		default:
+		}
+	})
+}
+
+// addTorrentListenerEvent occurs when a TorrentListener is registered.
+type addTorrentListenerEvent struct {
+	listener TorrentListener
+}
+
+func (e addTorrentListenerEvent) apply(s *state) {
+	s.sched.listeners = append(s.sched.listeners, e.listener)
+}
+
+// AddTorrentListener registers l to be notified of finished torrents.
+func (s *scheduler) AddTorrentListener(l TorrentListener) error {
+	if !s.eventLoop.send(addTorrentListenerEvent{l}) {
+		return ErrSchedulerStopped
+	}
+	return nil
+}
+
+// notifyListeners asynchronously notifies all listeners that the torrent of
+// ctrl finished with err. Results are queued for delivery by a single goroutine,
+// which is started along with the first notification.
+func (s *state) notifyListeners(ctrl *torrentControl, err error) {
+	if len(s.sched.listeners) == 0 {
+		return
+	}
+	d := ctrl.dispatcher
+	r := TorrentResult{
+		Namespace: ctrl.namespace,
+		Digest:    d.Digest(),
+		InfoHash:  d.InfoHash(),
+		Metadata:  ctrl.opts.metadata,
+		Err:       err,
+		Duration:  s.sched.clock.Now().Sub(d.CreatedAt()),
+		Length:    d.Length(),
+	}
+	for _, p := range d.Provenance() {
+		n := d.PieceLength(p.Index)
+		switch {
+		case p.Source == provenance.SourceFallback:
+			r.BytesFromFallback += n
+		case p.Source != provenance.SourcePeer:
+		case ctrl.origins[p.PeerID]:
+			r.BytesFromOrigins += n
+		default:
+			r.BytesFromPeers += n
+		}
+	}
+	if s.sched.listenerResults == nil {
+		s.sched.listenerResults = make(chan listenerResult, _listenerQueueSize)
+		go s.sched.deliverListenerResults(s.sched.listenerResults)
+	}
+	select {
+	case s.sched.listenerResults <- listenerResult{
+		listeners: append([]TorrentListener(nil), s.sched.listeners...),
+		result:    r,
+	}:
+	default:
+		s.sched.stats.Counter("listener_results_dropped").Inc(1)
+		s.log("hash", r.InfoHash).Warn("Listener queue full, dropping torrent result")
+	}
+}
+
+// listenerResult is a result pending delivery to the listeners registered when
+// the torrent finished.
+type listenerResult struct {
+	listeners []TorrentListener
+	result    TorrentResult
+}
+
+// deliverListenerResults notifies listeners of the results received on c until
+// the scheduler stops.
+func (s *scheduler) deliverListenerResults(c <-chan listenerResult) {
+	for {
+		select {
+		case r := <-c:
+			for _, l := range r.listeners {
+				l.TorrentFinished(r.result)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
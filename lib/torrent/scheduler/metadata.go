@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sync"
+
+	"github.com/uber-go/tally"
+)
+
+// Tag values of metadata keys.
+const (
+	// _noMetadataTag is the tag value of metadata keys a torrent was added
+	// without.
+	_noMetadataTag = "none"
+
+	// _otherMetadataTag is the tag value of metadata values past
+	// MetadataConfig.MaxTagValues.
+	_otherMetadataTag = "other"
+)
+
+// MetadataConfig defines how metadata attached to torrents via WithMetadata is
+// reported. Metadata is always included in torrent logs, progress and
+// completion callbacks.
+type MetadataConfig struct {
+	// TagKeys are the metadata keys which are added as tags to per-torrent
+	// metrics. Since metadata is opaque, only these keys are tagged. Torrents
+	// without a key are tagged "none".
+	TagKeys []string `yaml:"tag_keys"`
+
+	// MaxTagValues is the maximum number of distinct values tagged per key,
+	// such that metric cardinality stays bounded. Values seen after the first
+	// MaxTagValues are tagged "other".
+	MaxTagValues int `yaml:"max_tag_values"`
+}
+
+func (c MetadataConfig) applyDefaults() MetadataConfig {
+	if c.MaxTagValues == 0 {
+		c.MaxTagValues = 32
+	}
+	return c
+}
+
+// metadataTagger tags per-torrent metrics with torrent metadata. Thread-safe.
+type metadataTagger struct {
+	config MetadataConfig
+
+	mu     sync.Mutex
+	values map[string]map[string]bool // Tagged values by key.
+}
+
+func newMetadataTagger(config MetadataConfig) *metadataTagger {
+	return &metadataTagger{
+		config: config,
+		values: make(map[string]map[string]bool),
+	}
+}
+
+// tagged returns stats tagged with the metadata of md, per TagKeys.
+func (t *metadataTagger) tagged(stats tally.Scope, md map[string]string) tally.Scope {
+	if len(t.config.TagKeys) == 0 {
+		return stats
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tags := make(map[string]string, len(t.config.TagKeys))
+	for _, k := range t.config.TagKeys {
+		v, ok := md[k]
+		if !ok || v == "" {
+			v = _noMetadataTag
+		} else {
+			v = t.bound(k, v)
+		}
+		tags[k] = v
+	}
+	return stats.Tagged(tags)
+}
+
+// bound returns v if it is among the first MaxTagValues values of k, else
+// "other".
+func (t *metadataTagger) bound(k, v string) string {
+	values, ok := t.values[k]
+	if !ok {
+		values = make(map[string]bool)
+		t.values[k] = values
+	}
+	if values[v] {
+		return v
+	}
+	if len(values) >= t.config.MaxTagValues {
+		return _otherMetadataTag
+	}
+	values[v] = true
+	return v
+}
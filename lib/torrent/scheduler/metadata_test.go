@@ -0,0 +1,46 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestMetadataTaggerBoundsValuesPerKey(t *testing.T) {
+	require := require.New(t)
+
+	tagger := newMetadataTagger(MetadataConfig{TagKeys: []string{"image"}, MaxTagValues: 2})
+
+	tags := func(md map[string]string) map[string]string {
+		stats := tally.NewTestScope("", nil)
+		tagger.tagged(stats, md).Counter("test").Inc(1)
+		for _, c := range stats.Snapshot().Counters() {
+			return c.Tags()
+		}
+		return nil
+	}
+
+	require.Equal(map[string]string{"image": "a"}, tags(map[string]string{"image": "a"}))
+	require.Equal(map[string]string{"image": "b"}, tags(map[string]string{"image": "b"}))
+	require.Equal(map[string]string{"image": _otherMetadataTag}, tags(map[string]string{"image": "c"}))
+
+	// Values tagged before the limit was reached are still tagged.
+	require.Equal(map[string]string{"image": "a"}, tags(map[string]string{"image": "a"}))
+
+	// Missing keys do not count towards the limit.
+	require.Equal(map[string]string{"image": _noMetadataTag}, tags(nil))
+}
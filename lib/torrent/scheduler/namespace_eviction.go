@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// evictionClass orders namespaces for eviction. Lower classes are evicted
+// first.
+type evictionClass int
+
+const (
+	evictionBestEffort evictionClass = iota
+	evictionStandard
+	evictionGuaranteed
+)
+
+func (c evictionClass) String() string {
+	switch c {
+	case evictionBestEffort:
+		return "best_effort"
+	case evictionGuaranteed:
+		return "guaranteed"
+	default:
+		return "standard"
+	}
+}
+
+// NamespaceEvictionPolicy orders eviction under disk pressure by namespace,
+// such that content of namespaces which are merely cached on behalf of others
+// is evicted before content which the agent is expected to retain.
+type NamespaceEvictionPolicy struct {
+	// BestEffort are regular expressions of namespaces which are evicted before
+	// all other namespaces.
+	BestEffort []string `yaml:"best_effort"`
+
+	// Guaranteed are regular expressions of namespaces which are evicted only
+	// once no other namespace has content left to evict. Namespaces matching
+	// both BestEffort and Guaranteed are guaranteed.
+	Guaranteed []string `yaml:"guaranteed"`
+
+	// ProtectGuaranteed never evicts content of guaranteed namespaces.
+	ProtectGuaranteed bool `yaml:"protect_guaranteed"`
+}
+
+// namespaceClassifier assigns namespaces to eviction classes.
+type namespaceClassifier struct {
+	bestEffort        []*regexp.Regexp
+	guaranteed        []*regexp.Regexp
+	protectGuaranteed bool
+}
+
+func newNamespaceClassifier(p NamespaceEvictionPolicy) (*namespaceClassifier, error) {
+	bestEffort, err := compileNamespaces(p.BestEffort)
+	if err != nil {
+		return nil, fmt.Errorf("best effort: %s", err)
+	}
+	guaranteed, err := compileNamespaces(p.Guaranteed)
+	if err != nil {
+		return nil, fmt.Errorf("guaranteed: %s", err)
+	}
+	return &namespaceClassifier{bestEffort, guaranteed, p.ProtectGuaranteed}, nil
+}
+
+func compileNamespaces(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %s", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func (c *namespaceClassifier) classify(namespace string) evictionClass {
+	if matchAny(c.guaranteed, namespace) {
+		return evictionGuaranteed
+	}
+	if matchAny(c.bestEffort, namespace) {
+		return evictionBestEffort
+	}
+	return evictionStandard
+}
+
+// evictable returns true if content of namespace may be evicted.
+func (c *namespaceClassifier) evictable(namespace string) bool {
+	return !c.protectGuaranteed || c.classify(namespace) != evictionGuaranteed
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceClassifier(t *testing.T) {
+	c, err := newNamespaceClassifier(NamespaceEvictionPolicy{
+		BestEffort: []string{"^cache/.*", "^shared/.*"},
+		Guaranteed: []string{"^prod/.*", "^shared/critical$"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		namespace string
+		expected  evictionClass
+	}{
+		{"cache/foo", evictionBestEffort},
+		{"shared/foo", evictionBestEffort},
+		{"shared/critical", evictionGuaranteed},
+		{"prod/foo", evictionGuaranteed},
+		{"dev/foo", evictionStandard},
+		{"", evictionStandard},
+	}
+	for _, test := range tests {
+		t.Run(test.namespace, func(t *testing.T) {
+			require.Equal(t, test.expected, c.classify(test.namespace))
+			require.True(t, c.evictable(test.namespace))
+		})
+	}
+}
+
+func TestNamespaceClassifierProtectGuaranteed(t *testing.T) {
+	require := require.New(t)
+
+	c, err := newNamespaceClassifier(NamespaceEvictionPolicy{
+		Guaranteed:        []string{"^prod/.*"},
+		ProtectGuaranteed: true,
+	})
+	require.NoError(err)
+
+	require.False(c.evictable("prod/foo"))
+	require.True(c.evictable("dev/foo"))
+}
+
+func TestNamespaceClassifierInvalidPattern(t *testing.T) {
+	_, err := newNamespaceClassifier(NamespaceEvictionPolicy{BestEffort: []string{"("}})
+	require.Error(t, err)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/uber/kraken/core"
+)
+
+// offloader is implemented by events which can do expensive work before
+// entering the event loop, such as building peer candidate lists, to cut the
+// time the loop is occupied. The work is split in two steps:
+//
+//   - prepare runs on the sending goroutine. It has no access to state, and
+//     may only read the immutable inputs carried by the offloader itself.
+//   - The event returned by prepare applies only the minimal mutation of
+//     state within the event loop.
+//
+// Offloaders deliberately do not implement event, such that they can only
+// enter the event loop via liftedEventLoop.offload.
+type offloader interface {
+	prepare() event
+}
+
+// offload prepares o on the calling goroutine and sends the resulting event
+// into l. Returns false if l is not running.
+func (l *liftedEventLoop) offload(o offloader) bool {
+	return l.send(o.prepare())
+}
+
+// announceResult is a successful announce response, prepared into an
+// announceResultEvent off the event loop.
+type announceResult struct {
+	local    core.PeerContext
+	infoHash core.InfoHash
+	peers    []*core.PeerInfo
+	content  []byte
+}
+
+// prepare builds the peer candidate list of the announce, dropping duplicates
+// and the local peer. Other hosts announcing the local peer id are reported as
+// collisions.
+func (r announceResult) prepare() event {
+	e := announceResultEvent{infoHash: r.infoHash, content: r.content}
+	seen := make(map[core.PeerID]bool, len(r.peers))
+	for _, p := range r.peers {
+		if p.PeerID == r.local.PeerID {
+			// Tracker may return our own peer, however the same peer id at a
+			// different address belongs to another host.
+			if p.IP != r.local.IP || p.Port != r.local.Port {
+				e.collisions = append(e.collisions, fmt.Sprintf("%s:%d", p.IP, p.Port))
+			}
+			continue
+		}
+		if seen[p.PeerID] {
+			continue
+		}
+		seen[p.PeerID] = true
+		e.peers = append(e.peers, p)
+	}
+	return e
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func TestAnnounceResultPrepareBuildsCandidates(t *testing.T) {
+	require := require.New(t)
+
+	local := core.PeerContextFixture()
+	self := core.PeerInfoFromContext(local, false)
+	clone := core.PeerInfoFromContext(local, false)
+	clone.IP = "10.0.0.1"
+
+	p1 := core.PeerInfoFixture()
+	p2 := core.PeerInfoFixture()
+	h := core.InfoHashFixture()
+
+	e := announceResult{
+		local:    local,
+		infoHash: h,
+		peers:    []*core.PeerInfo{p1, self, p2, clone, p1},
+	}.prepare()
+
+	require.Equal(announceResultEvent{
+		infoHash:   h,
+		peers:      []*core.PeerInfo{p1, p2},
+		collisions: []string{fmt.Sprintf("10.0.0.1:%d", local.Port)},
+	}, e)
+}
+
+func TestOffloadSendsPreparedEvent(t *testing.T) {
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	h := core.InfoHashFixture()
+
+	l := liftEventLoop(mocks.eventLoop)
+	go l.offload(announceResult{local: core.PeerContextFixture(), infoHash: h})
+
+	mocks.eventLoop.expect(announceResultEvent{infoHash: h})
+}
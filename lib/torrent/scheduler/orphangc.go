@@ -0,0 +1,223 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// OrphanGCConfig defines collection of torrent data on disk which no torrent
+// can use, e.g. partial downloads left behind by a crash. Data is orphaned if
+// no torrent of the scheduler owns it, and it is either incomplete or missing
+// its metainfo. Complete data is left to the cleanup of the store.
+type OrphanGCConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Interval is the duration between passes, which run in addition to the
+	// pass at startup.
+	Interval time.Duration `yaml:"interval"`
+
+	// Grace is the minimum duration since data was last modified before it is
+	// considered orphaned, such that data of torrents being added is never
+	// collected.
+	Grace time.Duration `yaml:"grace"`
+
+	// DryRun logs and counts orphans without removing them.
+	DryRun bool `yaml:"dry_run"`
+
+	// QuarantineDir, if set, moves orphans into it rather than deleting them.
+	// Must be on the same filesystem as the torrent archive.
+	QuarantineDir string `yaml:"quarantine_dir"`
+}
+
+func (c OrphanGCConfig) applyDefaults() OrphanGCConfig {
+	if c.Interval == 0 {
+		c.Interval = time.Hour
+	}
+	if c.Grace == 0 {
+		c.Grace = time.Hour
+	}
+	return c
+}
+
+// orphanCollector periodically removes orphaned torrent data.
+type orphanCollector struct {
+	config  OrphanGCConfig
+	archive storage.TorrentArchive
+	scanner storage.Scanner
+	clk     clock.Clock
+	stats   tally.Scope
+	logger  *zap.SugaredLogger
+
+	// active returns the digests of all torrents of the scheduler.
+	active func() (map[core.Digest]bool, error)
+
+	wg sync.WaitGroup
+}
+
+func newOrphanCollector(
+	config OrphanGCConfig,
+	archive storage.TorrentArchive,
+	scanner storage.Scanner,
+	clk clock.Clock,
+	stats tally.Scope,
+	logger *zap.SugaredLogger,
+	active func() (map[core.Digest]bool, error)) *orphanCollector {
+
+	return &orphanCollector{
+		config:  config,
+		archive: archive,
+		scanner: scanner,
+		clk:     clk,
+		stats:   stats,
+		logger:  logger,
+		active:  active,
+	}
+}
+
+func (c *orphanCollector) start(done <-chan struct{}) {
+	if c.config.DryRun {
+		c.logger.Warn("Orphan GC running in dry run mode")
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := c.clk.Ticker(c.config.Interval)
+		defer ticker.Stop()
+		for {
+			c.collect()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// wait blocks until the collector has exited.
+func (c *orphanCollector) wait() {
+	c.wg.Wait()
+}
+
+// collect runs a single pass, and returns the number of orphans found.
+func (c *orphanCollector) collect() int {
+	start := c.clk.Now()
+	torrents, err := c.scanner.ListTorrents()
+	if err != nil {
+		c.logger.Errorf("Error listing torrents for orphan GC: %s", err)
+		c.stats.Counter("orphan_gc_errors").Inc(1)
+		return 0
+	}
+	// Listed first, such that torrents added concurrently are either active
+	// or were modified within the grace period.
+	active, err := c.active()
+	if err != nil {
+		c.logger.Errorf("Error getting active torrents for orphan GC, skipping pass: %s", err)
+		c.stats.Counter("orphan_gc_errors").Inc(1)
+		return 0
+	}
+	var n int
+	for _, t := range torrents {
+		reason := orphanReason(t)
+		if reason == "" || active[t.Digest] || c.clk.Now().Sub(t.ModTime) < c.config.Grace {
+			continue
+		}
+		c.remove(t, reason)
+		n++
+	}
+	c.stats.Timer("orphan_gc").Record(c.clk.Now().Sub(start))
+	return n
+}
+
+// orphanReason returns why t is orphaned, or empty if t may be used by a
+// torrent once added.
+func orphanReason(t storage.StoredTorrent) string {
+	if !t.HasMetaInfo {
+		return "no_metainfo"
+	}
+	if !t.Complete {
+		return "incomplete"
+	}
+	return ""
+}
+
+func (c *orphanCollector) remove(t storage.StoredTorrent, reason string) {
+	var action string
+	var err error
+	switch {
+	case c.config.DryRun:
+		action = "dry_run"
+	case c.config.QuarantineDir != "":
+		action = "quarantined"
+		err = c.scanner.QuarantineTorrent(t.Digest, c.config.QuarantineDir)
+	default:
+		action = "deleted"
+		err = c.archive.DeleteTorrent(t.Digest)
+	}
+	logger := c.logger.With(
+		"digest", t.Digest.Hex(), "size", t.Size, "reason", reason, "action", action)
+	if err != nil {
+		logger.Errorf("Error collecting orphaned torrent data: %s", err)
+		c.stats.Counter("orphan_gc_errors").Inc(1)
+		return
+	}
+	logger.Info("Collected orphaned torrent data")
+
+	stats := c.stats.Tagged(map[string]string{
+		"reason": reason,
+		"action": action,
+	})
+	stats.Counter("orphans").Inc(1)
+	stats.Counter("orphan_bytes").Inc(t.Size)
+}
+
+// activeDigestsEvent occurs when the orphan collector requests the digests of
+// all torrents, including torrents waiting for admission, whose partial data
+// is resumed once admitted.
+type activeDigestsEvent struct {
+	result chan map[core.Digest]bool
+}
+
+func (e activeDigestsEvent) apply(s *state) {
+	active := make(map[core.Digest]bool, len(s.torrentControls))
+	for _, ctrl := range s.torrentControls {
+		active[ctrl.dispatcher.Digest()] = true
+	}
+	for _, t := range s.admission.torrents {
+		active[t.requests[0].torrent.Digest()] = true
+	}
+	e.result <- active
+}
+
+func (s *scheduler) activeDigests() (map[core.Digest]bool, error) {
+	result := make(chan map[core.Digest]bool, 1)
+	if !s.eventLoop.send(activeDigestsEvent{result}) {
+		return nil, ErrSchedulerStopped
+	}
+	select {
+	case active := <-result:
+		return active, nil
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+func TestOrphanCollectorRemovesOnlyOrphans(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	p := mocks.newPeer(configFixture())
+	namespace := core.TagFixture()
+
+	// Active partial download.
+	active := core.NewBlobFixture()
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, active.Digest).Return(active.MetaInfo, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.scheduler.Download(ctx, namespace, active.Digest)
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		torrents, err := p.scheduler.Torrents()
+		return err == nil && len(torrents) == 1
+	}))
+
+	// Partial download which no torrent owns.
+	partial := core.NewBlobFixture()
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, partial.Digest).Return(partial.MetaInfo, nil)
+	_, err := p.torrentArchive.CreateTorrent(context.Background(), namespace, partial.Digest)
+	require.NoError(err)
+
+	// Complete torrent which is not seeding.
+	complete := core.NewBlobFixture()
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, complete.Digest).Return(complete.MetaInfo, nil)
+	p.writeTorrent(namespace, complete)
+
+	// Data whose metainfo was never written.
+	noMetaInfo := core.DigestFixture()
+	require.NoError(p.cads.CreateDownloadFile(noMetaInfo.Hex(), 16))
+
+	stats := tally.NewTestScope("", nil)
+	newCollector := func(config OrphanGCConfig) *orphanCollector {
+		config.Grace = time.Nanosecond
+		return newOrphanCollector(
+			config.applyDefaults(), p.torrentArchive, p.torrentArchive.(storage.Scanner),
+			p.scheduler.clock, stats, p.scheduler.logger, p.scheduler.activeDigests)
+	}
+
+	require.Equal(2, newCollector(OrphanGCConfig{DryRun: true}).collect())
+	torrents, err := p.torrentArchive.(storage.Scanner).ListTorrents()
+	require.NoError(err)
+	require.Len(torrents, 4)
+
+	require.Equal(2, newCollector(OrphanGCConfig{}).collect())
+
+	for _, d := range []core.Digest{active.Digest, complete.Digest} {
+		_, err := p.torrentArchive.Stat(namespace, d)
+		require.NoError(err)
+	}
+	_, err = p.torrentArchive.Stat(namespace, partial.Digest)
+	require.True(os.IsNotExist(err))
+	_, err = p.cads.Any().GetFileStat(noMetaInfo.Hex())
+	require.True(os.IsNotExist(err))
+
+	counts := make(map[string]int64)
+	for _, c := range stats.Snapshot().Counters() {
+		if c.Name() == "orphans" {
+			counts[c.Tags()["action"]] += c.Value()
+		}
+	}
+	require.Equal(map[string]int64{"dry_run": 2, "deleted": 2}, counts)
+}
+
+func TestOrphanCollectorQuarantine(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	p := mocks.newPeer(configFixture())
+
+	dir, err := ioutil.TempDir("", "quarantine")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orphan := core.DigestFixture()
+	require.NoError(p.cads.CreateDownloadFile(orphan.Hex(), 16))
+
+	c := newOrphanCollector(
+		OrphanGCConfig{Grace: time.Nanosecond, QuarantineDir: dir}.applyDefaults(),
+		p.torrentArchive, p.torrentArchive.(storage.Scanner),
+		p.scheduler.clock, tally.NoopScope, p.scheduler.logger, p.scheduler.activeDigests)
+	require.Equal(1, c.collect())
+
+	_, err = p.cads.Any().GetFileStat(orphan.Hex())
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, orphan.Hex()))
+	require.NoError(err)
+}
+
+func TestOrphanCollectorSkipsPassWhenActiveTorrentsUnavailable(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	p := mocks.newPeer(configFixture())
+
+	orphan := core.DigestFixture()
+	require.NoError(p.cads.CreateDownloadFile(orphan.Hex(), 16))
+
+	c := newOrphanCollector(
+		OrphanGCConfig{Grace: time.Nanosecond}.applyDefaults(),
+		p.torrentArchive, p.torrentArchive.(storage.Scanner),
+		p.scheduler.clock, tally.NoopScope, p.scheduler.logger,
+		func() (map[core.Digest]bool, error) { return nil, ErrSchedulerStopped })
+	require.Equal(0, c.collect())
+
+	_, err := p.cads.Any().GetFileStat(orphan.Hex())
+	require.NoError(err)
+}
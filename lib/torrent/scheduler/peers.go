@@ -0,0 +1,114 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// TorrentPeer describes an established conn of a torrent.
+type TorrentPeer struct {
+	PeerID          core.PeerID `json:"peer_id"`
+	ConnectedAt     time.Time   `json:"connected_at"`
+	ProtocolVersion int         `json:"protocol_version"`
+
+	// Zero if no piece was ever received from / sent to the peer.
+	LastGoodPieceReceived time.Time `json:"last_good_piece_received"`
+	LastPieceSent         time.Time `json:"last_piece_sent"`
+}
+
+// torrentPeersEvent occurs when the peers of a torrent are requested via
+// scheduler API.
+type torrentPeersEvent struct {
+	infoHash core.InfoHash
+	result   chan []*TorrentPeer
+}
+
+func (e torrentPeersEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		e.result <- nil
+		return
+	}
+	peers := make([]*TorrentPeer, 0)
+	for _, c := range s.conns.ActiveConns() {
+		if c.InfoHash() != e.infoHash {
+			continue
+		}
+		peers = append(peers, &TorrentPeer{
+			PeerID:                c.PeerID(),
+			ConnectedAt:           c.CreatedAt(),
+			ProtocolVersion:       int(c.ProtocolVersion()),
+			LastGoodPieceReceived: ctrl.dispatcher.LastGoodPieceReceived(c.PeerID()),
+			LastPieceSent:         ctrl.dispatcher.LastPieceSent(c.PeerID()),
+		})
+	}
+	e.result <- peers
+}
+
+// TorrentPeers returns the peers with established conns for the torrent of h,
+// sorted by peer id. Returns ErrTorrentNotFound if the torrent is neither
+// downloading nor seeding.
+func (s *scheduler) TorrentPeers(h core.InfoHash) ([]*TorrentPeer, error) {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan []*TorrentPeer, 1)
+	if !s.eventLoop.send(torrentPeersEvent{h, result}) {
+		return nil, ErrSchedulerStopped
+	}
+	var peers []*TorrentPeer
+	select {
+	case peers = <-result:
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+	if peers == nil {
+		return nil, ErrTorrentNotFound
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PeerID.LessThan(peers[j].PeerID)
+	})
+	return peers, nil
+}
+
+// announceNowEvent occurs when an immediate announce of a torrent is
+// requested via scheduler API.
+type announceNowEvent struct {
+	infoHash core.InfoHash
+	errc     chan error
+}
+
+func (e announceNowEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		e.errc <- ErrTorrentNotFound
+		return
+	}
+	s.forceAnnounce(ctrl.dispatcher)
+	e.errc <- nil
+}
+
+// Announce announces the torrent of h immediately, regardless of the announce
+// queue. The announce itself is asynchronous. Returns ErrTorrentNotFound if
+// the torrent is neither downloading nor seeding.
+func (s *scheduler) Announce(h core.InfoHash) error {
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(announceNowEvent{h, errc}) {
+		return ErrSchedulerStopped
+	}
+	return s.waitErr(errc)
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+)
+
+const persistedStateVersion = 1
+
+// PersistConfig defines the persistence of scheduler state across restarts.
+// On shutdown, in-flight torrents, their announce queue membership, the conn
+// blacklist and known-good peers are written to Path. On startup, they are restored from Path,
+// such that agents resume leeching and seeding without waiting for clients to
+// request the torrents again.
+type PersistConfig struct {
+	// Path is the file scheduler state is persisted to. Persistence is
+	// disabled if unset.
+	Path string `yaml:"path"`
+
+	// MaxAge is the maximum age of persisted state which is restored. Older
+	// state is discarded, since its torrents were likely abandoned.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c PersistConfig) applyDefaults() PersistConfig {
+	if c.MaxAge == 0 {
+		c.MaxAge = time.Hour
+	}
+	return c
+}
+
+// persistedState is the scheduler state written on shutdown.
+type persistedState struct {
+	Version   int                         `json:"version"`
+	SavedAt   time.Time                   `json:"saved_at"`
+	Torrents  []persistedTorrent          `json:"torrents"`
+	Blacklist []connstate.BlacklistedConn `json:"blacklist"`
+
+	KnownPeers []persistedKnownPeers `json:"known_peers,omitempty"`
+}
+
+// persistedTorrent is the state of a single torrent written on shutdown.
+type persistedTorrent struct {
+	Namespace string        `json:"namespace"`
+	Digest    core.Digest   `json:"digest"`
+	InfoHash  core.InfoHash `json:"info_hash"`
+	Complete  bool          `json:"complete"`
+
+	// Have is the bitfield of the torrent. Nil if complete.
+	Have core.PieceRanges `json:"have,omitempty"`
+
+	// Queued is true if the torrent was in the announce queue.
+	Queued bool `json:"queued"`
+	Paused bool `json:"paused"`
+
+	LocalRequest bool              `json:"local_request"`
+	Priority     int               `json:"priority"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// snapshotState returns the persistable state of s.
+func (s *state) snapshotState() *persistedState {
+	queued := make(map[core.InfoHash]bool)
+	for _, e := range s.announceQueue.Snapshot() {
+		queued[e.InfoHash] = true
+	}
+	ps := &persistedState{
+		Version:   persistedStateVersion,
+		SavedAt:   s.sched.clock.Now(),
+		Blacklist: s.conns.BlacklistSnapshot(),
+
+		KnownPeers: s.sched.knownPeers.snapshot(),
+	}
+	for h, ctrl := range s.torrentControls {
+		d := ctrl.dispatcher
+		ps.Torrents = append(ps.Torrents, persistedTorrent{
+			Namespace:    ctrl.namespace,
+			Digest:       d.Digest(),
+			InfoHash:     h,
+			Complete:     ctrl.seeding(),
+			Have:         d.HaveRanges(),
+			Queued:       queued[h],
+			Paused:       d.Paused(),
+			LocalRequest: ctrl.localRequest,
+			Priority:     ctrl.opts.priority,
+			Metadata:     ctrl.opts.metadata,
+		})
+	}
+	return ps
+}
+
+// persistState writes the persistable state of s to the configured path. The
+// file is replaced atomically, such that a crash mid-write never leaves a
+// truncated file behind.
+func (s *state) persistState() error {
+	path := s.sched.config.Persist.Path
+	b, err := json.Marshal(s.snapshotState())
+	if err != nil {
+		return fmt.Errorf("marshal: %s", err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir: %s", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("temp file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %s", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+	return nil
+}
+
+// loadPersistedState reads and removes the persisted state at path, such that
+// it is restored at most once. Returns nil state if none was persisted. State
+// which cannot be decoded is left in place for inspection.
+func loadPersistedState(path string) (*persistedState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read: %s", err)
+	}
+	var ps persistedState
+	if err := json.Unmarshal(b, &ps); err != nil {
+		return nil, fmt.Errorf("unmarshal: %s", err)
+	}
+	if ps.Version != persistedStateVersion {
+		return nil, fmt.Errorf("unsupported version %d", ps.Version)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("remove: %s", err)
+	}
+	return &ps, nil
+}
+
+// restoreState loads the persisted state of a previous scheduler, if any, and
+// restores it into s.
+func (s *scheduler) restoreState() {
+	if s.config.Persist.Path == "" {
+		return
+	}
+	ps, err := loadPersistedState(s.config.Persist.Path)
+	if err != nil {
+		s.stats.Counter("restore_errors").Inc(1)
+		s.log().Errorf("Error loading persisted state: %s", err)
+		return
+	}
+	if ps == nil {
+		return
+	}
+	if age := s.clock.Now().Sub(ps.SavedAt); age > s.config.Persist.MaxAge {
+		s.stats.Counter("restore_expired").Inc(1)
+		s.log().Infof("Discarding persisted state saved %s ago", age)
+		return
+	}
+	s.eventLoop.send(restoreStateEvent{ps})
+}
+
+// restoreStateEvent occurs when the persisted state of a previous scheduler
+// is loaded on startup.
+type restoreStateEvent struct {
+	state *persistedState
+}
+
+// apply re-adds every persisted torrent which is still on disk, and restores
+// the remaining blacklist entries. Torrents which were added since startup
+// are left untouched.
+func (e restoreStateEvent) apply(s *state) {
+	// Known peers are restored first, such that restored torrents dial them.
+	for _, kp := range e.state.KnownPeers {
+		s.sched.knownPeers.set(kp)
+	}
+	var restored int
+	for _, pt := range e.state.Torrents {
+		if _, ok := s.torrentControls[pt.InfoHash]; ok {
+			continue
+		}
+		if err := s.restoreTorrent(pt); err != nil {
+			s.sched.stats.Counter("restore_errors").Inc(1)
+			s.log("hash", pt.InfoHash).Errorf("Error restoring torrent: %s", err)
+			continue
+		}
+		restored++
+	}
+	elapsed := s.sched.clock.Now().Sub(e.state.SavedAt)
+	for _, c := range e.state.Blacklist {
+		c.Remaining -= elapsed
+		s.conns.RestoreBlacklist(c)
+	}
+	s.sched.stats.Counter("restored_torrents").Inc(int64(restored))
+	s.log().Infof(
+		"Restored %d/%d persisted torrents", restored, len(e.state.Torrents))
+}
+
+func (s *state) restoreTorrent(pt persistedTorrent) error {
+	t, err := s.sched.torrentArchive.GetTorrent(pt.Namespace, pt.Digest)
+	if err != nil {
+		return fmt.Errorf("get torrent: %s", err)
+	}
+	if t.InfoHash() != pt.InfoHash {
+		return fmt.Errorf("info hash mismatch: persisted %s, found %s", pt.InfoHash, t.InfoHash())
+	}
+	if !t.Complete() && uint(pt.Have.Count()) > t.Bitfield().Count() {
+		// Pieces may be lost if the agent crashed before flushing them.
+		// They are simply downloaded again.
+		s.sched.stats.Counter("restored_pieces_missing").Inc(1)
+		s.log("hash", pt.InfoHash).Warnf(
+			"Restored torrent has %d of %d persisted pieces",
+			t.Bitfield().Count(), pt.Have.Count())
+	}
+	opts := []TorrentOption{WithPriority(pt.Priority)}
+	if len(pt.Metadata) > 0 {
+		opts = append(opts, WithMetadata(pt.Metadata))
+	}
+	if !t.Complete() && (s.admission.position(t.InfoHash()) > 0 || s.admissionFull()) {
+		// Restored leechers count towards the limit of concurrent downloads,
+		// so they wait for admission like new torrents. No client waits on
+		// their result.
+		s.queueTorrent(newTorrentEvent{
+			namespace: pt.Namespace,
+			torrent:   t,
+			opts:      opts,
+			errc:      make(chan error, 1),
+		})
+		return nil
+	}
+	ctrl, err := s.addTorrent(pt.Namespace, t, pt.LocalRequest, opts...)
+	if err != nil {
+		return err
+	}
+	if pt.Paused && !t.Complete() {
+		ctrl.dispatcher.Pause()
+	}
+	if !pt.Queued || ctrl.dispatcher.Paused() {
+		s.announceQueue.Eject(pt.InfoHash)
+		return nil
+	}
+	s.dialKnownPeers(pt.InfoHash, ctrl)
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// PinningConfig defines a manifest of immutable content which must always be
+// present and seeding, e.g. base images every host depends on. Pinned torrents
+// are fetched proactively, and are exempt from idle preemption, seeding limits
+// and piece eviction.
+type PinningConfig struct {
+	// Path is the file the manifest is read from. Pinning is disabled if
+	// neither Path nor URL is set.
+	Path string `yaml:"path"`
+
+	// URL is the endpoint the manifest is fetched from if Path is unset.
+	URL string `yaml:"url"`
+
+	// Interval is the duration between compliance checks, each of which reloads
+	// the manifest and fetches missing pins. The manifest is also reloaded
+	// when the scheduler is reloaded.
+	Interval time.Duration `yaml:"interval"`
+
+	// Concurrency is the number of missing pins fetched concurrently.
+	Concurrency int `yaml:"concurrency"`
+}
+
+func (c PinningConfig) applyDefaults() PinningConfig {
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Minute
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 2
+	}
+	return c
+}
+
+// Enabled returns true if a manifest source is configured.
+func (c PinningConfig) Enabled() bool {
+	return c.Path != "" || c.URL != ""
+}
+
+// Pin is an entry of the pinning manifest, which is a JSON list of pins.
+type Pin struct {
+	Namespace string      `json:"namespace"`
+	Digest    core.Digest `json:"digest"`
+}
+
+// pinner periodically reconciles the torrents of the scheduler with the
+// pinning manifest.
+type pinner struct {
+	config PinningConfig
+	clk    clock.Clock
+	stats  tally.Scope
+	logger *zap.SugaredLogger
+
+	// apply marks pins as pinned in the scheduler, and returns the digests of
+	// pins which are seeding.
+	apply func(pins map[core.Digest]bool) (map[core.Digest]bool, error)
+
+	// add downloads p, blocking until it completes.
+	add func(p Pin) error
+
+	// pins is the last successfully loaded manifest.
+	pins []Pin
+
+	reload chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPinner(
+	config PinningConfig,
+	clk clock.Clock,
+	stats tally.Scope,
+	logger *zap.SugaredLogger,
+	apply func(pins map[core.Digest]bool) (map[core.Digest]bool, error),
+	add func(p Pin) error) *pinner {
+
+	return &pinner{
+		config: config,
+		clk:    clk,
+		stats:  stats,
+		logger: logger,
+		apply:  apply,
+		add:    add,
+		reload: make(chan struct{}, 1),
+	}
+}
+
+func (p *pinner) start(done <-chan struct{}) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := p.clk.Ticker(p.config.Interval)
+		defer ticker.Stop()
+		for {
+			p.check()
+			select {
+			case <-ticker.C:
+			case <-p.reload:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// wait blocks until the pinner has exited.
+func (p *pinner) wait() {
+	p.wg.Wait()
+}
+
+// triggerReload reloads the manifest without waiting for the next interval.
+func (p *pinner) triggerReload() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+}
+
+// check reloads the manifest, reports compliance and fetches missing pins.
+// If the manifest cannot be loaded, the previous manifest is enforced.
+func (p *pinner) check() {
+	pins, err := p.loadManifest()
+	if err != nil {
+		p.logger.Errorf("Error loading pinning manifest: %s", err)
+		p.stats.Counter("pin_manifest_errors").Inc(1)
+	} else {
+		p.pins = pins
+	}
+	digests := make(map[core.Digest]bool, len(p.pins))
+	for _, pin := range p.pins {
+		digests[pin.Digest] = true
+	}
+	seeding, err := p.apply(digests)
+	if err != nil {
+		return
+	}
+	var missing []Pin
+	for _, pin := range p.pins {
+		if !seeding[pin.Digest] {
+			missing = append(missing, pin)
+		}
+	}
+	p.stats.Gauge("pinned_torrents").Update(float64(len(digests)))
+	p.stats.Gauge("pinned_torrents_seeding").Update(float64(len(digests) - len(missing)))
+	p.stats.Gauge("pinned_torrents_missing").Update(float64(len(missing)))
+
+	sem := make(chan struct{}, p.config.Concurrency)
+	var wg sync.WaitGroup
+	for _, pin := range missing {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(pin Pin) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := p.add(pin); err != nil {
+				p.logger.With("namespace", pin.Namespace, "digest", pin.Digest).Errorf(
+					"Error fetching pinned torrent: %s", err)
+				p.stats.Counter("pin_fetch_errors").Inc(1)
+				return
+			}
+			p.stats.Counter("pin_fetches").Inc(1)
+		}(pin)
+	}
+	wg.Wait()
+}
+
+func (p *pinner) loadManifest() ([]Pin, error) {
+	var b []byte
+	if p.config.Path != "" {
+		var err error
+		b, err = ioutil.ReadFile(p.config.Path)
+		if err != nil {
+			return nil, fmt.Errorf("read: %s", err)
+		}
+	} else {
+		resp, err := httputil.Get(p.config.URL)
+		if err != nil {
+			return nil, fmt.Errorf("get: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read body: %s", err)
+		}
+	}
+	var pins []Pin
+	if err := json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("unmarshal: %s", err)
+	}
+	return pins, nil
+}
+
+// setPinsEvent occurs when the pinner loads the pinning manifest.
+type setPinsEvent struct {
+	pins   map[core.Digest]bool
+	result chan map[core.Digest]bool
+}
+
+// apply marks the torrentControls of pins as pinned, and returns the digests
+// of pins which are seeding.
+func (e setPinsEvent) apply(s *state) {
+	s.sched.pins = e.pins
+	seeding := make(map[core.Digest]bool)
+	for _, ctrl := range s.torrentControls {
+		d := ctrl.dispatcher.Digest()
+		ctrl.pinned = e.pins[d]
+		if ctrl.pinned && ctrl.seeding() {
+			seeding[d] = true
+		}
+	}
+	e.result <- seeding
+}
+
+func (s *scheduler) setPins(pins map[core.Digest]bool) (map[core.Digest]bool, error) {
+	result := make(chan map[core.Digest]bool, 1)
+	if !s.eventLoop.send(setPinsEvent{pins, result}) {
+		return nil, ErrSchedulerStopped
+	}
+	select {
+	case seeding := <-result:
+		return seeding, nil
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+}
+
+func (s *scheduler) addPin(p Pin) error {
+	return s.AddTorrentWithOptions(
+		context.Background(), p.Digest, WithNamespace(p.Namespace), WithCaller("pinning"))
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+func writePinningManifest(t *testing.T, path string, pins []Pin) {
+	b, err := json.Marshal(pins)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, b, 0644))
+}
+
+func TestLeecherFetchesPinnedTorrents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "pinning")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	manifest := filepath.Join(dir, "manifest.json")
+	writePinningManifest(t, manifest, []Pin{{namespace, blob.Digest}})
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+
+	lconfig := config
+	lconfig.SeederTTI = time.Millisecond
+	lconfig.Pinning = PinningConfig{Path: manifest, Interval: 10 * time.Millisecond}
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	leecher := mocks.newPeer(lconfig)
+
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		in, err := leecher.scheduler.Introspect()
+		if err != nil || len(in.Torrents) != 1 {
+			return false
+		}
+		return in.Torrents[0].Pinned && in.Torrents[0].State == "seeding"
+	}))
+
+	leecher.checkTorrent(t, namespace, blob)
+
+	// Pinned torrents are never preempted, despite the short seeder TTI.
+	time.Sleep(50 * time.Millisecond)
+	in, err := leecher.scheduler.Introspect()
+	require.NoError(err)
+	require.Len(in.Torrents, 1)
+}
+
+func TestPinnedTorrentsAreNotPreempted(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		LeecherTTI: time.Millisecond,
+	})
+
+	pinned, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	unpinned, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+
+	result := make(chan map[core.Digest]bool, 1)
+	setPinsEvent{map[core.Digest]bool{pinned.dispatcher.Digest(): true}, result}.apply(state)
+	// Pinned torrents are only seeding once complete.
+	require.Empty(<-result)
+
+	time.Sleep(5 * time.Millisecond)
+	preemptionTickEvent{}.apply(state)
+
+	require.Contains(state.torrentControls, pinned.dispatcher.InfoHash())
+	require.NotContains(state.torrentControls, unpinned.dispatcher.InfoHash())
+}
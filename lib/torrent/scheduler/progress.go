@@ -0,0 +1,167 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sort"
+
+	"github.com/uber/kraken/core"
+)
+
+// Progress is a snapshot of the progress of a torrent, e.g. for rendering
+// progress bars of pulls.
+type Progress struct {
+	InfoHash core.InfoHash `json:"info_hash"`
+	Digest   core.Digest   `json:"digest"`
+	Length   int64         `json:"length"`
+
+	// BytesComplete is the total bytes of complete pieces, including pieces
+	// which were complete before the torrent was added.
+	BytesComplete  int64 `json:"bytes_complete"`
+	PiecesComplete int   `json:"pieces_complete"`
+	NumPieces      int   `json:"num_pieces"`
+
+	// ActivePeers is the number of peers with established conns.
+	ActivePeers int `json:"active_peers"`
+
+	// Bytes per second of pieces recently downloaded from and uploaded to
+	// peers.
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+
+	Complete bool `json:"complete"`
+	Paused   bool `json:"paused"`
+
+	// Queued torrents are waiting for other downloads to finish, and
+	// QueuePosition is their 1-based position in the admission queue. See
+	// Config.MaxConcurrentDownloads.
+	Queued        bool `json:"queued"`
+	QueuePosition int  `json:"queue_position,omitempty"`
+
+	// Metadata is the metadata the torrent was added with. See WithMetadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// progressEvent occurs when the progress of a torrent is requested via
+// scheduler API.
+type progressEvent struct {
+	infoHash core.InfoHash
+	result   chan *Progress
+}
+
+func (e progressEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		if i := s.admission.position(e.infoHash); i > 0 {
+			e.result <- newQueuedProgress(s.admission.torrents[i-1], i)
+			return
+		}
+		e.result <- nil
+		return
+	}
+	e.result <- newProgress(ctrl)
+}
+
+// torrentsEvent occurs when the progress of all torrents is requested via
+// scheduler API.
+type torrentsEvent struct {
+	result chan []*Progress
+}
+
+func (e torrentsEvent) apply(s *state) {
+	progress := make([]*Progress, 0, len(s.torrentControls)+s.admission.len())
+	for _, ctrl := range s.torrentControls {
+		progress = append(progress, newProgress(ctrl))
+	}
+	for i, t := range s.admission.torrents {
+		progress = append(progress, newQueuedProgress(t, i+1))
+	}
+	e.result <- progress
+}
+
+func newProgress(ctrl *torrentControl) *Progress {
+	d := ctrl.dispatcher
+	info := d.Stat()
+	return &Progress{
+		InfoHash:       d.InfoHash(),
+		Digest:         d.Digest(),
+		Length:         d.Length(),
+		BytesComplete:  d.BytesComplete(),
+		PiecesComplete: int(info.Bitfield().Count()),
+		NumPieces:      int(info.Bitfield().Len()),
+		ActivePeers:    d.NumPeers(),
+		DownloadRate:   d.DownloadRate(),
+		UploadRate:     d.UploadRate(),
+		Complete:       ctrl.seeding(),
+		Paused:         d.Paused(),
+		Metadata:       ctrl.opts.metadata,
+	}
+}
+
+func newQueuedProgress(t *queuedTorrent, position int) *Progress {
+	req := t.requests[0]
+	tor := req.torrent
+	b := tor.Bitfield()
+	return &Progress{
+		InfoHash:       tor.InfoHash(),
+		Digest:         tor.Digest(),
+		Length:         tor.Length(),
+		BytesComplete:  tor.BytesDownloaded(),
+		PiecesComplete: int(b.Count()),
+		NumPieces:      int(b.Len()),
+		Queued:         true,
+		QueuePosition:  position,
+		Metadata:       newTorrentOptions(Config{}, req.opts...).metadata,
+	}
+}
+
+// Progress returns the progress of the torrent of h. Returns
+// ErrTorrentNotFound if the torrent is neither downloading, seeding nor queued.
+func (s *scheduler) Progress(h core.InfoHash) (*Progress, error) {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan *Progress, 1)
+	if !s.eventLoop.send(progressEvent{h, result}) {
+		return nil, ErrSchedulerStopped
+	}
+	var p *Progress
+	select {
+	case p = <-result:
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+	if p == nil {
+		return nil, ErrTorrentNotFound
+	}
+	return p, nil
+}
+
+// Torrents returns the progress of all torrents which are downloading, seeding
+// or queued, sorted by info hash.
+func (s *scheduler) Torrents() ([]*Progress, error) {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan []*Progress, 1)
+	if !s.eventLoop.send(torrentsEvent{result}) {
+		return nil, ErrSchedulerStopped
+	}
+	var progress []*Progress
+	select {
+	case progress = <-result:
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].InfoHash.Hex() < progress[j].InfoHash.Hex()
+	})
+	return progress, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package provenance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// ErrNotFound is returned when no provenance is recorded for a digest.
+var ErrNotFound = errors.New("provenance not found")
+
+// Sources of verified pieces.
+const (
+	SourcePeer     = "peer"
+	SourceIngest   = "ingest"
+	SourceFallback = "fallback"
+	SourceInline   = "inline"
+)
+
+// Config defines Store configuration.
+type Config struct {
+	// Size is the number of completed torrent records retained in memory.
+	Size int `yaml:"size"`
+
+	// Dir, if set, is the directory records are persisted to, such that they
+	// remain available after eviction from memory and across restarts.
+	Dir string `yaml:"dir"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.Size == 0 {
+		c.Size = 100
+	}
+	return c
+}
+
+// Piece describes where the verified copy of a piece was downloaded from.
+type Piece struct {
+	Index  int       `json:"index"`
+	Source string    `json:"source"`
+	PeerID string    `json:"peer_id,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Record is the provenance of all pieces of a completed torrent.
+type Record struct {
+	Namespace string        `json:"namespace"`
+	Digest    core.Digest   `json:"digest"`
+	InfoHash  core.InfoHash `json:"info_hash"`
+	Pieces    []Piece       `json:"pieces"`
+}
+
+// Store retains the provenance records of the last Size completed torrents,
+// and optionally persists all records to disk. Store is thread-safe.
+type Store struct {
+	config Config
+
+	mu      sync.Mutex
+	records []Record // Ordered from oldest to newest.
+}
+
+// NewStore creates a new Store.
+func NewStore(config Config) (*Store, error) {
+	config = config.applyDefaults()
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0775); err != nil {
+			return nil, fmt.Errorf("mkdir: %s", err)
+		}
+	}
+	return &Store{config: config}, nil
+}
+
+func (s *Store) path(d core.Digest) string {
+	return filepath.Join(s.config.Dir, d.Hex()+".json")
+}
+
+// Put adds r to s, replacing any existing record for the same digest.
+func (s *Store) Put(r Record) error {
+	s.mu.Lock()
+	for i := range s.records {
+		if s.records[i].Digest == r.Digest {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			break
+		}
+	}
+	s.records = append(s.records, r)
+	if len(s.records) > s.config.Size {
+		s.records = s.records[1:]
+	}
+	s.mu.Unlock()
+
+	if s.config.Dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("json marshal: %s", err)
+	}
+	tmp := s.path(r.Digest) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0664); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	if err := os.Rename(tmp, s.path(r.Digest)); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+	return nil
+}
+
+// Get returns the record of d. Returns ErrNotFound if d has no record.
+func (s *Store) Get(d core.Digest) (Record, error) {
+	s.mu.Lock()
+	for _, r := range s.records {
+		if r.Digest == d {
+			s.mu.Unlock()
+			return r, nil
+		}
+	}
+	s.mu.Unlock()
+
+	if s.config.Dir == "" {
+		return Record{}, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(s.path(d))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Record{}, ErrNotFound
+		}
+		return Record{}, fmt.Errorf("read: %s", err)
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Record{}, fmt.Errorf("json unmarshal: %s", err)
+	}
+	return r, nil
+}
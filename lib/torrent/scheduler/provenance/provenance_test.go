@@ -0,0 +1,105 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package provenance
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func recordFixture() Record {
+	d := core.DigestFixture()
+	return Record{
+		Namespace: "ns",
+		Digest:    d,
+		InfoHash:  core.InfoHashFixture(),
+		Pieces: []Piece{{
+			Index:  0,
+			Source: SourcePeer,
+			PeerID: core.PeerIDFixture().String(),
+			Time:   time.Now().UTC().Truncate(time.Second),
+		}},
+	}
+}
+
+func TestStorePutGet(t *testing.T) {
+	require := require.New(t)
+
+	s, err := NewStore(Config{})
+	require.NoError(err)
+
+	r := recordFixture()
+	require.NoError(s.Put(r))
+
+	result, err := s.Get(r.Digest)
+	require.NoError(err)
+	require.Equal(r, result)
+
+	_, err = s.Get(core.DigestFixture())
+	require.Equal(ErrNotFound, err)
+}
+
+func TestStoreEvictsOldestRecords(t *testing.T) {
+	require := require.New(t)
+
+	s, err := NewStore(Config{Size: 2})
+	require.NoError(err)
+
+	var records []Record
+	for i := 0; i < 3; i++ {
+		r := recordFixture()
+		require.NoError(s.Put(r))
+		records = append(records, r)
+	}
+
+	_, err = s.Get(records[0].Digest)
+	require.Equal(ErrNotFound, err)
+	for _, r := range records[1:] {
+		_, err := s.Get(r.Digest)
+		require.NoError(err)
+	}
+}
+
+func TestStorePersistsRecords(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "provenance")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewStore(Config{Size: 1, Dir: dir})
+	require.NoError(err)
+
+	r := recordFixture()
+	require.NoError(s.Put(r))
+	require.NoError(s.Put(recordFixture()))
+
+	// Evicted from memory, but still on disk.
+	result, err := s.Get(r.Digest)
+	require.NoError(err)
+	require.Equal(r, result)
+
+	// Survives restarts.
+	s, err = NewStore(Config{Dir: dir})
+	require.NoError(err)
+	result, err = s.Get(r.Digest)
+	require.NoError(err)
+	require.Equal(r, result)
+}
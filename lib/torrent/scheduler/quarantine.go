@@ -0,0 +1,50 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/uber/kraken/core"
+)
+
+// MetaInfoMismatchError is returned when a torrent is submitted whose metainfo
+// disagrees with the metainfo of the in-progress torrent of the same info
+// hash, e.g. because either metainfo is corrupt. The submission is
+// quarantined rather than attached to the in-progress torrent.
+type MetaInfoMismatchError struct {
+	InfoHash  core.InfoHash
+	Namespace string
+	Reason    string
+}
+
+func (e *MetaInfoMismatchError) Error() string {
+	return fmt.Sprintf(
+		"metainfo of torrent %s in namespace %s disagrees with in-progress torrent: %s",
+		e.InfoHash, e.Namespace, e.Reason)
+}
+
+// quarantineTorrent rejects the submission e, whose metainfo disagrees with
+// the metainfo of the in-progress torrent.
+func (s *state) quarantineTorrent(e newTorrentEvent, err error) {
+	merr := &MetaInfoMismatchError{
+		InfoHash:  e.torrent.InfoHash(),
+		Namespace: e.namespace,
+		Reason:    err.Error(),
+	}
+	s.sched.stats.Counter("metainfo_mismatches").Inc(1)
+	s.log("torrent", e.torrent, "namespace", e.namespace).Errorf(
+		"Quarantined torrent submission: %s", merr)
+	e.errc <- merr
+}
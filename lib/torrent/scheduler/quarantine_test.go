@@ -0,0 +1,55 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// truncatedTorrent reports a shorter length than its metainfo, as if either
+// metainfo were corrupt.
+type truncatedTorrent struct {
+	storage.Torrent
+}
+
+func (t truncatedTorrent) Length() int64 {
+	return t.Torrent.Length() - 1
+}
+
+func TestNewTorrentEventQuarantinesMetaInfoMismatch(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	torrent := mocks.newTorrent()
+	ctrl, err := state.addTorrent(_testNamespace, torrent, true)
+	require.NoError(err)
+
+	errc := make(chan error, 1)
+	newTorrentEvent{_testNamespace, truncatedTorrent{torrent}, nil, errc}.apply(state)
+
+	err = <-errc
+	require.IsType(&MetaInfoMismatchError{}, err)
+	require.Equal(torrent.InfoHash(), err.(*MetaInfoMismatchError).InfoHash)
+
+	// The submission is not attached to the in-progress torrent.
+	require.Empty(ctrl.errors)
+	require.Equal(ctrl, state.torrentControls[torrent.InfoHash()])
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"golang.org/x/time/rate"
+)
+
+// RampUpConfig staggers announces and outgoing dials for a window after the
+// Scheduler starts. After a fleet-wide restart, every agent would otherwise
+// announce and dial at once, overwhelming the tracker and seeders.
+type RampUpConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Window is the duration after startup during which the ramp-up applies.
+	Window time.Duration `yaml:"window"`
+
+	// MaxAnnounceJitter bounds the random delay added to announces within
+	// the window. Delays never extend past the end of the window.
+	MaxAnnounceJitter time.Duration `yaml:"max_announce_jitter"`
+
+	// The rate of outgoing dials increases linearly from InitialDialsPerSec to
+	// FinalDialsPerSec over the window, after which dials are unlimited.
+	InitialDialsPerSec float64 `yaml:"initial_dials_per_sec"`
+	FinalDialsPerSec   float64 `yaml:"final_dials_per_sec"`
+}
+
+func (c RampUpConfig) applyDefaults() RampUpConfig {
+	if c.Window == 0 {
+		c.Window = 2 * time.Minute
+	}
+	if c.MaxAnnounceJitter == 0 {
+		c.MaxAnnounceJitter = 30 * time.Second
+	}
+	if c.InitialDialsPerSec == 0 {
+		c.InitialDialsPerSec = 5
+	}
+	if c.FinalDialsPerSec == 0 {
+		c.FinalDialsPerSec = 50
+	}
+	return c
+}
+
+// rampUp delays announces and dials made shortly after startup. A nil rampUp
+// never delays anything.
+type rampUp struct {
+	config RampUpConfig
+	clock  clock.Clock
+	stats  tally.Scope
+	start  time.Time
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	dials *rate.Limiter
+}
+
+// newRampUp returns nil if ramp-up is disabled.
+func newRampUp(config RampUpConfig, clk clock.Clock, stats tally.Scope, seed int64) *rampUp {
+	if !config.Enable {
+		return nil
+	}
+	return &rampUp{
+		config: config,
+		clock:  clk,
+		stats:  stats,
+		start:  clk.Now(),
+		rand:   rand.New(rand.NewSource(seed)),
+		dials:  rate.NewLimiter(rate.Limit(config.InitialDialsPerSec), 1),
+	}
+}
+
+// remaining returns the duration until the window ends, or 0 if it has ended.
+func (r *rampUp) remaining(now time.Time) time.Duration {
+	d := r.config.Window - now.Sub(r.start)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// announceDelay returns a random delay for an announce made now.
+func (r *rampUp) announceDelay() time.Duration {
+	if r == nil {
+		return 0
+	}
+	max := r.remaining(r.clock.Now())
+	if max > r.config.MaxAnnounceJitter {
+		max = r.config.MaxAnnounceJitter
+	}
+	if max <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Duration(r.rand.Int63n(int64(max)))
+}
+
+// dialDelay reserves a dial and returns how long to wait before dialing.
+func (r *rampUp) dialDelay() time.Duration {
+	if r == nil {
+		return 0
+	}
+	now := r.clock.Now()
+	remaining := r.remaining(now)
+	if remaining == 0 {
+		return 0
+	}
+	progress := 1 - float64(remaining)/float64(r.config.Window)
+	limit := r.config.InitialDialsPerSec +
+		progress*(r.config.FinalDialsPerSec-r.config.InitialDialsPerSec)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dials.SetLimitAt(now, rate.Limit(limit))
+	return r.dials.ReserveN(now, 1).DelayFrom(now)
+}
+
+// wait sleeps for d, returning false if done is closed first.
+func (r *rampUp) wait(d time.Duration, done <-chan struct{}, counter string) bool {
+	if d <= 0 {
+		return true
+	}
+	r.stats.Counter(counter).Inc(1)
+	select {
+	case <-r.clock.After(d):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// waitAnnounce delays an announce during the window. Returns false if done is
+// closed while waiting.
+func (r *rampUp) waitAnnounce(done <-chan struct{}) bool {
+	return r.wait(r.announceDelay(), done, "ramp_up_announce_delays")
+}
+
+// waitDial delays a dial during the window. Returns false if done is closed
+// while waiting.
+func (r *rampUp) waitDial(done <-chan struct{}) bool {
+	return r.wait(r.dialDelay(), done, "ramp_up_dial_delays")
+}
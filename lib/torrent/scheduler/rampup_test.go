@@ -0,0 +1,81 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestRampUpAnnounceDelayEndsWithWindow(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	r := newRampUp(RampUpConfig{
+		Enable:            true,
+		Window:            10 * time.Second,
+		MaxAnnounceJitter: 5 * time.Second,
+	}.applyDefaults(), clk, tally.NoopScope, 1)
+
+	for i := 0; i < 100; i++ {
+		require.True(r.announceDelay() < 5*time.Second)
+	}
+
+	clk.Add(8 * time.Second)
+	for i := 0; i < 100; i++ {
+		require.True(r.announceDelay() < 2*time.Second)
+	}
+
+	clk.Add(2 * time.Second)
+	require.Equal(time.Duration(0), r.announceDelay())
+}
+
+func TestRampUpDialDelayRampsUpOverWindow(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	r := newRampUp(RampUpConfig{
+		Enable:             true,
+		Window:             10 * time.Second,
+		InitialDialsPerSec: 1,
+		FinalDialsPerSec:   4,
+	}.applyDefaults(), clk, tally.NoopScope, 1)
+
+	require.Equal(time.Duration(0), r.dialDelay())
+	require.Equal(time.Second, r.dialDelay())
+
+	// Halfway through the window, dials are allowed at 2.5/sec.
+	clk.Add(5 * time.Second)
+	require.Equal(time.Duration(0), r.dialDelay())
+	require.Equal(400*time.Millisecond, r.dialDelay())
+
+	clk.Add(5 * time.Second)
+	for i := 0; i < 10; i++ {
+		require.Equal(time.Duration(0), r.dialDelay())
+	}
+}
+
+func TestRampUpDisabled(t *testing.T) {
+	require := require.New(t)
+
+	r := newRampUp(RampUpConfig{}.applyDefaults(), clock.NewMock(), tally.NoopScope, 1)
+	require.Nil(r)
+	require.Equal(time.Duration(0), r.announceDelay())
+	require.Equal(time.Duration(0), r.dialDelay())
+	require.True(r.waitDial(make(chan struct{})))
+}
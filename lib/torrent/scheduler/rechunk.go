@@ -0,0 +1,116 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// Rechunk errors.
+var (
+	ErrRechunkUnsupported = errors.New("torrent archive does not support re-chunking")
+	ErrRechunkTorrentHeld = errors.New("torrent is held by the scheduler")
+	ErrTorrentRechunking  = errors.New("torrent is being re-chunked")
+)
+
+// Rechunk replaces the metainfo of the complete torrent of d with metainfo of
+// pieceLength, retaining the previous metainfo for window. Torrents currently
+// held by the Scheduler cannot be re-chunked, and d cannot be added while
+// being re-chunked. While the previous metainfo is retained, seeders of d
+// announce both info hashes.
+func (s *scheduler) Rechunk(
+	d core.Digest, pieceLength int64, window time.Duration) (*core.MetaInfo, error) {
+
+	ls, ok := s.torrentArchive.(storage.LegacyServer)
+	if !ok {
+		return nil, ErrRechunkUnsupported
+	}
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(rechunkEvent{d, errc}) {
+		return nil, ErrSchedulerStopped
+	}
+	if err := s.waitErr(errc); err != nil {
+		return nil, err
+	}
+	defer s.eventLoop.send(rechunkDoneEvent{d})
+
+	return ls.Rechunk(d, pieceLength, window)
+}
+
+// rechunkEvent reserves d for re-chunking, unless a torrent of d is held.
+type rechunkEvent struct {
+	digest core.Digest
+	errc   chan error
+}
+
+func (e rechunkEvent) apply(s *state) {
+	if s.rechunking[e.digest] {
+		e.errc <- ErrTorrentRechunking
+		return
+	}
+	for _, ctrl := range s.torrentControls {
+		// Incoming conns may hold the torrent under its legacy info hash, so
+		// torrents are matched by digest.
+		if ctrl.dispatcher.Digest() == e.digest {
+			e.errc <- ErrRechunkTorrentHeld
+			return
+		}
+	}
+	s.rechunking[e.digest] = true
+	e.errc <- nil
+}
+
+func (e rechunkEvent) class() eventClass     { return eventClassControl }
+func (e rechunkEvent) describe() eventFields { return eventFields{"digest": e.digest.Hex()} }
+
+// rechunkDoneEvent releases the reservation of rechunkEvent.
+type rechunkDoneEvent struct {
+	digest core.Digest
+}
+
+func (e rechunkDoneEvent) apply(s *state) {
+	delete(s.rechunking, e.digest)
+}
+
+func (e rechunkDoneEvent) class() eventClass     { return eventClassControl }
+func (e rechunkDoneEvent) describe() eventFields { return eventFields{"digest": e.digest.Hex()} }
+
+// announceLegacy announces the info hash a complete torrent of d had before
+// being re-chunked, if still retained, such that peers which use the previous
+// metainfo can find seeders of d. h is the info hash already announced.
+func (s *scheduler) announceLegacy(d core.Digest, h core.InfoHash) {
+	ls, ok := s.torrentArchive.(storage.LegacyServer)
+	if !ok {
+		return
+	}
+	legacy, err := ls.LegacyInfoHash(d)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.log("hash", h).Errorf("Error getting legacy info hash: %s", err)
+		}
+		return
+	}
+	if legacy == h {
+		return
+	}
+	if _, _, err := s.announcer.Announce(d, legacy, true, nil); err != nil {
+		s.stats.Counter("legacy_announce_errors").Inc(1)
+		s.log("hash", legacy).Infof("Error announcing legacy info hash: %s", err)
+	}
+}
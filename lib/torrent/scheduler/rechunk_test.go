@@ -0,0 +1,52 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRechunkReservesDigest(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	held := mocks.newTorrent()
+	_, err := state.addTorrent(_testNamespace, held, true)
+	require.NoError(err)
+
+	errc := make(chan error, 1)
+	rechunkEvent{held.Digest(), errc}.apply(state)
+	require.Equal(ErrRechunkTorrentHeld, <-errc)
+
+	tor := mocks.newTorrent()
+	rechunkEvent{tor.Digest(), errc}.apply(state)
+	require.NoError(<-errc)
+
+	rechunkEvent{tor.Digest(), errc}.apply(state)
+	require.Equal(ErrTorrentRechunking, <-errc)
+
+	_, err = state.addTorrent(_testNamespace, tor, true)
+	require.Equal(ErrTorrentRechunking, err)
+
+	rechunkDoneEvent{tor.Digest()}.apply(state)
+
+	_, err = state.addTorrent(_testNamespace, tor, true)
+	require.NoError(err)
+}
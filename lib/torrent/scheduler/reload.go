@@ -15,9 +15,11 @@ package scheduler
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+	"github.com/uber/kraken/lib/torrent/scheduler/completion"
 	"github.com/uber/kraken/utils/log"
 )
 
@@ -25,6 +27,7 @@ import (
 type ReloadableScheduler interface {
 	Scheduler
 	Reload(config Config)
+	TryReload(config Config) error
 }
 
 type reloadableScheduler struct {
@@ -37,8 +40,10 @@ func makeReloadable(s *scheduler, aq func() announcequeue.Queue) *reloadableSche
 	return &reloadableScheduler{scheduler: s, aq: aq}
 }
 
-// Reload restarts the Scheduler with new configuration. Panics if the Scheduler
-// fails to restart.
+// Reload applies new configuration to the Scheduler. If only TTLs, announce
+// intervals or conn capacity limits change, they are swapped at runtime.
+// Otherwise, the Scheduler is restarted. Panics if the Scheduler fails to
+// restart.
 func (rs *reloadableScheduler) Reload(config Config) {
 	if err := rs.reload(config); err != nil {
 		// Totally unrecoverable error -- rs.scheduler is now stopped and unusable,
@@ -47,22 +52,157 @@ func (rs *reloadableScheduler) Reload(config Config) {
 	}
 }
 
+// TryReload applies new configuration to the Scheduler, restarting it unless
+// the configuration is hot reloadable (see Reload). If the Scheduler fails to
+// restart, it is rolled back to its previous configuration and an
+// error is returned. Only panics if the rollback fails as well.
+func (rs *reloadableScheduler) TryReload(config Config) error {
+	prev := rs.currentConfig()
+	err := rs.reload(config)
+	if err == nil {
+		return nil
+	}
+	if rerr := rs.reload(prev); rerr != nil {
+		log.Fatalf("Failed to roll back scheduler config after %s: %s", err, rerr)
+	}
+	return err
+}
+
+func (rs *reloadableScheduler) currentConfig() Config {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.scheduler.config
+}
+
 func (rs *reloadableScheduler) reload(config Config) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
 	s := rs.scheduler
-	s.Stop()
-
+	if !s.stopped() && hotReloadable(s.config, config) {
+		return s.reloadConfig(config)
+	}
+	// The new scheduler is created before s is stopped, such that an invalid
+	// config leaves s and its torrents untouched.
 	n, err := newScheduler(
-		config, s.torrentArchive, s.stats, s.pctx, s.announceClient, s.netevents)
+		config, s.torrentArchive, s.stats, s.pctx, s.announceClient, s.netevents,
+		withResolver(s.resolver),
+		withReputationClient(s.reputations))
 	if err != nil {
 		return fmt.Errorf("create new scheduler: %s", err)
 	}
-	rs.scheduler = n
 
-	if err := rs.scheduler.start(rs.aq()); err != nil {
+	// Torrents are resumed by the new scheduler, so they are neither drained
+	// nor announced as stopped.
+	s.stop()
+
+	// Callbacks may have been registered with s after n loaded the journal.
+	completions, err := completion.New(config.Completion, n.stats, n.clock)
+	if err != nil {
+		return fmt.Errorf("reload completion callbacks: %s", err)
+	}
+	n.completions = completions
+
+	// Retain timelines of torrents which finished before the reload.
+	n.timelines = s.timelines
+	n.provenance = s.provenance
+	n.evictionHook = s.evictionHook
+	n.listeners = s.listeners
+	n.logLevels = s.logLevels
+	n.tracer = s.tracer
+	n.handles = s.handles
+	if n.rampUp != nil && s.rampUp != nil {
+		// Reloads must not restart the ramp-up window.
+		n.rampUp.start = s.rampUp.start
+	}
+	if n.bandwidth != nil && s.bandwidth != nil {
+		// Bandwidth of the current window must not be lost.
+		n.bandwidth.current = s.bandwidth.current
+		n.bandwidth.closed = s.bandwidth.closed
+	}
+	for _, kp := range s.knownPeers.snapshot() {
+		n.knownPeers.set(kp)
+	}
+
+	if err := n.start(rs.aq()); err != nil {
 		return fmt.Errorf("start new scheduler: %s", err)
 	}
+	rs.scheduler = n
+	return nil
+}
+
+// hotReloadable returns true if next only differs from cur in fields which
+// reloadConfigEvent applies, such that the Scheduler need not restart.
+func hotReloadable(cur, next Config) bool {
+	return reflect.DeepEqual(
+		cur.applyDefaults().withoutHotReloadable(),
+		next.applyDefaults().withoutHotReloadable())
+}
+
+// stopped returns true if s was stopped, e.g. by a reload which failed to
+// restart it.
+func (s *scheduler) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reloadConfig applies config to s without restarting it, keeping all conns
+// and torrents. config must be hot reloadable.
+func (s *scheduler) reloadConfig(config Config) error {
+	if err := config.ConnState.Validate(); err != nil {
+		return fmt.Errorf("connstate: %s", err)
+	}
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(reloadConfigEvent{config.applyDefaults(), errc}) {
+		return ErrSchedulerStopped
+	}
+	if err := s.waitErr(errc); err != nil {
+		return err
+	}
+	if s.pinner != nil {
+		// The manifest may have changed even if its source did not.
+		s.pinner.triggerReload()
+	}
 	return nil
 }
+
+// reloadConfigEvent swaps the TTLs, announce intervals and conn capacity
+// limits of the Scheduler. Restarting the Scheduler to tune these would drop
+// all active swarms. TTIs of existing torrents are unchanged, and existing
+// conns exceeding new limits are not closed, but are no longer replaced.
+type reloadConfigEvent struct {
+	config Config
+	errc   chan error
+}
+
+func (e reloadConfigEvent) apply(s *state) {
+	c := &s.sched.config
+	c.SeederTTI = e.config.SeederTTI
+	c.LeecherTTI = e.config.LeecherTTI
+	c.ConnTTI = e.config.ConnTTI
+	c.ConnTTL = e.config.ConnTTL
+	c.Announcer = e.config.Announcer
+	c.ConnState = e.config.ConnState
+	c.MaxConcurrentDownloads = e.config.MaxConcurrentDownloads
+
+	s.sched.announcer.SetConfig(c.Announcer)
+	s.conns.SetConfig(c.ConnState)
+	for h, ctrl := range s.torrentControls {
+		if ctrl.capacity != nil {
+			ctrl.capacity.SetMax(c.ConnState.MaxOpenConnectionsPerTorrent)
+			s.conns.SetTargetCapacity(h, ctrl.capacity.Capacity())
+		}
+	}
+	s.admitTorrents()
+	s.sched.stats.Counter("config_hot_reloads").Inc(1)
+	s.log().Info("Hot reloaded scheduler config")
+	e.errc <- nil
+}
+
+func (e reloadConfigEvent) class() eventClass     { return eventClassControl }
+func (e reloadConfigEvent) describe() eventFields { return nil }
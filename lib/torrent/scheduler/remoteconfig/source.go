@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remoteconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/kraken/utils/httputil"
+	"gopkg.in/yaml.v2"
+)
+
+// Snapshot is a version of the scheduler tunables published by a remote config
+// service.
+type Snapshot struct {
+	// Version identifies the snapshot. Snapshots of the same version are only
+	// applied once.
+	Version string
+
+	// Tunables is a YAML overlay of scheduler.Config. Fields which are not set
+	// keep their value from the local config.
+	Tunables []byte
+}
+
+// ParseSnapshot parses a snapshot document of the form:
+//
+//	version: <version>
+//	scheduler:
+//	  <scheduler.Config fields>
+func ParseSnapshot(b []byte) (*Snapshot, error) {
+	var doc struct {
+		Version   string      `yaml:"version"`
+		Scheduler interface{} `yaml:"scheduler"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("yaml: %s", err)
+	}
+	if doc.Version == "" {
+		return nil, fmt.Errorf("missing version")
+	}
+	var tunables []byte
+	if doc.Scheduler != nil {
+		var err error
+		tunables, err = yaml.Marshal(doc.Scheduler)
+		if err != nil {
+			return nil, fmt.Errorf("marshal tunables: %s", err)
+		}
+	}
+	return &Snapshot{Version: doc.Version, Tunables: tunables}, nil
+}
+
+// Source polls snapshots from a remote config service.
+type Source interface {
+	Fetch() (*Snapshot, error)
+}
+
+type httpSource struct {
+	url string
+	tls *tls.Config
+}
+
+// NewHTTPSource creates a Source which fetches snapshot documents from url.
+func NewHTTPSource(url string, tls *tls.Config) Source {
+	return &httpSource{url, tls}
+}
+
+func (s *httpSource) Fetch() (*Snapshot, error) {
+	resp, err := httputil.Get(s.url, httputil.SendTLS(s.tls))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %s", err)
+	}
+	return ParseSnapshot(b)
+}
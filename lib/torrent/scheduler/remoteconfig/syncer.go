@@ -0,0 +1,171 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remoteconfig
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/uber/kraken/lib/torrent/scheduler"
+)
+
+// Config defines how scheduler tunables are pulled from a remote config
+// service, such that fleet-wide tuning does not require redeploys.
+type Config struct {
+	Enable bool `yaml:"enable"`
+
+	// URL serves the current snapshot document. See ParseSnapshot.
+	URL string `yaml:"url"`
+
+	// Interval is the interval in which URL is polled.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	return c
+}
+
+// Reconfigurer applies new config to a scheduler, restarting it if needed
+// and rolling back to the previous config on error. Satisfied by scheduler.ReloadableScheduler.
+type Reconfigurer interface {
+	TryReload(config scheduler.Config) error
+}
+
+// Syncer applies remote snapshots on top of the local scheduler config. Each
+// snapshot is validated before it is applied, and if the scheduler fails to
+// restart with it, the scheduler is rolled back and the snapshot is not
+// retried.
+type Syncer struct {
+	config Config
+	base   scheduler.Config
+	source Source
+	sched  Reconfigurer
+	clk    clock.Clock
+	stats  tally.Scope
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex
+	applied string // Version of the last applied snapshot.
+	failed  string // Version of the last rejected snapshot.
+}
+
+// New creates a new Syncer. base is the local scheduler config, which
+// snapshots are overlaid on.
+func New(
+	config Config,
+	base scheduler.Config,
+	source Source,
+	sched Reconfigurer,
+	clk clock.Clock,
+	stats tally.Scope,
+	logger *zap.SugaredLogger) *Syncer {
+
+	config = config.applyDefaults()
+
+	stats = stats.Tagged(map[string]string{
+		"module": "remoteconfig",
+	})
+
+	return &Syncer{
+		config: config,
+		base:   base,
+		source: source,
+		sched:  sched,
+		clk:    clk,
+		stats:  stats,
+		logger: logger,
+	}
+}
+
+// Run polls the source until done is closed.
+func (s *Syncer) Run(done <-chan struct{}) {
+	ticker := s.clk.Ticker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.poll()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Syncer) poll() {
+	snapshot, err := s.source.Fetch()
+	if err != nil {
+		s.stats.Counter("fetch_errors").Inc(1)
+		s.logger.Errorf("Error fetching remote scheduler config: %s", err)
+		return
+	}
+	if err := s.Apply(snapshot); err != nil {
+		s.logger.Errorf("Error applying remote scheduler config: %s", err)
+	}
+}
+
+// Apply applies snapshot to the scheduler, e.g. when pushed by the remote
+// config service. No-ops if the version of snapshot was already applied or
+// rejected.
+func (s *Syncer) Apply(snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snapshot.Version == s.applied || snapshot.Version == s.failed {
+		return nil
+	}
+	config, err := s.overlay(snapshot.Tunables)
+	if err != nil {
+		s.failed = snapshot.Version
+		s.stats.Counter("invalid_snapshots").Inc(1)
+		return fmt.Errorf("invalid snapshot %s: %s", snapshot.Version, err)
+	}
+	s.logger.Infof("Reloading scheduler with remote config version %s", snapshot.Version)
+	if err := s.sched.TryReload(config); err != nil {
+		s.failed = snapshot.Version
+		s.stats.Counter("rollbacks").Inc(1)
+		return fmt.Errorf("reload with snapshot %s, rolled back: %s", snapshot.Version, err)
+	}
+	s.applied = snapshot.Version
+	s.stats.Counter("reloads").Inc(1)
+	return nil
+}
+
+// Applied returns the version of the last applied snapshot, or empty if no
+// snapshot was applied.
+func (s *Syncer) Applied() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applied
+}
+
+// overlay returns the base config with tunables applied. Unknown fields are
+// rejected, so that misspelled tunables do not silently no-op.
+func (s *Syncer) overlay(tunables []byte) (scheduler.Config, error) {
+	config := s.base
+	if err := yaml.UnmarshalStrict(tunables, &config); err != nil {
+		return scheduler.Config{}, err
+	}
+	return config, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remoteconfig
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/lib/torrent/scheduler"
+	"github.com/uber/kraken/utils/log"
+)
+
+type fakeReconfigurer struct {
+	configs []scheduler.Config
+	err     error
+}
+
+func (r *fakeReconfigurer) TryReload(config scheduler.Config) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.configs = append(r.configs, config)
+	return nil
+}
+
+type fakeSource struct {
+	snapshot *Snapshot
+}
+
+func (s fakeSource) Fetch() (*Snapshot, error) {
+	return s.snapshot, nil
+}
+
+func newTestSyncer(base scheduler.Config, source Source, r Reconfigurer) *Syncer {
+	return New(Config{}, base, source, r, clock.NewMock(), tally.NoopScope, log.Default())
+}
+
+func TestParseSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	snapshot, err := ParseSnapshot([]byte("version: v1\nscheduler:\n  conn_tti: 5m\n"))
+	require.NoError(err)
+	require.Equal("v1", snapshot.Version)
+	require.Equal("conn_tti: 5m\n", string(snapshot.Tunables))
+
+	_, err = ParseSnapshot([]byte("scheduler:\n  conn_tti: 5m\n"))
+	require.Error(err)
+}
+
+func TestSyncerOverlaysTunablesOnBaseConfig(t *testing.T) {
+	require := require.New(t)
+
+	base := scheduler.Config{SeederTTI: time.Minute, LeecherTTI: time.Hour}
+	r := &fakeReconfigurer{}
+	s := newTestSyncer(base, nil, r)
+
+	require.NoError(s.Apply(&Snapshot{Version: "v1", Tunables: []byte("seeder_tti: 5m")}))
+	require.Len(r.configs, 1)
+	require.Equal(5*time.Minute, r.configs[0].SeederTTI)
+	require.Equal(time.Hour, r.configs[0].LeecherTTI)
+	require.Equal("v1", s.Applied())
+
+	// The same version is only applied once.
+	require.NoError(s.Apply(&Snapshot{Version: "v1", Tunables: []byte("seeder_tti: 5m")}))
+	require.Len(r.configs, 1)
+
+	// Snapshots are applied on top of the base config, not previous snapshots.
+	require.NoError(s.Apply(&Snapshot{Version: "v2", Tunables: []byte("leecher_tti: 2h")}))
+	require.Len(r.configs, 2)
+	require.Equal(time.Minute, r.configs[1].SeederTTI)
+	require.Equal(2*time.Hour, r.configs[1].LeecherTTI)
+}
+
+func TestSyncerRejectsInvalidSnapshots(t *testing.T) {
+	require := require.New(t)
+
+	r := &fakeReconfigurer{}
+	s := newTestSyncer(scheduler.Config{}, nil, r)
+
+	require.Error(s.Apply(&Snapshot{Version: "v1", Tunables: []byte("seeder_ttl: 5m")}))
+	require.Error(s.Apply(&Snapshot{Version: "v2", Tunables: []byte("seeder_tti: abc")}))
+	require.Empty(r.configs)
+	require.Equal("", s.Applied())
+}
+
+func TestSyncerDoesNotRetryRolledBackSnapshots(t *testing.T) {
+	require := require.New(t)
+
+	r := &fakeReconfigurer{err: errors.New("some error")}
+	s := newTestSyncer(scheduler.Config{}, nil, r)
+
+	snapshot := &Snapshot{Version: "v1", Tunables: []byte("seeder_tti: 5m")}
+	require.Error(s.Apply(snapshot))
+	require.NoError(s.Apply(snapshot))
+	require.Equal("", s.Applied())
+}
+
+func TestSyncerPollsSource(t *testing.T) {
+	require := require.New(t)
+
+	r := &fakeReconfigurer{}
+	source := fakeSource{&Snapshot{Version: "v1", Tunables: []byte("seeder_tti: 5m")}}
+	s := newTestSyncer(scheduler.Config{}, source, r)
+
+	s.poll()
+
+	require.Equal("v1", s.Applied())
+	require.Len(r.configs, 1)
+}
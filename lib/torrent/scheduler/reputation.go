@@ -0,0 +1,85 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/reputation"
+)
+
+// ReputationExportConfig defines the opt-in export of peer reputations, which
+// trackers aggregate across the fleet to stop handing out chronically bad
+// peers. Reputations are computed from the pieces received from each peer by
+// the torrents currently held by the scheduler.
+type ReputationExportConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Interval is the interval in which reputations are exported.
+	Interval time.Duration `yaml:"interval"`
+
+	// MaxPeers bounds the number of peers in each export. Peers with bad
+	// exchanges are exported first.
+	MaxPeers int `yaml:"max_peers"`
+}
+
+func (c ReputationExportConfig) applyDefaults() ReputationExportConfig {
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Minute
+	}
+	if c.MaxPeers == 0 {
+		c.MaxPeers = reputation.MaxScores
+	}
+	return c
+}
+
+func withReputationClient(c reputation.Client) option {
+	return func(o *schedOverrides) { o.reputations = c }
+}
+
+// reputationExportTickEvent occurs periodically to export peer reputations.
+type reputationExportTickEvent struct{}
+
+func (e reputationExportTickEvent) apply(s *state) {
+	exchanges := make(map[core.PeerID]reputation.Score)
+	for _, ctrl := range s.torrentControls {
+		for peerID, x := range ctrl.dispatcher.PeerExchanges() {
+			score := exchanges[peerID]
+			score.PeerID = peerID
+			score.Good += x.Good
+			score.Bad += x.Bad
+			exchanges[peerID] = score
+		}
+	}
+	scores := make([]reputation.Score, 0, len(exchanges))
+	for _, score := range exchanges {
+		scores = append(scores, score)
+	}
+	report := reputation.NewReport(
+		s.sched.pctx.PeerID, scores, s.sched.config.ReputationExport.MaxPeers, s.sched.clock.Now())
+	if len(report.Scores) == 0 {
+		return
+	}
+	go s.sched.exportReputations(report)
+}
+
+func (s *scheduler) exportReputations(r *reputation.Report) {
+	if err := s.reputations.Report(r); err != nil {
+		s.stats.Counter("reputation_export_errors").Inc(1)
+		s.log().Errorf("Error exporting peer reputations: %s", err)
+		return
+	}
+	s.stats.Counter("reputation_exports").Inc(1)
+}
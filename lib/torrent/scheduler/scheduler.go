@@ -14,25 +14,40 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcer"
+	"github.com/uber/kraken/lib/torrent/scheduler/completion"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
 	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/tunnel"
 	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/reconcile"
+	"github.com/uber/kraken/tracker/reputation"
+	"github.com/uber/kraken/utils/dnscache"
 	"github.com/uber/kraken/utils/log"
 )
 
@@ -42,16 +57,49 @@ var (
 	ErrSchedulerStopped  = errors.New("scheduler has been stopped")
 	ErrTorrentTimeout    = errors.New("torrent timed out")
 	ErrTorrentRemoved    = errors.New("torrent manually removed")
+	ErrTorrentCancelled  = errors.New("torrent cancelled")
 	ErrSendEventTimedOut = errors.New("event loop send timed out")
 )
 
+var (
+	errLeechOnly         = errors.New("leech-only client does not serve torrents")
+	errAttachUnsupported = errors.New("torrent archive does not support attaching files")
+	errPeerIDCollision   = errors.New("remote peer uses the local peer id")
+	errSchedulerDraining = errors.New("scheduler is draining")
+)
+
 // Scheduler defines operations for scheduler.
 type Scheduler interface {
-	Stop()
-	Download(namespace string, d core.Digest) error
+	Stop(ctx context.Context) error
+	Download(ctx context.Context, namespace string, d core.Digest) error
+	AddTorrentWithOptions(ctx context.Context, d core.Digest, opts ...TorrentOption) error
+	AttachTorrent(namespace string, d core.Digest, path string) error
+	Ingest(namespace string, d core.Digest, r io.Reader) error
 	BlacklistSnapshot() ([]connstate.BlacklistedConn, error)
 	RemoveTorrent(d core.Digest) error
+	CancelTorrent(h core.InfoHash) error
+	PauseTorrent(h core.InfoHash) error
+	ResumeTorrent(h core.InfoHash) error
+	SetTorrentRateLimit(h core.InfoHash, bytesPerSec int64) error
 	Probe() error
+	TorrentTimelines() []timeline.Timeline
+	PieceProvenance(d core.Digest) (provenance.Record, error)
+	SetEvictionHook(h EvictionHook) error
+	SetTorrentLogLevel(d core.Digest, level zapcore.Level) error
+	ClearTorrentLogLevel(d core.Digest)
+	StartTrace(h core.InfoHash, d time.Duration) (string, error)
+	StopTrace(h core.InfoHash) error
+	Stats() (*Stats, error)
+	SupportBundle(w io.Writer) error
+	SeededExport() (*reconcile.Export, error)
+	Progress(h core.InfoHash) (*Progress, error)
+	Torrents() ([]*Progress, error)
+	TorrentPeers(h core.InfoHash) ([]*TorrentPeer, error)
+	Announce(h core.InfoHash) error
+	RecentEvents() []EventRecord
+	Introspect() (*Introspection, error)
+	AddTorrentListener(l TorrentListener) error
+	Rechunk(d core.Digest, pieceLength int64, window time.Duration) (*core.MetaInfo, error)
 }
 
 // scheduler manages global state for the peer. This includes:
@@ -70,12 +118,42 @@ type scheduler struct {
 
 	handshaker *conn.Handshaker
 
+	// resolver caches hostname lookups of peers, and is shared with the
+	// announce client such that it survives reloads.
+	resolver *dnscache.Resolver
+
+	completions *completion.Notifier
+
+	metadataTags *metadataTagger
+
+	// reputations exports peer reputations to trackers, and is nil unless
+	// provided by the constructor.
+	reputations reputation.Client
+
+	// handles tracks storage handles of torrents, and is retained across
+	// reloads such that handles of the previous scheduler are still watched.
+	handles *leakwatch.Watchdog
+
 	eventLoop *liftedEventLoop
 
 	listener net.Listener
 
-	preemptionTick <-chan time.Time
-	emitStatsTick  <-chan time.Time
+	// tunnelListener accepts connections forwarded by relays, and is nil
+	// unless relays are configured.
+	tunnelListener *tunnel.Listener
+
+	// tunnelServer accepts tunnel registrations of other peers, and is nil
+	// unless a tunnel server address is configured.
+	tunnelServer *tunnel.Server
+
+	preemptionTick    <-chan time.Time
+	emitStatsTick     <-chan time.Time
+	pieceEvictionTick <-chan time.Time
+	deadlineTick      <-chan time.Time
+	connCapacityTick  <-chan time.Time
+	seedingTick       <-chan time.Time
+	reputationTick    <-chan time.Time
+	bandwidthTick     <-chan time.Time
 
 	// TODO(codyg): We only need this hold on this reference for reloading the scheduler...
 	announceClient announceclient.Client
@@ -86,12 +164,82 @@ type scheduler struct {
 
 	torrentlog *torrentlog.Logger
 
+	timelines *timeline.Store
+
+	provenance *provenance.Store
+
+	// tiers is nil if tiering is disabled.
+	tiers *tierMover
+
+	// orphans is nil if orphan GC is disabled.
+	orphans *orphanCollector
+
+	// pinner is nil if pinning is disabled.
+	pinner *pinner
+
+	// pins are the digests of the pinning manifest, and are only accessed
+	// from the event loop.
+	pins map[core.Digest]bool
+
+	// bandwidth is nil if bandwidth reporting is disabled, and is only
+	// accessed from the event loop.
+	bandwidth *bandwidthUsage
+
+	// bandwidthSink receives closed bandwidth windows, and is nil unless a
+	// sink is configured.
+	bandwidthSink BandwidthSink
+
+	// knownPeers is nil if known-good peer caching is disabled, and is only
+	// accessed from the event loop.
+	knownPeers *knownPeers
+
+	// disk is nil if disk IO admission control is disabled.
+	disk *dispatch.DiskMonitor
+
+	// memory is nil if piece request memory is not budgeted.
+	memory *dispatch.MemoryBudget
+
+	// audit is nil if the event audit is disabled.
+	audit *eventAudit
+
+	// rampUp is nil if ramp-up is disabled.
+	rampUp *rampUp
+
+	// evictionClasses orders piece eviction by namespace.
+	evictionClasses *namespaceClassifier
+
+	// evictionHook is nil unless registered, and is only accessed from the
+	// event loop.
+	evictionHook EvictionHook
+
+	// listeners are notified of finished torrents, and are only accessed
+	// from the event loop.
+	listeners []TorrentListener
+
+	// listenerResults queues results for delivery to listeners. Nil until the
+	// first result is queued, and only accessed from the event loop.
+	listenerResults chan listenerResult
+
 	logger *zap.SugaredLogger
 
+	// logLevels holds per-torrent log level overrides, which are retained
+	// across reloads.
+	logLevels *torrentLogLevels
+
+	// tracer holds per-torrent traces, which are retained across reloads.
+	tracer *torrentTracer
+
+	// seed is the seed of rand, which is only accessed from the event loop.
+	seed int64
+	rand *rand.Rand
+
 	// The following fields orchestrate the stopping of the scheduler.
-	stopOnce sync.Once      // Ensures the stop sequence is executed only once.
-	done     chan struct{}  // Signals all goroutines to exit.
-	wg       sync.WaitGroup // Waits for eventLoop and listenLoop to exit.
+	drainOnce  sync.Once      // Ensures the drain sequence is executed only once.
+	draining   int32          // Accessed atomically.
+	announceMu sync.RWMutex   // Held for reading by in-flight announces.
+	stopOnce   sync.Once      // Ensures the stop sequence is executed only once.
+	done       chan struct{}  // Signals all goroutines to exit.
+	wg         sync.WaitGroup // Waits for eventLoop and listenLoop to exit.
 }
 
 // schedOverrides defines scheduler fields which may be overrided for testing
@@ -99,6 +247,10 @@ type scheduler struct {
 type schedOverrides struct {
 	clock     clock.Clock
 	eventLoop eventLoop
+	resolver  *dnscache.Resolver
+
+	reputations   reputation.Client
+	bandwidthSink BandwidthSink
 }
 
 type option func(*schedOverrides)
@@ -111,6 +263,10 @@ func withEventLoop(l eventLoop) option {
 	return func(o *schedOverrides) { o.eventLoop = l }
 }
 
+func withResolver(r *dnscache.Resolver) option {
+	return func(o *schedOverrides) { o.resolver = r }
+}
+
 // newScheduler creates and starts a scheduler.
 func newScheduler(
 	config Config,
@@ -123,6 +279,23 @@ func newScheduler(
 
 	config = config.applyDefaults()
 
+	if err := validateExperiments(config.Experiments); err != nil {
+		return nil, fmt.Errorf("experiments: %s", err)
+	}
+
+	if err := config.EventLoop.validate(); err != nil {
+		return nil, fmt.Errorf("event loop: %s", err)
+	}
+
+	if err := config.ConnState.Validate(); err != nil {
+		return nil, fmt.Errorf("connstate: %s", err)
+	}
+
+	evictionClasses, err := newNamespaceClassifier(config.PieceEviction.Namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("piece eviction namespaces: %s", err)
+	}
+
 	logger, err := log.New(config.Log, nil)
 	if err != nil {
 		return nil, fmt.Errorf("log: %s", err)
@@ -137,12 +310,17 @@ func newScheduler(
 
 	overrides := schedOverrides{
 		clock:     clock.New(),
-		eventLoop: newEventLoop(),
+		eventLoop: newEventLoop(config.EventLoop, stats),
 	}
 	for _, opt := range options {
 		opt(&overrides)
 	}
 
+	if overrides.resolver == nil {
+		overrides.resolver = dnscache.New(
+			config.DNSCache, stats, dnscache.WithClock(overrides.clock))
+	}
+
 	eventLoop := liftEventLoop(overrides.eventLoop)
 
 	var preemptionTick <-chan time.Time
@@ -150,33 +328,135 @@ func newScheduler(
 		preemptionTick = overrides.clock.Tick(config.PreemptionInterval)
 	}
 
+	var pieceEvictionTick <-chan time.Time
+	if config.PieceEviction.Enable {
+		pieceEvictionTick = overrides.clock.Tick(config.PieceEviction.Interval)
+	}
+
+	var connCapacityTick <-chan time.Time
+	if config.ConnCapacity.Enable {
+		connCapacityTick = overrides.clock.Tick(config.ConnCapacity.Interval)
+	}
+
+	// Seeding policies may be set per torrent, so they are always enforced.
+	seedingTick := overrides.clock.Tick(config.Seeding.Interval)
+
+	var reputationTick <-chan time.Time
+	if config.ReputationExport.Enable && overrides.reputations != nil {
+		reputationTick = overrides.clock.Tick(config.ReputationExport.Interval)
+	}
+
+	var bandwidthTick <-chan time.Time
+	if config.BandwidthReport.Enable {
+		bandwidthTick = overrides.clock.Tick(config.BandwidthReport.SampleInterval)
+	}
+
+	hopts := []conn.Option{conn.WithResolver(overrides.resolver)}
+	if dial := tunnel.RelayDialer(config.Tunnel); dial != nil {
+		hopts = append(hopts, conn.WithFallbackDial(dial))
+	}
 	handshaker, err := conn.NewHandshaker(
-		config.Conn, stats, overrides.clock, netevents, pctx.PeerID, eventLoop, slogger)
+		config.Conn, stats, overrides.clock, netevents, pctx.PeerID, eventLoop, slogger,
+		hopts...)
 	if err != nil {
 		return nil, fmt.Errorf("conn: %s", err)
 	}
 
+	completions, err := completion.New(config.Completion, stats, overrides.clock)
+	if err != nil {
+		return nil, fmt.Errorf("completion: %s", err)
+	}
+
 	tlog, err := torrentlog.New(config.TorrentLog, pctx)
 	if err != nil {
 		return nil, fmt.Errorf("torrentlog: %s", err)
 	}
 
+	pstore, err := provenance.NewStore(config.Provenance)
+	if err != nil {
+		return nil, fmt.Errorf("provenance: %s", err)
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
 	s := &scheduler{
-		pctx:           pctx,
-		config:         config,
-		clock:          overrides.clock,
-		torrentArchive: ta,
-		stats:          stats,
-		handshaker:     handshaker,
-		eventLoop:      eventLoop,
-		preemptionTick: preemptionTick,
-		emitStatsTick:  overrides.clock.Tick(config.EmitStatsInterval),
-		announceClient: announceClient,
-		announcer:      announcer.Default(announceClient, eventLoop, overrides.clock, slogger),
-		netevents:      netevents,
-		torrentlog:     tlog,
-		logger:         slogger,
-		done:           done,
+		pctx:              pctx,
+		config:            config,
+		clock:             overrides.clock,
+		torrentArchive:    ta,
+		stats:             stats,
+		handshaker:        handshaker,
+		resolver:          overrides.resolver,
+		completions:       completions,
+		metadataTags:      newMetadataTagger(config.Metadata),
+		reputations:       overrides.reputations,
+		evictionClasses:   evictionClasses,
+		handles:           leakwatch.New(config.LeakWatch, overrides.clock, stats, slogger),
+		eventLoop:         eventLoop,
+		audit:             newEventAudit(config.EventLoop.AuditSize),
+		rampUp:            newRampUp(config.RampUp, overrides.clock, stats, seed),
+		preemptionTick:    preemptionTick,
+		emitStatsTick:     overrides.clock.Tick(config.EmitStatsInterval),
+		pieceEvictionTick: pieceEvictionTick,
+		deadlineTick:      overrides.clock.Tick(config.Deadline.Interval),
+		connCapacityTick:  connCapacityTick,
+		seedingTick:       seedingTick,
+		reputationTick:    reputationTick,
+		bandwidthTick:     bandwidthTick,
+		announceClient:    announceClient,
+		announcer:         announcer.New(config.Announcer, announceClient, eventLoop, overrides.clock, slogger),
+		netevents:         netevents,
+		torrentlog:        tlog,
+		timelines:         timeline.NewStore(config.Timeline, overrides.clock),
+		provenance:        pstore,
+		logger:            slogger,
+		logLevels:         newTorrentLogLevels(),
+		tracer:            newTorrentTracer(config.Trace, overrides.clock),
+		seed:              seed,
+		rand:              rand.New(rand.NewSource(seed)),
+		done:              done,
+	}
+
+	if config.Tiering.Enable {
+		tierer, ok := ta.(storage.Tierer)
+		if !ok {
+			return nil, errors.New("tiering enabled but torrent archive does not support tiers")
+		}
+		s.tiers = newTierMover(config.Tiering, tierer, stats, slogger)
+	}
+
+	if config.OrphanGC.Enable {
+		scanner, ok := ta.(storage.Scanner)
+		if !ok {
+			return nil, errors.New("orphan gc enabled but torrent archive does not support scanning")
+		}
+		s.orphans = newOrphanCollector(
+			config.OrphanGC, ta, scanner, overrides.clock, stats, slogger, s.activeDigests)
+	}
+
+	s.knownPeers = newKnownPeers(config.KnownPeers)
+
+	if config.Pinning.Enabled() {
+		s.pinner = newPinner(config.Pinning, overrides.clock, stats, slogger, s.setPins, s.addPin)
+	}
+
+	if config.BandwidthReport.Enable {
+		s.bandwidth = newBandwidthUsage(config.BandwidthReport, overrides.clock.Now())
+		s.bandwidthSink = overrides.bandwidthSink
+		if s.bandwidthSink == nil && config.BandwidthReport.SinkURL != "" {
+			s.bandwidthSink = httpBandwidthSink{config.BandwidthReport.SinkURL}
+		}
+	}
+
+	if config.DiskIO.Enable {
+		s.disk = dispatch.NewDiskMonitor(config.DiskIO, stats, overrides.clock)
+	}
+
+	if config.PieceMemory.Enable {
+		s.memory = dispatch.NewMemoryBudget(config.PieceMemory, stats)
 	}
 
 	if config.DisablePreemption {
@@ -195,8 +475,8 @@ func newScheduler(
 // "unstarted" scheduler in certain cases.
 func (s *scheduler) start(aq announcequeue.Queue) error {
 	s.log().Infof(
-		"Scheduler starting as peer %s on addr %s:%d",
-		s.pctx.PeerID, s.pctx.IP, s.pctx.Port)
+		"Scheduler starting as peer %s on addr %s:%d with seed %d",
+		s.pctx.PeerID, s.pctx.IP, s.pctx.Port, s.seed)
 
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.pctx.Port))
 	if err != nil {
@@ -204,26 +484,120 @@ func (s *scheduler) start(aq announcequeue.Queue) error {
 	}
 	s.listener = l
 
+	var tl net.Listener
+	if s.config.Tunnel.ServerAddr != "" {
+		tl, err = net.Listen("tcp", s.config.Tunnel.ServerAddr)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("tunnel server: %s", err)
+		}
+		s.tunnelServer, err = tunnel.NewServer(s.config.Tunnel, s.stats, s.logger)
+		if err != nil {
+			tl.Close()
+			l.Close()
+			return fmt.Errorf("tunnel server: %s", err)
+		}
+	}
+
 	s.wg.Add(4)
 	go s.runEventLoop(aq) // Careful, this should be the only reference to aq.
-	go s.listenLoop()
+	go s.listenLoop(s.listener)
 	go s.tickerLoop()
 	go s.announceLoop()
 
+	s.restoreState()
+
+	if len(s.config.Tunnel.Relays) > 0 {
+		s.tunnelListener = tunnel.NewListener(s.config.Tunnel, s.pctx.Port, s.stats, s.logger)
+		s.wg.Add(1)
+		go s.listenLoop(s.tunnelListener)
+	}
+	if s.tunnelServer != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.tunnelServer.Serve(tl); err != nil {
+				s.log().Errorf("Tunnel server exited: %s", err)
+			}
+		}()
+	}
+
+	s.completions.Start()
+	go s.resolvePendingCompletions()
+
+	if s.orphans != nil {
+		s.orphans.start(s.done)
+	}
+	if s.pinner != nil {
+		s.pinner.start(s.done)
+	}
+	if s.tiers != nil {
+		s.tiers.start(s.done)
+	}
+
 	return nil
 }
 
-// Stop shuts down the scheduler.
-func (s *scheduler) Stop() {
+// resolvePendingCompletions marks completion callbacks registered before a
+// restart as landed if their blob was completed in the meantime, and restarts
+// the downloads of all other blobs, such that their callbacks do not sit idle
+// until they expire.
+func (s *scheduler) resolvePendingCompletions() {
+	restarted := make(map[core.Digest]bool)
+	for _, c := range s.completions.Pending() {
+		info, err := s.torrentArchive.Stat(c.Namespace, c.Digest)
+		if err == nil && info.Bitfield().All() {
+			s.completions.Landed(c.Digest)
+			continue
+		}
+		if restarted[c.Digest] {
+			continue
+		}
+		restarted[c.Digest] = true
+		go func(c completion.Callback) {
+			// Landed on success by AddTorrentWithOptions.
+			if err := s.AddTorrentWithOptions(
+				context.Background(),
+				c.Digest,
+				WithNamespace(c.Namespace),
+				WithMetadata(c.Metadata)); err != nil {
+
+				s.log("digest", c.Digest).Infof(
+					"Error resuming download for pending completion callback: %s", err)
+			}
+		}(c)
+	}
+}
+
+// stop shuts down the scheduler immediately, closing all conns and failing all
+// pending downloads.
+func (s *scheduler) stop() {
 	s.stopOnce.Do(func() {
 		s.log().Info("Stopping scheduler...")
 
 		close(s.done)
 		s.listener.Close()
+		if s.tunnelListener != nil {
+			s.tunnelListener.Close()
+		}
+		if s.tunnelServer != nil {
+			s.tunnelServer.Close()
+		}
 		s.eventLoop.send(shutdownEvent{})
 
 		// Waits for all loops to stop.
 		s.wg.Wait()
+		if s.tiers != nil {
+			s.tiers.wait()
+		}
+		if s.orphans != nil {
+			s.orphans.wait()
+		}
+		if s.pinner != nil {
+			s.pinner.wait()
+		}
+
+		s.completions.Stop()
 
 		s.torrentlog.Sync()
 
@@ -231,28 +605,83 @@ func (s *scheduler) Stop() {
 	})
 }
 
-func (s *scheduler) doDownload(namespace string, d core.Digest) (size int64, err error) {
-	t, err := s.torrentArchive.CreateTorrent(namespace, d)
+func (s *scheduler) doDownload(
+	ctx context.Context,
+	namespace string,
+	d core.Digest,
+	opts []TorrentOption) (size int64, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if s.isDraining() {
+		return 0, ErrSchedulerStopped
+	}
+
+	if s.tiers != nil {
+		s.tiers.promote(d)
+	}
+	start := s.clock.Now()
+	t, err := s.torrentArchive.CreateTorrent(ctx, namespace, d)
 	if err != nil {
 		if err == storage.ErrNotFound {
 			return 0, ErrTorrentNotFound
 		}
+		if err == ctx.Err() {
+			return 0, err
+		}
+		conn.RecordOutgoingStage(s.stats, conn.StageStorageOpen, s.clock.Now().Sub(start), err)
 		return 0, fmt.Errorf("create torrent: %s", err)
 	}
+	conn.RecordOutgoingStage(s.stats, conn.StageStorageOpen, s.clock.Now().Sub(start), nil)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// The request fails through the deadline timers of the torrent, which
+		// also close its pending conns if no other request is left.
+		opts = append(opts[:len(opts):len(opts)], withRequestDeadline(deadline))
+	}
 
 	// Buffer size of 1 so sends do not block.
 	errc := make(chan error, 1)
-	if !s.eventLoop.send(newTorrentEvent{namespace, t, errc}) {
+	if !s.eventLoop.send(newTorrentEvent{namespace, t, opts, errc}) {
 		return 0, ErrSchedulerStopped
 	}
-	return t.Length(), <-errc
+	select {
+	case err := <-errc:
+		return t.Length(), err
+	case <-s.done:
+		return t.Length(), ErrSchedulerStopped
+	case <-ctx.Done():
+		// If the torrent completes concurrently, errc is simply never read.
+		s.eventLoop.send(abandonTorrentEvent{t.InfoHash(), errc})
+		return t.Length(), ctx.Err()
+	}
 }
 
 // Download downloads the torrent given metainfo. Once the torrent is downloaded,
-// it will begin seeding asynchronously.
-func (s *scheduler) Download(namespace string, d core.Digest) error {
+// it will begin seeding asynchronously. Returns ctx.Err() if ctx is done before
+// the torrent is downloaded, in which case the torrent is removed if no other
+// caller is waiting on it.
+func (s *scheduler) Download(ctx context.Context, namespace string, d core.Digest) error {
+	return s.AddTorrentWithOptions(ctx, d, WithNamespace(namespace))
+}
+
+// AddTorrentWithOptions downloads the torrent of d, configured by opts. Once
+// the torrent is downloaded, it will begin seeding asynchronously. Cancellation
+// of ctx behaves as in Download.
+func (s *scheduler) AddTorrentWithOptions(
+	ctx context.Context, d core.Digest, opts ...TorrentOption) error {
+
+	o := newTorrentOptions(s.config, opts...)
+	namespace := o.namespace
+	if o.callbackURL != "" {
+		if err := s.completions.Register(namespace, d, o.callbackURL, o.metadata); err != nil {
+			return fmt.Errorf("register completion callback: %s", err)
+		}
+	}
+	stats := s.metadataTags.tagged(s.stats, o.metadata)
 	start := time.Now()
-	size, err := s.doDownload(namespace, d)
+	size, err := s.doDownload(ctx, namespace, d, opts)
 	if err != nil {
 		var errTag string
 		switch err {
@@ -264,28 +693,100 @@ func (s *scheduler) Download(namespace string, d core.Digest) error {
 			errTag = "scheduler_stopped"
 		case ErrTorrentRemoved:
 			errTag = "removed"
+		case ErrTorrentCancelled:
+			errTag = "cancelled"
+		case context.Canceled, context.DeadlineExceeded:
+			errTag = "abandoned"
 		default:
 			errTag = "unknown"
+			if _, ok := err.(*DeadlineError); ok {
+				errTag = "deadline"
+			}
 		}
-		s.stats.Tagged(map[string]string{
+		stats.Tagged(map[string]string{
 			"error": errTag,
 		}).Counter("download_errors").Inc(1)
 		s.torrentlog.DownloadFailure(namespace, d, size, err)
 	} else {
 		downloadTime := time.Since(start)
-		recordDownloadTime(s.stats, size, downloadTime)
+		recordDownloadTime(stats, size, downloadTime)
 		s.torrentlog.DownloadSuccess(namespace, d, size, downloadTime)
+		// Covers torrents which were already complete, and thus never emit
+		// a dispatcherCompleteEvent.
+		s.completions.Landed(d)
 	}
 	return err
 }
 
+// AttachTorrent registers the existing file at path as the blob of d, and begins
+// seeding it. The file is verified in place rather than copied, and is never
+// written to. Requires a torrent archive which supports attaching files.
+func (s *scheduler) AttachTorrent(namespace string, d core.Digest, path string) error {
+	a, ok := s.torrentArchive.(storage.Attacher)
+	if !ok {
+		return errAttachUnsupported
+	}
+	if err := a.AttachTorrent(namespace, d, path); err != nil {
+		if err == storage.ErrNotFound {
+			return ErrTorrentNotFound
+		}
+		// An existing torrent for d is simply seeded (or completed) as is.
+		if !os.IsExist(err) {
+			return fmt.Errorf("attach torrent: %s", err)
+		}
+	}
+	return s.Download(context.Background(), namespace, d)
+}
+
+// Ingest writes the blob of d from r, which is read sequentially, e.g. as an
+// upload arrives. Pieces are seeded as soon as they are written rather than
+// once the whole blob is written. Blocks until r is fully ingested.
+func (s *scheduler) Ingest(namespace string, d core.Digest, r io.Reader) error {
+	t, err := s.torrentArchive.CreateTorrent(context.Background(), namespace, d)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return ErrTorrentNotFound
+		}
+		return fmt.Errorf("create torrent: %s", err)
+	}
+
+	// Buffer size of 1 so sends do not block.
+	result := make(chan *dispatch.Dispatcher, 1)
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(ingestTorrentEvent{namespace, t, result, errc}) {
+		return ErrSchedulerStopped
+	}
+	var dispatcher *dispatch.Dispatcher
+	select {
+	case dispatcher = <-result:
+	case err := <-errc:
+		return err
+	case <-s.done:
+		return ErrSchedulerStopped
+	}
+	if dispatcher == nil {
+		// Torrent is already complete.
+		return nil
+	}
+	if err := dispatcher.Ingest(r); err != nil {
+		s.stats.Counter("ingest_errors").Inc(1)
+		return fmt.Errorf("ingest: %s", err)
+	}
+	return nil
+}
+
 // BlacklistSnapshot returns a snapshot of the current connection blacklist.
 func (s *scheduler) BlacklistSnapshot() ([]connstate.BlacklistedConn, error) {
-	result := make(chan []connstate.BlacklistedConn)
+	result := make(chan []connstate.BlacklistedConn, 1)
 	if !s.eventLoop.send(blacklistSnapshotEvent{result}) {
 		return nil, ErrSchedulerStopped
 	}
-	return <-result, nil
+	select {
+	case blacklist := <-result:
+		return blacklist, nil
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
 }
 
 // RemoveTorrent forcibly stops leeching / seeding torrent for d and removes
@@ -296,12 +797,169 @@ func (s *scheduler) RemoveTorrent(d core.Digest) error {
 	if !s.eventLoop.send(removeTorrentEvent{d, errc}) {
 		return ErrSchedulerStopped
 	}
-	return <-errc
+	return s.waitErr(errc)
+}
+
+// CancelTorrent stops downloading the in-progress torrent of h, releasing its
+// conns and bandwidth. Pending downloads of the torrent fail with
+// ErrTorrentCancelled. Returns ErrTorrentNotFound if no torrent of h is in
+// progress.
+func (s *scheduler) CancelTorrent(h core.InfoHash) error {
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(cancelTorrentEvent{h, errc}) {
+		return ErrSchedulerStopped
+	}
+	return s.waitErr(errc)
+}
+
+// PauseTorrent suspends downloading the in-progress torrent of h without
+// discarding its progress. Pending downloads of the torrent remain blocked
+// until it is resumed. Returns ErrTorrentNotFound if no torrent of h is in
+// progress.
+func (s *scheduler) PauseTorrent(h core.InfoHash) error {
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(pauseTorrentEvent{h, errc}) {
+		return ErrSchedulerStopped
+	}
+	return s.waitErr(errc)
+}
+
+// ResumeTorrent resumes downloading the torrent of h after PauseTorrent.
+// No-ops if the torrent is not paused.
+func (s *scheduler) ResumeTorrent(h core.InfoHash) error {
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(resumeTorrentEvent{h, errc}) {
+		return ErrSchedulerStopped
+	}
+	return s.waitErr(errc)
+}
+
+// SetTorrentRateLimit caps the download rate of the in-progress torrent of h
+// to bytesPerSec, applying to all of its current and future conns. A
+// non-positive bytesPerSec lifts the limit. Returns ErrTorrentNotFound if no
+// torrent of h is in progress.
+func (s *scheduler) SetTorrentRateLimit(h core.InfoHash, bytesPerSec int64) error {
+	// Buffer size of 1 so sends do not block.
+	errc := make(chan error, 1)
+	if !s.eventLoop.send(setTorrentRateLimitEvent{h, bytesPerSec, errc}) {
+		return ErrSchedulerStopped
+	}
+	return s.waitErr(errc)
+}
+
+// TorrentTimelines returns the event timelines of in-progress torrents and of
+// the most recently finished torrents.
+func (s *scheduler) TorrentTimelines() []timeline.Timeline {
+	return s.timelines.Snapshot()
+}
+
+// RecentEvents returns the most recently applied events, oldest first. Unlike
+// most operations, it does not wait on the event loop, and thus succeeds even
+// if the event loop is stuck.
+func (s *scheduler) RecentEvents() []EventRecord {
+	return s.audit.snapshot()
+}
+
+// PieceProvenance returns where each piece of the completed torrent of d was
+// downloaded from. Returns provenance.ErrNotFound if d was not downloaded by
+// the scheduler, or its record is no longer retained.
+func (s *scheduler) PieceProvenance(d core.Digest) (provenance.Record, error) {
+	return s.provenance.Get(d)
+}
+
+// SetEvictionHook registers h to approve or veto the removal of idle torrents.
+// A nil h approves all removals.
+func (s *scheduler) SetEvictionHook(h EvictionHook) error {
+	if !s.eventLoop.send(setEvictionHookEvent{h}) {
+		return ErrSchedulerStopped
+	}
+	return nil
+}
+
+// SetTorrentLogLevel overrides the log level of the torrent of d, for both
+// active and future torrents of d. Returns ErrTooManyTorrentLogLevels if too
+// many overrides are already set.
+func (s *scheduler) SetTorrentLogLevel(d core.Digest, level zapcore.Level) error {
+	return s.logLevels.set(d, level)
+}
+
+// ClearTorrentLogLevel removes the log level override of the torrent of d.
+func (s *scheduler) ClearTorrentLogLevel(d core.Digest) {
+	s.logLevels.clear(d)
+}
+
+// Stats returns a consolidated snapshot of scheduler state. Event loop state
+// is captured by a single event, such that it is internally consistent.
+func (s *scheduler) Stats() (*Stats, error) {
+	depth := s.eventLoop.depth()
+
+	result := make(chan *Stats, 1)
+	if !s.eventLoop.send(statsSnapshotEvent{result}) {
+		return nil, ErrSchedulerStopped
+	}
+	var stats *Stats
+	select {
+	case stats = <-result:
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+
+	stats.EventLoopDepth = depth
+	if err := s.addGlobalStats(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// addGlobalStats adds stats which are not owned by the event loop.
+func (s *scheduler) addGlobalStats(stats *Stats) error {
+	stats.EgressBytes, stats.IngressBytes = s.handshaker.BandwidthUsage()
+	stats.DNSCacheEntries = s.resolver.Len()
+	stats.OpenStorageHandles = s.handles.NumOpen()
+	stats.LeakedStorageHandles = len(s.handles.Leaks())
+	stats.DiskUsage = -1
+	if reporter, ok := s.torrentArchive.(storage.DiskUsageReporter); ok {
+		usage, err := reporter.DiskUsage()
+		if err != nil {
+			return fmt.Errorf("disk usage: %s", err)
+		}
+		stats.DiskUsage = usage
+	}
+	return nil
 }
 
 // Probe verifies that the scheduler event loop is running and unblocked.
 func (s *scheduler) Probe() error {
-	return s.eventLoop.sendTimeout(probeEvent{}, s.config.ProbeTimeout)
+	start := time.Now()
+	done := make(chan struct{})
+	if err := s.eventLoop.sendTimeout(probeEvent{done}, s.config.ProbeTimeout); err != nil {
+		return err
+	}
+	timer := time.NewTimer(s.config.ProbeTimeout - time.Since(start))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-s.done:
+		return ErrSchedulerStopped
+	case <-timer.C:
+		return ErrSendEventTimedOut
+	}
+}
+
+// waitErr waits for the result of an event sent to the event loop. Events may
+// still be queued when the scheduler stops, in which case they are never
+// applied.
+func (s *scheduler) waitErr(errc chan error) error {
+	select {
+	case err := <-errc:
+		return err
+	case <-s.done:
+		return ErrSchedulerStopped
+	}
 }
 
 func (s *scheduler) runEventLoop(aq announcequeue.Queue) {
@@ -310,13 +968,13 @@ func (s *scheduler) runEventLoop(aq announcequeue.Queue) {
 	s.eventLoop.run(newState(s, aq))
 }
 
-// listenLoop accepts incoming connections.
-func (s *scheduler) listenLoop() {
+// listenLoop accepts incoming connections from l.
+func (s *scheduler) listenLoop(l net.Listener) {
 	defer s.wg.Done()
 
-	s.log().Infof("Listening on %s", s.listener.Addr().String())
+	s.log().Infof("Listening on %s", l.Addr().String())
 	for {
-		nc, err := s.listener.Accept()
+		nc, err := l.Accept()
 		if err != nil {
 			// TODO Need some way to make this gracefully exit.
 			s.log().Infof("Error accepting new conn, exiting listen loop: %s", err)
@@ -329,7 +987,9 @@ func (s *scheduler) listenLoop() {
 				nc.Close()
 				return
 			}
-			s.eventLoop.send(incomingHandshakeEvent{pc})
+			if !s.eventLoop.send(incomingHandshakeEvent{pc}) {
+				s.handshaker.Reject(pc, p2p.RejectMessage_DRAINING, ErrSchedulerStopped)
+			}
 		}()
 	}
 }
@@ -344,6 +1004,18 @@ func (s *scheduler) tickerLoop() {
 			s.eventLoop.send(preemptionTickEvent{})
 		case <-s.emitStatsTick:
 			s.eventLoop.send(emitStatsEvent{})
+		case <-s.pieceEvictionTick:
+			s.eventLoop.send(pieceEvictionTickEvent{})
+		case <-s.deadlineTick:
+			s.eventLoop.send(deadlineTickEvent{})
+		case <-s.connCapacityTick:
+			s.eventLoop.send(connCapacityTickEvent{})
+		case <-s.seedingTick:
+			s.eventLoop.send(seedingPolicyTickEvent{})
+		case <-s.reputationTick:
+			s.eventLoop.send(reputationExportTickEvent{})
+		case <-s.bandwidthTick:
+			s.eventLoop.send(bandwidthTickEvent{})
 		case <-s.done:
 			return
 		}
@@ -357,15 +1029,45 @@ func (s *scheduler) announceLoop() {
 	s.announcer.Ticker(s.done)
 }
 
-func (s *scheduler) announce(d core.Digest, h core.InfoHash, complete bool) {
-	peers, err := s.announcer.Announce(d, h, complete)
+func (s *scheduler) announce(
+	d core.Digest, h core.InfoHash, complete bool, have core.PieceRanges) {
+
+	// Waits outside of announceMu, such that draining is not blocked by
+	// delayed announces.
+	if !s.rampUp.waitAnnounce(s.done) {
+		return
+	}
+
+	s.announceMu.RLock()
+	defer s.announceMu.RUnlock()
+
+	if s.isDraining() {
+		// Torrents are announced as stopped once drained.
+		return
+	}
+	peers, content, err := s.announcer.Announce(d, h, complete, have)
 	if err != nil {
 		if err != announceclient.ErrDisabled {
 			s.eventLoop.send(announceErrEvent{h, err})
 		}
 		return
 	}
-	s.eventLoop.send(announceResultEvent{h, peers})
+	s.eventLoop.offload(announceResult{s.pctx, h, peers, content})
+	if complete {
+		s.announceLegacy(d, h)
+	}
+}
+
+// writeInline writes the content inlined by the tracker to d. If the content
+// cannot be written, the torrent falls back to downloading from peers.
+func (s *scheduler) writeInline(d *dispatch.Dispatcher, content []byte, peers []*core.PeerInfo) {
+	if err := d.WriteInline(content); err != nil {
+		s.stats.Counter("inline_errors").Inc(1)
+		s.log("hash", d.InfoHash()).Errorf("Error writing inline content: %s", err)
+		s.eventLoop.send(announceResultEvent{infoHash: d.InfoHash(), peers: peers})
+		return
+	}
+	s.stats.Counter("inline_downloads").Inc(1)
 }
 
 func (s *scheduler) failIncomingHandshake(pc *conn.PendingConn, err error) {
@@ -376,14 +1078,85 @@ func (s *scheduler) failIncomingHandshake(pc *conn.PendingConn, err error) {
 	s.eventLoop.send(failedIncomingHandshakeEvent{pc.PeerID(), pc.InfoHash()})
 }
 
+// recordEndgame is a dispatch.StateChangeHook which records when a torrent
+// enters endgame on its timeline.
+func (s *scheduler) recordEndgame(d *dispatch.Dispatcher, from, to dispatch.State) {
+	if to == dispatch.StateEndgame {
+		s.timelines.Record(d.InfoHash(), timeline.Endgame, "")
+	}
+}
+
+// recordProvenance retains the piece provenance of the completed torrent of d.
+func (s *scheduler) recordProvenance(namespace string, d *dispatch.Dispatcher) {
+	pieces := d.Provenance()
+	if len(pieces) == 0 {
+		// Torrent was already on disk.
+		return
+	}
+	r := provenance.Record{
+		Namespace: namespace,
+		Digest:    d.Digest(),
+		InfoHash:  d.InfoHash(),
+		Pieces:    pieces,
+	}
+	if err := s.provenance.Put(r); err != nil {
+		s.log("hash", d.InfoHash()).Errorf("Error recording piece provenance: %s", err)
+	}
+}
+
+// rejectIncomingHandshake notifies the remote peer of pc why its handshake
+// could not be served before closing the connection.
+func (s *scheduler) rejectIncomingHandshake(
+	pc *conn.PendingConn, reason p2p.RejectMessage_Reason, err error) {
+
+	s.log(
+		"peer", pc.PeerID(),
+		"hash", pc.InfoHash(),
+		"reason", reason).Infof("Rejecting incoming handshake: %s", err)
+	s.handshaker.Reject(pc, reason, err)
+	s.eventLoop.send(failedIncomingHandshakeEvent{pc.PeerID(), pc.InfoHash()})
+}
+
+// getLegacyTorrent returns the re-chunked torrent of d which is still served
+// under its previous info hash h, if the torrent archive supports it.
+func (s *scheduler) getLegacyTorrent(d core.Digest, h core.InfoHash) (storage.Torrent, error) {
+	ls, ok := s.torrentArchive.(storage.LegacyServer)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return ls.GetLegacyTorrent(d, h)
+}
+
 // establishIncomingHandshake attempts to establish a pending conn initialized
 // by a remote peer. Success / failure is communicated via events.
 func (s *scheduler) establishIncomingHandshake(pc *conn.PendingConn, rb conn.RemoteBitfields) {
 	info, err := s.torrentArchive.Stat(pc.Namespace(), pc.Digest())
 	if err != nil {
-		s.failIncomingHandshake(pc, fmt.Errorf("torrent stat: %s", err))
+		reason := p2p.RejectMessage_OTHER
+		// Agent archives report missing torrents as not exist errors.
+		if err == storage.ErrNotFound || os.IsNotExist(err) {
+			reason = p2p.RejectMessage_UNKNOWN_HASH
+		}
+		s.rejectIncomingHandshake(pc, reason, fmt.Errorf("torrent stat: %s", err))
 		return
 	}
+	if info.InfoHash() != pc.InfoHash() {
+		// The remote peer may still be using the metainfo the torrent had
+		// before it was re-chunked.
+		t, err := s.getLegacyTorrent(pc.Digest(), pc.InfoHash())
+		if err != nil {
+			reason := p2p.RejectMessage_OTHER
+			if err == storage.ErrNotFound {
+				reason = p2p.RejectMessage_UNKNOWN_HASH
+			}
+			s.rejectIncomingHandshake(pc, reason, fmt.Errorf("legacy torrent: %s", err))
+			return
+		}
+		info = t.Stat()
+	}
+	if s.tiers != nil && info.Bitfield().All() {
+		s.tiers.promote(pc.Digest())
+	}
 	c, err := s.handshaker.Establish(pc, info, rb)
 	if err != nil {
 		s.failIncomingHandshake(pc, fmt.Errorf("establish handshake: %s", err))
@@ -394,18 +1167,32 @@ func (s *scheduler) establishIncomingHandshake(pc *conn.PendingConn, rb conn.Rem
 }
 
 // initializeOutgoingHandshake attempts to initialize a conn to a remote peer.
-// Success / failure is communicated via events.
+// Success / failure is communicated via events. The handshake is aborted once
+// ctx is done.
 func (s *scheduler) initializeOutgoingHandshake(
-	p *core.PeerInfo, info *storage.TorrentInfo, rb conn.RemoteBitfields, namespace string) {
+	ctx context.Context,
+	p *core.PeerInfo,
+	d *dispatch.Dispatcher,
+	rb conn.RemoteBitfields,
+	namespace string) {
 
+	if s.isDraining() {
+		s.eventLoop.send(failedOutgoingHandshakeEvent{p.PeerID, d.InfoHash(), errSchedulerDraining})
+		return
+	}
+	if !s.rampUp.waitDial(s.done) {
+		return
+	}
+
+	info := d.Stat()
 	addr := fmt.Sprintf("%s:%d", p.IP, p.Port)
-	result, err := s.handshaker.Initialize(p.PeerID, addr, info, rb, namespace)
+	result, err := s.handshaker.Initialize(ctx, p.PeerID, addr, info, rb, namespace)
 	if err != nil {
 		s.log(
 			"peer", p.PeerID,
 			"hash", info.InfoHash(),
 			"addr", addr).Infof("Error initializing outgoing handshake: %s", err)
-		s.eventLoop.send(failedOutgoingHandshakeEvent{p.PeerID, info.InfoHash()})
+		s.eventLoop.send(failedOutgoingHandshakeEvent{p.PeerID, info.InfoHash(), err})
 		s.torrentlog.OutgoingConnectionReject(info.Digest(), info.InfoHash(), p.PeerID, err)
 		return
 	}
@@ -413,6 +1200,18 @@ func (s *scheduler) initializeOutgoingHandshake(
 	s.eventLoop.send(outgoingConnEvent{result.Conn, result.Bitfield, info})
 }
 
+// handlePeerIDCollision reports a remote host at addr which uses the local peer
+// id, e.g. because both hosts were booted from an image with a persisted peer
+// id. Other peers cannot tell the two hosts apart, and so the collision is
+// resolved by exiting if configured, which regenerates the peer id on restart.
+func (s *scheduler) handlePeerIDCollision(addr string) {
+	s.stats.Counter("peer_id_collisions").Inc(1)
+	if s.config.ExitOnPeerIDCollision {
+		s.log("addr", addr).Fatal("Local peer id is used by another host, exiting to regenerate peer id")
+	}
+	s.log("addr", addr).Error("Local peer id is used by another host")
+}
+
 func (s *scheduler) log(args ...interface{}) *zap.SugaredLogger {
 	return s.logger.With(args...)
 }
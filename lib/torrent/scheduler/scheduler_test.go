@@ -14,7 +14,14 @@
 package scheduler
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -24,12 +31,20 @@ import (
 	"github.com/uber/kraken/lib/hostlist"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+	"github.com/uber/kraken/lib/torrent/scheduler/completion"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/reputation"
 	"github.com/uber/kraken/utils/bitsetutil"
+	"github.com/uber/kraken/utils/testutil"
 
 	"github.com/andres-erbsen/clock"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 func TestDownloadTorrentWithSeederAndLeecher(t *testing.T) {
@@ -46,16 +61,280 @@ func TestDownloadTorrentWithSeederAndLeecher(t *testing.T) {
 	blob := core.NewBlobFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
-	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 	leecher.checkTorrent(t, namespace, blob)
 }
 
+func TestDownloadRecordsPieceProvenance(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	var record provenance.Record
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		var err error
+		record, err = leecher.scheduler.PieceProvenance(blob.Digest)
+		return err == nil
+	}))
+	require.Equal(blob.MetaInfo.NumPieces(), len(record.Pieces))
+	for i, p := range record.Pieces {
+		require.Equal(i, p.Index)
+		require.Equal(provenance.SourcePeer, p.Source)
+		require.Equal(seeder.pctx.PeerID.String(), p.PeerID)
+	}
+
+	// Seeded torrents were never downloaded.
+	_, err := seeder.scheduler.PieceProvenance(blob.Digest)
+	require.Equal(provenance.ErrNotFound, err)
+}
+
+// finishedTimeline polls the timelines of s until the timeline of d is finished.
+func finishedTimeline(t *testing.T, s Scheduler, d core.Digest) timeline.Timeline {
+	var result timeline.Timeline
+	require.NoError(t, testutil.PollUntilTrue(5*time.Second, func() bool {
+		for _, tl := range s.TorrentTimelines() {
+			if tl.Digest == d && tl.Finished {
+				result = tl
+				return true
+			}
+		}
+		return false
+	}))
+	return result
+}
+
+func TestDownloadRecordsTimeline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	tl := finishedTimeline(t, leecher.scheduler, blob.Digest)
+	require.Equal(namespace, tl.Namespace)
+	require.Equal(blob.MetaInfo.InfoHash(), tl.InfoHash)
+
+	var kinds []string
+	for _, e := range tl.Events {
+		kinds = append(kinds, e.Kind)
+	}
+	require.Equal(timeline.Added, kinds[0])
+	require.Contains(kinds, timeline.FirstPeer)
+	require.Equal(timeline.Completed, kinds[len(kinds)-1])
+
+	// Seeded torrents were never downloaded.
+	require.Empty(seeder.scheduler.TorrentTimelines())
+}
+
+func TestCancelledDownloadRecordsFailedTimeline(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	w := newEventWatcher()
+
+	p := mocks.newPeer(configFixture(), withEventLoop(w))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	errc := make(chan error)
+	go func() { errc <- p.scheduler.Download(context.Background(), namespace, blob.Digest) }()
+
+	w.waitFor(t, newTorrentEvent{})
+
+	require.NoError(p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+	require.Equal(ErrTorrentCancelled, <-errc)
+
+	tl := finishedTimeline(t, p.scheduler, blob.Digest)
+	last := tl.Events[len(tl.Events)-1]
+	require.Equal(timeline.Failed, last.Kind)
+	require.Equal(ErrTorrentCancelled.Error(), last.Detail)
+}
+
+func TestRestartResumesDownloadsOfPendingCompletions(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "completion")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	notified := make(chan completion.Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n completion.Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err == nil {
+			notified <- n
+		}
+	}))
+	defer server.Close()
+
+	config := configFixture()
+	config.Completion = completion.Config{JournalPath: filepath.Join(dir, "journal")}
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	// Simulates a callback registered before a restart, whose download had not
+	// finished.
+	n, err := completion.New(config.Completion, tally.NoopScope, clock.New())
+	require.NoError(err)
+	require.NoError(n.Register(namespace, blob.Digest, server.URL, nil))
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder := mocks.newPeer(configFixture())
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	leecher := mocks.newPeer(config)
+
+	select {
+	case n := <-notified:
+		require.Equal(blob.Digest, n.Digest)
+		require.Equal(namespace, n.Namespace)
+	case <-time.After(10 * time.Second):
+		require.FailNow("completion callback not delivered")
+	}
+	leecher.checkTorrent(t, namespace, blob)
+}
+
+func TestTorrentListenersNotifiedOnCompletion(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	results := make(chan TorrentResult, 1)
+	require.NoError(leecher.scheduler.AddTorrentListener(TorrentResultChan(results)))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	select {
+	case r := <-results:
+		require.NoError(r.Err)
+		require.Equal(namespace, r.Namespace)
+		require.Equal(blob.Digest, r.Digest)
+		require.Equal(blob.MetaInfo.Length(), r.Length)
+		require.Equal(blob.MetaInfo.Length(), r.BytesFromPeers)
+		require.Zero(r.BytesFromOrigins)
+		require.Zero(r.BytesFromFallback)
+	case <-time.After(5 * time.Second):
+		require.FailNow("listener not notified")
+	}
+}
+
+type reportChan chan *reputation.Report
+
+func (c reportChan) Report(r *reputation.Report) error {
+	c <- r
+	return nil
+}
+
+func TestLeecherExportsPeerReputations(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+
+	lconfig := config
+	lconfig.ReputationExport = ReputationExportConfig{Enable: true, Interval: 10 * time.Millisecond}
+	reports := make(reportChan, 100)
+	leecher := mocks.newPeer(lconfig, withReputationClient(reports))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-reports:
+			require.Equal(reputation.SchemaVersion, r.Version)
+			require.Equal(leecher.pctx.PeerID, r.Reporter)
+			if len(r.Scores) > 0 && r.Scores[0].Good == blob.MetaInfo.NumPieces() {
+				require.Equal([]reputation.Score{{
+					PeerID: seeder.pctx.PeerID,
+					Good:   blob.MetaInfo.NumPieces(),
+				}}, r.Scores)
+				return
+			}
+		case <-timeout:
+			require.FailNow("no reputation report")
+		}
+	}
+}
+
 func TestDownloadManyTorrentsWithSeederAndLeecher(t *testing.T) {
 	require := require.New(t)
 
@@ -72,7 +351,7 @@ func TestDownloadManyTorrentsWithSeederAndLeecher(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		blob := core.NewBlobFixture()
 
-		mocks.metaInfoClient.EXPECT().Download(
+		mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 		wg.Add(1)
@@ -80,9 +359,9 @@ func TestDownloadManyTorrentsWithSeederAndLeecher(t *testing.T) {
 			defer wg.Done()
 
 			seeder.writeTorrent(namespace, blob)
-			require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+			require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
-			require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+			require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 			leecher.checkTorrent(t, namespace, blob)
 		}()
 	}
@@ -107,11 +386,11 @@ func TestDownloadManyTorrentsWithSeederAndManyLeechers(t *testing.T) {
 		blob := core.NewBlobFixture()
 		blobs[i] = blob
 
-		mocks.metaInfoClient.EXPECT().Download(
+		mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(6)
 
 		seeder.writeTorrent(namespace, blob)
-		require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+		require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 	}
 
 	var wg sync.WaitGroup
@@ -122,7 +401,7 @@ func TestDownloadManyTorrentsWithSeederAndManyLeechers(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				require.NoError(p.scheduler.Download(namespace, blob.Digest))
+				require.NoError(p.scheduler.Download(context.Background(), namespace, blob.Digest))
 				p.checkTorrent(t, namespace, blob)
 			}()
 		}
@@ -144,12 +423,12 @@ func TestDownloadTorrentWhenPeersAllHaveDifferentPiece(t *testing.T) {
 	pieceLength := 256
 	blob := core.SizedBlobFixture(uint64(len(peers)*pieceLength), uint64(pieceLength))
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(len(peers))
 
 	var wg sync.WaitGroup
 	for i, p := range peers {
-		tor, err := p.torrentArchive.CreateTorrent(namespace, blob.Digest)
+		tor, err := p.torrentArchive.CreateTorrent(context.Background(), namespace, blob.Digest)
 		require.NoError(err)
 
 		piece := make([]byte, pieceLength)
@@ -162,7 +441,7 @@ func TestDownloadTorrentWhenPeersAllHaveDifferentPiece(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			require.NoError(p.scheduler.Download(namespace, blob.Digest))
+			require.NoError(p.scheduler.Download(context.Background(), namespace, blob.Digest))
 			p.checkTorrent(t, namespace, blob)
 		}()
 	}
@@ -180,7 +459,7 @@ func TestSeederTTI(t *testing.T) {
 	blob := core.NewBlobFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 	clk := clock.NewMock()
@@ -188,12 +467,12 @@ func TestSeederTTI(t *testing.T) {
 
 	seeder := mocks.newPeer(config, withEventLoop(w), withClock(clk))
 	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
 	leecher := mocks.newPeer(config, withClock(clk))
 
 	errc := make(chan error)
-	go func() { errc <- leecher.scheduler.Download(namespace, blob.Digest) }()
+	go func() { errc <- leecher.scheduler.Download(context.Background(), namespace, blob.Digest) }()
 
 	require.NoError(<-errc)
 	leecher.checkTorrent(t, namespace, blob)
@@ -218,6 +497,57 @@ func TestSeederTTI(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestEvictionHookVetoesIdleSeederRemoval(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	clk := clock.NewMock()
+	w := newEventWatcher()
+
+	seeder := mocks.newPeer(config, withEventLoop(w), withClock(clk))
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+	w.waitFor(t, dispatcherCompleteEvent{})
+
+	candidates := make(chan EvictionCandidate, 16)
+	require.NoError(seeder.scheduler.SetEvictionHook(EvictionHookFunc(
+		func(c EvictionCandidate) bool {
+			candidates <- c
+			return false
+		})))
+
+	clk.Add(config.SeederTTI)
+	clk.Add(config.PreemptionInterval)
+	w.waitFor(t, preemptionTickEvent{})
+
+	c := <-candidates
+	require.Equal(namespace, c.Namespace)
+	require.Equal(blob.Digest, c.Digest)
+	require.Equal(EvictionIdleSeeder, c.Reason)
+	require.True(c.Complete)
+
+	result := make(chan bool)
+	seeder.scheduler.eventLoop.send(hasTorrentEvent{blob.MetaInfo.InfoHash(), result})
+	require.True(<-result)
+
+	// Approve all removals from now on.
+	require.NoError(seeder.scheduler.SetEvictionHook(nil))
+
+	clk.Add(config.PreemptionInterval)
+
+	waitForTorrentRemoved(t, seeder.scheduler, blob.MetaInfo.InfoHash())
+}
+
 func TestLeecherTTI(t *testing.T) {
 	t.Skip()
 
@@ -233,11 +563,11 @@ func TestLeecherTTI(t *testing.T) {
 	blob := core.NewBlobFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
 
 	p := mocks.newPeer(config, withEventLoop(w), withClock(clk))
 	errc := make(chan error)
-	go func() { errc <- p.scheduler.Download(namespace, blob.Digest) }()
+	go func() { errc <- p.scheduler.Download(context.Background(), namespace, blob.Digest) }()
 
 	waitForTorrentAdded(t, p.scheduler, blob.MetaInfo.InfoHash())
 
@@ -262,14 +592,14 @@ func TestMultipleDownloadsForSameTorrentSucceed(t *testing.T) {
 	namespace := core.TagFixture()
 
 	// Allow any number of downloads due to concurrency below.
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).AnyTimes()
 
 	config := configFixture()
 
 	seeder := mocks.newPeer(config)
 	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
 	leecher := mocks.newPeer(config)
 
@@ -279,7 +609,7 @@ func TestMultipleDownloadsForSameTorrentSucceed(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			// Multiple goroutines should be able to wait on the same torrent.
-			require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+			require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 		}()
 	}
 	wg.Wait()
@@ -287,7 +617,7 @@ func TestMultipleDownloadsForSameTorrentSucceed(t *testing.T) {
 	leecher.checkTorrent(t, namespace, blob)
 
 	// After the torrent is complete, further calls to Download should succeed immediately.
-	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 }
 
 func TestEmitStatsEventTriggers(t *testing.T) {
@@ -321,13 +651,13 @@ func TestNetworkEvents(t *testing.T) {
 	blob := core.SizedBlobFixture(1, 1)
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
-	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 	leecher.checkTorrent(t, namespace, blob)
 
 	sid := seeder.pctx.PeerID
@@ -341,7 +671,7 @@ func TestNetworkEvents(t *testing.T) {
 		networkevent.AddTorrentEvent(h, sid, bitsetutil.FromBools(true), config.ConnState.MaxOpenConnectionsPerTorrent),
 		networkevent.TorrentCompleteEvent(h, sid),
 		networkevent.AddActiveConnEvent(h, sid, lid),
-		networkevent.DropActiveConnEvent(h, sid, lid),
+		networkevent.DropActiveConnEvent(h, sid, lid, 1, 0),
 		networkevent.BlacklistConnEvent(h, sid, lid, config.ConnState.BlacklistDuration),
 	}
 
@@ -349,9 +679,9 @@ func TestNetworkEvents(t *testing.T) {
 		networkevent.AddTorrentEvent(h, lid, bitsetutil.FromBools(false), config.ConnState.MaxOpenConnectionsPerTorrent),
 		networkevent.AddActiveConnEvent(h, lid, sid),
 		networkevent.RequestPieceEvent(h, lid, sid, 0),
-		networkevent.ReceivePieceEvent(h, lid, sid, 0),
+		networkevent.ReceivePieceEvent(h, lid, sid, 0, 1),
 		networkevent.TorrentCompleteEvent(h, lid),
-		networkevent.DropActiveConnEvent(h, lid, sid),
+		networkevent.DropActiveConnEvent(h, lid, sid, 0, 1),
 		networkevent.BlacklistConnEvent(h, lid, sid, config.ConnState.BlacklistDuration),
 	}
 
@@ -375,7 +705,7 @@ func TestPullInactiveTorrent(t *testing.T) {
 	blob := core.NewBlobFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 	seeder := mocks.newPeer(config)
@@ -386,11 +716,11 @@ func TestPullInactiveTorrent(t *testing.T) {
 	// Force announce the scheduler for this torrent to simulate a peer which
 	// is registered in tracker but does not have the torrent in memory.
 	ac := announceclient.New(seeder.pctx, hashring.NoopPassiveRing(hostlist.Fixture(mocks.trackerAddr)), nil)
-	ac.Announce(blob.Digest, blob.MetaInfo.InfoHash(), false, announceclient.V1)
+	ac.Announce(blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V1)
 
 	leecher := mocks.newPeer(config)
 
-	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 	leecher.checkTorrent(t, namespace, blob)
 }
 
@@ -409,26 +739,143 @@ func TestSchedulerReload(t *testing.T) {
 	download := func() {
 		blob := core.NewBlobFixture()
 
-		mocks.metaInfoClient.EXPECT().Download(
+		mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
 		seeder.writeTorrent(namespace, blob)
-		require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+		require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
 
-		require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+		require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
 		leecher.checkTorrent(t, namespace, blob)
 	}
 
 	download()
 
 	rs := makeReloadable(leecher.scheduler, func() announcequeue.Queue { return announcequeue.New() })
-	config.ConnTTL += 5 * time.Minute
+	config.PreemptionInterval += time.Second
 	rs.Reload(config)
+	require.NotEqual(leecher.scheduler, rs.scheduler)
 	leecher.scheduler = rs.scheduler
 
 	download()
 }
 
+func TestSchedulerHotReload(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+	namespace := core.TagFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	download := func() {
+		blob := core.NewBlobFixture()
+
+		mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+		seeder.writeTorrent(namespace, blob)
+		require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+		require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+		leecher.checkTorrent(t, namespace, blob)
+	}
+
+	download()
+
+	rs := makeReloadable(leecher.scheduler, func() announcequeue.Queue { return announcequeue.New() })
+	config.ConnTTL += 5 * time.Minute
+	config.SeederTTI += time.Minute
+	config.ConnState.MaxOpenConnectionsPerTorrent++
+	config.Announcer.DefaultInterval = 2 * time.Second
+	require.NoError(rs.TryReload(config))
+
+	// The scheduler was not restarted.
+	require.Equal(leecher.scheduler, rs.scheduler)
+	require.Equal(config.ConnTTL, rs.currentConfig().ConnTTL)
+	require.Equal(config.SeederTTI, rs.currentConfig().SeederTTI)
+	require.Equal(
+		config.ConnState.MaxOpenConnectionsPerTorrent,
+		rs.currentConfig().ConnState.MaxOpenConnectionsPerTorrent)
+
+	download()
+}
+
+func TestHotReloadable(t *testing.T) {
+	base := configFixture()
+
+	tests := []struct {
+		desc     string
+		modify   func(*Config)
+		expected bool
+	}{
+		{"unchanged", func(c *Config) {}, true},
+		{"conn ttl", func(c *Config) { c.ConnTTL = time.Minute }, true},
+		{"conn tti", func(c *Config) { c.ConnTTI = time.Minute }, true},
+		{"seeder tti", func(c *Config) { c.SeederTTI = time.Minute }, true},
+		{"announce interval", func(c *Config) { c.Announcer.MaxInterval = time.Hour }, true},
+		{"conn capacity", func(c *Config) { c.ConnState.MaxOpenConnectionsPerTorrent = 50 }, true},
+		{"max concurrent downloads", func(c *Config) { c.MaxConcurrentDownloads = 5 }, true},
+		{"preemption interval", func(c *Config) { c.PreemptionInterval = time.Hour }, false},
+		{"dispatch", func(c *Config) { c.Dispatch.PipelineLimit = 50 }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			next := base
+			test.modify(&next)
+			require.Equal(t, test.expected, hotReloadable(base.applyDefaults(), next))
+		})
+	}
+}
+
+func TestSchedulerTryReloadRollsBackOnError(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	p := mocks.newPeer(config)
+
+	rs := makeReloadable(p.scheduler, func() announcequeue.Queue { return announcequeue.New() })
+
+	invalid := config
+	invalid.PieceEviction.Namespaces.BestEffort = []string{"("}
+	require.Error(rs.TryReload(invalid))
+	p.scheduler = rs.scheduler
+
+	// The scheduler was restarted with the previous config.
+	require.NotEqual(invalid.PieceEviction.Namespaces, rs.scheduler.config.PieceEviction.Namespaces)
+	require.NoError(rs.Probe())
+}
+
+func TestSchedulerTryReloadInvalidConfigKeepsScheduler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	p := mocks.newPeer(config)
+
+	rs := makeReloadable(p.scheduler, func() announcequeue.Queue { return announcequeue.New() })
+
+	invalid := config
+	invalid.PieceEviction.Namespaces.BestEffort = []string{"("}
+	require.Error(rs.reload(invalid))
+
+	// In-flight torrents of the running scheduler are not interrupted.
+	require.Equal(p.scheduler, rs.scheduler)
+	require.False(p.scheduler.stopped())
+	require.NoError(rs.Probe())
+}
+
 func TestSchedulerRemoveTorrent(t *testing.T) {
 	require := require.New(t)
 
@@ -442,11 +889,11 @@ func TestSchedulerRemoveTorrent(t *testing.T) {
 	blob := core.NewBlobFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
 		namespace, blob.Digest).Return(blob.MetaInfo, nil)
 
 	errc := make(chan error)
-	go func() { errc <- p.scheduler.Download(namespace, blob.Digest) }()
+	go func() { errc <- p.scheduler.Download(context.Background(), namespace, blob.Digest) }()
 
 	w.waitFor(t, newTorrentEvent{})
 
@@ -458,6 +905,118 @@ func TestSchedulerRemoveTorrent(t *testing.T) {
 	require.True(os.IsNotExist(err))
 }
 
+func TestSchedulerCancelTorrent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	w := newEventWatcher()
+
+	p := mocks.newPeer(configFixture(), withEventLoop(w))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	errc := make(chan error)
+	go func() { errc <- p.scheduler.Download(context.Background(), namespace, blob.Digest) }()
+
+	w.waitFor(t, newTorrentEvent{})
+
+	require.NoError(p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+
+	require.Equal(ErrTorrentCancelled, <-errc)
+
+	require.Equal(ErrTorrentNotFound, p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+}
+
+func TestSchedulerDownloadRemovesTorrentAbandonedByContext(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	w := newEventWatcher()
+
+	p := mocks.newPeer(configFixture(), withEventLoop(w))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- p.scheduler.Download(ctx, namespace, blob.Digest) }()
+
+	w.waitFor(t, newTorrentEvent{})
+
+	cancel()
+	require.Equal(context.Canceled, <-errc)
+
+	w.waitFor(t, abandonTorrentEvent{})
+
+	require.Equal(ErrTorrentNotFound, p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+}
+
+func TestSchedulerDownloadKeepsTorrentForRemainingCallers(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	w := newEventWatcher()
+
+	p := mocks.newPeer(configFixture(), withEventLoop(w))
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error)
+	go func() { abandoned <- p.scheduler.Download(ctx, namespace, blob.Digest) }()
+	w.waitFor(t, newTorrentEvent{})
+
+	remaining := make(chan error)
+	go func() { remaining <- p.scheduler.Download(context.Background(), namespace, blob.Digest) }()
+	w.waitFor(t, newTorrentEvent{})
+
+	cancel()
+	require.Equal(context.Canceled, <-abandoned)
+
+	w.waitFor(t, abandonTorrentEvent{})
+
+	require.NoError(p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+	require.Equal(ErrTorrentCancelled, <-remaining)
+}
+
+func TestSchedulerCancelTorrentIgnoresCompleteTorrents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	p := mocks.newPeer(configFixture())
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	p.writeTorrent(namespace, blob)
+	require.NoError(p.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.Equal(ErrTorrentNotFound, p.scheduler.CancelTorrent(blob.MetaInfo.InfoHash()))
+}
+
 func TestSchedulerProbe(t *testing.T) {
 	require := require.New(t)
 
@@ -468,15 +1027,156 @@ func TestSchedulerProbe(t *testing.T) {
 
 	require.NoError(p.scheduler.Probe())
 
-	p.scheduler.Stop()
+	require.NoError(p.scheduler.Stop(context.Background()))
 
 	require.Equal(ErrSchedulerStopped, p.scheduler.Probe())
 }
 
+func TestSchedulerStopDrainsAndAnnouncesStopped(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+	h := blob.MetaInfo.InfoHash()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	peerIDs := func() []core.PeerID {
+		var ids []core.PeerID
+		for _, p := range mocks.tracker.Peers(h) {
+			ids = append(ids, p.PeerID)
+		}
+		return ids
+	}
+	require.Contains(peerIDs(), leecher.pctx.PeerID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(leecher.scheduler.Stop(ctx))
+
+	require.NotContains(peerIDs(), leecher.pctx.PeerID)
+	require.Contains(peerIDs(), seeder.pctx.PeerID)
+
+	require.Equal(
+		ErrSchedulerStopped,
+		leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+	leecher.checkTorrent(t, namespace, blob)
+}
+
+func TestSchedulerStopReturnsContextErrorIfDrainInterrupted(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	seeder := mocks.newPeer(configFixture())
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(context.Canceled, seeder.scheduler.Stop(ctx))
+
+	// The scheduler is stopped regardless.
+	require.Equal(ErrSchedulerStopped, seeder.scheduler.Probe())
+}
+
+func TestSchedulerStats(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	stats, err := leecher.scheduler.Stats()
+	require.NoError(err)
+	require.Equal(StatsVersion, stats.Version)
+	require.Equal(1, stats.Torrents)
+	require.Equal(1, stats.TorrentsByState[dispatch.StateSeeding.String()])
+	require.True(stats.IngressBytes >= int64(len(blob.Content)))
+
+	require.NoError(leecher.scheduler.Stop(context.Background()))
+
+	_, err = leecher.scheduler.Stats()
+	require.Equal(ErrSchedulerStopped, err)
+}
+
+func TestLeechOnlyDropsCompletedTorrent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+
+	leechOnlyConfig := configFixture()
+	leechOnlyConfig.LeechOnly = true
+	leecher := mocks.newPeer(leechOnlyConfig)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+	leecher.checkTorrent(t, namespace, blob)
+
+	stats, err := leecher.scheduler.Stats()
+	require.NoError(err)
+	require.Equal(0, stats.Torrents)
+
+	// Downloading a complete torrent again does not start seeding it.
+	require.NoError(leecher.scheduler.Download(context.Background(), namespace, blob.Digest))
+	stats, err = leecher.scheduler.Stats()
+	require.NoError(err)
+	require.Equal(0, stats.Torrents)
+}
+
 type deadlockEvent struct {
 	release chan struct{}
 }
 
+func (e deadlockEvent) describe() eventFields { return nil }
+
 func (e deadlockEvent) apply(*state) {
 	<-e.release
 }
@@ -503,3 +1203,78 @@ func TestSchedulerProbeTimeoutsIfDeadlocked(t *testing.T) {
 
 	close(release)
 }
+
+func TestIngestSeedsPiecesBeforeBlobIsWritten(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	ingester := mocks.newPeer(config)
+	leecher := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(),
+		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+	r, w := io.Pipe()
+	ingestErr := make(chan error, 1)
+	go func() { ingestErr <- ingester.scheduler.Ingest(namespace, blob.Digest, r) }()
+
+	half := len(blob.Content) / 2
+	_, err := w.Write(blob.Content[:half])
+	require.NoError(err)
+
+	downloadErr := make(chan error, 1)
+	go func() { downloadErr <- leecher.scheduler.Download(context.Background(), namespace, blob.Digest) }()
+
+	_, err = w.Write(blob.Content[half:])
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	require.NoError(<-ingestErr)
+	require.NoError(<-downloadErr)
+
+	ingester.checkTorrent(t, namespace, blob)
+	leecher.checkTorrent(t, namespace, blob)
+}
+
+func TestSchedulerTorrentAdministration(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+	namespace := core.TagFixture()
+	blob := core.SizedBlobFixture(256, 8)
+
+	seeder := mocks.newPeer(config)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	h := blob.MetaInfo.InfoHash()
+
+	torrents, err := seeder.scheduler.Torrents()
+	require.NoError(err)
+	require.Len(torrents, 1)
+	require.Equal(h, torrents[0].InfoHash)
+	require.True(torrents[0].Complete)
+
+	peers, err := seeder.scheduler.TorrentPeers(h)
+	require.NoError(err)
+	require.Empty(peers)
+
+	require.NoError(seeder.scheduler.Announce(h))
+
+	other := core.InfoHashFixture()
+	_, err = seeder.scheduler.TorrentPeers(other)
+	require.Equal(ErrTorrentNotFound, err)
+	require.Equal(ErrTorrentNotFound, seeder.scheduler.Announce(other))
+}
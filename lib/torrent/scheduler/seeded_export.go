@@ -0,0 +1,70 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/reconcile"
+)
+
+// SeededExportConfig defines the export of the torrents this peer is seeding,
+// which trackers pull to detect and correct drift in their peer stores caused
+// by missed announces or tracker restarts, and neighbors pull to warm up.
+type SeededExportConfig struct {
+	// SigningKey, if set, signs exports such that trackers configured with the
+	// same key can authenticate them.
+	SigningKey string `yaml:"signing_key"`
+}
+
+// seededExportEvent occurs when the export of seeded torrents is requested via
+// scheduler API.
+type seededExportEvent struct {
+	result chan *reconcile.Export
+}
+
+func (e seededExportEvent) apply(s *state) {
+	var hashes []core.InfoHash
+	var torrents []reconcile.Torrent
+	for h, ctrl := range s.torrentControls {
+		if ctrl.seeding() {
+			hashes = append(hashes, h)
+			torrents = append(torrents, reconcile.Torrent{
+				Namespace: ctrl.namespace,
+				Digest:    ctrl.dispatcher.Digest(),
+			})
+		}
+	}
+	export := reconcile.NewExport(
+		core.PeerInfoFromContext(s.sched.pctx, true), hashes, s.sched.clock.Now())
+	export.SetTorrents(torrents)
+	if key := s.sched.config.SeededExport.SigningKey; key != "" {
+		export.Sign([]byte(key))
+	}
+	e.result <- export
+}
+
+// SeededExport returns an export of the torrents this peer is currently
+// seeding.
+func (s *scheduler) SeededExport() (*reconcile.Export, error) {
+	result := make(chan *reconcile.Export, 1)
+	if !s.eventLoop.send(seededExportEvent{result}) {
+		return nil, ErrSchedulerStopped
+	}
+	select {
+	case export := <-result:
+		return export, nil
+	case <-s.done:
+		return nil, ErrSchedulerStopped
+	}
+}
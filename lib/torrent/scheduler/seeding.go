@@ -0,0 +1,114 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// SeedingPolicy bounds how long a complete torrent is seeded. Zero values are
+// unlimited. Unlike SeederTTI, which only removes torrents nobody reads from,
+// seeding policies stop torrents which are still in demand.
+type SeedingPolicy struct {
+	// MaxRatio stops seeding once the bytes uploaded reach MaxRatio times the
+	// length of the torrent.
+	MaxRatio float64 `yaml:"max_ratio"`
+
+	// MaxDuration stops seeding once the torrent has been seeded for
+	// MaxDuration.
+	MaxDuration time.Duration `yaml:"max_duration"`
+
+	// MinSeeders prevents the other limits from stopping the torrent unless
+	// at least MinSeeders other seeders are in the swarm. Seeders are counted
+	// from the last announce handout, including origins.
+	MinSeeders int `yaml:"min_seeders"`
+}
+
+func (p SeedingPolicy) limited() bool {
+	return p.MaxRatio > 0 || p.MaxDuration > 0
+}
+
+// SeedingConfig defines the default seeding policy, which may be overridden
+// per torrent via WithSeedingPolicy.
+type SeedingConfig struct {
+	SeedingPolicy `yaml:",inline"`
+
+	// Interval is the interval in which seeding policies are enforced.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c SeedingConfig) applyDefaults() SeedingConfig {
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	return c
+}
+
+// WithSeedingPolicy overrides Config.Seeding for the torrent.
+func WithSeedingPolicy(p SeedingPolicy) TorrentOption {
+	return func(o *torrentOptions) { o.seeding = p }
+}
+
+// seedingLimit returns the reason the torrent of ctrl exceeds its seeding
+// policy, or the empty string if it may keep seeding.
+func (s *state) seedingLimit(ctrl *torrentControl) string {
+	p := ctrl.opts.seeding
+	if !p.limited() || !ctrl.seeding() || ctrl.swarmSeeders < p.MinSeeders {
+		return ""
+	}
+	if p.MaxRatio > 0 && ctrl.dispatcher.Length() > 0 {
+		ratio := float64(ctrl.dispatcher.BytesUploaded()) / float64(ctrl.dispatcher.Length())
+		if ratio >= p.MaxRatio {
+			return fmt.Sprintf("upload ratio %.2f reached max %.2f", ratio, p.MaxRatio)
+		}
+	}
+	if p.MaxDuration > 0 {
+		seeded := s.sched.clock.Now().Sub(ctrl.seedingSince)
+		if seeded >= p.MaxDuration {
+			return fmt.Sprintf("seeded for %s, max %s", seeded, p.MaxDuration)
+		}
+	}
+	return ""
+}
+
+// seedingPolicyTickEvent occurs periodically to stop seeding torrents which
+// exceed their seeding policy.
+type seedingPolicyTickEvent struct{}
+
+func (e seedingPolicyTickEvent) apply(s *state) {
+	for h, ctrl := range s.torrentControls {
+		if ctrl.opts.preemptionExempt || ctrl.pinned {
+			continue
+		}
+		reason := s.seedingLimit(ctrl)
+		if reason == "" {
+			continue
+		}
+		s.log("hash", h, "reason", reason).Info("Stopping seeding torrent")
+		ctrl.stats.Counter("seeding_limit_stops").Inc(1)
+		s.closeConns(h)
+		s.removeTorrent(h, nil)
+		go s.sched.announceStopped(ctrl.dispatcher.Digest(), h)
+	}
+}
+
+// announceStopped removes this peer from the swarm of h on the tracker.
+func (s *scheduler) announceStopped(d core.Digest, h core.InfoHash) {
+	if err := s.announcer.AnnounceStopped(d, h); err != nil {
+		s.log("hash", h).Errorf("Error announcing stopped torrent: %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/timeutil"
+)
+
+// StarvationConfig defines the detection of starved torrents, which receive
+// no new pieces for Window while leeching. Starved torrents are re-announced
+// immediately rather than on the next announce tick, such that swarms with
+// churn do not stall until then.
+type StarvationConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Window is the duration without new pieces after which a leeching
+	// torrent is starved.
+	Window time.Duration `yaml:"window"`
+
+	// ClearBlacklist un-blacklists all peers of a starved torrent, such that
+	// peers which failed previously may be retried.
+	ClearBlacklist bool `yaml:"clear_blacklist"`
+}
+
+func (c StarvationConfig) applyDefaults() StarvationConfig {
+	if c.Window == 0 {
+		c.Window = 30 * time.Second
+	}
+	return c
+}
+
+// setStarvationTimer sends a starvedTorrentEvent for h once d elapses.
+func (s *state) setStarvationTimer(h core.InfoHash, ctrl *torrentControl, d time.Duration) {
+	if !s.sched.config.Starvation.Enable {
+		return
+	}
+	if ctrl.starvationTimer != nil {
+		ctrl.starvationTimer.Stop()
+	}
+	ctrl.starvationTimer = s.sched.clock.AfterFunc(d, func() {
+		s.sched.eventLoop.send(starvedTorrentEvent{h})
+	})
+}
+
+// starvedTorrentEvent occurs when a leeching torrent may have received no new
+// pieces for the starvation window.
+type starvedTorrentEvent struct {
+	infoHash core.InfoHash
+}
+
+// apply re-announces the torrent immediately if it is starved, and checks
+// again once the window elapses. Paused torrents and torrents backing off
+// announces are never re-announced early.
+func (e starvedTorrentEvent) apply(s *state) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.seeding() {
+		return
+	}
+	config := s.sched.config.Starvation
+	if ctrl.dispatcher.Paused() {
+		s.setStarvationTimer(e.infoHash, ctrl, config.Window)
+		return
+	}
+	now := s.sched.clock.Now()
+	lastProgress := timeutil.MostRecent(
+		ctrl.dispatcher.CreatedAt(),
+		ctrl.dispatcher.LastWriteTime(),
+		ctrl.resumedAt,
+		ctrl.starvedAt)
+	if idle := now.Sub(lastProgress); idle < config.Window {
+		s.setStarvationTimer(e.infoHash, ctrl, config.Window-idle)
+		return
+	}
+	s.log("hash", e.infoHash).Infof("Torrent starved, no pieces written since %s", lastProgress)
+	ctrl.stats.Counter("starved_torrents").Inc(1)
+	ctrl.starvedAt = now
+	if config.ClearBlacklist {
+		s.conns.ClearBlacklist(e.infoHash)
+	}
+	if s.announceQueue.Take(e.infoHash) {
+		s.forceAnnounce(ctrl.dispatcher)
+	}
+	s.setStarvationTimer(e.infoHash, ctrl, config.Window)
+}
@@ -14,18 +14,28 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"time"
 
+	"github.com/andres-erbsen/clock"
+	"github.com/cenkalti/backoff"
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/conncapacity"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/leakwatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/timeline"
 	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/bandwidth"
 	"go.uber.org/zap"
 
+	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
 )
 
@@ -35,6 +45,88 @@ type torrentControl struct {
 	dispatcher   *dispatch.Dispatcher
 	errors       []chan error
 	localRequest bool
+	opts         torrentOptions
+
+	// escalations are the names of the deadline escalations applied to the
+	// torrent, in order.
+	escalations []string
+
+	// stats is tagged with the experiment the torrent is assigned to, if any
+	// experiments are configured.
+	stats tally.Scope
+
+	// logger attaches the torrent context to dispatcher and conn logs.
+	logger *zap.SugaredLogger
+
+	// handle is released once the torrentControl is removed.
+	handle *leakwatch.Handle
+
+	// dials is cancelled once the torrentControl is removed, which closes the
+	// pending outgoing handshakes of the torrent.
+	dials       context.Context
+	cancelDials context.CancelFunc
+
+	// resumedAt is the last time the torrent was resumed after being paused.
+	resumedAt time.Time
+
+	// capacity adapts the conn capacity of the torrent while in progress.
+	// Nil if dynamic conn capacity is disabled.
+	capacity *conncapacity.Target
+
+	// ingress is shared by all conns of the torrent to limit its download
+	// rate. Unlimited unless set via WithDownloadRateLimit or
+	// SetTorrentRateLimit.
+	ingress *bandwidth.Bucket
+
+	// timers fire deadlineEvents for the torrent and its waiters. Stopped once
+	// the torrent completes or is removed.
+	timers []*clock.Timer
+
+	// announceBackoff delays announces after failures. Nil unless the last
+	// announce failed.
+	announceBackoff *backoff.ExponentialBackOff
+
+	// starvationTimer fires starvedTorrentEvents while the torrent is in
+	// progress. Stopped along with timers.
+	starvationTimer *clock.Timer
+
+	// starvedAt is the last time the torrent was re-announced for being
+	// starved.
+	starvedAt time.Time
+
+	// seedingSince is when the torrent completed, or was added if it was
+	// already complete.
+	seedingSince time.Time
+
+	// announcedComplete is set if the torrent was already announced as
+	// complete before its dispatcher reported completion.
+	announcedComplete bool
+
+	// swarmSeeders is the number of seeders in the last announce handout
+	// received while the torrent was in progress.
+	swarmSeeders int
+
+	// origins are the peer ids of all origins handed out for the torrent.
+	origins map[string]bool
+
+	// dialed are the peers the torrent dialed, by peer id.
+	dialed map[core.PeerID]*core.PeerInfo
+
+	// pinned is true if the torrent is listed in the pinning manifest, which
+	// exempts it from idle preemption, seeding limits and piece eviction.
+	pinned bool
+
+	// sampledUploaded and sampledDownloaded are the bytes transferred by the
+	// dispatcher which were already attributed to the namespace of the
+	// torrent. See sampleBandwidth.
+	sampledUploaded   int64
+	sampledDownloaded int64
+}
+
+// seeding returns true if the dispatcher of ctrl completed its torrent and is
+// seeding it.
+func (ctrl *torrentControl) seeding() bool {
+	return ctrl.dispatcher.State() == dispatch.StateSeeding
 }
 
 // state is a superset of scheduler, which includes protected state which can
@@ -52,6 +144,10 @@ type state struct {
 	torrentControls map[core.InfoHash]*torrentControl
 	conns           *connstate.State
 	announceQueue   announcequeue.Queue
+	admission       *admissionQueue
+
+	// rechunking are the digests being re-chunked, which cannot be added.
+	rechunking map[core.Digest]bool
 }
 
 func newState(s *scheduler, aq announcequeue.Queue) *state {
@@ -61,33 +157,118 @@ func newState(s *scheduler, aq announcequeue.Queue) *state {
 		conns: connstate.New(
 			s.config.ConnState, s.clock, s.pctx.PeerID, s.netevents, s.logger),
 		announceQueue: aq,
+		admission:     newAdmissionQueue(),
+		rechunking:    make(map[core.Digest]bool),
 	}
 }
 
 // addTorrent initializes a new torrentControl for t. Overwrites any existing
 // torrentControl for t, so callers should check if one exists first.
 func (s *state) addTorrent(
-	namespace string, t storage.Torrent, localRequest bool) (*torrentControl, error) {
+	namespace string,
+	t storage.Torrent,
+	localRequest bool,
+	opts ...TorrentOption) (*torrentControl, error) {
+
+	if s.rechunking[t.Digest()] {
+		return nil, ErrTorrentRechunking
+	}
+
+	o := newTorrentOptions(s.sched.config, opts...)
+
+	var dopts []dispatch.Option
+	if o.pieceMask != nil {
+		dopts = append(dopts, dispatch.WithPriorityPieces(o.pieceMask))
+	}
+	if s.sched.config.LeechOnly {
+		dopts = append(dopts, dispatch.WithLeechOnly())
+	}
+	if s.sched.disk != nil {
+		dopts = append(dopts, dispatch.WithDiskMonitor(s.sched.disk))
+	}
+	if s.sched.memory != nil {
+		dopts = append(dopts, dispatch.WithMemoryBudget(s.sched.memory, o.priority))
+	}
+	dopts = append(dopts, dispatch.WithTracer(s.sched.tracer))
+
+	dconfig := s.sched.config.Dispatch
+	stats := s.sched.stats
+	if len(s.sched.config.Experiments) > 0 {
+		experiment := controlExperiment
+		if e := assignExperiment(s.sched.config.Experiments, t.InfoHash()); e != nil {
+			dconfig = e.applyDispatch(dconfig)
+			experiment = e.Name
+		}
+		stats = stats.Tagged(map[string]string{
+			"experiment": experiment,
+		})
+	}
+
+	stats = s.sched.metadataTags.tagged(stats, o.metadata)
+
+	logger := s.sched.torrentLogger(namespace, t.Digest(), t.InfoHash(), o.priority)
+	if len(o.metadata) > 0 {
+		logger = logger.With("metadata", o.metadata)
+	}
+
+	handle := s.sched.handles.Open(t.InfoHash(), "torrent_control")
+	dopts = append(dopts, dispatch.WithHandle(handle))
 
 	d, err := dispatch.New(
-		s.sched.config.Dispatch,
-		s.sched.stats,
+		dconfig,
+		stats,
 		s.sched.clock,
 		s.sched.netevents,
 		s.sched.eventLoop,
 		s.sched.pctx.PeerID,
 		t,
-		s.sched.logger,
-		s.sched.torrentlog)
+		logger,
+		s.sched.torrentlog,
+		// Each dispatcher has its own source, derived from the scheduler
+		// source, since dispatchers are accessed concurrently.
+		rand.New(rand.NewSource(s.sched.rand.Int63())),
+		dopts...)
 	if err != nil {
+		handle.Release()
 		return nil, fmt.Errorf("new dispatcher: %s", err)
 	}
+	dials, cancelDials := context.WithCancel(context.Background())
 	ctrl := &torrentControl{
 		namespace:    namespace,
 		dispatcher:   d,
 		localRequest: localRequest,
+		opts:         o,
+		stats:        stats,
+		logger:       logger,
+		handle:       handle,
+		dials:        dials,
+		cancelDials:  cancelDials,
+		ingress:      bandwidth.NewBucket(o.downloadRate, s.sched.clock),
+		origins:      make(map[string]bool),
+		dialed:       make(map[core.PeerID]*core.PeerInfo),
+		pinned:       s.sched.pins[t.Digest()],
+	}
+	if s.sched.config.ConnCapacity.Enable && !t.Complete() {
+		ctrl.capacity = conncapacity.New(
+			s.sched.config.ConnCapacity, s.sched.config.ConnState.MaxOpenConnectionsPerTorrent)
+		s.conns.SetTargetCapacity(t.InfoHash(), ctrl.capacity.Capacity())
+	}
+	if t.Complete() {
+		ctrl.seedingSince = s.sched.clock.Now()
+	} else {
+		s.sched.timelines.Start(namespace, t.Digest(), t.InfoHash())
+		d.AddStateChangeHook(s.sched.recordEndgame)
+	}
+	if !o.deadline.IsZero() && !t.Complete() {
+		s.setDeadlineTimer(ctrl, o.deadline, deadlineEvent{infoHash: t.InfoHash()})
+	}
+	if !t.Complete() {
+		s.setStarvationTimer(t.InfoHash(), ctrl, s.sched.config.Starvation.Window)
 	}
 	s.announceQueue.Add(t.InfoHash())
+	if !t.Complete() {
+		s.announceQueue.SetPriority(t.InfoHash(), announcequeue.PriorityLeecher)
+	}
 	s.sched.netevents.Produce(networkevent.AddTorrentEvent(
 		t.InfoHash(),
 		s.sched.pctx.PeerID,
@@ -100,20 +281,70 @@ func (s *state) addTorrent(
 // removeTorrent tears down the torrentControl associated with h, sending err to
 // all clients waiting on this torrent.
 func (s *state) removeTorrent(h core.InfoHash, err error) {
+	s.releaseTorrent(h, err, false)
+}
+
+// releaseTorrent tears down the torrentControl associated with h, sending err
+// to all clients waiting on this torrent. Unless keepData is set, the data of
+// incomplete torrents is deleted from disk. Torrents whose data is kept are torn
+// down even when complete, such that they stop seeding and may be
+// re-initialized from disk.
+func (s *state) releaseTorrent(h core.InfoHash, err error, keepData bool) {
 	ctrl, ok := s.torrentControls[h]
 	if !ok {
 		return
 	}
-	if !ctrl.dispatcher.Complete() {
+	complete := ctrl.seeding()
+	s.conns.SetExtraCapacity(h, 0)
+	s.conns.SetTargetCapacity(h, 0)
+	s.sampleBandwidth(ctrl)
+	s.rememberKnownPeers(h, ctrl)
+	ctrl.stopTimers()
+	ctrl.cancelDials()
+	if keepData || !complete {
 		ctrl.dispatcher.TearDown()
 		s.announceQueue.Eject(h)
+	}
+	if !complete {
 		for _, errc := range ctrl.errors {
 			errc <- err
 		}
+		s.notifyListeners(ctrl, err)
 		s.sched.netevents.Produce(networkevent.TorrentCancelledEvent(h, s.sched.pctx.PeerID))
-		s.sched.torrentArchive.DeleteTorrent(ctrl.dispatcher.Digest())
+		s.sched.timelines.Finish(h, timeline.Failed, errorString(err))
+		if !keepData && !ctrl.dispatcher.Evicted() {
+			// Torrents with evicted pieces still hold valuable data and may be
+			// completed again on demand.
+			s.sched.torrentArchive.DeleteTorrent(ctrl.dispatcher.Digest())
+		}
 	}
+	ctrl.handle.Release()
 	delete(s.torrentControls, h)
+	s.scheduleCleanupCheck(h)
+	s.admitTorrents()
+}
+
+// closeConns closes all active conns of the torrent of h.
+func (s *state) closeConns(h core.InfoHash) {
+	for _, c := range s.conns.ActiveConns() {
+		if c.InfoHash() == h {
+			c.Close()
+		}
+	}
+}
+
+// evictPieces evicts pieces of the torrent for d from disk. The torrent must
+// not have an active torrentControl.
+func (s *state) evictPieces(namespace string, d core.Digest, pieces []int) error {
+	t, err := s.sched.torrentArchive.GetTorrent(namespace, d)
+	if err != nil {
+		return fmt.Errorf("get torrent: %s", err)
+	}
+	e, ok := t.(storage.PieceEvictor)
+	if !ok {
+		return errors.New("torrent does not support piece eviction")
+	}
+	return e.EvictPieces(pieces)
 }
 
 // addOutgoingConn adds a conn, initialized by us, to state. The conn must already
@@ -122,14 +353,17 @@ func (s *state) addOutgoingConn(c *conn.Conn, b *bitset.BitSet, info *storage.To
 	if err := s.conns.MovePendingToActive(c); err != nil {
 		return fmt.Errorf("move pending to active: %s", err)
 	}
-	c.Start()
 	ctrl, ok := s.torrentControls[info.InfoHash()]
 	if !ok {
 		return errors.New("torrent controls must be created before sending handshake")
 	}
-	if err := ctrl.dispatcher.AddPeer(c.PeerID(), b, c); err != nil {
+	c.SetLogger(ctrl.logger)
+	c.SetIngressBucket(ctrl.ingress)
+	c.Start()
+	if err := s.addPeer(ctrl, c, b); err != nil {
 		return fmt.Errorf("add conn to dispatcher: %s", err)
 	}
+	s.sched.timelines.RecordOnce(info.InfoHash(), timeline.FirstPeer, c.PeerID().String())
 	return nil
 }
 
@@ -142,24 +376,61 @@ func (s *state) addIncomingConn(
 	if err := s.conns.MovePendingToActive(c); err != nil {
 		return fmt.Errorf("move pending to active: %s", err)
 	}
-	c.Start()
 	ctrl, ok := s.torrentControls[info.InfoHash()]
 	if !ok {
 		t, err := s.sched.torrentArchive.GetTorrent(namespace, info.Digest())
 		if err != nil {
 			return fmt.Errorf("get torrent: %s", err)
 		}
+		if t.InfoHash() != info.InfoHash() {
+			t, err = s.sched.getLegacyTorrent(info.Digest(), info.InfoHash())
+			if err != nil {
+				return fmt.Errorf("get legacy torrent: %s", err)
+			}
+		}
 		ctrl, err = s.addTorrent(namespace, t, false)
 		if err != nil {
 			return err
 		}
 	}
-	if err := ctrl.dispatcher.AddPeer(c.PeerID(), b, c); err != nil {
+	c.SetLogger(ctrl.logger)
+	c.SetIngressBucket(ctrl.ingress)
+	c.Start()
+	if err := s.addPeer(ctrl, c, b); err != nil {
 		return fmt.Errorf("add conn to dispatcher: %s", err)
 	}
+	s.sched.timelines.RecordOnce(info.InfoHash(), timeline.FirstPeer, c.PeerID().String())
+	return nil
+}
+
+// addPeer adds the started conn c to the dispatcher of ctrl, resuming the
+// interrupted session of the peer if c resumes it. Origins which were dialed at
+// the address handed out by the tracker are trusted to vouch for piece hashes.
+func (s *state) addPeer(ctrl *torrentControl, c *conn.Conn, b *bitset.BitSet) error {
+	var err error
+	if c.Resumed() {
+		s.sched.stats.Counter("sessions_resumed").Inc(1)
+		err = ctrl.dispatcher.ResumePeer(c.PeerID(), b, c)
+	} else {
+		err = ctrl.dispatcher.AddPeer(c.PeerID(), b, c)
+	}
+	if err != nil {
+		return err
+	}
+	if !c.OpenedByRemote() && ctrl.origins[c.PeerID().String()] {
+		ctrl.dispatcher.TrustPeer(c.PeerID())
+	}
 	return nil
 }
 
 func (s *state) log(args ...interface{}) *zap.SugaredLogger {
 	return s.sched.log(args...)
 }
+
+// errorString returns the message of err, or "" if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+// StatsVersion is the version of Stats. It is incremented whenever a field is
+// removed or changes meaning, such that scrapers may detect incompatible
+// snapshots. Adding fields does not change the version.
+const StatsVersion = 1
+
+// Stats is a consolidated snapshot of global scheduler state, suitable for
+// periodic scraping.
+type Stats struct {
+	Version int `json:"version"`
+
+	Torrents        int            `json:"torrents"`
+	TorrentsByState map[string]int `json:"torrents_by_state"`
+
+	PendingConns     int `json:"pending_conns"`
+	ActiveConns      int `json:"active_conns"`
+	BlacklistedConns int `json:"blacklisted_conns"`
+
+	// Total bytes sent and received over peer conns.
+	EgressBytes  int64 `json:"egress_bytes"`
+	IngressBytes int64 `json:"ingress_bytes"`
+
+	// DiskUsage is the fraction of disk used by the torrent archive, or -1 if
+	// the archive does not report disk usage.
+	DiskUsage float64 `json:"disk_usage"`
+
+	DNSCacheEntries int `json:"dns_cache_entries"`
+
+	// Storage handles which are open, and which were leaked by removed
+	// torrents.
+	OpenStorageHandles   int `json:"open_storage_handles"`
+	LeakedStorageHandles int `json:"leaked_storage_handles"`
+
+	// EventLoopDepth is the number of events waiting to be applied, excluding
+	// the snapshot event itself.
+	EventLoopDepth int `json:"event_loop_depth"`
+
+	// Bandwidth is the bandwidth used per namespace in recent windows, oldest
+	// first, and ending with the current window. Empty if bandwidth reporting
+	// is disabled.
+	Bandwidth []BandwidthWindow `json:"bandwidth,omitempty"`
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"time"
+
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+)
+
+// supportBundleSnapshot is the event loop state included in a support bundle.
+// It is captured by a single event, such that it is internally consistent.
+type supportBundleSnapshot struct {
+	Peer      core.PeerContext            `json:"peer"`
+	Seed      int64                       `json:"seed"`
+	Stats     *Stats                      `json:"stats"`
+	Torrents  []torrentSnapshot           `json:"torrents"`
+	Blacklist []connstate.BlacklistedConn `json:"blacklist"`
+}
+
+type torrentSnapshot struct {
+	InfoHash          string    `json:"info_hash"`
+	Digest            string    `json:"digest"`
+	Namespace         string    `json:"namespace"`
+	State             string    `json:"state"`
+	PercentDownloaded int       `json:"percent_downloaded"`
+	Peers             int       `json:"peers"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastReadTime      time.Time `json:"last_read_time"`
+	LastWriteTime     time.Time `json:"last_write_time"`
+}
+
+type supportBundleEvent struct {
+	result chan *supportBundleSnapshot
+}
+
+func (e supportBundleEvent) apply(s *state) {
+	stats := make(chan *Stats, 1)
+	statsSnapshotEvent{stats}.apply(s)
+
+	snapshot := &supportBundleSnapshot{
+		Peer:      s.sched.pctx,
+		Seed:      s.sched.seed,
+		Stats:     <-stats,
+		Blacklist: s.conns.BlacklistSnapshot(),
+	}
+	for h, ctrl := range s.torrentControls {
+		d := ctrl.dispatcher
+		snapshot.Torrents = append(snapshot.Torrents, torrentSnapshot{
+			InfoHash:          h.String(),
+			Digest:            d.Digest().String(),
+			Namespace:         ctrl.namespace,
+			State:             d.State().String(),
+			PercentDownloaded: d.Stat().PercentDownloaded(),
+			Peers:             len(d.RemoteBitfields()),
+			CreatedAt:         d.CreatedAt(),
+			LastReadTime:      d.LastReadTime(),
+			LastWriteTime:     d.LastWriteTime(),
+		})
+	}
+	e.result <- snapshot
+}
+
+// SupportBundle writes a gzipped tarball of diagnostics to w, which includes a
+// consistent snapshot of scheduler state, torrent timelines, configuration,
+// metrics and goroutine stacks.
+func (s *scheduler) SupportBundle(w io.Writer) error {
+	result := make(chan *supportBundleSnapshot, 1)
+	if !s.eventLoop.send(supportBundleEvent{result}) {
+		return ErrSchedulerStopped
+	}
+	var snapshot *supportBundleSnapshot
+	select {
+	case snapshot = <-result:
+	case <-s.done:
+		return ErrSchedulerStopped
+	}
+	if err := s.addGlobalStats(snapshot.Stats); err != nil {
+		return err
+	}
+
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"snapshot.json", func(w io.Writer) error { return encodeIndented(w, snapshot) }},
+		{"timelines.json", func(w io.Writer) error { return encodeIndented(w, s.timelines.Snapshot()) }},
+		{"config.json", func(w io.Writer) error { return encodeIndented(w, s.config) }},
+		{"metrics.json", s.writeMetrics},
+		{"goroutines.txt", func(w io.Writer) error { return pprof.Lookup("goroutine").WriteTo(w, 2) }},
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := s.clock.Now()
+	for _, f := range files {
+		var b bytes.Buffer
+		if err := f.write(&b); err != nil {
+			return fmt.Errorf("write %s: %s", f.name, err)
+		}
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    int64(b.Len()),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write %s header: %s", f.name, err)
+		}
+		if _, err := tw.Write(b.Bytes()); err != nil {
+			return fmt.Errorf("write %s: %s", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("close gzip: %s", err)
+	}
+	return nil
+}
+
+// writeMetrics writes the counters and gauges registered with the stats root
+// scope, if the scope supports snapshots. Counters are reported as deltas
+// since the last flush to the metrics backend.
+func (s *scheduler) writeMetrics(w io.Writer) error {
+	ts, ok := s.stats.(tally.TestScope)
+	if !ok {
+		return encodeIndented(w, map[string]string{"error": "stats scope does not support snapshots"})
+	}
+	snapshot := ts.Snapshot()
+	metrics := struct {
+		Counters map[string]int64   `json:"counters"`
+		Gauges   map[string]float64 `json:"gauges"`
+	}{make(map[string]int64), make(map[string]float64)}
+	for id, c := range snapshot.Counters() {
+		metrics.Counters[id] = c.Value()
+	}
+	for id, g := range snapshot.Gauges() {
+		metrics.Gauges[id] = g.Value()
+	}
+	return encodeIndented(w, metrics)
+}
+
+func encodeIndented(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func readSupportBundle(t *testing.T, r io.Reader) map[string][]byte {
+	gr, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = b
+	}
+	return files
+}
+
+func TestSchedulerSupportBundle(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	config := configFixture()
+
+	seeder := mocks.newPeer(config)
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.writeTorrent(namespace, blob)
+	require.NoError(seeder.scheduler.Download(context.Background(), namespace, blob.Digest))
+
+	var b bytes.Buffer
+	require.NoError(seeder.scheduler.SupportBundle(&b))
+
+	files := readSupportBundle(t, &b)
+	for _, name := range []string{
+		"snapshot.json", "timelines.json", "config.json", "metrics.json", "goroutines.txt",
+	} {
+		require.Contains(files, name)
+	}
+
+	var snapshot supportBundleSnapshot
+	require.NoError(json.Unmarshal(files["snapshot.json"], &snapshot))
+	require.Equal(seeder.pctx.PeerID, snapshot.Peer.PeerID)
+	require.Equal(1, snapshot.Stats.Torrents)
+	require.Len(snapshot.Torrents, 1)
+	require.Equal(blob.Digest.String(), snapshot.Torrents[0].Digest)
+	require.Equal(100, snapshot.Torrents[0].PercentDownloaded)
+
+	seeder.scheduler.stop()
+
+	require.Equal(ErrSchedulerStopped, seeder.scheduler.SupportBundle(&b))
+}
@@ -14,6 +14,7 @@
 package scheduler
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"net"
@@ -43,7 +44,7 @@ import (
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	mockmetainfoclient "github.com/uber/kraken/mocks/tracker/metainfoclient"
 	"github.com/uber/kraken/tracker/announceclient"
-	"github.com/uber/kraken/tracker/trackerserver"
+	"github.com/uber/kraken/tracker/trackertest"
 	"github.com/uber/kraken/utils/log"
 	"github.com/uber/kraken/utils/testutil"
 )
@@ -82,8 +83,10 @@ func configFixture() Config {
 }
 
 type testMocks struct {
+	t              gomock.TestReporter
 	ctrl           *gomock.Controller
 	metaInfoClient *mockmetainfoclient.MockClient
+	tracker        *trackertest.Tracker
 	trackerAddr    string
 	cleanup        *testutil.Cleanup
 }
@@ -94,12 +97,15 @@ func newTestMocks(t gomock.TestReporter) (*testMocks, func()) {
 	ctrl := gomock.NewController(t)
 	cleanup.Add(ctrl.Finish)
 
-	trackerAddr, stop := testutil.StartServer(trackerserver.Fixture().Handler())
+	tracker := trackertest.New(trackertest.Config{})
+	trackerAddr, stop := tracker.Start()
 	cleanup.Add(stop)
 
 	return &testMocks{
+		t:              t,
 		ctrl:           ctrl,
 		metaInfoClient: mockmetainfoclient.NewMockClient(ctrl),
+		tracker:        tracker,
 		trackerAddr:    trackerAddr,
 		cleanup:        &cleanup,
 	}, cleanup.Run
@@ -142,11 +148,31 @@ func (m *testMocks) newPeer(config Config, options ...option) *testPeer {
 	if err := s.start(announcequeue.New()); err != nil {
 		panic(err)
 	}
-	cleanup.Add(s.Stop)
+	cleanup.Add(func() {
+		s.stop()
+		m.requireNoLeakedHandles(s)
+	})
 
 	return &testPeer{pctx, s, ta, stats, tp, cads, &cleanup}
 }
 
+// requireNoLeakedHandles fails the test if any storage handle released by s
+// remains open shortly after s stops.
+func (m *testMocks) requireNoLeakedHandles(s *scheduler) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leaks := s.handles.Released()
+		if len(leaks) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			m.t.Errorf("Leaked storage handles: %v", leaks)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (m *testMocks) newPeers(n int, config Config) []*testPeer {
 	var peers []*testPeer
 	for i := 0; i < n; i++ {
@@ -158,7 +184,7 @@ func (m *testMocks) newPeers(n int, config Config) []*testPeer {
 // writeTorrent writes the given content into a torrent file into peers storage.
 // Useful for populating a completed torrent before seeding it.
 func (p *testPeer) writeTorrent(namespace string, blob *core.BlobFixture) {
-	t, err := p.torrentArchive.CreateTorrent(namespace, blob.Digest)
+	t, err := p.torrentArchive.CreateTorrent(context.Background(), namespace, blob.Digest)
 	if err != nil {
 		panic(err)
 	}
@@ -216,6 +242,8 @@ type hasConnEvent struct {
 	result   chan bool
 }
 
+func (e hasConnEvent) describe() eventFields { return nil }
+
 func (e hasConnEvent) apply(s *state) {
 	found := false
 	conns := s.conns.ActiveConns()
@@ -271,6 +299,8 @@ type hasTorrentEvent struct {
 	result   chan bool
 }
 
+func (e hasTorrentEvent) describe() eventFields { return nil }
+
 func (e hasTorrentEvent) apply(s *state) {
 	_, ok := s.torrentControls[e.infoHash]
 	e.result <- ok
@@ -311,7 +341,7 @@ type eventWatcher struct {
 
 func newEventWatcher() *eventWatcher {
 	return &eventWatcher{
-		l:      newEventLoop(),
+		l:      newEventLoop(EventLoopConfig{}, tally.NoopScope),
 		events: make(chan event),
 	}
 }
@@ -351,3 +381,7 @@ func (w *eventWatcher) run(s *state) {
 func (w *eventWatcher) stop() {
 	w.l.stop()
 }
+
+func (w *eventWatcher) depth() int {
+	return w.l.depth()
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sync"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// TieringConfig defines background migration of complete torrents between the
+// hot and cold tier of the torrent archive. Idle seeders are demoted to the
+// cold tier once removed, and promoted back to the hot tier when requested
+// again. Torrents remain readable from either tier while migrations are
+// pending, so promotion is transparent to peers and clients.
+type TieringConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Movers is the number of migrations which may run concurrently.
+	Movers int `yaml:"movers"`
+
+	// QueueSize is the maximum number of pending migrations. Migrations are
+	// dropped once the queue is full.
+	QueueSize int `yaml:"queue_size"`
+}
+
+func (c TieringConfig) applyDefaults() TieringConfig {
+	if c.Movers == 0 {
+		c.Movers = 1
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 1000
+	}
+	return c
+}
+
+// tierMover migrates torrents between tiers in the background. Each digest has
+// at most one pending migration, and the most recently requested direction
+// wins, such that a torrent which is demoted and then accessed again before
+// the demotion ran is simply left in the hot tier.
+type tierMover struct {
+	config TieringConfig
+	tierer storage.Tierer
+	stats  tally.Scope
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending map[core.Digest]bool // Maps to true for promotions.
+	queue   chan core.Digest
+
+	wg sync.WaitGroup
+}
+
+func newTierMover(
+	config TieringConfig,
+	tierer storage.Tierer,
+	stats tally.Scope,
+	logger *zap.SugaredLogger) *tierMover {
+
+	return &tierMover{
+		config:  config,
+		tierer:  tierer,
+		stats:   stats,
+		logger:  logger,
+		pending: make(map[core.Digest]bool),
+		queue:   make(chan core.Digest, config.QueueSize),
+	}
+}
+
+func (m *tierMover) start(done <-chan struct{}) {
+	for i := 0; i < m.config.Movers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for {
+				select {
+				case d := <-m.queue:
+					m.move(d)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// wait blocks until all movers have exited.
+func (m *tierMover) wait() {
+	m.wg.Wait()
+}
+
+// promote schedules d to be moved to the hot tier.
+func (m *tierMover) promote(d core.Digest) {
+	m.enqueue(d, true)
+}
+
+// demote schedules d to be moved to the cold tier.
+func (m *tierMover) demote(d core.Digest) {
+	m.enqueue(d, false)
+}
+
+func (m *tierMover) enqueue(d core.Digest, promote bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pending[d]; ok {
+		m.pending[d] = promote
+		return
+	}
+	select {
+	case m.queue <- d:
+		m.pending[d] = promote
+	default:
+		m.stats.Counter("tier_migrations_dropped").Inc(1)
+	}
+}
+
+func (m *tierMover) move(d core.Digest) {
+	m.mu.Lock()
+	promote := m.pending[d]
+	delete(m.pending, d)
+	m.mu.Unlock()
+
+	var err error
+	if promote {
+		err = m.tierer.Promote(d)
+	} else {
+		err = m.tierer.Demote(d)
+	}
+	if err != nil {
+		m.stats.Counter("tier_migration_errors").Inc(1)
+		m.logger.With("digest", d, "promote", promote).Errorf("Error migrating torrent: %s", err)
+	}
+}
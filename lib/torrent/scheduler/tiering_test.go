@@ -0,0 +1,97 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+type migration struct {
+	d       core.Digest
+	promote bool
+}
+
+type fakeTierer struct {
+	sync.Mutex
+	migrations []migration
+}
+
+func (t *fakeTierer) Promote(d core.Digest) error {
+	t.Lock()
+	defer t.Unlock()
+	t.migrations = append(t.migrations, migration{d, true})
+	return nil
+}
+
+func (t *fakeTierer) Demote(d core.Digest) error {
+	t.Lock()
+	defer t.Unlock()
+	t.migrations = append(t.migrations, migration{d, false})
+	return nil
+}
+
+func (t *fakeTierer) snapshot() []migration {
+	t.Lock()
+	defer t.Unlock()
+	return append([]migration(nil), t.migrations...)
+}
+
+func TestTierMoverLatestMigrationWins(t *testing.T) {
+	require := require.New(t)
+
+	tierer := &fakeTierer{}
+	m := newTierMover(TieringConfig{}.applyDefaults(), tierer, tally.NoopScope, log.Default())
+
+	d1 := core.DigestFixture()
+	d2 := core.DigestFixture()
+
+	m.demote(d1)
+	m.demote(d2)
+	m.promote(d1)
+
+	done := make(chan struct{})
+	m.start(done)
+	defer func() {
+		close(done)
+		m.wait()
+	}()
+
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		return len(tierer.snapshot()) == 2
+	}))
+
+	require.Equal([]migration{{d1, true}, {d2, false}}, tierer.snapshot())
+}
+
+func TestTierMoverDropsMigrationsWhenQueueFull(t *testing.T) {
+	require := require.New(t)
+
+	tierer := &fakeTierer{}
+	config := TieringConfig{QueueSize: 1}.applyDefaults()
+	m := newTierMover(config, tierer, tally.NoopScope, log.Default())
+
+	m.demote(core.DigestFixture())
+	m.demote(core.DigestFixture())
+
+	require.Len(m.pending, 1)
+}
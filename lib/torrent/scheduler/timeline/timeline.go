@@ -0,0 +1,193 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package timeline
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+)
+
+// Event kinds.
+const (
+	Added     = "added"
+	FirstPeer = "first_peer"
+	Progress  = "progress"
+	Endgame   = "endgame"
+	Stalled   = "stalled"
+	Escalated = "escalated"
+	Completed = "completed"
+	Failed    = "failed"
+)
+
+// Config defines Store configuration.
+type Config struct {
+	// Size is the number of finished torrent timelines retained.
+	Size int `yaml:"size"`
+
+	// MaxEvents limits the number of events retained per timeline. Once
+	// reached, the oldest events after the initial Added event are dropped.
+	MaxEvents int `yaml:"max_events"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.Size == 0 {
+		c.Size = 100
+	}
+	if c.MaxEvents == 0 {
+		c.MaxEvents = 32
+	}
+	return c
+}
+
+// Event is a significant event in the lifetime of a torrent download.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Timeline is the sequence of events of a single torrent download.
+type Timeline struct {
+	Namespace string        `json:"namespace"`
+	Digest    core.Digest   `json:"digest"`
+	InfoHash  core.InfoHash `json:"info_hash"`
+	Events    []Event       `json:"events"`
+	Finished  bool          `json:"finished"`
+}
+
+func (t *Timeline) copy() Timeline {
+	c := *t
+	c.Events = append([]Event(nil), t.Events...)
+	return c
+}
+
+// Store records timelines of in-progress torrent downloads and retains the
+// timelines of the last Size finished downloads. Store is thread-safe.
+type Store struct {
+	config Config
+	clk    clock.Clock
+
+	mu       sync.Mutex
+	active   map[core.InfoHash]*Timeline
+	finished []*Timeline // Ordered from oldest to newest.
+}
+
+// NewStore creates a new Store.
+func NewStore(config Config, clk clock.Clock) *Store {
+	return &Store{
+		config: config.applyDefaults(),
+		clk:    clk,
+		active: make(map[core.InfoHash]*Timeline),
+	}
+}
+
+// Start begins a new timeline for h, replacing any in-progress timeline for h.
+func (s *Store) Start(namespace string, d core.Digest, h core.InfoHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active[h] = &Timeline{
+		Namespace: namespace,
+		Digest:    d,
+		InfoHash:  h,
+		Events:    []Event{{Time: s.clk.Now(), Kind: Added}},
+	}
+}
+
+// Record appends an event to the in-progress timeline of h. Consecutive
+// identical events are collapsed into the first. No-op if h has no
+// in-progress timeline.
+func (s *Store) Record(h core.InfoHash, kind, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.active[h]
+	if !ok {
+		return
+	}
+	last := t.Events[len(t.Events)-1]
+	if last.Kind == kind && last.Detail == detail {
+		return
+	}
+	s.append(t, kind, detail)
+}
+
+// RecordOnce appends an event to the in-progress timeline of h unless an event
+// of the same kind was already recorded.
+func (s *Store) RecordOnce(h core.InfoHash, kind, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.active[h]
+	if !ok {
+		return
+	}
+	for _, e := range t.Events {
+		if e.Kind == kind {
+			return
+		}
+	}
+	s.append(t, kind, detail)
+}
+
+// Finish appends a final event to the in-progress timeline of h and retains
+// it as a finished timeline, evicting the oldest finished timeline if
+// necessary.
+func (s *Store) Finish(h core.InfoHash, kind, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.active[h]
+	if !ok {
+		return
+	}
+	delete(s.active, h)
+	s.append(t, kind, detail)
+	t.Finished = true
+	s.finished = append(s.finished, t)
+	if len(s.finished) > s.config.Size {
+		s.finished[0] = nil
+		s.finished = s.finished[1:]
+	}
+}
+
+// Snapshot returns copies of all in-progress and finished timelines, with the
+// most recently finished timelines last.
+func (s *Store) Snapshot() []Timeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Timeline, 0, len(s.active)+len(s.finished))
+	for _, t := range s.active {
+		result = append(result, t.copy())
+	}
+	for _, t := range s.finished {
+		result = append(result, t.copy())
+	}
+	return result
+}
+
+// append must be called with s.mu held.
+func (s *Store) append(t *Timeline, kind, detail string) {
+	if len(t.Events) >= s.config.MaxEvents && len(t.Events) > 1 {
+		// Always keep the initial Added event such that the total duration of
+		// the download is visible.
+		t.Events = append(t.Events[:1], t.Events[2:]...)
+	}
+	t.Events = append(t.Events, Event{Time: s.clk.Now(), Kind: kind, Detail: detail})
+}
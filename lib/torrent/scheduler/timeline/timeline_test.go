@@ -0,0 +1,105 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package timeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func kinds(t Timeline) []string {
+	var result []string
+	for _, e := range t.Events {
+		result = append(result, e.Kind)
+	}
+	return result
+}
+
+func TestStoreRecordsTimeline(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	s := NewStore(Config{}, clk)
+
+	d := core.DigestFixture()
+	h := core.InfoHashFixture()
+
+	s.Start("some/namespace", d, h)
+	clk.Add(time.Second)
+	s.RecordOnce(h, FirstPeer, "a")
+	s.RecordOnce(h, FirstPeer, "b")
+	s.Record(h, Progress, "25%")
+	s.Record(h, Stalled, "x")
+	s.Record(h, Stalled, "x")
+	s.Finish(h, Completed, "")
+
+	// Events for unknown torrents are ignored.
+	s.Record(core.InfoHashFixture(), Progress, "50%")
+
+	timelines := s.Snapshot()
+	require.Len(timelines, 1)
+	require.Equal(d, timelines[0].Digest)
+	require.True(timelines[0].Finished)
+	require.Equal(
+		[]string{Added, FirstPeer, Progress, Stalled, Completed}, kinds(timelines[0]))
+	require.Equal("a", timelines[0].Events[1].Detail)
+	require.Equal(clk.Now(), timelines[0].Events[1].Time)
+}
+
+func TestStoreEvictsOldestFinishedTimelines(t *testing.T) {
+	require := require.New(t)
+
+	s := NewStore(Config{Size: 2}, clock.NewMock())
+
+	var hashes []core.InfoHash
+	for i := 0; i < 3; i++ {
+		h := core.InfoHashFixture()
+		hashes = append(hashes, h)
+		s.Start("", core.DigestFixture(), h)
+		s.Finish(h, Failed, "some error")
+	}
+	active := core.InfoHashFixture()
+	s.Start("", core.DigestFixture(), active)
+
+	var result []core.InfoHash
+	for _, t := range s.Snapshot() {
+		result = append(result, t.InfoHash)
+	}
+	require.Equal([]core.InfoHash{active, hashes[1], hashes[2]}, result)
+}
+
+func TestStoreLimitsEventsPerTimeline(t *testing.T) {
+	require := require.New(t)
+
+	s := NewStore(Config{MaxEvents: 3}, clock.NewMock())
+
+	h := core.InfoHashFixture()
+	s.Start("", core.DigestFixture(), h)
+	s.Record(h, Progress, "25%")
+	s.Record(h, Progress, "50%")
+	s.Record(h, Progress, "75%")
+
+	timelines := s.Snapshot()
+	require.Len(timelines, 1)
+	events := timelines[0].Events
+	require.Len(events, 3)
+	require.Equal(Added, events[0].Kind)
+	require.Equal("50%", events[1].Detail)
+	require.Equal("75%", events[2].Detail)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/uber/kraken/core"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxTorrentLogLevels bounds the number of torrents with log level overrides,
+// such that forgotten overrides cannot accumulate indefinitely.
+const maxTorrentLogLevels = 64
+
+// ErrTooManyTorrentLogLevels is returned when setting a torrent log level
+// override while maxTorrentLogLevels overrides are already set.
+var ErrTooManyTorrentLogLevels = errors.New("too many torrent log level overrides")
+
+// torrentLogLevels maps torrent digests to log level overrides. Overrides are
+// keyed by digest rather than info hash, such that they may be set before the
+// torrent is added.
+type torrentLogLevels struct {
+	mu     sync.RWMutex
+	levels map[core.Digest]zapcore.Level
+
+	// size mirrors len(levels), such that loggers may skip locking when no
+	// overrides are set.
+	size *atomic.Int32
+}
+
+func newTorrentLogLevels() *torrentLogLevels {
+	return &torrentLogLevels{
+		levels: make(map[core.Digest]zapcore.Level),
+		size:   atomic.NewInt32(0),
+	}
+}
+
+func (l *torrentLogLevels) set(d core.Digest, level zapcore.Level) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.levels[d]; !ok && len(l.levels) >= maxTorrentLogLevels {
+		return ErrTooManyTorrentLogLevels
+	}
+	l.levels[d] = level
+	l.size.Store(int32(len(l.levels)))
+	return nil
+}
+
+func (l *torrentLogLevels) clear(d core.Digest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.levels, d)
+	l.size.Store(int32(len(l.levels)))
+}
+
+func (l *torrentLogLevels) get(d core.Digest) (zapcore.Level, bool) {
+	if l.size.Load() == 0 {
+		return 0, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	level, ok := l.levels[d]
+	return level, ok
+}
+
+// torrentLevelCore wraps a zapcore.Core such that the log level override of
+// a torrent, if any, takes precedence over the level of the wrapped core.
+type torrentLevelCore struct {
+	zapcore.Core
+	levels *torrentLogLevels
+	digest core.Digest
+}
+
+func (c *torrentLevelCore) Enabled(level zapcore.Level) bool {
+	if l, ok := c.levels.get(c.digest); ok {
+		return l.Enabled(level)
+	}
+	return c.Core.Enabled(level)
+}
+
+func (c *torrentLevelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &torrentLevelCore{c.Core.With(fields), c.levels, c.digest}
+}
+
+func (c *torrentLevelCore) Check(
+	e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+
+	if l, ok := c.levels.get(c.digest); ok {
+		if !l.Enabled(e.Level) {
+			return ce
+		}
+		// Bypass the level of the wrapped core, which may be less verbose
+		// than the override.
+		return ce.AddCore(e, c.Core)
+	}
+	return c.Core.Check(e, ce)
+}
+
+// torrentLogger returns a logger which attaches the context of a torrent to
+// all log lines, and which respects log level overrides of the torrent.
+func (s *scheduler) torrentLogger(
+	namespace string, d core.Digest, h core.InfoHash, priority int) *zap.SugaredLogger {
+
+	wrap := zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &torrentLevelCore{c, s.logLevels, d}
+	})
+	return s.logger.Desugar().WithOptions(wrap).Sugar().With(
+		"torrent_hash", shortHash(h),
+		"namespace", namespace,
+		"priority", priority)
+}
+
+// shortHash returns a prefix of h which is sufficient to tell torrents apart
+// in logs.
+func shortHash(h core.InfoHash) string {
+	s := h.Hex()
+	if len(s) > 12 {
+		return s[:12]
+	}
+	return s
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func schedulerWithObservedLogs(level zapcore.Level) (*scheduler, *observer.ObservedLogs) {
+	obs, logs := observer.New(level)
+	return &scheduler{logger: zap.New(obs).Sugar(), logLevels: newTorrentLogLevels()}, logs
+}
+
+func TestTorrentLoggerAttachesTorrentContext(t *testing.T) {
+	require := require.New(t)
+
+	s, logs := schedulerWithObservedLogs(zapcore.InfoLevel)
+
+	h := core.InfoHashFixture()
+	s.torrentLogger("some/namespace", core.DigestFixture(), h, 3).Info("hello")
+
+	entries := logs.AllUntimed()
+	require.Len(entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(h.Hex()[:12], fields["torrent_hash"])
+	require.Equal("some/namespace", fields["namespace"])
+	require.Equal(int64(3), fields["priority"])
+}
+
+func TestTorrentLoggerLevelOverrides(t *testing.T) {
+	require := require.New(t)
+
+	s, logs := schedulerWithObservedLogs(zapcore.InfoLevel)
+
+	d := core.DigestFixture()
+	logger := s.torrentLogger("", d, core.InfoHashFixture(), 0)
+	other := s.torrentLogger("", core.DigestFixture(), core.InfoHashFixture(), 0)
+
+	logger.Debug("dropped")
+	require.Equal(0, logs.Len())
+
+	// Overrides may lower the level of a single torrent...
+	require.NoError(s.logLevels.set(d, zapcore.DebugLevel))
+	logger.With("peer", "x").Debug("kept")
+	other.Debug("dropped")
+	require.Equal(1, logs.FilterMessage("kept").Len())
+	require.Equal(1, logs.Len())
+
+	// ...or raise it.
+	require.NoError(s.logLevels.set(d, zapcore.ErrorLevel))
+	logger.Info("dropped")
+	other.Info("kept")
+	require.Equal(2, logs.FilterMessage("kept").Len())
+	require.Equal(2, logs.Len())
+
+	s.logLevels.clear(d)
+	logger.Info("kept")
+	require.Equal(3, logs.FilterMessage("kept").Len())
+}
+
+func TestTorrentLogLevelsBounded(t *testing.T) {
+	require := require.New(t)
+
+	levels := newTorrentLogLevels()
+	for i := 0; i < maxTorrentLogLevels; i++ {
+		require.NoError(levels.set(core.DigestFixture(), zapcore.DebugLevel))
+	}
+	d := core.DigestFixture()
+	require.Equal(ErrTooManyTorrentLogLevels, levels.set(d, zapcore.DebugLevel))
+	_, ok := levels.get(d)
+	require.False(ok)
+}
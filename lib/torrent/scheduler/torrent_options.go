@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/fallback"
+	"github.com/willf/bitset"
+)
+
+// torrentOptions defines optional per-torrent parameters, which override the
+// scheduler-wide defaults for a single torrent.
+type torrentOptions struct {
+	namespace        string
+	priority         int
+	pieceMask        *bitset.BitSet
+	seederTTI        time.Duration
+	leecherTTI       time.Duration
+	preemptionExempt bool
+	caller           string
+	callbackURL      string
+	deadline         time.Time
+	requestDeadline  time.Time
+	fallback         fallback.Reader
+	downloadRate     int64
+	metadata         map[string]string
+	seeding          SeedingPolicy
+}
+
+// TorrentOption allows setting optional parameters when adding a torrent.
+// Options only take effect when the torrent is first added -- requests for a
+// torrent which is already active share the options of the original request.
+type TorrentOption func(*torrentOptions)
+
+// WithNamespace sets the namespace the torrent is downloaded from.
+func WithNamespace(namespace string) TorrentOption {
+	return func(o *torrentOptions) { o.namespace = namespace }
+}
+
+// WithPriority sets the priority of the torrent. When disk usage is high,
+// pieces of lower priority torrents are evicted first. Defaults to 0.
+func WithPriority(priority int) TorrentOption {
+	return func(o *torrentOptions) { o.priority = priority }
+}
+
+// WithPieceMask sets the pieces of the torrent which are requested before any
+// others, e.g. the pieces a caller needs to start reading the blob.
+func WithPieceMask(mask *bitset.BitSet) TorrentOption {
+	return func(o *torrentOptions) { o.pieceMask = mask }
+}
+
+// WithSeederTTI overrides Config.SeederTTI for the torrent.
+func WithSeederTTI(tti time.Duration) TorrentOption {
+	return func(o *torrentOptions) { o.seederTTI = tti }
+}
+
+// WithLeecherTTI overrides Config.LeecherTTI for the torrent.
+func WithLeecherTTI(tti time.Duration) TorrentOption {
+	return func(o *torrentOptions) { o.leecherTTI = tti }
+}
+
+// WithPreemptionExempt exempts the torrent from being removed when idle. The
+// torrent may still be removed via RemoveTorrent.
+func WithPreemptionExempt() TorrentOption {
+	return func(o *torrentOptions) { o.preemptionExempt = true }
+}
+
+// WithCaller identifies the caller requesting the torrent, for logging.
+func WithCaller(caller string) TorrentOption {
+	return func(o *torrentOptions) { o.caller = caller }
+}
+
+// WithCompletionCallback durably registers url to be POSTed a
+// completion.Notification once the torrent lands. Delivery is at-least-once
+// and survives restarts, for callers which cannot wait for the download to
+// finish. Requires Config.Completion.JournalPath.
+func WithCompletionCallback(url string) TorrentOption {
+	return func(o *torrentOptions) { o.callbackURL = url }
+}
+
+// WithDeadline sets the time by which the torrent must complete. As the
+// deadline approaches, the torrent is escalated per Config.Deadline, and if it
+// is not complete by the deadline, it is removed with a *DeadlineError.
+//
+// Unlike other options, WithDeadline also applies to requests for a torrent
+// which is already in progress. Such requests fail with a *DeadlineError on
+// their own deadline, while the torrent keeps downloading for any other
+// requests waiting on it.
+func WithDeadline(deadline time.Time) TorrentOption {
+	return func(o *torrentOptions) { o.deadline = deadline }
+}
+
+// withRequestDeadline fails the request with a *DeadlineError at deadline,
+// without escalating the torrent. Set from the context of the request.
+func withRequestDeadline(deadline time.Time) TorrentOption {
+	return func(o *torrentOptions) { o.requestDeadline = deadline }
+}
+
+// WithFallback sets the reader missing pieces are fetched from, bypassing the
+// swarm, when the torrent is escalated for being at risk of missing the
+// deadline set via WithDeadline.
+func WithFallback(r fallback.Reader) TorrentOption {
+	return func(o *torrentOptions) { o.fallback = r }
+}
+
+// WithDownloadRateLimit caps the rate at which piece payloads of the torrent
+// are downloaded to bytesPerSec, independently of other torrents. The limit may
+// be adjusted via SetTorrentRateLimit while the torrent is in progress.
+func WithDownloadRateLimit(bytesPerSec int64) TorrentOption {
+	return func(o *torrentOptions) { o.downloadRate = bytesPerSec }
+}
+
+// WithMetadata attaches opaque key/value metadata to the torrent, e.g. the
+// image name or deploy id the blob belongs to. Metadata is included in torrent
+// logs, progress and completion callbacks, and keys listed in
+// Config.Metadata.TagKeys are added as tags to per-torrent metrics. Multiple
+// WithMetadata options are merged.
+func WithMetadata(md map[string]string) TorrentOption {
+	return func(o *torrentOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string, len(md))
+		}
+		for k, v := range md {
+			o.metadata[k] = v
+		}
+	}
+}
+
+func newTorrentOptions(config Config, opts ...TorrentOption) torrentOptions {
+	o := torrentOptions{
+		seederTTI:  config.SeederTTI,
+		leecherTTI: config.LeecherTTI,
+		seeding:    config.Seeding.SeedingPolicy,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Errors returned by StartTrace and StopTrace.
+var (
+	ErrTracingDisabled = errors.New("tracing disabled: trace dir not configured")
+	ErrTooManyTraces   = errors.New("too many traces")
+	ErrTraceNotFound   = errors.New("trace not found")
+)
+
+// TraceConfig defines the verbose tracing of individual torrents, which writes
+// all events, messages and storage operations of a torrent to a dedicated file.
+type TraceConfig struct {
+	// Dir is the directory trace files are written to. Tracing is disabled if
+	// unset.
+	Dir string `yaml:"dir"`
+
+	// MaxDuration bounds the duration of a trace, such that forgotten traces
+	// cannot fill the disk.
+	MaxDuration time.Duration `yaml:"max_duration"`
+
+	// MaxTraces bounds the number of torrents traced at once.
+	MaxTraces int `yaml:"max_traces"`
+}
+
+func (c TraceConfig) applyDefaults() TraceConfig {
+	if c.MaxDuration == 0 {
+		c.MaxDuration = time.Hour
+	}
+	if c.MaxTraces == 0 {
+		c.MaxTraces = 4
+	}
+	return c
+}
+
+// torrentTrace is an active trace of a single torrent.
+type torrentTrace struct {
+	path   string
+	file   *os.File
+	logger *zap.SugaredLogger
+	timer  *clock.Timer
+}
+
+func (t *torrentTrace) close() {
+	t.timer.Stop()
+	t.logger.Info("Trace stopped")
+	t.logger.Sync()
+	t.file.Close()
+}
+
+// torrentTracer maps info hashes to active traces. torrentTracer is
+// thread-safe, since traces are written from both the event loop and
+// dispatchers, and are administered outside of the event loop.
+type torrentTracer struct {
+	config TraceConfig
+	clk    clock.Clock
+
+	mu     sync.RWMutex
+	traces map[core.InfoHash]*torrentTrace
+
+	// size mirrors len(traces), such that untraced torrents may skip locking.
+	size *atomic.Int32
+}
+
+func newTorrentTracer(config TraceConfig, clk clock.Clock) *torrentTracer {
+	return &torrentTracer{
+		config: config.applyDefaults(),
+		clk:    clk,
+		traces: make(map[core.InfoHash]*torrentTrace),
+		size:   atomic.NewInt32(0),
+	}
+}
+
+// start traces h for duration d, capped to the max duration, and returns the
+// path of the trace file. Starting an active trace extends it.
+func (t *torrentTracer) start(h core.InfoHash, d time.Duration) (string, error) {
+	if t.config.Dir == "" {
+		return "", ErrTracingDisabled
+	}
+	if d <= 0 || d > t.config.MaxDuration {
+		d = t.config.MaxDuration
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tr, ok := t.traces[h]; ok {
+		tr.timer.Reset(d)
+		tr.logger.Infow("Trace extended", "duration", d)
+		return tr.path, nil
+	}
+	if len(t.traces) >= t.config.MaxTraces {
+		return "", ErrTooManyTraces
+	}
+	if err := os.MkdirAll(t.config.Dir, 0755); err != nil {
+		return "", fmt.Errorf("mkdir: %s", err)
+	}
+	path := filepath.Join(
+		t.config.Dir, fmt.Sprintf("%s.%d.trace", h.Hex(), t.clk.Now().Unix()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", fmt.Errorf("open trace file: %s", err)
+	}
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	logger := zap.New(zapcore.NewCore(enc, zapcore.AddSync(f), zapcore.DebugLevel)).Sugar().With("hash", h.Hex())
+	logger.Infow("Trace started", "duration", d)
+
+	t.traces[h] = &torrentTrace{
+		path:   path,
+		file:   f,
+		logger: logger,
+		timer:  t.clk.AfterFunc(d, func() { t.stop(h) }),
+	}
+	t.size.Store(int32(len(t.traces)))
+	return path, nil
+}
+
+// stop stops the trace of h.
+func (t *torrentTracer) stop(h core.InfoHash) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.traces[h]
+	if !ok {
+		return ErrTraceNotFound
+	}
+	tr.close()
+	delete(t.traces, h)
+	t.size.Store(int32(len(t.traces)))
+	return nil
+}
+
+// Trace returns the logger which h is traced to, or nil if h is not being
+// traced. Implements dispatch.Tracer.
+func (t *torrentTracer) Trace(h core.InfoHash) *zap.SugaredLogger {
+	if t.size.Load() == 0 {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if tr, ok := t.traces[h]; ok {
+		return tr.logger
+	}
+	return nil
+}
+
+// StartTrace writes all events, messages and storage operations of the torrent
+// of h to a dedicated file for duration d, and returns the path of the file.
+// The torrent need not be added yet.
+func (s *scheduler) StartTrace(h core.InfoHash, d time.Duration) (string, error) {
+	return s.tracer.start(h, d)
+}
+
+// StopTrace stops the trace of the torrent of h before its duration elapses.
+func (s *scheduler) StopTrace(h core.InfoHash) error {
+	return s.tracer.stop(h)
+}
+
+// traceEvent traces e to the trace of the torrent e applies to, if any.
+func (s *state) traceEvent(e event, name string, elapsed time.Duration) {
+	if s.sched.tracer.size.Load() == 0 {
+		return
+	}
+	fields := e.describe()
+	h, err := core.NewInfoHashFromHex(fields["hash"])
+	if err != nil {
+		return
+	}
+	if t := s.sched.tracer.Trace(h); t != nil {
+		t.Debugw("Event applied", "event", name, "fields", fields, "latency", elapsed)
+	}
+}
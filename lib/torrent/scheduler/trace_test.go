@@ -0,0 +1,101 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTorrentTracer(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trace")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	clk := clock.NewMock()
+	tracer := newTorrentTracer(TraceConfig{Dir: dir, MaxDuration: time.Hour, MaxTraces: 1}, clk)
+
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+
+	path, err := tracer.start(h1, 10*time.Minute)
+	require.NoError(err)
+	require.NotNil(tracer.Trace(h1))
+	require.Nil(tracer.Trace(h2))
+
+	_, err = tracer.start(h2, time.Minute)
+	require.Equal(ErrTooManyTraces, err)
+
+	// Starting an active trace extends it.
+	clk.Add(5 * time.Minute)
+	extended, err := tracer.start(h1, 10*time.Minute)
+	require.NoError(err)
+	require.Equal(path, extended)
+
+	clk.Add(9 * time.Minute)
+	require.NotNil(tracer.Trace(h1))
+
+	clk.Add(2 * time.Minute)
+	require.Nil(tracer.Trace(h1))
+	require.Equal(ErrTraceNotFound, tracer.stop(h1))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Contains(string(b), "Trace started")
+	require.Contains(string(b), "Trace extended")
+	require.Contains(string(b), "Trace stopped")
+}
+
+func TestTorrentTracerDisabledWithoutDir(t *testing.T) {
+	tracer := newTorrentTracer(TraceConfig{}, clock.NewMock())
+
+	_, err := tracer.start(core.InfoHashFixture(), time.Minute)
+	require.Equal(t, ErrTracingDisabled, err)
+}
+
+func TestApplyEventTracesEventsOfTracedTorrents(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trace")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{Trace: TraceConfig{Dir: dir}})
+
+	h := core.InfoHashFixture()
+	path, err := state.sched.StartTrace(h, time.Minute)
+	require.NoError(err)
+
+	state.applyEvent(pauseTorrentEvent{h, make(chan error, 1)})
+	state.applyEvent(pauseTorrentEvent{core.InfoHashFixture(), make(chan error, 1)})
+	require.NoError(state.sched.StopTrace(h))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Contains(string(b), "pauseTorrentEvent")
+	require.Equal(1, strings.Count(string(b), "Event applied"))
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+)
+
+// UtilityPreemptionConfig defines the preemption of the least useful conns of
+// torrents at conn capacity. Without it, conns of saturated torrents are only
+// closed once idle or expired, which keeps slow peers connected while faster
+// peers with rarer pieces cannot connect.
+type UtilityPreemptionConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// MinConnAge is the duration a conn is exempt from preemption after being
+	// established, so its utility may be measured.
+	MinConnAge time.Duration `yaml:"min_conn_age"`
+
+	// Weights of the utility components. Zero weights default to 1.
+	//
+	// Goodput is the rate of pieces recently exchanged with the peer,
+	// relative to the other peers of the torrent.
+	GoodputWeight float64 `yaml:"goodput_weight"`
+	// Rarity is the rarity of the needed pieces the peer has, relative to
+	// the other peers of the torrent.
+	RarityWeight float64 `yaml:"rarity_weight"`
+	// Reciprocation is the balance between pieces received from and sent to
+	// the peer.
+	ReciprocationWeight float64 `yaml:"reciprocation_weight"`
+
+	// Threshold is the fraction of the mean utility of a torrent's conns
+	// below which its conns may be preempted.
+	Threshold float64 `yaml:"threshold"`
+
+	// MaxPerTick is the max number of conns preempted per torrent every
+	// preemption tick.
+	MaxPerTick int `yaml:"max_per_tick"`
+}
+
+func (c UtilityPreemptionConfig) applyDefaults() UtilityPreemptionConfig {
+	if c.MinConnAge == 0 {
+		c.MinConnAge = time.Minute
+	}
+	if c.GoodputWeight == 0 {
+		c.GoodputWeight = 1
+	}
+	if c.RarityWeight == 0 {
+		c.RarityWeight = 1
+	}
+	if c.ReciprocationWeight == 0 {
+		c.ReciprocationWeight = 1
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 0.5
+	}
+	if c.MaxPerTick == 0 {
+		c.MaxPerTick = 1
+	}
+	return c
+}
+
+// scores returns the utility of each peer in [0, 1].
+func (c UtilityPreemptionConfig) scores(
+	utilities map[core.PeerID]dispatch.PeerUtility) map[core.PeerID]float64 {
+
+	var maxGoodput, maxRarity float64
+	for _, u := range utilities {
+		maxGoodput = math.Max(maxGoodput, u.DownloadRate+u.UploadRate)
+		maxRarity = math.Max(maxRarity, u.Rarity)
+	}
+	total := c.GoodputWeight + c.RarityWeight + c.ReciprocationWeight
+
+	scores := make(map[core.PeerID]float64, len(utilities))
+	for peerID, u := range utilities {
+		var score float64
+		if maxGoodput > 0 {
+			score += c.GoodputWeight * (u.DownloadRate + u.UploadRate) / maxGoodput
+		}
+		if maxRarity > 0 {
+			score += c.RarityWeight * u.Rarity / maxRarity
+		}
+		if hi := math.Max(u.DownloadRate, u.UploadRate); hi > 0 {
+			score += c.ReciprocationWeight * math.Min(u.DownloadRate, u.UploadRate) / hi
+		}
+		scores[peerID] = score / total
+	}
+	return scores
+}
+
+// selectPreemptions returns the candidates to preempt, lowest utility first.
+// Candidates are only preempted if their utility is below the threshold of the
+// mean utility of all peers.
+func (c UtilityPreemptionConfig) selectPreemptions(
+	scores map[core.PeerID]float64, candidates []core.PeerID) []core.PeerID {
+
+	if len(scores) == 0 {
+		return nil
+	}
+	var mean float64
+	for _, score := range scores {
+		mean += score
+	}
+	mean /= float64(len(scores))
+
+	var low []core.PeerID
+	for _, peerID := range candidates {
+		if score, ok := scores[peerID]; ok && score < c.Threshold*mean {
+			low = append(low, peerID)
+		}
+	}
+	sort.Slice(low, func(i, j int) bool {
+		if scores[low[i]] != scores[low[j]] {
+			return scores[low[i]] < scores[low[j]]
+		}
+		return low[i].LessThan(low[j])
+	})
+	if len(low) > c.MaxPerTick {
+		low = low[:c.MaxPerTick]
+	}
+	return low
+}
+
+// preemptLowUtilityConns closes the least useful conns of ctrl if its torrent
+// is at conn capacity, making room for more useful peers.
+func (s *state) preemptLowUtilityConns(
+	h core.InfoHash, ctrl *torrentControl, conns []*conn.Conn) {
+
+	config := s.sched.config.UtilityPreemption
+	if !config.Enable || ctrl.opts.preemptionExempt || !s.conns.Saturated(h) {
+		return
+	}
+	scores := config.scores(ctrl.dispatcher.PeerUtilities())
+
+	byPeer := make(map[core.PeerID]*conn.Conn)
+	var candidates []core.PeerID
+	for _, c := range conns {
+		if s.sched.clock.Now().Sub(c.CreatedAt()) < config.MinConnAge ||
+			s.conns.Trusted(c.PeerID()) {
+			continue
+		}
+		byPeer[c.PeerID()] = c
+		candidates = append(candidates, c.PeerID())
+	}
+	for _, peerID := range config.selectPreemptions(scores, candidates) {
+		c := byPeer[peerID]
+		s.log("conn", c, "utility", scores[peerID]).Info("Preempting low utility conn")
+		ctrl.stats.Counter("utility_preemptions").Inc(1)
+		c.Close()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+)
+
+func TestUtilityPreemptionScores(t *testing.T) {
+	require := require.New(t)
+
+	config := UtilityPreemptionConfig{}.applyDefaults()
+
+	fast := core.PeerIDFixture()
+	rare := core.PeerIDFixture()
+	idle := core.PeerIDFixture()
+
+	scores := config.scores(map[core.PeerID]dispatch.PeerUtility{
+		fast: {DownloadRate: 100, UploadRate: 100},
+		rare: {DownloadRate: 10, Rarity: 4},
+		idle: {Rarity: 1},
+	})
+
+	require.InDelta(2.0/3, scores[fast], 0.001)
+	require.InDelta((10.0/200+1)/3, scores[rare], 0.001)
+	require.InDelta(0.25/3, scores[idle], 0.001)
+}
+
+func TestUtilityPreemptionSelectsLowestBelowThreshold(t *testing.T) {
+	require := require.New(t)
+
+	config := UtilityPreemptionConfig{MaxPerTick: 2}.applyDefaults()
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	p3 := core.PeerIDFixture()
+	p4 := core.PeerIDFixture()
+
+	scores := map[core.PeerID]float64{
+		p1: 0.9,
+		p2: 0.1,
+		p3: 0.05,
+		p4: 0.8,
+	}
+
+	// Mean utility is 0.4625, so only p2 and p3 are below the threshold.
+	require.Equal(
+		[]core.PeerID{p3, p2},
+		config.selectPreemptions(scores, []core.PeerID{p1, p2, p3, p4}))
+
+	// Ineligible peers are never preempted.
+	require.Equal(
+		[]core.PeerID{p2},
+		config.selectPreemptions(scores, []core.PeerID{p1, p2}))
+
+	config.MaxPerTick = 1
+	require.Equal(
+		[]core.PeerID{p3},
+		config.selectPreemptions(scores, []core.PeerID{p1, p2, p3, p4}))
+}
+
+func TestUtilityPreemptionSkipsUniformUtility(t *testing.T) {
+	require := require.New(t)
+
+	config := UtilityPreemptionConfig{}.applyDefaults()
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	scores := map[core.PeerID]float64{p1: 0, p2: 0}
+
+	require.Empty(config.selectPreemptions(scores, []core.PeerID{p1, p2}))
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package warmup
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/reconcile"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// Torrent identifies a torrent seeded by a neighbor.
+type Torrent struct {
+	Namespace string      `json:"namespace"`
+	Digest    core.Digest `json:"digest"`
+}
+
+// Client lists the torrents seeded by neighbor agents.
+type Client interface {
+	Seeded(addr string) ([]Torrent, error)
+}
+
+type client struct {
+	tls *tls.Config
+}
+
+// NewClient creates a new Client.
+func NewClient(tls *tls.Config) Client {
+	return &client{tls}
+}
+
+// Seeded returns the torrents seeded by the agent at addr.
+func (c *client) Seeded(addr string) ([]Torrent, error) {
+	resp, err := httputil.Get(
+		fmt.Sprintf("http://%s/x/seeded", addr), httputil.SendTLS(c.tls))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var export reconcile.Export
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		return nil, fmt.Errorf("decode export: %s", err)
+	}
+	torrents := make([]Torrent, len(export.Torrents))
+	for i, t := range export.Torrents {
+		torrents[i] = Torrent{t.Namespace, t.Digest}
+	}
+	return torrents, nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package warmup
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+)
+
+// Priority is the priority warmup torrents are added with, such that they are
+// evicted before any content requested by local clients.
+const Priority = -1
+
+// Config defines cold-start warmup, in which a freshly started agent seeds the
+// torrents most popular among its neighbors before they are requested locally,
+// so that it contributes to swarms instead of only leeching.
+type Config struct {
+	Enable bool `yaml:"enable"`
+
+	// Neighbors are the addresses of the agents queried for seeded torrents.
+	Neighbors []string `yaml:"neighbors"`
+
+	// MaxTorrents is the maximum number of torrents added during warmup.
+	MaxTorrents int `yaml:"max_torrents"`
+
+	// MinNeighbors is the minimum number of neighbors which must be seeding a
+	// torrent for it to be considered popular.
+	MinNeighbors int `yaml:"min_neighbors"`
+
+	// Concurrency is the number of warmup torrents downloaded concurrently.
+	Concurrency int `yaml:"concurrency"`
+
+	// Delay is how long after startup warmup begins, giving local clients a
+	// head start on bandwidth.
+	Delay time.Duration `yaml:"delay"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.MaxTorrents == 0 {
+		c.MaxTorrents = 20
+	}
+	if c.MinNeighbors == 0 {
+		c.MinNeighbors = 1
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 2
+	}
+	return c
+}
+
+// AddFunc downloads t with priority, blocking until it completes.
+type AddFunc func(t Torrent, priority int) error
+
+// Select returns the torrents seeded by at least minNeighbors of the given
+// neighbor lists, most popular first, up to max torrents. Ties are broken by
+// digest for determinism.
+func Select(lists [][]Torrent, minNeighbors, max int) []Torrent {
+	counts := make(map[core.Digest]int)
+	first := make(map[core.Digest]Torrent)
+	for _, list := range lists {
+		seen := make(map[core.Digest]bool)
+		for _, t := range list {
+			if seen[t.Digest] {
+				continue
+			}
+			seen[t.Digest] = true
+			if _, ok := first[t.Digest]; !ok {
+				first[t.Digest] = t
+			}
+			counts[t.Digest]++
+		}
+	}
+	var result []Torrent
+	for d, t := range first {
+		if counts[d] >= minNeighbors {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ci, cj := counts[result[i].Digest], counts[result[j].Digest]
+		if ci != cj {
+			return ci > cj
+		}
+		return result[i].Digest.String() < result[j].Digest.String()
+	})
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result
+}
+
+// Run queries the configured neighbors for their seeded torrents, and adds
+// the most popular ones via add. Blocks until all warmup downloads finish, or
+// done is closed.
+func Run(
+	config Config,
+	client Client,
+	add AddFunc,
+	stats tally.Scope,
+	logger *zap.SugaredLogger,
+	done <-chan struct{}) {
+
+	config = config.applyDefaults()
+	stats = stats.Tagged(map[string]string{
+		"module": "warmup",
+	})
+
+	if config.Delay > 0 {
+		select {
+		case <-time.After(config.Delay):
+		case <-done:
+			return
+		}
+	}
+
+	var lists [][]Torrent
+	for _, addr := range config.Neighbors {
+		torrents, err := client.Seeded(addr)
+		if err != nil {
+			logger.Infof("Error listing seeded torrents of neighbor %s: %s", addr, err)
+			stats.Counter("neighbor_errors").Inc(1)
+			continue
+		}
+		lists = append(lists, torrents)
+	}
+	torrents := Select(lists, config.MinNeighbors, config.MaxTorrents)
+	logger.Infof("Warming up %d torrents from %d neighbors", len(torrents), len(lists))
+
+	queue := make(chan Torrent, len(torrents))
+	for _, t := range torrents {
+		queue <- t
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := add(t, Priority); err != nil {
+					logger.Infof("Error warming up %s: %s", t.Digest, err)
+					stats.Counter("torrents_failed").Inc(1)
+					continue
+				}
+				stats.Counter("torrents_added").Inc(1)
+			}
+		}()
+	}
+	wg.Wait()
+}
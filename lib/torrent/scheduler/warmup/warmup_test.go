@@ -0,0 +1,102 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package warmup
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/log"
+)
+
+type fakeClient map[string][]Torrent
+
+func (c fakeClient) Seeded(addr string) ([]Torrent, error) {
+	torrents, ok := c[addr]
+	if !ok {
+		return nil, errors.New("unreachable")
+	}
+	return torrents, nil
+}
+
+func TestSelectOrdersByPopularity(t *testing.T) {
+	require := require.New(t)
+
+	a := Torrent{"ns", core.DigestFixture()}
+	b := Torrent{"ns", core.DigestFixture()}
+	c := Torrent{"ns", core.DigestFixture()}
+
+	lists := [][]Torrent{
+		{a, b, b},
+		{b, c},
+		{b, a},
+	}
+
+	require.Equal([]Torrent{b, a}, Select(lists, 2, 10))
+	require.Equal([]Torrent{b}, Select(lists, 1, 1))
+	require.Len(Select(lists, 1, 10), 3)
+	require.Empty(Select(lists, 4, 10))
+}
+
+func TestRunAddsPopularTorrentsAtLowPriority(t *testing.T) {
+	require := require.New(t)
+
+	a := Torrent{"ns", core.DigestFixture()}
+	b := Torrent{"ns", core.DigestFixture()}
+
+	client := fakeClient{
+		"n1": {a, b},
+		"n2": {a},
+	}
+
+	var mu sync.Mutex
+	added := make(map[core.Digest]int)
+	add := func(t Torrent, priority int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		added[t.Digest] = priority
+		return nil
+	}
+
+	Run(Config{
+		Neighbors:    []string{"n1", "n2", "unreachable"},
+		MinNeighbors: 2,
+	}, client, add, tally.NoopScope, log.Default(), make(chan struct{}))
+
+	require.Equal(map[core.Digest]int{a.Digest: Priority}, added)
+}
+
+func TestRunStopsWhenDone(t *testing.T) {
+	require := require.New(t)
+
+	client := fakeClient{"n1": {{"ns", core.DigestFixture()}}}
+
+	done := make(chan struct{})
+	close(done)
+
+	var added bool
+	add := func(Torrent, int) error {
+		added = true
+		return nil
+	}
+
+	Run(Config{Neighbors: []string{"n1"}}, client, add, tally.NoopScope, log.Default(), done)
+
+	require.False(added)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/store/metadata"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/tracker/metainfoclient"
+
+	"github.com/willf/bitset"
+)
+
+const _attachedSuffix = "_attached"
+
+func init() {
+	metadata.Register(regexp.MustCompile(_attachedSuffix), attachedMetadataFactory{})
+}
+
+var errAttachedReadOnly = errors.New("attached torrents are read-only")
+
+type attachedMetadataFactory struct{}
+
+func (m attachedMetadataFactory) Create(suffix string) metadata.Metadata {
+	return &attachedMetadata{}
+}
+
+// attachedMetadata marks whether a torrent is backed by a pre-existing file
+// outside of the cache, which must never be written to.
+type attachedMetadata struct {
+	value bool
+}
+
+func (m *attachedMetadata) GetSuffix() string {
+	return _attachedSuffix
+}
+
+func (m *attachedMetadata) Movable() bool {
+	return true
+}
+
+func (m *attachedMetadata) Serialize() ([]byte, error) {
+	return []byte(strconv.FormatBool(m.value)), nil
+}
+
+func (m *attachedMetadata) Deserialize(b []byte) error {
+	v, err := strconv.ParseBool(string(b))
+	if err != nil {
+		return err
+	}
+	m.value = v
+	return nil
+}
+
+// AttachTorrent registers the existing file at path as a complete torrent for
+// d, without copying it into the cache. The file is hashed in place and
+// verified against the metainfo of d. Attached torrents are read-only, thus
+// their pieces are never evicted.
+func (a *TorrentArchive) AttachTorrent(namespace string, d core.Digest, path string) error {
+	if _, err := a.cads.Any().GetFileStat(d.Hex()); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat: %s", err)
+	}
+
+	mi, err := a.metaInfoClient.Download(context.Background(), namespace, d)
+	if err != nil {
+		if err == metainfoclient.ErrNotFound {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("download metainfo: %s", err)
+	}
+
+	hashTimer := a.stats.Timer("attach_hash").Start()
+	if err := verifyFile(path, mi); err != nil {
+		return fmt.Errorf("verify file: %s", err)
+	}
+	hashTimer.Stop()
+
+	name := d.Hex()
+	if err := a.cads.LinkCacheFile(name, path); err != nil {
+		return fmt.Errorf("link cache file: %s", err)
+	}
+	complete := bitset.New(uint(mi.NumPieces())).Complement()
+	for _, md := range []metadata.Metadata{
+		metadata.NewTorrentMeta(mi),
+		newPieceStatusMetadata(complete),
+		&attachedMetadata{true},
+	} {
+		if _, err := a.cads.Cache().SetMetadata(name, md); err != nil {
+			a.cads.Cache().DeleteFile(name)
+			return fmt.Errorf("set metadata %s: %s", md.GetSuffix(), err)
+		}
+	}
+	a.stats.Counter("attached_torrents").Inc(1)
+	return nil
+}
+
+// verifyFile hashes the file at path in a single pass and checks that both its
+// digest and pieces match mi.
+func verifyFile(path string, mi *core.MetaInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %s", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %s", err)
+	}
+	if info.Size() != mi.Length() {
+		return fmt.Errorf("length mismatch: expected %d, got %d", mi.Length(), info.Size())
+	}
+
+	digester := core.NewDigester()
+	local, err := core.NewMetaInfo(
+		mi.Digest(),
+		digester.Tee(f),
+		mi.PieceLength(),
+		core.WithPieceHashAlgorithm(mi.PieceHashAlgorithm()))
+	if err != nil {
+		return fmt.Errorf("compute metainfo: %s", err)
+	}
+	if d := digester.Digest(); d != mi.Digest() {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", mi.Digest(), d)
+	}
+	if local.InfoHash() != mi.InfoHash() {
+		return fmt.Errorf("info hash mismatch: expected %s, got %s", mi.InfoHash(), local.InfoHash())
+	}
+	return nil
+}
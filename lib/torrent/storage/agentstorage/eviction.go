@@ -0,0 +1,137 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/uber/kraken/lib/store/metadata"
+)
+
+const _evictedSuffix = "_evicted"
+
+func init() {
+	metadata.Register(regexp.MustCompile(_evictedSuffix), evictedMetadataFactory{})
+}
+
+var errHolePunchingUnsupported = errors.New("hole punching not supported")
+
+type evictedMetadataFactory struct{}
+
+func (m evictedMetadataFactory) Create(suffix string) metadata.Metadata {
+	return &evictedMetadata{}
+}
+
+// evictedMetadata marks whether a torrent has had pieces evicted since it was
+// last complete.
+type evictedMetadata struct {
+	value bool
+}
+
+func (m *evictedMetadata) GetSuffix() string {
+	return _evictedSuffix
+}
+
+func (m *evictedMetadata) Movable() bool {
+	return true
+}
+
+func (m *evictedMetadata) Serialize() ([]byte, error) {
+	return []byte(strconv.FormatBool(m.value)), nil
+}
+
+func (m *evictedMetadata) Deserialize(b []byte) error {
+	v, err := strconv.ParseBool(string(b))
+	if err != nil {
+		return err
+	}
+	m.value = v
+	return nil
+}
+
+// Evicted returns true if t has had pieces evicted since it was last complete.
+func (t *Torrent) Evicted() bool {
+	return t.evicted.Load()
+}
+
+// EvictPieces removes the given pieces from disk and marks them as missing,
+// such that they may be downloaded again. If t is complete, its file is moved
+// back to the download directory. Pieces which are not complete are skipped.
+//
+// Callers must ensure no other Torrent instance is concurrently reading t.
+func (t *Torrent) EvictPieces(pieces []int) error {
+	if t.attached {
+		return errAttachedReadOnly
+	}
+
+	name := t.Digest().Hex()
+
+	if t.committed.Load() {
+		if err := t.cads.MoveCacheFileToDownload(name); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("move file to download: %s", err)
+		}
+		t.committed.Store(false)
+	}
+	if _, err := t.cads.Download().SetMetadata(name, &evictedMetadata{true}); err != nil {
+		return fmt.Errorf("set evicted metadata: %s", err)
+	}
+	t.evicted.Store(true)
+
+	f, err := t.cads.GetDownloadFileReadWriter(name)
+	if err != nil {
+		return fmt.Errorf("get download writer: %s", err)
+	}
+	defer f.Close()
+
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return errHolePunchingUnsupported
+	}
+
+	for _, pi := range pieces {
+		if err := t.checkPiece(pi); err != nil {
+			return err
+		}
+		if !t.pieces.isComplete(pi) {
+			continue
+		}
+		if err := t.evictPiece(fd.Fd(), pi); err != nil {
+			return fmt.Errorf("evict piece %d: %s", pi, err)
+		}
+	}
+	return nil
+}
+
+// evictPiece frees the disk space of complete piece pi and marks it as empty.
+func (t *Torrent) evictPiece(fd uintptr, pi int) error {
+	if _, err := t.cads.Download().SetMetadataAt(
+		t.Digest().Hex(), &pieceStatusMetadata{}, []byte{byte(_empty)}, int64(pi)); err != nil {
+		return fmt.Errorf("write piece metadata: %s", err)
+	}
+	t.pieces.markEmpty(pi)
+	if err := punchHole(fd, t.getFileOffset(pi), t.PieceLength(pi)); err != nil {
+		return fmt.Errorf("punch hole: %s", err)
+	}
+	return nil
+}
+
+// DiskUsage returns the utilization of the disk which the cache directory
+// resides on.
+func (a *TorrentArchive) DiskUsage() (float64, error) {
+	return diskUsage(a.cads.CacheDir())
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTorrentEvictPieces(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	prepareStore(cads, blob.MetaInfo)
+
+	tor, err := NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+
+	for i, b := range blob.Content {
+		require.NoError(tor.WritePiece(piecereader.NewBuffer([]byte{b}), i))
+	}
+	require.True(tor.Complete())
+	require.False(tor.Evicted())
+
+	require.NoError(tor.EvictPieces([]int{1, 2}))
+
+	require.False(tor.Complete())
+	require.True(tor.Evicted())
+	require.Equal(bitsetutil.FromBools(true, false, false, true), tor.Bitfield())
+
+	// Eviction should survive restoring the torrent from disk.
+	tor, err = NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+	require.False(tor.Complete())
+	require.True(tor.Evicted())
+	require.Equal([]int{1, 2}, tor.MissingPieces())
+
+	// Downloading the evicted pieces again completes the torrent.
+	for _, i := range tor.MissingPieces() {
+		require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+	require.True(tor.Complete())
+	require.False(tor.Evicted())
+
+	tor, err = NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+	require.True(tor.Complete())
+	require.False(tor.Evicted())
+}
@@ -14,6 +14,8 @@
 package agentstorage
 
 import (
+	"context"
+
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store"
 	"github.com/uber/kraken/tracker/metainfoclient"
@@ -44,7 +46,7 @@ func TorrentFixture(mi *core.MetaInfo) (*Torrent, func()) {
 		panic(err)
 	}
 
-	t, err := ta.CreateTorrent("noexist", mi.Digest())
+	t, err := ta.CreateTorrent(context.Background(), "noexist", mi.Digest())
 	if err != nil {
 		panic(err)
 	}
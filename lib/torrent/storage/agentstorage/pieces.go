@@ -21,6 +21,8 @@ import (
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store/metadata"
 	"github.com/uber/kraken/utils/log"
+
+	"github.com/willf/bitset"
 )
 
 const _pieceStatusSuffix = "_status"
@@ -43,13 +45,14 @@ func (m pieceStatusMetadataFactory) Create(suffix string) metadata.Metadata {
 	return &pieceStatusMetadata{}
 }
 
-// pieceStatusMetadata stores pieces statuses as metadata on disk.
+// pieceStatusMetadata stores pieces statuses as metadata on disk. Only
+// complete pieces are persisted -- dirty pieces are restored as empty.
 type pieceStatusMetadata struct {
-	pieces []*piece
+	complete *bitset.BitSet
 }
 
-func newPieceStatusMetadata(pieces []*piece) *pieceStatusMetadata {
-	return &pieceStatusMetadata{pieces}
+func newPieceStatusMetadata(complete *bitset.BitSet) *pieceStatusMetadata {
+	return &pieceStatusMetadata{complete}
 }
 
 func (m *pieceStatusMetadata) GetSuffix() string {
@@ -61,70 +64,118 @@ func (m *pieceStatusMetadata) Movable() bool {
 }
 
 func (m *pieceStatusMetadata) Serialize() ([]byte, error) {
-	b := make([]byte, len(m.pieces))
-	for i, p := range m.pieces {
-		b[i] = byte(p.status)
+	b := make([]byte, m.complete.Len())
+	for i := range b {
+		if m.complete.Test(uint(i)) {
+			b[i] = byte(_complete)
+		} else {
+			b[i] = byte(_empty)
+		}
 	}
 	return b, nil
 }
 
 func (m *pieceStatusMetadata) Deserialize(b []byte) error {
-	m.pieces = make([]*piece, len(b))
+	m.complete = bitset.New(uint(len(b)))
 	for i := range b {
 		status := pieceStatus(b[i])
 		if status != _empty && status != _complete {
 			log.Errorf("Unexpected status in piece metadata: %d", status)
 			status = _empty
 		}
-		m.pieces[i] = &piece{status: status}
+		if status == _complete {
+			m.complete.Set(uint(i))
+		}
 	}
 	return nil
 }
 
-type piece struct {
+// pieceStatuses tracks the status of every piece in a torrent using packed
+// bitsets, which is far cheaper than per-piece structs when seeding many
+// torrents with large piece counts. A piece is complete, dirty (i.e. currently
+// being written), or empty if neither bit is set.
+type pieceStatuses struct {
 	sync.RWMutex
-	status pieceStatus
+	complete *bitset.BitSet
+	dirty    *bitset.BitSet
+}
+
+func newPieceStatuses(complete *bitset.BitSet) *pieceStatuses {
+	return &pieceStatuses{
+		complete: complete,
+		dirty:    bitset.New(complete.Len()),
+	}
 }
 
-func (p *piece) complete() bool {
-	p.RLock()
-	defer p.RUnlock()
-	return p.status == _complete
+func (s *pieceStatuses) len() int {
+	return int(s.complete.Len())
 }
 
-func (p *piece) dirty() bool {
-	p.RLock()
-	defer p.RUnlock()
-	return p.status == _dirty
+func (s *pieceStatuses) isComplete(pi int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.complete.Test(uint(pi))
 }
 
-func (p *piece) tryMarkDirty() (dirty, complete bool) {
-	p.Lock()
-	defer p.Unlock()
+func (s *pieceStatuses) isDirty(pi int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.dirty.Test(uint(pi))
+}
 
-	switch p.status {
-	case _empty:
-		p.status = _dirty
-	case _dirty:
-		dirty = true
-	case _complete:
+func (s *pieceStatuses) tryMarkDirty(pi int) (dirty, complete bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case s.complete.Test(uint(pi)):
 		complete = true
+	case s.dirty.Test(uint(pi)):
+		dirty = true
 	default:
-		log.Fatalf("Unknown piece status: %d", p.status)
+		s.dirty.Set(uint(pi))
 	}
 	return
 }
 
-func (p *piece) markEmpty() {
-	p.Lock()
-	defer p.Unlock()
-	p.status = _empty
+func (s *pieceStatuses) markEmpty(pi int) {
+	s.Lock()
+	defer s.Unlock()
+	s.complete.Clear(uint(pi))
+	s.dirty.Clear(uint(pi))
 }
 
-func (p *piece) markComplete() {
-	p.Lock()
-	defer p.Unlock()
-	p.status = _complete
+func (s *pieceStatuses) markComplete(pi int) {
+	s.Lock()
+	defer s.Unlock()
+	s.complete.Set(uint(pi))
+	s.dirty.Clear(uint(pi))
+}
+
+// numComplete returns the number of complete pieces.
+func (s *pieceStatuses) numComplete() int {
+	s.RLock()
+	defer s.RUnlock()
+	return int(s.complete.Count())
+}
+
+// bitfield returns a copy of the complete pieces.
+func (s *pieceStatuses) bitfield() *bitset.BitSet {
+	s.RLock()
+	defer s.RUnlock()
+	return s.complete.Clone()
+}
+
+// missing returns the indices of all incomplete pieces.
+func (s *pieceStatuses) missing() []int {
+	s.RLock()
+	defer s.RUnlock()
+
+	var missing []int
+	for i, ok := s.complete.NextClear(0); ok && i < s.complete.Len(); i, ok = s.complete.NextClear(i + 1) {
+		missing = append(missing, int(i))
+	}
+	return missing
 }
 
 // restorePieces reads piece metadata from disk and restores the in-memory piece
@@ -135,25 +186,14 @@ func (p *piece) markComplete() {
 func restorePieces(
 	d core.Digest,
 	cads caDownloadStore,
-	numPieces int) (pieces []*piece, numComplete int, err error) {
+	numPieces int) (*pieceStatuses, error) {
 
-	for i := 0; i < numPieces; i++ {
-		pieces = append(pieces, &piece{status: _empty})
-	}
-	md := newPieceStatusMetadata(pieces)
+	md := newPieceStatusMetadata(bitset.New(uint(numPieces)))
 	if err := cads.Download().GetOrSetMetadata(d.Hex(), md); cads.InCacheError(err) {
 		// File is in cache state -- initialize completed pieces.
-		for _, p := range pieces {
-			p.status = _complete
-		}
-		return pieces, numPieces, nil
+		return newPieceStatuses(bitset.New(uint(numPieces)).Complement()), nil
 	} else if err != nil {
-		return nil, 0, fmt.Errorf("get or set piece metadata: %s", err)
-	}
-	for _, p := range md.pieces {
-		if p.status == _complete {
-			numComplete++
-		}
+		return nil, fmt.Errorf("get or set piece metadata: %s", err)
 	}
-	return md.pieces, numComplete, nil
+	return newPieceStatuses(md.complete), nil
 }
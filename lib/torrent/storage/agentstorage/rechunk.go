@@ -0,0 +1,195 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/store/metadata"
+	"github.com/uber/kraken/lib/torrent/storage"
+
+	"github.com/willf/bitset"
+	"go.uber.org/atomic"
+)
+
+// Note, must not contain the suffix of metadata.TorrentMeta, since suffixes
+// are matched as unanchored regexps.
+const _legacyMetaInfoSuffix = "_legacymeta"
+
+func init() {
+	metadata.Register(regexp.MustCompile(_legacyMetaInfoSuffix), legacyMetaInfoFactory{})
+}
+
+type legacyMetaInfoFactory struct{}
+
+func (f legacyMetaInfoFactory) Create(suffix string) metadata.Metadata {
+	return &legacyMetaInfoMetadata{}
+}
+
+// legacyMetaInfoMetadata retains the metainfo a torrent had before being
+// re-chunked, until expiration.
+type legacyMetaInfoMetadata struct {
+	metaInfo   *core.MetaInfo
+	expiration time.Time
+}
+
+type legacyMetaInfoJSON struct {
+	MetaInfo   json.RawMessage `json:"metainfo"`
+	Expiration time.Time       `json:"expiration"`
+}
+
+func (m *legacyMetaInfoMetadata) GetSuffix() string {
+	return _legacyMetaInfoSuffix
+}
+
+func (m *legacyMetaInfoMetadata) Movable() bool {
+	return true
+}
+
+func (m *legacyMetaInfoMetadata) Serialize() ([]byte, error) {
+	b, err := m.metaInfo.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(legacyMetaInfoJSON{b, m.expiration})
+}
+
+func (m *legacyMetaInfoMetadata) Deserialize(b []byte) error {
+	var j legacyMetaInfoJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	mi, err := core.DeserializeMetaInfo(j.MetaInfo)
+	if err != nil {
+		return err
+	}
+	m.metaInfo = mi
+	m.expiration = j.Expiration
+	return nil
+}
+
+// Rechunk errors.
+var (
+	ErrRechunkIncomplete      = errors.New("only complete torrents can be re-chunked")
+	ErrRechunkSamePieceLength = errors.New("torrent already has piece length")
+)
+
+// Rechunk replaces the metainfo of the complete torrent of d with metainfo of
+// pieceLength, computed from the content already on disk. The previous
+// metainfo is retained for window, during which peers which still use it may
+// be served from the same content via GetLegacyTorrent.
+//
+// Note, the torrent must not be open in the scheduler, which would otherwise
+// keep serving the previous metainfo as if it were current.
+func (a *TorrentArchive) Rechunk(
+	d core.Digest, pieceLength int64, window time.Duration) (*core.MetaInfo, error) {
+
+	var tm metadata.TorrentMeta
+	if err := a.cads.Cache().GetMetadata(d.Hex(), &tm); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrRechunkIncomplete
+		}
+		return nil, fmt.Errorf("get metainfo: %s", err)
+	}
+	old := tm.MetaInfo
+	if old.PieceLength() == pieceLength {
+		return nil, ErrRechunkSamePieceLength
+	}
+
+	f, err := a.cads.Cache().GetFileReader(d.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get file reader: %s", err)
+	}
+	defer f.Close()
+	mi, err := core.NewMetaInfo(
+		d, f, pieceLength, core.WithPieceHashAlgorithm(old.PieceHashAlgorithm()))
+	if err != nil {
+		return nil, fmt.Errorf("new metainfo: %s", err)
+	}
+
+	legacy := &legacyMetaInfoMetadata{old, a.clk.Now().Add(window)}
+	if _, err := a.cads.Cache().SetMetadata(d.Hex(), legacy); err != nil {
+		return nil, fmt.Errorf("set legacy metainfo: %s", err)
+	}
+	// Piece statuses must match the piece count of the new metainfo, since
+	// they are reported by Stat.
+	complete := bitset.New(uint(mi.NumPieces())).Complement()
+	if _, err := a.cads.Cache().SetMetadata(d.Hex(), newPieceStatusMetadata(complete)); err != nil {
+		return nil, fmt.Errorf("set piece status: %s", err)
+	}
+	if _, err := a.cads.Cache().SetMetadata(d.Hex(), metadata.NewTorrentMeta(mi)); err != nil {
+		return nil, fmt.Errorf("set metainfo: %s", err)
+	}
+	return mi, nil
+}
+
+// GetLegacyTorrent returns a read-only Torrent of the metainfo of d retained
+// by Rechunk, if its info hash is h. Returns storage.ErrNotFound if no such
+// metainfo is retained, or its window has passed.
+func (a *TorrentArchive) GetLegacyTorrent(d core.Digest, h core.InfoHash) (storage.Torrent, error) {
+	m, err := a.getLegacyMetaInfo(d)
+	if err != nil {
+		return nil, err
+	}
+	if m.metaInfo.InfoHash() != h {
+		return nil, storage.ErrNotFound
+	}
+	// Legacy torrents are complete by construction, so no piece statuses are
+	// persisted for them and writes are rejected as ErrPieceComplete.
+	complete := bitset.New(uint(m.metaInfo.NumPieces())).Complement()
+	return &Torrent{
+		cads:      a.cads,
+		metaInfo:  m.metaInfo,
+		pieces:    newPieceStatuses(complete),
+		committed: atomic.NewBool(true),
+		evicted:   atomic.NewBool(false),
+		metrics:   a.metrics,
+	}, nil
+}
+
+// LegacyInfoHash returns the info hash of the metainfo of d retained by
+// Rechunk. Returns storage.ErrNotFound if no such metainfo is retained, or its
+// window has passed.
+func (a *TorrentArchive) LegacyInfoHash(d core.Digest) (core.InfoHash, error) {
+	m, err := a.getLegacyMetaInfo(d)
+	if err != nil {
+		return core.InfoHash{}, err
+	}
+	return m.metaInfo.InfoHash(), nil
+}
+
+// getLegacyMetaInfo returns the metainfo of d retained by Rechunk, deleting it
+// once its window has passed.
+func (a *TorrentArchive) getLegacyMetaInfo(d core.Digest) (*legacyMetaInfoMetadata, error) {
+	var m legacyMetaInfoMetadata
+	if err := a.cads.Cache().GetMetadata(d.Hex(), &m); err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("get legacy metainfo: %s", err)
+	}
+	if a.clk.Now().After(m.expiration) {
+		if err := a.cads.Cache().DeleteMetadata(d.Hex(), &m); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("delete expired legacy metainfo: %s", err)
+		}
+		return nil, storage.ErrNotFound
+	}
+	return &m, nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func completeTorrentFixture(t *testing.T, mocks *archiveMocks, blob *core.BlobFixture) {
+	namespace := core.TagFixture()
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	tor, err := mocks.new().CreateTorrent(context.Background(), namespace, blob.Digest)
+	require.NoError(t, err)
+	for i := 0; i < tor.NumPieces(); i++ {
+		start := i * int(blob.MetaInfo.PieceLength())
+		end := start + int(tor.PieceLength(i))
+		require.NoError(t, tor.WritePiece(piecereader.NewBuffer(blob.Content[start:end]), i))
+	}
+	require.True(t, tor.Complete())
+}
+
+func TestRechunkServesBothMetaInfos(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(64, 4)
+	completeTorrentFixture(t, mocks, blob)
+
+	archive := mocks.new()
+
+	mi, err := archive.Rechunk(blob.Digest, 16, time.Hour)
+	require.NoError(err)
+	require.Equal(4, mi.NumPieces())
+	require.NotEqual(blob.MetaInfo.InfoHash(), mi.InfoHash())
+
+	info, err := archive.Stat("", blob.Digest)
+	require.NoError(err)
+	require.Equal(mi.InfoHash(), info.InfoHash())
+	require.Equal(100, info.PercentDownloaded())
+
+	tor, err := archive.GetTorrent("", blob.Digest)
+	require.NoError(err)
+	require.Equal(mi.InfoHash(), tor.InfoHash())
+
+	legacy, err := archive.GetLegacyTorrent(blob.Digest, blob.MetaInfo.InfoHash())
+	require.NoError(err)
+	require.Equal(16, legacy.NumPieces())
+	require.True(legacy.Complete())
+
+	r, err := legacy.GetPieceReader(5)
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob.Content[20:24], b)
+
+	require.Equal(storage.ErrPieceComplete, legacy.WritePiece(piecereader.NewBuffer(b), 5))
+
+	_, err = archive.GetLegacyTorrent(blob.Digest, mi.InfoHash())
+	require.Equal(storage.ErrNotFound, err)
+
+	h, err := archive.LegacyInfoHash(blob.Digest)
+	require.NoError(err)
+	require.Equal(blob.MetaInfo.InfoHash(), h)
+}
+
+func TestRechunkLegacyExpires(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(8, 4)
+	completeTorrentFixture(t, mocks, blob)
+
+	clk := clock.NewMock()
+	archive := NewTorrentArchive(tally.NoopScope, mocks.cads, mocks.metaInfoClient, WithClock(clk))
+
+	_, err := archive.Rechunk(blob.Digest, 8, time.Hour)
+	require.NoError(err)
+
+	_, err = archive.GetLegacyTorrent(blob.Digest, blob.MetaInfo.InfoHash())
+	require.NoError(err)
+
+	clk.Add(time.Hour + time.Second)
+
+	_, err = archive.GetLegacyTorrent(blob.Digest, blob.MetaInfo.InfoHash())
+	require.Equal(storage.ErrNotFound, err)
+	_, err = archive.LegacyInfoHash(blob.Digest)
+	require.Equal(storage.ErrNotFound, err)
+
+	var m legacyMetaInfoMetadata
+	require.Error(mocks.cads.Any().GetMetadata(blob.Digest.Hex(), &m))
+}
+
+func TestRechunkErrors(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(8, 4)
+
+	archive := mocks.new()
+
+	_, err := archive.Rechunk(blob.Digest, 8, time.Hour)
+	require.Equal(ErrRechunkIncomplete, err)
+
+	completeTorrentFixture(t, mocks, blob)
+
+	_, err = archive.Rechunk(blob.Digest, 4, time.Hour)
+	require.Equal(ErrRechunkSamePieceLength, err)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/store/metadata"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+var _ storage.Scanner = (*TorrentArchive)(nil)
+
+// ListTorrents returns the torrent data in the download and cache directories.
+// Files which are not named by digest are skipped.
+func (a *TorrentArchive) ListTorrents() ([]storage.StoredTorrent, error) {
+	var torrents []storage.StoredTorrent
+	for _, s := range []struct {
+		scope    *store.CADownloadStoreScope
+		complete bool
+	}{
+		{a.cads.Download(), false},
+		{a.cads.Cache(), true},
+	} {
+		names, err := s.scope.ListNames()
+		if err != nil {
+			return nil, fmt.Errorf("list names: %s", err)
+		}
+		for _, name := range names {
+			d, err := core.NewSHA256DigestFromHex(name)
+			if err != nil {
+				continue
+			}
+			info, err := s.scope.GetFileStat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Removed since listed.
+					continue
+				}
+				return nil, fmt.Errorf("stat %s: %s", name, err)
+			}
+			var tm metadata.TorrentMeta
+			err = s.scope.GetMetadata(name, &tm)
+			torrents = append(torrents, storage.StoredTorrent{
+				Digest:      d,
+				Size:        info.Size(),
+				ModTime:     info.ModTime(),
+				Complete:    s.complete,
+				HasMetaInfo: err == nil,
+			})
+		}
+	}
+	return torrents, nil
+}
+
+// QuarantineTorrent moves the data of d, along with its metadata, into dir.
+// dir must be on the same filesystem as the torrent archive.
+func (a *TorrentArchive) QuarantineTorrent(d core.Digest, dir string) error {
+	return a.cads.Any().QuarantineFile(d.Hex(), dir)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"errors"
+	"os"
+
+	"github.com/uber/kraken/core"
+)
+
+var errTiersDisabled = errors.New("cold tier disabled")
+
+// Promote moves the torrent for d from the cold tier back to the hot tier.
+// No-op if the torrent is not in the cold tier.
+func (a *TorrentArchive) Promote(d core.Digest) error {
+	if !a.cads.ColdTierEnabled() {
+		return errTiersDisabled
+	}
+	if !a.cads.InColdTier(d.Hex()) {
+		return nil
+	}
+	if err := a.cads.MoveColdFileToCache(d.Hex()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	a.stats.Counter("tier_promotions").Inc(1)
+	return nil
+}
+
+// Demote moves the complete torrent for d to the cold tier. No-op if the
+// torrent is already in the cold tier, or is attached, since attached torrents
+// are links to files we do not own.
+func (a *TorrentArchive) Demote(d core.Digest) error {
+	if !a.cads.ColdTierEnabled() {
+		return errTiersDisabled
+	}
+	var attached attachedMetadata
+	if err := a.cads.Any().GetMetadata(d.Hex(), &attached); err == nil && attached.value {
+		return nil
+	}
+	if err := a.cads.MoveCacheFileToCold(d.Hex()); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	a.stats.Counter("tier_demotions").Inc(1)
+	return nil
+}
@@ -14,10 +14,13 @@
 package agentstorage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store"
@@ -25,6 +28,7 @@ import (
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/utils/log"
 
+	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
 	"go.uber.org/atomic"
 )
@@ -32,12 +36,14 @@ import (
 var (
 	errPieceNotComplete   = errors.New("piece not complete")
 	errWritePieceConflict = errors.New("piece is already being written to")
+	errDigestMismatch     = errors.New("blob digest mismatch with overridden piece hashes")
 )
 
 // caDownloadStore defines the CADownloadStore methods which Torrent requires. Useful
 // for testing purposes, where we need to mock certain methods.
 type caDownloadStore interface {
 	MoveDownloadFileToCache(name string) error
+	MoveCacheFileToDownload(name string) error
 	GetDownloadFileReadWriter(name string) (store.FileReadWriter, error)
 	Any() *store.CADownloadStoreScope
 	Download() *store.CADownloadStoreScope
@@ -49,34 +55,59 @@ type caDownloadStore interface {
 // pieces. Behavior is undefined if multiple Torrent instances are backed
 // by the same file store and metainfo.
 type Torrent struct {
-	metaInfo    *core.MetaInfo
-	cads        caDownloadStore
-	pieces      []*piece
-	numComplete *atomic.Int32
-	committed   *atomic.Bool
+	metaInfo  *core.MetaInfo
+	cads      caDownloadStore
+	pieces    *pieceStatuses
+	committed *atomic.Bool
+	evicted   *atomic.Bool
+	attached  bool
+
+	// writer is nil unless piece writes are reordered.
+	writer *orderedWriter
+
+	metrics    *storage.Metrics
+	syncWrites bool
+
+	// overrides holds expected piece hashes which replace those of metaInfo.
+	// Overrides are not persisted, since they only serve to complete the
+	// current download.
+	overridesMu sync.Mutex
+	overrides   map[int][]byte
 }
 
 // NewTorrent creates a new Torrent.
 func NewTorrent(cads caDownloadStore, mi *core.MetaInfo) (*Torrent, error) {
-	pieces, numComplete, err := restorePieces(mi.Digest(), cads, mi.NumPieces())
+	pieces, err := restorePieces(mi.Digest(), cads, mi.NumPieces())
 	if err != nil {
 		return nil, fmt.Errorf("restore pieces: %s", err)
 	}
 
 	committed := false
-	if numComplete == len(pieces) {
+	if pieces.numComplete() == pieces.len() {
 		if err := cads.MoveDownloadFileToCache(mi.Digest().Hex()); err != nil && !os.IsExist(err) {
 			return nil, fmt.Errorf("move file to cache: %s", err)
 		}
 		committed = true
 	}
 
+	var em evictedMetadata
+	if err := cads.Any().GetMetadata(mi.Digest().Hex(), &em); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("get evicted metadata: %s", err)
+	}
+
+	var am attachedMetadata
+	if err := cads.Any().GetMetadata(mi.Digest().Hex(), &am); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("get attached metadata: %s", err)
+	}
+
 	return &Torrent{
-		cads:        cads,
-		metaInfo:    mi,
-		pieces:      pieces,
-		numComplete: atomic.NewInt32(int32(numComplete)),
-		committed:   atomic.NewBool(committed),
+		cads:      cads,
+		metaInfo:  mi,
+		pieces:    pieces,
+		committed: atomic.NewBool(committed),
+		evicted:   atomic.NewBool(em.value && !committed),
+		attached:  am.value,
+		metrics:   storage.NewMetrics(tally.NoopScope),
 	}, nil
 }
 
@@ -95,9 +126,14 @@ func (t *Torrent) InfoHash() core.InfoHash {
 	return t.metaInfo.InfoHash()
 }
 
+// MetaInfo returns the metainfo of the torrent.
+func (t *Torrent) MetaInfo() *core.MetaInfo {
+	return t.metaInfo
+}
+
 // NumPieces returns the number of pieces in the torrent.
 func (t *Torrent) NumPieces() int {
-	return len(t.pieces)
+	return t.pieces.len()
 }
 
 // Length returns the length of the target file.
@@ -124,19 +160,13 @@ func (t *Torrent) Complete() bool {
 // BytesDownloaded returns an estimate of the number of bytes downloaded in the
 // torrent.
 func (t *Torrent) BytesDownloaded() int64 {
-	return min(int64(t.numComplete.Load())*t.metaInfo.PieceLength(), t.metaInfo.Length())
+	return min(int64(t.pieces.numComplete())*t.metaInfo.PieceLength(), t.metaInfo.Length())
 }
 
 // Bitfield returns the bitfield of pieces where true denotes a complete piece
 // and false denotes an incomplete piece.
 func (t *Torrent) Bitfield() *bitset.BitSet {
-	bitfield := bitset.New(uint(len(t.pieces)))
-	for i, p := range t.pieces {
-		if p.complete() {
-			bitfield.Set(uint(i))
-		}
-	}
-	return bitfield
+	return t.pieces.bitfield()
 }
 
 func (t *Torrent) String() string {
@@ -146,11 +176,11 @@ func (t *Torrent) String() string {
 		t.Digest().Hex(), t.InfoHash().Hex(), downloaded)
 }
 
-func (t *Torrent) getPiece(pi int) (*piece, error) {
-	if pi >= len(t.pieces) {
-		return nil, fmt.Errorf("invalid piece index %d: num pieces = %d", pi, len(t.pieces))
+func (t *Torrent) checkPiece(pi int) error {
+	if pi < 0 || pi >= t.pieces.len() {
+		return fmt.Errorf("invalid piece index %d: num pieces = %d", pi, t.pieces.len())
 	}
-	return t.pieces[pi], nil
+	return nil
 }
 
 // markPieceComplete must only be called once per piece.
@@ -166,20 +196,24 @@ func (t *Torrent) markPieceComplete(pi int) error {
 		log.Errorf(
 			"Invariant violation: piece marked complete twice: piece %d in %s", pi, t.Digest().Hex())
 	}
-	t.pieces[pi].markComplete()
-	t.numComplete.Inc()
+	t.pieces.markComplete(pi)
 	return nil
 }
 
 // writePiece writes data to piece pi. If the write succeeds, marks the piece as completed.
 func (t *Torrent) writePiece(src storage.PieceReader, pi int) error {
+	if t.writer != nil {
+		return t.writePieceOrdered(src, pi)
+	}
 	f, err := t.cads.GetDownloadFileReadWriter(t.metaInfo.Digest().Hex())
 	if err != nil {
 		return fmt.Errorf("get download writer: %s", err)
 	}
+	t.metrics.HandleOpened()
+	defer t.metrics.HandleClosed()
 	defer f.Close()
 
-	h := core.PieceHash()
+	h := t.metaInfo.NewPieceHash()
 	r := io.TeeReader(src, h) // Calculates piece sum as we write to file.
 
 	if _, err := f.Seek(t.getFileOffset(pi), 0); err != nil {
@@ -188,8 +222,13 @@ func (t *Torrent) writePiece(src storage.PieceReader, pi int) error {
 	if _, err := io.Copy(f, r); err != nil {
 		return fmt.Errorf("copy: %s", err)
 	}
-	if h.Sum32() != t.metaInfo.GetPieceSum(pi) {
-		return errors.New("invalid piece sum")
+	if !t.verifyPieceSum(pi, h) {
+		return storage.ErrInvalidPieceSum
+	}
+	if t.syncWrites {
+		if err := syncFile(f, t.metrics); err != nil {
+			return err
+		}
 	}
 
 	if err := t.markPieceComplete(pi); err != nil {
@@ -198,10 +237,107 @@ func (t *Torrent) writePiece(src storage.PieceReader, pi int) error {
 	return nil
 }
 
+// writePieceOrdered buffers and verifies piece pi before handing it to the
+// ordered writer, such that only valid pieces occupy the write buffer.
+func (t *Torrent) writePieceOrdered(src storage.PieceReader, pi int) error {
+	verifyTimer := t.metrics.StartVerifyRead()
+	data := make([]byte, src.Length())
+	if _, err := io.ReadFull(src, data); err != nil {
+		return fmt.Errorf("read: %s", err)
+	}
+	h := t.metaInfo.NewPieceHash()
+	h.Write(data)
+	if !t.verifyPieceSum(pi, h) {
+		return storage.ErrInvalidPieceSum
+	}
+	verifyTimer.Stop()
+	if err := t.writer.write(t.metaInfo.Digest().Hex(), t.getFileOffset(pi), data); err != nil {
+		return err
+	}
+	if err := t.markPieceComplete(pi); err != nil {
+		return fmt.Errorf("mark piece complete: %s", err)
+	}
+	return nil
+}
+
+// ExpectedPieceHash returns the hash which piece pi must match.
+func (t *Torrent) ExpectedPieceHash(pi int) []byte {
+	t.overridesMu.Lock()
+	defer t.overridesMu.Unlock()
+
+	if h, ok := t.overrides[pi]; ok {
+		return h
+	}
+	return t.metaInfo.PieceHash(pi)
+}
+
+// OverridePieceHash replaces the hash which piece pi must match, for when the
+// hash in the local metainfo is known to be corrupt.
+func (t *Torrent) OverridePieceHash(pi int, h []byte) error {
+	if err := t.checkPiece(pi); err != nil {
+		return err
+	}
+	if expected := len(t.metaInfo.PieceHash(pi)); len(h) != expected {
+		return fmt.Errorf("invalid hash length: expected %d, got %d", expected, len(h))
+	}
+	t.overridesMu.Lock()
+	defer t.overridesMu.Unlock()
+
+	if t.overrides == nil {
+		t.overrides = make(map[int][]byte)
+	}
+	t.overrides[pi] = append([]byte(nil), h...)
+	return nil
+}
+
+// verifyOverrides verifies the digest of the whole blob if any expected piece
+// hash was overridden, since overrides are not covered by the metainfo. On
+// mismatch, overridden pieces are reset and their overrides dropped, such that
+// the blob is never committed to the cache.
+func (t *Torrent) verifyOverrides() error {
+	t.overridesMu.Lock()
+	defer t.overridesMu.Unlock()
+
+	if len(t.overrides) == 0 {
+		return nil
+	}
+	f, err := t.cads.Download().GetFileReader(t.Digest().Hex())
+	if err != nil {
+		return fmt.Errorf("get download reader: %s", err)
+	}
+	d, err := core.NewDigester().FromReader(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("compute digest: %s", err)
+	}
+	if d == t.Digest() {
+		return nil
+	}
+	for pi := range t.overrides {
+		if _, err := t.cads.Download().SetMetadataAt(
+			t.Digest().Hex(), &pieceStatusMetadata{}, []byte{byte(_empty)}, int64(pi)); err != nil {
+			return fmt.Errorf("write piece metadata: %s", err)
+		}
+		t.pieces.markEmpty(pi)
+	}
+	t.overrides = nil
+	return errDigestMismatch
+}
+
+func (t *Torrent) verifyPieceSum(pi int, h hash.Hash) bool {
+	t.overridesMu.Lock()
+	override, ok := t.overrides[pi]
+	t.overridesMu.Unlock()
+
+	if ok {
+		return bytes.Equal(h.Sum(nil), override)
+	}
+	return t.metaInfo.VerifyPieceSum(pi, h)
+}
+
 // WritePiece writes data to piece pi.
 func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
-	piece, err := t.getPiece(pi)
-	if err != nil {
+	if err := t.checkPiece(pi); err != nil {
 		return err
 	}
 	if int64(src.Length()) != t.PieceLength(pi) {
@@ -210,14 +346,14 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 	}
 
 	// Exit quickly if the piece is not writable.
-	if piece.complete() {
+	if t.pieces.isComplete(pi) {
 		return storage.ErrPieceComplete
 	}
-	if piece.dirty() {
+	if t.pieces.isDirty(pi) {
 		return errWritePieceConflict
 	}
 
-	dirty, complete := piece.tryMarkDirty()
+	dirty, complete := t.pieces.tryMarkDirty(pi)
 	if dirty {
 		return errWritePieceConflict
 	} else if complete {
@@ -228,13 +364,26 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 	// we are the only thread which may write the piece. We do not block other
 	// threads from checking if the piece is writable.
 
-	if err := t.writePiece(src, pi); err != nil {
+	// The length of src shrinks as it is read.
+	n := int64(src.Length())
+	t.metrics.AddDirtyBytes(n)
+	writeTimer := t.metrics.StartWrite()
+	err := t.writePiece(src, pi)
+	t.metrics.AddDirtyBytes(-n)
+	if err != nil {
 		// Allow other threads to write this piece since we mysteriously failed.
-		piece.markEmpty()
+		t.pieces.markEmpty(pi)
+		if err == storage.ErrInvalidPieceSum {
+			return err
+		}
 		return fmt.Errorf("write piece: %s", err)
 	}
+	writeTimer.Stop()
 
-	if int(t.numComplete.Load()) == len(t.pieces) {
+	if t.pieces.numComplete() == t.pieces.len() {
+		if err := t.verifyOverrides(); err != nil {
+			return err
+		}
 		// Multiple threads may attempt to move the download file to cache, however
 		// only one will succeed while the others will receive (and ignore) file exist
 		// error.
@@ -243,6 +392,13 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 			return fmt.Errorf("download completed but failed to move file to cache directory: %s", err)
 		}
 		t.committed.Store(true)
+		if t.evicted.Swap(false) {
+			// All evicted pieces have been downloaded again.
+			if _, err := t.cads.Any().SetMetadata(
+				t.metaInfo.Digest().Hex(), &evictedMetadata{false}); err != nil {
+				log.Errorf("Error clearing evicted metadata of %s: %s", t.Digest().Hex(), err)
+			}
+		}
 	}
 
 	return nil
@@ -253,16 +409,50 @@ type opener struct {
 }
 
 func (o *opener) Open() (store.FileReader, error) {
-	return o.torrent.cads.Any().GetFileReader(o.torrent.Digest().Hex())
+	f, err := o.torrent.cads.Any().GetFileReader(o.torrent.Digest().Hex())
+	if err != nil {
+		return nil, err
+	}
+	return o.torrent.metrics.Reader(f), nil
+}
+
+// Sync commits written pieces of an incomplete torrent to disk. No-ops for
+// complete torrents, which are committed when completed.
+func (t *Torrent) Sync() error {
+	if t.Complete() {
+		return nil
+	}
+	f, err := t.cads.GetDownloadFileReadWriter(t.metaInfo.Digest().Hex())
+	if err != nil {
+		return fmt.Errorf("get download writer: %s", err)
+	}
+	t.metrics.HandleOpened()
+	defer t.metrics.HandleClosed()
+	defer f.Close()
+
+	return syncFile(f, t.metrics)
+}
+
+// syncFile commits the contents of f to disk. No-ops if f does not support
+// syncing.
+func syncFile(f store.FileReadWriter, m *storage.Metrics) error {
+	s, ok := f.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	defer m.StartFsync().Stop()
+	if err := s.Sync(); err != nil {
+		return fmt.Errorf("fsync: %s", err)
+	}
+	return nil
 }
 
 // GetPieceReader returns a reader for piece pi.
 func (t *Torrent) GetPieceReader(pi int) (storage.PieceReader, error) {
-	piece, err := t.getPiece(pi)
-	if err != nil {
+	if err := t.checkPiece(pi); err != nil {
 		return nil, err
 	}
-	if !piece.complete() {
+	if !t.pieces.isComplete(pi) {
 		return nil, errPieceNotComplete
 	}
 	return piecereader.NewFileReader(t.getFileOffset(pi), t.PieceLength(pi), &opener{t}), nil
@@ -270,22 +460,15 @@ func (t *Torrent) GetPieceReader(pi int) (storage.PieceReader, error) {
 
 // HasPiece returns if piece pi is complete.
 func (t *Torrent) HasPiece(pi int) bool {
-	piece, err := t.getPiece(pi)
-	if err != nil {
+	if err := t.checkPiece(pi); err != nil {
 		return false
 	}
-	return piece.complete()
+	return t.pieces.isComplete(pi)
 }
 
 // MissingPieces returns the indeces of all missing pieces.
 func (t *Torrent) MissingPieces() []int {
-	var missing []int
-	for i, p := range t.pieces {
-		if !p.complete() {
-			missing = append(missing, i)
-		}
-	}
-	return missing
+	return t.pieces.missing()
 }
 
 // getFileOffset calculates the offset in the torrent file given piece index.
@@ -14,11 +14,12 @@
 package agentstorage
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
-	"github.com/willf/bitset"
 
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store"
@@ -31,21 +32,64 @@ import (
 // and serving torrents from either the download or cache directory.
 type TorrentArchive struct {
 	stats          tally.Scope
+	clk            clock.Clock
 	cads           *store.CADownloadStore
 	metaInfoClient metainfoclient.Client
+
+	metrics    *storage.Metrics
+	syncWrites bool
+	writeOrder WriteOrderConfig
+
+	// writer is nil unless piece writes are reordered.
+	writer *orderedWriter
+}
+
+// Option allows setting optional parameters in TorrentArchive.
+type Option func(*TorrentArchive)
+
+// WithWriteOrder configures a TorrentArchive to reorder concurrent piece
+// writes per config.
+func WithWriteOrder(config WriteOrderConfig) Option {
+	return func(a *TorrentArchive) { a.writeOrder = config }
+}
+
+// WithSyncWrites configures a TorrentArchive to fsync pieces before marking
+// them complete, such that complete pieces survive a crash.
+func WithSyncWrites() Option {
+	return func(a *TorrentArchive) { a.syncWrites = true }
+}
+
+// WithClock configures the clock of a TorrentArchive, which defaults to the
+// system clock.
+func WithClock(clk clock.Clock) Option {
+	return func(a *TorrentArchive) { a.clk = clk }
 }
 
 // NewTorrentArchive creates a new TorrentArchive.
 func NewTorrentArchive(
 	stats tally.Scope,
 	cads *store.CADownloadStore,
-	mic metainfoclient.Client) *TorrentArchive {
+	mic metainfoclient.Client,
+	opts ...Option) *TorrentArchive {
 
 	stats = stats.Tagged(map[string]string{
 		"module": "agenttorrentarchive",
 	})
 
-	return &TorrentArchive{stats, cads, mic}
+	a := &TorrentArchive{
+		stats:          stats,
+		clk:            clock.New(),
+		cads:           cads,
+		metaInfoClient: mic,
+		metrics:        storage.NewMetrics(stats),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if config := a.writeOrder.applyDefaults(); config.enabled(cads.DownloadDir()) {
+		a.writer = newOrderedWriter(config, cads, stats, a.metrics, a.syncWrites)
+	}
+	return a
 }
 
 // Stat returns TorrentInfo for the given digest. Returns os.ErrNotExist if the
@@ -59,27 +103,26 @@ func (a *TorrentArchive) Stat(namespace string, d core.Digest) (*storage.Torrent
 	if err := a.cads.Any().GetMetadata(d.Hex(), &psm); err != nil {
 		return nil, err
 	}
-	b := bitset.New(uint(len(psm.pieces)))
-	for i, p := range psm.pieces {
-		if p.status == _complete {
-			b.Set(uint(i))
-		}
-	}
-	return storage.NewTorrentInfo(tm.MetaInfo, b), nil
+	return storage.NewTorrentInfo(tm.MetaInfo, psm.complete), nil
 }
 
 // CreateTorrent returns a Torrent for either an existing metainfo / file on
 // disk, or downloads metainfo and initializes the file. Returns ErrNotFound
-// if no metainfo was found.
-func (a *TorrentArchive) CreateTorrent(namespace string, d core.Digest) (storage.Torrent, error) {
+// if no metainfo was found. ctx bounds the metainfo download.
+func (a *TorrentArchive) CreateTorrent(
+	ctx context.Context, namespace string, d core.Digest) (storage.Torrent, error) {
+
 	var tm metadata.TorrentMeta
 	if err := a.cads.Any().GetMetadata(d.Hex(), &tm); os.IsNotExist(err) {
 		downloadTimer := a.stats.Timer("metainfo_download").Start()
-		mi, err := a.metaInfoClient.Download(namespace, d)
+		mi, err := a.metaInfoClient.Download(ctx, namespace, d)
 		if err != nil {
 			if err == metainfoclient.ErrNotFound {
 				return nil, storage.ErrNotFound
 			}
+			if err == ctx.Err() {
+				return nil, err
+			}
 			return nil, fmt.Errorf("download metainfo: %s", err)
 		}
 		downloadTimer.Stop()
@@ -105,6 +148,9 @@ func (a *TorrentArchive) CreateTorrent(namespace string, d core.Digest) (storage
 	if err != nil {
 		return nil, fmt.Errorf("initialize torrent: %s", err)
 	}
+	t.writer = a.writer
+	t.metrics = a.metrics
+	t.syncWrites = a.syncWrites
 	return t, nil
 }
 
@@ -118,6 +164,9 @@ func (a *TorrentArchive) GetTorrent(namespace string, d core.Digest) (storage.To
 	if err != nil {
 		return nil, fmt.Errorf("initialize torrent: %s", err)
 	}
+	t.writer = a.writer
+	t.metrics = a.metrics
+	t.syncWrites = a.syncWrites
 	return t, nil
 }
 
@@ -14,6 +14,8 @@
 package agentstorage
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
 	"sync"
 	"testing"
@@ -70,9 +72,9 @@ func TestTorrentArchiveStatBitfield(t *testing.T) {
 	blob := core.SizedBlobFixture(4, 1)
 	mi := blob.MetaInfo
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(mi, nil).Times(1)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil).Times(1)
 
-	tor, err := archive.CreateTorrent(namespace, mi.Digest())
+	tor, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 
 	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[2:3]), 2))
@@ -109,9 +111,9 @@ func TestTorrentArchiveCreateTorrent(t *testing.T) {
 	mi := core.MetaInfoFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(mi, nil)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
 
-	tor, err := archive.CreateTorrent(namespace, mi.Digest())
+	tor, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 	require.NotNil(tor)
 
@@ -121,7 +123,7 @@ func TestTorrentArchiveCreateTorrent(t *testing.T) {
 	require.Equal(mi, tm.MetaInfo)
 
 	// Create again reads from disk.
-	tor, err = archive.CreateTorrent(namespace, mi.Digest())
+	tor, err = archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 	require.NotNil(tor)
 }
@@ -137,9 +139,9 @@ func TestTorrentArchiveCreateTorrentNotFound(t *testing.T) {
 	mi := core.MetaInfoFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(nil, metainfoclient.ErrNotFound)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(nil, metainfoclient.ErrNotFound)
 
-	_, err := archive.CreateTorrent(namespace, mi.Digest())
+	_, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.Equal(storage.ErrNotFound, err)
 }
 
@@ -154,9 +156,9 @@ func TestTorrentArchiveDeleteTorrent(t *testing.T) {
 	mi := core.MetaInfoFixture()
 	namespace := core.TagFixture()
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(mi, nil)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
 
-	tor, err := archive.CreateTorrent(namespace, mi.Digest())
+	tor, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 	require.NotNil(tor)
 
@@ -178,14 +180,14 @@ func TestTorrentArchiveConcurrentGet(t *testing.T) {
 	namespace := core.TagFixture()
 
 	// Allow any times for concurrency below.
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(mi, nil).AnyTimes()
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil).AnyTimes()
 
 	var wg sync.WaitGroup
 	for i := 0; i < 50; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			tor, err := archive.CreateTorrent(namespace, mi.Digest())
+			tor, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 			require.NoError(err)
 			require.NotNil(tor)
 		}()
@@ -208,9 +210,9 @@ func TestTorrentArchiveGetTorrent(t *testing.T) {
 	_, err := archive.GetTorrent(namespace, mi.Digest())
 	require.Error(err)
 
-	mocks.metaInfoClient.EXPECT().Download(namespace, mi.Digest()).Return(mi, nil)
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
 
-	_, err = archive.CreateTorrent(namespace, mi.Digest())
+	_, err = archive.CreateTorrent(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 
 	// After creating the torrent, get should succeed.
@@ -218,3 +220,176 @@ func TestTorrentArchiveGetTorrent(t *testing.T) {
 	require.NoError(err)
 	require.NotNil(tor)
 }
+
+func TestTorrentArchiveAttachTorrent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	archive := mocks.new()
+
+	blob := core.SizedBlobFixture(32, pieceLength)
+	namespace := core.TagFixture()
+
+	f, err := ioutil.TempFile("", "")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(blob.Content)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	require.NoError(archive.AttachTorrent(namespace, blob.Digest, f.Name()))
+
+	tor, err := archive.GetTorrent(namespace, blob.Digest)
+	require.NoError(err)
+	require.True(tor.Complete())
+
+	r, err := tor.GetPieceReader(0)
+	require.NoError(err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob.Content[:pieceLength], b)
+
+	// Attached files must never be written to.
+	require.Equal(errAttachedReadOnly, tor.(storage.PieceEvictor).EvictPieces([]int{0}))
+
+	require.Equal(os.ErrExist, archive.AttachTorrent(namespace, blob.Digest, f.Name()))
+}
+
+func TestTorrentArchiveAttachTorrentMismatch(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	archive := mocks.new()
+
+	blob := core.SizedBlobFixture(32, pieceLength)
+	namespace := core.TagFixture()
+
+	f, err := ioutil.TempFile("", "")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(core.SizedBlobFixture(32, pieceLength).Content)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	require.Error(archive.AttachTorrent(namespace, blob.Digest, f.Name()))
+
+	_, err = archive.Stat(namespace, blob.Digest)
+	require.True(os.IsNotExist(err))
+}
+
+func TestTorrentArchiveEmitsPieceIOMetrics(t *testing.T) {
+	for _, writeOrder := range []string{WriteOrderNever, WriteOrderAlways} {
+		t.Run(writeOrder, func(t *testing.T) {
+			require := require.New(t)
+
+			mocks, cleanup := newArchiveMocks(t)
+			defer cleanup()
+
+			stats := tally.NewTestScope("", nil)
+			archive := NewTorrentArchive(
+				stats, mocks.cads, mocks.metaInfoClient,
+				WithSyncWrites(), WithWriteOrder(WriteOrderConfig{Mode: writeOrder}))
+
+			namespace := core.TagFixture()
+			blob := core.SizedBlobFixture(4, 1)
+			mi := blob.MetaInfo
+
+			mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
+
+			tor, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
+			require.NoError(err)
+
+			require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[0:1]), 0))
+
+			r, err := tor.GetPieceReader(0)
+			require.NoError(err)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(blob.Content[0:1], b)
+			require.NoError(r.Close())
+
+			require.Zero(archive.metrics.OpenHandles())
+			require.Zero(archive.metrics.DirtyBytes())
+
+			timers := stats.Snapshot().Timers()
+			for _, name := range []string{"piece_write", "piece_read", "fsync"} {
+				require.Contains(timers, name+"+module=agenttorrentarchive")
+			}
+		})
+	}
+}
+
+func TestTorrentArchiveListTorrents(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	archive := mocks.new()
+
+	mi := core.MetaInfoFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
+
+	_, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
+	require.NoError(err)
+
+	// Complete data whose metainfo was never written.
+	orphan := core.DigestFixture()
+	require.NoError(mocks.cads.CreateDownloadFile(orphan.Hex(), 8))
+	require.NoError(mocks.cads.MoveDownloadFileToCache(orphan.Hex()))
+
+	torrents, err := archive.ListTorrents()
+	require.NoError(err)
+	require.Len(torrents, 2)
+
+	byDigest := make(map[core.Digest]storage.StoredTorrent)
+	for _, st := range torrents {
+		byDigest[st.Digest] = st
+	}
+	require.False(byDigest[mi.Digest()].Complete)
+	require.True(byDigest[mi.Digest()].HasMetaInfo)
+	require.Equal(mi.Length(), byDigest[mi.Digest()].Size)
+	require.True(byDigest[orphan].Complete)
+	require.False(byDigest[orphan].HasMetaInfo)
+}
+
+func TestTorrentArchiveQuarantineTorrent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newArchiveMocks(t)
+	defer cleanup()
+
+	archive := mocks.new()
+
+	mi := core.MetaInfoFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(gomock.Any(), namespace, mi.Digest()).Return(mi, nil)
+
+	_, err := archive.CreateTorrent(context.Background(), namespace, mi.Digest())
+	require.NoError(err)
+
+	dir, err := ioutil.TempDir("", "quarantine")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(archive.QuarantineTorrent(mi.Digest(), dir))
+
+	_, err = archive.Stat(namespace, mi.Digest())
+	require.True(os.IsNotExist(err))
+
+	torrents, err := archive.ListTorrents()
+	require.NoError(err)
+	require.Empty(torrents)
+}
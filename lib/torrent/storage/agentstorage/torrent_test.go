@@ -14,6 +14,7 @@
 package agentstorage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -89,6 +90,71 @@ func TestTorrentWriteUpdatesBytesDownloadedAndBitfield(t *testing.T) {
 	require.Equal(bitsetutil.FromBools(true, false), tor.Bitfield())
 }
 
+func TestTorrentOverridePieceHash(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4, 2)
+	corrupt := core.SizedBlobFixture(4, 2)
+
+	prepareStore(cads, corrupt.MetaInfo)
+
+	tor, err := NewTorrent(cads, corrupt.MetaInfo)
+	require.NoError(err)
+
+	piece := piecereader.NewBuffer(blob.Content[:2])
+	require.Equal(storage.ErrInvalidPieceSum, tor.WritePiece(piece, 0))
+
+	require.Error(tor.OverridePieceHash(0, []byte{1}))
+	require.Error(tor.OverridePieceHash(2, blob.MetaInfo.PieceHash(0)))
+
+	require.NoError(tor.OverridePieceHash(0, blob.MetaInfo.PieceHash(0)))
+	require.Equal(blob.MetaInfo.PieceHash(0), tor.ExpectedPieceHash(0))
+	require.Equal(corrupt.MetaInfo.PieceHash(1), tor.ExpectedPieceHash(1))
+
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[:2]), 0))
+	require.True(tor.HasPiece(0))
+}
+
+func TestTorrentVerifiesDigestWithOverriddenPieceHash(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4, 2)
+
+	// The metainfo carries the right digest, but a corrupt hash of piece 0.
+	corrupt := append([]byte{^blob.Content[0]}, blob.Content[1:]...)
+	mi, err := core.NewMetaInfo(blob.Digest, bytes.NewReader(corrupt), 2)
+	require.NoError(err)
+
+	prepareStore(cads, mi)
+
+	tor, err := NewTorrent(cads, mi)
+	require.NoError(err)
+
+	// A forged hash is only caught once the blob is complete.
+	forged := []byte{blob.Content[0], ^blob.Content[1]}
+	h := mi.NewPieceHash()
+	h.Write(forged)
+	require.NoError(tor.OverridePieceHash(0, h.Sum(nil)))
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(forged), 0))
+	require.Equal(errDigestMismatch, tor.WritePiece(piecereader.NewBuffer(blob.Content[2:]), 1))
+	require.False(tor.Complete())
+	require.False(tor.HasPiece(0))
+	require.True(tor.HasPiece(1))
+	require.Equal(mi.PieceHash(0), tor.ExpectedPieceHash(0))
+	_, err = cads.Cache().GetFileStat(blob.Digest.Hex())
+	require.Error(err)
+
+	require.NoError(tor.OverridePieceHash(0, blob.MetaInfo.PieceHash(0)))
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[:2]), 0))
+	require.True(tor.Complete())
+}
+
 func TestTorrentWriteComplete(t *testing.T) {
 	require := require.New(t)
 
@@ -0,0 +1,204 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// Write order modes.
+const (
+	WriteOrderAuto   = "auto"
+	WriteOrderAlways = "always"
+	WriteOrderNever  = "never"
+)
+
+// WriteOrderConfig defines the reordering of concurrent piece writes into
+// ascending file offsets, such that spinning disks write sequentially rather
+// than seeking between randomly ordered pieces.
+type WriteOrderConfig struct {
+	// Mode is one of "auto", "always" or "never". In auto mode, writes are
+	// reordered only if the download directory resides on a rotational disk.
+	// Defaults to "never".
+	Mode string `yaml:"mode"`
+
+	// MaxBufferBytes caps the total size of piece writes held for reordering.
+	MaxBufferBytes uint64 `yaml:"max_buffer_bytes"`
+
+	// Window is the maximum duration a piece write is held while waiting for
+	// other writes to reorder it with.
+	Window time.Duration `yaml:"window"`
+}
+
+func (c WriteOrderConfig) applyDefaults() WriteOrderConfig {
+	if c.Mode == "" {
+		c.Mode = WriteOrderNever
+	}
+	if c.MaxBufferBytes == 0 {
+		c.MaxBufferBytes = 256 * memsize.MB
+	}
+	if c.Window == 0 {
+		c.Window = 20 * time.Millisecond
+	}
+	return c
+}
+
+// enabled returns whether writes to dir should be reordered.
+func (c WriteOrderConfig) enabled(dir string) bool {
+	switch c.Mode {
+	case WriteOrderAlways:
+		return true
+	case WriteOrderAuto:
+		r, err := rotational(dir)
+		if err != nil {
+			log.Warnf("Cannot detect whether %s is on a rotational disk: %s", dir, err)
+			return false
+		}
+		return r
+	default:
+		return false
+	}
+}
+
+type pendingWrite struct {
+	name   string
+	offset int64
+	data   []byte
+	errc   chan error
+}
+
+// orderedWriter batches concurrent piece writes for up to a window, and writes
+// each batch sorted by file and offset.
+type orderedWriter struct {
+	config     WriteOrderConfig
+	cads       caDownloadStore
+	stats      tally.Scope
+	metrics    *storage.Metrics
+	syncWrites bool
+	writes     chan *pendingWrite
+}
+
+func newOrderedWriter(
+	config WriteOrderConfig,
+	cads caDownloadStore,
+	stats tally.Scope,
+	metrics *storage.Metrics,
+	syncWrites bool) *orderedWriter {
+
+	w := &orderedWriter{
+		config:     config,
+		cads:       cads,
+		stats:      stats,
+		metrics:    metrics,
+		syncWrites: syncWrites,
+		writes:     make(chan *pendingWrite),
+	}
+	go w.loop()
+	return w
+}
+
+// write writes data at offset of the download file of name, blocking until
+// the batch containing the write is flushed.
+func (w *orderedWriter) write(name string, offset int64, data []byte) error {
+	pw := &pendingWrite{name, offset, data, make(chan error, 1)}
+	w.writes <- pw
+	return <-pw.errc
+}
+
+func (w *orderedWriter) loop() {
+	for first := range w.writes {
+		batch := []*pendingWrite{first}
+		size := uint64(len(first.data))
+		timer := time.NewTimer(w.config.Window)
+	collect:
+		for size < w.config.MaxBufferBytes {
+			select {
+			case pw := <-w.writes:
+				batch = append(batch, pw)
+				size += uint64(len(pw.data))
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		w.flush(batch)
+	}
+}
+
+func (w *orderedWriter) flush(batch []*pendingWrite) {
+	sort.Slice(batch, func(i, j int) bool {
+		if batch[i].name != batch[j].name {
+			return batch[i].name < batch[j].name
+		}
+		return batch[i].offset < batch[j].offset
+	})
+	w.stats.Counter("ordered_write_batches").Inc(1)
+	w.stats.Counter("ordered_writes").Inc(int64(len(batch)))
+
+	var f store.FileReadWriter
+	var fname string
+	var ferr error
+	// Successful writes are acknowledged once their file is closed, such that
+	// synced writes are only acknowledged once durable.
+	var written []*pendingWrite
+	for _, pw := range batch {
+		if f == nil || fname != pw.name {
+			if f != nil {
+				w.close(f, written)
+				written = nil
+			}
+			fname = pw.name
+			f, ferr = w.cads.GetDownloadFileReadWriter(pw.name)
+			if ferr != nil {
+				f = nil
+			} else {
+				w.metrics.HandleOpened()
+			}
+		}
+		if ferr != nil {
+			pw.errc <- fmt.Errorf("get download writer: %s", ferr)
+			continue
+		}
+		if _, err := f.WriteAt(pw.data, pw.offset); err != nil {
+			pw.errc <- fmt.Errorf("write at: %s", err)
+			continue
+		}
+		written = append(written, pw)
+	}
+	if f != nil {
+		w.close(f, written)
+	}
+}
+
+// close syncs f if configured, closes it, and acknowledges written.
+func (w *orderedWriter) close(f store.FileReadWriter, written []*pendingWrite) {
+	var err error
+	if w.syncWrites {
+		err = syncFile(f, w.metrics)
+	}
+	f.Close()
+	w.metrics.HandleClosed()
+	for _, pw := range written {
+		pw.errc <- err
+	}
+}
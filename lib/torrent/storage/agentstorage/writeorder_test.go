@@ -0,0 +1,104 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestWriteOrderConfigEnabled(t *testing.T) {
+	require := require.New(t)
+
+	require.False(WriteOrderConfig{}.applyDefaults().enabled("/tmp"))
+	require.True(WriteOrderConfig{Mode: WriteOrderAlways}.enabled("/tmp"))
+	require.False(WriteOrderConfig{Mode: WriteOrderNever}.enabled("/tmp"))
+}
+
+func TestOrderedWriterWritesConcurrentPieces(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(64, 4)
+
+	prepareStore(cads, blob.MetaInfo)
+
+	tor, err := NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+
+	stats := tally.NewTestScope("", nil)
+	tor.writer = newOrderedWriter(WriteOrderConfig{
+		Mode:   WriteOrderAlways,
+		Window: 50 * time.Millisecond,
+	}.applyDefaults(), cads, stats, storage.NewMetrics(tally.NoopScope), false)
+
+	var wg sync.WaitGroup
+	for i := tor.NumPieces() - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := i * int(blob.MetaInfo.PieceLength())
+			end := start + int(tor.PieceLength(i))
+			require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[start:end]), i))
+		}(i)
+	}
+	wg.Wait()
+
+	require.True(tor.Complete())
+
+	reader, err := cads.Cache().GetFileReader(blob.MetaInfo.Digest().Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(err)
+	require.Equal(blob.Content, b)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(tor.NumPieces()), counters["ordered_writes+"].Value())
+	require.True(counters["ordered_write_batches+"].Value() < int64(tor.NumPieces()))
+}
+
+func TestOrderedWriterRejectsInvalidPiece(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(8, 4)
+
+	prepareStore(cads, blob.MetaInfo)
+
+	tor, err := NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+	tor.writer = newOrderedWriter(
+		WriteOrderConfig{Mode: WriteOrderAlways}.applyDefaults(),
+		cads,
+		tally.NoopScope,
+		storage.NewMetrics(tally.NoopScope),
+		false)
+
+	require.Error(tor.WritePiece(piecereader.NewBuffer([]byte("xxxx")), 0))
+	require.False(tor.HasPiece(0))
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+
+	"github.com/uber/kraken/lib/store"
+)
+
+// Metrics instruments the piece I/O of storage implementations. Timers are
+// emitted for piece writes, reads, verification reads and fsyncs, and gauges
+// for the number of open file handles and the bytes of pieces being written.
+type Metrics struct {
+	stats       tally.Scope
+	openHandles *atomic.Int64
+	dirtyBytes  *atomic.Int64
+}
+
+// NewMetrics creates a new Metrics which emits through stats.
+func NewMetrics(stats tally.Scope) *Metrics {
+	return &Metrics{
+		stats:       stats,
+		openHandles: atomic.NewInt64(0),
+		dirtyBytes:  atomic.NewInt64(0),
+	}
+}
+
+// StartWrite starts timing a piece write.
+func (m *Metrics) StartWrite() tally.Stopwatch {
+	return m.stats.Timer("piece_write").Start()
+}
+
+// StartVerifyRead starts timing a read of a piece for verification.
+func (m *Metrics) StartVerifyRead() tally.Stopwatch {
+	return m.stats.Timer("piece_verify_read").Start()
+}
+
+// StartFsync starts timing an fsync.
+func (m *Metrics) StartFsync() tally.Stopwatch {
+	return m.stats.Timer("fsync").Start()
+}
+
+// HandleOpened records a file handle being opened.
+func (m *Metrics) HandleOpened() {
+	m.stats.Gauge("open_handles").Update(float64(m.openHandles.Inc()))
+}
+
+// HandleClosed records a file handle being closed.
+func (m *Metrics) HandleClosed() {
+	m.stats.Gauge("open_handles").Update(float64(m.openHandles.Dec()))
+}
+
+// OpenHandles returns the number of open file handles.
+func (m *Metrics) OpenHandles() int64 {
+	return m.openHandles.Load()
+}
+
+// AddDirtyBytes adds n to the bytes of pieces being written. Negative n
+// records pieces which are no longer being written.
+func (m *Metrics) AddDirtyBytes(n int64) {
+	m.stats.Gauge("dirty_bytes").Update(float64(m.dirtyBytes.Add(n)))
+}
+
+// DirtyBytes returns the bytes of pieces being written.
+func (m *Metrics) DirtyBytes() int64 {
+	return m.dirtyBytes.Load()
+}
+
+// Reader records f as an open file handle until closed, and times the reads
+// of f as piece reads.
+func (m *Metrics) Reader(f store.FileReader) store.FileReader {
+	m.HandleOpened()
+	return &instrumentedReader{FileReader: f, metrics: m, closed: atomic.NewBool(false)}
+}
+
+type instrumentedReader struct {
+	store.FileReader
+	metrics *Metrics
+	closed  *atomic.Bool
+}
+
+func (r *instrumentedReader) Read(p []byte) (int, error) {
+	defer r.metrics.stats.Timer("piece_read").Start().Stop()
+	return r.FileReader.Read(p)
+}
+
+func (r *instrumentedReader) ReadAt(p []byte, off int64) (int, error) {
+	defer r.metrics.stats.Timer("piece_read").Start().Stop()
+	return r.FileReader.ReadAt(p, off)
+}
+
+func (r *instrumentedReader) Close() error {
+	if !r.closed.Swap(true) {
+		r.metrics.HandleClosed()
+	}
+	return r.FileReader.Close()
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+type bufferFileReader struct {
+	*bytes.Reader
+}
+
+func (r bufferFileReader) Close() error { return nil }
+
+func TestMetricsReaderTracksOpenHandles(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	m := NewMetrics(stats)
+
+	r := m.Reader(bufferFileReader{bytes.NewReader([]byte("some content"))})
+	require.Equal(int64(1), m.OpenHandles())
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal("some content", string(b))
+
+	// Closing twice only closes the handle once.
+	require.NoError(r.Close())
+	require.NoError(r.Close())
+	require.Zero(m.OpenHandles())
+
+	require.Contains(stats.Snapshot().Timers(), "piece_read+")
+	require.Equal(float64(0), stats.Snapshot().Gauges()["open_handles+"].Value())
+}
+
+func TestMetricsDirtyBytes(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMetrics(tally.NoopScope)
+	m.AddDirtyBytes(10)
+	m.AddDirtyBytes(5)
+	m.AddDirtyBytes(-10)
+	require.Equal(int64(5), m.DirtyBytes())
+}
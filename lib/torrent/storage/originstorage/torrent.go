@@ -22,6 +22,7 @@ import (
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 
+	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
 	"go.uber.org/atomic"
 )
@@ -37,6 +38,7 @@ type Torrent struct {
 	metaInfo    *core.MetaInfo
 	cas         *store.CAStore
 	numComplete *atomic.Int32
+	metrics     *storage.Metrics
 }
 
 // NewTorrent creates a new Torrent.
@@ -45,6 +47,7 @@ func NewTorrent(cas *store.CAStore, mi *core.MetaInfo) (*Torrent, error) {
 		cas:         cas,
 		metaInfo:    mi,
 		numComplete: atomic.NewInt32(int32(mi.NumPieces())),
+		metrics:     storage.NewMetrics(tally.NoopScope),
 	}, nil
 }
 
@@ -63,6 +66,11 @@ func (t *Torrent) InfoHash() core.InfoHash {
 	return t.metaInfo.InfoHash()
 }
 
+// MetaInfo returns the metainfo of the torrent.
+func (t *Torrent) MetaInfo() *core.MetaInfo {
+	return t.metaInfo
+}
+
 // NumPieces returns the number of pieces in the torrent.
 func (t *Torrent) NumPieces() int {
 	return t.metaInfo.NumPieces()
@@ -113,7 +121,11 @@ type opener struct {
 }
 
 func (o *opener) Open() (store.FileReader, error) {
-	return o.torrent.cas.GetCacheFileReader(o.torrent.Digest().Hex())
+	f, err := o.torrent.cas.GetCacheFileReader(o.torrent.Digest().Hex())
+	if err != nil {
+		return nil, err
+	}
+	return o.torrent.metrics.Reader(f), nil
 }
 
 // GetPieceReader returns a reader for piece pi.
@@ -14,6 +14,7 @@
 package originstorage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -24,6 +25,7 @@ import (
 	"github.com/uber/kraken/lib/store/metadata"
 	"github.com/uber/kraken/lib/torrent/storage"
 
+	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
 )
 
@@ -32,13 +34,35 @@ import (
 type TorrentArchive struct {
 	cas           *store.CAStore
 	blobRefresher *blobrefresh.Refresher
+	metrics       *storage.Metrics
+}
+
+// Option allows setting optional parameters in TorrentArchive.
+type Option func(*TorrentArchive)
+
+// WithStats configures a TorrentArchive to emit piece I/O metrics through
+// stats.
+func WithStats(stats tally.Scope) Option {
+	return func(a *TorrentArchive) {
+		a.metrics = storage.NewMetrics(stats.Tagged(map[string]string{
+			"module": "origintorrentarchive",
+		}))
+	}
 }
 
 // NewTorrentArchive creates a new TorrentArchive.
 func NewTorrentArchive(
-	cas *store.CAStore, blobRefresher *blobrefresh.Refresher) *TorrentArchive {
+	cas *store.CAStore, blobRefresher *blobrefresh.Refresher, opts ...Option) *TorrentArchive {
 
-	return &TorrentArchive{cas, blobRefresher}
+	a := &TorrentArchive{
+		cas:           cas,
+		blobRefresher: blobRefresher,
+		metrics:       storage.NewMetrics(tally.NoopScope),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 func (a *TorrentArchive) getMetaInfo(namespace string, d core.Digest) (*core.MetaInfo, error) {
@@ -69,7 +93,8 @@ func (a *TorrentArchive) Stat(namespace string, d core.Digest) (*storage.Torrent
 }
 
 // CreateTorrent is not supported.
-func (a *TorrentArchive) CreateTorrent(namespace string, d core.Digest) (storage.Torrent, error) {
+func (a *TorrentArchive) CreateTorrent(
+	ctx context.Context, namespace string, d core.Digest) (storage.Torrent, error) {
 	return nil, errors.New("not supported for origin")
 }
 
@@ -85,6 +110,7 @@ func (a *TorrentArchive) GetTorrent(namespace string, d core.Digest) (storage.To
 	if err != nil {
 		return nil, fmt.Errorf("initialize torrent: %s", err)
 	}
+	t.metrics = a.metrics
 	return t, nil
 }
 
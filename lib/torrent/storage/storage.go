@@ -14,8 +14,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/uber/kraken/core"
 
@@ -29,6 +31,10 @@ var ErrNotFound = errors.New("torrent not found")
 // complete.
 var ErrPieceComplete = errors.New("piece is already complete")
 
+// ErrInvalidPieceSum occurs when Torrent cannot write a piece because its
+// content does not match the expected sum of the piece.
+var ErrInvalidPieceSum = errors.New("invalid piece sum")
+
 // PieceReader defines operations for lazy piece reading.
 type PieceReader interface {
 	io.ReadCloser
@@ -44,6 +50,7 @@ type Torrent interface {
 	PieceLength(piece int) int64
 	MaxPieceLength() int64
 	InfoHash() core.InfoHash
+	MetaInfo() *core.MetaInfo
 	Complete() bool
 	BytesDownloaded() int64
 	Bitfield() *bitset.BitSet
@@ -56,10 +63,101 @@ type Torrent interface {
 	GetPieceReader(piece int) (PieceReader, error)
 }
 
+// PieceEvictor is implemented by Torrents which support evicting individual
+// pieces from disk. Evicted pieces are marked missing and may be downloaded
+// again on demand.
+type PieceEvictor interface {
+	EvictPieces(pieces []int) error
+
+	// Evicted returns true if the torrent has had pieces evicted since it was
+	// last complete.
+	Evicted() bool
+}
+
+// PieceHashOverrider is implemented by Torrents whose expected piece hashes
+// may be overridden, e.g. when peers agree that the local metainfo of a piece
+// is corrupt. Hashes are encoded as the sum of the piece hash algorithm of the
+// torrent.
+type PieceHashOverrider interface {
+	ExpectedPieceHash(piece int) []byte
+	OverridePieceHash(piece int, hash []byte) error
+}
+
+// Syncer is implemented by Torrents whose piece writes may not yet be durable,
+// and which can commit them to disk.
+type Syncer interface {
+	Sync() error
+}
+
+// DiskUsageReporter is implemented by TorrentArchives which can report the
+// utilization of the disk torrents are stored on, as a fraction between 0 and 1.
+type DiskUsageReporter interface {
+	DiskUsage() (float64, error)
+}
+
+// Attacher is implemented by TorrentArchives which can register an existing
+// file on disk as a complete torrent without copying it.
+type Attacher interface {
+	AttachTorrent(namespace string, d core.Digest, path string) error
+}
+
+// LegacyServer is implemented by TorrentArchives which retain the previous
+// metainfo of re-chunked torrents, such that peers which still use the
+// previous metainfo may be served from the same content.
+type LegacyServer interface {
+	// Rechunk replaces the metainfo of the complete torrent of d with metainfo
+	// of pieceLength, and retains the previous metainfo for window.
+	Rechunk(d core.Digest, pieceLength int64, window time.Duration) (*core.MetaInfo, error)
+
+	// GetLegacyTorrent returns a Torrent of the retained metainfo of d, if its
+	// info hash is h. Returns ErrNotFound otherwise.
+	GetLegacyTorrent(d core.Digest, h core.InfoHash) (Torrent, error)
+
+	// LegacyInfoHash returns the info hash of the retained metainfo of d.
+	// Returns ErrNotFound if no metainfo is retained.
+	LegacyInfoHash(d core.Digest) (core.InfoHash, error)
+}
+
+// StoredTorrent describes the data of a torrent on disk.
+type StoredTorrent struct {
+	Digest  core.Digest
+	Size    int64
+	ModTime time.Time
+
+	// Complete is false for partially downloaded data.
+	Complete bool
+
+	// HasMetaInfo is false if the metainfo of the data is missing, in which
+	// case the data cannot be served nor resumed.
+	HasMetaInfo bool
+}
+
+// Scanner is implemented by TorrentArchives which can enumerate the torrent
+// data on disk, e.g. to collect data orphaned by crashes.
+type Scanner interface {
+	ListTorrents() ([]StoredTorrent, error)
+
+	// QuarantineTorrent moves the data of d into dir rather than deleting it.
+	QuarantineTorrent(d core.Digest, dir string) error
+}
+
 // TorrentArchive creates and open torrent file
 type TorrentArchive interface {
 	Stat(namespace string, d core.Digest) (*TorrentInfo, error)
-	CreateTorrent(namespace string, d core.Digest) (Torrent, error)
+	CreateTorrent(ctx context.Context, namespace string, d core.Digest) (Torrent, error)
 	GetTorrent(namespace string, d core.Digest) (Torrent, error)
 	DeleteTorrent(d core.Digest) error
 }
+
+// Tierer is implemented by TorrentArchives which store complete torrents
+// across a hot and a cold tier, e.g. SSD and HDD. Torrents may be read from
+// either tier.
+type Tierer interface {
+	// Promote moves the torrent for d to the hot tier. No-op if the torrent
+	// is already in the hot tier.
+	Promote(d core.Digest) error
+
+	// Demote moves the complete torrent for d to the cold tier. No-op if the
+	// torrent is already in the cold tier.
+	Demote(d core.Digest) error
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config defines reverse tunnel configuration. Peers which cannot accept
+// inbound connections register with one or more relay peers, which accept
+// connections on their behalf and forward them over reverse connections opened
+// by the registered peer.
+//
+// A registered peer must announce an address which routes to the port it
+// registered on the relays, e.g. the address of a relay, such that other
+// peers dial the relay transparently.
+type Config struct {
+	// Relays are the tunnel server addresses of relays the local peer
+	// registers with. If empty, no tunnels are registered.
+	Relays []string `yaml:"relays"`
+
+	// ServerAddr, if set, runs a relay tunnel server on the address, which
+	// accepts registrations from other peers.
+	ServerAddr string `yaml:"server_addr"`
+
+	// Secret authenticates registrations and relay requests, and must be
+	// shared by relays and the peers using them. Relays reject all
+	// registrations and relay requests if no secret is configured.
+	Secret string `yaml:"secret"`
+
+	// Registration restricts the tunnel listeners relays open on behalf of
+	// registered peers.
+	Registration RegistrationConfig `yaml:"registration"`
+
+	// DialTimeout bounds dialing relays and the handshake of the tunnel
+	// protocol.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+
+	// OpenTimeout bounds how long relays wait for a registered peer to open a
+	// reverse connection, once a connection was accepted on its behalf.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+
+	// KeepaliveInterval is the interval relays ping registered peers in.
+	// Registered peers reconnect if no ping was received for three intervals.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+
+	// RetryInterval is the delay between attempts to register with a relay.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// RelayVia are the tunnel server addresses of relays which outgoing
+	// connections are routed through when a peer cannot be dialed directly.
+	RelayVia []string `yaml:"relay_via"`
+
+	// Relay configures the tunnel server to forward connections between
+	// peers which cannot reach each other directly.
+	Relay RelayConfig `yaml:"relay"`
+}
+
+// RegistrationConfig defines the tunnel listeners a relay opens on behalf of
+// registered peers. Relays reject all registrations unless BindAddr and the
+// port range are configured.
+type RegistrationConfig struct {
+	// BindAddr is the address of the interface tunnel listeners bind to.
+	BindAddr string `yaml:"bind_addr"`
+
+	// MinPort and MaxPort bound the ports peers may register, inclusive.
+	MinPort int `yaml:"min_port"`
+	MaxPort int `yaml:"max_port"`
+}
+
+// check returns an error if port may not be registered.
+func (c RegistrationConfig) check(port int) error {
+	if c.BindAddr == "" || c.MinPort == 0 || c.MaxPort == 0 {
+		return errors.New("registrations not configured")
+	}
+	if port < c.MinPort || port > c.MaxPort {
+		return fmt.Errorf("port %d outside of range [%d, %d]", port, c.MinPort, c.MaxPort)
+	}
+	return nil
+}
+
+// RelayConfig defines forwarding of connections by a relay. Relays always
+// dial targets directly, and reject targets which are relays themselves, such
+// that relayed paths are never longer than one hop. Relays only dial tunnels
+// registered with them, and targets within AllowedCIDRs.
+type RelayConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// AllowedCIDRs are the networks of the peers which may be relayed to,
+	// e.g. the networks of the cluster.
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+
+	// MaxRelayedBytes caps the bytes forwarded by the relay in both
+	// directions per Window. Once reached, relayed connections are closed and
+	// new relay requests are rejected until the window ends. If 0, relayed
+	// bytes are not capped.
+	MaxRelayedBytes uint64 `yaml:"max_relayed_bytes"`
+
+	// Window is the period MaxRelayedBytes applies to.
+	Window time.Duration `yaml:"window"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = 5 * time.Second
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = 10 * time.Second
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 5 * time.Second
+	}
+	if c.Relay.Window == 0 {
+		c.Relay.Window = time.Minute
+	}
+	return c
+}
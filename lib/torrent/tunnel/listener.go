@@ -0,0 +1,198 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// ErrListenerClosed is returned by Accept once the Listener is closed.
+var ErrListenerClosed = errors.New("tunnel listener closed")
+
+// Listener is the registered peer side of reverse tunnels. It maintains a
+// control conn to each relay, and yields the data conns opened in response to
+// relays as accepted connections. Listener implements net.Listener.
+type Listener struct {
+	config Config
+	port   int
+	stats  tally.Scope
+	logger *zap.SugaredLogger
+
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewListener creates a new Listener which registers port with all relays
+// of config.
+func NewListener(
+	config Config, port int, stats tally.Scope, logger *zap.SugaredLogger) *Listener {
+
+	l := &Listener{
+		config: config.applyDefaults(),
+		port:   port,
+		stats: stats.Tagged(map[string]string{
+			"module": "tunnellistener",
+		}),
+		logger: logger,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	for _, relay := range l.config.Relays {
+		l.wg.Add(1)
+		go l.maintain(relay)
+	}
+	return l
+}
+
+// Accept waits for the next forwarded connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes all control conns and unblocks Accept.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+	})
+	return nil
+}
+
+// Addr returns the address of the first relay.
+func (l *Listener) Addr() net.Addr {
+	return relayAddr(l.config.Relays)
+}
+
+type relayAddr []string
+
+func (a relayAddr) Network() string { return "tunnel" }
+
+func (a relayAddr) String() string {
+	if len(a) == 0 {
+		return ""
+	}
+	return a[0]
+}
+
+// maintain registers with relay, and registers again whenever the control
+// conn breaks.
+func (l *Listener) maintain(relay string) {
+	defer l.wg.Done()
+
+	for {
+		if err := l.serve(relay); err != nil {
+			l.stats.Counter("control_errors").Inc(1)
+			l.logger.With("relay", relay).Infof("Tunnel control conn failed: %s", err)
+		}
+		select {
+		case <-time.After(l.config.RetryInterval):
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// serve registers with relay and opens data conns as requested, until the
+// control conn breaks or l is closed.
+func (l *Listener) serve(relay string) error {
+	control, err := net.DialTimeout("tcp", relay, l.config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-l.done:
+			control.Close()
+		case <-stop:
+		}
+	}()
+
+	control.SetDeadline(time.Now().Add(l.config.DialTimeout))
+	if err := writeRegister(control, l.port); err != nil {
+		return err
+	}
+	n, err := readNonce(control)
+	if err != nil {
+		return err
+	}
+	if _, err := control.Write(registrationMAC(l.config.Secret, n, l.port)); err != nil {
+		return err
+	}
+	status, err := readByte(control)
+	if err != nil {
+		return err
+	}
+	if status != statusOK {
+		return errRegistrationRejected
+	}
+	control.SetWriteDeadline(time.Time{})
+	l.logger.With("relay", relay).Infof("Registered tunnel on port %d", l.port)
+
+	for {
+		control.SetReadDeadline(time.Now().Add(3 * l.config.KeepaliveInterval))
+		op, err := readByte(control)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opPing:
+		case opOpen:
+			t, err := readToken(control)
+			if err != nil {
+				return err
+			}
+			go l.open(relay, t)
+		default:
+			return errors.New("unknown op")
+		}
+	}
+}
+
+// open opens a data conn to relay for t, and yields it from Accept.
+func (l *Listener) open(relay string, t token) {
+	nc, err := net.DialTimeout("tcp", relay, l.config.DialTimeout)
+	if err != nil {
+		l.stats.Counter("open_errors").Inc(1)
+		return
+	}
+	if err := writeToken(nc, opAccept, t); err != nil {
+		l.stats.Counter("open_errors").Inc(1)
+		nc.Close()
+		return
+	}
+	select {
+	case l.conns <- nc:
+		l.stats.Counter("accepted_conns").Inc(1)
+	case <-l.done:
+		nc.Close()
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+)
+
+// Tunnel protocol messages are fixed size, and begin with an op byte:
+//
+//	register: op | port (2 bytes)  -- peer to relay, answered by a nonce.
+//	auth:     mac (32 bytes)       -- peer to relay, answered by a status byte.
+//	open:     op | token (8 bytes) -- relay to peer, over the control conn.
+//	accept:   op | token (8 bytes) -- peer to relay, over a new data conn.
+//	ping:     op                   -- relay to peer, over the control conn.
+//
+// The mac of auth is the HMAC-SHA256 of the nonce (16 bytes) and port, keyed
+// by the secret shared by relays and registered peers. Once accept is sent,
+// the data conn carries the raw stream of the forwarded connection.
+//
+// Relay requests are variable size, and are authenticated like registrations:
+//
+//	relay:    op | len (2 bytes) | target address (len bytes)
+//	          -- peer to relay, answered by a nonce.
+//	auth:     mac (32 bytes)  -- peer to relay, answered by a status byte.
+//
+// The mac of a relay request is the HMAC-SHA256 of the relay op, the nonce
+// and the target address. Once the relay answers with statusOK, the conn
+// carries the raw stream of the connection to the target.
+const (
+	opRegister byte = iota + 1
+	opOpen
+	opAccept
+	opPing
+	opRelay
+)
+
+const (
+	statusOK byte = iota
+	statusError
+)
+
+var errRegistrationRejected = errors.New("relay rejected registration")
+
+type token [8]byte
+
+type nonce [16]byte
+
+// registrationMAC authenticates the registration of port in response to n.
+func registrationMAC(secret string, n nonce, port int) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(n[:])
+	p := make([]byte, 2)
+	binary.BigEndian.PutUint16(p, uint16(port))
+	m.Write(p)
+	return m.Sum(nil)
+}
+
+// relayMAC authenticates the relay request for addr in response to n.
+func relayMAC(secret string, n nonce, addr string) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte{opRelay})
+	m.Write(n[:])
+	m.Write([]byte(addr))
+	return m.Sum(nil)
+}
+
+func readNonce(r io.Reader) (nonce, error) {
+	var n nonce
+	_, err := io.ReadFull(r, n[:])
+	return n, err
+}
+
+func readMAC(r io.Reader) ([]byte, error) {
+	b := make([]byte, sha256.Size)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func writeRegister(w io.Writer, port int) error {
+	b := make([]byte, 3)
+	b[0] = opRegister
+	binary.BigEndian.PutUint16(b[1:], uint16(port))
+	_, err := w.Write(b)
+	return err
+}
+
+func writeToken(w io.Writer, op byte, t token) error {
+	b := make([]byte, 1+len(t))
+	b[0] = op
+	copy(b[1:], t[:])
+	_, err := w.Write(b)
+	return err
+}
+
+func readToken(r io.Reader) (token, error) {
+	var t token
+	_, err := io.ReadFull(r, t[:])
+	return t, err
+}
+
+func readPort(r io.Reader) (int, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+func writeRelay(w io.Writer, addr string) error {
+	if len(addr) > math.MaxUint16 {
+		return errors.New("address too long")
+	}
+	b := make([]byte, 3+len(addr))
+	b[0] = opRelay
+	binary.BigEndian.PutUint16(b[1:], uint16(len(addr)))
+	copy(b[3:], addr)
+	_, err := w.Write(b)
+	return err
+}
+
+func readAddr(r io.Reader) (string, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	addr := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
+
+func readByte(r io.Reader) (byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	return b[0], err
+}
+
+// splice copies data between a and b in both directions until either side is
+// closed, then closes both.
+func splice(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errRelayRejected    = errors.New("relay rejected request")
+	errRelayCapExceeded = errors.New("relayed bytes cap exceeded")
+)
+
+// relayer forwards connections between peers on behalf of a Server.
+type relayer struct {
+	config  RelayConfig
+	allowed []*net.IPNet
+	now     func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes uint64
+}
+
+func newRelayer(config RelayConfig) (*relayer, error) {
+	var allowed []*net.IPNet
+	for _, c := range config.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("allowed cidr: %s", err)
+		}
+		allowed = append(allowed, n)
+	}
+	return &relayer{config: config, allowed: allowed, now: time.Now}, nil
+}
+
+// allows returns true if ip is within the allowed networks of r.
+func (r *relayer) allows(ip net.IP) bool {
+	for _, n := range r.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// roll starts a new window if the current window has ended. Must be called
+// with r.mu held.
+func (r *relayer) roll() {
+	if now := r.now(); now.Sub(r.windowStart) >= r.config.Window {
+		r.windowStart = now
+		r.windowBytes = 0
+	}
+}
+
+// add records n relayed bytes in the current window. Returns false if the
+// relayed bytes cap of the window is exceeded.
+func (r *relayer) add(n uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll()
+	r.windowBytes += n
+	return r.config.MaxRelayedBytes == 0 || r.windowBytes <= r.config.MaxRelayedBytes
+}
+
+// exhausted returns true if the relayed bytes cap of the current window was
+// reached.
+func (r *relayer) exhausted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll()
+	return r.config.MaxRelayedBytes > 0 && r.windowBytes >= r.config.MaxRelayedBytes
+}
+
+// copy copies src to dst until either fails, or the relayed bytes cap is
+// exceeded. Returns the number of bytes copied.
+func (r *relayer) copy(dst io.Writer, src io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !r.add(uint64(n)) {
+				return total, errRelayCapExceeded
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// relay handles a relay request of nc for a connection to addr.
+func (s *Server) relay(nc net.Conn, addr string) {
+	target, err := s.checkRelayTarget(addr)
+	if err != nil {
+		s.stats.Counter("relay_rejections").Inc(1)
+		s.logger.Infof("Rejecting relay request of %s: %s", nc.RemoteAddr(), err)
+		nc.Write([]byte{statusError})
+		nc.Close()
+		return
+	}
+	// Targets are always dialed directly, and never through other relays. The
+	// resolved address is dialed, such that the checked address is the one
+	// connected to.
+	tc, err := net.DialTimeout("tcp", target.String(), s.config.DialTimeout)
+	if err != nil {
+		s.stats.Counter("relay_dial_errors").Inc(1)
+		nc.Write([]byte{statusError})
+		nc.Close()
+		return
+	}
+	if _, err := nc.Write([]byte{statusOK}); err != nil {
+		nc.Close()
+		tc.Close()
+		return
+	}
+	s.stats.Counter("relayed_conns").Inc(1)
+
+	sent := make(chan int64, 1)
+	go func() {
+		n, _ := s.relayer.copy(tc, nc)
+		tc.Close()
+		nc.Close()
+		sent <- n
+	}()
+	received, _ := s.relayer.copy(nc, tc)
+	tc.Close()
+	nc.Close()
+
+	s.stats.Counter("relayed_bytes").Inc(received + <-sent)
+}
+
+// checkRelayTarget resolves addr, and rejects relay requests which cannot be
+// served. Only tunnels registered with the relay, and targets within the
+// allowed networks are relayed to. Targets which are relays themselves are
+// rejected, such that relayed paths are never longer than one hop.
+func (s *Server) checkRelayTarget(addr string) (*net.TCPAddr, error) {
+	if !s.config.Relay.Enable {
+		return nil, errors.New("relaying disabled")
+	}
+	if s.relayer.exhausted() {
+		return nil, errRelayCapExceeded
+	}
+	target, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", err)
+	}
+	if s.isRelay(target) {
+		return nil, errors.New("target is a relay")
+	}
+	if target.IP.IsLoopback() || isLocalIP(target.IP) {
+		s.mu.Lock()
+		_, registered := s.tunnels[target.Port]
+		s.mu.Unlock()
+		if registered {
+			return target, nil
+		}
+	}
+	if !s.relayer.allows(target.IP) {
+		return nil, errors.New("target not allowed")
+	}
+	return target, nil
+}
+
+// isRelay returns true if target is the tunnel server of a relay. Relays of a
+// cluster are assumed to share the port of their tunnel servers, so any
+// target on the port of s is rejected, as well as all configured relays.
+func (s *Server) isRelay(target *net.TCPAddr) bool {
+	s.mu.Lock()
+	l := s.listener
+	s.mu.Unlock()
+	if l != nil {
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok && tcp.Port == target.Port {
+			return true
+		}
+	}
+	var relays []string
+	relays = append(relays, s.config.Relays...)
+	relays = append(relays, s.config.RelayVia...)
+	for _, r := range relays {
+		a, err := net.ResolveTCPAddr("tcp", r)
+		if err != nil {
+			continue
+		}
+		if a.Port == target.Port && (a.IP.Equal(target.IP) || a.IP == nil || a.IP.IsUnspecified()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialRelay connects to addr through the relay at relay, authenticating
+// with secret.
+func DialRelay(ctx context.Context, relay, addr, secret string) (net.Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", relay)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	if err := writeRelay(nc, addr); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	n, err := readNonce(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if _, err := nc.Write(relayMAC(secret, n, addr)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	status, err := readByte(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if status != statusOK {
+		nc.Close()
+		return nil, errRelayRejected
+	}
+	nc.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+// RelayDialer returns a dial function which connects through the relays of
+// config, trying each relay in order and authenticating with the secret of
+// config. Returns nil if no relays are configured.
+func RelayDialer(config Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(config.RelayVia) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var errs []error
+		for _, relay := range config.RelayVia {
+			nc, err := DialRelay(ctx, relay, addr, config.Secret)
+			if err == nil {
+				return nc, nil
+			}
+			errs = append(errs, fmt.Errorf("relay %s: %s", relay, err))
+		}
+		return nil, fmt.Errorf("all relays failed: %v", errs)
+	}
+}
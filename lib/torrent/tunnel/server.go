@@ -0,0 +1,354 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// Server is the relay side of reverse tunnels. Peers register a port with the
+// Server over a control conn, and the Server listens on the port on their
+// behalf. Each accepted connection is forwarded to the registered peer over a
+// data conn the peer opens back to the Server upon request.
+//
+// If relaying is enabled, the Server also forwards connections of peers which
+// cannot reach their target directly.
+type Server struct {
+	config  Config
+	stats   tally.Scope
+	logger  *zap.SugaredLogger
+	relayer *relayer
+
+	mu       sync.Mutex
+	pending  map[token]chan net.Conn
+	tunnels  map[int]net.Listener
+	listener net.Listener
+	closed   bool
+}
+
+// NewServer creates a new Server.
+func NewServer(config Config, stats tally.Scope, logger *zap.SugaredLogger) (*Server, error) {
+	config = config.applyDefaults()
+	relayer, err := newRelayer(config.Relay)
+	if err != nil {
+		return nil, fmt.Errorf("relay: %s", err)
+	}
+	return &Server{
+		config:  config,
+		relayer: relayer,
+		stats: stats.Tagged(map[string]string{
+			"module": "tunnelserver",
+		}),
+		logger:  logger,
+		pending: make(map[token]chan net.Conn),
+		tunnels: make(map[int]net.Listener),
+	}, nil
+}
+
+// Serve accepts tunnel protocol connections on l until s is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.handle(nc)
+	}
+}
+
+// Close stops accepting registrations and closes all tunnel listeners. Spliced
+// connections are left open until either side closes them.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, l := range s.tunnels {
+		l.Close()
+	}
+}
+
+func (s *Server) handle(nc net.Conn) {
+	nc.SetReadDeadline(time.Now().Add(s.config.DialTimeout))
+	op, err := readByte(nc)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	switch op {
+	case opRegister:
+		port, err := readPort(nc)
+		if err != nil {
+			nc.Close()
+			return
+		}
+		if err := s.authenticate(nc, port); err != nil {
+			s.stats.Counter("registration_rejections").Inc(1)
+			s.logger.Infof("Rejecting tunnel registration of %s: %s", nc.RemoteAddr(), err)
+			nc.Write([]byte{statusError})
+			nc.Close()
+			return
+		}
+		nc.SetReadDeadline(time.Time{})
+		s.register(nc, port)
+	case opAccept:
+		t, err := readToken(nc)
+		if err != nil {
+			nc.Close()
+			return
+		}
+		nc.SetReadDeadline(time.Time{})
+		s.accept(nc, t)
+	case opRelay:
+		addr, err := readAddr(nc)
+		if err != nil {
+			nc.Close()
+			return
+		}
+		if err := s.authenticateRelay(nc, addr); err != nil {
+			s.stats.Counter("relay_rejections").Inc(1)
+			s.logger.Infof("Rejecting relay request of %s: %s", nc.RemoteAddr(), err)
+			nc.Write([]byte{statusError})
+			nc.Close()
+			return
+		}
+		nc.SetReadDeadline(time.Time{})
+		s.relay(nc, addr)
+	default:
+		s.logger.Infof("Closing tunnel conn from %s: unknown op %d", nc.RemoteAddr(), op)
+		nc.Close()
+	}
+}
+
+// authenticate challenges the peer of control to prove it holds the shared
+// secret, and checks whether port may be registered.
+func (s *Server) authenticate(control net.Conn, port int) error {
+	if err := s.challenge(control, func(n nonce) []byte {
+		return registrationMAC(s.config.Secret, n, port)
+	}); err != nil {
+		return err
+	}
+	return s.config.Registration.check(port)
+}
+
+// authenticateRelay challenges the peer of nc to prove it holds the shared
+// secret before relaying its connection to addr.
+func (s *Server) authenticateRelay(nc net.Conn, addr string) error {
+	return s.challenge(nc, func(n nonce) []byte {
+		return relayMAC(s.config.Secret, n, addr)
+	})
+}
+
+// challenge sends a nonce to the peer of nc, and checks the mac it answers
+// with against the mac computed by expected.
+func (s *Server) challenge(nc net.Conn, expected func(nonce) []byte) error {
+	var n nonce
+	if _, err := rand.Read(n[:]); err != nil {
+		return fmt.Errorf("nonce: %s", err)
+	}
+	if _, err := nc.Write(n[:]); err != nil {
+		return err
+	}
+	mac, err := readMAC(nc)
+	if err != nil {
+		return err
+	}
+	if s.config.Secret == "" {
+		return errors.New("no secret configured")
+	}
+	if !hmac.Equal(mac, expected(n)) {
+		return errors.New("invalid mac")
+	}
+	return nil
+}
+
+// register listens on port on behalf of the peer of control, until control
+// is closed.
+func (s *Server) register(control net.Conn, port int) {
+	defer control.Close()
+
+	l, err := s.listen(port)
+	if err != nil {
+		s.logger.Infof("Rejecting tunnel registration of %s: %s", control.RemoteAddr(), err)
+		control.Write([]byte{statusError})
+		return
+	}
+	defer s.unregister(port)
+
+	if _, err := control.Write([]byte{statusOK}); err != nil {
+		return
+	}
+	s.stats.Counter("registrations").Inc(1)
+	s.logger.Infof("Registered tunnel of %s on port %d", control.RemoteAddr(), port)
+
+	// Writes to control are serialized, since both opens and pings are sent
+	// over it.
+	var writeMu sync.Mutex
+	write := func(f func() error) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		control.SetWriteDeadline(time.Now().Add(s.config.DialTimeout))
+		return f()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Peers never write to the control conn after registering, so this
+		// only returns once the control conn is broken.
+		b := make([]byte, 1)
+		control.Read(b)
+		close(done)
+		l.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(s.config.KeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := write(func() error {
+					_, err := control.Write([]byte{opPing})
+					return err
+				}); err != nil {
+					control.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.forward(nc, func(t token) error {
+			return write(func() error { return writeToken(control, opOpen, t) })
+		})
+	}
+}
+
+func (s *Server) listen(port int) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("server closed")
+	}
+	if _, ok := s.tunnels[port]; ok {
+		return nil, fmt.Errorf("port %d already registered", port)
+	}
+	l, err := net.Listen(
+		"tcp", net.JoinHostPort(s.config.Registration.BindAddr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	s.tunnels[port] = l
+	return l, nil
+}
+
+func (s *Server) unregister(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.tunnels[port]; ok {
+		l.Close()
+		delete(s.tunnels, port)
+	}
+	s.logger.Infof("Unregistered tunnel on port %d", port)
+}
+
+// forward requests a data conn from the registered peer via open, and splices
+// nc with the data conn once opened.
+func (s *Server) forward(nc net.Conn, open func(token) error) {
+	var t token
+	if _, err := rand.Read(t[:]); err != nil {
+		nc.Close()
+		return
+	}
+	c := make(chan net.Conn, 1)
+	s.mu.Lock()
+	s.pending[t] = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+		select {
+		case data := <-c:
+			// Opened after we gave up waiting.
+			data.Close()
+		default:
+		}
+	}()
+
+	if err := open(t); err != nil {
+		nc.Close()
+		return
+	}
+	select {
+	case data := <-c:
+		s.stats.Counter("forwarded_conns").Inc(1)
+		splice(nc, data)
+	case <-time.After(s.config.OpenTimeout):
+		s.stats.Counter("open_timeouts").Inc(1)
+		nc.Close()
+	}
+}
+
+// accept hands data conn nc to the forward waiting on t.
+func (s *Server) accept(nc net.Conn, t token) {
+	s.mu.Lock()
+	c, ok := s.pending[t]
+	s.mu.Unlock()
+	if !ok {
+		nc.Close()
+		return
+	}
+	select {
+	case c <- nc:
+	default:
+		nc.Close()
+	}
+}
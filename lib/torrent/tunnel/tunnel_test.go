@@ -0,0 +1,345 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startServer(t *testing.T, config Config) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s, err := NewServer(config, tally.NoopScope, log.Default())
+	require.NoError(t, err)
+	go s.Serve(l)
+	return l.Addr().String(), s.Close
+}
+
+const _testSecret = "secret"
+
+// registrationConfig returns a Config which accepts registrations of all
+// ports on localhost.
+func registrationConfig() Config {
+	return Config{
+		Secret: _testSecret,
+		Registration: RegistrationConfig{
+			BindAddr: "localhost",
+			MinPort:  1,
+			MaxPort:  math.MaxUint16,
+		},
+	}
+}
+
+// register registers port with the relay at addr using secret, and returns
+// the status the relay answered with. The control conn is closed on return.
+func register(t *testing.T, addr, secret string, port int) byte {
+	control, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer control.Close()
+
+	require.NoError(t, writeRegister(control, port))
+	n, err := readNonce(control)
+	require.NoError(t, err)
+	_, err = control.Write(registrationMAC(secret, n, port))
+	require.NoError(t, err)
+	status, err := readByte(control)
+	require.NoError(t, err)
+	return status
+}
+
+// dialTunnel dials port until the relay has registered it.
+func dialTunnel(t *testing.T, port int) net.Conn {
+	var nc net.Conn
+	require.NoError(t, testutil.PollUntilTrue(5*time.Second, func() bool {
+		var err error
+		nc, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		return err == nil
+	}))
+	return nc
+}
+
+func TestTunnelForwardsConns(t *testing.T) {
+	require := require.New(t)
+
+	addr, stop := startServer(t, registrationConfig())
+	defer stop()
+
+	port := freePort(t)
+	l := NewListener(
+		Config{Relays: []string{addr}, Secret: _testSecret}, port, tally.NoopScope, log.Default())
+	defer l.Close()
+
+	nc := dialTunnel(t, port)
+	defer nc.Close()
+
+	_, err := nc.Write([]byte("ping"))
+	require.NoError(err)
+
+	forwarded, err := l.Accept()
+	require.NoError(err)
+	defer forwarded.Close()
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(forwarded, b)
+	require.NoError(err)
+	require.Equal("ping", string(b))
+
+	_, err = forwarded.Write([]byte("pong"))
+	require.NoError(err)
+	_, err = io.ReadFull(nc, b)
+	require.NoError(err)
+	require.Equal("pong", string(b))
+}
+
+func TestServerRejectsDuplicateRegistration(t *testing.T) {
+	require := require.New(t)
+
+	addr, stop := startServer(t, registrationConfig())
+	defer stop()
+
+	port := freePort(t)
+	l := NewListener(
+		Config{Relays: []string{addr}, Secret: _testSecret}, port, tally.NoopScope, log.Default())
+	defer l.Close()
+
+	dialTunnel(t, port).Close()
+
+	require.Equal(statusError, register(t, addr, _testSecret, port))
+}
+
+func TestServerRegistrationRejections(t *testing.T) {
+	port := 10000
+	tests := []struct {
+		desc   string
+		config func(*Config)
+		secret string
+	}{
+		{"invalid secret", func(*Config) {}, "wrong"},
+		{"no secret configured", func(c *Config) { c.Secret = "" }, ""},
+		{"not configured", func(c *Config) { c.Registration = RegistrationConfig{} }, _testSecret},
+		{"port below range", func(c *Config) { c.Registration.MinPort = port + 1 }, _testSecret},
+		{"port above range", func(c *Config) { c.Registration.MaxPort = port - 1 }, _testSecret},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			config := registrationConfig()
+			test.config(&config)
+
+			addr, stop := startServer(t, config)
+			defer stop()
+
+			require.Equal(t, statusError, register(t, addr, test.secret, port))
+		})
+	}
+}
+
+func TestListenerCloseUnblocksAccept(t *testing.T) {
+	require := require.New(t)
+
+	l := NewListener(Config{}, freePort(t), tally.NoopScope, log.Default())
+
+	errc := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		errc <- err
+	}()
+	require.NoError(l.Close())
+	require.Equal(ErrListenerClosed, <-errc)
+}
+
+func TestRelayForwardsConns(t *testing.T) {
+	require := require.New(t)
+
+	addr, stop := startServer(t, Config{Secret: _testSecret, Relay: RelayConfig{
+		Enable:       true,
+		AllowedCIDRs: []string{"127.0.0.0/8"},
+	}})
+	defer stop()
+
+	target, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	defer target.Close()
+
+	go func() {
+		nc, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		io.Copy(nc, nc)
+	}()
+
+	dial := RelayDialer(Config{RelayVia: []string{addr}, Secret: _testSecret})
+	nc, err := dial(context.Background(), "tcp", target.Addr().String())
+	require.NoError(err)
+	defer nc.Close()
+
+	_, err = nc.Write([]byte("echo"))
+	require.NoError(err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(nc, b)
+	require.NoError(err)
+	require.Equal("echo", string(b))
+}
+
+func TestRelayForwardsToRegisteredTunnels(t *testing.T) {
+	require := require.New(t)
+
+	config := registrationConfig()
+	config.Relay = RelayConfig{Enable: true}
+	addr, stop := startServer(t, config)
+	defer stop()
+
+	port := freePort(t)
+	l := NewListener(
+		Config{Relays: []string{addr}, Secret: _testSecret}, port, tally.NoopScope, log.Default())
+	defer l.Close()
+
+	dialTunnel(t, port).Close()
+	forwarded, err := l.Accept()
+	require.NoError(err)
+	forwarded.Close()
+
+	dial := RelayDialer(Config{RelayVia: []string{addr}, Secret: _testSecret})
+	nc, err := dial(context.Background(), "tcp", fmt.Sprintf("localhost:%d", port))
+	require.NoError(err)
+	defer nc.Close()
+
+	forwarded, err = l.Accept()
+	require.NoError(err)
+	defer forwarded.Close()
+}
+
+func TestRelayRejections(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config RelayConfig
+	}{
+		{"disabled", RelayConfig{AllowedCIDRs: []string{"127.0.0.0/8"}}},
+		{"target not allowed", RelayConfig{Enable: true, AllowedCIDRs: []string{"10.0.0.0/8"}}},
+		{"cap exceeded", RelayConfig{
+			Enable: true, AllowedCIDRs: []string{"127.0.0.0/8"}, MaxRelayedBytes: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			l, err := net.Listen("tcp", "localhost:0")
+			require.NoError(err)
+			s, err := NewServer(
+				Config{Secret: _testSecret, Relay: test.config}, tally.NoopScope, log.Default())
+			require.NoError(err)
+			s.relayer.add(1)
+			go s.Serve(l)
+			defer s.Close()
+
+			_, err = DialRelay(context.Background(), l.Addr().String(), "localhost:1", _testSecret)
+			require.Equal(errRelayRejected, err)
+		})
+	}
+}
+
+func TestRelayRejectsLoops(t *testing.T) {
+	require := require.New(t)
+
+	addr, stop := startServer(t, Config{Secret: _testSecret, Relay: RelayConfig{Enable: true}})
+	defer stop()
+
+	_, err := DialRelay(context.Background(), addr, addr, _testSecret)
+	require.Equal(errRelayRejected, err)
+}
+
+func TestRelayRejectsOtherRelays(t *testing.T) {
+	require := require.New(t)
+
+	other, stopOther := startServer(t, Config{Secret: _testSecret, Relay: RelayConfig{Enable: true}})
+	defer stopOther()
+
+	addr, stop := startServer(t, Config{
+		Secret:   _testSecret,
+		RelayVia: []string{other},
+		Relay: RelayConfig{
+			Enable:       true,
+			AllowedCIDRs: []string{"127.0.0.0/8"},
+		},
+	})
+	defer stop()
+
+	_, err := DialRelay(context.Background(), addr, other, _testSecret)
+	require.Equal(errRelayRejected, err)
+}
+
+func TestRelayRejectsUnauthenticatedRequests(t *testing.T) {
+	for _, secret := range []string{"", _testSecret} {
+		t.Run(fmt.Sprintf("server secret %q", secret), func(t *testing.T) {
+			require := require.New(t)
+
+			addr, stop := startServer(t, Config{Secret: secret, Relay: RelayConfig{
+				Enable:       true,
+				AllowedCIDRs: []string{"127.0.0.0/8"},
+			}})
+			defer stop()
+
+			target, err := net.Listen("tcp", "localhost:0")
+			require.NoError(err)
+			defer target.Close()
+
+			_, err = DialRelay(context.Background(), addr, target.Addr().String(), "wrong")
+			require.Equal(errRelayRejected, err)
+		})
+	}
+}
+
+func TestRelayedBytesCapResetsEveryWindow(t *testing.T) {
+	require := require.New(t)
+
+	r, err := newRelayer(RelayConfig{MaxRelayedBytes: 10, Window: time.Minute})
+	require.NoError(err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	require.True(r.add(10))
+	require.True(r.exhausted())
+	require.False(r.add(1))
+
+	now = now.Add(time.Minute)
+	require.False(r.exhausted())
+	require.True(r.add(10))
+}
+
+func TestNewServerRejectsInvalidAllowedCIDRs(t *testing.T) {
+	_, err := NewServer(
+		Config{Relay: RelayConfig{AllowedCIDRs: []string{"10.0.0.0"}}},
+		tally.NoopScope, log.Default())
+	require.Error(t, err)
+}
@@ -5,11 +5,18 @@
 package mockscheduler
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	core "github.com/uber/kraken/core"
 	scheduler "github.com/uber/kraken/lib/torrent/scheduler"
 	connstate "github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	provenance "github.com/uber/kraken/lib/torrent/scheduler/provenance"
+	timeline "github.com/uber/kraken/lib/torrent/scheduler/timeline"
+	reconcile "github.com/uber/kraken/tracker/reconcile"
+	zapcore "go.uber.org/zap/zapcore"
+	io "io"
 	reflect "reflect"
+	time "time"
 )
 
 // MockReloadableScheduler is a mock of ReloadableScheduler interface
@@ -35,6 +42,67 @@ func (m *MockReloadableScheduler) EXPECT() *MockReloadableSchedulerMockRecorder
 	return m.recorder
 }
 
+// AddTorrentListener mocks base method
+func (m *MockReloadableScheduler) AddTorrentListener(arg0 scheduler.TorrentListener) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddTorrentListener", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddTorrentListener indicates an expected call of AddTorrentListener
+func (mr *MockReloadableSchedulerMockRecorder) AddTorrentListener(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddTorrentListener", reflect.TypeOf((*MockReloadableScheduler)(nil).AddTorrentListener), arg0)
+}
+
+// AddTorrentWithOptions mocks base method
+func (m *MockReloadableScheduler) AddTorrentWithOptions(arg0 context.Context, arg1 core.Digest, arg2 ...scheduler.TorrentOption) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "AddTorrentWithOptions", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddTorrentWithOptions indicates an expected call of AddTorrentWithOptions
+func (mr *MockReloadableSchedulerMockRecorder) AddTorrentWithOptions(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddTorrentWithOptions", reflect.TypeOf((*MockReloadableScheduler)(nil).AddTorrentWithOptions), varargs...)
+}
+
+// Announce mocks base method
+func (m *MockReloadableScheduler) Announce(arg0 core.InfoHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Announce", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Announce indicates an expected call of Announce
+func (mr *MockReloadableSchedulerMockRecorder) Announce(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Announce", reflect.TypeOf((*MockReloadableScheduler)(nil).Announce), arg0)
+}
+
+// AttachTorrent mocks base method
+func (m *MockReloadableScheduler) AttachTorrent(arg0 string, arg1 core.Digest, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AttachTorrent", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AttachTorrent indicates an expected call of AttachTorrent
+func (mr *MockReloadableSchedulerMockRecorder) AttachTorrent(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AttachTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).AttachTorrent), arg0, arg1, arg2)
+}
+
 // BlacklistSnapshot mocks base method
 func (m *MockReloadableScheduler) BlacklistSnapshot() ([]connstate.BlacklistedConn, error) {
 	m.ctrl.T.Helper()
@@ -50,18 +118,102 @@ func (mr *MockReloadableSchedulerMockRecorder) BlacklistSnapshot() *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlacklistSnapshot", reflect.TypeOf((*MockReloadableScheduler)(nil).BlacklistSnapshot))
 }
 
+// CancelTorrent mocks base method
+func (m *MockReloadableScheduler) CancelTorrent(arg0 core.InfoHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelTorrent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelTorrent indicates an expected call of CancelTorrent
+func (mr *MockReloadableSchedulerMockRecorder) CancelTorrent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).CancelTorrent), arg0)
+}
+
+// ClearTorrentLogLevel mocks base method
+func (m *MockReloadableScheduler) ClearTorrentLogLevel(arg0 core.Digest) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ClearTorrentLogLevel", arg0)
+}
+
+// ClearTorrentLogLevel indicates an expected call of ClearTorrentLogLevel
+func (mr *MockReloadableSchedulerMockRecorder) ClearTorrentLogLevel(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearTorrentLogLevel", reflect.TypeOf((*MockReloadableScheduler)(nil).ClearTorrentLogLevel), arg0)
+}
+
 // Download mocks base method
-func (m *MockReloadableScheduler) Download(arg0 string, arg1 core.Digest) error {
+func (m *MockReloadableScheduler) Download(arg0 context.Context, arg1 string, arg2 core.Digest) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Download", arg0, arg1)
+	ret := m.ctrl.Call(m, "Download", arg0, arg1, arg2)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Download indicates an expected call of Download
-func (mr *MockReloadableSchedulerMockRecorder) Download(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockReloadableSchedulerMockRecorder) Download(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockReloadableScheduler)(nil).Download), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockReloadableScheduler)(nil).Download), arg0, arg1, arg2)
+}
+
+// Ingest mocks base method
+func (m *MockReloadableScheduler) Ingest(arg0 string, arg1 core.Digest, arg2 io.Reader) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ingest", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ingest indicates an expected call of Ingest
+func (mr *MockReloadableSchedulerMockRecorder) Ingest(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ingest", reflect.TypeOf((*MockReloadableScheduler)(nil).Ingest), arg0, arg1, arg2)
+}
+
+// Introspect mocks base method
+func (m *MockReloadableScheduler) Introspect() (*scheduler.Introspection, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Introspect")
+	ret0, _ := ret[0].(*scheduler.Introspection)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Introspect indicates an expected call of Introspect
+func (mr *MockReloadableSchedulerMockRecorder) Introspect() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Introspect", reflect.TypeOf((*MockReloadableScheduler)(nil).Introspect))
+}
+
+// PauseTorrent mocks base method
+func (m *MockReloadableScheduler) PauseTorrent(arg0 core.InfoHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PauseTorrent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PauseTorrent indicates an expected call of PauseTorrent
+func (mr *MockReloadableSchedulerMockRecorder) PauseTorrent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PauseTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).PauseTorrent), arg0)
+}
+
+// PieceProvenance mocks base method
+func (m *MockReloadableScheduler) PieceProvenance(arg0 core.Digest) (provenance.Record, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PieceProvenance", arg0)
+	ret0, _ := ret[0].(provenance.Record)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PieceProvenance indicates an expected call of PieceProvenance
+func (mr *MockReloadableSchedulerMockRecorder) PieceProvenance(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PieceProvenance", reflect.TypeOf((*MockReloadableScheduler)(nil).PieceProvenance), arg0)
 }
 
 // Probe mocks base method
@@ -78,6 +230,50 @@ func (mr *MockReloadableSchedulerMockRecorder) Probe() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Probe", reflect.TypeOf((*MockReloadableScheduler)(nil).Probe))
 }
 
+// Progress mocks base method
+func (m *MockReloadableScheduler) Progress(arg0 core.InfoHash) (*scheduler.Progress, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Progress", arg0)
+	ret0, _ := ret[0].(*scheduler.Progress)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Progress indicates an expected call of Progress
+func (mr *MockReloadableSchedulerMockRecorder) Progress(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Progress", reflect.TypeOf((*MockReloadableScheduler)(nil).Progress), arg0)
+}
+
+// RecentEvents mocks base method
+func (m *MockReloadableScheduler) RecentEvents() []scheduler.EventRecord {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecentEvents")
+	ret0, _ := ret[0].([]scheduler.EventRecord)
+	return ret0
+}
+
+// RecentEvents indicates an expected call of RecentEvents
+func (mr *MockReloadableSchedulerMockRecorder) RecentEvents() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecentEvents", reflect.TypeOf((*MockReloadableScheduler)(nil).RecentEvents))
+}
+
+// Rechunk mocks base method
+func (m *MockReloadableScheduler) Rechunk(arg0 core.Digest, arg1 int64, arg2 time.Duration) (*core.MetaInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rechunk", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*core.MetaInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Rechunk indicates an expected call of Rechunk
+func (mr *MockReloadableSchedulerMockRecorder) Rechunk(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rechunk", reflect.TypeOf((*MockReloadableScheduler)(nil).Rechunk), arg0, arg1, arg2)
+}
+
 // Reload mocks base method
 func (m *MockReloadableScheduler) Reload(arg0 scheduler.Config) {
 	m.ctrl.T.Helper()
@@ -104,14 +300,203 @@ func (mr *MockReloadableSchedulerMockRecorder) RemoveTorrent(arg0 interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).RemoveTorrent), arg0)
 }
 
+// ResumeTorrent mocks base method
+func (m *MockReloadableScheduler) ResumeTorrent(arg0 core.InfoHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResumeTorrent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResumeTorrent indicates an expected call of ResumeTorrent
+func (mr *MockReloadableSchedulerMockRecorder) ResumeTorrent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResumeTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).ResumeTorrent), arg0)
+}
+
+// SeededExport mocks base method
+func (m *MockReloadableScheduler) SeededExport() (*reconcile.Export, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SeededExport")
+	ret0, _ := ret[0].(*reconcile.Export)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SeededExport indicates an expected call of SeededExport
+func (mr *MockReloadableSchedulerMockRecorder) SeededExport() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SeededExport", reflect.TypeOf((*MockReloadableScheduler)(nil).SeededExport))
+}
+
+// SetEvictionHook mocks base method
+func (m *MockReloadableScheduler) SetEvictionHook(arg0 scheduler.EvictionHook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetEvictionHook", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetEvictionHook indicates an expected call of SetEvictionHook
+func (mr *MockReloadableSchedulerMockRecorder) SetEvictionHook(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEvictionHook", reflect.TypeOf((*MockReloadableScheduler)(nil).SetEvictionHook), arg0)
+}
+
+// SetTorrentLogLevel mocks base method
+func (m *MockReloadableScheduler) SetTorrentLogLevel(arg0 core.Digest, arg1 zapcore.Level) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTorrentLogLevel", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTorrentLogLevel indicates an expected call of SetTorrentLogLevel
+func (mr *MockReloadableSchedulerMockRecorder) SetTorrentLogLevel(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTorrentLogLevel", reflect.TypeOf((*MockReloadableScheduler)(nil).SetTorrentLogLevel), arg0, arg1)
+}
+
+// SetTorrentRateLimit mocks base method
+func (m *MockReloadableScheduler) SetTorrentRateLimit(arg0 core.InfoHash, arg1 int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTorrentRateLimit", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTorrentRateLimit indicates an expected call of SetTorrentRateLimit
+func (mr *MockReloadableSchedulerMockRecorder) SetTorrentRateLimit(arg0 interface{}, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTorrentRateLimit", reflect.TypeOf((*MockReloadableScheduler)(nil).SetTorrentRateLimit), arg0, arg1)
+}
+
+// StartTrace mocks base method
+func (m *MockReloadableScheduler) StartTrace(arg0 core.InfoHash, arg1 time.Duration) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StartTrace", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StartTrace indicates an expected call of StartTrace
+func (mr *MockReloadableSchedulerMockRecorder) StartTrace(arg0 interface{}, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartTrace", reflect.TypeOf((*MockReloadableScheduler)(nil).StartTrace), arg0, arg1)
+}
+
+// Stats mocks base method
+func (m *MockReloadableScheduler) Stats() (*scheduler.Stats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats")
+	ret0, _ := ret[0].(*scheduler.Stats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats
+func (mr *MockReloadableSchedulerMockRecorder) Stats() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockReloadableScheduler)(nil).Stats))
+}
+
 // Stop mocks base method
-func (m *MockReloadableScheduler) Stop() {
+func (m *MockReloadableScheduler) Stop(arg0 context.Context) error {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Stop")
+	ret := m.ctrl.Call(m, "Stop", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // Stop indicates an expected call of Stop
-func (mr *MockReloadableSchedulerMockRecorder) Stop() *gomock.Call {
+func (mr *MockReloadableSchedulerMockRecorder) Stop(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockReloadableScheduler)(nil).Stop), arg0)
+}
+
+// StopTrace mocks base method
+func (m *MockReloadableScheduler) StopTrace(arg0 core.InfoHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StopTrace", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StopTrace indicates an expected call of StopTrace
+func (mr *MockReloadableSchedulerMockRecorder) StopTrace(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopTrace", reflect.TypeOf((*MockReloadableScheduler)(nil).StopTrace), arg0)
+}
+
+// SupportBundle mocks base method
+func (m *MockReloadableScheduler) SupportBundle(arg0 io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SupportBundle", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SupportBundle indicates an expected call of SupportBundle
+func (mr *MockReloadableSchedulerMockRecorder) SupportBundle(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SupportBundle", reflect.TypeOf((*MockReloadableScheduler)(nil).SupportBundle), arg0)
+}
+
+// TorrentPeers mocks base method
+func (m *MockReloadableScheduler) TorrentPeers(arg0 core.InfoHash) ([]*scheduler.TorrentPeer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentPeers", arg0)
+	ret0, _ := ret[0].([]*scheduler.TorrentPeer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TorrentPeers indicates an expected call of TorrentPeers
+func (mr *MockReloadableSchedulerMockRecorder) TorrentPeers(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentPeers", reflect.TypeOf((*MockReloadableScheduler)(nil).TorrentPeers), arg0)
+}
+
+// TorrentTimelines mocks base method
+func (m *MockReloadableScheduler) TorrentTimelines() []timeline.Timeline {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentTimelines")
+	ret0, _ := ret[0].([]timeline.Timeline)
+	return ret0
+}
+
+// TorrentTimelines indicates an expected call of TorrentTimelines
+func (mr *MockReloadableSchedulerMockRecorder) TorrentTimelines() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentTimelines", reflect.TypeOf((*MockReloadableScheduler)(nil).TorrentTimelines))
+}
+
+// Torrents mocks base method
+func (m *MockReloadableScheduler) Torrents() ([]*scheduler.Progress, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Torrents")
+	ret0, _ := ret[0].([]*scheduler.Progress)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Torrents indicates an expected call of Torrents
+func (mr *MockReloadableSchedulerMockRecorder) Torrents() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Torrents", reflect.TypeOf((*MockReloadableScheduler)(nil).Torrents))
+}
+
+// TryReload mocks base method
+func (m *MockReloadableScheduler) TryReload(arg0 scheduler.Config) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TryReload", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TryReload indicates an expected call of TryReload
+func (mr *MockReloadableSchedulerMockRecorder) TryReload(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockReloadableScheduler)(nil).Stop))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TryReload", reflect.TypeOf((*MockReloadableScheduler)(nil).TryReload), arg0)
 }
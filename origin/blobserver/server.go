@@ -338,18 +338,24 @@ func (s *Server) overwriteMetaInfoHandler(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return handler.Errorf("invalid piece_length argument: %s", err).Status(http.StatusBadRequest)
 	}
-	return s.overwriteMetaInfo(d, pieceLength)
+	alg := core.PieceHashAlgorithm(r.URL.Query().Get("piece_hash_algorithm"))
+	if err := alg.Validate(); err != nil {
+		return handler.Errorf("invalid piece_hash_algorithm argument: %s", err).Status(http.StatusBadRequest)
+	}
+	return s.overwriteMetaInfo(d, pieceLength, alg)
 }
 
-// overwriteMetaInfo generates metainfo configured with pieceLength for d and
-// writes it to disk, overwriting any existing metainfo. Primarily intended for
-// benchmarking purposes.
-func (s *Server) overwriteMetaInfo(d core.Digest, pieceLength int64) error {
+// overwriteMetaInfo generates metainfo configured with pieceLength and alg for
+// d and writes it to disk, overwriting any existing metainfo. Primarily
+// intended for benchmarking purposes.
+func (s *Server) overwriteMetaInfo(
+	d core.Digest, pieceLength int64, alg core.PieceHashAlgorithm) error {
+
 	f, err := s.cas.GetCacheFileReader(d.Hex())
 	if err != nil {
 		return handler.Errorf("get cache file: %s", err)
 	}
-	mi, err := core.NewMetaInfo(d, f, pieceLength)
+	mi, err := core.NewMetaInfo(d, f, pieceLength, core.WithPieceHashAlgorithm(alg))
 	if err != nil {
 		return handler.Errorf("create metainfo: %s", err)
 	}
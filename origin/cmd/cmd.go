@@ -115,6 +115,8 @@ func Run(flags *Flags) {
 	zlog := log.ConfigureLogger(config.ZapLogging)
 	defer zlog.Sync()
 
+	log.Infof("Piece hash accelerations: %v", core.PieceHashAccelerations())
+
 	stats, closer, err := metrics.New(config.Metrics, flags.KrakenCluster)
 	if err != nil {
 		log.Fatalf("Failed to init metrics: %s", err)
@@ -0,0 +1,195 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/uber/kraken/agent/agentclient"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+const usage = `usage: kraken-sched [flags] <command> [args]
+
+commands:
+  list                        list torrents and their progress
+  add <namespace> <digest>    download a blob, waiting for completion
+  remove <digest>             stop serving a blob and delete it from disk
+  cancel <infohash>           cancel an in-progress torrent
+  pause <infohash>            stop requesting pieces of a torrent
+  resume <infohash>           resume a paused torrent
+  peers <infohash>            show the connected peers of a torrent
+  blacklist                   dump the conn blacklist
+  announce <infohash>         announce a torrent to the tracker immediately
+  bundle <file>               fetch the support bundle into file
+
+flags:
+`
+
+func main() {
+	agent := flag.String("agent", "localhost:7602", "agent server address")
+	timeout := flag.Duration("timeout", 15*time.Minute, "timeout of add")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	client := agentclient.New(*agent)
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	var err error
+	switch cmd {
+	case "list":
+		err = list(client)
+	case "add":
+		requireArgs(args, 2)
+		err = client.AddTorrent(args[0], parseDigest(args[1]), *timeout)
+	case "remove":
+		requireArgs(args, 1)
+		err = client.RemoveTorrent(parseDigest(args[0]))
+	case "cancel":
+		err = client.CancelTorrent(infoHashArg(args))
+	case "pause":
+		err = client.PauseTorrent(infoHashArg(args))
+	case "resume":
+		err = client.ResumeTorrent(infoHashArg(args))
+	case "peers":
+		err = peers(client, infoHashArg(args))
+	case "blacklist":
+		err = blacklist(client)
+	case "announce":
+		err = client.AnnounceTorrent(infoHashArg(args))
+	case "bundle":
+		requireArgs(args, 1)
+		err = bundle(client, args[0])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %s", cmd, err)
+	}
+}
+
+func requireArgs(args []string, n int) {
+	if len(args) != n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func parseDigest(raw string) core.Digest {
+	d, err := core.ParseSHA256Digest(raw)
+	if err != nil {
+		log.Fatalf("parse digest: %s", err)
+	}
+	return d
+}
+
+func infoHashArg(args []string) core.InfoHash {
+	requireArgs(args, 1)
+	h, err := core.NewInfoHashFromHex(args[0])
+	if err != nil {
+		log.Fatalf("parse infohash: %s", err)
+	}
+	return h
+}
+
+func list(client *agentclient.HTTPClient) error {
+	torrents, err := client.Torrents()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INFOHASH\tDIGEST\tSIZE\tPIECES\tPEERS\tDOWN/S\tUP/S\tSTATE")
+	for _, p := range torrents {
+		state := "downloading"
+		if p.Complete {
+			state = "seeding"
+		} else if p.Paused {
+			state = "paused"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%d\t%s\t%s\t%s\n",
+			p.InfoHash.Hex(), p.Digest.Hex(), memsize.Format(uint64(p.Length)),
+			p.PiecesComplete, p.NumPieces, p.ActivePeers,
+			memsize.Format(uint64(p.DownloadRate)), memsize.Format(uint64(p.UploadRate)),
+			state)
+	}
+	return w.Flush()
+}
+
+func peers(client *agentclient.HTTPClient, h core.InfoHash) error {
+	peers, err := client.TorrentPeers(h)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tVERSION\tCONNECTED\tLAST RECEIVED\tLAST SENT")
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			p.PeerID, p.ProtocolVersion, since(p.ConnectedAt),
+			since(p.LastGoodPieceReceived), since(p.LastPieceSent))
+	}
+	return w.Flush()
+}
+
+func blacklist(client *agentclient.HTTPClient) error {
+	conns, err := client.Blacklist()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tINFOHASH\tREMAINING")
+	for _, c := range conns {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.PeerID, c.InfoHash.Hex(), c.Remaining)
+	}
+	return w.Flush()
+}
+
+func bundle(client *agentclient.HTTPClient, path string) error {
+	r, err := client.SupportBundle()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create: %s", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("copy: %s", err)
+	}
+	return nil
+}
+
+// since formats t as a duration relative to now, or "-" if t is zero.
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%s ago", time.Since(t).Round(time.Second))
+}
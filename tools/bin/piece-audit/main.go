@@ -0,0 +1,85 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/networkevent/pieceaudit"
+)
+
+func readEvents(files []string) ([]*networkevent.Event, error) {
+	if len(files) == 0 {
+		return pieceaudit.ReadEvents(os.Stdin)
+	}
+	var events []*networkevent.Event
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		result, err := pieceaudit.ReadEvents(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		events = append(events, result...)
+	}
+	return events, nil
+}
+
+func printReport(w io.Writer, r *pieceaudit.Report) {
+	fmt.Fprintf(w, "events:          %d\n", r.Events)
+	fmt.Fprintf(w, "torrents:        %d\n", r.Torrents)
+	fmt.Fprintf(w, "completed:       %d\n", r.Completed)
+	fmt.Fprintf(w, "cancelled:       %d\n", r.Cancelled)
+	fmt.Fprintf(w, "pieces verified: %d\n", r.PiecesVerified)
+	fmt.Fprintf(w, "requests:        %d\n", r.Requests)
+	fmt.Fprintf(w, "in flight:       %d\n", r.InFlight)
+	fmt.Fprintf(w, "violations:      %d\n", len(r.Violations))
+	for _, v := range r.Violations {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+}
+
+// piece-audit verifies the piece accounting of network event logs written by
+// the scheduler. Multiple logs, e.g. of every peer in a test cluster, may be
+// audited together. Exits non-zero if any invariant is violated.
+func main() {
+	jsonOutput := flag.Bool("json", false, "print report as json")
+	flag.Parse()
+
+	events, err := readEvents(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read events: %s\n", err)
+		os.Exit(2)
+	}
+	report := pieceaudit.Audit(events)
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "encode report: %s\n", err)
+			os.Exit(2)
+		}
+	} else {
+		printReport(os.Stdout, report)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -15,10 +15,12 @@ package announceclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -54,6 +56,10 @@ func (r *Request) GetDigest() (core.Digest, error) {
 type Response struct {
 	Peers    []*core.PeerInfo `json:"peers"`
 	Interval time.Duration    `json:"interval"`
+
+	// Content is the full blob, inlined by the tracker for incomplete peers if
+	// the blob is too small to be worth swarming.
+	Content []byte `json:"content,omitempty"`
 }
 
 // Client defines a client for announcing and getting peers.
@@ -62,18 +68,65 @@ type Client interface {
 		d core.Digest,
 		h core.InfoHash,
 		complete bool,
+		have core.PieceRanges,
 		version int) ([]*core.PeerInfo, time.Duration, error)
 }
 
+// InlineClient is implemented by Clients which can receive blobs inlined in
+// announce responses.
+type InlineClient interface {
+	// AnnounceInline is like Announce, but returns the full response, including
+	// any inlined content.
+	AnnounceInline(
+		d core.Digest,
+		h core.InfoHash,
+		complete bool,
+		have core.PieceRanges,
+		version int) (*Response, error)
+}
+
+// StoppedClient is implemented by Clients which can notify the tracker that
+// the local peer stopped serving a torrent.
+type StoppedClient interface {
+	// AnnounceStopped announces that the local peer no longer serves the
+	// torrent identified by (d, h), such that it is no longer handed out.
+	AnnounceStopped(d core.Digest, h core.InfoHash, version int) error
+}
+
 type client struct {
 	pctx core.PeerContext
 	ring hashring.PassiveRing
 	tls  *tls.Config
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	leechOnly bool
+
+	sendOpts []httputil.SendOption
+}
+
+// Option allows setting optional parameters in client.
+type Option func(*client)
+
+// WithDialer configures a client to connect to trackers using dial, e.g. to
+// route hostname resolution through a cache.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *client) { c.dial = dial }
+}
+
+// WithLeechOnly configures a client to announce as a leech-only peer, such that
+// the tracker never hands it out as a source.
+func WithLeechOnly() Option {
+	return func(c *client) { c.leechOnly = true }
 }
 
 // New creates a new client.
-func New(pctx core.PeerContext, ring hashring.PassiveRing, tls *tls.Config) Client {
-	return &client{pctx, ring, tls}
+func New(pctx core.PeerContext, ring hashring.PassiveRing, tls *tls.Config, opts ...Option) Client {
+	c := &client{pctx: pctx, ring: ring, tls: tls}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.sendOpts = c.transportOptions()
+	return c
 }
 
 // Announce versionss.
@@ -96,41 +149,132 @@ func (c *client) Announce(
 	d core.Digest,
 	h core.InfoHash,
 	complete bool,
+	have core.PieceRanges,
 	version int) (peers []*core.PeerInfo, interval time.Duration, err error) {
 
-	body, err := json.Marshal(&Request{
+	resp, err := c.AnnounceInline(d, h, complete, have, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Peers, resp.Interval, nil
+}
+
+// AnnounceInline announces the torrent identified by (d, h) and returns the
+// tracker response, which may include the blob content if it was inlined.
+func (c *client) AnnounceInline(
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges,
+	version int) (*Response, error) {
+
+	peer := core.PeerInfoFromContext(c.pctx, complete)
+	peer.LeechOnly = c.leechOnly
+	if !complete && !c.leechOnly {
+		// Incomplete peers advertise the pieces they hold so they may serve as
+		// partial seeders.
+		peer.HaveRanges = have
+	}
+	return forward(c.ring, c.sendOpts, &Request{
 		Name:     d.Hex(), // For backwards compatability. TODO(codyg): Remove.
 		Digest:   &d,
 		InfoHash: h,
-		Peer:     core.PeerInfoFromContext(c.pctx, complete),
-	})
+		Peer:     peer,
+	}, version)
+}
+
+// AnnounceStopped announces that the local peer stopped serving the torrent
+// identified by (d, h).
+func (c *client) AnnounceStopped(d core.Digest, h core.InfoHash, version int) error {
+	peer := core.PeerInfoFromContext(c.pctx, false)
+	peer.Stopped = true
+	_, err := forward(c.ring, c.sendOpts, &Request{
+		Name:     d.Hex(), // For backwards compatability. TODO(codyg): Remove.
+		Digest:   &d,
+		InfoHash: h,
+		Peer:     peer,
+	}, version)
+	return err
+}
+
+// Forwarder sends pre-built announce requests to the tracker. Unlike Client,
+// the announcing peer is taken from the request rather than a local peer
+// context, which allows announces to be relayed on behalf of other peers.
+type Forwarder interface {
+	Forward(req *Request, version int) (*Response, error)
+}
+
+type forwarder struct {
+	ring hashring.PassiveRing
+	tls  *tls.Config
+}
+
+// NewForwarder creates a new Forwarder.
+func NewForwarder(ring hashring.PassiveRing, tls *tls.Config) Forwarder {
+	return &forwarder{ring, tls}
+}
+
+// Forward sends req to the tracker which owns the request digest.
+func (f *forwarder) Forward(req *Request, version int) (*Response, error) {
+	return forward(f.ring, []httputil.SendOption{httputil.SendTLS(f.tls)}, req, version)
+}
+
+// transportOptions builds the transport shared by all announces, such that
+// tracker connections are reused.
+func (c *client) transportOptions() []httputil.SendOption {
+	if c.dial == nil {
+		return []httputil.SendOption{httputil.SendTLS(c.tls)}
+	}
+	transport := &http.Transport{DialContext: c.dial}
+	if c.tls == nil {
+		return []httputil.SendOption{httputil.SendTransport(transport)}
+	}
+	transport.TLSClientConfig = c.tls
+	return []httputil.SendOption{httputil.SendTLSTransport(transport)}
+}
+
+func forward(
+	ring hashring.PassiveRing,
+	opts []httputil.SendOption,
+	req *Request,
+	version int) (*Response, error) {
+
+	d, err := req.GetDigest()
 	if err != nil {
-		return nil, 0, fmt.Errorf("marshal request: %s", err)
+		return nil, fmt.Errorf("get request digest: %s", err)
 	}
-	var httpResp *http.Response
-	for _, addr := range c.ring.Locations(d) {
-		method, url := getEndpoint(version, addr, h)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %s", err)
+	}
+	for _, addr := range ring.Locations(d) {
+		method, url := getEndpoint(version, addr, req.InfoHash)
+		var httpResp *http.Response
 		httpResp, err = httputil.Send(
 			method,
 			url,
-			httputil.SendBody(bytes.NewReader(body)),
-			httputil.SendTimeout(10*time.Second),
-			httputil.SendTLS(c.tls))
+			append([]httputil.SendOption{
+				httputil.SendBody(bytes.NewReader(body)),
+				httputil.SendTimeout(10 * time.Second),
+			}, opts...)...)
 		if err != nil {
 			if httputil.IsNetworkError(err) {
-				c.ring.Failed(addr)
+				ring.Failed(addr)
 				continue
 			}
-			return nil, 0, err
+			return nil, err
 		}
 		defer httpResp.Body.Close()
 		var resp Response
 		if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
-			return nil, 0, fmt.Errorf("decode response: %s", err)
+			return nil, fmt.Errorf("decode response: %s", err)
 		}
-		return resp.Peers, resp.Interval, nil
+		return &resp, nil
+	}
+	if err == nil {
+		err = errors.New("no tracker locations")
 	}
-	return nil, 0, err
+	return nil, err
 }
 
 // DisabledClient rejects all announces. Suitable for origin peers which should
@@ -144,7 +288,11 @@ func Disabled() Client {
 
 // Announce always returns error.
 func (c DisabledClient) Announce(
-	d core.Digest, h core.InfoHash, complete bool, version int) ([]*core.PeerInfo, time.Duration, error) {
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges,
+	version int) ([]*core.PeerInfo, time.Duration, error) {
 
 	return nil, 0, ErrDisabled
 }
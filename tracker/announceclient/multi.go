@@ -0,0 +1,276 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package announceclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+)
+
+// MultiConfig defines health tracking of trackers announced to by a multi
+// client.
+type MultiConfig struct {
+	// FailureThreshold is the number of consecutive failed announces after
+	// which a tracker is considered unhealthy.
+	FailureThreshold int `yaml:"failure_threshold"`
+
+	// Backoff is the duration an unhealthy tracker is skipped for.
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+func (c MultiConfig) applyDefaults() MultiConfig {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = 3
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 30 * time.Second
+	}
+	return c
+}
+
+// Tracker is a named tracker cluster announced to by a multi client.
+type Tracker struct {
+	Name   string
+	Client Client
+}
+
+type trackerHealth struct {
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// multiClient announces to several independent tracker clusters, such that a
+// single tracker outage does not partition the swarm.
+type multiClient struct {
+	config   MultiConfig
+	stats    tally.Scope
+	clk      clock.Clock
+	trackers []Tracker
+
+	mu     sync.Mutex
+	health []trackerHealth
+	next   int
+
+	// late holds the peers returned by trackers which answered after an
+	// announce already returned, merged into the next announce of the torrent.
+	late map[core.InfoHash][]*core.PeerInfo
+
+	// inflight tracks announces which have not completed yet.
+	inflight sync.WaitGroup
+}
+
+// NewMulti creates a Client which announces to all healthy trackers and merges
+// the peers they return. Announces return as soon as any tracker answers, and
+// the peers of slower trackers are merged into the next announce. Trackers which fail config.FailureThreshold announces
+// in a row are skipped for config.Backoff. If no tracker is healthy, trackers
+// are tried one at a time in rotation until one recovers.
+func NewMulti(
+	config MultiConfig, stats tally.Scope, clk clock.Clock, trackers []Tracker) Client {
+
+	return &multiClient{
+		config:   config.applyDefaults(),
+		stats:    stats.SubScope("multi_tracker"),
+		clk:      clk,
+		trackers: trackers,
+		health:   make([]trackerHealth, len(trackers)),
+		late:     make(map[core.InfoHash][]*core.PeerInfo),
+	}
+}
+
+// targets returns the indices of the trackers to announce to.
+func (c *multiClient) targets() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clk.Now()
+	var healthy []int
+	for i, h := range c.health {
+		if !now.Before(h.unhealthyUntil) {
+			healthy = append(healthy, i)
+		}
+	}
+	c.stats.Gauge("healthy_trackers").Update(float64(len(healthy)))
+	if len(healthy) > 0 {
+		return healthy
+	}
+	i := c.next % len(c.trackers)
+	c.next++
+	return []int{i}
+}
+
+// record updates the health of tracker i with the result of an announce.
+func (c *multiClient) record(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := &c.health[i]
+	if err == nil {
+		h.failures = 0
+		h.unhealthyUntil = time.Time{}
+		return
+	}
+	c.stats.Tagged(map[string]string{
+		"tracker": c.trackers[i].Name,
+	}).Counter("announce_failures").Inc(1)
+	h.failures++
+	if h.failures >= c.config.FailureThreshold {
+		h.unhealthyUntil = c.clk.Now().Add(c.config.Backoff)
+	}
+}
+
+// Announce announces to all healthy trackers. See AnnounceInline.
+func (c *multiClient) Announce(
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges,
+	version int) ([]*core.PeerInfo, time.Duration, error) {
+
+	resp, err := c.AnnounceInline(d, h, complete, have, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Peers, resp.Interval, nil
+}
+
+type announceResult struct {
+	tracker int
+	resp    *Response
+	err     error
+}
+
+// AnnounceInline announces to all healthy trackers concurrently, and returns
+// the response of the first tracker to succeed, such that a hung tracker does
+// not delay announces. The peers returned by the remaining trackers are merged
+// into the next announce of h. Fails only if every tracker failed.
+func (c *multiClient) AnnounceInline(
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges,
+	version int) (*Response, error) {
+
+	if len(c.trackers) == 0 {
+		return nil, errors.New("no trackers")
+	}
+	targets := c.targets()
+	results := make(chan announceResult, len(targets))
+	c.inflight.Add(len(targets))
+	for _, i := range targets {
+		go func(i int) {
+			defer c.inflight.Done()
+			resp, err := announceInline(c.trackers[i].Client, d, h, complete, have, version)
+			c.record(i, err)
+			results <- announceResult{i, resp, err}
+		}(i)
+	}
+	errs := make(map[int]error)
+	for n := len(targets); n > 0; n-- {
+		r := <-results
+		if r.err != nil {
+			errs[r.tracker] = r.err
+			continue
+		}
+		if n > 1 {
+			c.inflight.Add(1)
+			go c.mergeLate(h, results, n-1)
+		}
+		return c.withLate(h, r.resp), nil
+	}
+	i := targets[0]
+	return nil, fmt.Errorf("tracker %s: %s", c.trackers[i].Name, errs[i])
+}
+
+// mergeLate receives the remaining n results of an announce of h, and holds the
+// peers of successful results for the next announce of h.
+func (c *multiClient) mergeLate(h core.InfoHash, results <-chan announceResult, n int) {
+	defer c.inflight.Done()
+
+	for ; n > 0; n-- {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.late[h] = append(c.late[h], r.resp.Peers...)
+		c.mu.Unlock()
+	}
+}
+
+// withLate returns resp with the late peers held for h merged in, without
+// duplicates.
+func (c *multiClient) withLate(h core.InfoHash, resp *Response) *Response {
+	c.mu.Lock()
+	late := c.late[h]
+	delete(c.late, h)
+	c.mu.Unlock()
+
+	merged := &Response{Interval: resp.Interval, Content: resp.Content}
+	seen := make(map[core.PeerID]bool)
+	for _, peers := range [][]*core.PeerInfo{resp.Peers, late} {
+		for _, p := range peers {
+			if !seen[p.PeerID] {
+				seen[p.PeerID] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+	}
+	return merged
+}
+
+// AnnounceStopped announces to every tracker, regardless of health, that the
+// local peer stopped serving the torrent, such that no tracker keeps handing it
+// out. Returns the first error encountered.
+func (c *multiClient) AnnounceStopped(d core.Digest, h core.InfoHash, version int) error {
+	c.mu.Lock()
+	delete(c.late, h)
+	c.mu.Unlock()
+
+	var err error
+	for _, t := range c.trackers {
+		sc, ok := t.Client.(StoppedClient)
+		if !ok {
+			continue
+		}
+		if serr := sc.AnnounceStopped(d, h, version); serr != nil && err == nil {
+			err = fmt.Errorf("tracker %s: %s", t.Name, serr)
+		}
+	}
+	return err
+}
+
+func announceInline(
+	client Client,
+	d core.Digest,
+	h core.InfoHash,
+	complete bool,
+	have core.PieceRanges,
+	version int) (*Response, error) {
+
+	if ic, ok := client.(InlineClient); ok {
+		return ic.AnnounceInline(d, h, complete, have, version)
+	}
+	peers, interval, err := client.Announce(d, h, complete, have, version)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Peers: peers, Interval: interval}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package announceclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	mockannounceclient "github.com/uber/kraken/mocks/tracker/announceclient"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestMultiClientMergesLatePeersIntoNextAnnounce(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c1 := mockannounceclient.NewMockClient(ctrl)
+	c2 := mockannounceclient.NewMockClient(ctrl)
+
+	client := NewMulti(MultiConfig{}, tally.NoopScope, clock.NewMock(), []Tracker{
+		{"a", c1}, {"b", c2},
+	})
+
+	d := core.DigestFixture()
+	h := core.InfoHashFixture()
+	p1 := core.PeerInfoFixture()
+	p2 := core.PeerInfoFixture()
+	p3 := core.PeerInfoFixture()
+
+	// Tracker b hangs until tracker a's response was returned.
+	release := make(chan struct{})
+	c1.EXPECT().Announce(d, h, false, nil, V1).Return([]*core.PeerInfo{p1, p2}, 5*time.Second, nil)
+	c2.EXPECT().Announce(d, h, false, nil, V1).DoAndReturn(
+		func(core.Digest, core.InfoHash, bool, core.PieceRanges, int) ([]*core.PeerInfo, time.Duration, error) {
+			<-release
+			return []*core.PeerInfo{p2, p3}, 3 * time.Second, nil
+		})
+
+	peers, interval, err := client.Announce(d, h, false, nil, V1)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p1, p2}, peers)
+	require.Equal(5*time.Second, interval)
+
+	close(release)
+	client.(*multiClient).inflight.Wait()
+
+	// The late peers of tracker b are merged into the next announce.
+	c1.EXPECT().Announce(d, h, false, nil, V1).Return([]*core.PeerInfo{p1}, 5*time.Second, nil)
+	c2.EXPECT().Announce(d, h, false, nil, V1).Return(nil, time.Duration(0), errors.New("some error"))
+
+	peers, _, err = client.Announce(d, h, false, nil, V1)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p1, p2, p3}, peers)
+
+	client.(*multiClient).inflight.Wait()
+}
+
+func TestMultiClientSkipsUnhealthyTrackers(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c1 := mockannounceclient.NewMockClient(ctrl)
+	c2 := mockannounceclient.NewMockClient(ctrl)
+
+	clk := clock.NewMock()
+	config := MultiConfig{FailureThreshold: 2, Backoff: time.Minute}
+	client := NewMulti(config, tally.NoopScope, clk, []Tracker{{"a", c1}, {"b", c2}})
+
+	d := core.DigestFixture()
+	h := core.InfoHashFixture()
+	p := core.PeerInfoFixture()
+
+	c1.EXPECT().Announce(d, h, true, nil, V1).Return(nil, time.Duration(0), errors.New("some error")).Times(2)
+	c2.EXPECT().Announce(d, h, true, nil, V1).Return([]*core.PeerInfo{p}, time.Second, nil).Times(3)
+
+	// Announces succeed as long as any tracker is healthy.
+	for i := 0; i < 3; i++ {
+		peers, _, err := client.Announce(d, h, true, nil, V1)
+		require.NoError(err)
+		require.Equal([]*core.PeerInfo{p}, peers)
+		client.(*multiClient).inflight.Wait()
+	}
+
+	// Unhealthy trackers are retried once the backoff expires.
+	clk.Add(time.Minute)
+
+	c1.EXPECT().Announce(d, h, true, nil, V1).Return([]*core.PeerInfo{p}, time.Second, nil)
+	c2.EXPECT().Announce(d, h, true, nil, V1).Return(nil, time.Duration(0), errors.New("some error"))
+
+	peers, _, err := client.Announce(d, h, true, nil, V1)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p}, peers)
+	client.(*multiClient).inflight.Wait()
+}
+
+func TestMultiClientRotatesWhenAllTrackersUnhealthy(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c1 := mockannounceclient.NewMockClient(ctrl)
+	c2 := mockannounceclient.NewMockClient(ctrl)
+
+	config := MultiConfig{FailureThreshold: 1, Backoff: time.Minute}
+	client := NewMulti(config, tally.NoopScope, clock.NewMock(), []Tracker{{"a", c1}, {"b", c2}})
+
+	d := core.DigestFixture()
+	h := core.InfoHashFixture()
+
+	c1.EXPECT().Announce(d, h, true, nil, V1).Return(nil, time.Duration(0), errors.New("some error"))
+	c2.EXPECT().Announce(d, h, true, nil, V1).Return(nil, time.Duration(0), errors.New("some error"))
+
+	_, _, err := client.Announce(d, h, true, nil, V1)
+	require.Error(err)
+
+	// Only a single tracker is probed at a time, in rotation.
+	for _, c := range []*mockannounceclient.MockClient{c1, c2, c1} {
+		c.EXPECT().Announce(d, h, true, nil, V1).Return(nil, time.Duration(0), errors.New("some error"))
+		_, _, err := client.Announce(d, h, true, nil, V1)
+		require.Error(err)
+	}
+}
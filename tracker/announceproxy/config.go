@@ -0,0 +1,62 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package announceproxy
+
+import (
+	"time"
+
+	"github.com/uber/kraken/utils/listener"
+)
+
+// Config defines configuration for the announce proxy.
+type Config struct {
+	// Enable runs the announce proxy. Only one agent per rack should enable it.
+	Enable bool `yaml:"enable"`
+
+	// CacheTTL is how long a tracker response for an infohash is served from
+	// cache before the next announce for said infohash is forwarded
+	// synchronously.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// FlushInterval is how often announces answered from cache are batched and
+	// forwarded to the tracker, such that the tracker still learns about every
+	// peer behind the proxy.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// MaxPendingAnnounces limits the number of deduplicated announces waiting
+	// to be flushed. Announces beyond this limit are forwarded synchronously.
+	MaxPendingAnnounces int `yaml:"max_pending_announces"`
+
+	// DefaultInterval is the announce interval returned to complete peers whose
+	// announces are queued before any tracker response has been observed.
+	DefaultInterval time.Duration `yaml:"default_interval"`
+
+	Listener listener.Config `yaml:"listener"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.CacheTTL == 0 {
+		c.CacheTTL = 2 * time.Second
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.MaxPendingAnnounces == 0 {
+		c.MaxPendingAnnounces = 10000
+	}
+	if c.DefaultInterval == 0 {
+		c.DefaultInterval = 3 * time.Second
+	}
+	return c
+}
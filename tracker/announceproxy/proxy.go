@@ -0,0 +1,324 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package announceproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/pressly/chi"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/middleware"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/utils/handler"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/listener"
+	"github.com/uber/kraken/utils/log"
+)
+
+// Option allows setting optional Proxy parameters.
+type Option func(*Proxy)
+
+// WithClock configures a Proxy with a custom clock.
+func WithClock(clk clock.Clock) Option {
+	return func(p *Proxy) { p.clk = clk }
+}
+
+type cacheEntry struct {
+	resp      *announceclient.Response
+	expiresAt time.Time
+}
+
+type pendingKey struct {
+	h      core.InfoHash
+	peerID core.PeerID
+}
+
+type pendingAnnounce struct {
+	req     *announceclient.Request
+	version int
+}
+
+// Proxy aggregates announces from agents in the same rack before they reach
+// the tracker. The first announce for an infohash is forwarded synchronously
+// and its response is cached for CacheTTL. Announces which arrive while the
+// response is cached are answered from cache and deduplicated by peer, then
+// forwarded in batches every FlushInterval so the tracker still learns about
+// every peer. Since peer handouts are sorted relative to the peer which
+// triggered the cache fill, a Proxy should only serve agents which share
+// locality with each other.
+type Proxy struct {
+	config    Config
+	stats     tally.Scope
+	clk       clock.Clock
+	forwarder announceclient.Forwarder
+
+	mu      sync.Mutex
+	cache   map[core.InfoHash]cacheEntry
+	pending map[pendingKey]pendingAnnounce
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New creates a new Proxy which forwards announces through forwarder.
+func New(
+	config Config,
+	stats tally.Scope,
+	forwarder announceclient.Forwarder,
+	opts ...Option) *Proxy {
+
+	config = config.applyDefaults()
+
+	stats = stats.Tagged(map[string]string{
+		"module": "announceproxy",
+	})
+
+	p := &Proxy{
+		config:    config,
+		stats:     stats,
+		clk:       clock.New(),
+		forwarder: forwarder,
+		cache:     make(map[core.InfoHash]cacheEntry),
+		pending:   make(map[pendingKey]pendingAnnounce),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.wg.Add(1)
+	go p.flushLoop()
+
+	return p
+}
+
+// Close stops the background flush of pending announces.
+func (p *Proxy) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+	})
+}
+
+// Handler returns an http handler for p which mirrors the tracker announce
+// endpoints, such that agents may point their tracker config at p.
+func (p *Proxy) Handler() http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(middleware.StatusCounter(p.stats))
+	r.Use(middleware.LatencyTimer(p.stats))
+
+	r.Get("/health", handler.Wrap(p.healthHandler))
+	r.Get("/announce", handler.Wrap(p.announceHandlerV1))
+	r.Post("/announce/{infohash}", handler.Wrap(p.announceHandlerV2))
+
+	return r
+}
+
+// ListenAndServe is a blocking call which runs p.
+func (p *Proxy) ListenAndServe() error {
+	log.Infof("Starting announce proxy on %s", p.config.Listener)
+	return listener.Serve(p.config.Listener, p.Handler())
+}
+
+func (p *Proxy) healthHandler(w http.ResponseWriter, r *http.Request) error {
+	fmt.Fprintln(w, "OK")
+	return nil
+}
+
+func (p *Proxy) announceHandlerV1(w http.ResponseWriter, r *http.Request) error {
+	req := new(announceclient.Request)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return handler.Errorf("json decode request: %s", err)
+	}
+	return p.serveAnnounce(w, req, announceclient.V1)
+}
+
+func (p *Proxy) announceHandlerV2(w http.ResponseWriter, r *http.Request) error {
+	infohash, err := httputil.ParseParam(r, "infohash")
+	if err != nil {
+		return err
+	}
+	h, err := core.NewInfoHashFromHex(infohash)
+	if err != nil {
+		return handler.Errorf("parse infohash: %s", err).Status(http.StatusBadRequest)
+	}
+	req := new(announceclient.Request)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return handler.Errorf("json decode request: %s", err)
+	}
+	req.InfoHash = h
+	return p.serveAnnounce(w, req, announceclient.V2)
+}
+
+func (p *Proxy) serveAnnounce(
+	w http.ResponseWriter, req *announceclient.Request, version int) error {
+
+	if req.Peer == nil {
+		return handler.Errorf("request missing peer").Status(http.StatusBadRequest)
+	}
+	if _, err := req.GetDigest(); err != nil {
+		return handler.Errorf("get request digest: %s", err).Status(http.StatusBadRequest)
+	}
+	resp, err := p.announce(req, version)
+	if err != nil {
+		return handler.Errorf("forward announce: %s", err).Status(http.StatusBadGateway)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return handler.Errorf("json encode response: %s", err)
+	}
+	return nil
+}
+
+// announce answers req from cache if possible, else forwards req to the
+// tracker synchronously.
+func (p *Proxy) announce(
+	req *announceclient.Request, version int) (*announceclient.Response, error) {
+
+	h := req.InfoHash
+	k := pendingKey{h, req.Peer.PeerID}
+
+	p.mu.Lock()
+	entry, ok := p.cache[h]
+	if req.Peer.Complete {
+		// Complete peers receive no handout, so the tracker only needs to
+		// eventually learn that they are seeding.
+		if p.enqueue(k, req, version) {
+			interval := p.config.DefaultInterval
+			if ok {
+				interval = entry.resp.Interval
+			}
+			p.mu.Unlock()
+			p.stats.Counter("cache_hits").Inc(1)
+			return &announceclient.Response{Interval: interval}, nil
+		}
+	} else if ok && p.clk.Now().Before(entry.expiresAt) {
+		if p.enqueue(k, req, version) {
+			p.mu.Unlock()
+			p.stats.Counter("cache_hits").Inc(1)
+			return &announceclient.Response{
+				Peers:    excludePeer(entry.resp.Peers, req.Peer.PeerID),
+				Interval: entry.resp.Interval,
+			}, nil
+		}
+	}
+	p.mu.Unlock()
+
+	p.stats.Counter("cache_misses").Inc(1)
+
+	resp, err := p.forwarder.Forward(req, version)
+	if err != nil {
+		p.stats.Counter("forward_errors").Inc(1)
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.update(req, resp)
+	// The tracker has just seen this peer, so there is no need to flush any
+	// announce it queued earlier.
+	delete(p.pending, k)
+	p.mu.Unlock()
+
+	return resp, nil
+}
+
+// enqueue adds req to the pending announces, replacing any announce already
+// pending for the same peer. Returns false if there is no room for req.
+// Must be called with p.mu held.
+func (p *Proxy) enqueue(k pendingKey, req *announceclient.Request, version int) bool {
+	if _, ok := p.pending[k]; !ok && len(p.pending) >= p.config.MaxPendingAnnounces {
+		return false
+	}
+	p.pending[k] = pendingAnnounce{req, version}
+	return true
+}
+
+// update caches resp if it holds a peer handout. Must be called with p.mu held.
+func (p *Proxy) update(req *announceclient.Request, resp *announceclient.Response) {
+	if req.Peer.Complete {
+		// Responses to complete peers carry no handout and must not overwrite
+		// the cached handout.
+		return
+	}
+	p.cache[req.InfoHash] = cacheEntry{
+		resp:      resp,
+		expiresAt: p.clk.Now().Add(p.config.CacheTTL),
+	}
+}
+
+func (p *Proxy) flushLoop() {
+	defer p.wg.Done()
+
+	ticker := p.clk.Ticker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+// flush forwards all pending announces to the tracker and evicts expired
+// cache entries.
+func (p *Proxy) flush() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[pendingKey]pendingAnnounce)
+	now := p.clk.Now()
+	for h, entry := range p.cache {
+		if now.After(entry.expiresAt.Add(p.config.CacheTTL)) {
+			delete(p.cache, h)
+		}
+	}
+	p.mu.Unlock()
+
+	p.stats.Gauge("pending_announces").Update(float64(len(pending)))
+
+	for _, a := range pending {
+		resp, err := p.forwarder.Forward(a.req, a.version)
+		if err != nil {
+			p.stats.Counter("forward_errors").Inc(1)
+			log.With(
+				"hash", a.req.InfoHash,
+				"peer_id", a.req.Peer.PeerID).Errorf("Error forwarding announce: %s", err)
+			continue
+		}
+		p.stats.Counter("flushed_announces").Inc(1)
+		p.mu.Lock()
+		p.update(a.req, resp)
+		p.mu.Unlock()
+	}
+}
+
+func excludePeer(peers []*core.PeerInfo, peerID core.PeerID) []*core.PeerInfo {
+	var result []*core.PeerInfo
+	for _, peer := range peers {
+		if peer.PeerID != peerID {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
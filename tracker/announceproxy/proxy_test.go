@@ -0,0 +1,208 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package announceproxy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hashring"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+type fakeForwarder struct {
+	sync.Mutex
+	resp *announceclient.Response
+	err  error
+	reqs []*announceclient.Request
+}
+
+func (f *fakeForwarder) Forward(
+	req *announceclient.Request, version int) (*announceclient.Response, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	f.reqs = append(f.reqs, req)
+	return f.resp, f.err
+}
+
+func (f *fakeForwarder) forwarded() []*announceclient.Request {
+	f.Lock()
+	defer f.Unlock()
+	return append([]*announceclient.Request(nil), f.reqs...)
+}
+
+func newRequest(blob *core.BlobFixture, peer *core.PeerInfo) *announceclient.Request {
+	return &announceclient.Request{
+		Name:     blob.Digest.Hex(),
+		Digest:   &blob.Digest,
+		InfoHash: blob.MetaInfo.InfoHash(),
+		Peer:     peer,
+	}
+}
+
+func TestProxyServesCachedResponseAndFlushesAnnounces(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	config := Config{CacheTTL: 5 * time.Second, FlushInterval: time.Minute}
+	upstream := []*core.PeerInfo{core.PeerInfoFixture(), core.PeerInfoFixture()}
+	f := &fakeForwarder{
+		resp: &announceclient.Response{Peers: upstream, Interval: 3 * time.Second},
+	}
+	p := New(config, tally.NoopScope, f, WithClock(clk))
+	defer p.Close()
+
+	blob := core.NewBlobFixture()
+
+	resp, err := p.announce(newRequest(blob, core.PeerInfoFixture()), announceclient.V2)
+	require.NoError(err)
+	require.Equal(upstream, resp.Peers)
+	require.Len(f.forwarded(), 1)
+
+	// Subsequent announces, including repeats from the same peer, are answered
+	// from cache and deduplicated.
+	peer := core.PeerInfoFixture()
+	for i := 0; i < 3; i++ {
+		resp, err = p.announce(newRequest(blob, peer), announceclient.V2)
+		require.NoError(err)
+		require.Equal(upstream, resp.Peers)
+		require.Equal(3*time.Second, resp.Interval)
+	}
+	require.Len(f.forwarded(), 1)
+
+	p.flush()
+	reqs := f.forwarded()
+	require.Len(reqs, 2)
+	require.Equal(peer.PeerID, reqs[1].Peer.PeerID)
+
+	// Expired entries trigger a synchronous forward.
+	clk.Add(config.CacheTTL + time.Second)
+	_, err = p.announce(newRequest(blob, peer), announceclient.V2)
+	require.NoError(err)
+	require.Len(f.forwarded(), 3)
+}
+
+func TestProxyExcludesRequestingPeerFromCachedHandout(t *testing.T) {
+	require := require.New(t)
+
+	peer := core.PeerInfoFixture()
+	other := core.PeerInfoFixture()
+	f := &fakeForwarder{
+		resp: &announceclient.Response{Peers: []*core.PeerInfo{peer, other}},
+	}
+	p := New(Config{}, tally.NoopScope, f, WithClock(clock.NewMock()))
+	defer p.Close()
+
+	blob := core.NewBlobFixture()
+
+	_, err := p.announce(newRequest(blob, core.PeerInfoFixture()), announceclient.V1)
+	require.NoError(err)
+
+	resp, err := p.announce(newRequest(blob, peer), announceclient.V1)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{other}, resp.Peers)
+}
+
+func TestProxyQueuesCompleteAnnounces(t *testing.T) {
+	require := require.New(t)
+
+	f := &fakeForwarder{resp: &announceclient.Response{}}
+	config := Config{DefaultInterval: 7 * time.Second}
+	p := New(config, tally.NoopScope, f, WithClock(clock.NewMock()))
+	defer p.Close()
+
+	blob := core.NewBlobFixture()
+	peer := core.PeerInfoFixture()
+	peer.Complete = true
+
+	resp, err := p.announce(newRequest(blob, peer), announceclient.V1)
+	require.NoError(err)
+	require.Empty(resp.Peers)
+	require.Equal(config.DefaultInterval, resp.Interval)
+	require.Empty(f.forwarded())
+
+	p.flush()
+	require.Len(f.forwarded(), 1)
+}
+
+func TestProxyForwardsWhenPendingFull(t *testing.T) {
+	require := require.New(t)
+
+	f := &fakeForwarder{resp: &announceclient.Response{}}
+	p := New(Config{MaxPendingAnnounces: 1}, tally.NoopScope, f, WithClock(clock.NewMock()))
+	defer p.Close()
+
+	blob := core.NewBlobFixture()
+	for i := 0; i < 3; i++ {
+		peer := core.PeerInfoFixture()
+		peer.Complete = true
+		_, err := p.announce(newRequest(blob, peer), announceclient.V1)
+		require.NoError(err)
+	}
+	require.Len(f.forwarded(), 2)
+}
+
+func TestProxyForwardError(t *testing.T) {
+	require := require.New(t)
+
+	f := &fakeForwarder{err: errors.New("some error")}
+	p := New(Config{}, tally.NoopScope, f, WithClock(clock.NewMock()))
+	defer p.Close()
+
+	_, err := p.announce(
+		newRequest(core.NewBlobFixture(), core.PeerInfoFixture()), announceclient.V1)
+	require.Error(err)
+}
+
+func TestProxyHandlerSpeaksTrackerProtocol(t *testing.T) {
+	for _, version := range []int{announceclient.V1, announceclient.V2} {
+		require := require.New(t)
+
+		upstream := []*core.PeerInfo{core.PeerInfoFixture()}
+		f := &fakeForwarder{
+			resp: &announceclient.Response{Peers: upstream, Interval: time.Second},
+		}
+		p := New(Config{}, tally.NoopScope, f)
+		defer p.Close()
+
+		addr, stop := testutil.StartServer(p.Handler())
+		defer stop()
+
+		pctx := core.PeerContextFixture()
+		client := announceclient.New(
+			pctx, hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil)
+
+		blob := core.NewBlobFixture()
+		peers, interval, err := client.Announce(
+			blob.Digest, blob.MetaInfo.InfoHash(), false, nil, version)
+		require.NoError(err)
+		require.Equal(upstream, peers)
+		require.Equal(time.Second, interval)
+
+		reqs := f.forwarded()
+		require.Len(reqs, 1)
+		require.Equal(pctx.PeerID, reqs[0].Peer.PeerID)
+		require.Equal(blob.MetaInfo.InfoHash(), reqs[0].InfoHash)
+	}
+}
@@ -101,6 +101,9 @@ func Run(flags *Flags) {
 	r := blobclient.NewClientResolver(blobclient.NewProvider(blobclient.WithTLS(tls)), origins)
 	originCluster := blobclient.NewClusterClient(r)
 
+	if err := config.TrackerServer.Validate(); err != nil {
+		log.Fatalf("Invalid tracker server config: %s", err)
+	}
 	server := trackerserver.New(
 		config.TrackerServer, stats, policy, peerStore, originStore, originCluster)
 	go func() {
@@ -14,6 +14,7 @@
 package metainfoclient
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -36,7 +37,7 @@ var (
 
 // Client defines operations on torrent metainfo.
 type Client interface {
-	Download(namespace string, d core.Digest) (*core.MetaInfo, error)
+	Download(ctx context.Context, namespace string, d core.Digest) (*core.MetaInfo, error)
 }
 
 type client struct {
@@ -50,8 +51,11 @@ func New(ring hashring.PassiveRing, tls *tls.Config) Client {
 }
 
 // Download returns the MetaInfo associated with name. Returns ErrNotFound if
-// no torrent exists under name.
-func (c *client) Download(namespace string, d core.Digest) (*core.MetaInfo, error) {
+// no torrent exists under name. Returns ctx.Err() if ctx is done before the
+// metainfo is downloaded.
+func (c *client) Download(
+	ctx context.Context, namespace string, d core.Digest) (*core.MetaInfo, error) {
+
 	var resp *http.Response
 	var err error
 	for _, addr := range c.ring.Locations(d) {
@@ -59,17 +63,22 @@ func (c *client) Download(namespace string, d core.Digest) (*core.MetaInfo, erro
 			fmt.Sprintf(
 				"http://%s/namespace/%s/blobs/%s/metainfo",
 				addr, url.PathEscape(namespace), d),
-			&backoff.ExponentialBackOff{
+			backoff.WithContext(&backoff.ExponentialBackOff{
 				InitialInterval:     time.Second,
 				RandomizationFactor: 0.05,
 				Multiplier:          1.3,
 				MaxInterval:         5 * time.Second,
 				MaxElapsedTime:      15 * time.Minute,
 				Clock:               backoff.SystemClock,
-			},
+			}, ctx),
 			httputil.SendTimeout(10*time.Second),
-			httputil.SendTLS(c.tls))
+			httputil.SendTLS(c.tls),
+			httputil.SendContext(ctx))
 		if err != nil {
+			if ctx.Err() != nil {
+				// Cancellation is not a failure of addr.
+				return nil, ctx.Err()
+			}
 			if httputil.IsNetworkError(err) {
 				c.ring.Failed(addr)
 				continue
@@ -0,0 +1,52 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metainfoclient
+
+import (
+	"context"
+
+	"github.com/uber/kraken/core"
+)
+
+type failoverClient struct {
+	clients []Client
+}
+
+// NewFailover returns a Client which downloads metainfo from each of clients in
+// order until one succeeds, such that metainfo remains available while a
+// tracker cluster is down. Returns ErrNotFound only if every client returned
+// ErrNotFound.
+func NewFailover(clients ...Client) Client {
+	return &failoverClient{clients}
+}
+
+// Download returns the metainfo of d from the first client which has it.
+func (c *failoverClient) Download(
+	ctx context.Context, namespace string, d core.Digest) (*core.MetaInfo, error) {
+
+	err := ErrNotFound
+	for _, client := range c.clients {
+		mi, cerr := client.Download(ctx, namespace, d)
+		if cerr == nil {
+			return mi, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if cerr != ErrNotFound {
+			err = cerr
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metainfoclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+type errClient struct {
+	err error
+}
+
+func (c errClient) Download(context.Context, string, core.Digest) (*core.MetaInfo, error) {
+	return nil, c.err
+}
+
+func TestFailoverClientFallsBackOnError(t *testing.T) {
+	require := require.New(t)
+
+	mi := core.MetaInfoFixture()
+	fallback := NewTestClient()
+	require.NoError(fallback.Upload(mi))
+
+	client := NewFailover(errClient{errors.New("some error")}, fallback)
+
+	result, err := client.Download(context.Background(), "noexist", mi.Digest())
+	require.NoError(err)
+	require.Equal(mi, result)
+}
+
+func TestFailoverClientErrors(t *testing.T) {
+	d := core.DigestFixture()
+	someErr := errors.New("some error")
+
+	tests := []struct {
+		desc     string
+		clients  []Client
+		expected error
+	}{
+		{"all not found", []Client{NewTestClient(), NewTestClient()}, ErrNotFound},
+		{"not found and error", []Client{errClient{someErr}, NewTestClient()}, someErr},
+		{"error and not found", []Client{NewTestClient(), errClient{someErr}}, someErr},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := NewFailover(test.clients...).Download(context.Background(), "noexist", d)
+			require.Equal(t, test.expected, err)
+		})
+	}
+}
+
+func TestFailoverClientStopsOnContextDone(t *testing.T) {
+	require := require.New(t)
+
+	mi := core.MetaInfoFixture()
+	fallback := NewTestClient()
+	require.NoError(fallback.Upload(mi))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client := NewFailover(errClient{context.Canceled}, fallback)
+
+	_, err := client.Download(ctx, "noexist", mi.Digest())
+	require.Equal(context.Canceled, err)
+}
@@ -31,37 +31,85 @@ func peerSetKey(h core.InfoHash, window int64) string {
 	return fmt.Sprintf("peerset:%s:%d", h.String(), window)
 }
 
+// stoppedPeersKey is the set of ids of peers which stopped serving h. Stopped
+// peers are excluded from handouts until they announce again.
+func stoppedPeersKey(h core.InfoHash) string {
+	return fmt.Sprintf("stopped:%s", h.String())
+}
+
 func serializePeer(p *core.PeerInfo) string {
 	var completeBit int
 	if p.Complete {
 		completeBit = 1
 	}
-	return fmt.Sprintf("%s:%s:%d:%d", p.PeerID.String(), p.IP, p.Port, completeBit)
+	s := fmt.Sprintf("%s:%s:%d:%d", p.PeerID.String(), p.IP, p.Port, completeBit)
+	if p.Partial() || p.Rack != "" {
+		var have string
+		if p.Partial() {
+			have = p.HaveRanges.String()
+		}
+		s += ":" + have
+	}
+	if p.Rack != "" {
+		s += ":" + p.Rack
+	}
+	return s
 }
 
 type peerIdentity struct {
 	peerID core.PeerID
 	ip     string
 	port   int
+	rack   string
+}
+
+// peerStatus is the completion state of a peer.
+type peerStatus struct {
+	complete bool
+	have     core.PieceRanges
+}
+
+// merge combines the status of a peer observed in multiple windows, favoring
+// complete peers and otherwise the largest advertised set of pieces.
+func (s peerStatus) merge(o peerStatus) peerStatus {
+	if s.complete || o.complete {
+		return peerStatus{complete: true}
+	}
+	if o.have.Count() > s.have.Count() {
+		return o
+	}
+	return s
 }
 
-func deserializePeer(s string) (id peerIdentity, complete bool, err error) {
-	parts := strings.Split(s, ":")
-	if len(parts) != 4 {
-		return id, false, fmt.Errorf("invalid peer encoding: expected 'pid:ip:port:complete'")
+func deserializePeer(s string) (id peerIdentity, status peerStatus, err error) {
+	// The rack is the last, optional field. Racks never contain ':', since
+	// agents reject such racks on startup.
+	parts := strings.SplitN(s, ":", 6)
+	if len(parts) < 4 {
+		return id, status, fmt.Errorf(
+			"invalid peer encoding: expected 'pid:ip:port:complete[:have[:rack]]'")
 	}
 	peerID, err := core.NewPeerID(parts[0])
 	if err != nil {
-		return id, false, fmt.Errorf("parse peer id: %s", err)
+		return id, status, fmt.Errorf("parse peer id: %s", err)
 	}
 	ip := parts[1]
 	port, err := strconv.Atoi(parts[2])
 	if err != nil {
-		return id, false, fmt.Errorf("parse port: %s", err)
+		return id, status, fmt.Errorf("parse port: %s", err)
+	}
+	id = peerIdentity{peerID: peerID, ip: ip, port: port}
+	if len(parts) == 6 {
+		id.rack = parts[5]
 	}
-	id = peerIdentity{peerID, ip, port}
-	complete = parts[3] == "1"
-	return id, complete, nil
+	status.complete = parts[3] == "1"
+	if len(parts) >= 5 && parts[4] != "" {
+		status.have, err = core.ParsePieceRanges(parts[4])
+		if err != nil {
+			return id, status, fmt.Errorf("parse have ranges: %s", err)
+		}
+	}
+	return id, status, nil
 }
 
 // RedisStore is a Store backed by Redis.
@@ -140,6 +188,44 @@ func (s *RedisStore) UpdatePeer(h core.InfoHash, p *core.PeerInfo) error {
 	if err := c.Send("EXPIREAT", k, expireAt); err != nil {
 		return fmt.Errorf("send EXPIREAT: %s", err)
 	}
+	// A peer which announces again after stopping is served again.
+	if err := c.Send("SREM", stoppedPeersKey(h), p.PeerID.String()); err != nil {
+		return fmt.Errorf("send SREM: %s", err)
+	}
+	if err := c.Flush(); err != nil {
+		return fmt.Errorf("flush: %s", err)
+	}
+	if _, err := c.Receive(); err != nil {
+		return fmt.Errorf("SADD: %s", err)
+	}
+	if _, err := c.Receive(); err != nil {
+		return fmt.Errorf("EXPIREAT: %s", err)
+	}
+	if _, err := c.Receive(); err != nil {
+		return fmt.Errorf("SREM: %s", err)
+	}
+	return nil
+}
+
+// RemovePeer excludes the peer of peerID from handouts of h until it updates
+// h again. Entries of the peer are not removed from the peer sets, which
+// would require scanning them, but are filtered out by GetPeers until they
+// expire.
+func (s *RedisStore) RemovePeer(h core.InfoHash, peerID core.PeerID) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	// Entries of the peer expire with the current window at the latest.
+	w := s.curPeerSetWindow()
+	expireAt := w + int64(s.config.PeerSetWindowSize.Seconds())*int64(s.config.MaxPeerSetWindows)
+
+	k := stoppedPeersKey(h)
+	if err := c.Send("SADD", k, peerID.String()); err != nil {
+		return fmt.Errorf("send SADD: %s", err)
+	}
+	if err := c.Send("EXPIREAT", k, expireAt); err != nil {
+		return fmt.Errorf("send EXPIREAT: %s", err)
+	}
 	if err := c.Flush(); err != nil {
 		return fmt.Errorf("flush: %s", err)
 	}
@@ -166,8 +252,17 @@ func (s *RedisStore) GetPeers(h core.InfoHash, n int) ([]*core.PeerInfo, error)
 	windows := s.peerSetWindows()
 	randutil.ShuffleInt64s(windows)
 
+	stopped, err := redis.Strings(c.Do("SMEMBERS", stoppedPeersKey(h)))
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("SMEMBERS: %s", err)
+	}
+	excluded := make(map[string]bool, len(stopped))
+	for _, id := range stopped {
+		excluded[id] = true
+	}
+
 	// Eliminate duplicates from other windows and collapses complete bits.
-	selected := make(map[peerIdentity]bool)
+	selected := make(map[peerIdentity]peerStatus)
 
 	for i := 0; len(selected) < n && i < len(windows); i++ {
 		k := peerSetKey(h, windows[i])
@@ -178,18 +273,23 @@ func (s *RedisStore) GetPeers(h core.InfoHash, n int) ([]*core.PeerInfo, error)
 			return nil, err
 		}
 		for _, s := range result {
-			id, complete, err := deserializePeer(s)
+			id, status, err := deserializePeer(s)
 			if err != nil {
 				log.Errorf("Error deserializing peer %q: %s", s, err)
 				continue
 			}
-			selected[id] = selected[id] || complete
+			if excluded[id.peerID.String()] {
+				continue
+			}
+			selected[id] = selected[id].merge(status)
 		}
 	}
 
 	var peers []*core.PeerInfo
-	for id, complete := range selected {
-		p := core.NewPeerInfo(id.peerID, id.ip, id.port, false, complete)
+	for id, status := range selected {
+		p := core.NewPeerInfo(id.peerID, id.ip, id.port, false, status.complete)
+		p.HaveRanges = status.have
+		p.Rack = id.rack
 		peers = append(peers, p)
 	}
 	return peers, nil
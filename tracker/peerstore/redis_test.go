@@ -56,6 +56,81 @@ func TestRedisStoreGetPeersPopulatesPeerInfoFields(t *testing.T) {
 	require.Equal(peers, []*core.PeerInfo{p})
 }
 
+func TestRedisStoreRemovePeer(t *testing.T) {
+	require := require.New(t)
+
+	config := redisConfigFixture()
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	s, err := NewRedisStore(config, clk)
+	require.NoError(err)
+
+	h := core.InfoHashFixture()
+
+	p1 := core.PeerInfoFixture()
+	p2 := core.PeerInfoFixture()
+
+	// Spread p1 across multiple windows.
+	require.NoError(s.UpdatePeer(h, p1))
+	clk.Add(config.PeerSetWindowSize)
+	p1.Complete = true
+	require.NoError(s.UpdatePeer(h, p1))
+	require.NoError(s.UpdatePeer(h, p2))
+
+	require.NoError(s.RemovePeer(h, p1.PeerID))
+
+	peers, err := s.GetPeers(h, 2)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p2}, peers)
+
+	// Peers which announce again after stopping are handed out again.
+	require.NoError(s.UpdatePeer(h, p1))
+
+	peers, err = s.GetPeers(h, 2)
+	require.NoError(err)
+	require.ElementsMatch([]*core.PeerInfo{p1, p2}, peers)
+}
+
+func TestRedisStoreGetPeersPopulatesRack(t *testing.T) {
+	require := require.New(t)
+
+	config := redisConfigFixture()
+
+	s, err := NewRedisStore(config, clock.New())
+	require.NoError(err)
+
+	h := core.InfoHashFixture()
+
+	complete := core.PeerInfoFixture()
+	complete.Complete = true
+	complete.Rack = "rack1"
+
+	partial := core.PeerInfoFixture()
+	partial.HaveRanges = core.PieceRanges{{Start: 0, End: 3}}
+	partial.Rack = "rack2"
+
+	require.NoError(s.UpdatePeer(h, complete))
+	require.NoError(s.UpdatePeer(h, partial))
+
+	peers, err := s.GetPeers(h, 2)
+	require.NoError(err)
+	require.ElementsMatch([]*core.PeerInfo{complete, partial}, peers)
+}
+
+func TestDeserializePeerWithRackContainingColons(t *testing.T) {
+	require := require.New(t)
+
+	p := core.PeerInfoFixture()
+	p.Rack = "dc1:row2:rack3"
+
+	id, _, err := deserializePeer(serializePeer(p))
+	require.NoError(err)
+	require.Equal(p.Rack, id.rack)
+	require.Equal(p.Port, id.port)
+}
+
 func TestRedisStoreGetPeersFromMultipleWindows(t *testing.T) {
 	require := require.New(t)
 
@@ -154,6 +229,37 @@ func TestRedisStoreGetPeersCollapsesCompleteBits(t *testing.T) {
 	require.True(peers[0].Complete)
 }
 
+func TestRedisStoreGetPeersPopulatesHaveRanges(t *testing.T) {
+	require := require.New(t)
+
+	config := redisConfigFixture()
+
+	s, err := NewRedisStore(config, clock.New())
+	require.NoError(err)
+
+	h := core.InfoHashFixture()
+	p := core.PeerInfoFixture()
+	p.HaveRanges = core.PieceRanges{{Start: 0, End: 1}}
+
+	require.NoError(s.UpdatePeer(h, p))
+
+	p.HaveRanges = core.PieceRanges{{Start: 0, End: 4}, {Start: 6, End: 6}}
+	require.NoError(s.UpdatePeer(h, p))
+
+	peers, err := s.GetPeers(h, 2)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p}, peers)
+
+	p.Complete = true
+	require.NoError(s.UpdatePeer(h, p))
+
+	peers, err = s.GetPeers(h, 3)
+	require.NoError(err)
+	require.Len(peers, 1)
+	require.True(peers[0].Complete)
+	require.Empty(peers[0].HaveRanges)
+}
+
 func TestRedisStorePeerExpiration(t *testing.T) {
 	require := require.New(t)
 
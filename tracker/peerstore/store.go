@@ -25,4 +25,7 @@ type Store interface {
 
 	// UpdatePeer updates peer fields.
 	UpdatePeer(h core.InfoHash, peer *core.PeerInfo) error
+
+	// RemovePeer removes the peer of peerID from h.
+	RemovePeer(h core.InfoHash, peerID core.PeerID) error
 }
@@ -51,6 +51,20 @@ func (s *testStore) UpdatePeer(h core.InfoHash, p *core.PeerInfo) error {
 	return nil
 }
 
+func (s *testStore) RemovePeer(h core.InfoHash, peerID core.PeerID) error {
+	s.Lock()
+	defer s.Unlock()
+
+	peers := s.torrents[h]
+	for i := range peers {
+		if peers[i].PeerID == peerID {
+			s.torrents[h] = append(peers[:i], peers[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
 func (s *testStore) GetPeers(h core.InfoHash, n int) ([]*core.PeerInfo, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -0,0 +1,51 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// Client pulls exports from peers.
+type Client interface {
+	Pull(addr string) (*Export, error)
+}
+
+type client struct {
+	tls *tls.Config
+}
+
+// NewClient creates a new Client.
+func NewClient(tls *tls.Config) Client {
+	return &client{tls}
+}
+
+// Pull fetches the current export of the agent at addr.
+func (c *client) Pull(addr string) (*Export, error) {
+	resp, err := httputil.Get(
+		fmt.Sprintf("http://%s/x/seeded", addr), httputil.SendTLS(c.tls))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var e Export
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, fmt.Errorf("decode export: %s", err)
+	}
+	return &e, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// Export errors.
+var (
+	ErrUnsigned         = errors.New("export is not signed")
+	ErrInvalidSignature = errors.New("export signature is invalid")
+)
+
+// Export is a snapshot of the info hashes a peer is seeding, published such
+// that trackers may reconcile their records with the actual state of the peer,
+// e.g. after missed announces or a tracker restart.
+type Export struct {
+	Peer        *core.PeerInfo `json:"peer"`
+	GeneratedAt time.Time      `json:"generated_at"`
+
+	// InfoHashes are the hex encoded info hashes of seeded torrents, in sorted
+	// order.
+	InfoHashes []string `json:"info_hashes"`
+
+	// Torrents identifies the same seeded torrents by namespace and digest, in
+	// sorted order, such that neighbors may download them.
+	Torrents []Torrent `json:"torrents"`
+
+	// Signature is the hex encoded HMAC-SHA256 of the export, if signed.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Torrent identifies a seeded torrent by the namespace and digest of its blob.
+type Torrent struct {
+	Namespace string      `json:"namespace"`
+	Digest    core.Digest `json:"digest"`
+}
+
+// NewExport creates a new unsigned Export.
+func NewExport(peer *core.PeerInfo, hashes []core.InfoHash, now time.Time) *Export {
+	hexes := make([]string, len(hashes))
+	for i, h := range hashes {
+		hexes[i] = h.Hex()
+	}
+	sort.Strings(hexes)
+	return &Export{
+		Peer:        peer,
+		GeneratedAt: now,
+		InfoHashes:  hexes,
+	}
+}
+
+// payload returns the canonical encoding of e which is signed.
+func (e *Export) payload() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s:%d\n%d\n", e.Peer.PeerID, e.Peer.IP, e.Peer.Port, e.GeneratedAt.UnixNano())
+	for _, h := range e.InfoHashes {
+		b.WriteString(h)
+		b.WriteString("\n")
+	}
+	for _, t := range e.Torrents {
+		fmt.Fprintf(&b, "%s %s\n", t.Namespace, t.Digest)
+	}
+	return []byte(b.String())
+}
+
+func (e *Export) mac(key []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(e.payload())
+	return m.Sum(nil)
+}
+
+// Sign signs e with key.
+func (e *Export) Sign(key []byte) {
+	e.Signature = hex.EncodeToString(e.mac(key))
+}
+
+// Verify checks that e was signed with key.
+func (e *Export) Verify(key []byte) error {
+	if e.Signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := hex.DecodeString(e.Signature)
+	if err != nil || !hmac.Equal(sig, e.mac(key)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SetTorrents sets the torrents of e in sorted order. Must be called before
+// signing.
+func (e *Export) SetTorrents(torrents []Torrent) {
+	sort.Slice(torrents, func(i, j int) bool {
+		if torrents[i].Namespace != torrents[j].Namespace {
+			return torrents[i].Namespace < torrents[j].Namespace
+		}
+		return torrents[i].Digest.String() < torrents[j].Digest.String()
+	})
+	e.Torrents = torrents
+}
+
+// Hashes parses the info hashes of e.
+func (e *Export) Hashes() ([]core.InfoHash, error) {
+	hashes := make([]core.InfoHash, len(e.InfoHashes))
+	for i, s := range e.InfoHashes {
+		h, err := core.NewInfoHashFromHex(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse info hash %q: %s", s, err)
+		}
+		hashes[i] = h
+	}
+	return hashes, nil
+}
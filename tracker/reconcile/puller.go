@@ -0,0 +1,155 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/utils/log"
+)
+
+// ErrUnknownPeer is returned when pulling from an address which is not a
+// configured peer.
+var ErrUnknownPeer = errors.New("addr is not a configured peer")
+
+// Puller pulls the exports of the configured peers, periodically and on
+// demand, and reconciles them.
+type Puller struct {
+	config     Config
+	stats      tally.Scope
+	clk        clock.Clock
+	peers      hostlist.List
+	client     Client
+	reconciler *Reconciler
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPuller creates a new Puller. config must be valid.
+func NewPuller(
+	config Config,
+	stats tally.Scope,
+	clk clock.Clock,
+	client Client,
+	reconciler *Reconciler) (*Puller, error) {
+
+	config = config.applyDefaults()
+	peers, err := hostlist.New(config.Peers)
+	if err != nil {
+		return nil, fmt.Errorf("peers: %s", err)
+	}
+	stats = stats.Tagged(map[string]string{
+		"module": "reconcilepuller",
+	})
+	return &Puller{
+		config:     config,
+		stats:      stats,
+		clk:        clk,
+		peers:      peers,
+		client:     client,
+		reconciler: reconciler,
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// Pull fetches the export of the configured peer at addr.
+func (p *Puller) Pull(addr string) (*Export, error) {
+	if !p.peers.Resolve().Has(addr) {
+		return nil, ErrUnknownPeer
+	}
+	return p.client.Pull(addr)
+}
+
+// Reconcile reconciles e, which was pulled from addr. The peer of e must be
+// the host at addr, such that peers cannot vouch for other peers.
+func (p *Puller) Reconcile(addr string, e *Export) (*Result, error) {
+	if e.Peer == nil {
+		return nil, errors.New("export has no peer")
+	}
+	ok, err := hostMatches(addr, e.Peer.IP)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrPeerMismatch
+	}
+	return p.reconciler.Reconcile(e)
+}
+
+// hostMatches returns true if the host of addr resolves to ip.
+func hostMatches(addr string, ip string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, fmt.Errorf("split addr: %s", err)
+	}
+	if host == ip {
+		return true, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return false, fmt.Errorf("lookup host: %s", err)
+	}
+	for _, h := range ips {
+		if h == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Start pulls the exports of all peers every interval until Stop is called.
+func (p *Puller) Start() {
+	go p.run()
+}
+
+// Stop stops pulling. Stop is idempotent.
+func (p *Puller) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+func (p *Puller) run() {
+	ticker := p.clk.Ticker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.pullAll()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Puller) pullAll() {
+	for addr := range p.peers.Resolve() {
+		e, err := p.Pull(addr)
+		if err == nil {
+			_, err = p.Reconcile(addr, e)
+		}
+		if err != nil {
+			p.stats.Counter("pull_errors").Inc(1)
+			log.With("addr", addr).Errorf("Error reconciling export: %s", err)
+			continue
+		}
+		p.stats.Counter("pulls").Inc(1)
+	}
+}
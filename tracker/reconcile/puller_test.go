@@ -0,0 +1,130 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/peerstore"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+type fakeClient struct {
+	exports map[string]*Export
+}
+
+func (c fakeClient) Pull(addr string) (*Export, error) {
+	return c.exports[addr], nil
+}
+
+func TestConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(Config{}.Validate())
+	require.Error(Config{Enable: true, Peers: hostlist.Config{Static: []string{"a:1"}}}.Validate())
+	require.Error(Config{Enable: true, SigningKey: "key"}.Validate())
+	require.NoError(Config{
+		Enable:     true,
+		SigningKey: "key",
+		Peers:      hostlist.Config{Static: []string{"a:1"}},
+	}.Validate())
+}
+
+func TestReconcileRejectsExportsWithoutSigningKey(t *testing.T) {
+	clk := clock.NewMock()
+	r := New(Config{}, tally.NoopScope, clk, peerstore.NewTestStore())
+
+	e := NewExport(core.PeerInfoFixture(), []core.InfoHash{core.InfoHashFixture()}, clk.Now())
+	e.Sign(nil)
+	_, err := r.Reconcile(e)
+	require.Equal(t, ErrUnsigned, err)
+}
+
+func TestPullerOnlyReconcilesConfiguredPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	store := peerstore.NewTestStore()
+	config := Config{
+		Enable:     true,
+		SigningKey: "key",
+		Peers:      hostlist.Config{Static: []string{"127.0.0.1:8000"}},
+	}
+
+	peer := core.PeerInfoFixture()
+	peer.IP = "127.0.0.1"
+	e := NewExport(peer, []core.InfoHash{core.InfoHashFixture()}, clk.Now())
+	e.Sign([]byte("key"))
+
+	// The second export vouches for a host other than the one it is pulled
+	// from.
+	other := NewExport(core.PeerInfoFixture(), []core.InfoHash{core.InfoHashFixture()}, clk.Now())
+	other.Sign([]byte("key"))
+
+	client := fakeClient{map[string]*Export{"127.0.0.1:8000": e, "127.0.0.1:9000": other}}
+	p, err := NewPuller(config, tally.NoopScope, clk, client, New(config, tally.NoopScope, clk, store))
+	require.NoError(err)
+
+	_, err = p.Pull("127.0.0.1:9000")
+	require.Equal(ErrUnknownPeer, err)
+
+	_, err = p.Reconcile("127.0.0.1:9000", other)
+	require.Equal(ErrPeerMismatch, err)
+
+	pulled, err := p.Pull("127.0.0.1:8000")
+	require.NoError(err)
+	res, err := p.Reconcile("127.0.0.1:8000", pulled)
+	require.NoError(err)
+	require.Equal(&Result{Refreshed: 1, Missing: 1}, res)
+}
+
+func TestPullerPullsPeersPeriodically(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	store := peerstore.NewTestStore()
+	config := Config{
+		Enable:     true,
+		SigningKey: "key",
+		Peers:      hostlist.Config{Static: []string{"127.0.0.1:8000"}},
+		Interval:   time.Minute,
+		MaxAge:     24 * time.Hour,
+	}
+
+	peer := core.PeerInfoFixture()
+	peer.IP = "127.0.0.1"
+	h := core.InfoHashFixture()
+	e := NewExport(peer, []core.InfoHash{h}, clk.Now())
+	e.Sign([]byte("key"))
+
+	client := fakeClient{map[string]*Export{"127.0.0.1:8000": e}}
+	p, err := NewPuller(config, tally.NoopScope, clk, client, New(config, tally.NoopScope, clk, store))
+	require.NoError(err)
+
+	p.Start()
+	defer p.Stop()
+
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		clk.Add(time.Minute)
+		peers, err := store.GetPeers(h, 10)
+		return err == nil && len(peers) == 1
+	}))
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/peerstore"
+)
+
+// Reconcile errors.
+var (
+	ErrStaleExport  = errors.New("export is stale")
+	ErrPeerMismatch = errors.New("export peer does not match the pulled address")
+)
+
+// Config defines Reconciler configuration.
+type Config struct {
+	Enable bool `yaml:"enable"`
+
+	// SigningKey is the key exports must be signed with. Required if enabled,
+	// since anyone can sign exports with an empty key.
+	SigningKey string `yaml:"signing_key"`
+
+	// Peers are the addresses of the agents whose exports are pulled. Exports
+	// are never pulled from other addresses.
+	Peers hostlist.Config `yaml:"peers"`
+
+	// Interval is the interval in which the exports of all peers are pulled.
+	Interval time.Duration `yaml:"interval"`
+
+	// MaxAge is the maximum age of an export which is reconciled.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// MaxPeersChecked is the number of peers sampled from the peer store to
+	// detect whether the exporting peer is missing from a torrent. Drift in
+	// larger swarms may go undetected, but is still corrected.
+	MaxPeersChecked int `yaml:"max_peers_checked"`
+}
+
+// Validate returns an error if c is enabled but invalid.
+func (c Config) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.SigningKey == "" {
+		return errors.New("signing key required")
+	}
+	if c.Peers.DNS == "" && len(c.Peers.Static) == 0 {
+		return errors.New("peers required")
+	}
+	return nil
+}
+
+func (c Config) applyDefaults() Config {
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Minute
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 10 * time.Minute
+	}
+	if c.MaxPeersChecked == 0 {
+		c.MaxPeersChecked = 500
+	}
+	return c
+}
+
+// Result summarizes a reconciliation.
+type Result struct {
+	// Refreshed is the number of info hashes the peer was re-announced for.
+	Refreshed int `json:"refreshed"`
+
+	// Missing is the number of info hashes the peer store had no record of the
+	// peer seeding.
+	Missing int `json:"missing"`
+}
+
+// Reconciler corrects drift between peer exports and the peer store.
+type Reconciler struct {
+	config    Config
+	stats     tally.Scope
+	clk       clock.Clock
+	peerStore peerstore.Store
+}
+
+// New creates a new Reconciler.
+func New(
+	config Config, stats tally.Scope, clk clock.Clock, peerStore peerstore.Store) *Reconciler {
+
+	config = config.applyDefaults()
+
+	stats = stats.Tagged(map[string]string{
+		"module": "reconcile",
+	})
+
+	return &Reconciler{config, stats, clk, peerStore}
+}
+
+// Reconcile verifies e and records the exporting peer as a seeder of each of
+// the exported info hashes.
+func (r *Reconciler) Reconcile(e *Export) (*Result, error) {
+	if r.config.SigningKey == "" {
+		// Anyone can sign with an empty key, so exports cannot be trusted.
+		return nil, ErrUnsigned
+	}
+	if err := e.Verify([]byte(r.config.SigningKey)); err != nil {
+		return nil, err
+	}
+	if e.Peer == nil {
+		return nil, errors.New("export has no peer")
+	}
+	if r.clk.Now().Sub(e.GeneratedAt) > r.config.MaxAge {
+		return nil, ErrStaleExport
+	}
+	hashes, err := e.Hashes()
+	if err != nil {
+		return nil, err
+	}
+	peer := *e.Peer
+	peer.Complete = true
+
+	res := &Result{}
+	for _, h := range hashes {
+		// Some stores return errors for unknown info hashes, which counts as
+		// the peer missing. Genuine store failures surface from UpdatePeer.
+		peers, err := r.peerStore.GetPeers(h, r.config.MaxPeersChecked)
+		if err != nil || !containsPeer(peers, &peer) {
+			res.Missing++
+		}
+		if err := r.peerStore.UpdatePeer(h, &peer); err != nil {
+			return nil, fmt.Errorf("update peer: %s", err)
+		}
+		res.Refreshed++
+	}
+	r.stats.Counter("refreshed").Inc(int64(res.Refreshed))
+	r.stats.Counter("missing").Inc(int64(res.Missing))
+	return res, nil
+}
+
+func containsPeer(peers []*core.PeerInfo, p *core.PeerInfo) bool {
+	for _, q := range peers {
+		if q.PeerID == p.PeerID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reconcile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/peerstore"
+)
+
+func TestExportSignAndVerify(t *testing.T) {
+	require := require.New(t)
+
+	e := NewExport(
+		core.PeerInfoFixture(),
+		[]core.InfoHash{core.InfoHashFixture(), core.InfoHashFixture()},
+		time.Now())
+
+	require.Equal(ErrUnsigned, e.Verify([]byte("key")))
+
+	e.Sign([]byte("key"))
+	require.NoError(e.Verify([]byte("key")))
+	require.Equal(ErrInvalidSignature, e.Verify([]byte("other")))
+
+	e.InfoHashes = e.InfoHashes[:1]
+	require.Equal(ErrInvalidSignature, e.Verify([]byte("key")))
+}
+
+func TestReconcileRestoresMissingPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	store := peerstore.NewTestStore()
+	r := New(Config{SigningKey: "key"}, tally.NoopScope, clk, store)
+
+	peer := core.PeerInfoFixture()
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+
+	// The tracker only knows of the peer seeding h1, e.g. because announces
+	// for h2 were lost.
+	require.NoError(store.UpdatePeer(h1, peer))
+
+	e := NewExport(peer, []core.InfoHash{h1, h2}, clk.Now())
+	e.Sign([]byte("key"))
+
+	res, err := r.Reconcile(e)
+	require.NoError(err)
+	require.Equal(&Result{Refreshed: 2, Missing: 1}, res)
+
+	peers, err := store.GetPeers(h2, 10)
+	require.NoError(err)
+	require.Len(peers, 1)
+	require.Equal(peer.PeerID, peers[0].PeerID)
+	require.True(peers[0].Complete)
+}
+
+func TestReconcileRejectsInvalidExports(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	r := New(Config{SigningKey: "key"}, tally.NoopScope, clk, peerstore.NewTestStore())
+
+	e := NewExport(core.PeerInfoFixture(), []core.InfoHash{core.InfoHashFixture()}, clk.Now())
+
+	_, err := r.Reconcile(e)
+	require.Equal(ErrUnsigned, err)
+
+	e.Sign([]byte("wrong"))
+	_, err = r.Reconcile(e)
+	require.Equal(ErrInvalidSignature, err)
+
+	e.Sign([]byte("key"))
+	clk.Add(time.Hour)
+	_, err = r.Reconcile(e)
+	require.Equal(ErrStaleExport, err)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reputation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// SchemaVersion is the version of the Report schema. Trackers reject reports
+// of other versions, such that the meaning of scores may change without
+// mixing incompatible reports.
+const SchemaVersion = 1
+
+// MaxScores bounds the number of scores in a Report, such that reports remain
+// small regardless of how many peers the reporter exchanged pieces with.
+const MaxScores = 1000
+
+// Report errors.
+var (
+	ErrUnsupportedVersion = errors.New("unsupported report version")
+	ErrTooManyScores      = errors.New("too many scores")
+)
+
+// Score summarizes the piece exchanges of a reporter with a single peer.
+// Peers are only identified by peer id: reports carry no addresses and no
+// torrents.
+type Score struct {
+	PeerID core.PeerID `json:"peer_id"`
+
+	// Good is the number of verified pieces received from the peer.
+	Good int `json:"good"`
+
+	// Bad is the number of pieces received from the peer which failed
+	// verification, plus the number of piece requests the peer failed.
+	Bad int `json:"bad"`
+}
+
+func (s Score) total() int {
+	return s.Good + s.Bad
+}
+
+// Report is the export of the peer scores computed locally by a reporter.
+type Report struct {
+	Version  int         `json:"version"`
+	Reporter core.PeerID `json:"reporter"`
+	Scores   []Score     `json:"scores"`
+	Time     time.Time   `json:"time"`
+}
+
+// NewReport creates a new Report of scores. At most maxScores scores are kept,
+// preferring peers with the most bad exchanges, then those with the most
+// exchanges overall. Scores without exchanges are dropped.
+func NewReport(reporter core.PeerID, scores []Score, maxScores int, now time.Time) *Report {
+	if maxScores <= 0 || maxScores > MaxScores {
+		maxScores = MaxScores
+	}
+	var kept []Score
+	for _, s := range scores {
+		if s.total() > 0 && s.PeerID != reporter {
+			kept = append(kept, s)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Bad != kept[j].Bad {
+			return kept[i].Bad > kept[j].Bad
+		}
+		return kept[i].total() > kept[j].total()
+	})
+	if len(kept) > maxScores {
+		kept = kept[:maxScores]
+	}
+	return &Report{
+		Version:  SchemaVersion,
+		Reporter: reporter,
+		Scores:   kept,
+		Time:     now,
+	}
+}
+
+// Validate checks that r may be aggregated.
+func (r *Report) Validate() error {
+	if r.Version != SchemaVersion {
+		return ErrUnsupportedVersion
+	}
+	if len(r.Scores) > MaxScores {
+		return ErrTooManyScores
+	}
+	seen := make(map[core.PeerID]bool, len(r.Scores))
+	for _, s := range r.Scores {
+		if s.Good < 0 || s.Bad < 0 {
+			return fmt.Errorf("negative score for peer %s", s.PeerID)
+		}
+		if seen[s.PeerID] {
+			return fmt.Errorf("duplicate score for peer %s", s.PeerID)
+		}
+		seen[s.PeerID] = true
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reputation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReportBoundsScores(t *testing.T) {
+	require := require.New(t)
+
+	reporter := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	p3 := core.PeerIDFixture()
+
+	r := NewReport(reporter, []Score{
+		{PeerID: p1, Good: 10},
+		{PeerID: p2, Good: 1, Bad: 1},
+		{PeerID: p3, Good: 20},
+		{PeerID: core.PeerIDFixture()},
+		{PeerID: reporter, Good: 5},
+	}, 2, time.Now())
+
+	require.Equal(SchemaVersion, r.Version)
+	require.Equal([]Score{{PeerID: p2, Good: 1, Bad: 1}, {PeerID: p3, Good: 20}}, r.Scores)
+	require.NoError(r.Validate())
+}
+
+func TestReportValidate(t *testing.T) {
+	p := core.PeerIDFixture()
+
+	tests := []struct {
+		desc   string
+		report Report
+	}{
+		{"unsupported version", Report{Version: SchemaVersion + 1}},
+		{"too many scores", Report{Version: SchemaVersion, Scores: make([]Score, MaxScores+1)}},
+		{"negative score", Report{Version: SchemaVersion, Scores: []Score{{PeerID: p, Bad: -1}}}},
+		{"duplicate peer", Report{Version: SchemaVersion, Scores: []Score{{PeerID: p}, {PeerID: p}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Error(t, test.report.Validate())
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reputation
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+
+	"github.com/uber/kraken/core"
+)
+
+// Config defines Store configuration.
+type Config struct {
+	Enable bool `yaml:"enable"`
+
+	// TTL is how long a report is aggregated after it was received.
+	TTL time.Duration `yaml:"ttl"`
+
+	// MaxReporters bounds the number of reports retained. The oldest reports
+	// are evicted first.
+	MaxReporters int `yaml:"max_reporters"`
+
+	// MinReporters is the number of reporters which must have exchanged pieces
+	// with a peer before the peer may be considered bad, such that a single
+	// reporter cannot exclude a peer.
+	MinReporters int `yaml:"min_reporters"`
+
+	// MaxBadRatio is the ratio of bad exchanges to all exchanges with a peer,
+	// across all reporters, above which the peer is considered bad.
+	MaxBadRatio float64 `yaml:"max_bad_ratio"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.TTL == 0 {
+		c.TTL = 30 * time.Minute
+	}
+	if c.MaxReporters == 0 {
+		c.MaxReporters = 10000
+	}
+	if c.MinReporters == 0 {
+		c.MinReporters = 3
+	}
+	if c.MaxBadRatio == 0 {
+		c.MaxBadRatio = 0.5
+	}
+	return c
+}
+
+// Reputation aggregates the scores of a peer across reporters.
+type Reputation struct {
+	Reporters int
+	Good      int
+	Bad       int
+}
+
+func (r Reputation) bad(config Config) bool {
+	if r.Reporters < config.MinReporters {
+		return false
+	}
+	total := r.Good + r.Bad
+	return total > 0 && float64(r.Bad)/float64(total) > config.MaxBadRatio
+}
+
+type storedReport struct {
+	report   *Report
+	received time.Time
+}
+
+// Store aggregates the latest report of each reporter into fleet-wide
+// reputations. Store is thread-safe.
+type Store struct {
+	config Config
+	clk    clock.Clock
+
+	mu          sync.Mutex
+	reports     map[core.PeerID]*list.Element // Of *storedReport, oldest first.
+	order       *list.List
+	reputations map[core.PeerID]*Reputation
+}
+
+// NewStore creates a new Store.
+func NewStore(config Config, clk clock.Clock) *Store {
+	return &Store{
+		config:      config.applyDefaults(),
+		clk:         clk,
+		reports:     make(map[core.PeerID]*list.Element),
+		order:       list.New(),
+		reputations: make(map[core.PeerID]*Reputation),
+	}
+}
+
+// Add validates r and replaces the previous report of its reporter.
+func (s *Store) Add(r *Report) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.reports[r.Reporter]; ok {
+		s.remove(e)
+	}
+	s.reports[r.Reporter] = s.order.PushBack(&storedReport{r, s.clk.Now()})
+	s.apply(r, 1)
+	for s.order.Len() > s.config.MaxReporters {
+		s.remove(s.order.Front())
+	}
+	s.expire()
+	return nil
+}
+
+// Get returns the reputation of peerID.
+func (s *Store) Get(peerID core.PeerID) Reputation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if r, ok := s.reputations[peerID]; ok {
+		return *r
+	}
+	return Reputation{}
+}
+
+// Filter removes peers with bad reputations from peers, and returns the number
+// of peers removed. Origins are never removed.
+func (s *Store) Filter(peers []*core.PeerInfo) ([]*core.PeerInfo, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	var kept []*core.PeerInfo
+	for _, p := range peers {
+		if r, ok := s.reputations[p.PeerID]; ok && !p.Origin && r.bad(s.config) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept, len(peers) - len(kept)
+}
+
+// expire removes reports older than the TTL.
+func (s *Store) expire() {
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if s.clk.Now().Sub(e.Value.(*storedReport).received) < s.config.TTL {
+			return
+		}
+		s.remove(e)
+	}
+}
+
+func (s *Store) remove(e *list.Element) {
+	r := s.order.Remove(e).(*storedReport).report
+	delete(s.reports, r.Reporter)
+	s.apply(r, -1)
+}
+
+// apply adds the scores of r to the aggregated reputations if sign is 1, or
+// subtracts them if sign is -1.
+func (s *Store) apply(r *Report, sign int) {
+	for _, score := range r.Scores {
+		rep, ok := s.reputations[score.PeerID]
+		if !ok {
+			rep = &Reputation{}
+			s.reputations[score.PeerID] = rep
+		}
+		rep.Reporters += sign
+		rep.Good += sign * score.Good
+		rep.Bad += sign * score.Bad
+		if rep.Reporters == 0 {
+			delete(s.reputations, score.PeerID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package reputation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreFiltersPeersWithBadReputations(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	s := NewStore(Config{MinReporters: 2, MaxBadRatio: 0.5, TTL: time.Minute}, clk)
+
+	bad := core.PeerInfoFixture()
+	good := core.PeerInfoFixture()
+	unknown := core.PeerInfoFixture()
+
+	report := func(bads int) *Report {
+		return NewReport(core.PeerIDFixture(), []Score{
+			{PeerID: bad.PeerID, Good: 1, Bad: bads},
+			{PeerID: good.PeerID, Good: 10},
+		}, 0, clk.Now())
+	}
+	peers := []*core.PeerInfo{bad, good, unknown}
+
+	// A single reporter cannot exclude a peer.
+	require.NoError(s.Add(report(5)))
+	kept, filtered := s.Filter(peers)
+	require.Equal(peers, kept)
+	require.Equal(0, filtered)
+
+	require.NoError(s.Add(report(1)))
+	require.Equal(Reputation{Reporters: 2, Good: 2, Bad: 6}, s.Get(bad.PeerID))
+	kept, filtered = s.Filter(peers)
+	require.Equal([]*core.PeerInfo{good, unknown}, kept)
+	require.Equal(1, filtered)
+
+	// Reports expire.
+	clk.Add(time.Minute)
+	require.Equal(Reputation{}, s.Get(bad.PeerID))
+	kept, _ = s.Filter(peers)
+	require.Equal(peers, kept)
+}
+
+func TestStoreReplacesReportsOfSameReporter(t *testing.T) {
+	require := require.New(t)
+
+	s := NewStore(Config{}, clock.NewMock())
+
+	reporter := core.PeerIDFixture()
+	p := core.PeerIDFixture()
+
+	require.NoError(s.Add(NewReport(reporter, []Score{{PeerID: p, Bad: 3}}, 0, time.Now())))
+	require.NoError(s.Add(NewReport(reporter, []Score{{PeerID: p, Good: 2}}, 0, time.Now())))
+
+	require.Equal(Reputation{Reporters: 1, Good: 2}, s.Get(p))
+}
+
+func TestStoreEvictsOldestReporters(t *testing.T) {
+	require := require.New(t)
+
+	s := NewStore(Config{MaxReporters: 1}, clock.NewMock())
+
+	p := core.PeerIDFixture()
+
+	require.NoError(s.Add(NewReport(core.PeerIDFixture(), []Score{{PeerID: p, Bad: 3}}, 0, time.Now())))
+	require.NoError(s.Add(NewReport(core.PeerIDFixture(), []Score{{PeerID: p, Good: 2}}, 0, time.Now())))
+
+	require.Equal(Reputation{Reporters: 1, Good: 2}, s.Get(p))
+}
+
+func TestStoreRejectsInvalidReports(t *testing.T) {
+	s := NewStore(Config{}, clock.NewMock())
+
+	require.Equal(t, ErrUnsupportedVersion, s.Add(&Report{Version: 0}))
+}
@@ -75,18 +75,53 @@ func (s *Server) announceHandlerV2(w http.ResponseWriter, r *http.Request) error
 func (s *Server) announce(
 	d core.Digest, h core.InfoHash, peer *core.PeerInfo) (*announceclient.Response, error) {
 
-	if err := s.peerStore.UpdatePeer(h, peer); err != nil {
+	if addr, ok := s.collisions.observe(peer); ok {
+		// Both hosts remain in the peer store since entries are keyed by
+		// address, however peers cannot tell the two hosts apart, so the
+		// collision must be resolved by regenerating one of the peer ids.
+		s.stats.Counter("peer_id_collisions").Inc(1)
+		log.With(
+			"peer_id", peer.PeerID,
+			"addr", fmt.Sprintf("%s:%d", peer.IP, peer.Port),
+			"conflicting_addr", addr).Error("Peer id announced from multiple addresses")
+	}
+	if peer.Stopped {
+		// Stopped peers are shutting down, so they neither need a handout nor
+		// should be handed out.
+		s.stats.Counter("stopped_announces").Inc(1)
+		if err := s.peerStore.RemovePeer(h, peer.PeerID); err != nil {
+			return nil, fmt.Errorf("remove peer: %s", err)
+		}
+		return &announceclient.Response{Interval: s.config.AnnounceInterval}, nil
+	}
+	if peer.LeechOnly {
+		// Leech-only peers never serve pieces, so they are excluded from the
+		// peer store to prevent handing them out as a source.
+		s.stats.Counter("leech_only_announces").Inc(1)
+	} else if err := s.peerStore.UpdatePeer(h, peer); err != nil {
 		log.With(
 			"hash", h,
 			"peer_id", peer.PeerID).Errorf("Error updating peer: %s", err)
 	}
+	var content []byte
+	if !peer.Complete {
+		content, _ = s.inlined.get(d)
+	}
 	peers, err := s.getPeerHandout(d, h, peer)
 	if err != nil {
-		return nil, err
+		if content == nil {
+			return nil, err
+		}
+		// Peers which receive inline content do not need a handout.
+		peers = nil
+	}
+	if content != nil {
+		s.stats.Counter("inline_handouts").Inc(1)
 	}
 	return &announceclient.Response{
 		Peers:    peers,
 		Interval: s.config.AnnounceInterval,
+		Content:  content,
 	}, nil
 }
 
@@ -99,7 +134,13 @@ func (s *Server) getPeerHandout(
 		return nil, nil
 	}
 	var errs []error
-	peers, err := s.peerStore.GetPeers(h, s.config.PeerHandoutLimit)
+	limit := s.config.PeerHandoutLimit
+	if s.regions != nil {
+		// Peers of other regions are filtered after sampling, which would
+		// otherwise starve peers in regions with few local seeders.
+		limit *= s.config.RegionGateways.OverSample
+	}
+	peers, err := s.peerStore.GetPeers(h, limit)
 	if err != nil {
 		errs = append(errs, fmt.Errorf("peer store: %s", err))
 	}
@@ -111,5 +152,32 @@ func (s *Server) getPeerHandout(
 	if len(peers) == 0 {
 		return nil, handler.Errorf("no peers available: %s", errutil.Join(errs))
 	}
+	if s.regions != nil {
+		var filtered int
+		var fallback bool
+		peers, filtered, fallback = s.regions.filter(peer, peers)
+		s.stats.Counter("cross_region_peers_filtered").Inc(int64(filtered))
+		if fallback {
+			s.stats.Counter("cross_region_fallback_handouts").Inc(1)
+		}
+		peers = limitHandout(peers, s.config.PeerHandoutLimit)
+	}
+	if s.reputations != nil {
+		kept, filtered := s.reputations.Filter(peers)
+		s.stats.Counter("bad_reputation_peers_filtered").Inc(int64(filtered))
+		if len(kept) > 0 {
+			peers = kept
+		} else if filtered > 0 {
+			// Handing out bad peers is better than handing out none.
+			s.stats.Counter("bad_reputation_fallback_handouts").Inc(1)
+		}
+	}
+	if s.config.RackCoordination.Enable {
+		var follower bool
+		peers, follower = coordinateRack(peer, peers)
+		if follower {
+			s.stats.Counter("rack_follower_handouts").Inc(1)
+		}
+	}
 	return s.policy.SortPeers(peer, peers), nil
 }
@@ -60,7 +60,7 @@ func TestAnnounceSinglePeerResponse(t *testing.T) {
 				blob.MetaInfo.InfoHash(), core.PeerInfoFromContext(pctx, false)).Return(nil)
 
 			result, interval, err := client.Announce(
-				blob.Digest, blob.MetaInfo.InfoHash(), false, version)
+				blob.Digest, blob.MetaInfo.InfoHash(), false, nil, version)
 			require.NoError(err)
 			require.Equal(peers, result)
 			require.Equal(config.AnnounceInterval, interval)
@@ -68,6 +68,54 @@ func TestAnnounceSinglePeerResponse(t *testing.T) {
 	}
 }
 
+func TestAnnounceLeechOnlyPeerIsNotStored(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	pctx := core.PeerContextFixture()
+	blob := core.NewBlobFixture()
+	peers := []*core.PeerInfo{core.PeerInfoFixture()}
+
+	client := announceclient.New(
+		pctx, hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil, announceclient.WithLeechOnly())
+
+	// No UpdatePeer call is expected.
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, nil)
+	mocks.peerStore.EXPECT().GetPeers(
+		blob.MetaInfo.InfoHash(), gomock.Any()).Return(peers, nil)
+
+	result, _, err := client.Announce(
+		blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V2)
+	require.NoError(err)
+	require.Equal(peers, result)
+}
+
+func TestAnnounceStoppedPeerIsRemoved(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	pctx := core.PeerContextFixture()
+	blob := core.NewBlobFixture()
+
+	client := newAnnounceClient(pctx, addr)
+
+	// No handout is expected.
+	mocks.peerStore.EXPECT().RemovePeer(blob.MetaInfo.InfoHash(), pctx.PeerID).Return(nil)
+
+	require.NoError(client.(announceclient.StoppedClient).AnnounceStopped(
+		blob.Digest, blob.MetaInfo.InfoHash(), announceclient.V2))
+}
+
 func TestAnnounceUnavailablePeerStoreCanStillProvideOrigins(t *testing.T) {
 	require := require.New(t)
 
@@ -92,7 +140,7 @@ func TestAnnounceUnavailablePeerStoreCanStillProvideOrigins(t *testing.T) {
 	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(origins, nil)
 
 	result, _, err := client.Announce(
-		blob.Digest, blob.MetaInfo.InfoHash(), false, announceclient.V2)
+		blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V2)
 	require.NoError(err)
 	require.Equal(origins, result)
 }
@@ -120,7 +168,39 @@ func TestAnnouceUnavailableOriginClusterCanStillProvidePeers(t *testing.T) {
 	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, errors.New("some error"))
 
 	result, _, err := client.Announce(
-		blob.Digest, blob.MetaInfo.InfoHash(), false, announceclient.V2)
+		blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V2)
+	require.NoError(err)
+	require.Equal(peers, result)
+}
+
+func TestAnnouncePartialSeederAdvertisesHaveRanges(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	pctx := core.PeerContextFixture()
+	blob := core.NewBlobFixture()
+
+	client := newAnnounceClient(pctx, addr)
+
+	have := core.PieceRanges{{Start: 0, End: 3}, {Start: 7, End: 7}}
+
+	expected := core.PeerInfoFromContext(pctx, false)
+	expected.HaveRanges = have
+
+	peers := []*core.PeerInfo{core.PeerInfoFixture()}
+
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), expected).Return(nil)
+	mocks.peerStore.EXPECT().GetPeers(
+		blob.MetaInfo.InfoHash(), gomock.Any()).Return(peers, nil)
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, nil)
+
+	result, _, err := client.Announce(
+		blob.Digest, blob.MetaInfo.InfoHash(), false, have, announceclient.V2)
 	require.NoError(err)
 	require.Equal(peers, result)
 }
@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+
+	"github.com/uber/kraken/core"
+)
+
+// collisionDetector detects distinct hosts announcing with the same peer id,
+// e.g. hosts booted from a cloned image which persisted its peer id. Each
+// peer id is associated with the address it was last announced from, and an
+// announce from a different address within window is considered a collision.
+//
+// Observations are local to each tracker instance, so detection is best effort.
+type collisionDetector struct {
+	clk    clock.Clock
+	window time.Duration
+
+	mu           sync.Mutex
+	observations map[core.PeerID]observation
+	lastSweep    time.Time
+}
+
+type observation struct {
+	ip   string
+	addr string
+	seen time.Time
+}
+
+func newCollisionDetector(clk clock.Clock, window time.Duration) *collisionDetector {
+	return &collisionDetector{
+		clk:          clk,
+		window:       window,
+		observations: make(map[core.PeerID]observation),
+	}
+}
+
+// observe records that peer announced, returning the address of a different
+// host which recently announced with the same peer id, if any.
+func (d *collisionDetector) observe(peer *core.PeerInfo) (conflict string, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clk.Now()
+	addr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
+
+	if now.Sub(d.lastSweep) > d.window {
+		// Periodically drop expired observations, else peer ids which stop
+		// announcing would be retained forever.
+		for id, o := range d.observations {
+			if now.Sub(o.seen) > d.window {
+				delete(d.observations, id)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	prev, found := d.observations[peer.PeerID]
+	d.observations[peer.PeerID] = observation{peer.IP, addr, now}
+	if found && prev.addr != addr && now.Sub(prev.seen) <= d.window {
+		return prev.addr, true
+	}
+	return "", false
+}
+
+// announcedFrom returns true if peerID was announced from ip within window.
+func (d *collisionDetector) announcedFrom(peerID core.PeerID, ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	o, ok := d.observations[peerID]
+	return ok && o.ip == ip && d.clk.Now().Sub(o.seen) <= d.window
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+)
+
+func TestCollisionDetector(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	d := newCollisionDetector(clk, time.Minute)
+
+	p := core.PeerInfoFixture()
+	clone := core.NewPeerInfo(p.PeerID, "10.0.0.1", p.Port, false, false)
+
+	_, ok := d.observe(p)
+	require.False(ok)
+
+	// Announcing again from the same address is not a collision.
+	_, ok = d.observe(p)
+	require.False(ok)
+
+	addr, ok := d.observe(clone)
+	require.True(ok)
+	require.Equal(fmt.Sprintf("%s:%d", p.IP, p.Port), addr)
+
+	// Peers which moved to a new address after the window are not collisions.
+	clk.Add(2 * time.Minute)
+	_, ok = d.observe(p)
+	require.False(ok)
+}
+
+func TestCollisionDetectorEvictsExpiredObservations(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	d := newCollisionDetector(clk, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		d.observe(core.PeerInfoFixture())
+	}
+	clk.Add(2 * time.Minute)
+	d.observe(core.PeerInfoFixture())
+
+	require.Len(d.observations, 1)
+}
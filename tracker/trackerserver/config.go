@@ -14,8 +14,12 @@
 package trackerserver
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/uber/kraken/tracker/reconcile"
+	"github.com/uber/kraken/tracker/reputation"
+
 	"github.com/uber/kraken/utils/listener"
 )
 
@@ -30,6 +34,47 @@ type Config struct {
 	AnnounceInterval time.Duration `yaml:"announce_interval"`
 
 	Listener listener.Config `yaml:"listener"`
+
+	RackCoordination RackCoordinationConfig `yaml:"rack_coordination"`
+
+	RegionGateways RegionGatewaysConfig `yaml:"region_gateways"`
+
+	// PeerIDCollisionWindow is the duration for which the address of an
+	// announcing peer id is remembered. Announces with the same peer id from a
+	// different address within the window are reported as collisions.
+	// Reputation reports are only accepted from hosts which announced with the
+	// reporter's peer id within the window.
+	PeerIDCollisionWindow time.Duration `yaml:"peer_id_collision_window"`
+
+	InlineBlobs InlineBlobsConfig `yaml:"inline_blobs"`
+
+	// Reconcile configures the reconciliation of the peer store with the
+	// seeded info hashes exported by agents.
+	Reconcile reconcile.Config `yaml:"reconcile"`
+
+	// Reputation configures the aggregation of peer reputations reported by
+	// agents, which excludes chronically bad peers from handouts.
+	Reputation reputation.Config `yaml:"reputation"`
+}
+
+// RackCoordinationConfig defines coordination of peers in the same rack which
+// download the same torrent simultaneously. One peer per rack is elected to
+// lead the download from the rest of the swarm, while the other peers of the
+// rack only receive rack-local peers, such that the blob crosses the network
+// into the rack once.
+type RackCoordinationConfig struct {
+	Enable bool `yaml:"enable"`
+}
+
+// Validate returns an error if c is invalid.
+func (c Config) Validate() error {
+	if _, err := newRegionMap(c.RegionGateways); err != nil {
+		return fmt.Errorf("region gateways: %s", err)
+	}
+	if err := c.Reconcile.Validate(); err != nil {
+		return fmt.Errorf("reconcile: %s", err)
+	}
+	return nil
 }
 
 func (c Config) applyDefaults() Config {
@@ -42,5 +87,10 @@ func (c Config) applyDefaults() Config {
 	if c.AnnounceInterval == 0 {
 		c.AnnounceInterval = 3 * time.Second
 	}
+	if c.PeerIDCollisionWindow == 0 {
+		c.PeerIDCollisionWindow = time.Minute
+	}
+	c.InlineBlobs = c.InlineBlobs.applyDefaults()
+	c.RegionGateways = c.RegionGateways.applyDefaults()
 	return c
 }
@@ -0,0 +1,178 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/log"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// InlineBlobsConfig defines inlining of tiny blobs into announce responses.
+// Blobs no larger than MaxSize, e.g. manifests and image configs, are fetched
+// from origin in the background when their metainfo is requested, and returned
+// to incomplete peers on announce once fetched, such that they skip the swarm
+// entirely.
+type InlineBlobsConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// MaxSize is the largest blob, in bytes, which is inlined.
+	MaxSize uint64 `yaml:"max_size"`
+
+	// CacheSize is the number of inlined blobs retained in memory.
+	CacheSize int `yaml:"cache_size"`
+
+	// CacheBytes bounds the total size of inlined blobs retained in memory.
+	CacheBytes uint64 `yaml:"cache_bytes"`
+
+	// MaxConcurrentFetches bounds the number of blobs fetched from origin at
+	// once. Blobs requested while the limit is reached are not inlined until
+	// their metainfo is requested again.
+	MaxConcurrentFetches int `yaml:"max_concurrent_fetches"`
+}
+
+func (c InlineBlobsConfig) applyDefaults() InlineBlobsConfig {
+	if c.MaxSize == 0 {
+		c.MaxSize = 16 * memsize.KB
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = 1024
+	}
+	if c.CacheBytes == 0 {
+		c.CacheBytes = 16 * memsize.MB
+	}
+	if c.MaxConcurrentFetches == 0 {
+		c.MaxConcurrentFetches = 4
+	}
+	return c
+}
+
+type inlineBlob struct {
+	d       core.Digest
+	content []byte
+}
+
+// inlineCache is a thread-safe LRU of tiny blob contents keyed by digest,
+// bounded by both number of blobs and their total size.
+type inlineCache struct {
+	size     int
+	maxBytes uint64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[core.Digest]*list.Element
+	bytes   uint64
+
+	// fetching is the set of digests currently fetched from origin.
+	fetching map[core.Digest]bool
+}
+
+func newInlineCache(size int, maxBytes uint64) *inlineCache {
+	return &inlineCache{
+		size:     size,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[core.Digest]*list.Element),
+		fetching: make(map[core.Digest]bool),
+	}
+}
+
+func (c *inlineCache) get(d core.Digest) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[d]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*inlineBlob).content, true
+}
+
+func (c *inlineCache) put(d core.Digest, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[d]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[d] = c.lru.PushFront(&inlineBlob{d, content})
+	c.bytes += uint64(len(content))
+	for c.lru.Len() > c.size || c.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		b := oldest.Value.(*inlineBlob)
+		delete(c.entries, b.d)
+		c.bytes -= uint64(len(b.content))
+	}
+}
+
+// startFetch reserves a fetch of d. Returns false if d is already cached or
+// fetched, or if max fetches are already in progress.
+func (c *inlineCache) startFetch(d core.Digest, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[d]; ok || c.fetching[d] || len(c.fetching) >= max {
+		return false
+	}
+	c.fetching[d] = true
+	return true
+}
+
+// finishFetch releases the fetch of d reserved by startFetch.
+func (c *inlineCache) finishFetch(d core.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.fetching, d)
+}
+
+// maybeInline fetches the content of the blob of mi in the background if it is
+// small enough to be inlined. Failures are not fatal, since peers fall back to
+// the swarm.
+func (s *Server) maybeInline(namespace string, mi *core.MetaInfo) {
+	if !s.config.InlineBlobs.Enable || uint64(mi.Length()) > s.config.InlineBlobs.MaxSize {
+		return
+	}
+	if !s.inlined.startFetch(mi.Digest(), s.config.InlineBlobs.MaxConcurrentFetches) {
+		return
+	}
+	go func() {
+		defer s.inlined.finishFetch(mi.Digest())
+		s.fetchInline(namespace, mi)
+	}()
+}
+
+// fetchInline downloads the blob of mi from origin into the inline cache.
+func (s *Server) fetchInline(namespace string, mi *core.MetaInfo) {
+	var b bytes.Buffer
+	if err := s.originCluster.DownloadBlob(namespace, mi.Digest(), &b); err != nil {
+		s.stats.Counter("inline_download_errors").Inc(1)
+		log.With("digest", mi.Digest()).Errorf("Error downloading inline blob: %s", err)
+		return
+	}
+	d, err := core.NewDigester().FromBytes(b.Bytes())
+	if err != nil || d != mi.Digest() {
+		s.stats.Counter("inline_download_errors").Inc(1)
+		log.With("digest", mi.Digest()).Error("Inline blob does not match its digest")
+		return
+	}
+	s.inlined.put(mi.Digest(), b.Bytes())
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/utils/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceInlinesTinyBlobs(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{InlineBlobs: InlineBlobsConfig{Enable: true}})
+	defer cleanup()
+
+	server := mocks.server()
+	addr, stop := testutil.StartServer(server.Handler())
+	defer stop()
+
+	namespace := core.TagFixture()
+	blob := core.SizedBlobFixture(256, 64)
+	pctx := core.PeerContextFixture()
+
+	mocks.originCluster.EXPECT().GetMetaInfo(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+	mocks.originCluster.EXPECT().DownloadBlob(namespace, blob.Digest, gomock.Any()).DoAndReturn(
+		func(namespace string, d core.Digest, dst io.Writer) error {
+			_, err := dst.Write(blob.Content)
+			return err
+		})
+
+	_, err := newMetaInfoClient(addr).Download(context.Background(), namespace, blob.Digest)
+	require.NoError(err)
+
+	// Blobs are fetched in the background.
+	require.NoError(testutil.PollUntilTrue(5*time.Second, func() bool {
+		_, ok := server.inlined.get(blob.Digest)
+		return ok
+	}))
+
+	// The tracker has no peers, but inlined content still satisfies the announce.
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil)
+	mocks.peerStore.EXPECT().GetPeers(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil, nil)
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, errors.New("some error"))
+
+	client := newAnnounceClient(pctx, addr).(announceclient.InlineClient)
+
+	resp, err := client.AnnounceInline(
+		blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V1)
+	require.NoError(err)
+	require.Equal(blob.Content, resp.Content)
+	require.Empty(resp.Peers)
+}
+
+func TestAnnounceDoesNotInlineLargeBlobs(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{
+		InlineBlobs: InlineBlobsConfig{Enable: true, MaxSize: 128},
+	})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	namespace := core.TagFixture()
+	blob := core.SizedBlobFixture(256, 64)
+	pctx := core.PeerContextFixture()
+
+	mocks.originCluster.EXPECT().GetMetaInfo(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	_, err := newMetaInfoClient(addr).Download(context.Background(), namespace, blob.Digest)
+	require.NoError(err)
+
+	peers := []*core.PeerInfo{core.PeerInfoFixture()}
+
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil)
+	mocks.peerStore.EXPECT().GetPeers(blob.MetaInfo.InfoHash(), gomock.Any()).Return(peers, nil)
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, nil)
+
+	client := newAnnounceClient(pctx, addr).(announceclient.InlineClient)
+
+	resp, err := client.AnnounceInline(
+		blob.Digest, blob.MetaInfo.InfoHash(), false, nil, announceclient.V1)
+	require.NoError(err)
+	require.Nil(resp.Content)
+	require.Equal(peers, resp.Peers)
+}
+
+func TestInlineCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	require := require.New(t)
+
+	c := newInlineCache(2, 1024)
+
+	d1, d2, d3 := core.DigestFixture(), core.DigestFixture(), core.DigestFixture()
+	c.put(d1, []byte("a"))
+	c.put(d2, []byte("b"))
+	_, ok := c.get(d1)
+	require.True(ok)
+	c.put(d3, []byte("c"))
+
+	_, ok = c.get(d2)
+	require.False(ok)
+	b, ok := c.get(d1)
+	require.True(ok)
+	require.Equal([]byte("a"), b)
+}
+
+func TestInlineCacheEvictsBeyondMaxBytes(t *testing.T) {
+	require := require.New(t)
+
+	c := newInlineCache(10, 4)
+
+	d1, d2 := core.DigestFixture(), core.DigestFixture()
+	c.put(d1, []byte("aaa"))
+	c.put(d2, []byte("bb"))
+
+	_, ok := c.get(d1)
+	require.False(ok)
+	_, ok = c.get(d2)
+	require.True(ok)
+	require.Equal(uint64(2), c.bytes)
+}
+
+func TestInlineCacheBoundsConcurrentFetches(t *testing.T) {
+	require := require.New(t)
+
+	c := newInlineCache(10, 1024)
+
+	d1, d2 := core.DigestFixture(), core.DigestFixture()
+	require.True(c.startFetch(d1, 1))
+	require.False(c.startFetch(d1, 2))
+	require.False(c.startFetch(d2, 1))
+
+	c.put(d1, []byte("a"))
+	c.finishFetch(d1)
+	require.False(c.startFetch(d1, 1))
+	require.True(c.startFetch(d2, 1))
+}
@@ -42,6 +42,8 @@ func (s *Server) getMetaInfoHandler(w http.ResponseWriter, r *http.Request) erro
 	}
 	timer.Stop()
 
+	s.maybeInline(namespace, mi)
+
 	b, err := mi.Serialize()
 	if err != nil {
 		return fmt.Errorf("serialize metainfo: %s", err)
@@ -14,6 +14,7 @@
 package trackerserver
 
 import (
+	"context"
 	"testing"
 
 	"github.com/uber/kraken/core"
@@ -46,7 +47,7 @@ func TestGetMetaInfoHandlerFetchesFromOrigin(t *testing.T) {
 
 	client := newMetaInfoClient(addr)
 
-	result, err := client.Download(namespace, mi.Digest())
+	result, err := client.Download(context.Background(), namespace, mi.Digest())
 	require.NoError(err)
 	require.Equal(mi, result)
 }
@@ -68,7 +69,7 @@ func TestGetMetaInfoHandlerPropagatesOriginError(t *testing.T) {
 
 	client := newMetaInfoClient(addr)
 
-	_, err := client.Download(namespace, mi.Digest())
+	_, err := client.Download(context.Background(), namespace, mi.Digest())
 	require.Error(err)
 	require.True(httputil.IsStatus(err, 599))
 }
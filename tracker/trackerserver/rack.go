@@ -0,0 +1,52 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import "github.com/uber/kraken/core"
+
+// coordinateRack restricts the handout of source to peers in its rack, unless
+// source leads the download for its rack. The leader is the incomplete peer of
+// the rack with the lowest peer id, such that all peers of the rack agree on
+// the leader without further coordination. If the rack already holds a
+// complete peer, there is no leader and all peers of the rack download from
+// within the rack.
+//
+// Since peers are sampled from the peer store, election is best effort: large
+// swarms may briefly elect multiple leaders per rack. If the leader stops
+// announcing, it expires from the peer store and a new leader is elected.
+func coordinateRack(
+	source *core.PeerInfo, peers []*core.PeerInfo) (handout []*core.PeerInfo, follower bool) {
+
+	if source.Rack == "" {
+		return peers, false
+	}
+	var local []*core.PeerInfo
+	var seeded bool
+	leader := source.PeerID
+	for _, p := range peers {
+		if p.Rack != source.Rack || p.PeerID == source.PeerID {
+			continue
+		}
+		local = append(local, p)
+		if p.Complete {
+			seeded = true
+		} else if p.PeerID.LessThan(leader) {
+			leader = p.PeerID
+		}
+	}
+	if len(local) == 0 || (!seeded && leader == source.PeerID) {
+		return peers, false
+	}
+	return local, true
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/uber/kraken/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rackPeersFixture returns n incomplete peers in rack, sorted by peer id.
+func rackPeersFixture(n int, rack string) []*core.PeerInfo {
+	var peers []*core.PeerInfo
+	for i := 0; i < n; i++ {
+		p := core.PeerInfoFixture()
+		p.Rack = rack
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PeerID.LessThan(peers[j].PeerID)
+	})
+	return peers
+}
+
+func TestCoordinateRackLeaderReceivesFullHandout(t *testing.T) {
+	require := require.New(t)
+
+	local := rackPeersFixture(3, "rack1")
+	remote := core.PeerInfoFixture()
+	peers := append([]*core.PeerInfo{remote}, local...)
+
+	handout, follower := coordinateRack(local[0], peers)
+	require.False(follower)
+	require.Equal(peers, handout)
+}
+
+func TestCoordinateRackFollowersOnlyReceiveLocalPeers(t *testing.T) {
+	require := require.New(t)
+
+	local := rackPeersFixture(3, "rack1")
+	remote := core.PeerInfoFixture()
+	other := core.PeerInfoFixture()
+	other.Rack = "rack2"
+	peers := append([]*core.PeerInfo{remote, other}, local...)
+
+	handout, follower := coordinateRack(local[2], peers)
+	require.True(follower)
+	require.Equal(local[:2], handout)
+}
+
+func TestCoordinateRackSeededRackHasNoLeader(t *testing.T) {
+	require := require.New(t)
+
+	local := rackPeersFixture(2, "rack1")
+	local[1].Complete = true
+	peers := append([]*core.PeerInfo{core.PeerInfoFixture()}, local...)
+
+	handout, follower := coordinateRack(local[0], peers)
+	require.True(follower)
+	require.Equal(local[1:], handout)
+}
+
+func TestCoordinateRackIgnoresPeersWithoutRack(t *testing.T) {
+	require := require.New(t)
+
+	source := core.PeerInfoFixture()
+	peers := []*core.PeerInfo{core.PeerInfoFixture(), core.PeerInfoFixture()}
+
+	handout, follower := coordinateRack(source, peers)
+	require.False(follower)
+	require.Equal(peers, handout)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/reconcile"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func startExportServer(e *reconcile.Export) (addr string, stop func()) {
+	return testutil.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(e)
+	}))
+}
+
+func reconcileConfigFixture(agentAddr string) reconcile.Config {
+	return reconcile.Config{
+		Enable:     true,
+		SigningKey: "key",
+		Peers:      hostlist.Config{Static: []string{agentAddr}},
+	}
+}
+
+func TestReconcileHandlerRestoresPeers(t *testing.T) {
+	require := require.New(t)
+
+	peer := core.PeerInfoFixture()
+	peer.IP = "127.0.0.1"
+	h := core.InfoHashFixture()
+
+	e := reconcile.NewExport(peer, []core.InfoHash{h}, time.Now())
+	e.Sign([]byte("key"))
+	agentAddr, stopAgent := startExportServer(e)
+	defer stopAgent()
+
+	mocks, cleanup := newServerMocks(t, Config{Reconcile: reconcileConfigFixture(agentAddr)})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	expected := *peer
+	expected.Complete = true
+
+	mocks.peerStore.EXPECT().GetPeers(h, gomock.Any()).Return(nil, nil)
+	mocks.peerStore.EXPECT().UpdatePeer(h, &expected).Return(nil)
+
+	resp, err := httputil.Post(fmt.Sprintf("http://%s/reconcile?addr=%s", addr, agentAddr))
+	require.NoError(err)
+	defer resp.Body.Close()
+
+	var res reconcile.Result
+	require.NoError(json.NewDecoder(resp.Body).Decode(&res))
+	require.Equal(reconcile.Result{Refreshed: 1, Missing: 1}, res)
+}
+
+func TestReconcileHandlerRejectsUnsignedExports(t *testing.T) {
+	require := require.New(t)
+
+	peer := core.PeerInfoFixture()
+	peer.IP = "127.0.0.1"
+	e := reconcile.NewExport(peer, []core.InfoHash{core.InfoHashFixture()}, time.Now())
+	agentAddr, stopAgent := startExportServer(e)
+	defer stopAgent()
+
+	mocks, cleanup := newServerMocks(t, Config{Reconcile: reconcileConfigFixture(agentAddr)})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	_, err := httputil.Post(fmt.Sprintf("http://%s/reconcile?addr=%s", addr, agentAddr))
+	require.True(httputil.IsStatus(err, http.StatusForbidden))
+
+	_, err = httputil.Post(fmt.Sprintf("http://%s/reconcile", addr))
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+}
+
+func TestReconcileHandlerRejectsUnknownPeersAndPeerMismatch(t *testing.T) {
+	require := require.New(t)
+
+	// The export vouches for another host than the one it is pulled from.
+	e := reconcile.NewExport(core.PeerInfoFixture(), []core.InfoHash{core.InfoHashFixture()}, time.Now())
+	e.Sign([]byte("key"))
+	agentAddr, stopAgent := startExportServer(e)
+	defer stopAgent()
+
+	otherAddr, stopOther := startExportServer(e)
+	defer stopOther()
+
+	mocks, cleanup := newServerMocks(t, Config{Reconcile: reconcileConfigFixture(agentAddr)})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	_, err := httputil.Post(fmt.Sprintf("http://%s/reconcile?addr=%s", addr, otherAddr))
+	require.True(httputil.IsForbidden(err))
+
+	_, err = httputil.Post(fmt.Sprintf("http://%s/reconcile?addr=%s", addr, agentAddr))
+	require.True(httputil.IsForbidden(err))
+}
+
+func TestReconcileHandlerDisabled(t *testing.T) {
+	mocks, cleanup := newServerMocks(t, Config{})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	_, err := httputil.Post(fmt.Sprintf("http://%s/reconcile?addr=%s", addr, addr))
+	require.True(t, httputil.IsStatus(err, http.StatusNotImplemented))
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/uber/kraken/core"
+)
+
+// RegionGatewaysConfig restricts cross-region conns to designated gateway
+// peers. Peers only receive peers of their own region in handouts, except for
+// gateways, which additionally receive the gateways of other regions. Blobs
+// thus cross the WAN over the links between gateways, and are distributed
+// within each region by its local peers.
+//
+// Regions without gateways are not restricted, and neither are peers whose
+// region is unknown.
+type RegionGatewaysConfig struct {
+	Enable  bool           `yaml:"enable"`
+	Regions []RegionConfig `yaml:"regions"`
+
+	// OverSample is the factor by which the peers sampled from the peer store
+	// exceed the handout limit, since peers of other regions are filtered
+	// from the sample.
+	OverSample int `yaml:"over_sample"`
+}
+
+func (c RegionGatewaysConfig) applyDefaults() RegionGatewaysConfig {
+	if c.OverSample == 0 {
+		c.OverSample = 4
+	}
+	return c
+}
+
+// RegionConfig defines a region and its gateway peers.
+type RegionConfig struct {
+	Name string `yaml:"name"`
+
+	// CIDRs are the networks of the region. Peers are assigned to the first
+	// region containing their ip.
+	CIDRs []string `yaml:"cidrs"`
+
+	// Gateways are the ips of the gateway peers of the region.
+	Gateways []string `yaml:"gateways"`
+}
+
+type region struct {
+	name     string
+	nets     []*net.IPNet
+	gateways map[string]bool
+}
+
+func (r *region) restricted() bool {
+	return len(r.gateways) > 0
+}
+
+// regionMap assigns peers to regions. A nil regionMap assigns no regions.
+type regionMap struct {
+	regions []*region
+}
+
+func newRegionMap(config RegionGatewaysConfig) (*regionMap, error) {
+	if !config.Enable {
+		return nil, nil
+	}
+	m := &regionMap{}
+	names := make(map[string]bool)
+	for _, rc := range config.Regions {
+		if rc.Name == "" {
+			return nil, errors.New("region name required")
+		}
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicate region %s", rc.Name)
+		}
+		names[rc.Name] = true
+		r := &region{name: rc.Name, gateways: make(map[string]bool)}
+		for _, s := range rc.CIDRs {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("region %s: parse cidr: %s", rc.Name, err)
+			}
+			r.nets = append(r.nets, n)
+		}
+		for _, s := range rc.Gateways {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("region %s: invalid gateway ip %q", rc.Name, s)
+			}
+			if !r.contains(ip) {
+				return nil, fmt.Errorf("region %s: gateway %s outside of region", rc.Name, s)
+			}
+			r.gateways[ip.String()] = true
+		}
+		m.regions = append(m.regions, r)
+	}
+	return m, nil
+}
+
+func (r *region) contains(ip net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the region of the peer at ip, or nil if unknown.
+func (m *regionMap) lookup(ip string) *region {
+	if m == nil {
+		return nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	for _, r := range m.regions {
+		if r.contains(parsed) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (m *regionMap) gateway(p *core.PeerInfo) (*region, bool) {
+	r := m.lookup(p.IP)
+	if r == nil {
+		return nil, false
+	}
+	ip := net.ParseIP(p.IP)
+	return r, r.gateways[ip.String()]
+}
+
+// filter removes the peers which source may not connect to across regions.
+// If no peers remain, the configured gateways of other regions among peers are
+// returned so that source can still make progress, and fallback is set.
+func (m *regionMap) filter(
+	source *core.PeerInfo, peers []*core.PeerInfo) (handout []*core.PeerInfo, filtered int, fallback bool) {
+
+	sourceRegion, sourceGateway := m.gateway(source)
+	if sourceRegion == nil {
+		return peers, 0, false
+	}
+	var gateways []*core.PeerInfo
+	for _, p := range peers {
+		r, gateway := m.gateway(p)
+		allowed :=
+			r == nil ||
+				r == sourceRegion ||
+				((sourceGateway || !sourceRegion.restricted()) && (gateway || !r.restricted()))
+		if allowed {
+			handout = append(handout, p)
+		} else {
+			filtered++
+			if gateway {
+				gateways = append(gateways, p)
+			}
+		}
+	}
+	if len(handout) == 0 && len(gateways) > 0 {
+		return gateways, filtered - len(gateways), true
+	}
+	return handout, filtered, false
+}
+
+// limitHandout returns peers with at most n non-origin peers. Origins are
+// always kept.
+func limitHandout(peers []*core.PeerInfo, n int) []*core.PeerInfo {
+	var limited []*core.PeerInfo
+	for _, p := range peers {
+		if p.Origin || n > 0 {
+			limited = append(limited, p)
+			if !p.Origin {
+				n--
+			}
+		}
+	}
+	return limited
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func regionPeerFixture(ip string) *core.PeerInfo {
+	p := core.PeerInfoFixture()
+	p.IP = ip
+	return p
+}
+
+func regionMapFixture(t *testing.T) *regionMap {
+	m, err := newRegionMap(RegionGatewaysConfig{
+		Enable: true,
+		Regions: []RegionConfig{{
+			Name:     "east",
+			CIDRs:    []string{"10.1.0.0/16"},
+			Gateways: []string{"10.1.0.1"},
+		}, {
+			Name:     "west",
+			CIDRs:    []string{"10.2.0.0/16"},
+			Gateways: []string{"10.2.0.1"},
+		}, {
+			Name:  "south",
+			CIDRs: []string{"10.3.0.0/16"},
+		}},
+	})
+	require.NoError(t, err)
+	return m
+}
+
+func TestRegionFilterRestrictsCrossRegionPeersToGateways(t *testing.T) {
+	m := regionMapFixture(t)
+
+	eastGateway := regionPeerFixture("10.1.0.1")
+	eastPeer := regionPeerFixture("10.1.0.2")
+	westGateway := regionPeerFixture("10.2.0.1")
+	westPeer := regionPeerFixture("10.2.0.2")
+	southPeer := regionPeerFixture("10.3.0.2")
+	unknown := regionPeerFixture("192.168.0.1")
+
+	peers := []*core.PeerInfo{
+		eastGateway, eastPeer, westGateway, westPeer, southPeer, unknown,
+	}
+
+	tests := []struct {
+		desc     string
+		source   *core.PeerInfo
+		expected []*core.PeerInfo
+	}{
+		{
+			"non-gateways only receive local peers",
+			regionPeerFixture("10.1.0.3"),
+			[]*core.PeerInfo{eastGateway, eastPeer, unknown},
+		}, {
+			"gateways receive remote gateways and unrestricted regions",
+			eastGateway,
+			[]*core.PeerInfo{eastGateway, eastPeer, westGateway, southPeer, unknown},
+		}, {
+			"peers of unrestricted regions receive remote gateways",
+			regionPeerFixture("10.3.0.3"),
+			[]*core.PeerInfo{eastGateway, westGateway, southPeer, unknown},
+		}, {
+			"peers of unknown regions are unrestricted",
+			regionPeerFixture("192.168.0.2"),
+			peers,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			handout, filtered, fallback := m.filter(test.source, peers)
+			require.Equal(t, test.expected, handout)
+			require.Equal(t, len(peers)-len(test.expected), filtered)
+			require.False(t, fallback)
+		})
+	}
+}
+
+func TestRegionFilterFallsBackWithoutLocalPeers(t *testing.T) {
+	require := require.New(t)
+
+	m := regionMapFixture(t)
+
+	westGateway := regionPeerFixture("10.2.0.1")
+	peers := []*core.PeerInfo{westGateway, regionPeerFixture("10.2.0.2")}
+
+	// Only the gateways of other regions are handed out.
+	handout, filtered, fallback := m.filter(regionPeerFixture("10.1.0.2"), peers)
+	require.Equal([]*core.PeerInfo{westGateway}, handout)
+	require.Equal(1, filtered)
+	require.True(fallback)
+
+	// Without remote gateways, the handout is empty.
+	handout, filtered, fallback = m.filter(regionPeerFixture("10.1.0.2"), peers[1:])
+	require.Empty(handout)
+	require.Equal(1, filtered)
+	require.False(fallback)
+}
+
+func TestLimitHandoutKeepsOrigins(t *testing.T) {
+	require := require.New(t)
+
+	p1 := core.PeerInfoFixture()
+	p2 := core.PeerInfoFixture()
+	origin := core.OriginPeerInfoFixture()
+
+	require.Equal(
+		[]*core.PeerInfo{p1, origin},
+		limitHandout([]*core.PeerInfo{p1, p2, origin}, 1))
+	require.Equal(
+		[]*core.PeerInfo{p1, p2, origin},
+		limitHandout([]*core.PeerInfo{p1, p2, origin}, 5))
+}
+
+func TestNewRegionMapErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		regions []RegionConfig
+	}{
+		{"missing name", []RegionConfig{{CIDRs: []string{"10.1.0.0/16"}}}},
+		{"duplicate name", []RegionConfig{{Name: "a"}, {Name: "a"}}},
+		{"invalid cidr", []RegionConfig{{Name: "a", CIDRs: []string{"10.1.0.0"}}}},
+		{"invalid gateway", []RegionConfig{{
+			Name: "a", CIDRs: []string{"10.1.0.0/16"}, Gateways: []string{"x"},
+		}}},
+		{"gateway outside region", []RegionConfig{{
+			Name: "a", CIDRs: []string{"10.1.0.0/16"}, Gateways: []string{"10.2.0.1"},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newRegionMap(RegionGatewaysConfig{Enable: true, Regions: test.regions})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestAnnounceOverSamplesPeersWithRegionGateways(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PeerHandoutLimit: 2,
+		RegionGateways: RegionGatewaysConfig{
+			Enable: true,
+			Regions: []RegionConfig{{
+				Name:     "east",
+				CIDRs:    []string{"10.1.0.0/16"},
+				Gateways: []string{"10.1.0.1"},
+			}, {
+				Name:     "west",
+				CIDRs:    []string{"10.2.0.0/16"},
+				Gateways: []string{"10.2.0.1"},
+			}},
+			OverSample: 3,
+		},
+	}
+	mocks, cleanup := newServerMocks(t, config)
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	blob := core.NewBlobFixture()
+	h := blob.MetaInfo.InfoHash()
+
+	pctx := core.PeerContextFixture()
+	pctx.IP = "10.1.0.5"
+
+	east := []*core.PeerInfo{
+		regionPeerFixture("10.1.0.2"), regionPeerFixture("10.1.0.3"), regionPeerFixture("10.1.0.4"),
+	}
+	sample := []*core.PeerInfo{
+		regionPeerFixture("10.2.0.2"), regionPeerFixture("10.2.0.3"), regionPeerFixture("10.2.0.4"),
+	}
+	sample = append(sample, east...)
+
+	mocks.peerStore.EXPECT().UpdatePeer(h, gomock.Any()).Return(nil)
+	mocks.peerStore.EXPECT().GetPeers(h, 6).Return(sample, nil)
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, nil)
+
+	peers, _, err := newAnnounceClient(pctx, addr).Announce(blob.Digest, h, false, nil, 2)
+	require.NoError(err)
+	require.Len(peers, 2)
+	for _, p := range peers {
+		require.Contains([]string{"10.1.0.2", "10.1.0.3", "10.1.0.4"}, p.IP)
+	}
+}
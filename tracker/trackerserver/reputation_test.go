@@ -0,0 +1,139 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackerserver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hashring"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/reputation"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// announceReporter announces a torrent from the local host, such that reports
+// of the returned peer id are accepted.
+func announceReporter(t *testing.T, mocks *serverMocks, addr string) core.PeerID {
+	pctx := core.PeerContextFixture()
+	pctx.IP = "127.0.0.1"
+
+	blob := core.NewBlobFixture()
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil)
+
+	_, _, err := newAnnounceClient(pctx, addr).Announce(
+		blob.Digest, blob.MetaInfo.InfoHash(), true, nil, 2)
+	require.NoError(t, err)
+	return pctx.PeerID
+}
+
+func TestAnnounceExcludesPeersWithBadReputations(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{
+		Reputation: reputation.Config{Enable: true, MinReporters: 2},
+	})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	bad := core.PeerInfoFixture()
+	good := core.PeerInfoFixture()
+
+	reports := reputation.NewClient(hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil)
+	for i := 0; i < 2; i++ {
+		reporter := announceReporter(t, mocks, addr)
+		require.NoError(reports.Report(reputation.NewReport(reporter, []reputation.Score{
+			{PeerID: bad.PeerID, Bad: 4},
+			{PeerID: good.PeerID, Good: 4},
+		}, 0, time.Now())))
+	}
+
+	blob := core.NewBlobFixture()
+	pctx := core.PeerContextFixture()
+
+	mocks.originStore.EXPECT().GetOrigins(blob.Digest).Return(nil, nil).Times(2)
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil).Times(2)
+
+	mocks.peerStore.EXPECT().GetPeers(
+		blob.MetaInfo.InfoHash(), gomock.Any()).Return([]*core.PeerInfo{bad, good}, nil)
+
+	client := newAnnounceClient(pctx, addr)
+	peers, _, err := client.Announce(blob.Digest, blob.MetaInfo.InfoHash(), false, nil, 2)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{good}, peers)
+
+	// Bad peers are handed out if no other peers are available.
+	mocks.peerStore.EXPECT().GetPeers(
+		blob.MetaInfo.InfoHash(), gomock.Any()).Return([]*core.PeerInfo{bad}, nil)
+
+	peers, _, err = client.Announce(blob.Digest, blob.MetaInfo.InfoHash(), false, nil, 2)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{bad}, peers)
+}
+
+func TestReputationHandlerRejectsUnsupportedVersions(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{
+		Reputation: reputation.Config{Enable: true},
+	})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	reports := reputation.NewClient(hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil)
+	err := reports.Report(&reputation.Report{Version: reputation.SchemaVersion + 1})
+	require.True(httputil.IsStatus(err, http.StatusBadRequest))
+}
+
+func TestReputationHandlerRejectsReportersWhichDidNotAnnounce(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t, Config{
+		Reputation: reputation.Config{Enable: true},
+	})
+	defer cleanup()
+
+	addr, stop := testutil.StartServer(mocks.handler())
+	defer stop()
+
+	reports := reputation.NewClient(hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil)
+	scores := []reputation.Score{{PeerID: core.PeerIDFixture(), Bad: 4}}
+
+	err := reports.Report(reputation.NewReport(core.PeerIDFixture(), scores, 0, time.Now()))
+	require.True(httputil.IsForbidden(err))
+
+	// Reporters which announced from another host are rejected as well.
+	pctx := core.PeerContextFixture()
+	blob := core.NewBlobFixture()
+	mocks.peerStore.EXPECT().UpdatePeer(blob.MetaInfo.InfoHash(), gomock.Any()).Return(nil)
+	_, _, err = newAnnounceClient(pctx, addr).Announce(
+		blob.Digest, blob.MetaInfo.InfoHash(), true, nil, 2)
+	require.NoError(err)
+
+	err = reports.Report(reputation.NewReport(pctx.PeerID, scores, 0, time.Now()))
+	require.True(httputil.IsForbidden(err))
+
+	require.NoError(reports.Report(
+		reputation.NewReport(announceReporter(t, mocks, addr), scores, 0, time.Now())))
+}
@@ -14,10 +14,13 @@
 package trackerserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof" // Registers /debug/pprof endpoints in http.DefaultServeMux.
 
+	"github.com/andres-erbsen/clock"
 	"github.com/pressly/chi"
 	chimiddleware "github.com/pressly/chi/middleware"
 	"github.com/uber-go/tally"
@@ -27,6 +30,8 @@ import (
 	"github.com/uber/kraken/tracker/originstore"
 	"github.com/uber/kraken/tracker/peerhandoutpolicy"
 	"github.com/uber/kraken/tracker/peerstore"
+	"github.com/uber/kraken/tracker/reconcile"
+	"github.com/uber/kraken/tracker/reputation"
 	"github.com/uber/kraken/utils/handler"
 	"github.com/uber/kraken/utils/listener"
 	"github.com/uber/kraken/utils/log"
@@ -40,6 +45,15 @@ type Server struct {
 	peerStore   peerstore.Store
 	originStore originstore.Store
 	policy      *peerhandoutpolicy.PriorityPolicy
+	collisions  *collisionDetector
+	inlined     *inlineCache
+	regions     *regionMap
+
+	// reconciles is nil unless reconciliation is enabled.
+	reconciles *reconcile.Puller
+
+	// reputations is nil unless reputation is enabled.
+	reputations *reputation.Store
 
 	originCluster blobclient.ClusterClient
 }
@@ -59,13 +73,41 @@ func New(
 		"module": "trackerserver",
 	})
 
+	regions, err := newRegionMap(config.RegionGateways)
+	if err != nil {
+		log.Errorf("Invalid region gateways config, cross-region handouts unrestricted: %s", err)
+	}
+
+	var reputations *reputation.Store
+	if config.Reputation.Enable {
+		reputations = reputation.NewStore(config.Reputation, clock.New())
+	}
+
+	var reconciles *reconcile.Puller
+	if config.Reconcile.Enable {
+		reconciles, err = reconcile.NewPuller(
+			config.Reconcile,
+			stats,
+			clock.New(),
+			reconcile.NewClient(nil),
+			reconcile.New(config.Reconcile, stats, clock.New(), peerStore))
+		if err != nil {
+			log.Errorf("Invalid reconcile config, reconciliation disabled: %s", err)
+		}
+	}
+
 	return &Server{
 		config:        config,
 		stats:         stats,
 		peerStore:     peerStore,
 		originStore:   originStore,
 		policy:        policy,
+		collisions:    newCollisionDetector(clock.New(), config.PeerIDCollisionWindow),
+		inlined:       newInlineCache(config.InlineBlobs.CacheSize, config.InlineBlobs.CacheBytes),
+		reconciles:    reconciles,
 		originCluster: originCluster,
+		regions:       regions,
+		reputations:   reputations,
 	}
 }
 
@@ -81,6 +123,14 @@ func (s *Server) Handler() http.Handler {
 	r.Post("/announce/{infohash}", handler.Wrap(s.announceHandlerV2))
 	r.Get("/namespace/{namespace}/blobs/{digest}/metainfo", handler.Wrap(s.getMetaInfoHandler))
 
+	// Pulls the seeded info hashes exported by the configured agent at the addr
+	// query arg, and restores any records of the agent missing from the peer
+	// store. Configured agents are also pulled periodically.
+	r.Post("/reconcile", handler.Wrap(s.reconcileHandler))
+
+	// Aggregates the peer reputations reported by an agent.
+	r.Post("/reputation", handler.Wrap(s.reputationHandler))
+
 	r.Mount("/debug", chimiddleware.Profiler())
 
 	return r
@@ -89,10 +139,75 @@ func (s *Server) Handler() http.Handler {
 // ListenAndServe is a blocking call which runs s.
 func (s *Server) ListenAndServe() error {
 	log.Infof("Starting tracker server on %s", s.config.Listener)
+	if s.reconciles != nil {
+		s.reconciles.Start()
+		defer s.reconciles.Stop()
+	}
 	return listener.Serve(s.config.Listener, s.Handler())
 }
 
+func (s *Server) reputationHandler(w http.ResponseWriter, r *http.Request) error {
+	if s.reputations == nil {
+		return handler.Errorf("reputation disabled").Status(http.StatusNotImplemented)
+	}
+	var report reputation.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		return handler.Errorf("decode report: %s", err).Status(http.StatusBadRequest)
+	}
+	if err := report.Validate(); err != nil {
+		return handler.Errorf("invalid report: %s", err).Status(http.StatusBadRequest)
+	}
+	// Reporters are self-declared, so a report is only accepted from the host
+	// which recently announced with the reporter's peer id. Otherwise, a single
+	// host could pose as many reporters and exclude any peer.
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return handler.Errorf("parse remote addr: %s", err)
+	}
+	if !s.collisions.announcedFrom(report.Reporter, ip) {
+		s.stats.Counter("reputation_reports_rejected").Inc(1)
+		return handler.Errorf(
+			"reporter %s has not announced from %s", report.Reporter, ip).Status(http.StatusForbidden)
+	}
+	if err := s.reputations.Add(&report); err != nil {
+		return handler.Errorf("add report: %s", err).Status(http.StatusBadRequest)
+	}
+	s.stats.Counter("reputation_reports").Inc(1)
+	return nil
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) error {
 	fmt.Fprintln(w, "OK")
 	return nil
 }
+
+func (s *Server) reconcileHandler(w http.ResponseWriter, r *http.Request) error {
+	if s.reconciles == nil {
+		return handler.Errorf("reconciliation disabled").Status(http.StatusNotImplemented)
+	}
+	addr := r.URL.Query().Get("addr")
+	if addr == "" {
+		return handler.Errorf("query arg addr required").Status(http.StatusBadRequest)
+	}
+	e, err := s.reconciles.Pull(addr)
+	if err != nil {
+		if err == reconcile.ErrUnknownPeer {
+			return handler.Errorf("%s", err).Status(http.StatusForbidden)
+		}
+		return handler.Errorf("pull export: %s", err).Status(http.StatusBadGateway)
+	}
+	res, err := s.reconciles.Reconcile(addr, e)
+	if err != nil {
+		switch err {
+		case reconcile.ErrUnsigned, reconcile.ErrInvalidSignature, reconcile.ErrPeerMismatch:
+			return handler.Errorf("%s", err).Status(http.StatusForbidden)
+		case reconcile.ErrStaleExport:
+			return handler.Errorf("%s", err).Status(http.StatusConflict)
+		}
+		return handler.Errorf("reconcile: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return handler.Errorf("json encode result: %s", err)
+	}
+	return nil
+}
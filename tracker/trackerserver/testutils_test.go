@@ -48,12 +48,16 @@ func newServerMocks(t *testing.T, config Config) (*serverMocks, func()) {
 	}, ctrl.Finish
 }
 
-func (m *serverMocks) handler() http.Handler {
+func (m *serverMocks) server() *Server {
 	return New(
 		m.config,
 		m.stats,
 		m.policy,
 		m.peerStore,
 		m.originStore,
-		m.originCluster).Handler()
+		m.originCluster)
+}
+
+func (m *serverMocks) handler() http.Handler {
+	return m.server().Handler()
 }
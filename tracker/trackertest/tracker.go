@@ -0,0 +1,255 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pressly/chi"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/peerhandoutpolicy"
+	"github.com/uber/kraken/utils/handler"
+	"github.com/uber/kraken/utils/httputil"
+	"github.com/uber/kraken/utils/testutil"
+)
+
+// Config defines Tracker configuration.
+type Config struct {
+	AnnounceInterval time.Duration
+	PeerHandoutLimit int
+}
+
+func (c Config) applyDefaults() Config {
+	if c.AnnounceInterval == 0 {
+		c.AnnounceInterval = 250 * time.Millisecond
+	}
+	if c.PeerHandoutLimit == 0 {
+		c.PeerHandoutLimit = 50
+	}
+	return c
+}
+
+// Tracker is a lightweight, in-memory tracker for tests and local development.
+// It serves the same announce (v1 and v2) and metainfo endpoints as the
+// production tracker server, but stores all state in memory and serves
+// metainfo which has been explicitly added instead of fetching it from origins.
+// Tracker is thread-safe.
+type Tracker struct {
+	config Config
+	policy *peerhandoutpolicy.PriorityPolicy
+
+	mu        sync.Mutex
+	peers     map[core.InfoHash][]*core.PeerInfo
+	metaInfos map[core.Digest]*core.MetaInfo
+	announces []announceclient.Request
+}
+
+// New creates a new Tracker.
+func New(config Config) *Tracker {
+	return &Tracker{
+		config:    config.applyDefaults(),
+		policy:    peerhandoutpolicy.DefaultPriorityPolicyFixture(),
+		peers:     make(map[core.InfoHash][]*core.PeerInfo),
+		metaInfos: make(map[core.Digest]*core.MetaInfo),
+	}
+}
+
+// Start starts an HTTP server for t on a random local port. Returns the address
+// of the server and a function which stops it.
+func (t *Tracker) Start() (addr string, stop func()) {
+	return testutil.StartServer(t.Handler())
+}
+
+// Handler returns an http handler for t.
+func (t *Tracker) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/health", handler.Wrap(t.healthHandler))
+	r.Get("/announce", handler.Wrap(t.announceHandlerV1))
+	r.Post("/announce/{infohash}", handler.Wrap(t.announceHandlerV2))
+	r.Get("/namespace/{namespace}/blobs/{digest}/metainfo", handler.Wrap(t.getMetaInfoHandler))
+	return r
+}
+
+// AddMetaInfo makes mi available via the metainfo endpoint, in all namespaces.
+func (t *Tracker) AddMetaInfo(mi *core.MetaInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.metaInfos[mi.Digest()] = mi
+}
+
+// AddPeer registers p as a peer of h, as if p had announced.
+func (t *Tracker) AddPeer(h core.InfoHash, p *core.PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.updatePeer(h, p)
+}
+
+// Peers returns copies of all peers which have announced for h, in the order
+// they first announced.
+func (t *Tracker) Peers(h core.InfoHash) []*core.PeerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return copyPeers(t.peers[h])
+}
+
+// Announces returns all announce requests received by t, in the order they
+// were received.
+func (t *Tracker) Announces() []announceclient.Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]announceclient.Request(nil), t.announces...)
+}
+
+// Reset clears all peers and announces. Metainfo is retained.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.peers = make(map[core.InfoHash][]*core.PeerInfo)
+	t.announces = nil
+}
+
+func (t *Tracker) healthHandler(w http.ResponseWriter, r *http.Request) error {
+	fmt.Fprintln(w, "OK")
+	return nil
+}
+
+func (t *Tracker) announceHandlerV1(w http.ResponseWriter, r *http.Request) error {
+	req := new(announceclient.Request)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return handler.Errorf("json decode request: %s", err).Status(http.StatusBadRequest)
+	}
+	return t.serveAnnounce(w, req.InfoHash, req)
+}
+
+func (t *Tracker) announceHandlerV2(w http.ResponseWriter, r *http.Request) error {
+	infohash, err := httputil.ParseParam(r, "infohash")
+	if err != nil {
+		return err
+	}
+	h, err := core.NewInfoHashFromHex(infohash)
+	if err != nil {
+		return handler.Errorf("parse infohash: %s", err).Status(http.StatusBadRequest)
+	}
+	req := new(announceclient.Request)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return handler.Errorf("json decode request: %s", err).Status(http.StatusBadRequest)
+	}
+	return t.serveAnnounce(w, h, req)
+}
+
+func (t *Tracker) serveAnnounce(
+	w http.ResponseWriter, h core.InfoHash, req *announceclient.Request) error {
+
+	if _, err := req.GetDigest(); err != nil {
+		return handler.Errorf("get request digest: %s", err).Status(http.StatusBadRequest)
+	}
+	if req.Peer == nil {
+		return handler.Errorf("no peer in request").Status(http.StatusBadRequest)
+	}
+	resp := t.announce(h, req)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return handler.Errorf("json encode response: %s", err)
+	}
+	return nil
+}
+
+// announce mirrors the production tracker: the announcing peer is upserted and
+// complete peers receive no handout.
+func (t *Tracker) announce(
+	h core.InfoHash, req *announceclient.Request) *announceclient.Response {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.announces = append(t.announces, *req)
+
+	resp := &announceclient.Response{Interval: t.config.AnnounceInterval}
+	if req.Peer.Stopped {
+		t.removePeer(h, req.Peer.PeerID)
+		return resp
+	}
+	t.updatePeer(h, req.Peer)
+	if req.Peer.Complete {
+		return resp
+	}
+	peers := copyPeers(t.peers[h])
+	if len(peers) > t.config.PeerHandoutLimit {
+		peers = peers[:t.config.PeerHandoutLimit]
+	}
+	resp.Peers = t.policy.SortPeers(req.Peer, peers)
+	return resp
+}
+
+func (t *Tracker) removePeer(h core.InfoHash, peerID core.PeerID) {
+	for i, existing := range t.peers[h] {
+		if existing.PeerID == peerID {
+			t.peers[h] = append(t.peers[h][:i], t.peers[h][i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *Tracker) updatePeer(h core.InfoHash, p *core.PeerInfo) {
+	c := new(core.PeerInfo)
+	*c = *p
+	for i, existing := range t.peers[h] {
+		if existing.PeerID == p.PeerID {
+			t.peers[h][i] = c
+			return
+		}
+	}
+	t.peers[h] = append(t.peers[h], c)
+}
+
+func (t *Tracker) getMetaInfoHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := httputil.ParseDigest(r, "digest")
+	if err != nil {
+		return handler.Errorf("parse digest: %s", err).Status(http.StatusBadRequest)
+	}
+
+	t.mu.Lock()
+	mi, ok := t.metaInfos[d]
+	t.mu.Unlock()
+
+	if !ok {
+		return handler.ErrorStatus(http.StatusNotFound)
+	}
+	b, err := mi.Serialize()
+	if err != nil {
+		return fmt.Errorf("serialize metainfo: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func copyPeers(peers []*core.PeerInfo) []*core.PeerInfo {
+	copies := make([]*core.PeerInfo, len(peers))
+	for i, p := range peers {
+		copies[i] = new(core.PeerInfo)
+		*copies[i] = *p
+	}
+	return copies
+}
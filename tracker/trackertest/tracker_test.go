@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package trackertest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/hashring"
+	"github.com/uber/kraken/lib/hostlist"
+	"github.com/uber/kraken/tracker/announceclient"
+	"github.com/uber/kraken/tracker/metainfoclient"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestTrackerAnnounce(t *testing.T) {
+	for _, version := range []int{announceclient.V1, announceclient.V2} {
+		t.Run(fmt.Sprintf("V%d", version), func(t *testing.T) {
+			require := require.New(t)
+
+			tr := New(Config{})
+			addr, stop := tr.Start()
+			defer stop()
+
+			ring := hashring.NoopPassiveRing(hostlist.Fixture(addr))
+			blob := core.NewBlobFixture()
+			d, h := blob.Digest, blob.MetaInfo.InfoHash()
+
+			seeder := core.PeerContextFixture()
+			_, interval, err := announceclient.New(seeder, ring, nil).Announce(d, h, true, nil, version)
+			require.NoError(err)
+			require.Equal(tr.config.AnnounceInterval, interval)
+
+			leecher := core.PeerContextFixture()
+			have := core.NewPieceRanges(bitsetutil.FromBools(true, false, true))
+			peers, _, err := announceclient.New(leecher, ring, nil).Announce(d, h, false, have, version)
+			require.NoError(err)
+			require.Len(peers, 2)
+
+			var ids []core.PeerID
+			for _, p := range peers {
+				ids = append(ids, p.PeerID)
+			}
+			require.ElementsMatch([]core.PeerID{seeder.PeerID, leecher.PeerID}, ids)
+
+			stored := tr.Peers(h)
+			require.Len(stored, 2)
+			require.True(stored[0].Complete)
+			require.Equal(have, stored[1].HaveRanges)
+
+			require.Len(tr.Announces(), 2)
+		})
+	}
+}
+
+func TestTrackerMetaInfo(t *testing.T) {
+	require := require.New(t)
+
+	tr := New(Config{})
+	addr, stop := tr.Start()
+	defer stop()
+
+	client := metainfoclient.New(hashring.NoopPassiveRing(hostlist.Fixture(addr)), nil)
+
+	blob := core.NewBlobFixture()
+
+	_, err := client.Download(context.Background(), "some-namespace", blob.Digest)
+	require.Equal(metainfoclient.ErrNotFound, err)
+
+	tr.AddMetaInfo(blob.MetaInfo)
+
+	mi, err := client.Download(context.Background(), "some-namespace", blob.Digest)
+	require.NoError(err)
+	require.Equal(blob.MetaInfo.InfoHash(), mi.InfoHash())
+}
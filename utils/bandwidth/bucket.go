@@ -0,0 +1,150 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bandwidth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+)
+
+// ErrReservationCancelled occurs when a Bucket reservation is abandoned before
+// its bytes became available.
+var ErrReservationCancelled = errors.New("reservation cancelled")
+
+// Bucket is a token-bucket which limits a single stream, e.g. the ingress of
+// one torrent, to a number of bytes per second independently of the Limiter.
+// The rate may be adjusted at runtime, and applies to all reservations made
+// after the adjustment.
+//
+// Reservations beyond the available tokens put the Bucket into debt, which
+// later reservations wait for, such that payloads larger than the rate are
+// delayed instead of rejected.
+type Bucket struct {
+	clk clock.Clock
+
+	mu     sync.Mutex
+	rate   int64 // Bytes per second, or 0 if unlimited.
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a new Bucket limited to bytesPerSec. A non-positive
+// bytesPerSec leaves the Bucket unlimited.
+func NewBucket(bytesPerSec int64, clk clock.Clock) *Bucket {
+	b := &Bucket{clk: clk, last: clk.Now()}
+	b.setRate(bytesPerSec)
+	return b
+}
+
+// refill adds the tokens accumulated since the last refill. Bursts are capped
+// at one second worth of tokens, such that an idle stream cannot exceed its
+// rate for long. Must be called with b.mu held.
+func (b *Bucket) refill() {
+	now := b.clk.Now()
+	if b.rate > 0 {
+		b.tokens += float64(b.rate) * now.Sub(b.last).Seconds()
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+// setRate must be called with b.mu held, after refilling b.
+func (b *Bucket) setRate(bytesPerSec int64) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	if b.rate == 0 {
+		// Unlimited buckets accumulate no tokens, so they start from a full
+		// burst once limited.
+		b.tokens = float64(bytesPerSec)
+	} else if b.tokens > float64(bytesPerSec) {
+		b.tokens = float64(bytesPerSec)
+	}
+	b.rate = bytesPerSec
+}
+
+// SetRate sets the limit of b to bytesPerSec. A non-positive bytesPerSec
+// lifts the limit. Tokens accumulated at the previous rate are kept, up to the
+// burst of the new rate, as is any debt. Reservations already waiting on b
+// keep their delay.
+func (b *Bucket) SetRate(bytesPerSec int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.setRate(bytesPerSec)
+}
+
+// Rate returns the current limit of b in bytes per second, or 0 if b is
+// unlimited.
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate
+}
+
+// Reserve blocks until nbytes are available in b, or done is closed. If done
+// is closed first, the reservation is returned to b and
+// ErrReservationCancelled is returned.
+func (b *Bucket) Reserve(done <-chan struct{}, nbytes int64) error {
+	delay := b.reserve(nbytes)
+	if delay <= 0 {
+		return nil
+	}
+	t := b.clk.Timer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-done:
+		b.refund(nbytes)
+		return ErrReservationCancelled
+	}
+}
+
+// reserve takes nbytes from b, and returns how long until they are available.
+func (b *Bucket) reserve(nbytes int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill()
+	b.tokens -= float64(nbytes)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+func (b *Bucket) refund(nbytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return
+	}
+	b.refill()
+	b.tokens += float64(nbytes)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketUnlimited(t *testing.T) {
+	require := require.New(t)
+
+	b := NewBucket(0, clock.NewMock())
+	require.Equal(int64(0), b.Rate())
+	require.Equal(time.Duration(0), b.reserve(1<<30))
+}
+
+func TestBucketDelaysReservationsBeyondRate(t *testing.T) {
+	require := require.New(t)
+
+	b := NewBucket(100, clock.NewMock())
+	require.Equal(int64(100), b.Rate())
+
+	// The first 100 bytes are covered by the initial burst, the remaining 150
+	// bytes take 1.5 seconds to accumulate.
+	require.Equal(1500*time.Millisecond, b.reserve(250))
+}
+
+func TestBucketSetRate(t *testing.T) {
+	require := require.New(t)
+
+	b := NewBucket(100, clock.NewMock())
+	require.Equal(time.Duration(0), b.reserve(100))
+
+	b.SetRate(0)
+	require.Equal(int64(0), b.Rate())
+	require.Equal(time.Duration(0), b.reserve(1000))
+
+	// Limiting an unlimited bucket starts from a full burst at the new rate.
+	b.SetRate(1000)
+	require.Equal(int64(1000), b.Rate())
+	require.Equal(time.Second, b.reserve(2000))
+}
+
+func TestBucketSetRateKeepsAccumulatedTokens(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	b := NewBucket(100, clk)
+	require.Equal(time.Duration(0), b.reserve(100))
+
+	clk.Add(500 * time.Millisecond)
+
+	// The 50 bytes accumulated at the previous rate are kept.
+	b.SetRate(1000)
+	require.Equal(time.Duration(0), b.reserve(50))
+	require.Equal(100*time.Millisecond, b.reserve(100))
+
+	// Debt is kept as well, and accumulated tokens are capped to the burst of
+	// the new rate.
+	b.SetRate(100)
+	require.Equal(2*time.Second, b.reserve(100))
+}
+
+func TestBucketReserveCancelled(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	b := NewBucket(100, clk)
+
+	require.NoError(b.Reserve(nil, 100))
+
+	done := make(chan struct{})
+	close(done)
+	require.Equal(ErrReservationCancelled, b.Reserve(done, 100))
+
+	// Cancelled reservations are returned to the bucket.
+	clk.Add(time.Second)
+	require.Equal(time.Duration(0), b.reserve(100))
+}
+
+func TestBucketReserveWaitsForClock(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	b := NewBucket(100, clk)
+	require.Equal(time.Duration(0), b.reserve(100))
+
+	errc := make(chan error)
+	go func() { errc <- b.Reserve(nil, 100) }()
+
+	select {
+	case <-errc:
+		require.FailNow("Reserve returned before the bucket refilled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Add(time.Second)
+	require.NoError(<-errc)
+}
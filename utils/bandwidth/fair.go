@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bandwidth
+
+import (
+	"sync"
+
+	"github.com/uber/kraken/utils/heap"
+)
+
+// fairQueue grants turns to reserve egress bandwidth via weighted fair
+// queueing. Each reservation is tagged with a virtual finish time, i.e. the
+// cumulative bytes of its flow scaled by the flow's weight, and waiting
+// reservations are granted in order of lowest tag. As such, a flow which
+// reserves greedily is only granted its weighted share of the budget while
+// other flows are waiting.
+type fairQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	vtime   int
+	waiters *heap.PriorityQueue
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{waiters: heap.NewPriorityQueue()}
+}
+
+// acquire blocks until f is granted a turn for nbytes. Must be followed by
+// release.
+func (q *fairQueue) acquire(f *Flow, nbytes int64, weight float64) {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	q.mu.Lock()
+	start := f.finish
+	if q.vtime > start {
+		start = q.vtime
+	}
+	tag := start + int(float64(nbytes)/weight)
+	f.finish = tag
+	if !q.busy {
+		q.busy = true
+		q.vtime = tag
+		q.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	q.waiters.Push(&heap.Item{Value: ready, Priority: tag})
+	q.mu.Unlock()
+
+	<-ready
+}
+
+// release passes the turn to the waiter with the lowest tag.
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, err := q.waiters.Pop()
+	if err != nil {
+		q.busy = false
+		return
+	}
+	q.vtime = item.Priority
+	close(item.Value.(chan struct{}))
+}
+
+// Flow is a stream of egress reservations, e.g. the uploads of a single
+// connection, which is scheduled fairly against all other flows of the same
+// Limiter.
+type Flow struct {
+	l *Limiter
+
+	// finish is the virtual finish time of the last reservation of the flow.
+	// Protected by l.fair.mu.
+	finish int
+}
+
+// NewFlow creates a new Flow which reserves egress bandwidth from l.
+func (l *Limiter) NewFlow() *Flow {
+	return &Flow{l: l}
+}
+
+// ReserveEgress blocks until egress bandwidth for nbytes is available and it
+// is the turn of f. Flows with higher weight are granted proportionally more
+// bandwidth than other flows while contended.
+func (f *Flow) ReserveEgress(nbytes int64, weight float64) error {
+	if !f.l.config.Enable {
+		return f.l.ReserveEgress(nbytes)
+	}
+	f.l.fair.acquire(f, nbytes, weight)
+	defer f.l.fair.release()
+
+	return f.l.ReserveEgress(nbytes)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForWaiters(t *testing.T, q *fairQueue, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		l := q.waiters.Len()
+		q.mu.Unlock()
+		if l == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d waiters", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueueGrantsLowestTagFirst(t *testing.T) {
+	require := require.New(t)
+
+	l, err := NewLimiter(Config{})
+	require.NoError(err)
+	q := newFairQueue()
+
+	greedy := l.NewFlow()
+	light := l.NewFlow()
+	heavy := l.NewFlow()
+
+	// Greedy flow holds the turn and has already queued a large reservation.
+	q.acquire(greedy, 100, 1)
+
+	order := make(chan *Flow, 3)
+	enqueue := func(f *Flow, nbytes int64, weight float64, waiters int) {
+		go func() {
+			q.acquire(f, nbytes, weight)
+			order <- f
+			q.release()
+		}()
+		waitForWaiters(t, q, waiters)
+	}
+	enqueue(greedy, 100, 1, 1)
+	enqueue(light, 50, 1, 2)
+	enqueue(heavy, 100, 4, 3)
+
+	q.release()
+
+	// The greedy flow must wait behind the other flows, and the heavier
+	// weighted flow is served first.
+	require.Equal(heavy, <-order)
+	require.Equal(light, <-order)
+	require.Equal(greedy, <-order)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	require.False(q.busy)
+}
+
+func TestFlowReserveEgressCountsBytes(t *testing.T) {
+	require := require.New(t)
+
+	l, err := NewLimiter(Config{
+		EgressBitsPerSec:  800,
+		IngressBitsPerSec: 800,
+		TokenSize:         1,
+		Enable:            true,
+	})
+	require.NoError(err)
+
+	f := l.NewFlow()
+	require.NoError(f.ReserveEgress(10, 1))
+	require.NoError(f.ReserveEgress(10, 2))
+	require.Equal(int64(20), l.EgressBytes())
+}
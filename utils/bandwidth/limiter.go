@@ -21,6 +21,7 @@ import (
 	"github.com/uber/kraken/utils/log"
 	"github.com/uber/kraken/utils/memsize"
 
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
@@ -51,6 +52,12 @@ type Limiter struct {
 	egress  *rate.Limiter
 	ingress *rate.Limiter
 	logger  *zap.SugaredLogger
+
+	fair *fairQueue
+
+	// Total bytes reserved, regardless of whether limits are enabled.
+	egressBytes  *atomic.Int64
+	ingressBytes *atomic.Int64
 }
 
 // Option allows setting optional parameters in Limiter.
@@ -66,8 +73,11 @@ func NewLimiter(config Config, opts ...Option) (*Limiter, error) {
 	config = config.applyDefaults()
 
 	l := &Limiter{
-		config: config,
-		logger: log.Default(),
+		config:       config,
+		logger:       log.Default(),
+		fair:         newFairQueue(),
+		egressBytes:  atomic.NewInt64(0),
+		ingressBytes: atomic.NewInt64(0),
 	}
 	for _, opt := range opts {
 		opt(l)
@@ -97,8 +107,9 @@ func NewLimiter(config Config, opts ...Option) (*Limiter, error) {
 	return l, nil
 }
 
-func (l *Limiter) reserve(rl *rate.Limiter, nbytes int64) error {
+func (l *Limiter) reserve(rl *rate.Limiter, total *atomic.Int64, nbytes int64) error {
 	if !l.config.Enable {
+		total.Add(nbytes)
 		return nil
 	}
 	tokens := int(uint64(nbytes*8) / l.config.TokenSize)
@@ -113,19 +124,20 @@ func (l *Limiter) reserve(rl *rate.Limiter, nbytes int64) error {
 			memsize.BitFormat(l.config.TokenSize*uint64(rl.Burst())))
 	}
 	time.Sleep(r.Delay())
+	total.Add(nbytes)
 	return nil
 }
 
 // ReserveEgress blocks until egress bandwidth for nbytes is available.
 // Returns error if nbytes is larger than the maximum egress bandwidth.
 func (l *Limiter) ReserveEgress(nbytes int64) error {
-	return l.reserve(l.egress, nbytes)
+	return l.reserve(l.egress, l.egressBytes, nbytes)
 }
 
 // ReserveIngress blocks until ingress bandwidth for nbytes is available.
 // Returns error if nbytes is larger than the maximum ingress bandwidth.
 func (l *Limiter) ReserveIngress(nbytes int64) error {
-	return l.reserve(l.ingress, nbytes)
+	return l.reserve(l.ingress, l.ingressBytes, nbytes)
 }
 
 // Adjust divides the originally configured egress and ingress bps by denominator.
@@ -145,6 +157,35 @@ func (l *Limiter) Adjust(denominator int) error {
 	return nil
 }
 
+// MaxEgressReservation returns the largest nbytes which ReserveEgress accepts,
+// or 0 if limits are disabled.
+func (l *Limiter) MaxEgressReservation() int64 {
+	return l.maxReservation(l.egress)
+}
+
+// MaxIngressReservation returns the largest nbytes which ReserveIngress
+// accepts, or 0 if limits are disabled.
+func (l *Limiter) MaxIngressReservation() int64 {
+	return l.maxReservation(l.ingress)
+}
+
+func (l *Limiter) maxReservation(rl *rate.Limiter) int64 {
+	if !l.config.Enable {
+		return 0
+	}
+	return int64(uint64(rl.Burst()) * l.config.TokenSize / 8)
+}
+
+// EgressBytes returns the total bytes reserved for egress.
+func (l *Limiter) EgressBytes() int64 {
+	return l.egressBytes.Load()
+}
+
+// IngressBytes returns the total bytes reserved for ingress.
+func (l *Limiter) IngressBytes() int64 {
+	return l.ingressBytes.Load()
+}
+
 // EgressLimit returns the current egress limit.
 func (l *Limiter) EgressLimit() int64 {
 	return int64(l.egress.Limit())
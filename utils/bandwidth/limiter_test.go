@@ -71,6 +71,11 @@ func TestLimiterDisabled(t *testing.T) {
 	require.Nil(l.ingress)
 	require.NoError(reserve(l, 1, egress))
 	require.NoError(reserve(l, 1, ingress))
+	require.NoError(reserve(l, 2, ingress))
+
+	// Usage is tracked even if limits are disabled.
+	require.Equal(int64(1), l.EgressBytes())
+	require.Equal(int64(3), l.IngressBytes())
 }
 
 func TestLimiterReserveConcurrency(t *testing.T) {
@@ -208,6 +213,27 @@ func TestLimiterReserveErrorWhenBytesLargerThanBucket(t *testing.T) {
 	}
 }
 
+func TestLimiterMaxReservation(t *testing.T) {
+	require := require.New(t)
+
+	l, err := NewLimiter(Config{
+		EgressBitsPerSec:  800, // 100 bytes.
+		IngressBitsPerSec: 80,  // 10 bytes.
+		TokenSize:         8,
+		Enable:            true,
+	})
+	require.NoError(err)
+	require.Equal(int64(100), l.MaxEgressReservation())
+	require.Equal(int64(10), l.MaxIngressReservation())
+	require.NoError(reserve(l, l.MaxEgressReservation(), egress))
+	require.Error(reserve(l, l.MaxEgressReservation()+1, egress))
+
+	l, err = NewLimiter(Config{Enable: false})
+	require.NoError(err)
+	require.Equal(int64(0), l.MaxEgressReservation())
+	require.Equal(int64(0), l.MaxIngressReservation())
+}
+
 func TestLimiterAdjustError(t *testing.T) {
 	require := require.New(t)
 
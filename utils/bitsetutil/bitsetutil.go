@@ -13,7 +13,11 @@
 // limitations under the License.
 package bitsetutil
 
-import "github.com/willf/bitset"
+import (
+	"math/bits"
+
+	"github.com/willf/bitset"
+)
 
 // FromBools returns a new BitSet from the given bools.
 func FromBools(bs ...bool) *bitset.BitSet {
@@ -23,3 +27,38 @@ func FromBools(bs ...bool) *bitset.BitSet {
 	}
 	return s
 }
+
+// CountRange returns the number of set bits in b within [start, end), using
+// popcount on whole words where possible.
+func CountRange(b *bitset.BitSet, start, end uint) uint {
+	if end > b.Len() {
+		end = b.Len()
+	}
+	if start >= end {
+		return 0
+	}
+	words := b.Bytes()
+	first, last := start/64, (end-1)/64
+	var n int
+	for w := first; w <= last; w++ {
+		word := words[w]
+		if w == first {
+			word &= ^uint64(0) << (start % 64)
+		}
+		if w == last && end%64 != 0 {
+			word &= ^uint64(0) >> (64 - end%64)
+		}
+		n += bits.OnesCount64(word)
+	}
+	return uint(n)
+}
+
+// ForEachSet calls f with the index of each set bit in b, in increasing order,
+// until f returns false.
+func ForEachSet(b *bitset.BitSet, f func(i uint) bool) {
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		if !f(i) {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bitsetutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/willf/bitset"
+)
+
+func TestCountRange(t *testing.T) {
+	b := bitset.New(200)
+	for _, i := range []uint{0, 3, 63, 64, 65, 127, 128, 199} {
+		b.Set(i)
+	}
+	tests := []struct {
+		desc       string
+		start, end uint
+		expected   uint
+	}{
+		{"all", 0, 200, 8},
+		{"empty range", 10, 10, 0},
+		{"inverted range", 10, 5, 0},
+		{"within word", 1, 63, 1},
+		{"word boundary", 63, 65, 2},
+		{"spans words", 3, 129, 6},
+		{"end past length", 128, 500, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, CountRange(b, test.start, test.end))
+		})
+	}
+}
+
+func TestForEachSet(t *testing.T) {
+	require := require.New(t)
+
+	b := FromBools(false, true, true, false, true)
+
+	var all []uint
+	ForEachSet(b, func(i uint) bool {
+		all = append(all, i)
+		return true
+	})
+	require.Equal([]uint{1, 2, 4}, all)
+
+	var first []uint
+	ForEachSet(b, func(i uint) bool {
+		first = append(first, i)
+		return false
+	})
+	require.Equal([]uint{1}, first)
+}
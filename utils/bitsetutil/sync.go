@@ -0,0 +1,149 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package bitsetutil
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/willf/bitset"
+)
+
+// SyncBitSet is a packed bitset which is safe for concurrent use.
+type SyncBitSet struct {
+	sync.RWMutex
+	b *bitset.BitSet
+}
+
+// NewSyncBitSet creates a new SyncBitSet initialized with a copy of b.
+func NewSyncBitSet(b *bitset.BitSet) *SyncBitSet {
+	return &SyncBitSet{
+		b: b.Clone(),
+	}
+}
+
+// Copy returns a copy of the underlying bitset.
+func (s *SyncBitSet) Copy() *bitset.BitSet {
+	s.RLock()
+	defer s.RUnlock()
+
+	b := &bitset.BitSet{}
+	s.b.Copy(b)
+	return b
+}
+
+// Intersection returns the intersection of s and other.
+func (s *SyncBitSet) Intersection(other *bitset.BitSet) *bitset.BitSet {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.b.Intersection(other)
+}
+
+// Len returns the number of bits in s.
+func (s *SyncBitSet) Len() uint {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.b.Len()
+}
+
+// Has returns whether bit i is set.
+func (s *SyncBitSet) Has(i uint) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.b.Test(i)
+}
+
+// Complete returns whether all bits are set.
+func (s *SyncBitSet) Complete() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.b.All()
+}
+
+// Count returns the number of set bits.
+func (s *SyncBitSet) Count() uint {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.b.Count()
+}
+
+// CountRange returns the number of set bits within [start, end).
+func (s *SyncBitSet) CountRange(start, end uint) uint {
+	s.RLock()
+	defer s.RUnlock()
+
+	return CountRange(s.b, start, end)
+}
+
+// Set sets bit i to v.
+func (s *SyncBitSet) Set(i uint, v bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.b.SetTo(i, v)
+}
+
+// SetAll sets all bits to v.
+func (s *SyncBitSet) SetAll(v bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if v {
+		s.b = bitset.New(s.b.Len()).Complement()
+	} else {
+		s.b.ClearAll()
+	}
+}
+
+// ForEachSet calls f with the index of each set bit, in increasing order, until
+// f returns false. f must not modify s.
+func (s *SyncBitSet) ForEachSet(f func(i uint) bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ForEachSet(s.b, f)
+}
+
+// GetAllSet returns the indices of all set bits in the bitset.
+func (s *SyncBitSet) GetAllSet() []uint {
+	s.RLock()
+	defer s.RUnlock()
+
+	all := make([]uint, 0, s.b.Count())
+	ForEachSet(s.b, func(i uint) bool {
+		all = append(all, i)
+		return true
+	})
+	return all
+}
+
+func (s *SyncBitSet) String() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	var buf bytes.Buffer
+	for i := uint(0); i < s.b.Len(); i++ {
+		if s.b.Test(i) {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	return buf.String()
+}
@@ -11,20 +11,18 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-package dispatch
+package bitsetutil
 
 import (
 	"testing"
 
-	"github.com/uber/kraken/utils/bitsetutil"
-
 	"github.com/stretchr/testify/require"
 )
 
-func TestSyncBitfieldDuplicateSetDoesNotDoubleCount(t *testing.T) {
+func TestSyncBitSetDuplicateSetDoesNotDoubleCount(t *testing.T) {
 	require := require.New(t)
 
-	b := newSyncBitfield(bitsetutil.FromBools(false, false))
+	b := NewSyncBitSet(FromBools(false, false))
 	require.False(b.Complete())
 
 	b.Set(0, true)
@@ -44,16 +42,33 @@ func TestSyncBitfieldDuplicateSetDoesNotDoubleCount(t *testing.T) {
 	require.True(b.Complete())
 }
 
-func TestSyncBitfieldNewCountsNumComplete(t *testing.T) {
+func TestSyncBitSetNewCountsNumComplete(t *testing.T) {
 	require := require.New(t)
 
-	b := newSyncBitfield(bitsetutil.FromBools(true, true, true))
+	b := NewSyncBitSet(FromBools(true, true, true))
 	require.True(b.Complete())
 }
 
-func TestSyncBitfieldString(t *testing.T) {
+func TestSyncBitSetString(t *testing.T) {
 	require := require.New(t)
 
-	b := newSyncBitfield(bitsetutil.FromBools(true, false, true, false))
+	b := NewSyncBitSet(FromBools(true, false, true, false))
 	require.Equal("1010", b.String())
 }
+
+func TestSyncBitSetCount(t *testing.T) {
+	require := require.New(t)
+
+	b := NewSyncBitSet(FromBools(true, false, true, true))
+	require.Equal(uint(3), b.Count())
+	require.Equal(uint(2), b.CountRange(1, 4))
+	require.Equal([]uint{0, 2, 3}, b.GetAllSet())
+
+	b.SetAll(true)
+	require.Equal(uint(4), b.Count())
+	require.True(b.Complete())
+
+	b.SetAll(false)
+	require.Equal(uint(0), b.Count())
+	require.Empty(b.GetAllSet())
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dnscache
+
+import "time"
+
+// Config defines Resolver configuration.
+type Config struct {
+	// TTL is the duration a successful lookup is cached for.
+	TTL time.Duration `yaml:"ttl"`
+
+	// NegativeTTL is the duration a failed lookup is cached for, such that
+	// repeated dials to a broken hostname do not hammer the resolver.
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+
+	// LookupTimeout bounds each lookup issued to the system resolver.
+	LookupTimeout time.Duration `yaml:"lookup_timeout"`
+
+	// Disabled bypasses the cache, resolving every lookup.
+	Disabled bool `yaml:"disabled"`
+}
+
+func (c Config) applyDefaults() Config {
+	if c.TTL == 0 {
+		c.TTL = time.Minute
+	}
+	if c.NegativeTTL == 0 {
+		c.NegativeTTL = 5 * time.Second
+	}
+	if c.LookupTimeout == 0 {
+		c.LookupTimeout = 5 * time.Second
+	}
+	return c
+}
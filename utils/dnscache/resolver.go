@@ -0,0 +1,175 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+)
+
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+type entry struct {
+	addrs     []string
+	err       error
+	expiresAt time.Time
+}
+
+// Resolver resolves hostnames, caching both successful and failed lookups.
+// Resolver is safe for concurrent use.
+type Resolver struct {
+	config Config
+	stats  tally.Scope
+	clk    clock.Clock
+	lookup lookupFunc
+	dialer *net.Dialer
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// Option allows setting optional parameters in Resolver.
+type Option func(*Resolver)
+
+// WithClock configures a Resolver with a custom clock.
+func WithClock(clk clock.Clock) Option {
+	return func(r *Resolver) { r.clk = clk }
+}
+
+func withLookup(f lookupFunc) Option {
+	return func(r *Resolver) { r.lookup = f }
+}
+
+// New creates a new Resolver.
+func New(config Config, stats tally.Scope, opts ...Option) *Resolver {
+	config = config.applyDefaults()
+
+	stats = stats.Tagged(map[string]string{
+		"module": "dnscache",
+	})
+
+	r := &Resolver{
+		config:  config,
+		stats:   stats,
+		clk:     clock.New(),
+		lookup:  net.DefaultResolver.LookupHost,
+		dialer:  &net.Dialer{},
+		entries: make(map[string]entry),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// LookupHost returns the addresses of host. Cached results are returned until
+// they expire, including failures. Lookups which fail because ctx is done are
+// not cached, and return ctx.Err().
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if !r.config.Disabled {
+		r.mu.Lock()
+		e, ok := r.entries[host]
+		r.mu.Unlock()
+		if ok && r.clk.Now().Before(e.expiresAt) {
+			if e.err != nil {
+				r.stats.Counter("negative_hits").Inc(1)
+			} else {
+				r.stats.Counter("hits").Inc(1)
+			}
+			return e.addrs, e.err
+		}
+		r.stats.Counter("misses").Inc(1)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, r.config.LookupTimeout)
+	defer cancel()
+
+	start := r.clk.Now()
+	addrs, err := r.lookup(ctx, host)
+	r.stats.Timer("lookup_latency").Record(r.clk.Now().Sub(start))
+	if err != nil && parent.Err() != nil {
+		// The caller gave up, which says nothing about host.
+		return nil, parent.Err()
+	}
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses found")
+	}
+
+	ttl := r.config.TTL
+	if err != nil {
+		r.stats.Counter("lookup_errors").Inc(1)
+		err = fmt.Errorf("lookup %s: %s", host, err)
+		addrs = nil
+		ttl = r.config.NegativeTTL
+	}
+	if !r.config.Disabled {
+		r.mu.Lock()
+		r.entries[host] = entry{addrs, err, r.clk.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, err
+}
+
+// Len returns the number of cached lookups, including expired ones which have
+// not been refreshed yet.
+func (r *Resolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// DialFunc opens a network connection to addr.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext connects to addr, resolving its host through the cache. Each
+// resolved address is tried in order until one succeeds. Suitable for use as
+// http.Transport.DialContext.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.WrapDial(r.dialer.DialContext)(ctx, network, addr)
+}
+
+// WrapDial returns a DialFunc which resolves the host of addr through the
+// cache before connecting to the resolved addresses with dial.
+func (r *Resolver) WrapDial(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			var nc net.Conn
+			nc, err = dial(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return nc, nil
+			}
+		}
+		return nil, err
+	}
+}
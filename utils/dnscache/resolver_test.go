@@ -0,0 +1,132 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+type lookupFixture struct {
+	calls int
+	addrs []string
+	err   error
+}
+
+func (f *lookupFixture) lookup(ctx context.Context, host string) ([]string, error) {
+	f.calls++
+	return f.addrs, f.err
+}
+
+func TestLookupHostCachesUntilTTL(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	f := &lookupFixture{addrs: []string{"10.0.0.1"}}
+	r := New(Config{TTL: time.Minute}, tally.NoopScope, WithClock(clk), withLookup(f.lookup))
+
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupHost(context.Background(), "tracker")
+		require.NoError(err)
+		require.Equal([]string{"10.0.0.1"}, addrs)
+	}
+	require.Equal(1, f.calls)
+
+	clk.Add(time.Minute)
+
+	_, err := r.LookupHost(context.Background(), "tracker")
+	require.NoError(err)
+	require.Equal(2, f.calls)
+}
+
+func TestLookupHostNegativeCaching(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	f := &lookupFixture{err: errors.New("some error")}
+	r := New(Config{NegativeTTL: time.Second}, tally.NoopScope, WithClock(clk), withLookup(f.lookup))
+
+	_, err := r.LookupHost(context.Background(), "tracker")
+	require.Error(err)
+	_, err = r.LookupHost(context.Background(), "tracker")
+	require.Error(err)
+	require.Equal(1, f.calls)
+
+	clk.Add(time.Second)
+	f.err = nil
+	f.addrs = []string{"10.0.0.1"}
+
+	addrs, err := r.LookupHost(context.Background(), "tracker")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.1"}, addrs)
+	require.Equal(2, f.calls)
+}
+
+func TestLookupHostDoesNotCacheCancelledLookups(t *testing.T) {
+	require := require.New(t)
+
+	f := &lookupFixture{err: errors.New("operation was canceled")}
+	r := New(Config{}, tally.NoopScope, withLookup(f.lookup))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := r.LookupHost(ctx, "tracker")
+	require.Equal(context.Canceled, err)
+
+	f.err = nil
+	f.addrs = []string{"10.0.0.1"}
+
+	addrs, err := r.LookupHost(context.Background(), "tracker")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.1"}, addrs)
+	require.Equal(2, f.calls)
+}
+
+func TestLookupHostSkipsIPs(t *testing.T) {
+	require := require.New(t)
+
+	f := &lookupFixture{}
+	r := New(Config{}, tally.NoopScope, withLookup(f.lookup))
+
+	addrs, err := r.LookupHost(context.Background(), "127.0.0.1")
+	require.NoError(err)
+	require.Equal([]string{"127.0.0.1"}, addrs)
+	require.Equal(0, f.calls)
+}
+
+func TestDialContextUsesCachedAddrs(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(err)
+
+	f := &lookupFixture{addrs: []string{"127.0.0.1"}}
+	r := New(Config{}, tally.NoopScope, withLookup(f.lookup))
+
+	nc, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("some-host", port))
+	require.NoError(err)
+	nc.Close()
+	require.Equal(1, f.calls)
+}